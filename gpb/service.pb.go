@@ -0,0 +1,659 @@
+// Code generated by protoc-gen-gogo.
+// source: service.proto
+// DO NOT EDIT!
+
+/*
+	Package gpb is a generated protocol buffer package.
+
+	It is generated from these files:
+		service.proto
+
+	It has these top-level messages:
+*/
+package gpb
+
+import proto "github.com/gogo/protobuf/proto"
+import fmt "fmt"
+import math "math"
+import spb "github.com/nats-io/nats-streaming-server/spb"
+
+import (
+	context "golang.org/x/net/context"
+	grpc "google.golang.org/grpc"
+)
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ = proto.Marshal
+var _ = fmt.Errorf
+var _ = math.Inf
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ context.Context
+var _ grpc.ClientConn
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+const _ = grpc.SupportPackageIsVersion4
+
+// Client API for Admin service
+
+type AdminClient interface {
+	Clients(ctx context.Context, in *spb.AdminClientsRequest, opts ...grpc.CallOption) (*spb.AdminClientsResponse, error)
+	CloseClient(ctx context.Context, in *spb.AdminCloseClientRequest, opts ...grpc.CallOption) (*spb.AdminCloseClientResponse, error)
+	Channels(ctx context.Context, in *spb.AdminChannelsRequest, opts ...grpc.CallOption) (*spb.AdminChannelsResponse, error)
+	CreateChannel(ctx context.Context, in *spb.AdminCreateChannelRequest, opts ...grpc.CallOption) (*spb.AdminCreateChannelResponse, error)
+	PurgeChannel(ctx context.Context, in *spb.AdminPurgeChannelRequest, opts ...grpc.CallOption) (*spb.AdminPurgeChannelResponse, error)
+	Limits(ctx context.Context, in *spb.AdminLimitsRequest, opts ...grpc.CallOption) (*spb.AdminLimitsResponse, error)
+	Durables(ctx context.Context, in *spb.AdminDurablesRequest, opts ...grpc.CallOption) (*spb.AdminDurablesResponse, error)
+	Queues(ctx context.Context, in *spb.AdminQueuesRequest, opts ...grpc.CallOption) (*spb.AdminQueuesResponse, error)
+	DeleteDurable(ctx context.Context, in *spb.AdminDeleteDurableRequest, opts ...grpc.CallOption) (*spb.AdminDeleteDurableResponse, error)
+	RewindDurable(ctx context.Context, in *spb.AdminRewindDurableRequest, opts ...grpc.CallOption) (*spb.AdminRewindDurableResponse, error)
+	ExportDurable(ctx context.Context, in *spb.AdminExportDurableRequest, opts ...grpc.CallOption) (*spb.AdminExportDurableResponse, error)
+	ImportDurable(ctx context.Context, in *spb.AdminImportDurableRequest, opts ...grpc.CallOption) (*spb.AdminImportDurableResponse, error)
+	CopyMsgs(ctx context.Context, in *spb.AdminCopyMsgsRequest, opts ...grpc.CallOption) (*spb.AdminCopyMsgsResponse, error)
+	Snapshot(ctx context.Context, in *spb.AdminSnapshotRequest, opts ...grpc.CallOption) (*spb.AdminSnapshotResponse, error)
+	LameDuck(ctx context.Context, in *spb.AdminLameDuckRequest, opts ...grpc.CallOption) (*spb.AdminLameDuckResponse, error)
+}
+
+type adminClient struct {
+	cc *grpc.ClientConn
+}
+
+func NewAdminClient(cc *grpc.ClientConn) AdminClient {
+	return &adminClient{cc}
+}
+
+func (c *adminClient) Clients(ctx context.Context, in *spb.AdminClientsRequest, opts ...grpc.CallOption) (*spb.AdminClientsResponse, error) {
+	out := new(spb.AdminClientsResponse)
+	err := grpc.Invoke(ctx, "/gpb.Admin/Clients", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *adminClient) CloseClient(ctx context.Context, in *spb.AdminCloseClientRequest, opts ...grpc.CallOption) (*spb.AdminCloseClientResponse, error) {
+	out := new(spb.AdminCloseClientResponse)
+	err := grpc.Invoke(ctx, "/gpb.Admin/CloseClient", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *adminClient) Channels(ctx context.Context, in *spb.AdminChannelsRequest, opts ...grpc.CallOption) (*spb.AdminChannelsResponse, error) {
+	out := new(spb.AdminChannelsResponse)
+	err := grpc.Invoke(ctx, "/gpb.Admin/Channels", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *adminClient) CreateChannel(ctx context.Context, in *spb.AdminCreateChannelRequest, opts ...grpc.CallOption) (*spb.AdminCreateChannelResponse, error) {
+	out := new(spb.AdminCreateChannelResponse)
+	err := grpc.Invoke(ctx, "/gpb.Admin/CreateChannel", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *adminClient) PurgeChannel(ctx context.Context, in *spb.AdminPurgeChannelRequest, opts ...grpc.CallOption) (*spb.AdminPurgeChannelResponse, error) {
+	out := new(spb.AdminPurgeChannelResponse)
+	err := grpc.Invoke(ctx, "/gpb.Admin/PurgeChannel", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *adminClient) Limits(ctx context.Context, in *spb.AdminLimitsRequest, opts ...grpc.CallOption) (*spb.AdminLimitsResponse, error) {
+	out := new(spb.AdminLimitsResponse)
+	err := grpc.Invoke(ctx, "/gpb.Admin/Limits", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *adminClient) Durables(ctx context.Context, in *spb.AdminDurablesRequest, opts ...grpc.CallOption) (*spb.AdminDurablesResponse, error) {
+	out := new(spb.AdminDurablesResponse)
+	err := grpc.Invoke(ctx, "/gpb.Admin/Durables", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *adminClient) Queues(ctx context.Context, in *spb.AdminQueuesRequest, opts ...grpc.CallOption) (*spb.AdminQueuesResponse, error) {
+	out := new(spb.AdminQueuesResponse)
+	err := grpc.Invoke(ctx, "/gpb.Admin/Queues", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *adminClient) DeleteDurable(ctx context.Context, in *spb.AdminDeleteDurableRequest, opts ...grpc.CallOption) (*spb.AdminDeleteDurableResponse, error) {
+	out := new(spb.AdminDeleteDurableResponse)
+	err := grpc.Invoke(ctx, "/gpb.Admin/DeleteDurable", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *adminClient) RewindDurable(ctx context.Context, in *spb.AdminRewindDurableRequest, opts ...grpc.CallOption) (*spb.AdminRewindDurableResponse, error) {
+	out := new(spb.AdminRewindDurableResponse)
+	err := grpc.Invoke(ctx, "/gpb.Admin/RewindDurable", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *adminClient) ExportDurable(ctx context.Context, in *spb.AdminExportDurableRequest, opts ...grpc.CallOption) (*spb.AdminExportDurableResponse, error) {
+	out := new(spb.AdminExportDurableResponse)
+	err := grpc.Invoke(ctx, "/gpb.Admin/ExportDurable", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *adminClient) ImportDurable(ctx context.Context, in *spb.AdminImportDurableRequest, opts ...grpc.CallOption) (*spb.AdminImportDurableResponse, error) {
+	out := new(spb.AdminImportDurableResponse)
+	err := grpc.Invoke(ctx, "/gpb.Admin/ImportDurable", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *adminClient) CopyMsgs(ctx context.Context, in *spb.AdminCopyMsgsRequest, opts ...grpc.CallOption) (*spb.AdminCopyMsgsResponse, error) {
+	out := new(spb.AdminCopyMsgsResponse)
+	err := grpc.Invoke(ctx, "/gpb.Admin/CopyMsgs", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *adminClient) Snapshot(ctx context.Context, in *spb.AdminSnapshotRequest, opts ...grpc.CallOption) (*spb.AdminSnapshotResponse, error) {
+	out := new(spb.AdminSnapshotResponse)
+	err := grpc.Invoke(ctx, "/gpb.Admin/Snapshot", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *adminClient) LameDuck(ctx context.Context, in *spb.AdminLameDuckRequest, opts ...grpc.CallOption) (*spb.AdminLameDuckResponse, error) {
+	out := new(spb.AdminLameDuckResponse)
+	err := grpc.Invoke(ctx, "/gpb.Admin/LameDuck", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// Server API for Admin service
+
+type AdminServer interface {
+	Clients(context.Context, *spb.AdminClientsRequest) (*spb.AdminClientsResponse, error)
+	CloseClient(context.Context, *spb.AdminCloseClientRequest) (*spb.AdminCloseClientResponse, error)
+	Channels(context.Context, *spb.AdminChannelsRequest) (*spb.AdminChannelsResponse, error)
+	CreateChannel(context.Context, *spb.AdminCreateChannelRequest) (*spb.AdminCreateChannelResponse, error)
+	PurgeChannel(context.Context, *spb.AdminPurgeChannelRequest) (*spb.AdminPurgeChannelResponse, error)
+	Limits(context.Context, *spb.AdminLimitsRequest) (*spb.AdminLimitsResponse, error)
+	Durables(context.Context, *spb.AdminDurablesRequest) (*spb.AdminDurablesResponse, error)
+	Queues(context.Context, *spb.AdminQueuesRequest) (*spb.AdminQueuesResponse, error)
+	DeleteDurable(context.Context, *spb.AdminDeleteDurableRequest) (*spb.AdminDeleteDurableResponse, error)
+	RewindDurable(context.Context, *spb.AdminRewindDurableRequest) (*spb.AdminRewindDurableResponse, error)
+	ExportDurable(context.Context, *spb.AdminExportDurableRequest) (*spb.AdminExportDurableResponse, error)
+	ImportDurable(context.Context, *spb.AdminImportDurableRequest) (*spb.AdminImportDurableResponse, error)
+	CopyMsgs(context.Context, *spb.AdminCopyMsgsRequest) (*spb.AdminCopyMsgsResponse, error)
+	Snapshot(context.Context, *spb.AdminSnapshotRequest) (*spb.AdminSnapshotResponse, error)
+	LameDuck(context.Context, *spb.AdminLameDuckRequest) (*spb.AdminLameDuckResponse, error)
+}
+
+func RegisterAdminServer(s *grpc.Server, srv AdminServer) {
+	s.RegisterService(&_Admin_serviceDesc, srv)
+}
+
+func _Admin_Clients_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(spb.AdminClientsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServer).Clients(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/gpb.Admin/Clients",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServer).Clients(ctx, req.(*spb.AdminClientsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Admin_CloseClient_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(spb.AdminCloseClientRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServer).CloseClient(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/gpb.Admin/CloseClient",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServer).CloseClient(ctx, req.(*spb.AdminCloseClientRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Admin_Channels_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(spb.AdminChannelsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServer).Channels(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/gpb.Admin/Channels",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServer).Channels(ctx, req.(*spb.AdminChannelsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Admin_CreateChannel_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(spb.AdminCreateChannelRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServer).CreateChannel(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/gpb.Admin/CreateChannel",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServer).CreateChannel(ctx, req.(*spb.AdminCreateChannelRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Admin_PurgeChannel_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(spb.AdminPurgeChannelRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServer).PurgeChannel(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/gpb.Admin/PurgeChannel",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServer).PurgeChannel(ctx, req.(*spb.AdminPurgeChannelRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Admin_Limits_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(spb.AdminLimitsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServer).Limits(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/gpb.Admin/Limits",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServer).Limits(ctx, req.(*spb.AdminLimitsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Admin_Durables_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(spb.AdminDurablesRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServer).Durables(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/gpb.Admin/Durables",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServer).Durables(ctx, req.(*spb.AdminDurablesRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Admin_Queues_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(spb.AdminQueuesRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServer).Queues(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/gpb.Admin/Queues",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServer).Queues(ctx, req.(*spb.AdminQueuesRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Admin_DeleteDurable_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(spb.AdminDeleteDurableRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServer).DeleteDurable(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/gpb.Admin/DeleteDurable",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServer).DeleteDurable(ctx, req.(*spb.AdminDeleteDurableRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Admin_RewindDurable_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(spb.AdminRewindDurableRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServer).RewindDurable(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/gpb.Admin/RewindDurable",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServer).RewindDurable(ctx, req.(*spb.AdminRewindDurableRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Admin_ExportDurable_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(spb.AdminExportDurableRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServer).ExportDurable(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/gpb.Admin/ExportDurable",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServer).ExportDurable(ctx, req.(*spb.AdminExportDurableRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Admin_ImportDurable_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(spb.AdminImportDurableRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServer).ImportDurable(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/gpb.Admin/ImportDurable",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServer).ImportDurable(ctx, req.(*spb.AdminImportDurableRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Admin_CopyMsgs_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(spb.AdminCopyMsgsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServer).CopyMsgs(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/gpb.Admin/CopyMsgs",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServer).CopyMsgs(ctx, req.(*spb.AdminCopyMsgsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Admin_Snapshot_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(spb.AdminSnapshotRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServer).Snapshot(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/gpb.Admin/Snapshot",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServer).Snapshot(ctx, req.(*spb.AdminSnapshotRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Admin_LameDuck_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(spb.AdminLameDuckRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServer).LameDuck(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/gpb.Admin/LameDuck",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServer).LameDuck(ctx, req.(*spb.AdminLameDuckRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+var _Admin_serviceDesc = grpc.ServiceDesc{
+	ServiceName: "gpb.Admin",
+	HandlerType: (*AdminServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Clients",
+			Handler:    _Admin_Clients_Handler,
+		},
+		{
+			MethodName: "CloseClient",
+			Handler:    _Admin_CloseClient_Handler,
+		},
+		{
+			MethodName: "Channels",
+			Handler:    _Admin_Channels_Handler,
+		},
+		{
+			MethodName: "CreateChannel",
+			Handler:    _Admin_CreateChannel_Handler,
+		},
+		{
+			MethodName: "PurgeChannel",
+			Handler:    _Admin_PurgeChannel_Handler,
+		},
+		{
+			MethodName: "Limits",
+			Handler:    _Admin_Limits_Handler,
+		},
+		{
+			MethodName: "Durables",
+			Handler:    _Admin_Durables_Handler,
+		},
+		{
+			MethodName: "Queues",
+			Handler:    _Admin_Queues_Handler,
+		},
+		{
+			MethodName: "DeleteDurable",
+			Handler:    _Admin_DeleteDurable_Handler,
+		},
+		{
+			MethodName: "RewindDurable",
+			Handler:    _Admin_RewindDurable_Handler,
+		},
+		{
+			MethodName: "ExportDurable",
+			Handler:    _Admin_ExportDurable_Handler,
+		},
+		{
+			MethodName: "ImportDurable",
+			Handler:    _Admin_ImportDurable_Handler,
+		},
+		{
+			MethodName: "CopyMsgs",
+			Handler:    _Admin_CopyMsgs_Handler,
+		},
+		{
+			MethodName: "Snapshot",
+			Handler:    _Admin_Snapshot_Handler,
+		},
+		{
+			MethodName: "LameDuck",
+			Handler:    _Admin_LameDuck_Handler,
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "service.proto",
+}
+
+// Client API for Data service
+
+type DataClient interface {
+	Publish(ctx context.Context, in *spb.PublishRequest, opts ...grpc.CallOption) (*spb.PublishResponse, error)
+	Fetch(ctx context.Context, in *spb.FetchRequest, opts ...grpc.CallOption) (*spb.FetchResponse, error)
+}
+
+type dataClient struct {
+	cc *grpc.ClientConn
+}
+
+func NewDataClient(cc *grpc.ClientConn) DataClient {
+	return &dataClient{cc}
+}
+
+func (c *dataClient) Publish(ctx context.Context, in *spb.PublishRequest, opts ...grpc.CallOption) (*spb.PublishResponse, error) {
+	out := new(spb.PublishResponse)
+	err := grpc.Invoke(ctx, "/gpb.Data/Publish", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *dataClient) Fetch(ctx context.Context, in *spb.FetchRequest, opts ...grpc.CallOption) (*spb.FetchResponse, error) {
+	out := new(spb.FetchResponse)
+	err := grpc.Invoke(ctx, "/gpb.Data/Fetch", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// Server API for Data service
+
+type DataServer interface {
+	Publish(context.Context, *spb.PublishRequest) (*spb.PublishResponse, error)
+	Fetch(context.Context, *spb.FetchRequest) (*spb.FetchResponse, error)
+}
+
+func RegisterDataServer(s *grpc.Server, srv DataServer) {
+	s.RegisterService(&_Data_serviceDesc, srv)
+}
+
+func _Data_Publish_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(spb.PublishRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(DataServer).Publish(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/gpb.Data/Publish",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(DataServer).Publish(ctx, req.(*spb.PublishRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Data_Fetch_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(spb.FetchRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(DataServer).Fetch(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/gpb.Data/Fetch",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(DataServer).Fetch(ctx, req.(*spb.FetchRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+var _Data_serviceDesc = grpc.ServiceDesc{
+	ServiceName: "gpb.Data",
+	HandlerType: (*DataServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Publish",
+			Handler:    _Data_Publish_Handler,
+		},
+		{
+			MethodName: "Fetch",
+			Handler:    _Data_Fetch_Handler,
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "service.proto",
+}
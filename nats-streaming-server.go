@@ -8,6 +8,7 @@ import (
 	"os/signal"
 	"runtime"
 	"strings"
+	"time"
 
 	"fmt"
 
@@ -21,13 +22,165 @@ Usage: nats-streaming-server [options]
 
 Streaming Server Options:
     -cluster_id  <cluster ID>    Cluster ID (default: test-cluster)
-    -store <type>                Store type: MEMORY|FILE (default: MEMORY)
+    -store <type>                Store type: MEMORY|FILE, or a type registered
+                                 by the build (default: MEMORY)
     -dir <directory>             For FILE store type, this is the root directory
+    -memory_snapshot_interval <duration>
+                                 Snapshot the MEMORY store in the -dir directory
+                                 at this interval (0 to disable)
     -max_channels <number>       Max number of channels
     -max_subs <number>           Max number of subscriptions per channel
     -max_msgs <number>           Max number of messages per channel
     -max_bytes <number>          Max messages total size per channel
-    -nats_server <url>           Connect to this external NATS Server (embedded otherwise)
+    -max_clients <number>        Max number of connected clients
+    -max_client_subs <number>    Max number of subscriptions per client
+    -max_client_channels <number>
+                                 Max number of channels created per client
+    -max_queue_members <number>  Max number of members per queue group
+    -min_ack_wait <duration>     Min ack wait of the subscriptions
+    -max_ack_wait <duration>     Max ack wait of the subscriptions
+    -min_sub_inflight <number>   Min max in flight of the subscriptions
+    -max_sub_inflight <number>   Max max in flight of the subscriptions
+    -clamp_sub_bounds            Bring the ack wait and max in flight of the
+                                 subscriptions within bounds instead of
+                                 rejecting them
+    -store_high_watermark <bytes>
+                                 Reject published messages when the total size
+                                 of the stored messages exceeds this value
+    -store_low_watermark <bytes> Accept published messages again when the total
+                                 size falls below this value (default: high
+                                 watermark)
+    -memory_budget <bytes>       Max memory used by the messages kept in memory
+                                 by the store (0 means no limit)
+    -memory_budget_policy <string>
+                                 When the memory budget is exceeded: "reject"
+                                 published messages (default) or "trim" the
+                                 oldest messages of the channels
+    -store_error_policy <string> When the store fails to write: "report" the
+                                 error (default), become "readonly", "retry"
+                                 with backoff or "panic"
+    -store_error_retries <number>
+                                 Retries of a failed write with the retry
+                                 policy (default: 5)
+    -store_error_backoff <duration>
+                                 Delay before the first retry, doubled after
+                                 each one (default: 100ms)
+    -store_timeout <duration>    Fail the writes of the store for a publish,
+                                 delivery or ack that take longer than this
+                                 (0 means no limit)
+    -monotonic_timestamps        Never let the timestamps of the messages of a
+                                 channel go back, for instance after a failover
+                                 to a server whose clock is behind
+    -compacted_channels <list>   Comma separated list of channels (wildcards allowed)
+                                 that keep only the latest message per key
+    -priority_channels <list>    Comma separated list of channels (wildcards allowed)
+                                 whose messages are delivered highest priority first
+    -interest_channels <list>    Comma separated list of channels (wildcards allowed)
+                                 whose messages are removed once acknowledged by
+                                 all their subscriptions
+    -dedup_windows <list>        Comma separated list of channel=duration (wildcards
+                                 allowed): drop messages whose dedup key was
+                                 stored on the channel within the duration
+    -partitioned_channels <list> Comma separated list of channel=partitions (wildcards
+                                 allowed): queue members get exclusive partitions
+                                 by partition key
+    -archive_dir <path>          Export the messages of the archive channels to
+                                 this directory at each archive interval
+    -archive_channels <list>     Comma separated list of channels (wildcards allowed)
+                                 to archive
+    -archive_interval <duration> Interval between two archives (default: 1h)
+    -archive_format <format>     Format of the archives: json or proto
+                                 (default: json)
+    -nats_server <url(s)>        Connect to this external NATS Server or comma
+                                 separated list of cluster URLs (embedded otherwise)
+    -nats_check_interval <duration>
+                                 Interval at which the embedded NATS Server is
+                                 checked (default: 0, not checked)
+    -nats_failure_policy <string>
+                                 When the embedded NATS Server stops accepting
+                                 connections: exit or restart (default: exit)
+    -users <file>                JSON file of the users allowed to connect, with
+                                 their channel publish/subscribe permissions
+    -bind_client_ids             Users without client IDs can only connect with
+                                 their user name as client ID
+    -tenants <file>              JSON file of the tenants, each owning the channels
+                                 prefixed with its name, with their own limits
+    -channels <file>             JSON file of the channels created on startup, with
+                                 their own limits and aliases
+    -no_implicit_channels        Reject publishes and subscriptions on channels that
+                                 do not exist, instead of creating them
+    -channel_name_pattern <re>   Regular expression the whole name of a channel
+                                 created by a client must match
+    -max_channel_name_len <int>  Max length of the name of a channel created by a
+                                 client (0 for no limit)
+    -reserved_prefixes <list>    Comma separated list of prefixes of the channels on
+                                 which clients can't publish, in addition to _STAN.
+    -publish_limits <file>       JSON file of the publish rate limits of clients
+                                 and channels
+    -validators <file>           JSON file of the JSON Schema files or webhooks
+                                 validating the payloads published on channels
+    -max_pub_inflight <number>   Max number of messages of a client being stored
+                                 and not yet acknowledged
+    -pub_inflight_block          Wait, instead of rejecting the message, when a
+                                 client is at -max_pub_inflight
+    -audit_log <file>            Append-only file recording client, subscription
+                                 and channel events, and limit violations
+    -mirrors <file>              JSON file of the channels replicated from remote
+                                 clusters
+    -mqtt_listen <host:port>     Accept MQTT 3.1.1 publishes on this address
+    -mqtt_mappings <file>        JSON file of the MQTT topics to channels mappings
+    -http_listen <host:port>     Accept HTTP publish and fetch requests on this address
+    -grpc_listen <host:port>     Accept gRPC admin and data requests on this address (grpc tag)
+    -ws_listen <host:port>       Accept streaming clients over WebSocket on this address
+    -webhooks <file>             JSON file of the channels whose messages are posted
+                                 to HTTP endpoints
+    -trace_endpoint <url>        OTLP/HTTP endpoint to which the spans of the messages
+                                 published with a trace context are exported
+    -monitor_listen <host:port>  Address of the monitoring endpoints (channel latencies)
+    -monitor_profiling           Serve the net/http/pprof endpoints on the monitoring address
+    -listeners <file>            JSON file of additional NATS, monitoring, HTTP and
+                                 gRPC listeners (IPv6, Unix sockets, own TLS and auth)
+    -admin_socket <path>         Unix domain socket accepting admin requests in JSON,
+                                 without credentials, from the local user
+    -runtime_stats_interval <duration>
+                                 Interval at which runtime statistics are sampled (default: 10s)
+    -slow_consumer_timeout <duration>
+                                 Report subscriptions that stay at their max
+                                 in flight for longer than this (0 to disable)
+    -slow_consumer_close         Close the subscriptions reported as slow
+    -consumer_lag_threshold <number>
+                                 Report subscriptions more than this number of
+                                 messages behind their channel (0 to disable)
+    -consumer_lag_duration <duration>
+                                 How long a subscription must stay above the
+                                 lag threshold before being reported
+    -advisories                  Store client, subscription and channel events in
+                                 the _STAN.advisory.<event> channels
+    -hb_interval <duration>      Interval at which clients are sent heartbeats (default: 30s)
+    -hb_timeout <duration>       How long to wait for a heartbeat answer (default: 10s)
+    -hb_fail_count <number>      Number of consecutive failed heartbeats after which
+                                 a client is unreachable (default: 10)
+    -client_purge_delay <duration>
+                                 How long an unreachable client is kept, with its
+                                 subscriptions, before being closed (default: 0)
+    -client_recovery_max_age <duration>
+                                 Close the recovered clients whose last contact is
+                                 older than this on startup (default: 0, keep all)
+    -max_recovered_pending <int>
+                                 Maximum number of recovered pending messages of a
+                                 subscription kept in memory (default: 0, unlimited)
+    -dup_client_id_policy <string>
+                                 When a client connects with the ID of a registered
+                                 client: reject, verify or replace (default: verify)
+    -dup_client_id_timeout <duration>
+                                 How long the registered client has to answer a
+                                 heartbeat with the verify policy (default: 500ms)
+    -lame_duck_timeout <duration>
+                                 How long to wait in lame duck mode (SIGUSR2)
+                                 for messages in flight to be acknowledged
+                                 (default: 30s)
+    -systemd_notify              Notify systemd (Type=notify) once ready, and
+                                 feed its watchdog (WatchdogSec)
 
 Streaming Server TLS Options:
     -secure                      Use a TLS connection to the NATS server without
@@ -40,15 +193,30 @@ Streaming Server Logging Options:
     -SD, --stan_debug            Enable STAN debugging output
     -SV, --stan_trace            Trace the raw STAN protocol
     -SDV                         Debug and trace STAN
+    -log_json                    Log in JSON format, one object per line with
+                                 level, component, client and channel fields
+    -log_file <file>             Log file, reopened on SIGUSR1 (takes precedence
+                                 over -l)
+    -log_size_limit <bytes>      Rotate the log file when it reaches this size
+    -log_max_age <duration>      Rotate the log file when it reaches this age
+                                 (for instance 24h)
     (See additional NATS logging options below)
 
+Windows Service Options:
+    -service <command>           Install, uninstall, start or stop the Windows
+                                 service, then exit. On install, the other
+                                 options are those the service is started with
+    -service_name <name>         Name of the Windows service
+                                 (default: nats-streaming-server)
+
 Embedded NATS Server Options:
     -a, --addr <host>                Bind to host address (default: 0.0.0.0)
     -p, --port <port>                Use port for clients (default: 4222)
     -P, --pid <file>                 File to store PID
     -m, --http_port <port>           Use port for http monitoring
     -ms,--https_port <port>          Use port for https monitoring
-    -c, --config <file>              Configuration file
+    -c, --config <file>              NATS Server configuration file (any gnatsd
+                                     option, command line options take precedence)
 
 Logging Options:
     -l, --log <file>                 File to redirect log output
@@ -68,17 +236,21 @@ TLS Options:
         --tls                        Enable TLS, do not verify clients (default: false)
         --tlscert <file>             Server certificate file
         --tlskey <file>              Private key for server certificate
-        --tlsverify                  Enable TLS, very client certificates
+        --tlsverify                  Enable TLS, verify client certificates
         --tlscacert <file>           Client certificate CA for verification
 
 NATS Clustering Options:
         --routes <rurl-1, rurl-2>    Routes to solicit and connect
         --cluster <cluster-url>      Cluster URL for solicited routes
+        --cluster_listen <url>       Same as --cluster
 
 Common Options:
     -h, --help                       Show this message
     -v, --version                    Show version
         --help_tls                   TLS help.
+        --validate                   Check the configuration, recover the FILE
+                                     store read-only and report conflicting
+                                     limits, then exit without serving
 `
 
 // usage will print out the flag options for the server.
@@ -91,44 +263,199 @@ func main() {
 
 	// Parse flags
 	sOpts, nOpts := parseFlags()
+	if serviceCommand != "" {
+		if err := stand.ControlService(serviceName, serviceCommand, serviceArgs(os.Args[1:])); err != nil {
+			natsd.PrintAndDie(err.Error())
+		}
+		os.Exit(0)
+	}
+	if validateOnly {
+		validate(sOpts, nOpts)
+	}
 	// override the NoSigs for NATS since we have our own signal handler below
 	nOpts.NoSigs = true
+	if stand.IsWindowsService() {
+		if err := stand.RunService(serviceName, sOpts, nOpts); err != nil {
+			natsd.PrintAndDie(err.Error())
+		}
+		return
+	}
 	stand.ConfigureLogger(sOpts, nOpts)
-	s := stand.RunServerWithOpts(sOpts, nOpts)
+	s, err := stand.StartServerWithOpts(sOpts, nOpts)
+	if err != nil {
+		natsd.PrintAndDie(err.Error())
+	}
+	stand.HandleLameDuckSignal(s)
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt)
 	go func() {
-		<-c
-		s.Shutdown()
+		select {
+		case <-c:
+			s.Shutdown()
+		case <-s.LameDuckDone():
+		}
 		os.Exit(0)
 	}()
 
 	runtime.Goexit()
 }
 
+// Windows service flags, which apply to the process rather than the server.
+var (
+	serviceCommand string
+	serviceName    string
+)
+
+// Set with -validate to only check the configuration.
+var validateOnly bool
+
+// validate checks the configuration and the store, prints the report and
+// exits, with a non-zero status if there are conflicts.
+func validate(sOpts *stand.Options, nOpts *natsd.Options) {
+	report, err := stand.ValidateConfig(sOpts, nOpts)
+	if err != nil {
+		natsd.PrintAndDie(err.Error())
+	}
+	report.Print(os.Stdout)
+	if len(report.Conflicts) > 0 {
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+// serviceArgs returns the command line arguments without the -service
+// flag, so that the service can be installed with the other options.
+func serviceArgs(args []string) []string {
+	var filtered []string
+	for i := 0; i < len(args); i++ {
+		name := strings.TrimLeft(args[i], "-")
+		if name == "service" {
+			// Skip the flag and its value.
+			i++
+		} else if !strings.HasPrefix(name, "service=") {
+			filtered = append(filtered, args[i])
+		}
+	}
+	return filtered
+}
+
 func parseFlags() (*stand.Options, *natsd.Options) {
 
 	// STAN options
 	var stanDebugAndTrace bool
+	var compactedChannels string
+	var priorityChannels string
+	var interestChannels string
+	var dedupWindows string
+	var partitionedChannels string
+	var archiveChannels string
+	var reservedPrefixes string
+	var usersFile string
+	var tenantsFile string
+	var channelsFile string
+	var tierDir string
+	var s3TierOpts stores.S3TierOptions
+	var maintenanceWindows string
+	var mirrorsFile string
+	var webhooksFile string
+	var listenersFile string
+	var mqttMappingsFile string
+	var publishLimitsFile string
+	var validatorsFile string
 
 	stanOpts := stand.GetDefaultOptions()
 	flag.StringVar(&stanOpts.ID, "cluster_id", stand.DefaultClusterID, "Cluster ID.")
-	flag.StringVar(&stanOpts.StoreType, "store", stores.TypeMemory, fmt.Sprintf("Store type: (%s|%s)", stores.TypeMemory, stores.TypeFile))
+	flag.StringVar(&stanOpts.StoreType, "store", stores.TypeMemory, fmt.Sprintf("Store type: (%s)", strings.Join(stores.RegisteredTypes(), "|")))
 	flag.StringVar(&stanOpts.FilestoreDir, "dir", "", "Root directory")
+	flag.DurationVar(&stanOpts.SnapshotInterval, "memory_snapshot_interval", 0, "Interval at which the MEMORY store is snapshotted in the root directory")
 	flag.IntVar(&stanOpts.MaxChannels, "max_channels", stand.DefaultChannelLimit, "Max number of channels")
 	flag.IntVar(&stanOpts.MaxSubscriptions, "max_subs", stand.DefaultSubStoreLimit, "Max number of subscriptions per channel")
+	flag.IntVar(&stanOpts.MaxClients, "max_clients", 0, "Max number of connected clients (0 for no limit)")
+	flag.IntVar(&stanOpts.MaxSubsPerClient, "max_client_subs", 0, "Max number of subscriptions per client (0 for no limit)")
+	flag.IntVar(&stanOpts.MaxChannelsPerClient, "max_client_channels", 0, "Max number of channels created per client (0 for no limit)")
+	flag.IntVar(&stanOpts.MaxQueueMembers, "max_queue_members", 0, "Max number of members per queue group (0 for no limit)")
+	flag.DurationVar(&stanOpts.MinAckWait, "min_ack_wait", 0, "Min ack wait of the subscriptions (0 for no minimum)")
+	flag.DurationVar(&stanOpts.MaxAckWait, "max_ack_wait", 0, "Max ack wait of the subscriptions (0 for no maximum)")
+	flag.IntVar(&stanOpts.MinSubInFlight, "min_sub_inflight", 0, "Min max in flight of the subscriptions (0 for no minimum)")
+	flag.IntVar(&stanOpts.MaxSubInFlight, "max_sub_inflight", 0, "Max max in flight of the subscriptions (0 for no maximum)")
+	flag.BoolVar(&stanOpts.ClampSubBounds, "clamp_sub_bounds", false, "Bring the ack wait and max in flight of the subscriptions within bounds instead of rejecting them")
 	flag.IntVar(&stanOpts.MaxMsgs, "max_msgs", stand.DefaultMsgStoreLimit, "Max number of messages per channel")
 	flag.Uint64Var(&stanOpts.MaxBytes, "max_bytes", stand.DefaultMsgSizeStoreLimit, "Max messages total size per channel")
+	flag.Int64Var(&stanOpts.StoreHighWatermark, "store_high_watermark", 0, "Reject published messages when the total size of the stored messages exceeds this value")
+	flag.Int64Var(&stanOpts.StoreLowWatermark, "store_low_watermark", 0, "Accept published messages again when the total size falls below this value")
+	flag.Int64Var(&stanOpts.MemoryBudget, "memory_budget", 0, "Max memory used by the messages kept in memory by the store")
+	flag.StringVar(&stanOpts.MemoryBudgetPolicy, "memory_budget_policy", stand.MemoryBudgetReject, "When the memory budget is exceeded: reject or trim")
+	flag.StringVar(&stanOpts.StoreErrorPolicy, "store_error_policy", stand.StoreErrorReport, "When the store fails to write: report, readonly, retry or panic")
+	flag.IntVar(&stanOpts.StoreErrorRetries, "store_error_retries", stand.DefaultStoreErrorRetries, "Retries of a failed write with the retry policy")
+	flag.DurationVar(&stanOpts.StoreErrorBackoff, "store_error_backoff", stand.DefaultStoreErrorBackoff, "Delay before the first retry of a failed write, doubled after each one")
+	flag.DurationVar(&stanOpts.StoreTimeout, "store_timeout", 0, "Fail the writes of the store for a publish, delivery or ack that take longer than this (0 for no limit)")
+	flag.BoolVar(&stanOpts.MonotonicTimestamps, "monotonic_timestamps", false, "Never let the timestamps of the messages of a channel go back")
+	flag.StringVar(&compactedChannels, "compacted_channels", "", "Comma separated list of channels that keep only the latest message per key")
+	flag.StringVar(&priorityChannels, "priority_channels", "", "Comma separated list of channels whose messages are delivered highest priority first")
+	flag.StringVar(&interestChannels, "interest_channels", "", "Comma separated list of channels whose messages are removed once acknowledged by all their subscriptions")
+	flag.StringVar(&dedupWindows, "dedup_windows", "", "Comma separated list of channel=duration dedup windows")
+	flag.StringVar(&partitionedChannels, "partitioned_channels", "", "Comma separated list of channel=partitions partitioned channels")
+	flag.StringVar(&stanOpts.ArchiveDir, "archive_dir", "", "Directory to which the messages of the archive channels are exported")
+	flag.StringVar(&archiveChannels, "archive_channels", "", "Comma separated list of channels to archive")
+	flag.DurationVar(&stanOpts.ArchiveInterval, "archive_interval", stand.DefaultArchiveInterval, "Interval between two archives")
+	flag.StringVar(&stanOpts.ArchiveFormat, "archive_format", stores.ArchiveJSON, "Format of the archives: json or proto")
 	flag.BoolVar(&stanOpts.Debug, "SD", false, "Enable STAN Debug logging.")
 	flag.BoolVar(&stanOpts.Debug, "stan_debug", false, "Enable STAN Debug logging.")
 	flag.BoolVar(&stanOpts.Trace, "SV", false, "Enable STAN Trace logging.")
 	flag.BoolVar(&stanOpts.Trace, "stan_trace", false, "Enable STAN Trace logging.")
 	flag.BoolVar(&stanDebugAndTrace, "SDV", false, "Enable STAN Debug and Trace logging.")
+	flag.BoolVar(&stanOpts.LogJSON, "log_json", false, "Log in JSON format.")
+	flag.StringVar(&stanOpts.LogFile, "log_file", "", "Log file, reopened on SIGUSR1.")
+	flag.Int64Var(&stanOpts.LogFileMaxSize, "log_size_limit", 0, "Rotate the log file when it reaches this size.")
+	flag.DurationVar(&stanOpts.LogFileMaxAge, "log_max_age", 0, "Rotate the log file when it reaches this age.")
 	flag.BoolVar(&stanOpts.Secure, "secure", false, "Enables TLS secure connection that skips server verification.")
 	flag.StringVar(&stanOpts.ClientCert, "tls_client_cert", "", "Path to a client certificate file")
 	flag.StringVar(&stanOpts.ClientKey, "tls_client_key", "", "Path to a client key file")
 	flag.StringVar(&stanOpts.ClientCA, "tls_client_cacert", "", "Path to a client CA file")
 	flag.StringVar(&stanOpts.NATSServerURL, "nats_server", "", "URL of the NATS Server to connect to (embedded by default)")
+	flag.DurationVar(&stanOpts.NATSCheckInterval, "nats_check_interval", 0, "Interval at which the embedded NATS Server is checked")
+	flag.StringVar(&stanOpts.NATSFailurePolicy, "nats_failure_policy", stand.NATSFailureExit, "When the embedded NATS Server stops accepting connections: exit or restart")
+	flag.StringVar(&usersFile, "users", "", "JSON file of the users allowed to connect, with their channel permissions")
+	flag.BoolVar(&stanOpts.BindClientIDs, "bind_client_ids", false, "Users without client IDs can only connect with their user name as client ID")
+	flag.StringVar(&tenantsFile, "tenants", "", "JSON file of the tenants, with their own channel namespace and limits")
+	flag.StringVar(&channelsFile, "channels", "", "JSON file of the channels created on startup, with their own limits and aliases")
+	flag.BoolVar(&stanOpts.NoImplicitChannels, "no_implicit_channels", false, "Reject publishes and subscriptions on channels that do not exist")
+	flag.StringVar(&stanOpts.ChannelNamePattern, "channel_name_pattern", "", "Regular expression the names of the channels created by clients must match")
+	flag.IntVar(&stanOpts.MaxChannelNameLen, "max_channel_name_len", 0, "Max length of the names of the channels created by clients (0 for no limit)")
+	flag.StringVar(&reservedPrefixes, "reserved_prefixes", "", "Comma separated list of prefixes of the channels on which clients can't publish")
+	flag.StringVar(&publishLimitsFile, "publish_limits", "", "JSON file of the publish rate limits of clients and channels")
+	flag.StringVar(&validatorsFile, "validators", "", "JSON file of the JSON Schema files or webhooks validating the payloads published on channels")
+	flag.IntVar(&stanOpts.MaxPubInFlight, "max_pub_inflight", 0, "Max number of messages of a client being stored and not yet acknowledged (0 for no limit)")
+	flag.BoolVar(&stanOpts.PubInFlightBlock, "pub_inflight_block", false, "Wait, instead of rejecting the message, when a client is at max_pub_inflight")
+	flag.StringVar(&mirrorsFile, "mirrors", "", "JSON file of the channels replicated from remote clusters")
+	flag.StringVar(&stanOpts.MQTTListen, "mqtt_listen", "", "Accept MQTT publishes on this address")
+	flag.StringVar(&mqttMappingsFile, "mqtt_mappings", "", "JSON file of the MQTT topics to channels mappings")
+	flag.StringVar(&stanOpts.HTTPListen, "http_listen", "", "Accept HTTP publish and fetch requests on this address")
+	flag.StringVar(&stanOpts.GRPCListen, "grpc_listen", "", "Accept gRPC admin and data requests on this address")
+	flag.StringVar(&stanOpts.WebSocketListen, "ws_listen", "", "Accept streaming clients over WebSocket on this address")
+	flag.StringVar(&webhooksFile, "webhooks", "", "JSON file of the channels whose messages are posted to HTTP endpoints")
+	flag.StringVar(&stanOpts.TraceEndpoint, "trace_endpoint", "", "OTLP/HTTP endpoint to which the spans of traced messages are exported")
+	flag.StringVar(&stanOpts.MonitorListen, "monitor_listen", "", "Address (host:port) of the monitoring endpoints")
+	flag.BoolVar(&stanOpts.MonitorProfiling, "monitor_profiling", false, "Serve the net/http/pprof endpoints on the monitoring address")
+	flag.StringVar(&listenersFile, "listeners", "", "JSON file of additional NATS, monitoring, HTTP and gRPC listeners")
+	flag.StringVar(&stanOpts.AdminSocket, "admin_socket", "", "Unix domain socket accepting admin requests in JSON, without credentials")
+	flag.DurationVar(&stanOpts.RuntimeStatsInterval, "runtime_stats_interval", stand.DefaultRuntimeStatsInterval, "Interval at which runtime statistics are sampled")
+	flag.DurationVar(&stanOpts.SlowConsumerTimeout, "slow_consumer_timeout", 0, "Report subscriptions that stay at their max in flight for longer than this (0 to disable)")
+	flag.BoolVar(&stanOpts.SlowConsumerClose, "slow_consumer_close", false, "Close the subscriptions reported as slow")
+	flag.Uint64Var(&stanOpts.ConsumerLagThreshold, "consumer_lag_threshold", 0, "Report subscriptions more than this number of messages behind their channel (0 to disable)")
+	flag.DurationVar(&stanOpts.ConsumerLagDuration, "consumer_lag_duration", 0, "How long a subscription must stay above the lag threshold before being reported")
+	flag.BoolVar(&stanOpts.Advisories, "advisories", false, "Store client, subscription and channel events in the _STAN.advisory.<event> channels")
+	flag.DurationVar(&stanOpts.HeartbeatInterval, "hb_interval", stand.DefaultHeartBeatInterval, "Interval at which clients are sent heartbeats")
+	flag.DurationVar(&stanOpts.HeartbeatTimeout, "hb_timeout", stand.DefaultClientHBTimeout, "How long to wait for a client to answer a heartbeat")
+	flag.IntVar(&stanOpts.MaxFailedHeartbeats, "hb_fail_count", stand.DefaultMaxFailedHeartBeats, "Number of consecutive failed heartbeats after which a client is unreachable")
+	flag.DurationVar(&stanOpts.ClientPurgeDelay, "client_purge_delay", 0, "How long an unreachable client is kept, with its subscriptions, before being closed")
+	flag.DurationVar(&stanOpts.ClientRecoveryMaxAge, "client_recovery_max_age", 0, "Close the recovered clients whose last contact is older than this on startup")
+	flag.IntVar(&stanOpts.MaxRecoveredPending, "max_recovered_pending", 0, "Maximum number of recovered pending messages of a subscription kept in memory")
+	flag.StringVar(&stanOpts.DupClientIDPolicy, "dup_client_id_policy", stand.DupClientIDVerify, "When a client connects with the ID of a registered client: reject, verify or replace")
+	flag.DurationVar(&stanOpts.DupClientIDTimeout, "dup_client_id_timeout", stand.DefaultDupClientIDTimeout, "How long the registered client has to answer a heartbeat with the verify policy")
+	flag.StringVar(&stanOpts.AuditLogFile, "audit_log", "", "Append-only file recording client, subscription and channel events")
+	flag.DurationVar(&stanOpts.LameDuckTimeout, "lame_duck_timeout", stand.DefaultLameDuckTimeout, "How long to wait in lame duck mode for messages in flight to be acknowledged")
+	flag.BoolVar(&stanOpts.SystemdNotify, "systemd_notify", false, "Notify systemd of readiness and feed its watchdog")
 	flag.BoolVar(&stanOpts.FileStoreOpts.CompactEnabled, "file_compact_enabled", stores.DefaultFileStoreOptions.CompactEnabled, "Enable file compaction")
 	flag.IntVar(&stanOpts.FileStoreOpts.CompactFragmentation, "file_compact_frag", stores.DefaultFileStoreOptions.CompactFragmentation, "File fragmentation threshold for compaction")
 	flag.IntVar(&stanOpts.FileStoreOpts.CompactInterval, "file_compact_interval", stores.DefaultFileStoreOptions.CompactInterval, "Minimum interval (in seconds) between file compactions")
@@ -137,6 +464,22 @@ func parseFlags() (*stand.Options, *natsd.Options) {
 	flag.BoolVar(&stanOpts.FileStoreOpts.DoCRC, "file_crc", stores.DefaultFileStoreOptions.DoCRC, "Enable file CRC-32 checksum")
 	flag.Int64Var(&stanOpts.FileStoreOpts.CRCPolynomial, "file_crc_poly", stores.DefaultFileStoreOptions.CRCPolynomial, "Polynomial used to make the table used for CRC-32 checksum")
 	flag.BoolVar(&stanOpts.FileStoreOpts.DoSync, "file_sync", stores.DefaultFileStoreOptions.DoSync, "Enable File.Sync on Flush")
+	flag.IntVar(&stanOpts.FileStoreOpts.RecoveryParallelism, "file_recovery_parallelism", stores.DefaultFileStoreOptions.RecoveryParallelism, "Number of channels recovered concurrently on startup")
+	flag.BoolVar(&stanOpts.FileStoreOpts.LazyRecovery, "file_lazy_recovery", stores.DefaultFileStoreOptions.LazyRecovery, "Read the messages of a channel on first access instead of on startup")
+	flag.BoolVar(&stanOpts.FileStoreOpts.GroupCommit, "file_group_commit", stores.DefaultFileStoreOptions.GroupCommit, "Coalesce the file syncs requested concurrently by the stores")
+	flag.IntVar(&stanOpts.FileStoreOpts.AckFlushInterval, "file_ack_flush_interval", stores.DefaultFileStoreOptions.AckFlushInterval, "Interval (in milliseconds) at which acks are flushed, 0 to flush each ack")
+	flag.Int64Var(&stanOpts.FileStoreOpts.PreallocateSize, "file_prealloc_size", stores.DefaultFileStoreOptions.PreallocateSize, "Disk space (in bytes) reserved for a message file when it is opened for writing")
+	flag.Int64Var(&stanOpts.FileStoreOpts.ReservedDiskSpace, "file_reserved_disk_space", stores.DefaultFileStoreOptions.ReservedDiskSpace, "Free disk space (in bytes) below which messages are rejected")
+	flag.Int64Var(&stanOpts.FileStoreOpts.RetentionRate, "file_retention_rate", stores.DefaultFileStoreOptions.RetentionRate, "Enforce the channel limits in the background, removing at most this many bytes per second")
+	flag.StringVar(&tierDir, "file_tier_dir", "", "Directory (for instance a mounted object storage bucket) to which old message files are offloaded")
+	flag.StringVar(&s3TierOpts.Endpoint, "file_tier_s3_endpoint", "", "URL of the S3 compatible object storage (S3, MinIO, GCS) to which old message files are offloaded")
+	flag.StringVar(&s3TierOpts.Bucket, "file_tier_s3_bucket", "", "Bucket of the S3 compatible object storage")
+	flag.StringVar(&s3TierOpts.Region, "file_tier_s3_region", "", "Region of the bucket, us-east-1 if not set")
+	flag.StringVar(&s3TierOpts.Prefix, "file_tier_s3_prefix", "", "Prefix of the names of the objects in the bucket")
+	flag.IntVar(&stanOpts.FileStoreOpts.TierAge, "file_tier_age", stores.DefaultFileStoreOptions.TierAge, "Age (in seconds) of the last message of a file before it is offloaded")
+	flag.StringVar(&maintenanceWindows, "file_maintenance_windows", "", "Semicolon separated list of the windows (for instance \"Mon-Fri 01:00-05:00\") during which the files are compacted and offloaded")
+	flag.BoolVar(&stanOpts.FileStoreOpts.ShardChannelDirs, "file_shard_dirs", stores.DefaultFileStoreOptions.ShardChannelDirs, "Store the channel directories under two levels of hashed directories")
+	flag.BoolVar(&stanOpts.FileStoreOpts.Upgrade, "upgrade_store", false, "Upgrade, on startup, the files written in an older format")
 	flag.IntVar(&stanOpts.IOBatchSize, "io_batch_size", stand.DefaultIOBatchSize, "# of message to batch in flushing io")
 	flag.Int64Var(&stanOpts.IOSleepTime, "io_sleep_time", stand.DefaultIOSleepTime, "duration the server waits for more messages (in micro-seconds, 0 to disable)")
 	// NATS options
@@ -192,6 +535,10 @@ func parseFlags() (*stand.Options, *natsd.Options) {
 	flag.StringVar(&natsOpts.TLSKey, "tlskey", "", "Private key for server certificate.")
 	flag.StringVar(&natsOpts.TLSCaCert, "tlscacert", "", "Client certificate CA for verification.")
 
+	flag.StringVar(&serviceCommand, "service", "", "Install, uninstall, start or stop the Windows service")
+	flag.StringVar(&serviceName, "service_name", stand.DefaultServiceName, "Name of the Windows service")
+	flag.BoolVar(&validateOnly, "validate", false, "Check the configuration and the store, then exit")
+
 	flag.Usage = usage
 	flag.Parse()
 
@@ -214,7 +561,7 @@ func parseFlags() (*stand.Options, *natsd.Options) {
 		if err != nil {
 			natsd.PrintAndDie(err.Error())
 		}
-		natsOpts = *natsd.MergeOptions(fileOpts, &natsOpts)
+		natsOpts = *stand.MergeNATSOptions(fileOpts, &natsOpts)
 	}
 
 	// Remove any host/ip that points to itself in Route
@@ -243,6 +590,161 @@ func parseFlags() (*stand.Options, *natsd.Options) {
 		stanOpts.Trace, stanOpts.Debug = true, true
 	}
 
+	if compactedChannels != "" {
+		for _, c := range strings.Split(compactedChannels, ",") {
+			if c = strings.TrimSpace(c); c != "" {
+				stanOpts.CompactedChannels = append(stanOpts.CompactedChannels, c)
+			}
+		}
+	}
+
+	if priorityChannels != "" {
+		for _, c := range strings.Split(priorityChannels, ",") {
+			if c = strings.TrimSpace(c); c != "" {
+				stanOpts.PriorityChannels = append(stanOpts.PriorityChannels, c)
+			}
+		}
+	}
+
+	if interestChannels != "" {
+		for _, c := range strings.Split(interestChannels, ",") {
+			if c = strings.TrimSpace(c); c != "" {
+				stanOpts.InterestChannels = append(stanOpts.InterestChannels, c)
+			}
+		}
+	}
+
+	if archiveChannels != "" {
+		for _, c := range strings.Split(archiveChannels, ",") {
+			if c = strings.TrimSpace(c); c != "" {
+				stanOpts.ArchiveChannels = append(stanOpts.ArchiveChannels, c)
+			}
+		}
+	}
+
+	if reservedPrefixes != "" {
+		for _, p := range strings.Split(reservedPrefixes, ",") {
+			if p = strings.TrimSpace(p); p != "" {
+				stanOpts.ReservedPrefixes = append(stanOpts.ReservedPrefixes, p)
+			}
+		}
+	}
+
+	if dedupWindows != "" {
+		windows, err := stand.ParseDedupWindows(dedupWindows)
+		if err != nil {
+			natsd.PrintAndDie(err.Error())
+		}
+		stanOpts.DedupWindows = windows
+	}
+
+	if partitionedChannels != "" {
+		parts, err := stand.ParseChannelPartitions(partitionedChannels)
+		if err != nil {
+			natsd.PrintAndDie(err.Error())
+		}
+		stanOpts.PartitionedChannels = parts
+	}
+
+	if usersFile != "" {
+		users, err := stand.LoadUsersFile(usersFile)
+		if err != nil {
+			natsd.PrintAndDie(err.Error())
+		}
+		stanOpts.Users = users
+	}
+
+	if tenantsFile != "" {
+		tenants, err := stand.LoadTenantsFile(tenantsFile)
+		if err != nil {
+			natsd.PrintAndDie(err.Error())
+		}
+		stanOpts.Tenants = tenants
+	}
+
+	if channelsFile != "" {
+		channels, err := stand.LoadChannelsFile(channelsFile)
+		if err != nil {
+			natsd.PrintAndDie(err.Error())
+		}
+		stanOpts.Channels = channels
+	}
+
+	if mirrorsFile != "" {
+		mirrors, err := stand.LoadMirrorsFile(mirrorsFile)
+		if err != nil {
+			natsd.PrintAndDie(err.Error())
+		}
+		stanOpts.Mirrors = mirrors
+	}
+
+	if webhooksFile != "" {
+		webhooks, err := stand.LoadWebhooksFile(webhooksFile)
+		if err != nil {
+			natsd.PrintAndDie(err.Error())
+		}
+		stanOpts.Webhooks = webhooks
+	}
+
+	if listenersFile != "" {
+		listeners, err := stand.LoadListenersFile(listenersFile)
+		if err != nil {
+			natsd.PrintAndDie(err.Error())
+		}
+		stanOpts.Listeners = listeners
+	}
+
+	if mqttMappingsFile != "" {
+		mappings, err := stand.LoadMQTTMappingsFile(mqttMappingsFile)
+		if err != nil {
+			natsd.PrintAndDie(err.Error())
+		}
+		stanOpts.MQTTMappings = mappings
+	}
+
+	if validatorsFile != "" {
+		validators, err := stand.LoadValidatorsFile(validatorsFile)
+		if err != nil {
+			natsd.PrintAndDie(err.Error())
+		}
+		stanOpts.Validators = validators
+	}
+
+	if publishLimitsFile != "" {
+		limits, err := stand.LoadPublishRateLimitsFile(publishLimitsFile)
+		if err != nil {
+			natsd.PrintAndDie(err.Error())
+		}
+		stanOpts.PublishRateLimits = limits
+	}
+
+	if tierDir != "" && s3TierOpts.Endpoint != "" {
+		natsd.PrintAndDie("-file_tier_dir and -file_tier_s3_endpoint can't be both set")
+	}
+	if tierDir != "" {
+		stanOpts.FileStoreOpts.Tier = stores.NewDirTier(tierDir)
+	}
+	if s3TierOpts.Endpoint != "" {
+		// The credentials are not given on the command line, which is
+		// visible to the other users of the host.
+		s3TierOpts.AccessKey = os.Getenv("AWS_ACCESS_KEY_ID")
+		s3TierOpts.SecretKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+		s3TierOpts.Timeout = time.Minute
+		tier, err := stores.NewS3Tier(s3TierOpts)
+		if err != nil {
+			natsd.PrintAndDie(err.Error())
+		}
+		stanOpts.FileStoreOpts.Tier = tier
+	}
+
+	if maintenanceWindows != "" {
+		windows, err := stores.ParseMaintenanceWindows(maintenanceWindows)
+		if err != nil {
+			natsd.PrintAndDie(err.Error())
+		}
+		stanOpts.FileStoreOpts.MaintenanceWindows = windows
+	}
+
 	return stanOpts, &natsOpts
 }
 
@@ -250,10 +752,10 @@ func checkStoreOpts(opts *stand.Options) {
 	// Convert the user input to upper case
 	storeType := strings.ToUpper(opts.StoreType)
 
-	// If FILE, check some parameters
-	if storeType == stores.TypeFile {
+	// If FILE, or MEMORY with snapshots, check some parameters
+	if storeType == stores.TypeFile || (storeType == stores.TypeMemory && opts.SnapshotInterval > 0) {
 		if opts.FilestoreDir == "" {
-			fmt.Printf("\nFor %v stores, option \"-dir\" must be specified\n", stores.TypeFile)
+			fmt.Printf("\nFor %v stores, option \"-dir\" must be specified\n", storeType)
 			flag.Usage()
 			os.Exit(0)
 		}
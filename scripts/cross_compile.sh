@@ -1,6 +1,9 @@
 #!/bin/bash
 go get github.com/mitchellh/gox
 go get github.com/tcnksm/ghr
+# Windows only dependency of the service support, not fetched by go get on
+# other platforms.
+go get golang.org/x/sys/windows/svc/...
 
 export APPNAME="nats-streaming-server"
 export OSARCH="linux/386 linux/amd64 linux/arm darwin/amd64 windows/386 windows/amd64"
@@ -0,0 +1,920 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/nats-io/go-nats-streaming/pb"
+	"github.com/nats-io/nats"
+	"github.com/nats-io/nats-streaming-server/spb"
+	"github.com/nats-io/nats-streaming-server/stores"
+)
+
+// Administrative requests are sent to the subject returned by AdminSubject(),
+// which is the DefaultAdminPrefix followed by the cluster ID and one of
+// these request names.
+const (
+	// AdminClients lists the clients (see spb.AdminClientsRequest).
+	AdminClients = "clients"
+	// AdminCloseClient closes a client (see spb.AdminCloseClientRequest).
+	AdminCloseClient = "close"
+	// AdminDurables lists the durable subscriptions (see spb.AdminDurablesRequest).
+	AdminDurables = "durables"
+	// AdminDeleteDurable deletes a durable subscription (see spb.AdminDeleteDurableRequest).
+	AdminDeleteDurable = "deldurable"
+	// AdminRewindDurable repositions a durable subscription (see spb.AdminRewindDurableRequest).
+	AdminRewindDurable = "rewind"
+	// AdminQueues lists the members of the queue groups (see spb.AdminQueuesRequest).
+	AdminQueues = "queues"
+	// AdminLameDuck puts the server in lame duck mode (see spb.AdminLameDuckRequest).
+	AdminLameDuck = "lameduck"
+	// AdminChannels lists the channels (see spb.AdminChannelsRequest).
+	AdminChannels = "channels"
+	// AdminCreateChannel creates a channel (see spb.AdminCreateChannelRequest).
+	AdminCreateChannel = "createchannel"
+	// AdminExportDurable exports the state of a durable subscription (see spb.AdminExportDurableRequest).
+	AdminExportDurable = "exportdurable"
+	// AdminImportDurable creates a durable subscription from an exported state (see spb.AdminImportDurableRequest).
+	AdminImportDurable = "importdurable"
+	// AdminCopyMsgs copies messages of a channel to another channel (see spb.AdminCopyMsgsRequest).
+	AdminCopyMsgs = "copymsgs"
+	// AdminSnapshot snapshots the store, or flushes its channels (see spb.AdminSnapshotRequest).
+	AdminSnapshot = "snapshot"
+	// AdminPurgeChannel removes the oldest messages of a channel (see spb.AdminPurgeChannelRequest).
+	AdminPurgeChannel = "purge"
+	// AdminLimits gets the limits of the store or of a channel (see spb.AdminLimitsRequest).
+	AdminLimits = "limits"
+)
+
+// Number of messages read at once from the source channel of an
+// AdminCopyMsgs request.
+const copyMsgsBatchSize = 1000
+
+// AdminSubject returns the subject the server of the given cluster receives
+// the administrative `request` on.
+func AdminSubject(clusterID, request string) string {
+	return fmt.Sprintf("%s.%s.%s", DefaultAdminPrefix, clusterID, request)
+}
+
+// initAdminSubscriptions subscribes to the administrative requests.
+func (s *StanServer) initAdminSubscriptions() {
+	handlers := []struct {
+		request string
+		cb      nats.MsgHandler
+	}{
+		{AdminClients, s.processAdminClientsRequest},
+		{AdminCloseClient, s.processAdminCloseClientRequest},
+		{AdminDurables, s.processAdminDurablesRequest},
+		{AdminDeleteDurable, s.processAdminDeleteDurableRequest},
+		{AdminRewindDurable, s.processAdminRewindDurableRequest},
+		{AdminQueues, s.processAdminQueuesRequest},
+		{AdminLameDuck, s.processAdminLameDuckRequest},
+		{AdminChannels, s.processAdminChannelsRequest},
+		{AdminCreateChannel, s.processAdminCreateChannelRequest},
+		{AdminExportDurable, s.processAdminExportDurableRequest},
+		{AdminImportDurable, s.processAdminImportDurableRequest},
+		{AdminCopyMsgs, s.processAdminCopyMsgsRequest},
+		{AdminSnapshot, s.processAdminSnapshotRequest},
+		{AdminPurgeChannel, s.processAdminPurgeChannelRequest},
+		{AdminLimits, s.processAdminLimitsRequest},
+	}
+	for _, h := range handlers {
+		subject := AdminSubject(s.info.ClusterID, h.request)
+		if _, err := s.nc.Subscribe(subject, h.cb); err != nil {
+			panic(fmt.Sprintf("Could not subscribe to admin subject %s, %v\n", subject, err))
+		}
+		Debugf("STAN: Admin subject:       %s", subject)
+	}
+}
+
+// processAdminClientsRequest sends the list of registered clients, with
+// their heartbeat inbox, number of subscriptions, connection metadata and,
+// if they do not answer heartbeats, the time since when.
+func (s *StanServer) processAdminClientsRequest(m *nats.Msg) {
+	req := &spb.AdminClientsRequest{}
+	resp := &spb.AdminClientsResponse{}
+	if err := req.Unmarshal(m.Data); err != nil {
+		Errorf("STAN: Received invalid admin clients request, subject=%s.", m.Subject)
+		resp.Error = ErrInvalidAdminReq.Error()
+		s.sendAdminResponse(m.Reply, resp)
+		return
+	}
+	for ID, sc := range s.store.GetClients() {
+		if req.ClientID != "" && ID != req.ClientID {
+			continue
+		}
+		c := sc.UserData.(*client)
+		c.RLock()
+		subsCount := len(c.subs)
+		unreachableSince := sc.UnreachableSince
+		c.RUnlock()
+		md := clientMetadata(sc)
+		resp.Clients = append(resp.Clients, &spb.AdminClientInfo{
+			ID:               ID,
+			HbInbox:          sc.HbInbox,
+			SubsCount:        int32(subsCount),
+			UnreachableSince: unreachableSince,
+			ConnectTime:      md.ConnectTime,
+			User:             md.User,
+			Version:          md.Version,
+		})
+	}
+	if req.ClientID != "" && len(resp.Clients) == 0 {
+		resp.Error = ErrUnknownClient.Error()
+	}
+	sort.Sort(adminClientsByID(resp.Clients))
+	s.sendAdminResponse(m.Reply, resp)
+}
+
+// processAdminCloseClientRequest closes the client, removing its
+// non-durable subscriptions, as if the client had closed its connection.
+// This is used to get rid of clients that are still answering heartbeats
+// but are otherwise unresponsive.
+func (s *StanServer) processAdminCloseClientRequest(m *nats.Msg) {
+	req := &spb.AdminCloseClientRequest{}
+	resp := &spb.AdminCloseClientResponse{}
+	if err := req.Unmarshal(m.Data); err != nil || req.ClientID == "" {
+		Errorf("STAN: Received invalid admin close request, subject=%s.", m.Subject)
+		resp.Error = ErrInvalidAdminReq.Error()
+		s.sendAdminResponse(m.Reply, resp)
+		return
+	}
+	if !s.closeClient(req.ClientID, closeReasonAdmin) {
+		Errorf("STAN: Unknown client %q in admin close request", req.ClientID)
+		resp.Error = ErrUnknownClient.Error()
+	} else {
+		Noticef("STAN: [Client:%s] Closed by administrative request", req.ClientID)
+	}
+	s.sendAdminResponse(m.Reply, resp)
+}
+
+// processAdminDurablesRequest sends the list of durable subscriptions, of
+// all channels or of the requested channel, whether they are active or not.
+func (s *StanServer) processAdminDurablesRequest(m *nats.Msg) {
+	req := &spb.AdminDurablesRequest{}
+	resp := &spb.AdminDurablesResponse{}
+	if err := req.Unmarshal(m.Data); err != nil {
+		Errorf("STAN: Received invalid admin durables request, subject=%s.", m.Subject)
+		resp.Error = ErrInvalidAdminReq.Error()
+		s.sendAdminResponse(m.Reply, resp)
+		return
+	}
+	channels := s.store.GetChannelNames()
+	if req.Channel != "" {
+		if s.store.LookupChannel(req.Channel) == nil {
+			resp.Error = ErrUnknownChannel.Error()
+			s.sendAdminResponse(m.Reply, resp)
+			return
+		}
+		channels = []string{req.Channel}
+	}
+	for _, channel := range channels {
+		cs := s.store.LookupChannel(channel)
+		if cs == nil {
+			continue
+		}
+		ss := cs.UserData.(*subStore)
+		ss.RLock()
+		durables := make(map[string]*subState, len(ss.durables))
+		for key, sub := range ss.durables {
+			durables[key] = sub
+		}
+		ss.RUnlock()
+		for key, sub := range durables {
+			sub.RLock()
+			info := &spb.AdminDurableInfo{
+				Channel:      channel,
+				ClientID:     durableClientID(key, channel, sub.DurableName),
+				DurableName:  sub.DurableName,
+				LastSent:     sub.LastSent,
+				PendingCount: int32(len(sub.acksPending) + len(sub.spilled)),
+			}
+			sub.RUnlock()
+			resp.Durables = append(resp.Durables, info)
+		}
+	}
+	for _, info := range resp.Durables {
+		info.Active = s.isActiveDurable(info.Channel, info.ClientID, info.DurableName)
+	}
+	sort.Sort(adminDurablesByName(resp.Durables))
+	s.sendAdminResponse(m.Reply, resp)
+}
+
+// processAdminDeleteDurableRequest deletes a durable subscription that is not
+// active, so that applications that have been decommissioned don't leave
+// their durables behind.
+func (s *StanServer) processAdminDeleteDurableRequest(m *nats.Msg) {
+	req := &spb.AdminDeleteDurableRequest{}
+	resp := &spb.AdminDeleteDurableResponse{}
+	if err := req.Unmarshal(m.Data); err != nil || req.Channel == "" ||
+		req.ClientID == "" || req.DurableName == "" {
+		Errorf("STAN: Received invalid admin delete durable request, subject=%s.", m.Subject)
+		resp.Error = ErrInvalidAdminReq.Error()
+		s.sendAdminResponse(m.Reply, resp)
+		return
+	}
+	var (
+		ss  *subStore
+		sub *subState
+	)
+	key := fmt.Sprintf("%s-%s-%s", req.ClientID, req.Channel, req.DurableName)
+	if cs := s.store.LookupChannel(req.Channel); cs != nil {
+		ss = cs.UserData.(*subStore)
+		sub = ss.LookupByDurable(key)
+	}
+	switch {
+	case sub == nil:
+		resp.Error = ErrUnknownDurable.Error()
+	case s.isActiveDurable(req.Channel, req.ClientID, req.DurableName):
+		resp.Error = ErrDurableActive.Error()
+	default:
+		s.recordEvent(&auditRecord{Event: auditSubUnsubscribe, Client: req.ClientID,
+			Channel: req.Channel, Durable: req.DurableName, Reason: closeReasonAdmin})
+		ss.Remove(sub, true)
+		// The client ID of an inactive durable has been cleared, so Remove()
+		// can't compute the durable key.
+		ss.Lock()
+		delete(ss.durables, key)
+		ss.Unlock()
+		Noticef("STAN: [Client:%s] Durable %s on %s deleted by administrative request",
+			req.ClientID, req.DurableName, req.Channel)
+	}
+	if resp.Error != "" {
+		Errorf("STAN: [Client:%s] Unable to delete durable %s on %s: %s",
+			req.ClientID, req.DurableName, req.Channel, resp.Error)
+	}
+	s.sendAdminResponse(m.Reply, resp)
+}
+
+// processAdminRewindDurableRequest repositions a durable subscription that is
+// not active at the requested sequence, or at the first message stored at or
+// after the requested time, so that messages can be processed again without
+// deleting and recreating the durable.
+func (s *StanServer) processAdminRewindDurableRequest(m *nats.Msg) {
+	req := &spb.AdminRewindDurableRequest{}
+	resp := &spb.AdminRewindDurableResponse{}
+	if err := req.Unmarshal(m.Data); err != nil || req.Channel == "" ||
+		req.ClientID == "" || req.DurableName == "" ||
+		(req.StartSequence == 0) == (req.StartTime == 0) {
+		Errorf("STAN: Received invalid admin rewind durable request, subject=%s.", m.Subject)
+		resp.Error = ErrInvalidAdminReq.Error()
+		s.sendAdminResponse(m.Reply, resp)
+		return
+	}
+	var (
+		cs  *stores.ChannelStore
+		sub *subState
+	)
+	key := fmt.Sprintf("%s-%s-%s", req.ClientID, req.Channel, req.DurableName)
+	if cs = s.store.LookupChannel(req.Channel); cs != nil {
+		sub = cs.UserData.(*subStore).LookupByDurable(key)
+	}
+	switch {
+	case sub == nil:
+		resp.Error = ErrUnknownDurable.Error()
+	case s.isActiveDurable(req.Channel, req.ClientID, req.DurableName):
+		resp.Error = ErrDurableActive.Error()
+	default:
+		seq, err := s.rewindDurable(cs, sub, req.StartSequence, req.StartTime, req.KeepPending)
+		if err != nil {
+			resp.Error = err.Error()
+			break
+		}
+		resp.StartSequence = seq
+		Noticef("STAN: [Client:%s] Durable %s on %s rewound to seq=%d by administrative request",
+			req.ClientID, req.DurableName, req.Channel, seq)
+	}
+	if resp.Error != "" {
+		Errorf("STAN: [Client:%s] Unable to rewind durable %s on %s: %s",
+			req.ClientID, req.DurableName, req.Channel, resp.Error)
+	}
+	s.sendAdminResponse(m.Reply, resp)
+}
+
+// rewindDurable sets the position of the durable so that the next message
+// sent is the one with sequence startSeq, or, if startSeq is 0, the first
+// one stored at or after startTime. The pending messages are acknowledged,
+// unless keepPending is true, in which case only the ones at or after the
+// new position are, since they will be sent again. It returns the sequence
+// of the next message to send.
+func (s *StanServer) rewindDurable(cs *stores.ChannelStore, sub *subState, startSeq uint64, startTime int64, keepPending bool) (uint64, error) {
+	if startSeq != 0 {
+		if !s.startSequenceValid(cs, sub.subject, startSeq) {
+			return 0, ErrInvalidSequence
+		}
+	} else {
+		if !s.startTimeValid(cs, sub.subject, startTime) {
+			return 0, ErrInvalidTime
+		}
+		startSeq = s.getSequenceFromStartTime(cs, startTime)
+	}
+	sub.Lock()
+	defer sub.Unlock()
+	var acked []uint64
+	for seq := range sub.acksPending {
+		if !keepPending || seq >= startSeq {
+			delete(sub.acksPending, seq)
+			delete(sub.sentTimes, seq)
+			delete(sub.deliveries, seq)
+			delete(sub.expirations, seq)
+			sub.releaseWorker(seq)
+			acked = append(acked, seq)
+		}
+	}
+	for seq := range sub.scheduled {
+		if !keepPending || seq >= startSeq {
+			delete(sub.scheduled, seq)
+			delete(sub.naks, seq)
+			acked = append(acked, seq)
+		}
+	}
+	spilled := sub.spilled[:0]
+	for _, seq := range sub.spilled {
+		if !keepPending || seq >= startSeq {
+			acked = append(acked, seq)
+		} else {
+			spilled = append(spilled, seq)
+		}
+	}
+	if len(spilled) == 0 && len(sub.spilled) > 0 {
+		// New messages were held until these were redelivered.
+		spilled = nil
+		sub.newOnHold = false
+	}
+	sub.spilled = spilled
+	if len(acked) > 0 {
+		if err := sub.store.AckSeqPendingBatch(sub.ID, acked...); err != nil {
+			return 0, err
+		}
+	}
+	sub.LastSent = startSeq - 1
+	// Messages from the start sequence must not be suppressed as acknowledged.
+	if sub.AckFloor >= startSeq {
+		sub.AckFloor = startSeq - 1
+	}
+	for seq := range sub.recentAcks {
+		if seq >= startSeq {
+			delete(sub.recentAcks, seq)
+		}
+	}
+	if err := sub.store.UpdateSub(&sub.SubState); err != nil {
+		return 0, err
+	}
+	return startSeq, nil
+}
+
+// processAdminExportDurableRequest sends the state of a durable subscription
+// that is not active, with the sequences of its unacknowledged messages, so
+// that it can be imported on another server with an importdurable request.
+func (s *StanServer) processAdminExportDurableRequest(m *nats.Msg) {
+	req := &spb.AdminExportDurableRequest{}
+	resp := &spb.AdminExportDurableResponse{}
+	if err := req.Unmarshal(m.Data); err != nil || req.Channel == "" ||
+		req.ClientID == "" || req.DurableName == "" {
+		Errorf("STAN: Received invalid admin export durable request, subject=%s.", m.Subject)
+		resp.Error = ErrInvalidAdminReq.Error()
+		s.sendAdminResponse(m.Reply, resp)
+		return
+	}
+	var sub *subState
+	key := fmt.Sprintf("%s-%s-%s", req.ClientID, req.Channel, req.DurableName)
+	if cs := s.store.LookupChannel(req.Channel); cs != nil {
+		sub = cs.UserData.(*subStore).LookupByDurable(key)
+	}
+	switch {
+	case sub == nil:
+		resp.Error = ErrUnknownDurable.Error()
+	case s.isActiveDurable(req.Channel, req.ClientID, req.DurableName):
+		resp.Error = ErrDurableActive.Error()
+	default:
+		sub.RLock()
+		state := &spb.AdminDurableState{
+			Channel:  req.Channel,
+			ClientID: req.ClientID,
+			Sub:      &spb.SubState{},
+			Pending:  make([]uint64, 0, len(sub.acksPending)+len(sub.scheduled)+len(sub.spilled)),
+		}
+		*state.Sub = sub.SubState
+		for seq := range sub.acksPending {
+			state.Pending = append(state.Pending, seq)
+		}
+		for seq := range sub.scheduled {
+			state.Pending = append(state.Pending, seq)
+		}
+		state.Pending = append(state.Pending, sub.spilled...)
+		sub.RUnlock()
+		sort.Sort(bySeqNo(state.Pending))
+		resp.State = state
+		Noticef("STAN: [Client:%s] Durable %s on %s exported by administrative request",
+			req.ClientID, req.DurableName, req.Channel)
+	}
+	if resp.Error != "" {
+		Errorf("STAN: [Client:%s] Unable to export durable %s on %s: %s",
+			req.ClientID, req.DurableName, req.Channel, resp.Error)
+	}
+	s.sendAdminResponse(m.Reply, resp)
+}
+
+// processAdminImportDurableRequest creates a durable subscription, not
+// active, from the state exported by another server, so that its client
+// resumes it at the same position. The channel must exist and have the
+// messages up to the last one sent to the durable. An existing durable
+// that is not active is replaced only if requested.
+func (s *StanServer) processAdminImportDurableRequest(m *nats.Msg) {
+	req := &spb.AdminImportDurableRequest{}
+	resp := &spb.AdminImportDurableResponse{}
+	if err := req.Unmarshal(m.Data); err != nil || req.State == nil || req.State.Sub == nil ||
+		req.State.Channel == "" || req.State.ClientID == "" || req.State.Sub.DurableName == "" ||
+		req.State.Sub.QGroup != "" || req.State.Sub.Wildcard != "" {
+		Errorf("STAN: Received invalid admin import durable request, subject=%s.", m.Subject)
+		resp.Error = ErrInvalidAdminReq.Error()
+		s.sendAdminResponse(m.Reply, resp)
+		return
+	}
+	state := req.State
+	durableName := state.Sub.DurableName
+	var (
+		cs  *stores.ChannelStore
+		ss  *subStore
+		sub *subState
+	)
+	key := fmt.Sprintf("%s-%s-%s", state.ClientID, state.Channel, durableName)
+	if cs = s.store.LookupChannel(state.Channel); cs != nil {
+		ss = cs.UserData.(*subStore)
+		sub = ss.LookupByDurable(key)
+	}
+	switch {
+	case cs == nil:
+		resp.Error = ErrUnknownChannel.Error()
+	case state.Sub.LastSent > cs.Msgs.LastSequence():
+		resp.Error = ErrInvalidSequence.Error()
+	case sub != nil && s.isActiveDurable(state.Channel, state.ClientID, durableName):
+		resp.Error = ErrDurableActive.Error()
+	case sub != nil && !req.Replace:
+		resp.Error = ErrDupDurable.Error()
+	default:
+		if sub != nil {
+			ss.Remove(sub, true)
+			ss.Lock()
+			delete(ss.durables, key)
+			ss.Unlock()
+		}
+		if err := s.importDurable(cs, ss, key, state); err != nil {
+			resp.Error = err.Error()
+			break
+		}
+		Noticef("STAN: [Client:%s] Durable %s on %s imported by administrative request, last sent seq=%d",
+			state.ClientID, durableName, state.Channel, state.Sub.LastSent)
+	}
+	if resp.Error != "" {
+		Errorf("STAN: [Client:%s] Unable to import durable %s on %s: %s",
+			state.ClientID, durableName, state.Channel, resp.Error)
+	}
+	s.sendAdminResponse(m.Reply, resp)
+}
+
+// importDurable stores the durable subscription with the given state and
+// its unacknowledged messages that are still in the channel, and adds it
+// to the subStore as a durable whose client has closed.
+func (s *StanServer) importDurable(cs *stores.ChannelStore, ss *subStore, key string, state *spb.AdminDurableState) error {
+	sub := &subState{
+		SubState:    *state.Sub,
+		subject:     state.Channel,
+		acksPending: make(map[uint64]*pb.MsgProto, len(state.Pending)),
+		store:       cs.Subs,
+		msgs:        cs.Msgs,
+	}
+	// The ID is assigned by the store, and the ack inbox is replaced when
+	// the durable is resumed.
+	sub.ID = 0
+	sub.ClientID = state.ClientID
+	sub.AckInbox = nats.NewInbox()
+	sub.ackWait = time.Duration(sub.AckWaitInSecs) * time.Second
+	if sub.Filter != "" {
+		f, err := parseFilter(sub.Filter)
+		if err != nil {
+			return err
+		}
+		sub.filter = f
+	}
+	sub.rate = newRateLimiter(sub.MaxMsgsPerSec, sub.MaxBytesPerSec)
+	loadSnapshot(sub)
+	if err := cs.Subs.CreateSub(&sub.SubState); err != nil {
+		return err
+	}
+	for _, seq := range state.Pending {
+		m, err := cs.Msgs.Lookup(seq)
+		if err != nil {
+			return err
+		}
+		// Messages no longer in the channel can't be redelivered.
+		if m == nil {
+			continue
+		}
+		if err := cs.Subs.AddSeqPending(sub.ID, seq); err != nil {
+			return err
+		}
+		sub.acksPending[seq] = m
+	}
+	// Same as for a recovered durable. The pending messages are redelivered
+	// when the durable is resumed, before the new ones.
+	recoverScheduledMsgs(sub, s.clock.Now().UnixNano())
+	dropAckedPending(sub)
+	sub.ClientID = ""
+	ss.Lock()
+	ss.durables[key] = sub
+	ss.Unlock()
+	return nil
+}
+
+// processAdminQueuesRequest sends the members of the queue groups, of all
+// channels or of the requested channel, and optionally of a single queue
+// group, so that unexpected or stuck members can be spotted.
+func (s *StanServer) processAdminQueuesRequest(m *nats.Msg) {
+	req := &spb.AdminQueuesRequest{}
+	resp := &spb.AdminQueuesResponse{}
+	if err := req.Unmarshal(m.Data); err != nil {
+		Errorf("STAN: Received invalid admin queues request, subject=%s.", m.Subject)
+		resp.Error = ErrInvalidAdminReq.Error()
+		s.sendAdminResponse(m.Reply, resp)
+		return
+	}
+	channels := s.store.GetChannelNames()
+	if req.Channel != "" {
+		if s.store.LookupChannel(req.Channel) == nil {
+			resp.Error = ErrUnknownChannel.Error()
+			s.sendAdminResponse(m.Reply, resp)
+			return
+		}
+		channels = []string{req.Channel}
+	}
+	for _, channel := range channels {
+		cs := s.store.LookupChannel(channel)
+		if cs == nil {
+			continue
+		}
+		ss := cs.UserData.(*subStore)
+		ss.RLock()
+		members := make(map[string][]*subState, len(ss.qsubs))
+		for qgroup, qs := range ss.qsubs {
+			if req.QGroup != "" && qgroup != req.QGroup {
+				continue
+			}
+			qs.RLock()
+			members[qgroup] = append([]*subState(nil), qs.subs...)
+			qs.RUnlock()
+		}
+		ss.RUnlock()
+		for qgroup, subs := range members {
+			for _, sub := range subs {
+				sub.RLock()
+				resp.Members = append(resp.Members, &spb.AdminQueueMemberInfo{
+					Channel:      channel,
+					QGroup:       qgroup,
+					ClientID:     sub.ClientID,
+					PendingCount: int32(len(sub.acksPending) + len(sub.spilled)),
+					LastAckTime:  sub.lastAck,
+					Stalled:      sub.stalled,
+				})
+				sub.RUnlock()
+			}
+		}
+	}
+	sort.Sort(adminQueueMembersByName(resp.Members))
+	s.sendAdminResponse(m.Reply, resp)
+}
+
+// processAdminLameDuckRequest puts the server in lame duck mode. The reply
+// is sent when the mode is entered, not when the server shuts down.
+func (s *StanServer) processAdminLameDuckRequest(m *nats.Msg) {
+	req := &spb.AdminLameDuckRequest{}
+	resp := &spb.AdminLameDuckResponse{}
+	if err := req.Unmarshal(m.Data); err != nil || req.TimeoutInSecs < 0 {
+		Errorf("STAN: Received invalid admin lame duck request, subject=%s.", m.Subject)
+		resp.Error = ErrInvalidAdminReq.Error()
+		s.sendAdminResponse(m.Reply, resp)
+		return
+	}
+	if s.isLameDuck() {
+		resp.Error = ErrLameDuck.Error()
+		s.sendAdminResponse(m.Reply, resp)
+		return
+	}
+	Noticef("STAN: Lame duck mode requested by administrative request")
+	s.sendAdminResponse(m.Reply, resp)
+	// Make sure the reply is sent before the connection is closed.
+	s.nc.Flush()
+	go s.LameDuck(time.Duration(req.TimeoutInSecs) * time.Second)
+}
+
+// processAdminChannelsRequest sends the list of channels, or only the
+// requested one, with their creation time and message state.
+func (s *StanServer) processAdminChannelsRequest(m *nats.Msg) {
+	req := &spb.AdminChannelsRequest{}
+	resp := &spb.AdminChannelsResponse{}
+	if err := req.Unmarshal(m.Data); err != nil {
+		Errorf("STAN: Received invalid admin channels request, subject=%s.", m.Subject)
+		resp.Error = ErrInvalidAdminReq.Error()
+		s.sendAdminResponse(m.Reply, resp)
+		return
+	}
+	infos, err := s.store.GetChannels()
+	if err != nil {
+		Errorf("STAN: Unable to get channels for admin channels request: %v", err)
+		resp.Error = err.Error()
+		s.sendAdminResponse(m.Reply, resp)
+		return
+	}
+	for _, info := range infos {
+		if req.Channel != "" && info.Name != req.Channel {
+			continue
+		}
+		ci := &spb.AdminChannelInfo{
+			Name:     info.Name,
+			FirstSeq: info.FirstSeq,
+			LastSeq:  info.LastSeq,
+			Msgs:     int32(info.Msgs),
+			Bytes:    info.Bytes,
+		}
+		if !info.Created.IsZero() {
+			ci.Created = info.Created.UnixNano()
+		}
+		resp.Channels = append(resp.Channels, ci)
+	}
+	if req.Channel != "" && len(resp.Channels) == 0 {
+		resp.Error = ErrUnknownChannel.Error()
+	}
+	s.sendAdminResponse(m.Reply, resp)
+}
+
+// processAdminCopyMsgsRequest copies a range of messages of a channel at
+// the end of another channel, which is created if needed. The copies keep
+// the timestamps, reply subjects and attributes of the original messages.
+func (s *StanServer) processAdminCopyMsgsRequest(m *nats.Msg) {
+	req := &spb.AdminCopyMsgsRequest{}
+	resp := &spb.AdminCopyMsgsResponse{}
+	err := req.Unmarshal(m.Data)
+	req.Channel, req.Target = s.resolveChannel(req.Channel), s.resolveChannel(req.Target)
+	if err != nil || req.Channel == "" || !isValidSubject(req.Target) || req.Target == req.Channel ||
+		(req.EndSequence != 0 && req.EndSequence < req.StartSequence) {
+		Errorf("STAN: Received invalid admin copy messages request, subject=%s.", m.Subject)
+		resp.Error = ErrInvalidAdminReq.Error()
+		s.sendAdminResponse(m.Reply, resp)
+		return
+	}
+	src := s.store.LookupChannel(req.Channel)
+	if src == nil {
+		resp.Error = ErrUnknownChannel.Error()
+		s.sendAdminResponse(m.Reply, resp)
+		return
+	}
+	switch {
+	case s.isMirror(req.Target):
+		err = ErrMirrorChannel
+	case s.isReservedChannel(req.Target):
+		err = ErrReservedChannel
+	case s.isStorageFull():
+		err = ErrStorageFull
+	}
+	dst := s.store.LookupChannel(req.Target)
+	if err == nil && dst == nil {
+		if err = s.checkChannelName(req.Target); err == nil {
+			dst, err = s.createChannel(req.Target, "")
+		}
+	}
+	if err == nil {
+		err = s.copyMsgs(src, dst, req.Target, req.StartSequence, req.EndSequence, resp)
+	}
+	if err != nil {
+		Errorf("STAN: Unable to copy messages of %s to %s for admin copy messages request: %v",
+			req.Channel, req.Target, err)
+		resp.Error = err.Error()
+	}
+	if resp.Copied > 0 {
+		Noticef("STAN: %d messages of %s copied to %s (seq=%d to %d) by administrative request",
+			resp.Copied, req.Channel, req.Target, resp.FirstSequence, resp.LastSequence)
+	}
+	s.sendAdminResponse(m.Reply, resp)
+}
+
+// copyMsgs copies the messages of src with a sequence between first and
+// last included, up to the last message stored if last is 0, at the end of
+// the target channel, and delivers them to its subscribers. The response
+// is updated with the copies made, even if an error occurs.
+func (s *StanServer) copyMsgs(src, dst *stores.ChannelStore, target string, first, last uint64, resp *spb.AdminCopyMsgsResponse) error {
+	if srcLast := src.Msgs.LastSequence(); last == 0 || last > srcLast {
+		last = srcLast
+	}
+	for first <= last {
+		msgs, err := src.Msgs.LookupRange(first, last, copyMsgsBatchSize)
+		if err != nil || len(msgs) == 0 {
+			return err
+		}
+		for _, msg := range msgs {
+			seq, err := storeCopiedMsg(dst, target, msg, src.Msgs.LookupExt(msg.Sequence))
+			if err != nil {
+				return err
+			}
+			if resp.FirstSequence == 0 {
+				resp.FirstSequence = seq
+			}
+			resp.LastSequence = seq
+			resp.Copied++
+		}
+		if err := dst.Msgs.Flush(); err != nil {
+			return err
+		}
+		s.processMsg(dst)
+		if err := dst.Subs.Flush(); err != nil {
+			return err
+		}
+		first = msgs[len(msgs)-1].Sequence + 1
+	}
+	return nil
+}
+
+// storeCopiedMsg stores a copy of the message after the last message of
+// the target channel, and returns the sequence of the copy.
+func storeCopiedMsg(cs *stores.ChannelStore, target string, msg *pb.MsgProto, ext *spb.MsgExt) (uint64, error) {
+	cp := &pb.MsgProto{
+		Subject:   target,
+		Reply:     msg.Reply,
+		Data:      msg.Data,
+		Timestamp: msg.Timestamp,
+	}
+	for {
+		cp.Sequence = cs.Msgs.LastSequence() + 1
+		err := cs.Msgs.StoreMsg(cp, ext)
+		// A message published on the target channel in the meantime may
+		// have taken the sequence, in which case try the next one.
+		if err != stores.ErrSeqOutOfOrder {
+			return cp.Sequence, err
+		}
+	}
+}
+
+// processAdminSnapshotRequest snapshots the store or, if it does not
+// support snapshots, flushes all its channels, so that its files can be
+// backed up.
+func (s *StanServer) processAdminSnapshotRequest(m *nats.Msg) {
+	req := &spb.AdminSnapshotRequest{}
+	resp := &spb.AdminSnapshotResponse{}
+	if err := req.Unmarshal(m.Data); err != nil {
+		Errorf("STAN: Received invalid admin snapshot request, subject=%s.", m.Subject)
+		resp.Error = ErrInvalidAdminReq.Error()
+		s.sendAdminResponse(m.Reply, resp)
+		return
+	}
+	names := s.store.GetChannelNames()
+	err := stores.Snapshot(s.store)
+	if err == nil {
+		resp.Snapshot = true
+	} else if err == stores.ErrNoSnapshots {
+		err = s.store.Flush()
+	}
+	if err != nil {
+		Errorf("STAN: Unable to snapshot the store for admin snapshot request: %v", err)
+		resp.Error = err.Error()
+	} else {
+		resp.Channels = int32(len(names))
+	}
+	s.sendAdminResponse(m.Reply, resp)
+}
+
+// processAdminPurgeChannelRequest removes the messages of a channel with a
+// sequence lower than the requested one, or all of them but the last one.
+// As with the limits, messages not yet acknowledged are removed too.
+func (s *StanServer) processAdminPurgeChannelRequest(m *nats.Msg) {
+	req := &spb.AdminPurgeChannelRequest{}
+	resp := &spb.AdminPurgeChannelResponse{}
+	if err := req.Unmarshal(m.Data); err != nil || req.Channel == "" {
+		Errorf("STAN: Received invalid admin purge channel request, subject=%s.", m.Subject)
+		resp.Error = ErrInvalidAdminReq.Error()
+		s.sendAdminResponse(m.Reply, resp)
+		return
+	}
+	channel := s.resolveChannel(req.Channel)
+	cs := s.store.LookupChannel(channel)
+	if cs == nil {
+		resp.Error = ErrUnknownChannel.Error()
+		s.sendAdminResponse(m.Reply, resp)
+		return
+	}
+	seq := req.Sequence
+	if seq == 0 {
+		_, seq = cs.Msgs.FirstAndLastSequence()
+	}
+	n, err := stores.PurgeBefore(cs.Msgs, seq)
+	if err != nil {
+		Errorf("STAN: Unable to purge channel %q for admin purge channel request: %v", channel, err)
+		resp.Error = err.Error()
+	} else {
+		Noticef("STAN: Removed %d messages of channel %q by administrative request", n, channel)
+		resp.Purged = int32(n)
+	}
+	s.sendAdminResponse(m.Reply, resp)
+}
+
+// processAdminLimitsRequest sends the limits of the store or, if a channel
+// is requested, the limits that apply to it, which include those of its
+// tenant and its own.
+func (s *StanServer) processAdminLimitsRequest(m *nats.Msg) {
+	req := &spb.AdminLimitsRequest{}
+	resp := &spb.AdminLimitsResponse{}
+	if err := req.Unmarshal(m.Data); err != nil || (req.Channel != "" && !isValidSubject(req.Channel)) {
+		Errorf("STAN: Received invalid admin limits request, subject=%s.", m.Subject)
+		resp.Error = ErrInvalidAdminReq.Error()
+		s.sendAdminResponse(m.Reply, resp)
+		return
+	}
+	limits := storeLimits(s.opts)
+	if req.Channel != "" {
+		cl := limits.ForChannel(s.resolveChannel(req.Channel))
+		limits = &cl
+	}
+	resp.MaxChannels = int32(limits.MaxChannels)
+	resp.MaxMsgs = int32(limits.MaxNumMsgs)
+	resp.MaxBytes = limits.MaxMsgBytes
+	resp.MaxAge = int64(limits.MaxMsgAge)
+	resp.MaxSubs = int32(limits.MaxSubs)
+	s.sendAdminResponse(m.Reply, resp)
+}
+
+// durableClientID returns the client ID part of the durable key. Since the
+// client ID of a subState is cleared when the durable becomes inactive, this
+// is the only way to get it back.
+func durableClientID(key, channel, durableName string) string {
+	return strings.TrimSuffix(key, fmt.Sprintf("-%s-%s", channel, durableName))
+}
+
+// isActiveDurable returns true if the client is registered and currently
+// has the given durable subscription.
+func (s *StanServer) isActiveDurable(channel, clientID, durableName string) bool {
+	for _, sub := range s.clients.GetSubs(clientID) {
+		sub.RLock()
+		active := sub.subject == channel && sub.DurableName == durableName
+		sub.RUnlock()
+		if active {
+			return true
+		}
+	}
+	return false
+}
+
+// adminResponse is implemented by all administrative responses.
+type adminResponse interface {
+	Marshal() ([]byte, error)
+}
+
+// sendAdminResponse sends the response to the administrative request.
+func (s *StanServer) sendAdminResponse(subj string, resp adminResponse) {
+	if subj == "" {
+		return
+	}
+	if b, err := resp.Marshal(); err == nil {
+		s.nc.Publish(subj, b)
+	}
+}
+
+// adminClientsByID is used to sort clients by ID.
+type adminClientsByID []*spb.AdminClientInfo
+
+func (c adminClientsByID) Len() int           { return len(c) }
+func (c adminClientsByID) Less(i, j int) bool { return c[i].ID < c[j].ID }
+func (c adminClientsByID) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
+
+// adminDurablesByName is used to sort durables by channel, client ID and
+// durable name.
+type adminDurablesByName []*spb.AdminDurableInfo
+
+func (d adminDurablesByName) Len() int      { return len(d) }
+func (d adminDurablesByName) Swap(i, j int) { d[i], d[j] = d[j], d[i] }
+func (d adminDurablesByName) Less(i, j int) bool {
+	if d[i].Channel != d[j].Channel {
+		return d[i].Channel < d[j].Channel
+	}
+	if d[i].ClientID != d[j].ClientID {
+		return d[i].ClientID < d[j].ClientID
+	}
+	return d[i].DurableName < d[j].DurableName
+}
+
+// adminQueueMembersByName is used to sort queue members by channel, queue
+// group and client ID.
+type adminQueueMembersByName []*spb.AdminQueueMemberInfo
+
+func (q adminQueueMembersByName) Len() int      { return len(q) }
+func (q adminQueueMembersByName) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+func (q adminQueueMembersByName) Less(i, j int) bool {
+	if q[i].Channel != q[j].Channel {
+		return q[i].Channel < q[j].Channel
+	}
+	if q[i].QGroup != q[j].QGroup {
+		return q[i].QGroup < q[j].QGroup
+	}
+	return q[i].ClientID < q[j].ClientID
+}
@@ -0,0 +1,878 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/nats-io/go-nats-streaming"
+	"github.com/nats-io/go-nats-streaming/pb"
+	"github.com/nats-io/nats"
+	"github.com/nats-io/nats-streaming-server/spb"
+)
+
+type adminRequest interface {
+	Marshal() ([]byte, error)
+}
+
+type adminReply interface {
+	Unmarshal([]byte) error
+}
+
+func sendAdminRequest(t *testing.T, nc *nats.Conn, request string, req adminRequest, resp adminReply) {
+	b, _ := req.Marshal()
+	reply, err := nc.Request(AdminSubject(clusterName, request), b, 2*time.Second)
+	if err != nil {
+		stackFatalf(t, "Unexpected error on admin request: %v", err)
+	}
+	if err := resp.Unmarshal(reply.Data); err != nil {
+		stackFatalf(t, "Unexpected error on unmarshal: %v", err)
+	}
+}
+
+func TestAdminClients(t *testing.T) {
+	s := RunServer(clusterName)
+	defer s.Shutdown()
+
+	nc, err := nats.Connect(nats.DefaultURL)
+	if err != nil {
+		t.Fatalf("Unexpected error on connect: %v", err)
+	}
+	defer nc.Close()
+
+	resp := &spb.AdminClientsResponse{}
+	sendAdminRequest(t, nc, AdminClients, &spb.AdminClientsRequest{}, resp)
+	if resp.Error != "" || len(resp.Clients) != 0 {
+		t.Fatalf("Unexpected response: %v", resp)
+	}
+
+	sc1, err := stan.Connect(clusterName, "me")
+	if err != nil {
+		t.Fatalf("Unexpected error on connect: %v", err)
+	}
+	defer sc1.Close()
+	sc2, err := stan.Connect(clusterName, "another")
+	if err != nil {
+		t.Fatalf("Unexpected error on connect: %v", err)
+	}
+	defer sc2.Close()
+	for i := 0; i < 2; i++ {
+		if _, err := sc1.Subscribe("foo", func(_ *stan.Msg) {}); err != nil {
+			t.Fatalf("Unexpected error on subscribe: %v", err)
+		}
+	}
+
+	resp = &spb.AdminClientsResponse{}
+	sendAdminRequest(t, nc, AdminClients, &spb.AdminClientsRequest{}, resp)
+	if resp.Error != "" || len(resp.Clients) != 2 {
+		t.Fatalf("Unexpected response: %v", resp)
+	}
+	for i, expected := range []struct {
+		ID        string
+		subsCount int32
+	}{{"another", 0}, {"me", 2}} {
+		c := resp.Clients[i]
+		if c.ID != expected.ID || c.SubsCount != expected.subsCount || c.HbInbox == "" || c.ConnectTime == 0 {
+			t.Fatalf("Unexpected client info: %v", c)
+		}
+		if hbInbox := s.store.GetClient(c.ID).HbInbox; c.HbInbox != hbInbox {
+			t.Fatalf("Expected HbInbox %q, got %q", hbInbox, c.HbInbox)
+		}
+	}
+
+	resp = &spb.AdminClientsResponse{}
+	sendAdminRequest(t, nc, AdminClients, &spb.AdminClientsRequest{ClientID: "me"}, resp)
+	if resp.Error != "" || len(resp.Clients) != 1 || resp.Clients[0].ID != "me" {
+		t.Fatalf("Unexpected response: %v", resp)
+	}
+
+	resp = &spb.AdminClientsResponse{}
+	sendAdminRequest(t, nc, AdminClients, &spb.AdminClientsRequest{ClientID: "unknown"}, resp)
+	if resp.Error != ErrUnknownClient.Error() {
+		t.Fatalf("Expected error %v, got %v", ErrUnknownClient, resp.Error)
+	}
+}
+
+func TestAdminClientsMetadata(t *testing.T) {
+	sOpts := GetDefaultOptions()
+	sOpts.ID = clusterName
+	sOpts.Users = []*User{{Username: "alice", Password: "foo", Permissions: Permissions{Subscribe: []string{">"}}}}
+	s := RunServerWithOpts(sOpts, nil)
+	defer s.Shutdown()
+
+	nc, err := nats.Connect(nats.DefaultURL)
+	if err != nil {
+		t.Fatalf("Unexpected error on connect: %v", err)
+	}
+	defer nc.Close()
+
+	start := time.Now().UnixNano()
+	creds := &spb.ConnectRequestExt{User: "alice", Password: "foo", Version: "1.2.3"}
+	if err := connectWithCreds(t, nc, clientName, creds); err != nil {
+		t.Fatalf("Unexpected error on connect: %v", err)
+	}
+
+	resp := &spb.AdminClientsResponse{}
+	sendAdminRequest(t, nc, AdminClients, &spb.AdminClientsRequest{}, resp)
+	if resp.Error != "" || len(resp.Clients) != 1 {
+		t.Fatalf("Unexpected response: %v", resp)
+	}
+	c := resp.Clients[0]
+	if c.User != "alice" || c.Version != "1.2.3" || c.ConnectTime < start || c.ConnectTime > time.Now().UnixNano() {
+		t.Fatalf("Unexpected client info: %v", c)
+	}
+	// The metadata is stored with the client.
+	md := clientMetadata(s.store.GetClient(clientName))
+	if md.User != "alice" || md.Version != "1.2.3" || md.ConnectTime != c.ConnectTime {
+		t.Fatalf("Unexpected client metadata: %v", md)
+	}
+}
+func TestAdminCloseClient(t *testing.T) {
+	s := RunServer(clusterName)
+	defer s.Shutdown()
+
+	nc, err := nats.Connect(nats.DefaultURL)
+	if err != nil {
+		t.Fatalf("Unexpected error on connect: %v", err)
+	}
+	defer nc.Close()
+
+	sc := NewDefaultConnection(t)
+	defer sc.Close()
+
+	if _, err := sc.Subscribe("foo", func(_ *stan.Msg) {}); err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+	if _, err := sc.Subscribe("foo", func(_ *stan.Msg) {}, stan.DurableName("dur")); err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+	waitForNumSubs(t, s, clientName, 2)
+
+	resp := &spb.AdminCloseClientResponse{}
+	sendAdminRequest(t, nc, AdminCloseClient, &spb.AdminCloseClientRequest{}, resp)
+	if resp.Error != ErrInvalidAdminReq.Error() {
+		t.Fatalf("Expected error %v, got %v", ErrInvalidAdminReq, resp.Error)
+	}
+
+	resp = &spb.AdminCloseClientResponse{}
+	sendAdminRequest(t, nc, AdminCloseClient, &spb.AdminCloseClientRequest{ClientID: "unknown"}, resp)
+	if resp.Error != ErrUnknownClient.Error() {
+		t.Fatalf("Expected error %v, got %v", ErrUnknownClient, resp.Error)
+	}
+
+	resp = &spb.AdminCloseClientResponse{}
+	sendAdminRequest(t, nc, AdminCloseClient, &spb.AdminCloseClientRequest{ClientID: clientName}, resp)
+	if resp.Error != "" {
+		t.Fatalf("Unexpected error: %v", resp.Error)
+	}
+	if s.clients.Lookup(clientName) != nil {
+		t.Fatal("Client should have been removed")
+	}
+	cs := s.store.LookupChannel("foo")
+	ss := cs.UserData.(*subStore)
+	ss.RLock()
+	numSubs := len(ss.psubs)
+	ss.RUnlock()
+	if numSubs != 0 {
+		t.Fatalf("Expected no active subscription, got %v", numSubs)
+	}
+	dur := &subState{SubState: spb.SubState{ClientID: clientName, DurableName: "dur"}, subject: "foo"}
+	if ss.LookupByDurable(dur.durableKey()) == nil {
+		t.Fatal("Durable subscription should have been kept")
+	}
+
+	// The client ID can be reused right away.
+	sc2, err := stan.Connect(clusterName, clientName)
+	if err != nil {
+		t.Fatalf("Unexpected error on connect: %v", err)
+	}
+	sc2.Close()
+}
+
+func TestAdminDurables(t *testing.T) {
+	s := RunServer(clusterName)
+	defer s.Shutdown()
+
+	nc, err := nats.Connect(nats.DefaultURL)
+	if err != nil {
+		t.Fatalf("Unexpected error on connect: %v", err)
+	}
+	defer nc.Close()
+
+	sc := NewDefaultConnection(t)
+	defer sc.Close()
+
+	ch := make(chan bool, 10)
+	cb := func(_ *stan.Msg) { ch <- true }
+	if _, err := sc.Subscribe("foo", cb, stan.DurableName("dur"),
+		stan.SetManualAckMode(), stan.AckWait(time.Minute)); err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+	if _, err := sc.Subscribe("bar", func(_ *stan.Msg) {}, stan.DurableName("dur")); err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+	if _, err := sc.Subscribe("bar", func(_ *stan.Msg) {}); err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := sc.Publish("foo", []byte("hello")); err != nil {
+			t.Fatalf("Unexpected error on publish: %v", err)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		select {
+		case <-ch:
+		case <-time.After(5 * time.Second):
+			t.Fatal("Did not get our message")
+		}
+	}
+
+	checkDurables := func(channel string, expected []spb.AdminDurableInfo) {
+		resp := &spb.AdminDurablesResponse{}
+		sendAdminRequest(t, nc, AdminDurables, &spb.AdminDurablesRequest{Channel: channel}, resp)
+		if resp.Error != "" || len(resp.Durables) != len(expected) {
+			stackFatalf(t, "Unexpected response: %v", resp)
+		}
+		for i, d := range resp.Durables {
+			if *d != expected[i] {
+				stackFatalf(t, "Expected durable %v, got %v", expected[i], *d)
+			}
+		}
+	}
+	fooDur := spb.AdminDurableInfo{Channel: "foo", ClientID: clientName, DurableName: "dur",
+		LastSent: 3, PendingCount: 3, Active: true}
+	barDur := spb.AdminDurableInfo{Channel: "bar", ClientID: clientName, DurableName: "dur",
+		Active: true}
+	checkDurables("", []spb.AdminDurableInfo{barDur, fooDur})
+	checkDurables("foo", []spb.AdminDurableInfo{fooDur})
+
+	resp := &spb.AdminDurablesResponse{}
+	sendAdminRequest(t, nc, AdminDurables, &spb.AdminDurablesRequest{Channel: "baz"}, resp)
+	if resp.Error != ErrUnknownChannel.Error() {
+		t.Fatalf("Expected error %v, got %v", ErrUnknownChannel, resp.Error)
+	}
+
+	deleteDurable := func(req *spb.AdminDeleteDurableRequest, expectedErr error) {
+		resp := &spb.AdminDeleteDurableResponse{}
+		sendAdminRequest(t, nc, AdminDeleteDurable, req, resp)
+		if (expectedErr == nil && resp.Error != "") ||
+			(expectedErr != nil && resp.Error != expectedErr.Error()) {
+			stackFatalf(t, "Expected error %v, got %v", expectedErr, resp.Error)
+		}
+	}
+	fooReq := &spb.AdminDeleteDurableRequest{Channel: "foo", ClientID: clientName, DurableName: "dur"}
+	deleteDurable(&spb.AdminDeleteDurableRequest{Channel: "foo", ClientID: clientName}, ErrInvalidAdminReq)
+	deleteDurable(&spb.AdminDeleteDurableRequest{Channel: "foo", ClientID: clientName, DurableName: "other"}, ErrUnknownDurable)
+	deleteDurable(&spb.AdminDeleteDurableRequest{Channel: "baz", ClientID: clientName, DurableName: "dur"}, ErrUnknownDurable)
+	deleteDurable(fooReq, ErrDurableActive)
+
+	// Once the client is gone, durables are reported inactive and can be deleted.
+	sc.Close()
+	fooDur.Active = false
+	barDur.Active = false
+	checkDurables("", []spb.AdminDurableInfo{barDur, fooDur})
+	deleteDurable(fooReq, nil)
+	checkDurables("", []spb.AdminDurableInfo{barDur})
+	deleteDurable(fooReq, ErrUnknownDurable)
+
+	// Restarting the deleted durable creates a new one.
+	sc = NewDefaultConnection(t)
+	if _, err := sc.Subscribe("foo", cb, stan.DurableName("dur"),
+		stan.StartAt(pb.StartPosition_NewOnly)); err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+	fooDur = spb.AdminDurableInfo{Channel: "foo", ClientID: clientName, DurableName: "dur",
+		LastSent: 3, Active: true}
+	checkDurables("foo", []spb.AdminDurableInfo{fooDur})
+}
+
+func TestAdminRewindDurable(t *testing.T) {
+	s := RunServer(clusterName)
+	defer s.Shutdown()
+
+	nc, err := nats.Connect(nats.DefaultURL)
+	if err != nil {
+		t.Fatalf("Unexpected error on connect: %v", err)
+	}
+	defer nc.Close()
+
+	sc := NewDefaultConnection(t)
+	defer sc.Close()
+
+	ch := make(chan *stan.Msg, 10)
+	cb := func(m *stan.Msg) { ch <- m }
+	if _, err := sc.Subscribe("foo", cb, stan.DurableName("dur"),
+		stan.SetManualAckMode(), stan.AckWait(time.Minute)); err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+	for i := 0; i < 5; i++ {
+		if err := sc.Publish("foo", []byte("hello")); err != nil {
+			t.Fatalf("Unexpected error on publish: %v", err)
+		}
+	}
+	for i := 0; i < 5; i++ {
+		select {
+		case m := <-ch:
+			// Leave messages 4 and 5 pending.
+			if m.Sequence <= 3 {
+				m.Ack()
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Did not get our message")
+		}
+	}
+	waitForCount(t, 2, func() (string, int) {
+		resp := &spb.AdminDurablesResponse{}
+		sendAdminRequest(t, nc, AdminDurables, &spb.AdminDurablesRequest{Channel: "foo"}, resp)
+		if len(resp.Durables) != 1 {
+			stackFatalf(t, "Unexpected response: %v", resp)
+		}
+		return "pending messages", int(resp.Durables[0].PendingCount)
+	})
+
+	rewind := func(req *spb.AdminRewindDurableRequest, expectedErr error, expectedSeq uint64) {
+		resp := &spb.AdminRewindDurableResponse{}
+		sendAdminRequest(t, nc, AdminRewindDurable, req, resp)
+		if (expectedErr == nil && resp.Error != "") ||
+			(expectedErr != nil && resp.Error != expectedErr.Error()) {
+			stackFatalf(t, "Expected error %v, got %v", expectedErr, resp.Error)
+		}
+		if resp.StartSequence != expectedSeq {
+			stackFatalf(t, "Expected start sequence %v, got %v", expectedSeq, resp.StartSequence)
+		}
+	}
+	checkDurable := func(lastSent uint64, pending int32) {
+		resp := &spb.AdminDurablesResponse{}
+		sendAdminRequest(t, nc, AdminDurables, &spb.AdminDurablesRequest{Channel: "foo"}, resp)
+		if len(resp.Durables) != 1 || resp.Durables[0].LastSent != lastSent ||
+			resp.Durables[0].PendingCount != pending {
+			stackFatalf(t, "Unexpected response: %v", resp)
+		}
+	}
+	rewind(&spb.AdminRewindDurableRequest{Channel: "foo", ClientID: clientName, DurableName: "dur"},
+		ErrInvalidAdminReq, 0)
+	rewind(&spb.AdminRewindDurableRequest{Channel: "foo", ClientID: clientName, DurableName: "dur",
+		StartSequence: 1, StartTime: time.Now().UnixNano()}, ErrInvalidAdminReq, 0)
+	rewind(&spb.AdminRewindDurableRequest{Channel: "foo", ClientID: clientName, DurableName: "other",
+		StartSequence: 1}, ErrUnknownDurable, 0)
+	rewind(&spb.AdminRewindDurableRequest{Channel: "foo", ClientID: clientName, DurableName: "dur",
+		StartSequence: 1}, ErrDurableActive, 0)
+
+	sc.Close()
+	rewind(&spb.AdminRewindDurableRequest{Channel: "foo", ClientID: clientName, DurableName: "dur",
+		StartSequence: 10}, ErrInvalidSequence, 0)
+	// Pending messages before the new position are kept if requested.
+	rewind(&spb.AdminRewindDurableRequest{Channel: "foo", ClientID: clientName, DurableName: "dur",
+		StartSequence: 5, KeepPending: true}, nil, 5)
+	checkDurable(4, 1)
+	// Rewind to the time of the second message, dropping the pending ones.
+	m, err := s.store.LookupChannel("foo").Msgs.Lookup(2)
+	if err != nil || m == nil {
+		t.Fatalf("Unable to lookup message: %v", err)
+	}
+	rewind(&spb.AdminRewindDurableRequest{Channel: "foo", ClientID: clientName, DurableName: "dur",
+		StartTime: m.Timestamp}, nil, 2)
+	checkDurable(1, 0)
+
+	// The resumed durable gets the messages from the new position.
+	sc = NewDefaultConnection(t)
+	if _, err := sc.Subscribe("foo", cb, stan.DurableName("dur"),
+		stan.SetManualAckMode(), stan.AckWait(time.Minute)); err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+	for seq := uint64(2); seq <= 5; seq++ {
+		select {
+		case m := <-ch:
+			if m.Sequence != seq || m.Redelivered {
+				t.Fatalf("Expected message %v, got %v (redelivered=%v)", seq, m.Sequence, m.Redelivered)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Did not get our message")
+		}
+	}
+	select {
+	case m := <-ch:
+		t.Fatalf("Unexpected message: %v", m.Sequence)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestAdminExportImportDurable(t *testing.T) {
+	s := RunServer(clusterName)
+	defer s.Shutdown()
+
+	nc, err := nats.Connect(nats.DefaultURL)
+	if err != nil {
+		t.Fatalf("Unexpected error on connect: %v", err)
+	}
+	defer nc.Close()
+
+	sc := NewDefaultConnection(t)
+	defer sc.Close()
+
+	ch := make(chan *stan.Msg, 10)
+	cb := func(m *stan.Msg) { ch <- m }
+	if _, err := sc.Subscribe("foo", cb, stan.DurableName("dur"),
+		stan.SetManualAckMode(), stan.AckWait(time.Minute)); err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+	publish := func(count int) {
+		for i := 0; i < count; i++ {
+			if err := sc.Publish("foo", []byte("hello")); err != nil {
+				stackFatalf(t, "Unexpected error on publish: %v", err)
+			}
+		}
+	}
+	publish(5)
+	for i := 0; i < 5; i++ {
+		select {
+		case m := <-ch:
+			// Leave messages 2 and 5 pending.
+			if m.Sequence != 2 && m.Sequence != 5 {
+				m.Ack()
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Did not get our message")
+		}
+	}
+	waitForCount(t, 2, func() (string, int) {
+		resp := &spb.AdminDurablesResponse{}
+		sendAdminRequest(t, nc, AdminDurables, &spb.AdminDurablesRequest{Channel: "foo"}, resp)
+		if len(resp.Durables) != 1 {
+			stackFatalf(t, "Unexpected response: %v", resp)
+		}
+		return "pending messages", int(resp.Durables[0].PendingCount)
+	})
+
+	export := func(req *spb.AdminExportDurableRequest, expectedErr error) *spb.AdminDurableState {
+		resp := &spb.AdminExportDurableResponse{}
+		sendAdminRequest(t, nc, AdminExportDurable, req, resp)
+		if (expectedErr == nil && resp.Error != "") ||
+			(expectedErr != nil && resp.Error != expectedErr.Error()) {
+			stackFatalf(t, "Expected error %v, got %v", expectedErr, resp.Error)
+		}
+		return resp.State
+	}
+	export(&spb.AdminExportDurableRequest{Channel: "foo", ClientID: clientName}, ErrInvalidAdminReq)
+	export(&spb.AdminExportDurableRequest{Channel: "foo", ClientID: clientName, DurableName: "other"},
+		ErrUnknownDurable)
+	export(&spb.AdminExportDurableRequest{Channel: "foo", ClientID: clientName, DurableName: "dur"},
+		ErrDurableActive)
+
+	sc.Close()
+	state := export(&spb.AdminExportDurableRequest{Channel: "foo", ClientID: clientName, DurableName: "dur"}, nil)
+	if state == nil || state.Channel != "foo" || state.ClientID != clientName ||
+		state.Sub.DurableName != "dur" || state.Sub.LastSent != 5 ||
+		len(state.Pending) != 2 || state.Pending[0] != 2 || state.Pending[1] != 5 {
+		t.Fatalf("Unexpected state: %v", state)
+	}
+	b, err := state.Marshal()
+	if err != nil {
+		t.Fatalf("Unexpected error on marshal: %v", err)
+	}
+
+	// Import the state on a new server, whose channel has the same messages.
+	nc.Close()
+	s.Shutdown()
+	s = RunServer(clusterName)
+	defer s.Shutdown()
+	if nc, err = nats.Connect(nats.DefaultURL); err != nil {
+		t.Fatalf("Unexpected error on connect: %v", err)
+	}
+	defer nc.Close()
+
+	importState := func(req *spb.AdminImportDurableRequest, expectedErr error) {
+		resp := &spb.AdminImportDurableResponse{}
+		sendAdminRequest(t, nc, AdminImportDurable, req, resp)
+		if (expectedErr == nil && resp.Error != "") ||
+			(expectedErr != nil && resp.Error != expectedErr.Error()) {
+			stackFatalf(t, "Expected error %v, got %v", expectedErr, resp.Error)
+		}
+	}
+	state = &spb.AdminDurableState{}
+	if err := state.Unmarshal(b); err != nil {
+		t.Fatalf("Unexpected error on unmarshal: %v", err)
+	}
+	importState(&spb.AdminImportDurableRequest{}, ErrInvalidAdminReq)
+	importState(&spb.AdminImportDurableRequest{State: state}, ErrUnknownChannel)
+
+	sc = NewDefaultConnection(t)
+	publish(4)
+	importState(&spb.AdminImportDurableRequest{State: state}, ErrInvalidSequence)
+	publish(1)
+	importState(&spb.AdminImportDurableRequest{State: state}, nil)
+	importState(&spb.AdminImportDurableRequest{State: state}, ErrDupDurable)
+	importState(&spb.AdminImportDurableRequest{State: state, Replace: true}, nil)
+
+	resp := &spb.AdminDurablesResponse{}
+	sendAdminRequest(t, nc, AdminDurables, &spb.AdminDurablesRequest{Channel: "foo"}, resp)
+	if len(resp.Durables) != 1 || resp.Durables[0].LastSent != 5 ||
+		resp.Durables[0].PendingCount != 2 || resp.Durables[0].Active {
+		t.Fatalf("Unexpected response: %v", resp)
+	}
+
+	// The resumed durable gets its pending messages, then the new ones.
+	if _, err := sc.Subscribe("foo", cb, stan.DurableName("dur"),
+		stan.SetManualAckMode(), stan.AckWait(time.Minute)); err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+	for _, seq := range []uint64{2, 5, 6} {
+		if seq == 6 {
+			publish(1)
+		}
+		select {
+		case m := <-ch:
+			if m.Sequence != seq || m.Redelivered != (seq != 6) {
+				t.Fatalf("Expected message %v, got %v (redelivered=%v)", seq, m.Sequence, m.Redelivered)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Did not get our message")
+		}
+	}
+	select {
+	case m := <-ch:
+		t.Fatalf("Unexpected message: %v", m.Sequence)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestAdminQueues(t *testing.T) {
+	s := RunServer(clusterName)
+	defer s.Shutdown()
+
+	nc, err := nats.Connect(nats.DefaultURL)
+	if err != nil {
+		t.Fatalf("Unexpected error on connect: %v", err)
+	}
+	defer nc.Close()
+
+	sc := NewDefaultConnection(t)
+	defer sc.Close()
+	sc2, err := stan.Connect(clusterName, "otherClient")
+	if err != nil {
+		t.Fatalf("Unexpected error on connect: %v", err)
+	}
+	defer sc2.Close()
+
+	ch := make(chan *stan.Msg, 10)
+	otherCh := make(chan *stan.Msg, 10)
+	if _, err := sc.QueueSubscribe("foo", "group", func(m *stan.Msg) { ch <- m },
+		stan.SetManualAckMode(), stan.AckWait(time.Minute)); err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+	if _, err := sc2.QueueSubscribe("foo", "group", func(m *stan.Msg) { otherCh <- m },
+		stan.SetManualAckMode(), stan.AckWait(time.Minute)); err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+	if _, err := sc.QueueSubscribe("bar", "group", func(_ *stan.Msg) {}); err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+	if _, err := sc.Subscribe("bar", func(_ *stan.Msg) {}); err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+	// Each member gets a message.
+	start := time.Now().UnixNano()
+	for i := 0; i < 2; i++ {
+		if err := sc.Publish("foo", []byte("hello")); err != nil {
+			t.Fatalf("Unexpected error on publish: %v", err)
+		}
+	}
+	var otherMsg *stan.Msg
+	for _, c := range []chan *stan.Msg{ch, otherCh} {
+		select {
+		case otherMsg = <-c:
+		case <-time.After(5 * time.Second):
+			t.Fatal("Did not get our message")
+		}
+	}
+
+	listQueues := func(req *spb.AdminQueuesRequest) *spb.AdminQueuesResponse {
+		resp := &spb.AdminQueuesResponse{}
+		sendAdminRequest(t, nc, AdminQueues, req, resp)
+		return resp
+	}
+	resp := listQueues(&spb.AdminQueuesRequest{})
+	if resp.Error != "" || len(resp.Members) != 3 {
+		t.Fatalf("Unexpected response: %v", resp)
+	}
+	expected := []spb.AdminQueueMemberInfo{
+		{Channel: "bar", QGroup: "group", ClientID: clientName},
+		{Channel: "foo", QGroup: "group", ClientID: clientName, PendingCount: 1},
+		{Channel: "foo", QGroup: "group", ClientID: "otherClient", PendingCount: 1},
+	}
+	for i, q := range resp.Members {
+		if *q != expected[i] {
+			t.Fatalf("Expected member %v, got %v", expected[i], *q)
+		}
+	}
+	if resp := listQueues(&spb.AdminQueuesRequest{Channel: "baz"}); resp.Error != ErrUnknownChannel.Error() {
+		t.Fatalf("Expected error %v, got %v", ErrUnknownChannel, resp.Error)
+	}
+	if resp := listQueues(&spb.AdminQueuesRequest{Channel: "foo", QGroup: "other"}); resp.Error != "" || len(resp.Members) != 0 {
+		t.Fatalf("Unexpected response: %v", resp)
+	}
+
+	// Once otherClient's member acks its message, its last ack time is reported.
+	if err := otherMsg.Ack(); err != nil {
+		t.Fatalf("Unexpected error on ack: %v", err)
+	}
+	waitForCount(t, 0, func() (string, int) {
+		members := listQueues(&spb.AdminQueuesRequest{Channel: "foo"}).Members
+		return "pending messages", int(members[1].PendingCount)
+	})
+	resp = listQueues(&spb.AdminQueuesRequest{Channel: "foo", QGroup: "group"})
+	if resp.Error != "" || len(resp.Members) != 2 {
+		t.Fatalf("Unexpected response: %v", resp)
+	}
+	if m := resp.Members[0]; m.ClientID != clientName || m.PendingCount != 1 || m.LastAckTime != 0 {
+		t.Fatalf("Unexpected member: %v", m)
+	}
+	if m := resp.Members[1]; m.ClientID != "otherClient" || m.PendingCount != 0 || m.LastAckTime < start {
+		t.Fatalf("Unexpected member: %v", m)
+	}
+}
+
+func TestAdminChannels(t *testing.T) {
+	s := RunServer(clusterName)
+	defer s.Shutdown()
+
+	nc, err := nats.Connect(nats.DefaultURL)
+	if err != nil {
+		t.Fatalf("Unexpected error on connect: %v", err)
+	}
+	defer nc.Close()
+
+	sc := NewDefaultConnection(t)
+	defer sc.Close()
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		if err := sc.Publish("foo", []byte("hello")); err != nil {
+			t.Fatalf("Unexpected error on publish: %v", err)
+		}
+	}
+	if _, err := sc.Subscribe("bar", func(_ *stan.Msg) {}); err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+
+	resp := &spb.AdminChannelsResponse{}
+	sendAdminRequest(t, nc, AdminChannels, &spb.AdminChannelsRequest{}, resp)
+	if resp.Error != "" || len(resp.Channels) != 2 {
+		t.Fatalf("Unexpected response: %v", resp)
+	}
+	for _, c := range resp.Channels {
+		if c.Created < start.Add(-time.Second).UnixNano() || c.Created > time.Now().UnixNano() {
+			t.Fatalf("Unexpected creation time for %s: %v", c.Name, time.Unix(0, c.Created))
+		}
+		c.Created = 0
+	}
+	bar := spb.AdminChannelInfo{Name: "bar"}
+	foo := spb.AdminChannelInfo{Name: "foo", FirstSeq: 1, LastSeq: 3, Msgs: 3, Bytes: 15}
+	if *resp.Channels[0] != bar || *resp.Channels[1] != foo {
+		t.Fatalf("Unexpected channels: %v", resp.Channels)
+	}
+
+	resp = &spb.AdminChannelsResponse{}
+	sendAdminRequest(t, nc, AdminChannels, &spb.AdminChannelsRequest{Channel: "foo"}, resp)
+	if resp.Error != "" || len(resp.Channels) != 1 || resp.Channels[0].Name != "foo" {
+		t.Fatalf("Unexpected response: %v", resp)
+	}
+
+	resp = &spb.AdminChannelsResponse{}
+	sendAdminRequest(t, nc, AdminChannels, &spb.AdminChannelsRequest{Channel: "baz"}, resp)
+	if resp.Error != ErrUnknownChannel.Error() {
+		t.Fatalf("Expected error %v, got %v", ErrUnknownChannel, resp.Error)
+	}
+}
+
+func TestAdminPurgeChannel(t *testing.T) {
+	s := RunServer(clusterName)
+	defer s.Shutdown()
+
+	nc, err := nats.Connect(nats.DefaultURL)
+	if err != nil {
+		t.Fatalf("Unexpected error on connect: %v", err)
+	}
+	defer nc.Close()
+
+	sc := NewDefaultConnection(t)
+	defer sc.Close()
+	for i := 0; i < 10; i++ {
+		if err := sc.Publish("foo", []byte("hello")); err != nil {
+			t.Fatalf("Unexpected error on publish: %v", err)
+		}
+	}
+	cs := s.store.LookupChannel("foo")
+
+	resp := &spb.AdminPurgeChannelResponse{}
+	sendAdminRequest(t, nc, AdminPurgeChannel, &spb.AdminPurgeChannelRequest{Channel: "foo", Sequence: 4}, resp)
+	if resp.Error != "" || resp.Purged != 3 {
+		t.Fatalf("Unexpected response: %v", resp)
+	}
+	if first, last := cs.Msgs.FirstAndLastSequence(); first != 4 || last != 10 {
+		t.Fatalf("Unexpected sequences: %v-%v", first, last)
+	}
+	// The last message is kept.
+	resp = &spb.AdminPurgeChannelResponse{}
+	sendAdminRequest(t, nc, AdminPurgeChannel, &spb.AdminPurgeChannelRequest{Channel: "foo"}, resp)
+	if resp.Error != "" || resp.Purged != 6 {
+		t.Fatalf("Unexpected response: %v", resp)
+	}
+	if first, last := cs.Msgs.FirstAndLastSequence(); first != 10 || last != 10 {
+		t.Fatalf("Unexpected sequences: %v-%v", first, last)
+	}
+
+	resp = &spb.AdminPurgeChannelResponse{}
+	sendAdminRequest(t, nc, AdminPurgeChannel, &spb.AdminPurgeChannelRequest{Channel: "bar"}, resp)
+	if resp.Error != ErrUnknownChannel.Error() {
+		t.Fatalf("Expected error %v, got %v", ErrUnknownChannel, resp.Error)
+	}
+	resp = &spb.AdminPurgeChannelResponse{}
+	sendAdminRequest(t, nc, AdminPurgeChannel, &spb.AdminPurgeChannelRequest{}, resp)
+	if resp.Error != ErrInvalidAdminReq.Error() {
+		t.Fatalf("Expected error %v, got %v", ErrInvalidAdminReq, resp.Error)
+	}
+}
+
+func TestAdminLimits(t *testing.T) {
+	opts := GetDefaultOptions()
+	opts.MaxMsgs = 100
+	opts.Channels = []*ChannelConfig{{Name: "foo", MaxMsgs: 10, MaxBytes: 1024}}
+	s := runServerWithOpts(t, opts, nil)
+	defer s.Shutdown()
+
+	nc, err := nats.Connect(nats.DefaultURL)
+	if err != nil {
+		t.Fatalf("Unexpected error on connect: %v", err)
+	}
+	defer nc.Close()
+
+	resp := &spb.AdminLimitsResponse{}
+	sendAdminRequest(t, nc, AdminLimits, &spb.AdminLimitsRequest{}, resp)
+	if resp.Error != "" || resp.MaxChannels != DefaultChannelLimit || resp.MaxMsgs != 100 ||
+		resp.MaxBytes != DefaultMsgStoreLimit*1024 || resp.MaxSubs != DefaultSubStoreLimit {
+		t.Fatalf("Unexpected response: %v", resp)
+	}
+	resp = &spb.AdminLimitsResponse{}
+	sendAdminRequest(t, nc, AdminLimits, &spb.AdminLimitsRequest{Channel: "foo"}, resp)
+	if resp.Error != "" || resp.MaxMsgs != 10 || resp.MaxBytes != 1024 || resp.MaxSubs != DefaultSubStoreLimit {
+		t.Fatalf("Unexpected response: %v", resp)
+	}
+	resp = &spb.AdminLimitsResponse{}
+	sendAdminRequest(t, nc, AdminLimits, &spb.AdminLimitsRequest{Channel: "bar"}, resp)
+	if resp.Error != "" || resp.MaxMsgs != 100 {
+		t.Fatalf("Unexpected response: %v", resp)
+	}
+	resp = &spb.AdminLimitsResponse{}
+	sendAdminRequest(t, nc, AdminLimits, &spb.AdminLimitsRequest{Channel: "foo.*"}, resp)
+	if resp.Error != ErrInvalidAdminReq.Error() {
+		t.Fatalf("Expected error %v, got %v", ErrInvalidAdminReq, resp.Error)
+	}
+}
+
+func TestAdminCopyMsgs(t *testing.T) {
+	s := RunServer(clusterName)
+	defer s.Shutdown()
+
+	nc, err := nats.Connect(nats.DefaultURL)
+	if err != nil {
+		t.Fatalf("Unexpected error on connect: %v", err)
+	}
+	defer nc.Close()
+
+	sc := NewDefaultConnection(t)
+	defer sc.Close()
+
+	for i := 1; i <= 5; i++ {
+		if err := sc.Publish("foo", []byte(fmt.Sprintf("msg%d", i))); err != nil {
+			t.Fatalf("Unexpected error on publish: %v", err)
+		}
+	}
+	ch := make(chan *stan.Msg, 10)
+	if _, err := sc.Subscribe("bar", func(m *stan.Msg) { ch <- m }); err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+
+	copyMsgs := func(req *spb.AdminCopyMsgsRequest, expectedErr error) *spb.AdminCopyMsgsResponse {
+		resp := &spb.AdminCopyMsgsResponse{}
+		sendAdminRequest(t, nc, AdminCopyMsgs, req, resp)
+		if (expectedErr == nil && resp.Error != "") ||
+			(expectedErr != nil && resp.Error != expectedErr.Error()) {
+			stackFatalf(t, "Expected error %v, got %v", expectedErr, resp.Error)
+		}
+		return resp
+	}
+	copyMsgs(&spb.AdminCopyMsgsRequest{Channel: "foo"}, ErrInvalidAdminReq)
+	copyMsgs(&spb.AdminCopyMsgsRequest{Channel: "foo", Target: "foo"}, ErrInvalidAdminReq)
+	copyMsgs(&spb.AdminCopyMsgsRequest{Channel: "foo", Target: "bar", StartSequence: 3, EndSequence: 2}, ErrInvalidAdminReq)
+	copyMsgs(&spb.AdminCopyMsgsRequest{Channel: "baz", Target: "bar"}, ErrUnknownChannel)
+	copyMsgs(&spb.AdminCopyMsgsRequest{Channel: "foo", Target: "_STAN.bar"}, ErrReservedChannel)
+
+	checkCopies := func(first, last uint64, seq uint64) {
+		src := s.store.LookupChannel("foo").Msgs
+		for i := first; i <= last; i++ {
+			select {
+			case m := <-ch:
+				orig, _ := src.Lookup(i)
+				if m.Subject != "bar" || m.Sequence != seq || string(m.Data) != string(orig.Data) ||
+					m.Timestamp != orig.Timestamp {
+					stackFatalf(t, "Unexpected copy of %v: %v", orig, m)
+				}
+				seq++
+			case <-time.After(5 * time.Second):
+				stackFatalf(t, "Did not get our message")
+			}
+		}
+	}
+	resp := copyMsgs(&spb.AdminCopyMsgsRequest{Channel: "foo", Target: "bar", StartSequence: 2, EndSequence: 4}, nil)
+	if resp.Copied != 3 || resp.FirstSequence != 1 || resp.LastSequence != 3 {
+		t.Fatalf("Unexpected response: %v", resp)
+	}
+	checkCopies(2, 4, 1)
+
+	// The whole channel is copied by default, after the previous copies.
+	resp = copyMsgs(&spb.AdminCopyMsgsRequest{Channel: "foo", Target: "bar"}, nil)
+	if resp.Copied != 5 || resp.FirstSequence != 4 || resp.LastSequence != 8 {
+		t.Fatalf("Unexpected response: %v", resp)
+	}
+	checkCopies(1, 5, 4)
+
+	// The target channel is created if needed.
+	resp = copyMsgs(&spb.AdminCopyMsgsRequest{Channel: "foo", Target: "baz", StartSequence: 5, EndSequence: 10}, nil)
+	if resp.Copied != 1 || resp.FirstSequence != 1 || resp.LastSequence != 1 {
+		t.Fatalf("Unexpected response: %v", resp)
+	}
+	if s.store.LookupChannel("baz") == nil {
+		t.Fatal("Target channel should have been created")
+	}
+}
+
+func TestAdminLameDuck(t *testing.T) {
+	s := RunServer(clusterName)
+	defer s.Shutdown()
+
+	nc, err := nats.Connect(nats.DefaultURL)
+	if err != nil {
+		t.Fatalf("Unexpected error on connect: %v", err)
+	}
+	defer nc.Close()
+
+	resp := &spb.AdminLameDuckResponse{}
+	sendAdminRequest(t, nc, AdminLameDuck, &spb.AdminLameDuckRequest{TimeoutInSecs: -1}, resp)
+	if resp.Error != ErrInvalidAdminReq.Error() {
+		t.Fatalf("Expected error %v, got %v", ErrInvalidAdminReq, resp.Error)
+	}
+	resp = &spb.AdminLameDuckResponse{}
+	sendAdminRequest(t, nc, AdminLameDuck, &spb.AdminLameDuckRequest{TimeoutInSecs: 1}, resp)
+	if resp.Error != "" {
+		t.Fatalf("Unexpected error: %v", resp.Error)
+	}
+	// Nothing is in flight, so the server shuts down right away.
+	select {
+	case <-s.LameDuckDone():
+	case <-time.After(2 * time.Second):
+		t.Fatal("Server should have shut down")
+	}
+}
@@ -0,0 +1,218 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats-streaming-server/spb"
+)
+
+// Timeout of the administrative requests received on the admin socket.
+const adminSocketTimeout = 30 * time.Second
+
+// adminMsg is implemented by the administrative requests and responses.
+type adminMsg interface {
+	Marshal() ([]byte, error)
+	Unmarshal([]byte) error
+}
+
+// adminSocketRequests returns, for each administrative request accepted
+// on the admin socket, a new request and a new response.
+var adminSocketRequests = map[string]func() (adminMsg, adminMsg){
+	AdminClients: func() (adminMsg, adminMsg) {
+		return &spb.AdminClientsRequest{}, &spb.AdminClientsResponse{}
+	},
+	AdminCloseClient: func() (adminMsg, adminMsg) {
+		return &spb.AdminCloseClientRequest{}, &spb.AdminCloseClientResponse{}
+	},
+	AdminDurables: func() (adminMsg, adminMsg) {
+		return &spb.AdminDurablesRequest{}, &spb.AdminDurablesResponse{}
+	},
+	AdminDeleteDurable: func() (adminMsg, adminMsg) {
+		return &spb.AdminDeleteDurableRequest{}, &spb.AdminDeleteDurableResponse{}
+	},
+	AdminRewindDurable: func() (adminMsg, adminMsg) {
+		return &spb.AdminRewindDurableRequest{}, &spb.AdminRewindDurableResponse{}
+	},
+	AdminQueues: func() (adminMsg, adminMsg) {
+		return &spb.AdminQueuesRequest{}, &spb.AdminQueuesResponse{}
+	},
+	AdminLameDuck: func() (adminMsg, adminMsg) {
+		return &spb.AdminLameDuckRequest{}, &spb.AdminLameDuckResponse{}
+	},
+	AdminChannels: func() (adminMsg, adminMsg) {
+		return &spb.AdminChannelsRequest{}, &spb.AdminChannelsResponse{}
+	},
+	AdminCreateChannel: func() (adminMsg, adminMsg) {
+		return &spb.AdminCreateChannelRequest{}, &spb.AdminCreateChannelResponse{}
+	},
+	AdminExportDurable: func() (adminMsg, adminMsg) {
+		return &spb.AdminExportDurableRequest{}, &spb.AdminExportDurableResponse{}
+	},
+	AdminImportDurable: func() (adminMsg, adminMsg) {
+		return &spb.AdminImportDurableRequest{}, &spb.AdminImportDurableResponse{}
+	},
+	AdminCopyMsgs: func() (adminMsg, adminMsg) {
+		return &spb.AdminCopyMsgsRequest{}, &spb.AdminCopyMsgsResponse{}
+	},
+	AdminSnapshot: func() (adminMsg, adminMsg) {
+		return &spb.AdminSnapshotRequest{}, &spb.AdminSnapshotResponse{}
+	},
+	AdminPurgeChannel: func() (adminMsg, adminMsg) {
+		return &spb.AdminPurgeChannelRequest{}, &spb.AdminPurgeChannelResponse{}
+	},
+	AdminLimits: func() (adminMsg, adminMsg) {
+		return &spb.AdminLimitsRequest{}, &spb.AdminLimitsResponse{}
+	},
+}
+
+// startAdminSocket starts accepting administrative requests on the
+// AdminSocket Unix domain socket, which only the user running the server
+// can connect to. Each request is a line with the name of the request,
+// optionally followed by the request in JSON, for instance:
+//
+//	channels {"channel": "foo"}
+//
+// and is answered with a line with the response in JSON. The requests
+// are processed as those received on the admin subjects, without
+// credentials.
+func (s *StanServer) startAdminSocket() error {
+	if s.opts.AdminSocket == "" {
+		return nil
+	}
+	l, err := listen(unixAddrPrefix + s.opts.AdminSocket)
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(s.opts.AdminSocket, 0600); err != nil {
+		l.Close()
+		return err
+	}
+	s.adminSockListener = l
+	s.adminSockConns = make(map[net.Conn]struct{})
+	Noticef("STAN: Listening for admin requests on %s", s.opts.AdminSocket)
+	s.adminSockWg.Add(1)
+	go s.adminSocketAcceptLoop(l)
+	return nil
+}
+
+// stopAdminSocket stops accepting admin connections, closes the existing
+// ones and waits for their go routines to return.
+func (s *StanServer) stopAdminSocket() {
+	if s.adminSockListener == nil {
+		return
+	}
+	s.adminSockListener.Close()
+	s.adminSockLock.Lock()
+	for c := range s.adminSockConns {
+		c.Close()
+	}
+	s.adminSockConns = nil
+	s.adminSockLock.Unlock()
+	s.adminSockWg.Wait()
+}
+
+func (s *StanServer) adminSocketAcceptLoop(l net.Listener) {
+	defer s.adminSockWg.Done()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		s.adminSockLock.Lock()
+		if s.adminSockConns == nil {
+			s.adminSockLock.Unlock()
+			conn.Close()
+			return
+		}
+		s.adminSockConns[conn] = struct{}{}
+		s.adminSockLock.Unlock()
+		s.adminSockWg.Add(1)
+		go s.handleAdminSocketConn(conn)
+	}
+}
+
+// handleAdminSocketConn answers the requests of the connection until it
+// is closed.
+func (s *StanServer) handleAdminSocketConn(conn net.Conn) {
+	defer s.adminSockWg.Done()
+	defer func() {
+		conn.Close()
+		s.adminSockLock.Lock()
+		if s.adminSockConns != nil {
+			delete(s.adminSockConns, conn)
+		}
+		s.adminSockLock.Unlock()
+	}()
+	br := bufio.NewReader(conn)
+	for {
+		line, err := br.ReadString('\n')
+		if line = strings.TrimSpace(line); line != "" {
+			if _, werr := conn.Write(append(s.processAdminSocketRequest(line), '\n')); werr != nil {
+				return
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// processAdminSocketRequest processes a request line of the admin socket
+// and returns the response in JSON. The request is sent to its admin
+// subject, so that it is processed as any administrative request.
+func (s *StanServer) processAdminSocketRequest(line string) []byte {
+	name, body := line, ""
+	if i := strings.IndexAny(line, " \t"); i >= 0 {
+		name, body = line[:i], strings.TrimSpace(line[i:])
+	}
+	newMsgs, ok := adminSocketRequests[name]
+	if !ok {
+		return adminSocketError(fmt.Errorf("unknown admin request %q", name))
+	}
+	req, resp := newMsgs()
+	if body != "" {
+		if err := json.Unmarshal([]byte(body), req); err != nil {
+			return adminSocketError(fmt.Errorf("%v: %v", ErrInvalidAdminReq, err))
+		}
+	}
+	if err := s.forwardAdminRequest(name, req, resp, adminSocketTimeout); err != nil {
+		return adminSocketError(err)
+	}
+	b, err := json.Marshal(resp)
+	if err != nil {
+		return adminSocketError(err)
+	}
+	return b
+}
+
+// forwardAdminRequest sends the administrative request to its admin
+// subject, so that it is processed as any administrative request, and
+// decodes the reply into resp.
+func (s *StanServer) forwardAdminRequest(name string, req, resp adminMsg, timeout time.Duration) error {
+	data, err := req.Marshal()
+	if err != nil {
+		return err
+	}
+	reply, err := s.nc.Request(AdminSubject(s.info.ClusterID, name), data, timeout)
+	if err != nil {
+		return err
+	}
+	return resp.Unmarshal(reply.Data)
+}
+
+// adminSocketError returns the JSON response of a request of the admin
+// socket that failed before being processed.
+func adminSocketError(err error) []byte {
+	b, _ := json.Marshal(struct {
+		Error string `json:"error"`
+	}{err.Error()})
+	return b
+}
@@ -0,0 +1,85 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/nats-io/nats-streaming-server/spb"
+)
+
+func TestAdminSocket(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "stan_server_adminsocket_")
+	if err != nil {
+		t.Fatalf("Unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	path := filepath.Join(tmpDir, "admin.sock")
+
+	opts := GetDefaultOptions()
+	opts.AdminSocket = path
+	s := runServerWithOpts(t, opts, nil)
+	defer s.Shutdown()
+
+	if fi, err := os.Stat(path); err != nil || fi.Mode().Perm() != 0600 {
+		t.Fatalf("Unexpected socket mode: %v, %v", fi, err)
+	}
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("Unable to connect to admin socket: %v", err)
+	}
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+	request := func(line string, resp interface{}) {
+		if _, err := fmt.Fprintf(conn, "%s\n", line); err != nil {
+			stackFatalf(t, "Error sending request: %v", err)
+		}
+		b, err := br.ReadBytes('\n')
+		if err != nil {
+			stackFatalf(t, "Error reading response: %v", err)
+		}
+		if err := json.Unmarshal(b, resp); err != nil {
+			stackFatalf(t, "Invalid response %q: %v", b, err)
+		}
+	}
+
+	createResp := &spb.AdminCreateChannelResponse{}
+	request(`createchannel {"channel": "foo"}`, createResp)
+	if createResp.Error != "" {
+		t.Fatalf("Unexpected error: %v", createResp.Error)
+	}
+	channelsResp := &spb.AdminChannelsResponse{}
+	request("channels", channelsResp)
+	if channelsResp.Error != "" || len(channelsResp.Channels) != 1 || channelsResp.Channels[0].Name != "foo" {
+		t.Fatalf("Unexpected response: %v", channelsResp)
+	}
+	snapResp := &spb.AdminSnapshotResponse{}
+	request("snapshot", snapResp)
+	if snapResp.Error != "" || snapResp.Snapshot || snapResp.Channels != 1 {
+		t.Fatalf("Unexpected response: %v", snapResp)
+	}
+	for _, line := range []string{"bogus", `channels {"channel": 12}`} {
+		resp := &spb.AdminChannelsResponse{}
+		request(line, resp)
+		if resp.Error == "" {
+			t.Fatalf("Expected error for %q", line)
+		}
+	}
+	// Empty lines are ignored.
+	request("\n  \nchannels", channelsResp)
+	if len(channelsResp.Channels) != 1 {
+		t.Fatalf("Unexpected response: %v", channelsResp)
+	}
+
+	s.Shutdown()
+	if _, err := br.ReadString('\n'); err == nil {
+		t.Fatal("Connection should have been closed")
+	}
+}
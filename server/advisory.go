@@ -0,0 +1,132 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Advisories are stored, in JSON, in the channel returned by
+// AdvisoryChannel(), which is the DefaultAdvisoryPrefix followed by one of
+// these advisory names. Except for AdvisorySlowConsumer and
+// AdvisoryConsumerLag, they have the format of the audit log records.
+const (
+	AdvisoryClientConnect       = auditClientConnect
+	AdvisoryClientDisconnect    = auditClientDisconnect
+	AdvisoryClientReplaced      = auditClientReplaced
+	AdvisorySubCreate           = auditSubCreate
+	AdvisorySubClose            = auditSubClose
+	AdvisorySubUnsubscribe      = auditSubUnsubscribe
+	AdvisoryChannelCreate       = auditChannelCreate
+	AdvisoryLimitViolation      = auditLimitViolation
+	AdvisoryPermissionViolation = auditPermissionViolation
+	AdvisoryStoreError          = auditStoreError
+	// AdvisorySlowConsumer is stored when a subscription stays at its
+	// MaxInFlight for longer than the SlowConsumerTimeout option (see
+	// SlowConsumerAdvisory).
+	AdvisorySlowConsumer = auditSlowConsumer
+	// AdvisoryConsumerLag is stored when the lag of a subscription stays
+	// above the ConsumerLagThreshold option for longer than the
+	// ConsumerLagDuration option (see ConsumerLagAdvisory).
+	AdvisoryConsumerLag = auditConsumerLag
+)
+
+// Maximum number of advisories waiting to be stored, advisories are dropped
+// beyond that.
+const advisoryQueueSize = 8192
+
+// AdvisoryChannel returns the channel in which the `advisory` is stored.
+func AdvisoryChannel(advisory string) string {
+	return DefaultAdvisoryPrefix + "." + advisory
+}
+
+// isAdvisoryChannel returns true if the channel stores advisories. Events
+// on these channels are not themselves advised.
+func isAdvisoryChannel(channel string) bool {
+	return strings.HasPrefix(channel, DefaultAdvisoryPrefix+".")
+}
+
+type advisoryMsg struct {
+	channel string
+	data    []byte
+}
+
+// advisories queues the advisories, which are stored by a go routine so
+// that events can be advised while holding locks, including the ones
+// needed to store a message.
+type advisories struct {
+	sync.Mutex
+	msgs   chan *advisoryMsg
+	closed bool
+	wg     sync.WaitGroup
+}
+
+// startAdvisories starts storing the advisories, if enabled.
+func (s *StanServer) startAdvisories() {
+	if !s.opts.Advisories {
+		return
+	}
+	s.advisories = &advisories{msgs: make(chan *advisoryMsg, advisoryQueueSize)}
+	s.advisories.wg.Add(1)
+	go func() {
+		defer s.advisories.wg.Done()
+		for am := range s.advisories.msgs {
+			if s.isStorageFull() || s.isMemoryBudgetExceeded() {
+				continue
+			}
+			if _, err := s.storeAndDeliver(am.channel, "", am.data); err != nil {
+				Errorf("STAN: Unable to store advisory in channel=%s: %v", am.channel, err)
+			}
+		}
+	}()
+}
+
+// stopAdvisories stores the queued advisories and waits for the go routine
+// to return. It must be called before the store is closed.
+func (s *StanServer) stopAdvisories() {
+	a := s.advisories
+	if a == nil {
+		return
+	}
+	a.Lock()
+	a.closed = true
+	close(a.msgs)
+	a.Unlock()
+	a.wg.Wait()
+}
+
+// recordEvent records the event in the audit log and stores it as an
+// advisory, if enabled.
+func (s *StanServer) recordEvent(r *auditRecord) {
+	r.Time = time.Now().UTC().Format(time.RFC3339Nano)
+	s.audit.record(r)
+	if !isAdvisoryChannel(r.Channel) {
+		s.publishAdvisory(r.Event, r)
+	}
+}
+
+// publishAdvisory queues the advisory, in JSON, to be stored in its
+// channel. It is dropped if advisories are not enabled or if too many are
+// waiting to be stored.
+func (s *StanServer) publishAdvisory(advisory string, v interface{}) {
+	a := s.advisories
+	if a == nil {
+		return
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return
+	}
+	a.Lock()
+	defer a.Unlock()
+	if a.closed {
+		return
+	}
+	select {
+	case a.msgs <- &advisoryMsg{channel: AdvisoryChannel(advisory), data: b}:
+	default:
+	}
+}
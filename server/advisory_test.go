@@ -0,0 +1,100 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/nats-io/go-nats-streaming"
+)
+
+// getAdvisories returns the advisories stored in the channel, once there
+// are `expected` of them.
+func getAdvisories(t *testing.T, s *StanServer, advisory string, expected int) []auditRecord {
+	channel := AdvisoryChannel(advisory)
+	waitForCount(t, expected, func() (string, int) {
+		cs := s.store.LookupChannel(channel)
+		if cs == nil {
+			return channel, 0
+		}
+		return channel, int(cs.Msgs.LastSequence())
+	})
+	msgs := s.store.LookupChannel(channel).Msgs
+	var records []auditRecord
+	for seq := uint64(1); seq <= uint64(expected); seq++ {
+		r := auditRecord{}
+		m, err := msgs.Lookup(seq)
+		if err != nil {
+			stackFatalf(t, "Unable to lookup advisory: %v", err)
+		}
+		if err := json.Unmarshal(m.Data, &r); err != nil {
+			stackFatalf(t, "Invalid advisory: %v", err)
+		}
+		if r.Time == "" || r.Event != advisory {
+			stackFatalf(t, "Unexpected advisory: %+v", r)
+		}
+		records = append(records, r)
+	}
+	return records
+}
+
+func TestAdvisories(t *testing.T) {
+	opts := GetDefaultOptions()
+	opts.Advisories = true
+	s := RunServerWithOpts(opts, nil)
+	defer s.Shutdown()
+
+	sc := NewDefaultConnection(t)
+	if _, err := sc.Subscribe("foo", func(_ *stan.Msg) {}, stan.DurableName("dur")); err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+	sub, err := sc.Subscribe("foo", func(_ *stan.Msg) {})
+	if err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+	if err := sub.Unsubscribe(); err != nil {
+		t.Fatalf("Unexpected error on unsubscribe: %v", err)
+	}
+	sc.Close()
+
+	if r := getAdvisories(t, s, AdvisoryClientConnect, 1)[0]; r.Client != clientName || r.Inbox == "" {
+		t.Fatalf("Unexpected advisory: %+v", r)
+	}
+	if r := getAdvisories(t, s, AdvisoryChannelCreate, 1)[0]; r.Client != clientName || r.Channel != "foo" {
+		t.Fatalf("Unexpected advisory: %+v", r)
+	}
+	subs := getAdvisories(t, s, AdvisorySubCreate, 2)
+	if subs[0].Durable != "dur" || subs[1].Durable != "" || subs[1].Channel != "foo" {
+		t.Fatalf("Unexpected advisories: %+v", subs)
+	}
+	if r := getAdvisories(t, s, AdvisorySubUnsubscribe, 1)[0]; r.Inbox != subs[1].Inbox {
+		t.Fatalf("Unexpected advisory: %+v", r)
+	}
+	if r := getAdvisories(t, s, AdvisorySubClose, 1)[0]; r.Durable != "dur" {
+		t.Fatalf("Unexpected advisory: %+v", r)
+	}
+	if r := getAdvisories(t, s, AdvisoryClientDisconnect, 1)[0]; r.Client != clientName || r.Reason != closeReasonRequest {
+		t.Fatalf("Unexpected advisory: %+v", r)
+	}
+	// The creation of the advisory channels is not advised.
+	if got := len(s.store.GetChannelNames()); got != 7 {
+		t.Fatalf("Expected 7 channels, got %v", got)
+	}
+
+	// Advisories are stored in regular channels that applications can
+	// subscribe to.
+	sc = NewDefaultConnection(t)
+	defer sc.Close()
+	ch := make(chan bool, 10)
+	if _, err := sc.Subscribe(AdvisoryChannel(AdvisoryClientConnect), func(_ *stan.Msg) { ch <- true },
+		stan.DeliverAllAvailable()); err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+	getAdvisories(t, s, AdvisoryClientConnect, 2)
+	for i := 0; i < 2; i++ {
+		if err := Wait(ch); err != nil {
+			t.Fatal("Did not get our advisory")
+		}
+	}
+}
@@ -0,0 +1,129 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/nats-io/nats-streaming-server/stores"
+	"github.com/nats-io/nats-streaming-server/util"
+)
+
+// Messages are archived once they are older than this, so that a message
+// being stored while the archive is written, with a timestamp in the
+// archived range, is not missed.
+const archiveDelay = time.Second
+
+// validateArchiveOptions checks the options of the scheduled archiving.
+func validateArchiveOptions(opts *Options) error {
+	if opts.ArchiveDir == "" {
+		return nil
+	}
+	if len(opts.ArchiveChannels) == 0 {
+		return fmt.Errorf("archiving requires channels")
+	}
+	for _, c := range opts.ArchiveChannels {
+		if !isValidSubject(c) && !isValidWildcardSubject(c) {
+			return fmt.Errorf("invalid archive channel %q", c)
+		}
+	}
+	switch opts.ArchiveFormat {
+	case "", stores.ArchiveJSON, stores.ArchiveProto:
+	default:
+		return fmt.Errorf("invalid archive format %q", opts.ArchiveFormat)
+	}
+	if opts.ArchiveInterval < 0 {
+		return fmt.Errorf("invalid archive interval %v", opts.ArchiveInterval)
+	}
+	return nil
+}
+
+// isArchivedChannel returns true if the channel matches one of the
+// archive channels of the options.
+func (s *StanServer) isArchivedChannel(channel string) bool {
+	for _, pattern := range s.opts.ArchiveChannels {
+		if util.SubjectMatches(pattern, channel) {
+			return true
+		}
+	}
+	return false
+}
+
+// startArchiver starts, if enabled, exporting the messages of the archive
+// channels at each interval. Each archive holds the messages stored since
+// the end of the previous one, found from the manifests in the directory.
+func (s *StanServer) startArchiver() error {
+	if s.opts.ArchiveDir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(s.opts.ArchiveDir, os.ModeDir+os.ModePerm); err != nil {
+		return err
+	}
+	ends, err := stores.LastArchiveEnds(s.opts.ArchiveDir)
+	if err != nil {
+		return err
+	}
+	interval := s.opts.ArchiveInterval
+	if interval == 0 {
+		interval = DefaultArchiveInterval
+	}
+	s.archiveQuit = make(chan struct{})
+	s.archiveWg.Add(1)
+	go func() {
+		defer s.archiveWg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-s.archiveQuit:
+				return
+			case <-ticker.C:
+				s.archiveChannels(ends, time.Now().Add(-archiveDelay).UnixNano())
+			}
+		}
+	}()
+	return nil
+}
+
+// stopArchiver stops the archiving and waits for it to return.
+func (s *StanServer) stopArchiver() {
+	if s.archiveQuit == nil {
+		return
+	}
+	close(s.archiveQuit)
+	s.archiveWg.Wait()
+}
+
+// archiveChannels exports the messages of the archive channels stored
+// between the end of their previous archive, in `ends`, and `end`.
+func (s *StanServer) archiveChannels(ends map[string]int64, end int64) {
+	format := s.opts.ArchiveFormat
+	if format == "" {
+		format = stores.ArchiveJSON
+	}
+	infos, err := s.store.GetChannels()
+	if err != nil {
+		Errorf("STAN: Unable to get the channels to archive: %v", err)
+		return
+	}
+	for _, info := range infos {
+		if !s.isArchivedChannel(info.Name) {
+			continue
+		}
+		cs := s.store.LookupChannel(info.Name)
+		if cs == nil {
+			continue
+		}
+		am, err := stores.ExportChannel(cs.Msgs, info.Name, s.opts.ArchiveDir, format, ends[info.Name], end)
+		if err != nil {
+			Errorf("STAN: Unable to archive channel=%s: %v", info.Name, err)
+			continue
+		}
+		ends[info.Name] = end
+		if am.Count > 0 {
+			Noticef("STAN: Archived %d messages of channel=%s to %s", am.Count, info.Name, am.File)
+		}
+	}
+}
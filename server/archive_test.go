@@ -0,0 +1,109 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-streaming-server/stores"
+)
+
+func TestArchiveOptions(t *testing.T) {
+	opts := GetDefaultOptions()
+	opts.ArchiveDir = "archives"
+	if err := validateArchiveOptions(opts); err == nil {
+		t.Fatal("Expected error without archive channels")
+	}
+	opts.ArchiveChannels = []string{"foo.>"}
+	opts.ArchiveFormat = "xml"
+	if err := validateArchiveOptions(opts); err == nil {
+		t.Fatal("Expected error for invalid format")
+	}
+	opts.ArchiveFormat = stores.ArchiveProto
+	opts.ArchiveInterval = -time.Second
+	if err := validateArchiveOptions(opts); err == nil {
+		t.Fatal("Expected error for invalid interval")
+	}
+	opts.ArchiveInterval = 0
+	if err := validateArchiveOptions(opts); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
+
+func TestArchiveChannels(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stan_archives_")
+	if err != nil {
+		t.Fatalf("Unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	opts := GetDefaultOptions()
+	opts.ArchiveDir = dir
+	opts.ArchiveChannels = []string{"foo.*"}
+	// Archives are written by the test.
+	opts.ArchiveInterval = time.Hour
+	s := runServerWithOpts(t, opts, nil)
+	defer s.Shutdown()
+
+	sc := NewDefaultConnection(t)
+	defer sc.Close()
+
+	for _, channel := range []string{"foo.a", "foo.b", "bar"} {
+		for i := 0; i < 3; i++ {
+			if err := sc.Publish(channel, []byte("hello")); err != nil {
+				t.Fatalf("Unexpected error on publish: %v", err)
+			}
+		}
+	}
+	ends := make(map[string]int64)
+	end := time.Now().UnixNano()
+	s.archiveChannels(ends, end)
+	for _, channel := range []string{"foo.a", "foo.b"} {
+		if ends[channel] != end {
+			t.Fatalf("Unexpected end for channel %q: %v", channel, ends[channel])
+		}
+		manifests, _ := filepath.Glob(filepath.Join(dir, channel+".*.manifest.json"))
+		if len(manifests) != 1 {
+			t.Fatalf("Expected one archive of channel %q, got %v", channel, manifests)
+		}
+		am, err := stores.ReadArchiveManifest(manifests[0])
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if am.Count != 3 || am.FirstSeq != 1 || am.LastSeq != 3 || am.Start != 0 || am.End != end {
+			t.Fatalf("Unexpected manifest: %+v", am)
+		}
+	}
+	if _, ok := ends["bar"]; ok {
+		t.Fatal("Channel bar should not have been archived")
+	}
+
+	// The next archive holds only the new messages.
+	if err := sc.Publish("foo.a", []byte("hello")); err != nil {
+		t.Fatalf("Unexpected error on publish: %v", err)
+	}
+	s.archiveChannels(ends, time.Now().UnixNano())
+	manifests, _ := filepath.Glob(filepath.Join(dir, "foo.a.*.manifest.json"))
+	if len(manifests) != 2 {
+		t.Fatalf("Expected two archives, got %v", manifests)
+	}
+	// No new file for foo.b, which has no new message.
+	if manifests, _ := filepath.Glob(filepath.Join(dir, "foo.b.*.manifest.json")); len(manifests) != 1 {
+		t.Fatalf("Expected one archive, got %v", manifests)
+	}
+	total := 0
+	for _, m := range manifests {
+		am, err := stores.ReadArchiveManifest(m)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		total += am.Count
+	}
+	if total != 4 {
+		t.Fatalf("Expected 4 archived messages, got %v", total)
+	}
+}
@@ -0,0 +1,126 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+)
+
+// Events recorded in the audit log.
+const (
+	auditClientConnect       = "client_connect"
+	auditClientDisconnect    = "client_disconnect"
+	auditClientReplaced      = "client_replaced"
+	auditSubCreate           = "sub_create"
+	auditSubClose            = "sub_close"
+	auditSubUnsubscribe      = "sub_unsubscribe"
+	auditChannelCreate       = "channel_create"
+	auditLimitViolation      = "limit_violation"
+	auditPermissionViolation = "permission_violation"
+	auditSlowConsumer        = "slow_consumer"
+	auditConsumerLag         = "consumer_lag"
+	auditStoreError          = "store_error"
+)
+
+// Reasons a client is disconnected.
+const (
+	closeReasonRequest      = "close request"
+	closeReasonHeartbeat    = "heartbeat timeout"
+	closeReasonReplaced     = "replaced by new connection"
+	closeReasonAdmin        = "administrative request"
+	closeReasonSlowConsumer = "slow consumer"
+	closeReasonExpired      = "no contact before restart"
+)
+
+// auditRecord is what is written in the audit log for each event.
+type auditRecord struct {
+	Time    string `json:"time"`
+	Event   string `json:"event"`
+	Client  string `json:"client,omitempty"`
+	Channel string `json:"channel,omitempty"`
+	Durable string `json:"durable,omitempty"`
+	Queue   string `json:"queue,omitempty"`
+	Inbox   string `json:"inbox,omitempty"`
+	Reason  string `json:"reason,omitempty"`
+	Code    string `json:"code,omitempty"` // see ErrorCode
+}
+
+// auditLog is an append-only file in which events are recorded, one JSON
+// object per line. It is separate from the operational log so that it
+// can be kept for compliance review.
+type auditLog struct {
+	sync.Mutex
+	file *os.File
+}
+
+// openAuditLog opens (or creates) the audit log file.
+func openAuditLog(name string) (*auditLog, error) {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0660)
+	if err != nil {
+		return nil, err
+	}
+	return &auditLog{file: f}, nil
+}
+
+// record writes the record in the audit log. It is a no-op if the audit
+// log is not enabled, so callers don't need to check.
+func (a *auditLog) record(r *auditRecord) {
+	if a == nil {
+		return
+	}
+	if r.Time == "" {
+		r.Time = time.Now().UTC().Format(time.RFC3339Nano)
+	}
+	b, err := json.Marshal(r)
+	if err != nil {
+		return
+	}
+	b = append(b, '\n')
+	a.Lock()
+	defer a.Unlock()
+	if a.file == nil {
+		return
+	}
+	if _, err := a.file.Write(b); err != nil {
+		Errorf("STAN: Unable to write %s event in audit log: %v", r.Event, err)
+	}
+}
+
+// close closes the audit log file.
+func (a *auditLog) close() {
+	if a == nil {
+		return
+	}
+	a.Lock()
+	if a.file != nil {
+		a.file.Close()
+		a.file = nil
+	}
+	a.Unlock()
+}
+
+// auditSub records a subscription event.
+func (s *StanServer) auditSub(event string, sub *subState, reason string) {
+	if s.audit == nil && s.advisories == nil {
+		return
+	}
+	s.recordEvent(subAuditRecord(event, sub, reason))
+}
+
+// subAuditRecord returns the record of a subscription event.
+func subAuditRecord(event string, sub *subState, reason string) *auditRecord {
+	sub.RLock()
+	defer sub.RUnlock()
+	return &auditRecord{
+		Event:   event,
+		Client:  sub.ClientID,
+		Channel: sub.subject,
+		Durable: sub.DurableName,
+		Queue:   sub.QGroup,
+		Inbox:   sub.Inbox,
+		Reason:  reason,
+	}
+}
@@ -0,0 +1,92 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/nats-io/go-nats-streaming"
+)
+
+func readAuditLog(t *testing.T, name string) []auditRecord {
+	f, err := os.Open(name)
+	if err != nil {
+		stackFatalf(t, "Unable to open audit log: %v", err)
+	}
+	defer f.Close()
+	var records []auditRecord
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		r := auditRecord{}
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			stackFatalf(t, "Invalid audit record %q: %v", scanner.Text(), err)
+		}
+		if r.Time == "" {
+			stackFatalf(t, "Missing time in audit record %q", scanner.Text())
+		}
+		records = append(records, r)
+	}
+	return records
+}
+
+func TestAuditLog(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "stan_server_audit_")
+	if err != nil {
+		t.Fatalf("Unable to create dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	sOpts := GetDefaultOptions()
+	sOpts.ID = clusterName
+	sOpts.MaxChannels = 1
+	sOpts.AuditLogFile = filepath.Join(tmpDir, "audit.log")
+	s := RunServerWithOpts(sOpts, nil)
+	defer s.Shutdown()
+
+	sc := NewDefaultConnection(t)
+	if _, err := sc.Subscribe("foo", func(_ *stan.Msg) {}, stan.DurableName("dur")); err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+	sub, err := sc.Subscribe("foo", func(_ *stan.Msg) {})
+	if err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+	if err := sub.Unsubscribe(); err != nil {
+		t.Fatalf("Unexpected error on unsubscribe: %v", err)
+	}
+	if _, err := sc.Subscribe("bar", func(_ *stan.Msg) {}); err == nil {
+		t.Fatal("Expected error on subscribe")
+	}
+	sc.Close()
+	s.Shutdown()
+
+	expected := []auditRecord{
+		{Event: auditClientConnect, Client: clientName},
+		{Event: auditChannelCreate, Client: clientName, Channel: "foo"},
+		{Event: auditSubCreate, Client: clientName, Channel: "foo", Durable: "dur"},
+		{Event: auditSubCreate, Client: clientName, Channel: "foo"},
+		{Event: auditSubUnsubscribe, Client: clientName, Channel: "foo"},
+		{Event: auditLimitViolation, Client: clientName, Channel: "bar", Reason: "too many channels"},
+		{Event: auditSubClose, Client: clientName, Channel: "foo", Durable: "dur"},
+		{Event: auditClientDisconnect, Client: clientName, Reason: closeReasonRequest},
+	}
+	records := readAuditLog(t, sOpts.AuditLogFile)
+	if len(records) != len(expected) {
+		t.Fatalf("Expected %v records, got %v", len(expected), records)
+	}
+	for i, r := range records {
+		e := expected[i]
+		if r.Event != e.Event || r.Client != e.Client || r.Channel != e.Channel ||
+			r.Durable != e.Durable || r.Reason != e.Reason {
+			t.Fatalf("Expected record %v to be %+v, got %+v", i, e, r)
+		}
+		if e.Event != auditChannelCreate && e.Event != auditLimitViolation && r.Inbox == "" {
+			t.Fatalf("Expected inbox in record %+v", r)
+		}
+	}
+}
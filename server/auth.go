@@ -0,0 +1,240 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/nats-io/nats-streaming-server/spb"
+)
+
+// User is allowed to connect to the server, and is granted permissions
+// on channels. A user is identified either by Username and Password, or
+// by Token. If ClientIDs is not empty, the user can only connect with
+// one of these client IDs, a trailing `*` matching any suffix.
+type User struct {
+	Username    string      `json:"user,omitempty"`
+	Password    string      `json:"password,omitempty"`
+	Token       string      `json:"token,omitempty"`
+	ClientIDs   []string    `json:"client_ids,omitempty"`
+	Permissions Permissions `json:"permissions"`
+}
+
+// Permissions lists the channel patterns (wildcards allowed) a user can
+// publish to and subscribe from, and the NATS subject patterns its
+// subscriptions can be delivered to, besides inboxes (see isInbox()).
+// An empty list denies all channels or subjects. Admin allows the user
+// to send the administrative requests of the gRPC API.
+type Permissions struct {
+	Publish   []string `json:"publish,omitempty"`
+	Subscribe []string `json:"subscribe,omitempty"`
+	Deliver   []string `json:"deliver,omitempty"`
+	Admin     bool     `json:"admin,omitempty"`
+}
+
+// Prefix of the inboxes generated by the NATS clients.
+const inboxPrefix = "_INBOX."
+
+// LoadUsersFile reads the users and their permissions from a JSON file
+// containing an array of users, for instance:
+//
+//	[{"user": "alice", "password": "foo",
+//	  "permissions": {"publish": ["orders.>"], "subscribe": ["orders.*"]}},
+//	 {"token": "s3cr3t", "permissions": {"subscribe": [">"]}}]
+func LoadUsersFile(path string) ([]*User, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var users []*User
+	if err := json.Unmarshal(b, &users); err != nil {
+		return nil, fmt.Errorf("error parsing users file %q: %v", path, err)
+	}
+	for i, u := range users {
+		if u.Token == "" && u.Username == "" {
+			return nil, fmt.Errorf("error parsing users file %q: user %d has neither a user name nor a token", path, i)
+		}
+	}
+	return users, nil
+}
+
+// authenticate returns the user matching the credentials, or nil if
+// there is none.
+func (s *StanServer) authenticate(creds *spb.ConnectRequestExt) *User {
+	if creds == nil {
+		return nil
+	}
+	for _, u := range s.opts.Users {
+		if u.Token != "" {
+			if creds.Token != "" && secureEquals(u.Token, creds.Token) {
+				return u
+			}
+		} else if creds.User == u.Username && secureEquals(u.Password, creds.Password) {
+			return u
+		}
+	}
+	return nil
+}
+
+// isClientIDAllowed returns true if the user can connect with the given
+// client ID. Without client IDs, a user is bound to its user name if the
+// server binds client IDs, and can use any client ID otherwise.
+func (s *StanServer) isClientIDAllowed(u *User, clientID string) bool {
+	if len(u.ClientIDs) == 0 {
+		return !s.opts.BindClientIDs || (u.Username != "" && clientID == u.Username)
+	}
+	for _, id := range u.ClientIDs {
+		if strings.HasSuffix(id, "*") {
+			if strings.HasPrefix(clientID, id[:len(id)-1]) {
+				return true
+			}
+		} else if clientID == id {
+			return true
+		}
+	}
+	return false
+}
+
+// secureEquals compares the two strings in constant time.
+func secureEquals(s1, s2 string) bool {
+	return subtle.ConstantTimeCompare([]byte(s1), []byte(s2)) == 1
+}
+
+// canPublish returns true if the channel matches one of the publish patterns.
+func (p *Permissions) canPublish(channel string) bool {
+	return matchesAny(p.Publish, channel)
+}
+
+// canSubscribe returns true if the subject, which may be a wildcard subject,
+// matches one of the subscribe patterns.
+func (p *Permissions) canSubscribe(subject string) bool {
+	return matchesAny(p.Subscribe, subject)
+}
+
+// canDeliver returns true if the subject matches one of the deliver patterns.
+func (p *Permissions) canDeliver(subject string) bool {
+	return matchesAny(p.Deliver, subject)
+}
+
+func matchesAny(patterns []string, subject string) bool {
+	for _, pattern := range patterns {
+		if patternCovers(pattern, subject) {
+			return true
+		}
+	}
+	return false
+}
+
+// patternCovers returns true if every channel matching the subject also
+// matches the pattern. Unlike util.SubjectMatches(), wildcards in the
+// subject are only covered by the same or a wider wildcard in the pattern,
+// so that `foo.*` does not grant a subscription on `foo.>`.
+func patternCovers(pattern, subject string) bool {
+	pts := strings.Split(pattern, ".")
+	sts := strings.Split(subject, ".")
+	for i, pt := range pts {
+		if pt == ">" && i == len(pts)-1 {
+			return len(sts) > i
+		}
+		if i >= len(sts) {
+			return false
+		}
+		if pt == "*" && sts[i] != ">" {
+			continue
+		}
+		if pt != sts[i] {
+			return false
+		}
+	}
+	return len(pts) == len(sts)
+}
+
+// Number of random bytes of a session.
+const sessionLen = 16
+
+// newSession returns a random session, the secret that the client sends
+// with its requests to prove that they come from the connection that was
+// authenticated with this client ID.
+func newSession() string {
+	b := make([]byte, sessionLen)
+	if _, err := rand.Read(b); err != nil {
+		panic(fmt.Errorf("unable to generate a session: %v", err))
+	}
+	return hex.EncodeToString(b)
+}
+
+// isAllowed returns true if the client is allowed to publish to (or
+// subscribe from if `publish` is false) the given subject. Clients are
+// allowed everything if the server has no users configured.
+func (s *StanServer) isAllowed(clientID, session, subject string, publish bool) bool {
+	perms, allowed := s.clientPermissions(clientID, session)
+	if perms == nil {
+		return allowed
+	}
+	if publish {
+		return perms.canPublish(subject)
+	}
+	return perms.canSubscribe(subject)
+}
+
+// isDeliverAllowed returns true if the subscriptions of the client can be
+// delivered to the given subject, which is always the case for an inbox.
+func (s *StanServer) isDeliverAllowed(clientID, session, subject string) bool {
+	if isInbox(subject) {
+		return true
+	}
+	perms, allowed := s.clientPermissions(clientID, session)
+	if perms == nil {
+		return allowed
+	}
+	return perms.canDeliver(subject)
+}
+
+// isSessionValid returns true if the session is the one returned to the
+// client when it connected, or if the server has no users configured.
+func (s *StanServer) isSessionValid(clientID, session string) bool {
+	perms, allowed := s.clientPermissions(clientID, session)
+	return perms != nil || allowed
+}
+
+// clientPermissions returns the permissions of the client. If they are
+// nil, the client is allowed everything if the returned boolean is true,
+// which is the case when the server has no users, and nothing otherwise.
+// Since the client ID of a request is chosen by the sender, the request
+// must carry the session of the client for its permissions to apply.
+func (s *StanServer) clientPermissions(clientID, session string) (*Permissions, bool) {
+	if len(s.opts.Users) == 0 {
+		return nil, true
+	}
+	c := s.clients.Lookup(clientID)
+	if c == nil {
+		return nil, false
+	}
+	c.RLock()
+	perms, clientSession := c.perms, c.session
+	c.RUnlock()
+	// Credentials are not persisted, so clients recovered from the store
+	// have no permissions, nor session, until they connect again.
+	if clientSession == "" || !secureEquals(clientSession, session) {
+		return nil, false
+	}
+	return perms, false
+}
+
+// isInbox returns true if the subject is an inbox generated by a NATS
+// client, as opposed to a delivery subject chosen by the application.
+func isInbox(subject string) bool {
+	return strings.HasPrefix(subject, inboxPrefix)
+}
+
+// isInternalSubject returns true if the subject is used by the server to
+// receive requests, so that a subscription can't be delivered to it.
+func (s *StanServer) isInternalSubject(subject string) bool {
+	return strings.HasPrefix(subject, "_STAN.") || strings.HasPrefix(subject, s.opts.DiscoverPrefix+".")
+}
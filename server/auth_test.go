@@ -0,0 +1,453 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/nats-io/go-nats-streaming/pb"
+	"github.com/nats-io/nats"
+	"github.com/nats-io/nats-streaming-server/spb"
+)
+
+// connectWithCreds sends a connect request followed by the given
+// credentials and returns the error returned by the server, if any.
+func connectWithCreds(t *testing.T, nc *nats.Conn, clientID string, creds *spb.ConnectRequestExt) error {
+	_, err := connectWithSession(t, nc, clientID, creds)
+	return err
+}
+
+// connectWithSession is like connectWithCreds but also returns the session
+// returned by the server.
+func connectWithSession(t *testing.T, nc *nats.Conn, clientID string, creds *spb.ConnectRequestExt) (string, error) {
+	req := &pb.ConnectRequest{ClientID: clientID, HeartbeatInbox: nats.NewInbox()}
+	b, _ := req.Marshal()
+	if creds != nil {
+		cb, _ := creds.Marshal()
+		b = append(b, cb...)
+	}
+	resp, err := nc.Request(fmt.Sprintf("%s.%s", DefaultDiscoverPrefix, clusterName), b, 2*time.Second)
+	if err != nil {
+		stackFatalf(t, "Unexpected error on connect: %v", err)
+	}
+	r := &pb.ConnectResponse{}
+	if err := r.Unmarshal(resp.Data); err != nil {
+		stackFatalf(t, "Unexpected error on unmarshal: %v", err)
+	}
+	if r.Error != "" {
+		return "", errors.New(r.Error)
+	}
+	ext := &spb.ConnectResponseExt{}
+	if err := ext.Unmarshal(resp.Data); err != nil {
+		stackFatalf(t, "Unexpected error on unmarshal: %v", err)
+	}
+	return ext.Session, nil
+}
+
+func TestPatternCovers(t *testing.T) {
+	for _, c := range []struct {
+		pattern  string
+		subject  string
+		expected bool
+	}{
+		{"foo", "foo", true},
+		{"foo", "bar", false},
+		{"foo.*", "foo.bar", true},
+		{"foo.*", "foo.*", true},
+		{"foo.*", "foo.>", false},
+		{"foo.*", "foo.bar.baz", false},
+		{"foo.>", "foo.bar.baz", true},
+		{"foo.>", "foo.*", true},
+		{"foo.>", "foo.>", true},
+		{"foo.>", "foo", false},
+		{"foo.bar", "foo.*", false},
+		{">", "foo.>", true},
+	} {
+		if covers := patternCovers(c.pattern, c.subject); covers != c.expected {
+			t.Fatalf("Expected patternCovers(%q, %q) to be %v", c.pattern, c.subject, c.expected)
+		}
+	}
+}
+
+func TestLoadUsersFile(t *testing.T) {
+	f, err := ioutil.TempFile("", "users")
+	if err != nil {
+		t.Fatalf("Unable to create file: %v", err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(`[{"user": "alice", "password": "foo", "permissions": {"publish": ["foo.>"], "subscribe": ["foo.*", "bar"]}},
+		{"token": "s3cr3t", "permissions": {"subscribe": [">"]}}]`)
+	f.Close()
+
+	users, err := LoadUsersFile(f.Name())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(users) != 2 || users[0].Username != "alice" || users[0].Password != "foo" ||
+		len(users[0].Permissions.Publish) != 1 || len(users[0].Permissions.Subscribe) != 2 ||
+		users[1].Token != "s3cr3t" || len(users[1].Permissions.Publish) != 0 {
+		t.Fatalf("Unexpected users: %v", users)
+	}
+
+	for _, content := range []string{"not json", `[{"password": "foo"}]`} {
+		if err := ioutil.WriteFile(f.Name(), []byte(content), 0600); err != nil {
+			t.Fatalf("Unable to write file: %v", err)
+		}
+		if _, err := LoadUsersFile(f.Name()); err == nil {
+			t.Fatalf("Expected error loading %q", content)
+		}
+	}
+	if _, err := LoadUsersFile("does/not/exist"); err == nil {
+		t.Fatal("Expected error on missing file")
+	}
+}
+
+func TestChannelPermissions(t *testing.T) {
+	sOpts := GetDefaultOptions()
+	sOpts.ID = clusterName
+	sOpts.Users = []*User{
+		{Username: "alice", Password: "foo", Permissions: Permissions{
+			Publish:   []string{"orders.>"},
+			Subscribe: []string{"orders.*", "invoices"},
+		}},
+		{Token: "s3cr3t", Permissions: Permissions{Subscribe: []string{">"}}},
+	}
+	s := RunServerWithOpts(sOpts, nil)
+	defer s.Shutdown()
+
+	nc, err := nats.Connect(nats.DefaultURL)
+	if err != nil {
+		t.Fatalf("Unexpected error on connect: %v", err)
+	}
+	defer nc.Close()
+
+	for _, creds := range []*spb.ConnectRequestExt{
+		nil,
+		{User: "alice"},
+		{User: "alice", Password: "bar"},
+		{User: "bob", Password: "foo"},
+		{Token: "bad"},
+	} {
+		if err := connectWithCreds(t, nc, "bad", creds); err == nil || err.Error() != ErrAuthorization.Error() {
+			t.Fatalf("Expected error %v for %v, got %v", ErrAuthorization, creds, err)
+		}
+	}
+	if s.clients.Lookup("bad") != nil {
+		t.Fatal("Client should not have been registered")
+	}
+
+	alice, err := connectWithSession(t, nc, clientName, &spb.ConnectRequestExt{User: "alice", Password: "foo"})
+	if err != nil {
+		t.Fatalf("Unexpected error on connect: %v", err)
+	}
+	reader, err := connectWithSession(t, nc, "reader", &spb.ConnectRequestExt{Token: "s3cr3t"})
+	if err != nil {
+		t.Fatalf("Unexpected error on connect: %v", err)
+	}
+	if alice == "" || reader == "" || alice == reader {
+		t.Fatalf("Unexpected sessions %q and %q", alice, reader)
+	}
+
+	if err := sendPubMsgWithExt(t, s, nc, "orders.new.eu", []byte("hello"), &spb.MsgExt{Session: alice}); err != nil {
+		t.Fatalf("Unexpected error on publish: %v", err)
+	}
+	for _, channel := range []string{"orders", "invoices"} {
+		if err := sendPubMsgWithExt(t, s, nc, channel, []byte("hello"), &spb.MsgExt{Session: alice}); err == nil || err.Error() != ErrPubPermission.Error() {
+			t.Fatalf("Expected error %v publishing on %s, got %v", ErrPubPermission, channel, err)
+		}
+	}
+	// The session is not stored with the message.
+	if ext := s.store.LookupChannel("orders.new.eu").Msgs.LookupExt(1); ext != nil {
+		t.Fatalf("Unexpected message attributes: %v", ext)
+	}
+
+	for _, subject := range []string{"orders.new", "orders.*", "invoices"} {
+		if _, err := sendSubRequestWithExt(t, s, nc, &pb.SubscriptionRequest{Subject: subject, Inbox: nats.NewInbox()}, &spb.SubRequestExt{Session: alice}); err != nil {
+			t.Fatalf("Unexpected error subscribing on %s: %v", subject, err)
+		}
+	}
+	for _, subject := range []string{"orders.>", "orders.new.eu", "other"} {
+		if _, err := sendSubRequestWithExt(t, s, nc, &pb.SubscriptionRequest{Subject: subject, Inbox: nats.NewInbox()}, &spb.SubRequestExt{Session: alice}); err == nil || err.Error() != ErrSubPermission.Error() {
+			t.Fatalf("Expected error %v subscribing on %s, got %v", ErrSubPermission, subject, err)
+		}
+	}
+	// The channel should not have been created.
+	if s.store.LookupChannel("other") != nil {
+		t.Fatal("Channel should not have been created")
+	}
+
+	// The token user can subscribe to anything, but not publish.
+	if _, err := sendSubRequestWithExt(t, s, nc, &pb.SubscriptionRequest{ClientID: "reader", Subject: "other", Inbox: nats.NewInbox()}, &spb.SubRequestExt{Session: reader}); err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+}
+
+func TestSessions(t *testing.T) {
+	sOpts := GetDefaultOptions()
+	sOpts.ID = clusterName
+	sOpts.Users = []*User{
+		{Username: "alice", Password: "foo", Permissions: Permissions{
+			Publish:   []string{"orders"},
+			Subscribe: []string{"orders"},
+		}},
+		{Username: "bob", Password: "bar"},
+	}
+	s := runServerWithOpts(t, sOpts, nil)
+	defer s.Shutdown()
+
+	nc, err := nats.Connect(nats.DefaultURL)
+	if err != nil {
+		t.Fatalf("Unexpected error on connect: %v", err)
+	}
+	defer nc.Close()
+
+	alice, err := connectWithSession(t, nc, clientName, &spb.ConnectRequestExt{User: "alice", Password: "foo"})
+	if err != nil {
+		t.Fatalf("Unexpected error on connect: %v", err)
+	}
+	bob, err := connectWithSession(t, nc, "bob", &spb.ConnectRequestExt{User: "bob", Password: "bar"})
+	if err != nil {
+		t.Fatalf("Unexpected error on connect: %v", err)
+	}
+	if err := sendPubMsgWithExt(t, s, nc, "orders", []byte("hello"), &spb.MsgExt{Session: alice}); err != nil {
+		t.Fatalf("Unexpected error on publish: %v", err)
+	}
+	sr := &pb.SubscriptionRequest{Subject: "orders", Inbox: nats.NewInbox(), DurableName: "dur"}
+	ackInbox, err := sendSubRequestWithExt(t, s, nc, sr, &spb.SubRequestExt{Session: alice})
+	if err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+
+	// Requests with the client ID of alice, but without its session or
+	// with the session of another client, are denied.
+	for _, session := range []string{"", bob, alice + "x"} {
+		if err := sendPubMsgWithExt(t, s, nc, "orders", []byte("hello"), &spb.MsgExt{Session: session}); err == nil || err.Error() != ErrPubPermission.Error() {
+			t.Fatalf("Expected error %v publishing with session %q, got %v", ErrPubPermission, session, err)
+		}
+		sr.Inbox = nats.NewInbox()
+		if _, err := sendSubRequestWithExt(t, s, nc, sr, &spb.SubRequestExt{Session: session}); err == nil || err.Error() != ErrSubPermission.Error() {
+			t.Fatalf("Expected error %v resuming the durable with session %q, got %v", ErrSubPermission, session, err)
+		}
+		if err := sendPauseRequest(t, nc, &spb.PauseRequest{ClientID: clientName, Subject: "orders", Inbox: ackInbox, Session: session}); err == nil || err.Error() != ErrInvalidSession.Error() {
+			t.Fatalf("Expected error %v pausing with session %q, got %v", ErrInvalidSession, session, err)
+		}
+		unsub := &pb.SubscriptionResponse{}
+		sendWithSession(t, nc, s.info.Unsubscribe, &pb.UnsubscribeRequest{ClientID: clientName, Subject: "orders", Inbox: ackInbox}, session, unsub)
+		if unsub.Error != ErrInvalidSession.Error() {
+			t.Fatalf("Expected error %v unsubscribing with session %q, got %v", ErrInvalidSession, session, unsub.Error)
+		}
+		closeResp := &pb.CloseResponse{}
+		sendWithSession(t, nc, s.info.Close, &pb.CloseRequest{ClientID: clientName}, session, closeResp)
+		if closeResp.Error != ErrInvalidSession.Error() {
+			t.Fatalf("Expected error %v closing with session %q, got %v", ErrInvalidSession, session, closeResp.Error)
+		}
+		seqAtTime := &spb.SeqAtTimeResponse{}
+		sendRequest(t, nc, DefaultSeqTimePrefix, &spb.SeqAtTimeRequest{Channels: []string{"orders"}, ClientID: clientName, Session: session}, seqAtTime)
+		if seqAtTime.Error != ErrSubPermission.Error() || len(seqAtTime.Sequences) != 0 {
+			t.Fatalf("Expected error %v resolving a time with session %q, got %v", ErrSubPermission, session, seqAtTime)
+		}
+		hwm := &spb.HighWaterMarkResponse{}
+		sendRequest(t, nc, DefaultHWMPrefix, &spb.HighWaterMarkRequest{Channels: []string{"orders"}, ClientID: clientName, Session: session}, hwm)
+		if hwm.Error != ErrSubPermission.Error() || len(hwm.Channels) != 0 {
+			t.Fatalf("Expected error %v reading the high-water mark with session %q, got %v", ErrSubPermission, session, hwm)
+		}
+		fetch := &spb.FetchResponse{}
+		sendRequest(t, nc, DefaultFetchPrefix, &spb.FetchRequest{Channel: "orders", ClientID: clientName, Session: session}, fetch)
+		if fetch.Error != ErrSubPermission.Error() || len(fetch.Msgs) != 0 {
+			t.Fatalf("Expected error %v fetching with session %q, got %v", ErrSubPermission, session, fetch)
+		}
+		last := &spb.LastValueResponse{}
+		sendRequest(t, nc, DefaultLastPrefix, &spb.LastValueRequest{Channel: "orders", ClientID: clientName, Session: session}, last)
+		if last.Error != ErrSubPermission.Error() || len(last.Msg) != 0 {
+			t.Fatalf("Expected error %v reading the last value with session %q, got %v", ErrSubPermission, session, last)
+		}
+	}
+	if err := sendPauseRequest(t, nc, &spb.PauseRequest{ClientID: clientName, Subject: "orders", Inbox: ackInbox, Session: alice}); err != nil {
+		t.Fatalf("Unexpected error on pause: %v", err)
+	}
+	fetch := &spb.FetchResponse{}
+	sendRequest(t, nc, DefaultFetchPrefix, &spb.FetchRequest{Channel: "orders", ClientID: clientName, Session: alice}, fetch)
+	if fetch.Error != "" || len(fetch.Msgs) != 1 {
+		t.Fatalf("Unexpected fetch response: %v", fetch)
+	}
+	last := &spb.LastValueResponse{}
+	sendRequest(t, nc, DefaultLastPrefix, &spb.LastValueRequest{Channel: "orders", ClientID: clientName, Session: alice}, last)
+	if last.Error != "" || len(last.Msg) == 0 {
+		t.Fatalf("Unexpected last value response: %v", last)
+	}
+	seqAtTime := &spb.SeqAtTimeResponse{}
+	sendRequest(t, nc, DefaultSeqTimePrefix, &spb.SeqAtTimeRequest{Channels: []string{"orders"}, ClientID: clientName, Session: alice}, seqAtTime)
+	if seqAtTime.Error != "" || len(seqAtTime.Sequences) != 1 || seqAtTime.Sequences[0] != 2 {
+		t.Fatalf("Unexpected sequence at time response: %v", seqAtTime)
+	}
+	hwm := &spb.HighWaterMarkResponse{}
+	sendRequest(t, nc, DefaultHWMPrefix, &spb.HighWaterMarkRequest{Channels: []string{"orders"}, ClientID: clientName, Session: alice}, hwm)
+	if hwm.Error != "" || len(hwm.Channels) != 1 || hwm.Channels[0].LastSequence != 1 {
+		t.Fatalf("Unexpected high-water mark response: %v", hwm)
+	}
+
+	// Reading without a subscription requires the subscribe permission.
+	fetch = &spb.FetchResponse{}
+	sendRequest(t, nc, DefaultFetchPrefix, &spb.FetchRequest{Channel: "orders", ClientID: "bob", Session: bob}, fetch)
+	if fetch.Error != ErrSubPermission.Error() {
+		t.Fatalf("Expected error %v, got %v", ErrSubPermission, fetch.Error)
+	}
+
+	unsub := &pb.SubscriptionResponse{}
+	sendWithSession(t, nc, s.info.Unsubscribe, &pb.UnsubscribeRequest{ClientID: clientName, Subject: "orders", Inbox: ackInbox}, alice, unsub)
+	if unsub.Error != "" {
+		t.Fatalf("Unexpected error on unsubscribe: %v", unsub.Error)
+	}
+	closeResp := &pb.CloseResponse{}
+	sendWithSession(t, nc, s.info.Close, &pb.CloseRequest{ClientID: clientName}, alice, closeResp)
+	if closeResp.Error != "" {
+		t.Fatalf("Unexpected error on close: %v", closeResp.Error)
+	}
+	if s.clients.Lookup(clientName) != nil {
+		t.Fatal("Client should have been closed")
+	}
+}
+
+// sendWithSession sends the request, followed by a RequestExt with the
+// session, to the subject and decodes the response.
+func sendWithSession(t *testing.T, nc *nats.Conn, subject string, req adminRequest, session string, resp adminReply) {
+	b, _ := req.Marshal()
+	eb, _ := (&spb.RequestExt{Session: session}).Marshal()
+	reply, err := nc.Request(subject, append(b, eb...), 2*time.Second)
+	if err != nil {
+		stackFatalf(t, "Unexpected error on request: %v", err)
+	}
+	if err := resp.Unmarshal(reply.Data); err != nil {
+		stackFatalf(t, "Unexpected error on unmarshal: %v", err)
+	}
+}
+
+// sendRequest sends the request to the subject made of the prefix and the
+// cluster ID, and decodes the response.
+func sendRequest(t *testing.T, nc *nats.Conn, prefix string, req adminRequest, resp adminReply) {
+	b, _ := req.Marshal()
+	reply, err := nc.Request(fmt.Sprintf("%s.%s", prefix, clusterName), b, 2*time.Second)
+	if err != nil {
+		stackFatalf(t, "Unexpected error on request: %v", err)
+	}
+	if err := resp.Unmarshal(reply.Data); err != nil {
+		stackFatalf(t, "Unexpected error on unmarshal: %v", err)
+	}
+}
+
+func TestClientIDBinding(t *testing.T) {
+	sOpts := GetDefaultOptions()
+	sOpts.ID = clusterName
+	sOpts.BindClientIDs = true
+	sOpts.Users = []*User{
+		{Username: "alice", Password: "foo"},
+		{Username: "bob", Password: "bar", ClientIDs: []string{"billing", "billing-worker-*"}},
+		{Token: "s3cr3t"},
+	}
+	s := runServerWithOpts(t, sOpts, nil)
+	defer s.Shutdown()
+
+	nc, err := nats.Connect(nats.DefaultURL)
+	if err != nil {
+		t.Fatalf("Unexpected error on connect: %v", err)
+	}
+	defer nc.Close()
+
+	alice := &spb.ConnectRequestExt{User: "alice", Password: "foo"}
+	bob := &spb.ConnectRequestExt{User: "bob", Password: "bar"}
+	for _, c := range []struct {
+		clientID string
+		creds    *spb.ConnectRequestExt
+		allowed  bool
+	}{
+		{"alice", alice, true},
+		{"billing", alice, false},
+		{"billing", bob, true},
+		{"billing-worker-1", bob, true},
+		{"billing-other", bob, false},
+		{"bob", bob, false},
+		{"reader", &spb.ConnectRequestExt{Token: "s3cr3t"}, false},
+	} {
+		err := connectWithCreds(t, nc, c.clientID, c.creds)
+		if c.allowed && err != nil {
+			t.Fatalf("Unexpected error connecting %s as %v: %v", c.clientID, c.creds, err)
+		} else if !c.allowed && (err == nil || err.Error() != ErrClientIDBinding.Error()) {
+			t.Fatalf("Expected error %v connecting %s as %v, got %v", ErrClientIDBinding, c.clientID, c.creds, err)
+		}
+	}
+	s.Shutdown()
+
+	// Binding client IDs requires users.
+	sOpts = GetDefaultOptions()
+	sOpts.BindClientIDs = true
+	if s, err := StartServerWithOpts(sOpts, nil); err == nil {
+		s.Shutdown()
+		t.Fatal("Expected error binding client IDs without users")
+	}
+}
+
+func TestDeliverSubject(t *testing.T) {
+	sOpts := GetDefaultOptions()
+	sOpts.ID = clusterName
+	sOpts.Users = []*User{
+		{Username: "alice", Password: "foo", Permissions: Permissions{
+			Publish:   []string{"orders"},
+			Subscribe: []string{"orders"},
+			Deliver:   []string{"bridge.>"},
+		}},
+	}
+	s := runServerWithOpts(t, sOpts, nil)
+	defer s.Shutdown()
+
+	nc, err := nats.Connect(nats.DefaultURL)
+	if err != nil {
+		t.Fatalf("Unexpected error on connect: %v", err)
+	}
+	defer nc.Close()
+
+	session, err := connectWithSession(t, nc, clientName, &spb.ConnectRequestExt{User: "alice", Password: "foo"})
+	if err != nil {
+		t.Fatalf("Unexpected error on connect: %v", err)
+	}
+	for _, c := range []struct {
+		subject string
+		err     error
+	}{
+		{"bridge.orders", nil},
+		{"other", ErrDeliverPerm},
+		{"bridge.*", ErrDeliverSubject},
+		{DefaultPubPrefix + ".foo", ErrDeliverSubject},
+		{DefaultDiscoverPrefix + "." + clusterName, ErrDeliverSubject},
+	} {
+		_, err := sendSubRequestWithExt(t, s, nc, &pb.SubscriptionRequest{Subject: "orders", Inbox: c.subject}, &spb.SubRequestExt{Session: session})
+		if (err == nil) != (c.err == nil) || (err != nil && err.Error() != c.err.Error()) {
+			t.Fatalf("Expected error %v delivering to %s, got %v", c.err, c.subject, err)
+		}
+	}
+
+	// The messages are delivered to the subject, where they can be received
+	// by a plain NATS subscriber.
+	sub, err := nc.SubscribeSync("bridge.orders")
+	if err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+	if err := sendPubMsgWithExt(t, s, nc, "orders", []byte("hello"), &spb.MsgExt{Session: session}); err != nil {
+		t.Fatalf("Unexpected error on publish: %v", err)
+	}
+	msg, err := sub.NextMsg(5 * time.Second)
+	if err != nil {
+		t.Fatalf("Did not get our message: %v", err)
+	}
+	m := &pb.MsgProto{}
+	if err := m.Unmarshal(msg.Data); err != nil {
+		t.Fatalf("Error decoding message: %v", err)
+	}
+	if m.Subject != "orders" || string(m.Data) != "hello" {
+		t.Fatalf("Unexpected message: %v", m)
+	}
+}
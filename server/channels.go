@@ -0,0 +1,170 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/nats-io/nats"
+	"github.com/nats-io/nats-streaming-server/spb"
+)
+
+// ChannelConfig is a channel created on startup, with its own limits. A
+// zero limit means that the limit of the channel's tenant, if any, or
+// else the server's limit, applies. Clients using one of the aliases of
+// the channel publish and subscribe on the channel itself.
+type ChannelConfig struct {
+	Name     string   `json:"name"`
+	MaxMsgs  int      `json:"max_msgs,omitempty"`  // Maximum number of messages
+	MaxBytes uint64   `json:"max_bytes,omitempty"` // Maximum number of bytes used by messages
+	MaxSubs  int      `json:"max_subs,omitempty"`  // Maximum number of subscriptions
+	Aliases  []string `json:"aliases,omitempty"`   // Other names of the channel
+}
+
+// LoadChannelsFile reads the channels and their limits from a JSON file
+// containing an array of channels, for instance:
+//
+//	[{"name": "orders", "max_msgs": 100000, "aliases": ["sales.orders"]},
+//	 {"name": "acme.invoices", "max_bytes": 1048576, "max_subs": 10}]
+func LoadChannelsFile(path string) ([]*ChannelConfig, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var channels []*ChannelConfig
+	if err := json.Unmarshal(b, &channels); err != nil {
+		return nil, fmt.Errorf("error parsing channels file %q: %v", path, err)
+	}
+	if err := validateChannels(channels); err != nil {
+		return nil, fmt.Errorf("error parsing channels file %q: %v", path, err)
+	}
+	return channels, nil
+}
+
+// validateChannels checks that the channel names and aliases are valid,
+// not listed twice, and that the limits are not negative.
+func validateChannels(channels []*ChannelConfig) error {
+	names := make(map[string]struct{}, len(channels))
+	for _, c := range channels {
+		if !isValidSubject(c.Name) {
+			return fmt.Errorf("invalid channel name %q", c.Name)
+		}
+		if c.MaxMsgs < 0 || c.MaxSubs < 0 {
+			return fmt.Errorf("invalid limits for channel %q", c.Name)
+		}
+		if _, dup := names[c.Name]; dup {
+			return fmt.Errorf("channel %q is listed twice", c.Name)
+		}
+		names[c.Name] = struct{}{}
+	}
+	for _, c := range channels {
+		for _, alias := range c.Aliases {
+			if !isValidSubject(alias) {
+				return fmt.Errorf("invalid alias %q of channel %q", alias, c.Name)
+			}
+			if _, dup := names[alias]; dup {
+				return fmt.Errorf("alias %q of channel %q is already a channel or an alias", alias, c.Name)
+			}
+			names[alias] = struct{}{}
+		}
+	}
+	return nil
+}
+
+// checkChannelAliases returns an error if an alias is the name of a
+// recovered channel, whose messages and subscriptions would no longer be
+// reachable.
+func (s *StanServer) checkChannelAliases() error {
+	for alias, channel := range s.channelAliases {
+		if s.store.LookupChannel(alias) != nil {
+			return fmt.Errorf("alias %q of channel %q is an existing channel", alias, channel)
+		}
+	}
+	return nil
+}
+
+// createConfiguredChannels creates the channels listed in the options
+// that do not exist yet.
+func (s *StanServer) createConfiguredChannels() error {
+	for _, c := range s.opts.Channels {
+		if _, err := s.createChannel(c.Name, ""); err != nil {
+			return fmt.Errorf("channel %q: %v", c.Name, err)
+		}
+	}
+	return nil
+}
+
+// resolveChannel returns the channel the given name is an alias of, or
+// the name itself if it is not an alias.
+func (s *StanServer) resolveChannel(name string) string {
+	if channel, ok := s.channelAliases[name]; ok {
+		return channel
+	}
+	return name
+}
+
+// processAdminCreateChannelRequest creates a channel, which is useful when
+// the server does not create channels implicitly. The channel gets the
+// limits of the channels file if it is listed there.
+func (s *StanServer) processAdminCreateChannelRequest(m *nats.Msg) {
+	req := &spb.AdminCreateChannelRequest{}
+	resp := &spb.AdminCreateChannelResponse{}
+	if err := req.Unmarshal(m.Data); err != nil || !isValidSubject(req.Channel) {
+		Errorf("STAN: Received invalid admin create channel request, subject=%s.", m.Subject)
+		resp.Error = ErrInvalidAdminReq.Error()
+		s.sendAdminResponse(m.Reply, resp)
+		return
+	}
+	if err := s.checkChannelName(req.Channel); err != nil {
+		resp.Error = err.Error()
+		s.sendAdminResponse(m.Reply, resp)
+		return
+	}
+	// An alias is the name of an existing channel.
+	if s.store.LookupChannel(s.resolveChannel(req.Channel)) != nil {
+		resp.Error = ErrChannelExists.Error()
+		s.sendAdminResponse(m.Reply, resp)
+		return
+	}
+	if _, err := s.createChannel(req.Channel, ""); err != nil {
+		Errorf("STAN: Unable to create channel %q for admin create channel request: %v", req.Channel, err)
+		resp.Error = err.Error()
+	} else {
+		Noticef("STAN: Channel %s created by administrative request", req.Channel)
+	}
+	s.sendAdminResponse(m.Reply, resp)
+}
+
+// Prefix of the internal channels, such as the advisory channels, which is
+// always reserved.
+const internalChannelPrefix = "_STAN."
+
+// checkChannelName returns ErrInvalidChannel if the name of a channel to
+// be created by a client is too long or does not match the configured
+// pattern.
+func (s *StanServer) checkChannelName(channel string) error {
+	if max := s.opts.MaxChannelNameLen; max > 0 && len(channel) > max {
+		return ErrInvalidChannel
+	}
+	if s.channelNameRE != nil && !s.channelNameRE.MatchString(channel) {
+		return ErrInvalidChannel
+	}
+	return nil
+}
+
+// isReservedChannel returns true if the channel has a reserved prefix, in
+// which case clients can't publish on it.
+func (s *StanServer) isReservedChannel(channel string) bool {
+	if strings.HasPrefix(channel, internalChannelPrefix) {
+		return true
+	}
+	for _, prefix := range s.opts.ReservedPrefixes {
+		if strings.HasPrefix(channel, prefix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,255 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/nats-io/go-nats-streaming"
+	"github.com/nats-io/nats-streaming-server/spb"
+	"github.com/nats-io/nats-streaming-server/stores"
+)
+
+func TestLoadChannelsFile(t *testing.T) {
+	f, err := ioutil.TempFile("", "channels")
+	if err != nil {
+		t.Fatalf("Unable to create file: %v", err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(`[{"name": "orders", "max_msgs": 100, "max_bytes": 1024, "max_subs": 5, "aliases": ["sales.orders"]},
+		{"name": "acme.invoices"}]`)
+	f.Close()
+
+	channels, err := LoadChannelsFile(f.Name())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expected := []*ChannelConfig{
+		{Name: "orders", MaxMsgs: 100, MaxBytes: 1024, MaxSubs: 5, Aliases: []string{"sales.orders"}},
+		{Name: "acme.invoices"},
+	}
+	if !reflect.DeepEqual(channels, expected) {
+		t.Fatalf("Expected %v, got %v", expected, channels)
+	}
+
+	for _, content := range []string{
+		"not json",
+		`[{"name": ""}]`,
+		`[{"name": "orders.*"}]`,
+		`[{"name": "orders", "max_subs": -1}]`,
+		`[{"name": "orders"}, {"name": "orders"}]`,
+		`[{"name": "orders", "aliases": ["sales.*"]}]`,
+		`[{"name": "orders", "aliases": ["orders"]}]`,
+		`[{"name": "orders", "aliases": ["invoices"]}, {"name": "invoices"}]`,
+		`[{"name": "orders", "aliases": ["sales"]}, {"name": "invoices", "aliases": ["sales"]}]`,
+	} {
+		if err := ioutil.WriteFile(f.Name(), []byte(content), 0600); err != nil {
+			t.Fatalf("Unable to write file: %v", err)
+		}
+		if _, err := LoadChannelsFile(f.Name()); err == nil {
+			t.Fatalf("Expected error loading %q", content)
+		}
+	}
+}
+
+func TestNoImplicitChannels(t *testing.T) {
+	sOpts := GetDefaultOptions()
+	sOpts.ID = clusterName
+	sOpts.NoImplicitChannels = true
+	sOpts.Channels = []*ChannelConfig{{Name: "foo", MaxMsgs: 2}}
+	sOpts.Advisories = true
+	s := RunServerWithOpts(sOpts, nil)
+	defer s.Shutdown()
+
+	sc, nc := createConnectionWithNatsOpts(t, clientName)
+	defer nc.Close()
+	defer sc.Close()
+
+	// The server still creates its own channels.
+	waitForCount(t, 1, func() (string, int) {
+		n, _, _ := s.store.MsgsState(AdvisoryChannel(AdvisoryClientConnect))
+		return "advisories", n
+	})
+
+	// The configured channel is created on startup, with its own limits.
+	if s.store.LookupChannel("foo") == nil {
+		t.Fatal("Channel foo should have been created")
+	}
+	for i := 0; i < 3; i++ {
+		if err := sc.Publish("foo", []byte("hello")); err != nil {
+			t.Fatalf("Unexpected error on publish: %v", err)
+		}
+	}
+	if n, _, _ := s.store.LookupChannel("foo").Msgs.State(); n != 2 {
+		t.Fatalf("Expected 2 messages, got %v", n)
+	}
+
+	// Unknown channels are not created.
+	if err := sc.Publish("bar", []byte("hello")); err == nil || err.Error() != ErrUnknownChannel.Error() {
+		t.Fatalf("Expected error %v, got %v", ErrUnknownChannel, err)
+	}
+	if _, err := sc.Subscribe("bar", func(*stan.Msg) {}); err == nil || err.Error() != ErrUnknownChannel.Error() {
+		t.Fatalf("Expected error %v, got %v", ErrUnknownChannel, err)
+	}
+	if s.store.LookupChannel("bar") != nil {
+		t.Fatal("Channel bar should not have been created")
+	}
+
+	createChannel := func(channel string) string {
+		resp := &spb.AdminCreateChannelResponse{}
+		sendAdminRequest(t, nc, AdminCreateChannel, &spb.AdminCreateChannelRequest{Channel: channel}, resp)
+		return resp.Error
+	}
+	if errStr := createChannel("bar.*"); errStr != ErrInvalidAdminReq.Error() {
+		t.Fatalf("Expected error %v, got %v", ErrInvalidAdminReq, errStr)
+	}
+	if errStr := createChannel("foo"); errStr != ErrChannelExists.Error() {
+		t.Fatalf("Expected error %v, got %v", ErrChannelExists, errStr)
+	}
+	if errStr := createChannel("bar"); errStr != "" {
+		t.Fatalf("Unexpected error: %v", errStr)
+	}
+	if _, err := sc.Subscribe("bar", func(*stan.Msg) {}); err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+	if err := sc.Publish("bar", []byte("hello")); err != nil {
+		t.Fatalf("Unexpected error on publish: %v", err)
+	}
+}
+
+func TestConfiguredChannelsWithImplicitCreation(t *testing.T) {
+	sOpts := GetDefaultOptions()
+	sOpts.ID = clusterName
+	sOpts.Channels = []*ChannelConfig{{Name: "foo"}}
+	s := RunServerWithOpts(sOpts, nil)
+	defer s.Shutdown()
+
+	if s.store.LookupChannel("foo") == nil {
+		t.Fatal("Channel foo should have been created")
+	}
+
+	// Other channels are still created implicitly.
+	sc := NewDefaultConnection(t)
+	defer sc.Close()
+	if err := sc.Publish("bar", []byte("hello")); err != nil {
+		t.Fatalf("Unexpected error on publish: %v", err)
+	}
+	if s.store.LookupChannel("bar") == nil {
+		t.Fatal("Channel bar should have been created")
+	}
+}
+
+func TestChannelNamePolicy(t *testing.T) {
+	sOpts := GetDefaultOptions()
+	sOpts.ID = clusterName
+	sOpts.ChannelNamePattern = `[a-z]+(\.[a-z]+)*`
+	sOpts.MaxChannelNameLen = 10
+	sOpts.ReservedPrefixes = []string{"internal."}
+	s := RunServerWithOpts(sOpts, nil)
+	defer s.Shutdown()
+
+	sc, nc := createConnectionWithNatsOpts(t, clientName)
+	defer nc.Close()
+	defer sc.Close()
+
+	if err := sc.Publish("foo.bar", []byte("hello")); err != nil {
+		t.Fatalf("Unexpected error on publish: %v", err)
+	}
+	for _, channel := range []string{"Foo", "foo.bar1", "foo.barbazz"} {
+		if err := sc.Publish(channel, []byte("hello")); err == nil || err.Error() != ErrInvalidChannel.Error() {
+			t.Fatalf("Expected error %v publishing on %q, got %v", ErrInvalidChannel, channel, err)
+		}
+		if _, err := sc.Subscribe(channel, func(*stan.Msg) {}); err == nil || err.Error() != ErrInvalidChannel.Error() {
+			t.Fatalf("Expected error %v subscribing to %q, got %v", ErrInvalidChannel, channel, err)
+		}
+	}
+	resp := &spb.AdminCreateChannelResponse{}
+	sendAdminRequest(t, nc, AdminCreateChannel, &spb.AdminCreateChannelRequest{Channel: "Foo"}, resp)
+	if resp.Error != ErrInvalidChannel.Error() {
+		t.Fatalf("Expected error %v, got %v", ErrInvalidChannel, resp.Error)
+	}
+
+	// Clients can subscribe to reserved channels, but not publish on them.
+	for _, channel := range []string{"internal.x", AdvisoryChannel(AdvisoryClientConnect)} {
+		if err := sc.Publish(channel, []byte("hello")); err == nil || err.Error() != ErrReservedChannel.Error() {
+			t.Fatalf("Expected error %v publishing on %q, got %v", ErrReservedChannel, channel, err)
+		}
+	}
+	if _, err := sc.Subscribe("internal.x", func(*stan.Msg) {}); err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+}
+
+func TestChannelAliases(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	sOpts := GetDefaultOptions()
+	sOpts.ID = clusterName
+	sOpts.StoreType = stores.TypeFile
+	sOpts.FilestoreDir = defaultDataStore
+	sOpts.NoImplicitChannels = true
+	sOpts.Channels = []*ChannelConfig{{Name: "foo", Aliases: []string{"bar"}}}
+	s := runServerWithOpts(t, sOpts, nil)
+	defer s.Shutdown()
+
+	sc := NewDefaultConnection(t)
+	defer sc.Close()
+
+	ch := make(chan *stan.Msg, 10)
+	sub, err := sc.Subscribe("bar", func(m *stan.Msg) { ch <- m }, stan.DurableName("dur"))
+	if err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+	for _, channel := range []string{"foo", "bar"} {
+		if err := sc.Publish(channel, []byte(channel)); err != nil {
+			t.Fatalf("Unexpected error on publish: %v", err)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case m := <-ch:
+			if m.Subject != "foo" || m.Sequence != uint64(i+1) {
+				t.Fatalf("Unexpected message: %v", m)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Did not get our message")
+		}
+	}
+	if s.store.LookupChannel("bar") != nil {
+		t.Fatal("Alias should not have been created as a channel")
+	}
+	if n, _, _ := s.store.LookupChannel("foo").Msgs.State(); n != 2 {
+		t.Fatalf("Expected 2 messages, got %v", n)
+	}
+
+	// The durable is created on the channel, and unsubscribed with the alias.
+	countDurables := func() int {
+		ss := s.store.LookupChannel("foo").UserData.(*subStore)
+		ss.RLock()
+		defer ss.RUnlock()
+		return len(ss.durables)
+	}
+	if n := countDurables(); n != 1 {
+		t.Fatalf("Expected 1 durable on foo, got %v", n)
+	}
+	if err := sub.Unsubscribe(); err != nil {
+		t.Fatalf("Unexpected error on unsubscribe: %v", err)
+	}
+	if n := countDurables(); n != 0 {
+		t.Fatalf("Expected no durable on foo, got %v", n)
+	}
+	sc.Close()
+	s.Shutdown()
+
+	// An alias can't hide an existing channel.
+	sOpts.Channels = []*ChannelConfig{{Name: "baz", Aliases: []string{"foo"}}}
+	if s, err := StartServerWithOpts(sOpts, nil); err == nil {
+		s.Shutdown()
+		t.Fatal("Expected server to fail to start")
+	}
+}
@@ -3,6 +3,7 @@
 package server
 
 import (
+	"github.com/nats-io/nats-streaming-server/spb"
 	"github.com/nats-io/nats-streaming-server/stores"
 	"sync"
 	"time"
@@ -21,13 +22,41 @@ type client struct {
 	hbt          *time.Timer
 	fhb          int
 	subs         []*subState
+	perms        *Permissions  // nil if the server has no users configured
+	session      string        // secret of the connection, sent with the requests of the client, empty without users
+	pubInFlight  chan struct{} // one slot per published message not yet acknowledged, created on first use
+}
+
+// pubWindow returns the publish window of the client, created with the
+// given size if needed.
+func (c *client) pubWindow(size int) chan struct{} {
+	c.Lock()
+	defer c.Unlock()
+	if c.pubInFlight == nil {
+		c.pubInFlight = make(chan struct{}, size)
+	}
+	return c.pubInFlight
+}
+
+// clientMetadata returns the metadata stored with the client, which is empty
+// for clients recovered from a store written by a previous version.
+func clientMetadata(sc *stores.Client) *spb.ClientMetadata {
+	md := &spb.ClientMetadata{}
+	if len(sc.Metadata) > 0 {
+		md.Unmarshal(sc.Metadata)
+	}
+	return md
 }
 
 // Register a client if new, otherwise returns the client already registered
-// and `false` to indicate that the client is not new.
-func (cs *clientStore) Register(ID, hbInbox string) (*stores.Client, bool, error) {
+// and `false` to indicate that the client is not new. A client with
+// permissions gets a new session.
+func (cs *clientStore) Register(ID, hbInbox string, perms *Permissions) (*stores.Client, bool, error) {
 	// Will be gc'ed if we fail to register, that's ok.
-	c := &client{subs: make([]*subState, 0, 4)}
+	c := &client{subs: make([]*subState, 0, 4), perms: perms}
+	if perms != nil {
+		c.session = newSession()
+	}
 	sc, isNew, err := cs.store.AddClient(ID, hbInbox, c)
 	if err != nil {
 		return nil, false, err
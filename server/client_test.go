@@ -32,7 +32,7 @@ func TestClientRegister(t *testing.T) {
 	clientID, hbInbox := createClientInfo()
 
 	// Register a new one
-	sc, isNew, _ := cs.Register(clientID, hbInbox)
+	sc, isNew, _ := cs.Register(clientID, hbInbox, nil)
 	if sc == nil || !isNew {
 		t.Fatal("Expected client to be new")
 	}
@@ -63,7 +63,7 @@ func TestClientRegister(t *testing.T) {
 	}()
 
 	// Register with same info
-	secondCli, isNew, _ := cs.Register(clientID, hbInbox)
+	secondCli, isNew, _ := cs.Register(clientID, hbInbox, nil)
 	if secondCli != sc || isNew {
 		t.Fatal("Expected to get the same client")
 	}
@@ -86,7 +86,7 @@ func TestClientParallelRegister(t *testing.T) {
 
 			for j := 0; j < totalClients; j++ {
 				clientID := fmt.Sprintf("clientID-%v", j)
-				c, isNew, _ := cs.Register(clientID, hbInbox)
+				c, isNew, _ := cs.Register(clientID, hbInbox, nil)
 				if c == nil {
 					errors <- fmt.Errorf("client should not be nil")
 					return
@@ -125,7 +125,7 @@ func TestClientUnregister(t *testing.T) {
 	cs.Unregister(clientID)
 
 	// Now register a client
-	cs.Register(clientID, hbInbox)
+	cs.Register(clientID, hbInbox, nil)
 
 	// Verify it's in the list of clients
 	if !cs.IsValid(clientID) {
@@ -152,7 +152,7 @@ func TestClientLookup(t *testing.T) {
 	}
 
 	// Registers one
-	cs.Register(clientID, hbInbox)
+	cs.Register(clientID, hbInbox, nil)
 
 	// Lookup again
 	if c := cs.Lookup(clientID); c == nil {
@@ -180,12 +180,12 @@ func TestClientGetClients(t *testing.T) {
 	clientID := "me"
 	hbInbox := nuid.Next()
 
-	cs.Register(clientID, hbInbox)
+	cs.Register(clientID, hbInbox, nil)
 
 	clientID = "me2"
 	hbInbox = nuid.Next()
 
-	cs.Register(clientID, hbInbox)
+	cs.Register(clientID, hbInbox, nil)
 
 	clients := cs.store.GetClients()
 	if clients == nil || len(clients) != 2 {
@@ -212,7 +212,7 @@ func TestClientAddSub(t *testing.T) {
 	}
 
 	// Now register the client
-	sc, _, _ := cs.Register(clientID, hbInbox)
+	sc, _, _ := cs.Register(clientID, hbInbox, nil)
 
 	// Now this should work
 	if !cs.AddSub(clientID, sub) {
@@ -266,7 +266,7 @@ func TestClientAddSub(t *testing.T) {
 	insubs := 0
 	for i := 0; i < total; i++ {
 		// Register the client
-		cs.Register(clientID, hbInbox)
+		cs.Register(clientID, hbInbox, nil)
 		runtime.Gosched()
 		sc = cs.Unregister(clientID)
 		if sc == nil {
@@ -298,7 +298,7 @@ func TestClientRemoveSub(t *testing.T) {
 	}
 
 	// Now register the client
-	cs.Register(clientID, hbInbox)
+	cs.Register(clientID, hbInbox, nil)
 
 	// Add a subscription
 	if !cs.AddSub(clientID, sub) {
@@ -343,7 +343,7 @@ func TestClientRemoveSub(t *testing.T) {
 	insubs := 0
 	for i := 0; i < total; i++ {
 		// Register the client
-		cs.Register(clientID, hbInbox)
+		cs.Register(clientID, hbInbox, nil)
 		cs.AddSub(clientID, sub)
 		runtime.Gosched()
 		sc := cs.Unregister(clientID)
@@ -373,7 +373,7 @@ func TestClientGetSubs(t *testing.T) {
 	}
 
 	// Now register the client
-	cs.Register(clientID, hbInbox)
+	cs.Register(clientID, hbInbox, nil)
 
 	// Add a subscription
 	if !cs.AddSub(clientID, &subState{subject: "foo"}) {
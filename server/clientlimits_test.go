@@ -0,0 +1,243 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nats-io/go-nats-streaming"
+)
+
+func TestMaxClients(t *testing.T) {
+	opts := GetDefaultOptions()
+	opts.MaxClients = 2
+	s := RunServerWithOpts(opts, nil)
+	defer s.Shutdown()
+
+	sc1 := NewDefaultConnection(t)
+	defer sc1.Close()
+	sc2, err := stan.Connect(clusterName, "otherClient")
+	if err != nil {
+		t.Fatalf("Unexpected error on connect: %v", err)
+	}
+	if _, err := stan.Connect(clusterName, "thirdClient"); err == nil || !strings.Contains(err.Error(), ErrTooManyClients.Error()) {
+		t.Fatalf("Expected error %q, got %v", ErrTooManyClients, err)
+	}
+	sc2.Close()
+	waitForNumClients(t, s, 1)
+	sc3, err := stan.Connect(clusterName, "thirdClient")
+	if err != nil {
+		t.Fatalf("Unexpected error on connect: %v", err)
+	}
+	sc3.Close()
+}
+
+func TestMaxSubsPerClient(t *testing.T) {
+	opts := GetDefaultOptions()
+	opts.MaxSubsPerClient = 2
+	s := RunServerWithOpts(opts, nil)
+	defer s.Shutdown()
+
+	sc := NewDefaultConnection(t)
+	defer sc.Close()
+
+	cb := func(_ *stan.Msg) {}
+	if err := sc.Publish("foo.bar", []byte("hello")); err != nil {
+		t.Fatalf("Unexpected error on publish: %v", err)
+	}
+	if err := sc.Publish("foo.baz", []byte("hello")); err != nil {
+		t.Fatalf("Unexpected error on publish: %v", err)
+	}
+	// A wildcard subscription counts as one.
+	if _, err := sc.Subscribe("foo.*", cb); err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+	sub, err := sc.Subscribe("foo.bar", cb)
+	if err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+	if _, err := sc.Subscribe("foo.bar", cb); err == nil || err.Error() != ErrMaxClientSubs.Error() {
+		t.Fatalf("Expected error %q, got %v", ErrMaxClientSubs, err)
+	}
+	if _, err := sc.Subscribe("foo.>", cb); err == nil || err.Error() != ErrMaxClientSubs.Error() {
+		t.Fatalf("Expected error %q, got %v", ErrMaxClientSubs, err)
+	}
+	// Other clients are not affected.
+	sc2, err := stan.Connect(clusterName, "otherClient")
+	if err != nil {
+		t.Fatalf("Unexpected error on connect: %v", err)
+	}
+	defer sc2.Close()
+	if _, err := sc2.Subscribe("foo.bar", cb); err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+	if err := sub.Unsubscribe(); err != nil {
+		t.Fatalf("Unexpected error on unsubscribe: %v", err)
+	}
+	if _, err := sc.Subscribe("foo.bar", cb); err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+}
+
+func TestMaxChannelsPerClient(t *testing.T) {
+	opts := GetDefaultOptions()
+	opts.MaxChannelsPerClient = 2
+	s := RunServerWithOpts(opts, nil)
+	defer s.Shutdown()
+
+	sc := NewDefaultConnection(t)
+	defer sc.Close()
+
+	if err := sc.Publish("foo", []byte("hello")); err != nil {
+		t.Fatalf("Unexpected error on publish: %v", err)
+	}
+	if _, err := sc.Subscribe("bar", func(_ *stan.Msg) {}); err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+	if err := sc.Publish("baz", []byte("hello")); err == nil || err.Error() != ErrMaxClientChans.Error() {
+		t.Fatalf("Expected error %q, got %v", ErrMaxClientChans, err)
+	}
+	if _, err := sc.Subscribe("baz", func(_ *stan.Msg) {}); err == nil || err.Error() != ErrMaxClientChans.Error() {
+		t.Fatalf("Expected error %q, got %v", ErrMaxClientChans, err)
+	}
+	// Existing channels can still be used.
+	if err := sc.Publish("bar", []byte("hello")); err != nil {
+		t.Fatalf("Unexpected error on publish: %v", err)
+	}
+	// Other clients can create channels.
+	sc2, err := stan.Connect(clusterName, "otherClient")
+	if err != nil {
+		t.Fatalf("Unexpected error on connect: %v", err)
+	}
+	defer sc2.Close()
+	if err := sc2.Publish("baz", []byte("hello")); err != nil {
+		t.Fatalf("Unexpected error on publish: %v", err)
+	}
+	// Reconnecting does not reset the count.
+	sc.Close()
+	sc = NewDefaultConnection(t)
+	defer sc.Close()
+	if err := sc.Publish("bat", []byte("hello")); err == nil || err.Error() != ErrMaxClientChans.Error() {
+		t.Fatalf("Expected error %q, got %v", ErrMaxClientChans, err)
+	}
+}
+
+func TestMaxQueueMembers(t *testing.T) {
+	opts := GetDefaultOptions()
+	opts.MaxQueueMembers = 2
+	s := RunServerWithOpts(opts, nil)
+	defer s.Shutdown()
+
+	sc := NewDefaultConnection(t)
+	defer sc.Close()
+
+	cb := func(_ *stan.Msg) {}
+	qsub, err := sc.QueueSubscribe("foo", "group", cb)
+	if err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+	if _, err := sc.QueueSubscribe("foo", "group", cb); err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+	if _, err := sc.QueueSubscribe("foo", "group", cb); err == nil || err.Error() != ErrMaxQueueMembers.Error() {
+		t.Fatalf("Expected error %q, got %v", ErrMaxQueueMembers, err)
+	}
+	// Other groups and channels are not affected.
+	if _, err := sc.QueueSubscribe("foo", "other", cb); err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+	if _, err := sc.QueueSubscribe("bar", "group", cb); err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+	// A member leaving makes room for a new one.
+	if err := qsub.Unsubscribe(); err != nil {
+		t.Fatalf("Unexpected error on unsubscribe: %v", err)
+	}
+	if _, err := sc.QueueSubscribe("foo", "group", cb); err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+}
+
+func TestSubBounds(t *testing.T) {
+	for _, bounds := range []Options{
+		{MinAckWait: -time.Second},
+		{MaxAckWait: 500 * time.Millisecond},
+		{MinAckWait: 5 * time.Second, MaxAckWait: 2 * time.Second},
+		{MinSubInFlight: 10, MaxSubInFlight: 5},
+	} {
+		opts := GetDefaultOptions()
+		opts.MinAckWait, opts.MaxAckWait = bounds.MinAckWait, bounds.MaxAckWait
+		opts.MinSubInFlight, opts.MaxSubInFlight = bounds.MinSubInFlight, bounds.MaxSubInFlight
+		if s, err := StartServerWithOpts(opts, nil); err == nil {
+			s.Shutdown()
+			t.Fatalf("Expected error with bounds %v, %v, %v, %v", bounds.MinAckWait, bounds.MaxAckWait,
+				bounds.MinSubInFlight, bounds.MaxSubInFlight)
+		}
+	}
+
+	opts := GetDefaultOptions()
+	opts.MinAckWait = 1500 * time.Millisecond
+	opts.MaxAckWait = time.Minute
+	opts.MinSubInFlight = 10
+	opts.MaxSubInFlight = 100
+	s := runServerWithOpts(t, opts, nil)
+	defer func() { s.Shutdown() }()
+
+	sc := NewDefaultConnection(t)
+	defer func() { sc.Close() }()
+
+	cb := func(_ *stan.Msg) {}
+	for _, c := range []struct {
+		opts []stan.SubscriptionOption
+		err  error
+	}{
+		{[]stan.SubscriptionOption{stan.AckWait(time.Second), stan.MaxInflight(50)}, ErrAckWaitBounds},
+		{[]stan.SubscriptionOption{stan.AckWait(2 * time.Minute), stan.MaxInflight(50)}, ErrAckWaitBounds},
+		{[]stan.SubscriptionOption{stan.AckWait(30 * time.Second), stan.MaxInflight(5)}, ErrInFlightBounds},
+		{[]stan.SubscriptionOption{stan.AckWait(30 * time.Second), stan.MaxInflight(500)}, ErrInFlightBounds},
+	} {
+		if _, err := sc.Subscribe("foo", cb, c.opts...); err == nil || err.Error() != c.err.Error() {
+			t.Fatalf("Expected error %q, got %v", c.err, err)
+		}
+	}
+	if _, err := sc.Subscribe("foo", cb, stan.AckWait(2*time.Second), stan.MaxInflight(100)); err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+	s.Shutdown()
+
+	// Out of bounds values are brought within bounds if so configured.
+	opts.ClampSubBounds = true
+	s = runServerWithOpts(t, opts, nil)
+	sc.Close()
+	sc = NewDefaultConnection(t)
+	for _, c := range []struct {
+		ackWait     time.Duration
+		maxInFlight int
+		expected    []int32
+	}{
+		{time.Second, 5, []int32{2, 10}},
+		{2 * time.Minute, 500, []int32{60, 100}},
+		{30 * time.Second, 50, []int32{30, 50}},
+	} {
+		sub, err := sc.Subscribe("foo", cb, stan.AckWait(c.ackWait), stan.MaxInflight(c.maxInFlight))
+		if err != nil {
+			t.Fatalf("Unexpected error on subscribe: %v", err)
+		}
+		subs := s.clients.GetSubs(clientName)
+		if len(subs) != 1 {
+			t.Fatalf("Expected 1 subscription, got %v", len(subs))
+		}
+		subs[0].RLock()
+		ackWait, maxInFlight := subs[0].AckWaitInSecs, subs[0].MaxInFlight
+		subs[0].RUnlock()
+		if ackWait != c.expected[0] || maxInFlight != c.expected[1] {
+			t.Fatalf("Expected ack wait %v and max in flight %v, got %v and %v",
+				c.expected[0], c.expected[1], ackWait, maxInFlight)
+		}
+		if err := sub.Unsubscribe(); err != nil {
+			t.Fatalf("Unexpected error on unsubscribe: %v", err)
+		}
+	}
+}
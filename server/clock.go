@@ -0,0 +1,38 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import "time"
+
+// Clock is the source of time of the redelivery of unacknowledged
+// messages, of the delivery rate of subscriptions, and of the delayed
+// delivery and expiration of messages. It is
+// meant to be replaced by a fake clock in tests, so that redelivery and
+// expiration can be triggered without waiting. Note that the timestamps
+// of the messages are assigned by the store, from the system time unless
+// Options.MsgStamper or Options.MonotonicTimestamps is set.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+	// AfterFunc calls f in its own go routine once the duration has
+	// elapsed, unless the returned timer is stopped first.
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+// Timer is a timer created by Clock.AfterFunc. It has the same semantic
+// as time.Timer.
+type Timer interface {
+	Stop() bool
+	Reset(d time.Duration) bool
+}
+
+// systemClock is the Clock used by default, based on the time package.
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) AfterFunc(d time.Duration, f func()) Timer {
+	return time.AfterFunc(d, f)
+}
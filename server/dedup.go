@@ -0,0 +1,104 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+// Maximum number of acknowledged sequences above the ack floor that are
+// remembered for a subscription with redelivery suppression. When the
+// window is full, the lowest sequence is forgotten.
+const dedupWindow = 1024
+
+// isAcked returns true if the subscription suppresses the redelivery of
+// acknowledged messages and the message with the given sequence has been
+// acknowledged.
+// Sub lock should be held before calling.
+func (sub *subState) isAcked(seq uint64) bool {
+	if !sub.Dedup {
+		return false
+	}
+	if seq <= sub.AckFloor {
+		return true
+	}
+	_, acked := sub.recentAcks[seq]
+	return acked
+}
+
+// recordAck records the acknowledgment of the given sequence for a
+// subscription with redelivery suppression. The ack floor is the sequence
+// up to which all messages have been acknowledged, that is, just below
+// the lowest pending or scheduled message. It is persisted whenever it
+// advances. Acknowledged sequences above the floor are kept in memory.
+// Sub lock should be held before calling.
+func (s *StanServer) recordAck(sub *subState, seq uint64) {
+	if !sub.Dedup {
+		return
+	}
+	floor := sub.LastSent
+	for pseq := range sub.acksPending {
+		if pseq-1 < floor {
+			floor = pseq - 1
+		}
+	}
+	for pseq := range sub.scheduled {
+		if pseq-1 < floor {
+			floor = pseq - 1
+		}
+	}
+	if seq > floor {
+		if sub.recentAcks == nil {
+			sub.recentAcks = make(map[uint64]struct{})
+		}
+		sub.recentAcks[seq] = struct{}{}
+		if len(sub.recentAcks) > dedupWindow {
+			lowest := seq
+			for aseq := range sub.recentAcks {
+				if aseq < lowest {
+					lowest = aseq
+				}
+			}
+			delete(sub.recentAcks, lowest)
+		}
+	}
+	if floor <= sub.AckFloor {
+		return
+	}
+	sub.AckFloor = floor
+	for aseq := range sub.recentAcks {
+		if aseq <= floor {
+			delete(sub.recentAcks, aseq)
+		}
+	}
+	if err := sub.store.UpdateSub(&sub.SubState); err != nil {
+		Errorf("STAN: [Client:%s] Unable to persist ack floor %v for %s (%v)",
+			sub.ClientID, floor, sub.subject, err)
+	}
+}
+
+// dropAckedPending removes from the recovered pending messages of a
+// subscription with redelivery suppression those that are at or below
+// its ack floor. They have been acknowledged, but the ack was not
+// recorded by the store before the server stopped.
+func dropAckedPending(sub *subState) {
+	if !sub.Dedup {
+		return
+	}
+	var acked []uint64
+	for seq := range sub.acksPending {
+		if seq <= sub.AckFloor {
+			delete(sub.acksPending, seq)
+			acked = append(acked, seq)
+		}
+	}
+	for seq := range sub.scheduled {
+		if seq <= sub.AckFloor {
+			delete(sub.scheduled, seq)
+			acked = append(acked, seq)
+		}
+	}
+	if len(acked) == 0 {
+		return
+	}
+	if err := sub.store.AckSeqPendingBatch(sub.ID, acked...); err != nil {
+		Errorf("STAN: Unable to persist acks of subscription %v on subject=%s: %v",
+			sub.ID, sub.subject, err)
+	}
+}
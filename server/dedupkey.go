@@ -0,0 +1,123 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats-streaming-server/stores"
+	"github.com/nats-io/nats-streaming-server/util"
+)
+
+// DedupWindow sets the deduplication window of the channels matching
+// Channel, a channel or a wildcard subject. A message published with a
+// dedup key is dropped if a message with the same key has been stored on
+// the channel within the window. The first matching window applies.
+type DedupWindow struct {
+	Channel string
+	Window  time.Duration
+}
+
+// ParseDedupWindows parses a comma separated list of `channel=duration`,
+// for instance `orders.>=2m,payments=10m`.
+func ParseDedupWindows(list string) ([]*DedupWindow, error) {
+	var windows []*DedupWindow
+	for _, w := range strings.Split(list, ",") {
+		if w = strings.TrimSpace(w); w == "" {
+			continue
+		}
+		i := strings.LastIndex(w, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("invalid dedup window %q, expected channel=duration", w)
+		}
+		channel := w[:i]
+		if !isValidSubject(channel) && !isValidWildcardSubject(channel) {
+			return nil, fmt.Errorf("invalid channel %q in dedup window", channel)
+		}
+		window, err := time.ParseDuration(w[i+1:])
+		if err != nil || window <= 0 {
+			return nil, fmt.Errorf("invalid duration in dedup window %q", w)
+		}
+		windows = append(windows, &DedupWindow{Channel: channel, Window: window})
+	}
+	return windows, nil
+}
+
+// dedupWindow returns the deduplication window of the channel, 0 if none.
+func (s *StanServer) dedupWindow(channel string) time.Duration {
+	for _, w := range s.opts.DedupWindows {
+		if util.SubjectMatches(w.Channel, channel) {
+			return w.Window
+		}
+	}
+	return 0
+}
+
+// dedupKeys holds the dedup keys of the messages stored on a channel
+// within its deduplication window, with the time they were stored.
+type dedupKeys struct {
+	sync.Mutex
+	window    int64 // in nanoseconds
+	keys      map[string]int64
+	lastPurge int64
+}
+
+// channelDedupKeys returns the dedup keys of the channel, or nil if the
+// channel has no deduplication window. On first use, the keys are read
+// from the messages stored within the window, which are persisted, so
+// that a restart does not reopen the window.
+func (s *StanServer) channelDedupKeys(cs *stores.ChannelStore, channel string) *dedupKeys {
+	ss := cs.UserData.(*subStore)
+	ss.Lock()
+	defer ss.Unlock()
+	if ss.dedupSet {
+		return ss.dedup
+	}
+	ss.dedupSet = true
+	window := s.dedupWindow(channel)
+	if window <= 0 {
+		return nil
+	}
+	dk := &dedupKeys{window: int64(window), keys: make(map[string]int64)}
+	now := time.Now().UnixNano()
+	dk.lastPurge = now
+	last := cs.Msgs.LastSequence()
+	for seq := cs.Msgs.GetSequenceFromTimestamp(now - dk.window); seq != 0 && seq <= last; seq++ {
+		ext := cs.Msgs.LookupExt(seq)
+		if ext == nil || ext.DedupKey == "" {
+			continue
+		}
+		if m, err := cs.Msgs.Lookup(seq); err == nil && m != nil {
+			dk.keys[ext.DedupKey] = m.Timestamp
+		}
+	}
+	ss.dedup = dk
+	return dk
+}
+
+// isDuplicate returns true if the key has been stored within the window.
+// Keys that are out of the window are purged at most once per window.
+func (dk *dedupKeys) isDuplicate(key string, now int64) bool {
+	dk.Lock()
+	defer dk.Unlock()
+	if now-dk.lastPurge >= dk.window {
+		for k, ts := range dk.keys {
+			if now-ts >= dk.window {
+				delete(dk.keys, k)
+			}
+		}
+		dk.lastPurge = now
+	}
+	ts, ok := dk.keys[key]
+	return ok && now-ts < dk.window
+}
+
+// add records the key of a message stored at the given time.
+func (dk *dedupKeys) add(key string, timestamp int64) {
+	dk.Lock()
+	dk.keys[key] = timestamp
+	dk.Unlock()
+}
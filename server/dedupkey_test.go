@@ -0,0 +1,86 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats"
+	"github.com/nats-io/nats-streaming-server/spb"
+	"github.com/nats-io/nats-streaming-server/stores"
+)
+
+func TestParseDedupWindows(t *testing.T) {
+	windows, err := ParseDedupWindows("orders.>=2m, payments=10s,")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(windows) != 2 ||
+		windows[0].Channel != "orders.>" || windows[0].Window != 2*time.Minute ||
+		windows[1].Channel != "payments" || windows[1].Window != 10*time.Second {
+		t.Fatalf("Unexpected windows: %v, %v", windows[0], windows[1])
+	}
+	for _, list := range []string{"orders", "orders=abc", "orders=-1s", "orders..foo=1s"} {
+		if _, err := ParseDedupWindows(list); err == nil {
+			t.Fatalf("Expected error parsing %q", list)
+		}
+	}
+}
+
+func TestDedupWindow(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	opts := GetDefaultOptions()
+	opts.StoreType = stores.TypeFile
+	opts.FilestoreDir = defaultDataStore
+	opts.DedupWindows = []*DedupWindow{
+		{Channel: "foo", Window: time.Hour},
+		{Channel: "bar.>", Window: 100 * time.Millisecond},
+	}
+	s := RunServerWithOpts(opts, nil)
+	defer func() { s.Shutdown() }()
+
+	sc, nc := createConnectionWithNatsOpts(t, clientName,
+		nats.MaxReconnects(-1), nats.ReconnectWait(50*time.Millisecond))
+	defer nc.Close()
+	defer sc.Close()
+
+	publish := func(channel, key string) {
+		var ext *spb.MsgExt
+		if key != "" {
+			ext = &spb.MsgExt{DedupKey: key}
+		}
+		if err := sendPubMsgWithExt(t, s, nc, channel, []byte("hello"), ext); err != nil {
+			stackFatalf(t, "Unexpected error on publish: %v", err)
+		}
+	}
+	checkCount := func(channel string, expected int) {
+		if n, _, _ := s.store.LookupChannel(channel).Msgs.State(); n != expected {
+			stackFatalf(t, "Expected %v messages on %q, got %v", expected, channel, n)
+		}
+	}
+
+	publish("foo", "a")
+	publish("foo", "a")
+	publish("foo", "b")
+	publish("foo", "")
+	publish("foo", "")
+	checkCount("foo", 4)
+
+	// A key is accepted again once out of the window.
+	publish("bar.baz", "a")
+	publish("bar.baz", "a")
+	checkCount("bar.baz", 1)
+	time.Sleep(150 * time.Millisecond)
+	publish("bar.baz", "a")
+	checkCount("bar.baz", 2)
+
+	// The window is not reopened by a restart.
+	s.Shutdown()
+	s = RunServerWithOpts(opts, nil)
+	publish("foo", "a")
+	publish("foo", "c")
+	checkCount("foo", 5)
+}
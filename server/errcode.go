@@ -0,0 +1,58 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"strings"
+	"sync/atomic"
+)
+
+// Codes of the errors returned to clients when the MaxChannels and
+// MaxSubscriptions limits are reached. The protocol has no field for them,
+// so they end the error of the publish ack or subscription response, in
+// brackets: use ErrorCode to get them.
+const (
+	ErrCodeMaxChannels = "max_channels"
+	ErrCodeMaxSubs     = "max_subs"
+)
+
+// ErrorCode returns the code at the end of an error returned by the
+// server, such as ErrCodeMaxChannels, or an empty string if it has none.
+func ErrorCode(err error) string {
+	if err == nil {
+		return ""
+	}
+	msg := err.Error()
+	if !strings.HasSuffix(msg, "]") {
+		return ""
+	}
+	start := strings.LastIndex(msg, "[")
+	if start == -1 {
+		return ""
+	}
+	return msg[start+1 : len(msg)-1]
+}
+
+// rejectLimit counts an operation rejected because the limit of error
+// `err` is reached, records the limit violation `r` with the code of the
+// error, and returns the error.
+func (s *StanServer) rejectLimit(err error, r *auditRecord) error {
+	switch err {
+	case ErrMaxChannels:
+		atomic.AddUint64(&s.rejectedChannels, 1)
+	case ErrMaxSubs:
+		atomic.AddUint64(&s.rejectedSubs, 1)
+	}
+	r.Code = ErrorCode(err)
+	s.recordEvent(r)
+	return err
+}
+
+// RejectedOps returns the number of operations rejected since the server
+// started, by error code.
+func (s *StanServer) RejectedOps() map[string]uint64 {
+	return map[string]uint64{
+		ErrCodeMaxChannels: atomic.LoadUint64(&s.rejectedChannels),
+		ErrCodeMaxSubs:     atomic.LoadUint64(&s.rejectedSubs),
+	}
+}
@@ -0,0 +1,61 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"github.com/nats-io/nats-streaming-server/spb"
+)
+
+// ProtocolVersion is the version of the protocol implemented by the server.
+// It is incremented when a change of the protocol can't be detected with
+// the features below.
+const ProtocolVersion = 1
+
+// Features of the server, listed in the ConnectResponseExt, so that clients
+// can check for them instead of timing out on requests that an older server
+// ignores.
+const (
+	FeatureHeaders         = "headers"          // MsgExt headers
+	FeatureDelayedDelivery = "delayed_delivery" // MsgExt deliverAt and deliverDelay
+	FeatureExpiration      = "expiration"       // MsgExt expiration and ttl
+	FeatureNak             = "nak"              // Negative acks, with AckExt
+	FeatureFetch           = "fetch"            // FetchRequest
+	FeatureLastValue       = "last_value"       // LastValueRequest
+	FeatureWildcardSubs    = "wildcard_subs"    // Subscriptions on wildcard subjects
+	FeatureFilters         = "filters"          // SubRequestExt filter
+	FeatureDeliveryRate    = "delivery_rate"    // SubRequestExt maxMsgsPerSec and maxBytesPerSec
+	FeaturePause           = "pause"            // PauseRequest
+	FeatureBatchPublish    = "batch_publish"    // PubBatchRequest
+	FeatureTransactions    = "transactions"     // PubTxRequest
+	FeatureDeliverSubject  = "deliver_subject"  // Delivery to a subject other than an inbox
+	FeatureWorkers         = "workers"          // SubRequestExt workers and MsgExt worker
+)
+
+var serverFeatures = []string{
+	FeatureHeaders,
+	FeatureDelayedDelivery,
+	FeatureExpiration,
+	FeatureNak,
+	FeatureFetch,
+	FeatureLastValue,
+	FeatureWildcardSubs,
+	FeatureFilters,
+	FeatureDeliveryRate,
+	FeaturePause,
+	FeatureBatchPublish,
+	FeatureTransactions,
+	FeatureDeliverSubject,
+	FeatureWorkers,
+}
+
+// connectResponseExt returns the attributes appended to the ConnectResponse
+// sent to a client supporting up to the given version of the protocol, 0
+// if it did not say: the version to use, the lowest of the client's and the
+// server's, and the features of the server.
+func connectResponseExt(clientProtocol uint32) *spb.ConnectResponseExt {
+	protocol := uint32(ProtocolVersion)
+	if clientProtocol != 0 && clientProtocol < protocol {
+		protocol = clientProtocol
+	}
+	return &spb.ConnectResponseExt{Protocol: protocol, Features: serverFeatures}
+}
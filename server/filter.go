@@ -0,0 +1,164 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/nats-io/go-nats-streaming/pb"
+	"github.com/nats-io/nats-streaming-server/spb"
+)
+
+// Prefix of a filter field that refers to a message header.
+const filterHeaderPrefix = "header."
+
+// Operators supported in a filter condition. Longer operators must be
+// listed first since they are looked up in order.
+var filterOps = []string{"==", "!=", "<=", ">=", "<", ">"}
+
+// msgFilter is a filter set on a subscription that the server evaluates
+// before delivering a message. It is a list of conditions that must all
+// be satisfied, for instance:
+//
+//	header.type == "order" && size > 100
+//
+// The supported fields are:
+//
+//	header.<name>  The value of the header <name>. Without an operator,
+//	               the condition is that the header is present.
+//	key            The key of the message.
+//	subject        The subject of the message.
+//	size           The size of the payload, which can be compared with
+//	               any operator.
+//
+// Other fields support only `==` and `!=`.
+type msgFilter struct {
+	conds []filterCond
+}
+
+// filterCond is a single condition of a msgFilter.
+type filterCond struct {
+	field string // "key", "subject", "size" or a "header.<name>"
+	op    string // empty if the condition is a header presence
+	value string
+	size  int // value converted to an int for the "size" field
+}
+
+// parseFilter returns the msgFilter corresponding to the given expression,
+// or an error if the expression is invalid.
+func parseFilter(expr string) (*msgFilter, error) {
+	f := &msgFilter{}
+	for _, c := range strings.Split(expr, "&&") {
+		cond, err := parseFilterCond(strings.TrimSpace(c))
+		if err != nil {
+			return nil, fmt.Errorf("%v in %q", err, expr)
+		}
+		f.conds = append(f.conds, cond)
+	}
+	return f, nil
+}
+
+// parseFilterCond parses a single condition.
+func parseFilterCond(c string) (filterCond, error) {
+	cond := filterCond{}
+	if c == "" {
+		return cond, fmt.Errorf("empty condition")
+	}
+	for _, op := range filterOps {
+		if i := strings.Index(c, op); i > 0 {
+			cond.field = strings.TrimSpace(c[:i])
+			cond.op = op
+			cond.value = strings.TrimSpace(c[i+len(op):])
+			break
+		}
+	}
+	if cond.op == "" {
+		cond.field = c
+	}
+	// Remove optional quotes around the value.
+	if l := len(cond.value); l >= 2 && cond.value[0] == '"' && cond.value[l-1] == '"' {
+		cond.value = cond.value[1 : l-1]
+	}
+	switch {
+	case strings.HasPrefix(cond.field, filterHeaderPrefix) && len(cond.field) > len(filterHeaderPrefix):
+		if cond.op != "" && cond.op != "==" && cond.op != "!=" {
+			return cond, fmt.Errorf("invalid operator %q for %q", cond.op, cond.field)
+		}
+	case cond.field == "key" || cond.field == "subject":
+		if cond.op != "==" && cond.op != "!=" {
+			return cond, fmt.Errorf("invalid operator %q for %q", cond.op, cond.field)
+		}
+	case cond.field == "size":
+		if cond.op == "" {
+			return cond, fmt.Errorf("missing operator for %q", cond.field)
+		}
+		size, err := strconv.Atoi(cond.value)
+		if err != nil {
+			return cond, fmt.Errorf("invalid size %q", cond.value)
+		}
+		cond.size = size
+	default:
+		return cond, fmt.Errorf("unknown field %q", cond.field)
+	}
+	return cond, nil
+}
+
+// match returns true if the message `m`, with its optional attributes
+// `ext`, satisfies all conditions of the filter.
+func (f *msgFilter) match(m *pb.MsgProto, ext *spb.MsgExt) bool {
+	for i := range f.conds {
+		if !f.conds[i].match(m, ext) {
+			return false
+		}
+	}
+	return true
+}
+
+// match returns true if the message satisfies this condition.
+func (c *filterCond) match(m *pb.MsgProto, ext *spb.MsgExt) bool {
+	var value string
+	switch c.field {
+	case "size":
+		size := len(m.Data)
+		switch c.op {
+		case "==":
+			return size == c.size
+		case "!=":
+			return size != c.size
+		case "<":
+			return size < c.size
+		case "<=":
+			return size <= c.size
+		case ">":
+			return size > c.size
+		default:
+			return size >= c.size
+		}
+	case "subject":
+		value = m.Subject
+	case "key":
+		if ext != nil {
+			value = ext.Key
+		}
+	default:
+		name := c.field[len(filterHeaderPrefix):]
+		found := false
+		if ext != nil {
+			for _, h := range ext.Headers {
+				if h.Key == name {
+					value, found = h.Value, true
+					break
+				}
+			}
+		}
+		if c.op == "" {
+			return found
+		}
+	}
+	if c.op == "==" {
+		return value == c.value
+	}
+	return value != c.value
+}
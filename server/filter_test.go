@@ -0,0 +1,73 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"testing"
+
+	"github.com/nats-io/go-nats-streaming/pb"
+	"github.com/nats-io/nats-streaming-server/spb"
+)
+
+func TestParseFilterErrors(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"foo == bar",
+		"header.",
+		"header.type == a &&",
+		"key",
+		"key > a",
+		"subject < foo",
+		"size",
+		"size > abc",
+		"header.type > a",
+	} {
+		if _, err := parseFilter(expr); err == nil {
+			t.Fatalf("Expected error for filter %q", expr)
+		}
+	}
+}
+
+func TestFilterMatch(t *testing.T) {
+	m := &pb.MsgProto{Subject: "foo", Data: []byte("hello")}
+	ext := &spb.MsgExt{
+		Key:     "k1",
+		Headers: []*spb.MsgHeader{&spb.MsgHeader{Key: "type", Value: "order"}},
+	}
+	tests := []struct {
+		expr  string
+		ext   *spb.MsgExt
+		match bool
+	}{
+		{"header.type", ext, true},
+		{"header.type", nil, false},
+		{"header.other", ext, false},
+		{"header.type == order", ext, true},
+		{`header.type == "order"`, ext, true},
+		{"header.type != order", ext, false},
+		{"header.type == quote", ext, false},
+		{"header.other != order", ext, true},
+		{"key == k1", ext, true},
+		{"key == k1", nil, false},
+		{"key != k1", nil, true},
+		{"subject == foo", nil, true},
+		{"subject != foo", nil, false},
+		{"size == 5", nil, true},
+		{"size != 5", nil, false},
+		{"size < 5", nil, false},
+		{"size <= 5", nil, true},
+		{"size > 4", nil, true},
+		{"size >= 6", nil, false},
+		{"header.type == order && size > 4 && key == k1", ext, true},
+		{"header.type == order && size > 5", ext, false},
+	}
+	for _, test := range tests {
+		f, err := parseFilter(test.expr)
+		if err != nil {
+			t.Fatalf("Unexpected error parsing %q: %v", test.expr, err)
+		}
+		if match := f.match(m, test.ext); match != test.match {
+			t.Fatalf("Filter %q: expected match to be %v, got %v", test.expr, test.match, match)
+		}
+	}
+}
@@ -0,0 +1,301 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+//go:build grpc
+// +build grpc
+
+package server
+
+import (
+	"encoding/base64"
+	"strings"
+	"time"
+
+	"github.com/nats-io/gnatsd/server"
+	"github.com/nats-io/nats"
+	"github.com/nats-io/nats-streaming-server/gpb"
+	"github.com/nats-io/nats-streaming-server/spb"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// grpcSupported is true: the server is built with the `grpc` tag.
+const grpcSupported = true
+
+// Timeout of the administrative requests of the gRPC API whose context has
+// no deadline.
+const grpcAdminTimeout = 30 * time.Second
+
+// newGRPCService returns a gRPC server with the Admin and Data services.
+// The Admin service forwards the administrative requests to their admin
+// subjects, and the Data service publishes and fetches messages as the
+// HTTP gateway does (see gpb/service.proto). If `auth` is false, requests
+// are served without credentials, with all the permissions.
+func (s *StanServer) newGRPCService(auth bool) (grpcService, error) {
+	gs := grpc.NewServer()
+	gpb.RegisterAdminServer(gs, &grpcAdmin{s: s, auth: auth})
+	gpb.RegisterDataServer(gs, &grpcData{s: s, auth: auth})
+	return gs, nil
+}
+
+// grpcUser returns the user matching the credentials of the call, or nil
+// if the server has no users or `auth` is false.
+func (s *StanServer) grpcUser(ctx context.Context, auth bool) (*User, error) {
+	if !auth || len(s.opts.Users) == 0 {
+		return nil, nil
+	}
+	u := s.authenticate(grpcCredentials(ctx))
+	if u == nil {
+		return nil, status.Errorf(codes.Unauthenticated, "%v", ErrAuthorization)
+	}
+	return u, nil
+}
+
+// grpcCredentials returns the credentials of the basic or bearer token
+// `authorization` metadata of the call, as sent to the HTTP gateway.
+func grpcCredentials(ctx context.Context) *spb.ConnectRequestExt {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok || len(md["authorization"]) == 0 {
+		return nil
+	}
+	auth := md["authorization"][0]
+	if strings.HasPrefix(auth, "Basic ") {
+		b, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(auth, "Basic "))
+		if i := strings.IndexByte(string(b), ':'); err == nil && i >= 0 {
+			return &spb.ConnectRequestExt{User: string(b[:i]), Password: string(b[i+1:])}
+		}
+	} else if strings.HasPrefix(auth, "Bearer ") {
+		return &spb.ConnectRequestExt{Token: strings.TrimPrefix(auth, "Bearer ")}
+	}
+	return nil
+}
+
+// grpcPeer returns the address of the caller, which identifies it in the
+// logs, the audit log and the publish rate limits.
+func grpcPeer(ctx context.Context) string {
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		return p.Addr.String()
+	}
+	return "grpc"
+}
+
+// grpcAdmin implements the gRPC Admin service.
+type grpcAdmin struct {
+	s    *StanServer
+	auth bool
+}
+
+// request checks that the caller can send administrative requests, then
+// sends the request to its admin subject, so that it is processed as any
+// administrative request, and decodes the reply into resp.
+func (a *grpcAdmin) request(ctx context.Context, name string, req, resp adminMsg) error {
+	u, err := a.s.grpcUser(ctx, a.auth)
+	if err != nil {
+		return err
+	}
+	if u != nil && !u.Permissions.Admin {
+		a.s.recordEvent(&auditRecord{Event: auditPermissionViolation, Client: grpcPeer(ctx),
+			Reason: ErrAdminPermission.Error()})
+		return status.Errorf(codes.PermissionDenied, "%v", ErrAdminPermission)
+	}
+	timeout := grpcAdminTimeout
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout = deadline.Sub(time.Now())
+	}
+	if err := a.s.forwardAdminRequest(name, req, resp, timeout); err != nil {
+		if err == nats.ErrTimeout {
+			return status.Errorf(codes.DeadlineExceeded, "%v", err)
+		}
+		return status.Errorf(codes.Unavailable, "%v", err)
+	}
+	return nil
+}
+
+func (a *grpcAdmin) Clients(ctx context.Context, req *spb.AdminClientsRequest) (*spb.AdminClientsResponse, error) {
+	resp := &spb.AdminClientsResponse{}
+	if err := a.request(ctx, AdminClients, req, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func (a *grpcAdmin) CloseClient(ctx context.Context, req *spb.AdminCloseClientRequest) (*spb.AdminCloseClientResponse, error) {
+	resp := &spb.AdminCloseClientResponse{}
+	if err := a.request(ctx, AdminCloseClient, req, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func (a *grpcAdmin) Channels(ctx context.Context, req *spb.AdminChannelsRequest) (*spb.AdminChannelsResponse, error) {
+	resp := &spb.AdminChannelsResponse{}
+	if err := a.request(ctx, AdminChannels, req, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func (a *grpcAdmin) CreateChannel(ctx context.Context, req *spb.AdminCreateChannelRequest) (*spb.AdminCreateChannelResponse, error) {
+	resp := &spb.AdminCreateChannelResponse{}
+	if err := a.request(ctx, AdminCreateChannel, req, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func (a *grpcAdmin) PurgeChannel(ctx context.Context, req *spb.AdminPurgeChannelRequest) (*spb.AdminPurgeChannelResponse, error) {
+	resp := &spb.AdminPurgeChannelResponse{}
+	if err := a.request(ctx, AdminPurgeChannel, req, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func (a *grpcAdmin) Limits(ctx context.Context, req *spb.AdminLimitsRequest) (*spb.AdminLimitsResponse, error) {
+	resp := &spb.AdminLimitsResponse{}
+	if err := a.request(ctx, AdminLimits, req, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func (a *grpcAdmin) Durables(ctx context.Context, req *spb.AdminDurablesRequest) (*spb.AdminDurablesResponse, error) {
+	resp := &spb.AdminDurablesResponse{}
+	if err := a.request(ctx, AdminDurables, req, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func (a *grpcAdmin) Queues(ctx context.Context, req *spb.AdminQueuesRequest) (*spb.AdminQueuesResponse, error) {
+	resp := &spb.AdminQueuesResponse{}
+	if err := a.request(ctx, AdminQueues, req, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func (a *grpcAdmin) DeleteDurable(ctx context.Context, req *spb.AdminDeleteDurableRequest) (*spb.AdminDeleteDurableResponse, error) {
+	resp := &spb.AdminDeleteDurableResponse{}
+	if err := a.request(ctx, AdminDeleteDurable, req, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func (a *grpcAdmin) RewindDurable(ctx context.Context, req *spb.AdminRewindDurableRequest) (*spb.AdminRewindDurableResponse, error) {
+	resp := &spb.AdminRewindDurableResponse{}
+	if err := a.request(ctx, AdminRewindDurable, req, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func (a *grpcAdmin) ExportDurable(ctx context.Context, req *spb.AdminExportDurableRequest) (*spb.AdminExportDurableResponse, error) {
+	resp := &spb.AdminExportDurableResponse{}
+	if err := a.request(ctx, AdminExportDurable, req, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func (a *grpcAdmin) ImportDurable(ctx context.Context, req *spb.AdminImportDurableRequest) (*spb.AdminImportDurableResponse, error) {
+	resp := &spb.AdminImportDurableResponse{}
+	if err := a.request(ctx, AdminImportDurable, req, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func (a *grpcAdmin) CopyMsgs(ctx context.Context, req *spb.AdminCopyMsgsRequest) (*spb.AdminCopyMsgsResponse, error) {
+	resp := &spb.AdminCopyMsgsResponse{}
+	if err := a.request(ctx, AdminCopyMsgs, req, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func (a *grpcAdmin) Snapshot(ctx context.Context, req *spb.AdminSnapshotRequest) (*spb.AdminSnapshotResponse, error) {
+	resp := &spb.AdminSnapshotResponse{}
+	if err := a.request(ctx, AdminSnapshot, req, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func (a *grpcAdmin) LameDuck(ctx context.Context, req *spb.AdminLameDuckRequest) (*spb.AdminLameDuckResponse, error) {
+	resp := &spb.AdminLameDuckResponse{}
+	if err := a.request(ctx, AdminLameDuck, req, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// grpcData implements the gRPC Data service.
+type grpcData struct {
+	s    *StanServer
+	auth bool
+}
+
+// permissions returns the permissions of the caller, nil for all of them.
+func (d *grpcData) permissions(ctx context.Context) (*Permissions, error) {
+	u, err := d.s.grpcUser(ctx, d.auth)
+	if u == nil {
+		return nil, err
+	}
+	return &u.Permissions, nil
+}
+
+// Publish stores the message in the channel, as a message published on the
+// HTTP gateway: it has no client ID, and the publish rate limits of the
+// caller apply to its address.
+func (d *grpcData) Publish(ctx context.Context, req *spb.PublishRequest) (*spb.PublishResponse, error) {
+	perms, err := d.permissions(ctx)
+	if err != nil {
+		return nil, err
+	}
+	resp := &spb.PublishResponse{}
+	if !isValidSubject(req.Channel) || strings.ContainsAny(req.Channel, "*>") {
+		resp.Error = ErrInvalidSubject.Error()
+		return resp, nil
+	}
+	if len(req.Data) > server.MAX_PAYLOAD_SIZE {
+		resp.Error = ErrInvalidPubReq.Error()
+		return resp, nil
+	}
+	caller := grpcPeer(ctx)
+	msg, err := d.s.storeGatewayMsg(caller, perms, req.Channel, req.Data)
+	if err != nil {
+		Errorf("STAN: Unable to store message published from %s, subject=%s: %v", caller, req.Channel, err)
+		resp.Error = err.Error()
+		return resp, nil
+	}
+	resp.Sequence, resp.Timestamp = msg.Sequence, msg.Timestamp
+	return resp, nil
+}
+
+// Fetch returns messages of the channel, as a FetchRequest received over
+// NATS, but with the permissions of the credentials of the call.
+func (d *grpcData) Fetch(ctx context.Context, req *spb.FetchRequest) (*spb.FetchResponse, error) {
+	perms, err := d.permissions(ctx)
+	if err != nil {
+		return nil, err
+	}
+	resp := &spb.FetchResponse{}
+	if req.Channel == "" || req.MaxMsgs < 0 || (req.StartSequence != 0 && req.StartTime != 0) {
+		resp.Error = ErrInvalidFetchReq.Error()
+		return resp, nil
+	}
+	channel := d.s.resolveChannel(req.Channel)
+	if perms != nil && !perms.canSubscribe(channel) {
+		d.s.recordEvent(&auditRecord{Event: auditPermissionViolation, Client: grpcPeer(ctx),
+			Channel: channel, Reason: ErrSubPermission.Error()})
+		resp.Error = ErrSubPermission.Error()
+		return resp, nil
+	}
+	d.s.fetchMsgs(channel, req, resp)
+	return resp, nil
+}
@@ -0,0 +1,146 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+//go:build grpc
+// +build grpc
+
+package server
+
+import (
+	"encoding/base64"
+	"testing"
+	"time"
+
+	"github.com/nats-io/go-nats-streaming/pb"
+	"github.com/nats-io/nats-streaming-server/gpb"
+	"github.com/nats-io/nats-streaming-server/spb"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// grpcTestConn returns a connection to the gRPC API of the server.
+func grpcTestConn(t *testing.T, s *StanServer) *grpc.ClientConn {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	conn, err := grpc.DialContext(ctx, s.grpcListener.Addr().String(), grpc.WithInsecure(), grpc.WithBlock())
+	if err != nil {
+		stackFatalf(t, "Unable to connect to the gRPC API: %v", err)
+	}
+	return conn
+}
+
+// grpcBasicAuth returns a context with the basic credentials of the user.
+func grpcBasicAuth(user, password string) context.Context {
+	auth := "Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+password))
+	return metadata.NewOutgoingContext(context.Background(), metadata.Pairs("authorization", auth))
+}
+
+func TestGRPC(t *testing.T) {
+	opts := GetDefaultOptions()
+	opts.GRPCListen = "localhost:0"
+	s := runServerWithOpts(t, opts, nil)
+	defer s.Shutdown()
+
+	conn := grpcTestConn(t, s)
+	defer conn.Close()
+	admin := gpb.NewAdminClient(conn)
+	data := gpb.NewDataClient(conn)
+	ctx := context.Background()
+
+	for i := 1; i <= 3; i++ {
+		resp, err := data.Publish(ctx, &spb.PublishRequest{Channel: "foo", Data: []byte("hello")})
+		if err != nil || resp.Error != "" || resp.Sequence != uint64(i) {
+			t.Fatalf("Unexpected publish response: %v, %v", resp, err)
+		}
+	}
+	presp, err := data.Publish(ctx, &spb.PublishRequest{Channel: "foo.*"})
+	if err != nil || presp.Error != ErrInvalidSubject.Error() {
+		t.Fatalf("Expected error %v, got %v, %v", ErrInvalidSubject, presp, err)
+	}
+
+	fresp, err := data.Fetch(ctx, &spb.FetchRequest{Channel: "foo", StartSequence: 2})
+	if err != nil || fresp.Error != "" || len(fresp.Msgs) != 2 || fresp.NextSequence != 4 {
+		t.Fatalf("Unexpected fetch response: %v, %v", fresp, err)
+	}
+	msg := &pb.MsgProto{}
+	if err := msg.Unmarshal(fresp.Msgs[0]); err != nil || msg.Sequence != 2 || string(msg.Data) != "hello" {
+		t.Fatalf("Unexpected message: %v, %v", msg, err)
+	}
+	fresp, err = data.Fetch(ctx, &spb.FetchRequest{Channel: "bar"})
+	if err != nil || fresp.Error != ErrUnknownChannel.Error() {
+		t.Fatalf("Expected error %v, got %v, %v", ErrUnknownChannel, fresp, err)
+	}
+
+	cresp, err := admin.Channels(ctx, &spb.AdminChannelsRequest{})
+	if err != nil || cresp.Error != "" || len(cresp.Channels) != 1 || cresp.Channels[0].Msgs != 3 {
+		t.Fatalf("Unexpected channels response: %v, %v", cresp, err)
+	}
+	// Errors of the requests are in the responses.
+	cresp, err = admin.Channels(ctx, &spb.AdminChannelsRequest{Channel: "bar"})
+	if err != nil || cresp.Error != ErrUnknownChannel.Error() {
+		t.Fatalf("Expected error %v, got %v, %v", ErrUnknownChannel, cresp, err)
+	}
+	purgeResp, err := admin.PurgeChannel(ctx, &spb.AdminPurgeChannelRequest{Channel: "foo"})
+	if err != nil || purgeResp.Error != "" || purgeResp.Purged != 2 {
+		t.Fatalf("Unexpected purge response: %v, %v", purgeResp, err)
+	}
+	lresp, err := admin.Limits(ctx, &spb.AdminLimitsRequest{})
+	if err != nil || lresp.Error != "" || lresp.MaxChannels != DefaultChannelLimit {
+		t.Fatalf("Unexpected limits response: %v, %v", lresp, err)
+	}
+}
+
+func TestGRPCAuthorization(t *testing.T) {
+	opts := GetDefaultOptions()
+	opts.GRPCListen = "localhost:0"
+	opts.Users = []*User{
+		{Username: "alice", Password: "foo", Permissions: Permissions{Publish: []string{"foo"}}},
+		{Username: "ops", Password: "bar", Permissions: Permissions{Admin: true}},
+	}
+	s := runServerWithOpts(t, opts, nil)
+	defer s.Shutdown()
+
+	conn := grpcTestConn(t, s)
+	defer conn.Close()
+	admin := gpb.NewAdminClient(conn)
+	data := gpb.NewDataClient(conn)
+	alice := grpcBasicAuth("alice", "foo")
+	ops := grpcBasicAuth("ops", "bar")
+
+	for _, ctx := range []context.Context{context.Background(), grpcBasicAuth("alice", "bar")} {
+		if _, err := data.Publish(ctx, &spb.PublishRequest{Channel: "foo"}); status.Code(err) != codes.Unauthenticated {
+			t.Fatalf("Expected unauthenticated error, got %v", err)
+		}
+	}
+	if resp, err := data.Publish(alice, &spb.PublishRequest{Channel: "foo"}); err != nil || resp.Error != "" {
+		t.Fatalf("Unexpected publish response: %v, %v", resp, err)
+	}
+	if resp, err := data.Publish(alice, &spb.PublishRequest{Channel: "bar"}); err != nil || resp.Error != ErrPubPermission.Error() {
+		t.Fatalf("Expected error %v, got %v, %v", ErrPubPermission, resp, err)
+	}
+	if resp, err := data.Fetch(alice, &spb.FetchRequest{Channel: "foo"}); err != nil || resp.Error != ErrSubPermission.Error() {
+		t.Fatalf("Expected error %v, got %v, %v", ErrSubPermission, resp, err)
+	}
+	if s.store.LookupChannel("bar") != nil {
+		t.Fatal("Channel bar should not have been created")
+	}
+
+	if _, err := admin.Channels(alice, &spb.AdminChannelsRequest{}); status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("Expected permission denied error, got %v", err)
+	}
+	if resp, err := admin.Channels(ops, &spb.AdminChannelsRequest{}); err != nil || resp.Error != "" || len(resp.Channels) != 1 {
+		t.Fatalf("Unexpected channels response: %v, %v", resp, err)
+	}
+}
+
+func TestGRPCListenerValidation(t *testing.T) {
+	opts := GetDefaultOptions()
+	opts.GRPCListen = "localhost:0"
+	opts.Users = []*User{{Username: "alice", Password: "foo"}}
+	opts.Listeners = []*Listener{{Service: ListenerGRPC, Address: "localhost:0", Auth: ListenerAuthUsers}}
+	if err := validateOptions(opts); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,49 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"net"
+)
+
+// grpcService serves the gRPC API on a listener. It is only implemented
+// when the server is built with the `grpc` tag (see grpc.go), so that the
+// applications embedding the server don't depend on gRPC otherwise.
+type grpcService interface {
+	Serve(l net.Listener) error
+	// Stop also closes the listener and the connections.
+	Stop()
+}
+
+// startGRPC starts serving the gRPC API on the GRPCListen address.
+func (s *StanServer) startGRPC() error {
+	if s.opts.GRPCListen == "" {
+		return nil
+	}
+	gs, err := s.newGRPCService(true)
+	if err != nil {
+		return err
+	}
+	l, err := listen(s.opts.GRPCListen)
+	if err != nil {
+		return err
+	}
+	s.grpcListener = l
+	s.grpcServer = gs
+	Noticef("STAN: Listening for gRPC requests on %s", l.Addr())
+	s.grpcWg.Add(1)
+	go func() {
+		defer s.grpcWg.Done()
+		gs.Serve(l)
+	}()
+	return nil
+}
+
+// stopGRPC stops accepting gRPC requests and closes the connections.
+func (s *StanServer) stopGRPC() {
+	if s.grpcServer == nil {
+		return
+	}
+	s.grpcServer.Stop()
+	s.grpcWg.Wait()
+}
@@ -0,0 +1,89 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// Status reported by the HealthzPath and ReadyzPath endpoints.
+const (
+	// HealthOK means that the server is running, or ready.
+	HealthOK = "ok"
+	// HealthDegraded means that the server is ready, but its store recently
+	// failed to write.
+	HealthDegraded = "degraded"
+	// HealthUnavailable means that the server is not ready.
+	HealthUnavailable = "unavailable"
+)
+
+// How long after a write error of the store the server is reported as
+// degraded.
+const storeErrorWindow = time.Minute
+
+// Health is the response of the HealthzPath and ReadyzPath endpoints.
+type Health struct {
+	Status string    `json:"status"`
+	Now    time.Time `json:"now"`
+	Errors []string  `json:"errors,omitempty"`
+}
+
+// handleHealthz reports that the process is alive.
+func (s *StanServer) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	httpJSON(w, http.StatusOK, &Health{Status: HealthOK, Now: time.Now()})
+}
+
+// handleReadyz reports whether the server is ready to serve clients: the
+// store is recovered, the connection to NATS is up, the server is not in
+// lame duck mode and the storage is below its high watermark. A ready
+// server whose store recently failed to write, or that is read-only after
+// a write error, is reported as degraded.
+func (s *StanServer) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	health := s.Readiness(time.Now())
+	status := http.StatusOK
+	if health.Status == HealthUnavailable {
+		status = http.StatusServiceUnavailable
+	}
+	httpJSON(w, status, health)
+}
+
+// Readiness returns the readiness of the server, as served by the
+// ReadyzPath endpoint.
+func (s *StanServer) Readiness(now time.Time) *Health {
+	health := &Health{Status: HealthOK, Now: now}
+	if atomic.LoadInt32(&s.ready) == 0 {
+		health.Errors = append(health.Errors, "server not started")
+	} else {
+		if !s.nc.IsConnected() {
+			health.Errors = append(health.Errors, "not connected to NATS")
+		}
+		if s.isLameDuck() {
+			health.Errors = append(health.Errors, "lame duck mode")
+		}
+		if s.isStorageFull() {
+			health.Errors = append(health.Errors, "storage above high watermark")
+		}
+		if s.isMemoryBudgetExceeded() {
+			health.Errors = append(health.Errors, "memory budget exceeded")
+		}
+	}
+	if len(health.Errors) > 0 {
+		health.Status = HealthUnavailable
+		return health
+	}
+	s.storeErrorLock.Lock()
+	if s.storeError != nil && now.Sub(s.storeErrorTime) < storeErrorWindow {
+		health.Status = HealthDegraded
+		health.Errors = append(health.Errors, fmt.Sprintf("store write error %v ago: %v",
+			now.Sub(s.storeErrorTime), s.storeError))
+	}
+	s.storeErrorLock.Unlock()
+	if s.isReadOnly() {
+		health.Status = HealthDegraded
+		health.Errors = append(health.Errors, "read-only after a store write error")
+	}
+	return health
+}
@@ -0,0 +1,93 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func getHealth(t *testing.T, s *StanServer, path string, expectedStatus int) *Health {
+	resp, err := http.Get(fmt.Sprintf("http://%s%s", s.monitorListener.Addr(), path))
+	if err != nil {
+		stackFatalf(t, "Unexpected error on GET: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != expectedStatus {
+		stackFatalf(t, "Expected status %v, got %v", expectedStatus, resp.Status)
+	}
+	health := &Health{}
+	if err := json.NewDecoder(resp.Body).Decode(health); err != nil {
+		stackFatalf(t, "Unexpected error decoding response: %v", err)
+	}
+	return health
+}
+
+func TestHealthz(t *testing.T) {
+	opts := GetDefaultOptions()
+	opts.MonitorListen = "localhost:0"
+	s := runServerWithOpts(t, opts, nil)
+	defer s.Shutdown()
+
+	if h := getHealth(t, s, HealthzPath, http.StatusOK); h.Status != HealthOK || len(h.Errors) != 0 {
+		t.Fatalf("Unexpected health: %+v", h)
+	}
+	if h := getHealth(t, s, ReadyzPath, http.StatusOK); h.Status != HealthOK || len(h.Errors) != 0 {
+		t.Fatalf("Unexpected readiness: %+v", h)
+	}
+
+	// A store write error degrades the server for a while.
+	s.recordStoreError(errors.New("disk failure"))
+	h := getHealth(t, s, ReadyzPath, http.StatusOK)
+	if h.Status != HealthDegraded || len(h.Errors) != 1 || !strings.Contains(h.Errors[0], "disk failure") {
+		t.Fatalf("Unexpected readiness: %+v", h)
+	}
+	if h := s.Readiness(time.Now().Add(storeErrorWindow)); h.Status != HealthOK {
+		t.Fatalf("Server should no longer be degraded: %+v", h)
+	}
+
+	// The server is not ready in lame duck mode.
+	atomic.StoreInt32(&s.lameDuck, 1)
+	h = getHealth(t, s, ReadyzPath, http.StatusServiceUnavailable)
+	if h.Status != HealthUnavailable || len(h.Errors) != 1 || h.Errors[0] != "lame duck mode" {
+		t.Fatalf("Unexpected readiness: %+v", h)
+	}
+	atomic.StoreInt32(&s.lameDuck, 0)
+
+	// Nor once shut down, while the process is still alive.
+	s.Shutdown()
+	if h := s.Readiness(time.Now()); h.Status != HealthUnavailable {
+		t.Fatalf("Unexpected readiness: %+v", h)
+	}
+}
+
+func TestReadyzStorageFull(t *testing.T) {
+	opts := GetDefaultOptions()
+	opts.MonitorListen = "localhost:0"
+	opts.StoreHighWatermark = 50
+	s := runServerWithOpts(t, opts, nil)
+	defer s.Shutdown()
+	s.storageLock.Lock()
+	s.storageCheckInterval = 0
+	s.storageLock.Unlock()
+
+	sc := NewDefaultConnection(t)
+	defer sc.Close()
+	if err := sc.Publish("foo", make([]byte, 100)); err != nil {
+		t.Fatalf("Unexpected error on publish: %v", err)
+	}
+	h := getHealth(t, s, ReadyzPath, http.StatusServiceUnavailable)
+	if h.Status != HealthUnavailable || len(h.Errors) != 1 || h.Errors[0] != "storage above high watermark" {
+		t.Fatalf("Unexpected readiness: %+v", h)
+	}
+	// The process is still alive.
+	if h := getHealth(t, s, HealthzPath, http.StatusOK); h.Status != HealthOK {
+		t.Fatalf("Unexpected health: %+v", h)
+	}
+}
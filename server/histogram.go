@@ -0,0 +1,89 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Number of buckets of a histogram. Bucket 0 counts the durations below
+// 1µs, bucket i the durations in [2^(i-1), 2^i) µs, and the last one all
+// longer durations (more than half an hour).
+const histogramBuckets = 32
+
+// histogram is a lock-free histogram of durations, with exponential
+// buckets. It is precise enough to spot a slow channel, not to measure
+// exact percentiles.
+type histogram struct {
+	count   int64
+	sum     int64
+	max     int64
+	buckets [histogramBuckets]int64
+}
+
+// Histogram is the summary of a histogram returned by the monitoring
+// endpoint. Durations are in nanoseconds. Percentiles are the upper bound
+// of the bucket they fall in, so they are at most twice the actual value.
+type Histogram struct {
+	Count int64         `json:"count"`
+	Mean  time.Duration `json:"mean"`
+	P50   time.Duration `json:"p50"`
+	P90   time.Duration `json:"p90"`
+	P99   time.Duration `json:"p99"`
+	Max   time.Duration `json:"max"`
+}
+
+// record adds the duration to the histogram.
+func (h *histogram) record(d time.Duration) {
+	if d < 0 {
+		d = 0
+	}
+	i := 0
+	for us := int64(d / time.Microsecond); us > 0 && i < histogramBuckets-1; us >>= 1 {
+		i++
+	}
+	atomic.AddInt64(&h.buckets[i], 1)
+	atomic.AddInt64(&h.count, 1)
+	atomic.AddInt64(&h.sum, int64(d))
+	for {
+		max := atomic.LoadInt64(&h.max)
+		if int64(d) <= max || atomic.CompareAndSwapInt64(&h.max, max, int64(d)) {
+			break
+		}
+	}
+}
+
+// summary returns the count, mean, percentiles and maximum of the recorded
+// durations.
+func (h *histogram) summary() *Histogram {
+	var buckets [histogramBuckets]int64
+	count := int64(0)
+	for i := range buckets {
+		buckets[i] = atomic.LoadInt64(&h.buckets[i])
+		count += buckets[i]
+	}
+	sum := atomic.LoadInt64(&h.sum)
+	max := time.Duration(atomic.LoadInt64(&h.max))
+	hs := &Histogram{Count: count, Max: max}
+	if count == 0 {
+		return hs
+	}
+	hs.Mean = time.Duration(sum / count)
+	percentile := func(p int64) time.Duration {
+		target, cumul := (count*p+99)/100, int64(0)
+		for i, n := range buckets {
+			cumul += n
+			if cumul >= target {
+				upper := time.Duration(1<<uint(i)) * time.Microsecond
+				if upper > max {
+					upper = max
+				}
+				return upper
+			}
+		}
+		return max
+	}
+	hs.P50, hs.P90, hs.P99 = percentile(50), percentile(90), percentile(99)
+	return hs
+}
@@ -0,0 +1,228 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nats-io/gnatsd/server"
+	"github.com/nats-io/nats-streaming-server/spb"
+)
+
+const (
+	// Path prefix of the HTTP gateway, followed by the channel name.
+	httpChannelsPath = "/channels/"
+
+	// Default and maximum number of messages returned by a fetch.
+	httpDefaultFetchLimit = 100
+	httpMaxFetchLimit     = 1000
+)
+
+var (
+	errHTTPUnknownChannel = errors.New("stan: unknown channel")
+	errHTTPInvalidRequest = errors.New("stan: invalid request")
+)
+
+// httpMsg is a message returned by the HTTP gateway. Data is encoded in
+// base64 in JSON.
+type httpMsg struct {
+	Sequence  uint64 `json:"sequence"`
+	Timestamp int64  `json:"timestamp"`
+	Data      []byte `json:"data,omitempty"`
+}
+
+// httpFetchResponse is the response to a GET request.
+type httpFetchResponse struct {
+	FirstSequence uint64     `json:"first_sequence"`
+	LastSequence  uint64     `json:"last_sequence"`
+	Messages      []*httpMsg `json:"messages"`
+}
+
+// startHTTPGateway starts serving the HTTP gateway on the HTTPListen
+// address. Requests are on the `/channels/<channel>` path:
+//
+//	POST stores the request body as a message in the channel and returns
+//	     its sequence and timestamp.
+//	GET  returns the messages of the channel, starting at the `start_seq`
+//	     sequence or at the `start_time` (RFC 3339) timestamp, up to the
+//	     `end_seq` sequence or `limit` messages.
+func (s *StanServer) startHTTPGateway() error {
+	if s.opts.HTTPListen == "" {
+		return nil
+	}
+	l, err := listen(s.opts.HTTPListen)
+	if err != nil {
+		return err
+	}
+	s.httpListener = l
+	s.httpServer = &http.Server{Handler: s.httpHandler(true)}
+	Noticef("STAN: Listening for HTTP requests on %s", l.Addr())
+	s.httpWg.Add(1)
+	go func() {
+		defer s.httpWg.Done()
+		s.httpServer.Serve(l)
+	}()
+	return nil
+}
+
+// stopHTTPGateway stops accepting HTTP requests.
+func (s *StanServer) stopHTTPGateway() {
+	if s.httpListener == nil {
+		return
+	}
+	s.httpServer.SetKeepAlivesEnabled(false)
+	s.httpListener.Close()
+	s.httpWg.Wait()
+}
+
+// httpHandler returns the handler of the HTTP gateway. If `auth` is false,
+// requests are served without credentials, with all the permissions.
+func (s *StanServer) httpHandler(auth bool) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(httpChannelsPath, func(w http.ResponseWriter, r *http.Request) {
+		s.handleHTTPChannel(w, r, auth)
+	})
+	return mux
+}
+
+func (s *StanServer) handleHTTPChannel(w http.ResponseWriter, r *http.Request, auth bool) {
+	channel := strings.TrimPrefix(r.URL.Path, httpChannelsPath)
+	if !isValidSubject(channel) || strings.ContainsAny(channel, "*>") {
+		httpError(w, http.StatusBadRequest, ErrInvalidSubject)
+		return
+	}
+	var perms *Permissions
+	if auth && len(s.opts.Users) > 0 {
+		u := s.authenticate(httpCredentials(r))
+		if u == nil {
+			w.Header().Set("WWW-Authenticate", `Basic realm="nats-streaming"`)
+			httpError(w, http.StatusUnauthorized, ErrAuthorization)
+			return
+		}
+		perms = &u.Permissions
+	}
+	switch r.Method {
+	case "POST":
+		s.handleHTTPPublish(w, r, channel, perms)
+	case "GET":
+		s.handleHTTPFetch(w, r, channel, perms)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		httpError(w, http.StatusMethodNotAllowed, errHTTPInvalidRequest)
+	}
+}
+
+// httpCredentials returns the credentials of the basic or bearer token
+// authorization header of the request.
+func httpCredentials(r *http.Request) *spb.ConnectRequestExt {
+	if user, password, ok := r.BasicAuth(); ok {
+		return &spb.ConnectRequestExt{User: user, Password: password}
+	}
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return &spb.ConnectRequestExt{Token: strings.TrimPrefix(auth, "Bearer ")}
+	}
+	return nil
+}
+
+func (s *StanServer) handleHTTPPublish(w http.ResponseWriter, r *http.Request, channel string, perms *Permissions) {
+	data, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, server.MAX_PAYLOAD_SIZE))
+	if err != nil {
+		httpError(w, http.StatusRequestEntityTooLarge, err)
+		return
+	}
+	msg, err := s.storeGatewayMsg(r.RemoteAddr, perms, channel, data)
+	if err != nil {
+		Errorf("STAN: Unable to store message published from %s, subject=%s: %v", r.RemoteAddr, channel, err)
+		status := http.StatusInternalServerError
+		switch err {
+		case ErrPubPermission:
+			status = http.StatusForbidden
+		case ErrMirrorChannel:
+			status = http.StatusConflict
+		case ErrStorageFull, ErrMemoryBudget, ErrReadOnly, ErrValidatorDown, ErrMaxChannels:
+			status = http.StatusServiceUnavailable
+		case ErrPubRateLimit:
+			status = http.StatusTooManyRequests
+		}
+		if _, ok := err.(*payloadError); ok {
+			status = http.StatusBadRequest
+		}
+		httpError(w, status, err)
+		return
+	}
+	httpJSON(w, http.StatusOK, &httpMsg{Sequence: msg.Sequence, Timestamp: msg.Timestamp})
+}
+
+func (s *StanServer) handleHTTPFetch(w http.ResponseWriter, r *http.Request, channel string, perms *Permissions) {
+	channel = s.resolveChannel(channel)
+	if perms != nil && !perms.canSubscribe(channel) {
+		httpError(w, http.StatusForbidden, ErrSubPermission)
+		return
+	}
+	cs := s.store.LookupChannel(channel)
+	if cs == nil {
+		httpError(w, http.StatusNotFound, errHTTPUnknownChannel)
+		return
+	}
+	first, last := cs.Msgs.FirstAndLastSequence()
+	start, end, limit := first, last, httpDefaultFetchLimit
+	query := r.URL.Query()
+	var err error
+	if v := query.Get("start_seq"); v != "" {
+		start, err = strconv.ParseUint(v, 10, 64)
+	} else if v := query.Get("start_time"); v != "" {
+		var t time.Time
+		if t, err = time.Parse(time.RFC3339Nano, v); err == nil {
+			start = cs.Msgs.GetSequenceFromTimestamp(t.UnixNano())
+		}
+	}
+	if v := query.Get("end_seq"); v != "" && err == nil {
+		end, err = strconv.ParseUint(v, 10, 64)
+	}
+	if v := query.Get("limit"); v != "" && err == nil {
+		limit, err = strconv.Atoi(v)
+		if err == nil && (limit <= 0 || limit > httpMaxFetchLimit) {
+			err = errHTTPInvalidRequest
+		}
+	}
+	if err != nil {
+		httpError(w, http.StatusBadRequest, errHTTPInvalidRequest)
+		return
+	}
+	if start < first {
+		start = first
+	}
+	if end > last {
+		end = last
+	}
+	resp := &httpFetchResponse{FirstSequence: first, LastSequence: last, Messages: []*httpMsg{}}
+	for seq := start; seq != 0 && seq <= end && len(resp.Messages) < limit; seq++ {
+		// Messages removed by key compaction are skipped.
+		m, err := cs.Msgs.Lookup(seq)
+		if err != nil {
+			httpError(w, http.StatusInternalServerError, err)
+			return
+		}
+		if m != nil {
+			resp.Messages = append(resp.Messages, &httpMsg{Sequence: m.Sequence, Timestamp: m.Timestamp, Data: m.Data})
+		}
+	}
+	httpJSON(w, http.StatusOK, resp)
+}
+
+func httpJSON(w http.ResponseWriter, status int, v interface{}) {
+	b, _ := json.Marshal(v)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(b)
+}
+
+func httpError(w http.ResponseWriter, status int, err error) {
+	httpJSON(w, status, map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,153 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nats-io/go-nats-streaming"
+)
+
+// httpTestRequest sends the request to the HTTP gateway of the server and
+// decodes the JSON response into `v`, returning the status code.
+func httpTestRequest(t *testing.T, s *StanServer, method, path, body string, v interface{}, setAuth func(*http.Request)) int {
+	req, err := http.NewRequest(method, fmt.Sprintf("http://%s%s", s.httpListener.Addr(), path), strings.NewReader(body))
+	if err != nil {
+		stackFatalf(t, "Unable to create request: %v", err)
+	}
+	if setAuth != nil {
+		setAuth(req)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		stackFatalf(t, "Error on request: %v", err)
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		stackFatalf(t, "Error reading response: %v", err)
+	}
+	if v != nil && resp.StatusCode == http.StatusOK {
+		if err := json.Unmarshal(b, v); err != nil {
+			stackFatalf(t, "Invalid response %q: %v", b, err)
+		}
+	}
+	return resp.StatusCode
+}
+
+func TestHTTPGateway(t *testing.T) {
+	opts := GetDefaultOptions()
+	opts.HTTPListen = "localhost:0"
+	s := RunServerWithOpts(opts, nil)
+	defer s.Shutdown()
+
+	sc := NewDefaultConnection(t)
+	defer sc.Close()
+	received := make(chan *stan.Msg, 10)
+	if _, err := sc.Subscribe("foo", func(m *stan.Msg) {
+		received <- m
+	}); err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+
+	var times []time.Time
+	for i := 1; i <= 5; i++ {
+		times = append(times, time.Now())
+		msg := &httpMsg{}
+		if status := httpTestRequest(t, s, "POST", "/channels/foo", fmt.Sprintf("msg%d", i), msg, nil); status != http.StatusOK {
+			t.Fatalf("Unexpected status: %v", status)
+		}
+		if msg.Sequence != uint64(i) || msg.Timestamp < times[i-1].UnixNano() {
+			t.Fatalf("Unexpected response: %v", msg)
+		}
+		select {
+		case m := <-received:
+			if string(m.Data) != fmt.Sprintf("msg%d", i) {
+				t.Fatalf("Unexpected message: %v", m)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("Did not receive message")
+		}
+	}
+
+	check := func(query string, expected ...uint64) {
+		resp := &httpFetchResponse{}
+		if status := httpTestRequest(t, s, "GET", "/channels/foo"+query, "", resp, nil); status != http.StatusOK {
+			stackFatalf(t, "Unexpected status for %q: %v", query, status)
+		}
+		if resp.FirstSequence != 1 || resp.LastSequence != 5 || len(resp.Messages) != len(expected) {
+			stackFatalf(t, "Unexpected response for %q: %v", query, resp)
+		}
+		for i, seq := range expected {
+			if m := resp.Messages[i]; m.Sequence != seq || string(m.Data) != fmt.Sprintf("msg%d", seq) {
+				stackFatalf(t, "Unexpected message for %q: %v", query, m)
+			}
+		}
+	}
+	check("", 1, 2, 3, 4, 5)
+	check("?start_seq=2&end_seq=3", 2, 3)
+	check("?start_seq=4&end_seq=10", 4, 5)
+	check("?limit=2", 1, 2)
+	check("?start_seq=6")
+	check("?start_time="+times[3].Format(time.RFC3339Nano), 4, 5)
+
+	for _, test := range []struct {
+		method, path string
+		status       int
+	}{
+		{"GET", "/channels/bar", http.StatusNotFound},
+		{"GET", "/channels/foo?start_seq=x", http.StatusBadRequest},
+		{"GET", "/channels/foo?start_time=yesterday", http.StatusBadRequest},
+		{"GET", "/channels/foo?limit=0", http.StatusBadRequest},
+		{"GET", "/channels/foo?limit=1001", http.StatusBadRequest},
+		{"POST", "/channels/foo.*", http.StatusBadRequest},
+		{"POST", "/channels/", http.StatusBadRequest},
+		{"DELETE", "/channels/foo", http.StatusMethodNotAllowed},
+	} {
+		if status := httpTestRequest(t, s, test.method, test.path, "", nil, nil); status != test.status {
+			t.Fatalf("Expected status %v for %s %s, got %v", test.status, test.method, test.path, status)
+		}
+	}
+}
+
+func TestHTTPGatewayAuthorization(t *testing.T) {
+	opts := GetDefaultOptions()
+	opts.HTTPListen = "localhost:0"
+	opts.Users = []*User{
+		{Username: "alice", Password: "foo", Permissions: Permissions{Publish: []string{"foo"}}},
+		{Token: "s3cr3t", Permissions: Permissions{Subscribe: []string{"foo"}}},
+	}
+	s := RunServerWithOpts(opts, nil)
+	defer s.Shutdown()
+
+	alice := func(r *http.Request) { r.SetBasicAuth("alice", "foo") }
+	token := func(r *http.Request) { r.Header.Set("Authorization", "Bearer s3cr3t") }
+	wrong := func(r *http.Request) { r.SetBasicAuth("alice", "bar") }
+
+	for _, test := range []struct {
+		method, path string
+		auth         func(*http.Request)
+		status       int
+	}{
+		{"POST", "/channels/foo", nil, http.StatusUnauthorized},
+		{"POST", "/channels/foo", wrong, http.StatusUnauthorized},
+		{"POST", "/channels/foo", alice, http.StatusOK},
+		{"POST", "/channels/bar", alice, http.StatusForbidden},
+		{"POST", "/channels/foo", token, http.StatusForbidden},
+		{"GET", "/channels/foo", alice, http.StatusForbidden},
+		{"GET", "/channels/foo", token, http.StatusOK},
+	} {
+		if status := httpTestRequest(t, s, test.method, test.path, "hello", nil, test.auth); status != test.status {
+			t.Fatalf("Expected status %v for %s %s, got %v", test.status, test.method, test.path, status)
+		}
+	}
+	if s.store.LookupChannel("bar") != nil {
+		t.Fatal("Channel bar should not have been created")
+	}
+}
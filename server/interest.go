@@ -0,0 +1,119 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"github.com/nats-io/nats-streaming-server/stores"
+	"github.com/nats-io/nats-streaming-server/util"
+)
+
+// isInterestChannel returns true if the channel matches one of the
+// interest channels of the options, whose messages are removed once
+// acknowledged by all the subscriptions of the channel.
+func (s *StanServer) isInterestChannel(channel string) bool {
+	for _, pattern := range s.opts.InterestChannels {
+		if util.SubjectMatches(pattern, channel) {
+			return true
+		}
+	}
+	return false
+}
+
+// interestFloor returns the lowest sequence the subscription may still
+// need: the lowest of its pending, scheduled, recovered or snapshot
+// messages, or `next` if it has none.
+// Sub lock should be held before calling.
+func (sub *subState) interestFloor(next uint64) uint64 {
+	floor := next
+	for seq := range sub.acksPending {
+		if seq < floor {
+			floor = seq
+		}
+	}
+	for seq := range sub.scheduled {
+		if seq < floor {
+			floor = seq
+		}
+	}
+	if len(sub.spilled) > 0 && sub.spilled[0] < floor {
+		floor = sub.spilled[0]
+	}
+	for seq := range sub.snapshot {
+		if seq < floor {
+			floor = seq
+		}
+	}
+	return floor
+}
+
+// purgeAckedMsgs removes, from an interest channel, the messages that all
+// the subscriptions of the channel, including the offline durables, have
+// acknowledged. Nothing is removed while the channel has no subscription,
+// and the last message is always kept, as with the limits.
+func (s *StanServer) purgeAckedMsgs(cs *stores.ChannelStore, channel string) {
+	ss := cs.UserData.(*subStore)
+	var floor uint64
+	lower := func(f uint64) {
+		if floor == 0 || f < floor {
+			floor = f
+		}
+	}
+	ss.RLock()
+	for _, sub := range ss.psubs {
+		sub.RLock()
+		lower(sub.interestFloor(sub.LastSent + 1))
+		sub.RUnlock()
+	}
+	for _, sub := range ss.durables {
+		sub.RLock()
+		lower(sub.interestFloor(sub.LastSent + 1))
+		sub.RUnlock()
+	}
+	// The members of a queue group only hold the messages pending for them,
+	// the others were sent to other members.
+	for _, qs := range ss.qsubs {
+		qs.RLock()
+		next := qs.lastSent + 1
+		for _, sub := range qs.subs {
+			sub.RLock()
+			next = sub.interestFloor(next)
+			sub.RUnlock()
+		}
+		qs.RUnlock()
+		lower(next)
+	}
+	ss.RUnlock()
+	if floor <= 1 {
+		return
+	}
+	n, err := stores.PurgeBefore(cs.Msgs, floor)
+	if err != nil {
+		Errorf("STAN: Unable to remove acknowledged messages of channel=%s: %v", channel, err)
+		return
+	}
+	if n > 0 {
+		Tracef("STAN: Removed %d acknowledged messages of channel=%s", n, channel)
+	}
+}
+
+// purgeAckedMsgsOnStartup removes the acknowledged messages of the
+// interest channels after the recovery, since stores may recover messages
+// that were removed before the restart.
+func (s *StanServer) purgeAckedMsgsOnStartup() error {
+	if len(s.opts.InterestChannels) == 0 {
+		return nil
+	}
+	infos, err := s.store.GetChannels()
+	if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		if !s.isInterestChannel(info.Name) {
+			continue
+		}
+		if cs := s.store.LookupChannel(info.Name); cs != nil {
+			s.purgeAckedMsgs(cs, info.Name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nats-io/go-nats-streaming"
+)
+
+func TestInterestChannels(t *testing.T) {
+	opts := GetDefaultOptions()
+	opts.InterestChannels = []string{"foo"}
+	s := runServerWithOpts(t, opts, nil)
+	defer s.Shutdown()
+
+	sc := NewDefaultConnection(t)
+	defer sc.Close()
+
+	msgsCount := func(channel string) (string, int) {
+		n, _, _ := s.store.MsgsState(channel)
+		return "messages", n
+	}
+	// Without subscription, nothing is removed.
+	for i := 0; i < 3; i++ {
+		if err := sc.Publish("foo", []byte("hello")); err != nil {
+			t.Fatalf("Unexpected error on publish: %v", err)
+		}
+	}
+
+	// A durable that does not ack its messages holds them.
+	sc2, err := stan.Connect(clusterName, "durable")
+	if err != nil {
+		t.Fatalf("Unexpected error on connect: %v", err)
+	}
+	defer sc2.Close()
+	received := make(chan *stan.Msg, 10)
+	if _, err := sc2.Subscribe("foo", func(m *stan.Msg) { received <- m },
+		stan.DurableName("dur"), stan.DeliverAllAvailable(), stan.SetManualAckMode(),
+		stan.AckWait(time.Minute)); err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+	// A plain subscription acks its messages.
+	done := make(chan struct{}, 10)
+	if _, err := sc.Subscribe("foo", func(_ *stan.Msg) { done <- struct{}{} }, stan.DeliverAllAvailable()); err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("Did not get our message")
+		}
+	}
+	time.Sleep(100 * time.Millisecond)
+	if _, n := msgsCount("foo"); n != 3 {
+		t.Fatalf("Expected 3 messages, got %v", n)
+	}
+
+	// Once offline, the durable still holds them.
+	sc2.Close()
+	waitForNumClients(t, s, 1)
+	if _, n := msgsCount("foo"); n != 3 {
+		t.Fatalf("Expected 3 messages, got %v", n)
+	}
+
+	// Resume the durable and ack the messages, all but the last one are removed.
+	sc2, err = stan.Connect(clusterName, "durable")
+	if err != nil {
+		t.Fatalf("Unexpected error on connect: %v", err)
+	}
+	defer sc2.Close()
+	if _, err := sc2.Subscribe("foo", func(m *stan.Msg) { m.Ack() },
+		stan.DurableName("dur"), stan.SetManualAckMode()); err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+	waitForCount(t, 1, func() (string, int) { return msgsCount("foo") })
+	if first, last := s.store.LookupChannel("foo").Msgs.FirstAndLastSequence(); first != 3 || last != 3 {
+		t.Fatalf("Unexpected sequences: %v, %v", first, last)
+	}
+}
@@ -0,0 +1,154 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"fmt"
+	"time"
+)
+
+// Minimum interval between two checks of the lag of the subscriptions.
+const minConsumerLagCheckInterval = 100 * time.Millisecond
+
+// ConsumerLagAdvisory describes a subscription whose lag has exceeded the
+// ConsumerLagThreshold option for longer than ConsumerLagDuration.
+type ConsumerLagAdvisory struct {
+	Time         time.Time     `json:"time"`
+	ClientID     string        `json:"client_id"`
+	Channel      string        `json:"channel"`
+	Durable      string        `json:"durable,omitempty"`
+	Queue        string        `json:"queue,omitempty"`
+	Inbox        string        `json:"inbox"`
+	Lag          uint64        `json:"lag"`
+	LastSequence uint64        `json:"last_seq"`
+	LaggingFor   time.Duration `json:"lagging_for"`
+}
+
+// lag returns the number of messages of the channel, whose last sequence
+// is `last`, after the last message acknowledged by the subscription, that
+// is, after the message preceding its oldest pending or scheduled message,
+// or the last message sent if there is none. For a queue subscriber, this
+// is the last message sent to its group, `qsent` (see queueLastSent()).
+// Sub lock should be held before calling.
+func (sub *subState) lag(last, qsent uint64) uint64 {
+	acked := sub.LastSent
+	if qsent > acked {
+		acked = qsent
+	}
+	for seq := range sub.acksPending {
+		if seq <= acked {
+			acked = seq - 1
+		}
+	}
+	for seq := range sub.scheduled {
+		if seq <= acked {
+			acked = seq - 1
+		}
+	}
+	if last <= acked {
+		return 0
+	}
+	return last - acked
+}
+
+// queueLastSent returns the last message sent to the queue group of the
+// subscription, 0 if it is not a queue subscriber.
+func (sub *subState) queueLastSent() uint64 {
+	sub.RLock()
+	qs := sub.qstate
+	sub.RUnlock()
+	if qs == nil {
+		return 0
+	}
+	// The queue state lock is acquired before the subscription's one when
+	// sending to the group, so it can't be acquired while holding the latter.
+	qs.RLock()
+	defer qs.RUnlock()
+	return qs.lastSent
+}
+
+// startConsumerLagCheck starts checking, if enabled, for subscriptions
+// whose lag exceeds ConsumerLagThreshold for longer than ConsumerLagDuration.
+func (s *StanServer) startConsumerLagCheck() {
+	if s.opts.ConsumerLagThreshold == 0 {
+		return
+	}
+	interval := s.opts.ConsumerLagDuration / 4
+	if interval < minConsumerLagCheckInterval {
+		interval = minConsumerLagCheckInterval
+	}
+	s.consumerLagQuit = make(chan struct{})
+	s.consumerLagWg.Add(1)
+	go func() {
+		defer s.consumerLagWg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-s.consumerLagQuit:
+				return
+			case <-ticker.C:
+				s.checkConsumerLag(time.Now())
+			}
+		}
+	}()
+}
+
+// stopConsumerLagCheck stops the check and waits for it to return.
+func (s *StanServer) stopConsumerLagCheck() {
+	if s.consumerLagQuit == nil {
+		return
+	}
+	close(s.consumerLagQuit)
+	s.consumerLagWg.Wait()
+}
+
+// checkConsumerLag reports, once each time it happens, the subscriptions
+// whose lag exceeds ConsumerLagThreshold for longer than ConsumerLagDuration.
+func (s *StanServer) checkConsumerLag(now time.Time) {
+	for _, channel := range s.store.GetChannelNames() {
+		cs := s.store.LookupChannel(channel)
+		if cs == nil {
+			continue
+		}
+		last := cs.Msgs.LastSequence()
+		for _, sub := range cs.UserData.(*subStore).getAllSubs() {
+			qsent := sub.queueLastSent()
+			sub.Lock()
+			lag := sub.lag(last, qsent)
+			if lag <= s.opts.ConsumerLagThreshold || sub.ClientID == "" {
+				sub.laggingSince = time.Time{}
+				sub.lagReported = false
+				sub.Unlock()
+				continue
+			}
+			if sub.laggingSince.IsZero() {
+				sub.laggingSince = now
+			}
+			if sub.lagReported || now.Sub(sub.laggingSince) < s.opts.ConsumerLagDuration {
+				sub.Unlock()
+				continue
+			}
+			sub.lagReported = true
+			adv := &ConsumerLagAdvisory{
+				Time:         now.UTC(),
+				ClientID:     sub.ClientID,
+				Channel:      channel,
+				Durable:      sub.DurableName,
+				Queue:        sub.QGroup,
+				Inbox:        sub.Inbox,
+				Lag:          lag,
+				LastSequence: last,
+				LaggingFor:   now.Sub(sub.laggingSince),
+			}
+			sub.Unlock()
+
+			Noticef("STAN: [Client:%s] Consumer lag on subject=%s inbox=%s: %d messages behind for %v",
+				adv.ClientID, channel, adv.Inbox, adv.Lag, adv.LaggingFor)
+			s.audit.record(&auditRecord{Event: auditConsumerLag, Client: adv.ClientID, Channel: channel,
+				Durable: adv.Durable, Queue: adv.Queue, Inbox: adv.Inbox,
+				Reason: fmt.Sprintf("%d messages behind for %v", adv.Lag, adv.LaggingFor)})
+			s.publishAdvisory(AdvisoryConsumerLag, adv)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/nats-io/go-nats-streaming"
+)
+
+func TestConsumerLagReport(t *testing.T) {
+	opts := GetDefaultOptions()
+	opts.ConsumerLagThreshold = 2
+	opts.ConsumerLagDuration = 250 * time.Millisecond
+	opts.Advisories = true
+	s := runServerWithOpts(t, opts, nil)
+	defer s.Shutdown()
+
+	sc := NewDefaultConnection(t)
+	defer sc.Close()
+
+	advisories := make(chan *ConsumerLagAdvisory, 10)
+	if _, err := sc.Subscribe(AdvisoryChannel(AdvisoryConsumerLag), func(m *stan.Msg) {
+		adv := &ConsumerLagAdvisory{}
+		if err := json.Unmarshal(m.Data, adv); err != nil {
+			t.Errorf("Invalid advisory: %v", err)
+		}
+		advisories <- adv
+	}); err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+	// This subscription does not ack its messages until told to.
+	received := make(chan *stan.Msg, 10)
+	if _, err := sc.Subscribe("foo", func(m *stan.Msg) { received <- m },
+		stan.SetManualAckMode(), stan.MaxInflight(1), stan.AckWait(time.Minute), stan.DurableName("dur")); err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		if err := sc.Publish("foo", []byte("hello")); err != nil {
+			t.Fatalf("Unexpected error on publish: %v", err)
+		}
+	}
+	var adv *ConsumerLagAdvisory
+	select {
+	case adv = <-advisories:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Did not get the advisory")
+	}
+	if elapsed := time.Since(start); elapsed < opts.ConsumerLagDuration {
+		t.Fatalf("Advisory sent too soon: %v", elapsed)
+	}
+	if adv.ClientID != clientName || adv.Channel != "foo" || adv.Durable != "dur" || adv.Lag != 5 ||
+		adv.LastSequence != 5 || adv.LaggingFor < opts.ConsumerLagDuration {
+		t.Fatalf("Unexpected advisory: %+v", adv)
+	}
+	// Reported once while the lag stays above the threshold.
+	select {
+	case <-advisories:
+		t.Fatal("Advisory should be sent only once")
+	case <-time.After(500 * time.Millisecond):
+	}
+	// Catch up: the lag goes back to 0.
+	for i := 0; i < 5; i++ {
+		select {
+		case m := <-received:
+			m.Ack()
+		case <-time.After(5 * time.Second):
+			t.Fatal("Did not get our message")
+		}
+	}
+	waitForCount(t, 0, func() (string, int) {
+		subs, err := s.SubscriptionsStats("foo")
+		if err != nil || len(subs) != 1 {
+			stackFatalf(t, "Unexpected subscriptions: %v (%v)", subs, err)
+		}
+		return "lag", int(subs[0].Lag)
+	})
+	select {
+	case adv := <-advisories:
+		t.Fatalf("Unexpected advisory: %+v", adv)
+	case <-time.After(500 * time.Millisecond):
+	}
+}
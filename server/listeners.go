@@ -0,0 +1,346 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nats-io/gnatsd/server"
+)
+
+// Services of the additional listeners.
+const (
+	// ListenerNATS accepts NATS connections, forwarded to the embedded
+	// NATS Server.
+	ListenerNATS = "nats"
+	// ListenerMonitor serves the monitoring endpoints.
+	ListenerMonitor = "monitor"
+	// ListenerHTTP serves the HTTP gateway.
+	ListenerHTTP = "http"
+	// ListenerGRPC serves the gRPC API.
+	ListenerGRPC = "grpc"
+)
+
+// Authorization of the requests received on an additional listener.
+const (
+	// ListenerAuthUsers requires the credentials of one of the users.
+	ListenerAuthUsers = "users"
+	// ListenerAuthNone accepts requests without credentials, with all the
+	// permissions. Meant for Unix sockets restricted to local administration.
+	ListenerAuthNone = "none"
+)
+
+// Prefix of the addresses of the listeners on a Unix domain socket.
+const unixAddrPrefix = "unix:"
+
+// Timeout of the connections to the embedded NATS Server on behalf of the
+// clients of an additional NATS listener.
+const natsForwardDialTimeout = 2 * time.Second
+
+// Listener is an additional address on which the server accepts the
+// connections of one of its services. TLS is enabled if TLSCert is set,
+// and client certificates are required if TLSCaCert is set. Auth defaults
+// to ListenerAuthUsers for the HTTP gateway and the gRPC API, if users are
+// configured, and to ListenerAuthNone for the monitoring endpoints. The NATS listeners
+// forward the connections as is: the embedded NATS Server applies its own
+// TLS and authorization, so neither can be set for them.
+type Listener struct {
+	Service   string `json:"service"`              // ListenerNATS, ListenerMonitor, ListenerHTTP or ListenerGRPC
+	Address   string `json:"address"`              // host:port, [ipv6]:port or unix:/path
+	TLSCert   string `json:"tls_cert,omitempty"`   // Server certificate
+	TLSKey    string `json:"tls_key,omitempty"`    // Server private key
+	TLSCaCert string `json:"tls_cacert,omitempty"` // CAs of the required client certificates
+	Auth      string `json:"auth,omitempty"`       // ListenerAuthUsers or ListenerAuthNone
+}
+
+// extraListener is a started additional listener.
+type extraListener struct {
+	cfg  *Listener
+	l    net.Listener
+	srv  *http.Server // nil for the NATS and gRPC listeners
+	gsrv grpcService  // only for the gRPC listeners
+}
+
+// LoadListenersFile reads the additional listeners from a JSON file
+// containing an array of listeners, for instance:
+//
+//	[{"service": "nats", "address": "[::1]:4222"},
+//	 {"service": "monitor", "address": "unix:/var/run/stan/monitor.sock"},
+//	 {"service": "http", "address": "10.0.0.5:8080",
+//	  "tls_cert": "server.pem", "tls_key": "server-key.pem"}]
+func LoadListenersFile(path string) ([]*Listener, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var listeners []*Listener
+	if err := json.Unmarshal(b, &listeners); err != nil {
+		return nil, fmt.Errorf("error parsing listeners file %q: %v", path, err)
+	}
+	if err := validateListeners(listeners); err != nil {
+		return nil, fmt.Errorf("error parsing listeners file %q: %v", path, err)
+	}
+	return listeners, nil
+}
+
+// validateListeners checks the services, addresses, TLS and authorization
+// of the listeners.
+func validateListeners(listeners []*Listener) error {
+	for _, l := range listeners {
+		switch l.Service {
+		case ListenerNATS, ListenerMonitor, ListenerHTTP, ListenerGRPC:
+		default:
+			return fmt.Errorf("invalid service %q for listener %q (should be %s, %s, %s or %s)",
+				l.Service, l.Address, ListenerNATS, ListenerMonitor, ListenerHTTP, ListenerGRPC)
+		}
+		if l.Address == "" || l.Address == unixAddrPrefix {
+			return fmt.Errorf("missing address for %s listener", l.Service)
+		}
+		switch l.Auth {
+		case "", ListenerAuthUsers, ListenerAuthNone:
+		default:
+			return fmt.Errorf("invalid authorization %q for listener %q (should be %s or %s)",
+				l.Auth, l.Address, ListenerAuthUsers, ListenerAuthNone)
+		}
+		if (l.TLSCert == "") != (l.TLSKey == "") || (l.TLSCaCert != "" && l.TLSCert == "") {
+			return fmt.Errorf("listener %q: %v", l.Address, ErrTLSCertRequired)
+		}
+		if l.Service == ListenerNATS && (l.TLSCert != "" || l.Auth != "") {
+			return fmt.Errorf("NATS listener %q can't set TLS or authorization, those of the NATS Server apply", l.Address)
+		}
+	}
+	return nil
+}
+
+// validateListenerOptions checks the additional listeners against the
+// other options.
+func validateListenerOptions(opts *Options) error {
+	if err := validateListeners(opts.Listeners); err != nil {
+		return err
+	}
+	if opts.GRPCListen != "" && !grpcSupported {
+		return ErrNoGRPC
+	}
+	for _, l := range opts.Listeners {
+		if l.Service == ListenerGRPC && !grpcSupported {
+			return ErrNoGRPC
+		}
+		if l.Service == ListenerNATS && opts.NATSServerURL != "" {
+			return fmt.Errorf("NATS listener %q requires the embedded NATS Server", l.Address)
+		}
+		if l.Auth == ListenerAuthUsers && len(opts.Users) == 0 {
+			return fmt.Errorf("listener %q requires users", l.Address)
+		}
+	}
+	return nil
+}
+
+// listen listens on `address`, a Unix domain socket if it starts with
+// unixAddrPrefix, a TCP address, possibly IPv6, otherwise.
+func listen(address string) (net.Listener, error) {
+	if !strings.HasPrefix(address, unixAddrPrefix) {
+		return net.Listen("tcp", address)
+	}
+	path := strings.TrimPrefix(address, unixAddrPrefix)
+	// Remove the socket left behind by a server that did not exit cleanly,
+	// but not the one of a running server.
+	if fi, err := os.Stat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if c, err := net.Dial("unix", path); err == nil {
+			c.Close()
+		} else {
+			os.Remove(path)
+		}
+	}
+	return net.Listen("unix", path)
+}
+
+// startListeners starts the additional listeners. It must be called after
+// the embedded NATS Server is started.
+func (s *StanServer) startListeners() error {
+	if len(s.opts.Listeners) == 0 {
+		return nil
+	}
+	s.listenerConns = make(map[net.Conn]struct{})
+	for _, cfg := range s.opts.Listeners {
+		l, err := listen(cfg.Address)
+		if err != nil {
+			return err
+		}
+		if cfg.TLSCert != "" {
+			tc, err := server.GenTLSConfig(&server.TLSConfigOpts{
+				CertFile: cfg.TLSCert,
+				KeyFile:  cfg.TLSKey,
+				CaFile:   cfg.TLSCaCert,
+				Verify:   cfg.TLSCaCert != "",
+			})
+			if err != nil {
+				l.Close()
+				return fmt.Errorf("unable to setup TLS of listener %q: %v", cfg.Address, err)
+			}
+			l = tls.NewListener(l, tc)
+		}
+		el := &extraListener{cfg: cfg, l: l}
+		s.listeners = append(s.listeners, el)
+		switch cfg.Service {
+		case ListenerNATS:
+			Noticef("STAN: Forwarding NATS connections from %s", l.Addr())
+			s.listenerWg.Add(1)
+			go s.forwardNATSConns(l)
+			continue
+		case ListenerGRPC:
+			el.gsrv, err = s.newGRPCService(cfg.Auth != ListenerAuthNone)
+			if err != nil {
+				return err
+			}
+			Noticef("STAN: Listening for gRPC requests on %s", l.Addr())
+			s.listenerWg.Add(1)
+			go func() {
+				defer s.listenerWg.Done()
+				el.gsrv.Serve(el.l)
+			}()
+			continue
+		case ListenerMonitor:
+			h := s.monitorHandler()
+			if cfg.Auth == ListenerAuthUsers {
+				h = s.requireUser(h)
+			}
+			el.srv = &http.Server{Handler: h}
+			Noticef("STAN: Listening for monitoring requests on %s", l.Addr())
+		case ListenerHTTP:
+			el.srv = &http.Server{Handler: s.httpHandler(cfg.Auth != ListenerAuthNone)}
+			Noticef("STAN: Listening for HTTP requests on %s", l.Addr())
+		}
+		s.listenerWg.Add(1)
+		go func() {
+			defer s.listenerWg.Done()
+			el.srv.Serve(el.l)
+		}()
+	}
+	return nil
+}
+
+// stopListeners stops the additional listeners, closes the forwarded NATS
+// connections and waits for their go routines to return.
+func (s *StanServer) stopListeners() {
+	if len(s.listeners) == 0 {
+		return
+	}
+	for _, el := range s.listeners {
+		if el.srv != nil {
+			el.srv.SetKeepAlivesEnabled(false)
+		}
+		if el.gsrv != nil {
+			// Also closes the listener and the connections.
+			el.gsrv.Stop()
+		}
+		el.l.Close()
+	}
+	s.listenerLock.Lock()
+	for c := range s.listenerConns {
+		c.Close()
+	}
+	s.listenerConns = nil
+	s.listenerLock.Unlock()
+	s.listenerWg.Wait()
+}
+
+// requireUser returns a handler that serves only the requests with the
+// credentials of one of the users.
+func (s *StanServer) requireUser(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.authenticate(httpCredentials(r)) == nil {
+			w.Header().Set("WWW-Authenticate", `Basic realm="nats-streaming"`)
+			httpError(w, http.StatusUnauthorized, ErrAuthorization)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// trackListenerConn records a forwarded connection, so that it is closed
+// on shutdown. It returns false if the listeners are stopped.
+func (s *StanServer) trackListenerConn(c net.Conn) bool {
+	s.listenerLock.Lock()
+	defer s.listenerLock.Unlock()
+	if s.listenerConns == nil {
+		return false
+	}
+	s.listenerConns[c] = struct{}{}
+	return true
+}
+
+// closeListenerConn closes a forwarded connection and forgets about it.
+func (s *StanServer) closeListenerConn(c net.Conn) {
+	c.Close()
+	s.listenerLock.Lock()
+	if s.listenerConns != nil {
+		delete(s.listenerConns, c)
+	}
+	s.listenerLock.Unlock()
+}
+
+// forwardNATSConns accepts the connections of an additional NATS listener
+// and forwards each of them to the embedded NATS Server.
+func (s *StanServer) forwardNATSConns(l net.Listener) {
+	defer s.listenerWg.Done()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		if !s.trackListenerConn(conn) {
+			conn.Close()
+			return
+		}
+		s.listenerWg.Add(1)
+		go s.forwardNATSConn(conn)
+	}
+}
+
+// forwardNATSConn copies the data of the connection to the embedded NATS
+// Server and back, until either side closes it.
+func (s *StanServer) forwardNATSConn(conn net.Conn) {
+	defer s.listenerWg.Done()
+	defer s.closeListenerConn(conn)
+	nconn, err := net.DialTimeout("tcp", s.natsForwardAddr(), natsForwardDialTimeout)
+	if err != nil {
+		Errorf("STAN: Unable to forward NATS connection from %s: %v", conn.RemoteAddr(), err)
+		return
+	}
+	if !s.trackListenerConn(nconn) {
+		nconn.Close()
+		return
+	}
+	defer s.closeListenerConn(nconn)
+	s.listenerWg.Add(1)
+	go func() {
+		defer s.listenerWg.Done()
+		io.Copy(nconn, conn)
+		nconn.Close()
+	}()
+	io.Copy(conn, nconn)
+}
+
+// natsForwardAddr returns the address at which the embedded NATS Server
+// is reached, the loopback address if it listens on all interfaces.
+func (s *StanServer) natsForwardAddr() string {
+	host := s.natsOpts.Host
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		if ip != nil && ip.To4() == nil {
+			host = "::1"
+		} else {
+			host = "127.0.0.1"
+		}
+	}
+	return net.JoinHostPort(host, strconv.Itoa(s.natsOpts.Port))
+}
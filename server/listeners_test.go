@@ -0,0 +1,131 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/nats-io/nats"
+)
+
+func TestAdditionalListeners(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "stan_server_listeners_")
+	if err != nil {
+		t.Fatalf("Unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	monitorSock := filepath.Join(tmpDir, "monitor.sock")
+	httpSock := filepath.Join(tmpDir, "http.sock")
+
+	opts := GetDefaultOptions()
+	opts.HTTPListen = "localhost:0"
+	opts.Users = []*User{{Username: "alice", Password: "foo"}}
+	opts.Listeners = []*Listener{
+		{Service: ListenerNATS, Address: "127.0.0.1:0"},
+		{Service: ListenerMonitor, Address: "unix:" + monitorSock, Auth: ListenerAuthUsers},
+		{Service: ListenerHTTP, Address: "unix:" + httpSock, Auth: ListenerAuthNone},
+	}
+	s := runServerWithOpts(t, opts, nil)
+	defer s.Shutdown()
+
+	// The NATS connections are forwarded to the embedded NATS Server.
+	nc, err := nats.Connect("nats://" + s.listeners[0].l.Addr().String())
+	if err != nil {
+		t.Fatalf("Unexpected error on connect: %v", err)
+	}
+	defer nc.Close()
+	if err := nc.Flush(); err != nil {
+		t.Fatalf("Unexpected error on flush: %v", err)
+	}
+
+	unixClient := func(path string) *http.Client {
+		return &http.Client{Transport: &http.Transport{
+			Dial: func(string, string) (net.Conn, error) { return net.Dial("unix", path) },
+		}}
+	}
+	do := func(c *http.Client, method, path string, auth bool) int {
+		req, err := http.NewRequest(method, "http://stan"+path, strings.NewReader("hello"))
+		if err != nil {
+			stackFatalf(t, "Unable to create request: %v", err)
+		}
+		if auth {
+			req.SetBasicAuth("alice", "foo")
+		}
+		resp, err := c.Do(req)
+		if err != nil {
+			stackFatalf(t, "Error on request: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	monitor := unixClient(monitorSock)
+	if status := do(monitor, "GET", HealthzPath, false); status != http.StatusUnauthorized {
+		t.Fatalf("Expected status %v, got %v", http.StatusUnauthorized, status)
+	}
+	if status := do(monitor, "GET", HealthzPath, true); status != http.StatusOK {
+		t.Fatalf("Expected status %v, got %v", http.StatusOK, status)
+	}
+	// The HTTP gateway requires credentials on its main address, not on
+	// the local one.
+	if status := httpTestRequest(t, s, "POST", "/channels/foo", "hello", nil, nil); status != http.StatusUnauthorized {
+		t.Fatalf("Expected status %v, got %v", http.StatusUnauthorized, status)
+	}
+	if status := do(unixClient(httpSock), "POST", "/channels/foo", false); status != http.StatusOK {
+		t.Fatalf("Expected status %v, got %v", http.StatusOK, status)
+	}
+	if n, _, _ := s.store.MsgsState("foo"); n != 1 {
+		t.Fatalf("Expected 1 message, got %v", n)
+	}
+
+	// The sockets are removed on shutdown.
+	s.Shutdown()
+	for _, path := range []string{monitorSock, httpSock} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Fatalf("Socket %q should have been removed: %v", path, err)
+		}
+	}
+}
+
+func TestListenersValidation(t *testing.T) {
+	for _, test := range []struct {
+		listener *Listener
+		natsURL  string
+		users    bool
+	}{
+		{&Listener{Service: "ftp", Address: "localhost:0"}, "", false},
+		{&Listener{Service: ListenerHTTP, Address: "unix:"}, "", false},
+		{&Listener{Service: ListenerHTTP, Address: "localhost:0", Auth: "maybe"}, "", true},
+		{&Listener{Service: ListenerHTTP, Address: "localhost:0", TLSCert: "cert.pem"}, "", false},
+		{&Listener{Service: ListenerHTTP, Address: "localhost:0", TLSCaCert: "ca.pem"}, "", false},
+		{&Listener{Service: ListenerMonitor, Address: "localhost:0", Auth: ListenerAuthUsers}, "", false},
+		{&Listener{Service: ListenerNATS, Address: "localhost:0", Auth: ListenerAuthNone}, "", false},
+		{&Listener{Service: ListenerNATS, Address: "localhost:0", TLSCert: "cert.pem", TLSKey: "key.pem"}, "", false},
+		{&Listener{Service: ListenerNATS, Address: "localhost:0"}, nats.DefaultURL, false},
+	} {
+		opts := GetDefaultOptions()
+		opts.NATSServerURL = test.natsURL
+		if test.users {
+			opts.Users = []*User{{Username: "alice", Password: "foo"}}
+		}
+		opts.Listeners = []*Listener{test.listener}
+		if err := validateListenerOptions(opts); err == nil {
+			t.Fatalf("Expected error for listener %+v", test.listener)
+		}
+	}
+	opts := GetDefaultOptions()
+	opts.Users = []*User{{Username: "alice", Password: "foo"}}
+	opts.Listeners = []*Listener{
+		{Service: ListenerNATS, Address: "[::1]:4222"},
+		{Service: ListenerMonitor, Address: "unix:/tmp/monitor.sock", Auth: ListenerAuthUsers},
+		{Service: ListenerHTTP, Address: "localhost:0", TLSCert: "cert.pem", TLSKey: "key.pem", TLSCaCert: "ca.pem"},
+	}
+	if err := validateListenerOptions(opts); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
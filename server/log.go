@@ -3,11 +3,17 @@
 package server
 
 import (
-	"github.com/nats-io/gnatsd/logger"
-	natsd "github.com/nats-io/gnatsd/server"
+	"encoding/json"
+	"fmt"
+	"io"
 	"os"
+	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
+
+	"github.com/nats-io/gnatsd/logger"
+	natsd "github.com/nats-io/gnatsd/server"
 )
 
 // Logging in STAN
@@ -23,6 +29,15 @@ import (
 //
 // All logging functions are fully implemented (versus calling into the NATS
 // server) in case STAN is decoupled from the NATS server.
+//
+// Log statements follow the convention:
+//
+//	COMPONENT: [Client:<client ID>] <message> subject=<channel>
+//
+// where COMPONENT is "STAN" for the streaming server and "STORE" for the
+// stores (statements without a component come from the NATS server).
+// When JSON logging is enabled, those tags are extracted into their own
+// fields so that the log can be filtered per component, client or channel.
 
 // Package globals for performance checks
 var trace int32
@@ -32,8 +47,12 @@ var debug int32
 var stanLog = struct {
 	sync.Mutex
 	logger natsd.Logger
+	file   *logFile
 }{}
 
+// Ensures that the log file signal handler is installed only once.
+var logSignalOnce sync.Once
+
 // ConfigureLogger configures logging for STAN and the embedded NATS server
 // based on options passed.
 func ConfigureLogger(stanOpts *Options, natsOpts *natsd.Options) {
@@ -54,12 +73,39 @@ func ConfigureLogger(stanOpts *Options, natsOpts *natsd.Options) {
 	enableDebug := nOpts.Debug || sOpts.Debug
 	enableTrace := nOpts.Trace || sOpts.Trace
 
-	if nOpts.LogFile != "" {
+	// The log file is managed by STAN (and can be rotated) if specified
+	// with the STAN option, or if the log is in JSON format.
+	var lf *logFile
+	logFileName := sOpts.LogFile
+	if logFileName == "" && sOpts.LogJSON {
+		logFileName = nOpts.LogFile
+	}
+	if logFileName != "" {
+		var err error
+		lf, err = openLogFile(logFileName, sOpts.LogFileMaxSize, sOpts.LogFileMaxAge)
+		if err != nil {
+			panic(fmt.Errorf("error opening log file: %v", err))
+		}
+		logSignalOnce.Do(handleLogFileSignal)
+	}
+
+	if sOpts.LogJSON {
+		var out io.Writer = os.Stderr
+		if lf != nil {
+			out = lf
+		}
+		newLogger = newJSONLogger(out, enableDebug, enableTrace)
+	} else if lf != nil {
+		newLogger = newTextLogger(lf, nOpts.Logtime, enableDebug, enableTrace)
+	} else if nOpts.LogFile != "" {
 		newLogger = logger.NewFileLogger(nOpts.LogFile, nOpts.Logtime, enableDebug, sOpts.Trace, true)
 	} else if nOpts.RemoteSyslog != "" {
 		newLogger = logger.NewRemoteSysLogger(nOpts.RemoteSyslog, sOpts.Debug, sOpts.Trace)
 	} else if nOpts.Syslog {
 		newLogger = logger.NewSysLogger(sOpts.Debug, sOpts.Trace)
+	} else if sl := newServiceLogger(enableDebug, enableTrace); sl != nil {
+		// Running as a Windows service, log to the event log.
+		newLogger = sl
 	} else {
 		colors := true
 		// Check to see if stderr is being redirected and if so turn off color
@@ -81,10 +127,132 @@ func ConfigureLogger(stanOpts *Options, natsOpts *natsd.Options) {
 	s.SetLogger(newLogger, nOpts.Debug, nOpts.Trace)
 
 	stanLog.Lock()
+	if stanLog.file != nil {
+		stanLog.file.Close()
+	}
 	stanLog.logger = newLogger
+	stanLog.file = lf
 	stanLog.Unlock()
 }
 
+// ReopenLogFile closes and reopens the log file, if any. This should be
+// invoked after the log file has been moved by an external tool, such
+// as logrotate. On Unix systems, this is done on reception of SIGUSR1.
+func ReopenLogFile() {
+	stanLog.Lock()
+	lf := stanLog.file
+	stanLog.Unlock()
+	if lf == nil {
+		return
+	}
+	if err := lf.Reopen(); err != nil {
+		Errorf("STAN: Unable to reopen log file: %v", err)
+		return
+	}
+	Noticef("STAN: Log file reopened")
+}
+
+// jsonLogger is a NATS logger writing one JSON object per statement.
+type jsonLogger struct {
+	sync.Mutex
+	out   io.Writer
+	debug bool
+	trace bool
+}
+
+// jsonLogEntry is what jsonLogger writes for each statement.
+type jsonLogEntry struct {
+	Time      string `json:"time"`
+	Level     string `json:"level"`
+	Component string `json:"component"`
+	Client    string `json:"client,omitempty"`
+	Channel   string `json:"channel,omitempty"`
+	Msg       string `json:"msg"`
+}
+
+func newJSONLogger(out io.Writer, debug, trace bool) *jsonLogger {
+	return &jsonLogger{out: out, debug: debug, trace: trace}
+}
+
+func (l *jsonLogger) log(level, format string, v ...interface{}) {
+	e := jsonLogEntry{Time: time.Now().UTC().Format(time.RFC3339Nano), Level: level}
+	e.Component, e.Client, e.Channel, e.Msg = logTags(fmt.Sprintf(format, v...))
+	b, err := json.Marshal(&e)
+	if err != nil {
+		return
+	}
+	b = append(b, '\n')
+	l.Lock()
+	l.out.Write(b)
+	l.Unlock()
+}
+
+// Noticef logs a notice statement
+func (l *jsonLogger) Noticef(format string, v ...interface{}) {
+	l.log("notice", format, v...)
+}
+
+// Errorf logs an error
+func (l *jsonLogger) Errorf(format string, v ...interface{}) {
+	l.log("error", format, v...)
+}
+
+// Fatalf logs a fatal error and exits
+func (l *jsonLogger) Fatalf(format string, v ...interface{}) {
+	l.log("fatal", format, v...)
+	os.Exit(1)
+}
+
+// Debugf logs a debug statement
+func (l *jsonLogger) Debugf(format string, v ...interface{}) {
+	if l.debug {
+		l.log("debug", format, v...)
+	}
+}
+
+// Tracef logs a trace statement
+func (l *jsonLogger) Tracef(format string, v ...interface{}) {
+	if l.trace {
+		l.log("trace", format, v...)
+	}
+}
+
+// logTags extracts the component, client ID and channel tags from a log
+// statement, and returns them along with the statement stripped of its
+// component prefix.
+func logTags(stmt string) (component, clientID, channel, msg string) {
+	component = "NATS"
+	msg = stmt
+	if i := strings.Index(stmt, ": "); i > 0 && isLogComponent(stmt[:i]) {
+		component = stmt[:i]
+		msg = strings.TrimLeft(stmt[i+2:], " ")
+	}
+	if strings.HasPrefix(msg, "[Client:") {
+		if end := strings.IndexByte(msg, ']'); end > 0 && msg[8:end] != "?" {
+			clientID = msg[8:end]
+		}
+	}
+	for _, f := range strings.Fields(msg) {
+		for _, key := range []string{"subject=", "subj=", "channel="} {
+			if strings.HasPrefix(f, key) {
+				channel = strings.TrimRight(f[len(key):], ".,:;")
+				return
+			}
+		}
+	}
+	return
+}
+
+// isLogComponent returns true if the string is made of upper case letters.
+func isLogComponent(s string) bool {
+	for _, c := range s {
+		if c < 'A' || c > 'Z' {
+			return false
+		}
+	}
+	return true
+}
+
 // RemoveLogger clears the logger instance and debug/trace flags.
 // Used for testing.
 func RemoveLogger() {
@@ -94,7 +262,11 @@ func RemoveLogger() {
 	atomic.StoreInt32(&debug, 0)
 
 	stanLog.Lock()
+	if stanLog.file != nil {
+		stanLog.file.Close()
+	}
 	stanLog.logger = nil
+	stanLog.file = nil
 	stanLog.Unlock()
 
 	s.SetLogger(nil, false, false)
@@ -3,11 +3,18 @@
 package server
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 	natsd "github.com/nats-io/gnatsd/server"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/nats-io/nats-streaming-server/stores"
 )
 
 func TestConfigureLogger(t *testing.T) {
@@ -186,3 +193,190 @@ func TestLogOutput(t *testing.T) {
 	Tracef("foo")
 	checkLogger("foo")
 }
+
+func TestLogTags(t *testing.T) {
+	for _, c := range []struct {
+		stmt      string
+		component string
+		client    string
+		channel   string
+		msg       string
+	}{
+		{"STAN: [Client:me] Added subscription on subject=foo.bar, inbox=bar", "STAN", "me", "foo.bar", "[Client:me] Added subscription on subject=foo.bar, inbox=bar"},
+		{"STAN: [Client:me] Unsubscribing subject=foo.", "STAN", "me", "foo", "[Client:me] Unsubscribing subject=foo."},
+		{"STAN:  Invalid Subscription request from foo.", "STAN", "", "", "Invalid Subscription request from foo."},
+		{"STAN: [Client:?] Ack received, invalid channel (foo)", "STAN", "", "", "[Client:?] Ack received, invalid channel (foo)"},
+		{"STORE: Unable to compact message store for channel=foo: err", "STORE", "", "foo", "Unable to compact message store for channel=foo: err"},
+		{"Listening for client connections on 0.0.0.0:4222", "NATS", "", "", "Listening for client connections on 0.0.0.0:4222"},
+		{"127.0.0.1:52000 - cid:1 - Client connection created", "NATS", "", "", "127.0.0.1:52000 - cid:1 - Client connection created"},
+	} {
+		component, client, channel, msg := logTags(c.stmt)
+		if component != c.component || client != c.client || channel != c.channel || msg != c.msg {
+			t.Fatalf("Unexpected tags for %q: %q %q %q %q", c.stmt, component, client, channel, msg)
+		}
+	}
+}
+
+func TestJSONLogger(t *testing.T) {
+	buf := &bytes.Buffer{}
+	l := &jsonLogger{out: buf}
+
+	l.Noticef("STAN: [Client:%s] Connected", "me")
+	l.Debugf("STAN: debug is not enabled")
+	l.Tracef("STAN: trace is not enabled")
+	l.debug = true
+	l.Errorf("STAN: [Client:%s] Unsubscribing subject=%s.", "me", "foo")
+	l.Debugf("STORE: WARNING: Reached limits for channel=%s", "bar")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("Expected 3 statements, got %v", lines)
+	}
+	expected := []jsonLogEntry{
+		{Level: "notice", Component: "STAN", Client: "me", Msg: "[Client:me] Connected"},
+		{Level: "error", Component: "STAN", Client: "me", Channel: "foo", Msg: "[Client:me] Unsubscribing subject=foo."},
+		{Level: "debug", Component: "STORE", Channel: "bar", Msg: "WARNING: Reached limits for channel=bar"},
+	}
+	for i, line := range lines {
+		e := jsonLogEntry{}
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			t.Fatalf("Invalid JSON statement %q: %v", line, err)
+		}
+		if e.Time == "" {
+			t.Fatalf("Missing time in %q", line)
+		}
+		e.Time = ""
+		if e != expected[i] {
+			t.Fatalf("Expected %+v, got %+v", expected[i], e)
+		}
+	}
+}
+
+func TestJSONLoggerFile(t *testing.T) {
+	defer RemoveLogger()
+
+	file, err := ioutil.TempFile("", "stan_server_json_log_")
+	if err != nil {
+		t.Fatalf("Unable to create file: %v", err)
+	}
+	file.Close()
+	defer os.Remove(file.Name())
+
+	sOpts := GetDefaultOptions()
+	sOpts.LogJSON = true
+	nOpts := &natsd.Options{LogFile: file.Name()}
+	ConfigureLogger(sOpts, nOpts)
+
+	Noticef("STAN: [Client:%s] Closed", "me")
+
+	b, err := ioutil.ReadFile(file.Name())
+	if err != nil {
+		t.Fatalf("Unable to read file: %v", err)
+	}
+	e := jsonLogEntry{}
+	if err := json.Unmarshal(b, &e); err != nil {
+		t.Fatalf("Invalid JSON statement %q: %v", b, err)
+	}
+	if e.Level != "notice" || e.Component != "STAN" || e.Client != "me" || e.Msg != "[Client:me] Closed" {
+		t.Fatalf("Unexpected statement: %q", b)
+	}
+}
+
+func TestLogFileRotation(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "stan_server_log_")
+	if err != nil {
+		t.Fatalf("Unable to create dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	name := filepath.Join(tmpDir, "stan.log")
+
+	lf, err := openLogFile(name, 10, 0)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer lf.Close()
+	// A single statement larger than the limit does not cause a rotation
+	// of an empty file.
+	for _, stmt := range []string{"0123456789ab\n", "foo\n", "bar\n", "baz\n"} {
+		if _, err := lf.Write([]byte(stmt)); err != nil {
+			t.Fatalf("Unexpected error on write: %v", err)
+		}
+	}
+	checkLogFiles := func(expected int) []string {
+		files, _ := filepath.Glob(name + ".*")
+		if len(files) != expected {
+			stackFatalf(t, "Expected %v rotated files, got %v", expected, files)
+		}
+		return files
+	}
+	files := checkLogFiles(2)
+	for i, expected := range []string{"0123456789ab\n", "foo\nbar\n"} {
+		if b, _ := ioutil.ReadFile(files[i]); string(b) != expected {
+			t.Fatalf("Unexpected content of %s: %q", files[i], b)
+		}
+	}
+	if b, _ := ioutil.ReadFile(name); string(b) != "baz\n" {
+		t.Fatalf("Unexpected content of %s: %q", name, b)
+	}
+	lf.Close()
+
+	// Rotation based on age.
+	lf, err = openLogFile(name, 0, 50*time.Millisecond)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer lf.Close()
+	lf.Write([]byte("bat\n"))
+	checkLogFiles(2)
+	time.Sleep(100 * time.Millisecond)
+	lf.Write([]byte("qux\n"))
+	files = checkLogFiles(3)
+	if b, _ := ioutil.ReadFile(files[2]); string(b) != "baz\nbat\n" {
+		t.Fatalf("Unexpected content of %s: %q", files[2], b)
+	}
+	if b, _ := ioutil.ReadFile(name); string(b) != "qux\n" {
+		t.Fatalf("Unexpected content of %s: %q", name, b)
+	}
+}
+
+func TestReopenLogFile(t *testing.T) {
+	defer RemoveLogger()
+
+	tmpDir, err := ioutil.TempDir("", "stan_server_log_")
+	if err != nil {
+		t.Fatalf("Unable to create dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	name := filepath.Join(tmpDir, "stan.log")
+
+	sOpts := GetDefaultOptions()
+	sOpts.LogFile = name
+	// The STAN log file takes precedence over the NATS one.
+	nOpts := &natsd.Options{LogFile: filepath.Join(tmpDir, "nats.log")}
+	ConfigureLogger(sOpts, nOpts)
+
+	Noticef("STAN: before")
+	// Store notices go to the same file.
+	stores.Noticef("from store")
+	if err := os.Rename(name, name+".1"); err != nil {
+		t.Fatalf("Unable to rename file: %v", err)
+	}
+	Noticef("STAN: still in moved file")
+	ReopenLogFile()
+	Noticef("STAN: after")
+
+	b, _ := ioutil.ReadFile(name + ".1")
+	moved := string(b)
+	b, _ = ioutil.ReadFile(name)
+	current := string(b)
+	if !strings.Contains(moved, "[INF] STAN: before") || !strings.Contains(moved, "[INF] STORE: from store") ||
+		!strings.Contains(moved, "STAN: still in moved file") || strings.Contains(moved, "STAN: after") {
+		t.Fatalf("Unexpected content of moved file: %q", moved)
+	}
+	if !strings.Contains(current, "STAN: Log file reopened") || !strings.Contains(current, "STAN: after") {
+		t.Fatalf("Unexpected content of log file: %q", current)
+	}
+	if _, err := os.Stat(nOpts.LogFile); err == nil {
+		t.Fatal("NATS log file should not have been created")
+	}
+}
@@ -0,0 +1,157 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// Format of the suffix added to the name of a rotated log file.
+const logFileRotateSuffix = "2006-01-02T15-04-05.000000000"
+
+// logFile is a log file that is rotated when it reaches a given size
+// or age. The rotated file is renamed with the time of the rotation
+// as a suffix, and a new file is created with the original name.
+type logFile struct {
+	sync.Mutex
+	name    string
+	maxSize int64
+	maxAge  time.Duration
+	file    *os.File
+	size    int64
+	created time.Time
+}
+
+// openLogFile opens (or creates) the log file. A `maxSize` or `maxAge`
+// of 0 means that the file is not rotated on size or age respectively.
+func openLogFile(name string, maxSize int64, maxAge time.Duration) (*logFile, error) {
+	lf := &logFile{name: name, maxSize: maxSize, maxAge: maxAge}
+	if err := lf.open(); err != nil {
+		return nil, err
+	}
+	return lf, nil
+}
+
+// open opens the file with the configured name. Lock held on entry.
+func (lf *logFile) open() error {
+	f, err := os.OpenFile(lf.name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0660)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	lf.file = f
+	lf.size = fi.Size()
+	lf.created = time.Now()
+	return nil
+}
+
+// Write implements io.Writer, rotating the file first if needed.
+func (lf *logFile) Write(p []byte) (int, error) {
+	lf.Lock()
+	defer lf.Unlock()
+	if lf.file == nil {
+		return 0, os.ErrClosed
+	}
+	if lf.size > 0 && ((lf.maxSize > 0 && lf.size+int64(len(p)) > lf.maxSize) ||
+		(lf.maxAge > 0 && time.Since(lf.created) >= lf.maxAge)) {
+		if err := lf.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := lf.file.Write(p)
+	lf.size += int64(n)
+	return n, err
+}
+
+// rotate renames the current file and creates a new one.
+// Lock held on entry.
+func (lf *logFile) rotate() error {
+	if err := lf.file.Close(); err != nil {
+		return err
+	}
+	lf.file = nil
+	rotated := fmt.Sprintf("%s.%s", lf.name, time.Now().Format(logFileRotateSuffix))
+	if err := os.Rename(lf.name, rotated); err != nil {
+		return err
+	}
+	return lf.open()
+}
+
+// Reopen closes and reopens the file by its name. This is used when the
+// file has been moved by an external tool, such as logrotate.
+func (lf *logFile) Reopen() error {
+	lf.Lock()
+	defer lf.Unlock()
+	if lf.file != nil {
+		lf.file.Close()
+		lf.file = nil
+	}
+	return lf.open()
+}
+
+// Close closes the file.
+func (lf *logFile) Close() error {
+	lf.Lock()
+	defer lf.Unlock()
+	if lf.file == nil {
+		return nil
+	}
+	err := lf.file.Close()
+	lf.file = nil
+	return err
+}
+
+// textLogger is a NATS logger writing plain text statements, in the
+// same format as the NATS file logger, to any writer.
+type textLogger struct {
+	logger *log.Logger
+	debug  bool
+	trace  bool
+}
+
+func newTextLogger(out io.Writer, time, debug, trace bool) *textLogger {
+	flags := 0
+	if time {
+		flags = log.LstdFlags | log.Lmicroseconds
+	}
+	pre := fmt.Sprintf("[%d] ", os.Getpid())
+	return &textLogger{logger: log.New(out, pre, flags), debug: debug, trace: trace}
+}
+
+// Noticef logs a notice statement
+func (l *textLogger) Noticef(format string, v ...interface{}) {
+	l.logger.Printf("[INF] "+format, v...)
+}
+
+// Errorf logs an error
+func (l *textLogger) Errorf(format string, v ...interface{}) {
+	l.logger.Printf("[ERR] "+format, v...)
+}
+
+// Fatalf logs a fatal error and exits
+func (l *textLogger) Fatalf(format string, v ...interface{}) {
+	l.logger.Fatalf("[FTL] "+format, v...)
+}
+
+// Debugf logs a debug statement
+func (l *textLogger) Debugf(format string, v ...interface{}) {
+	if l.debug {
+		l.logger.Printf("[DBG] "+format, v...)
+	}
+}
+
+// Tracef logs a trace statement
+func (l *textLogger) Tracef(format string, v ...interface{}) {
+	if l.trace {
+		l.logger.Printf("[TRC] "+format, v...)
+	}
+}
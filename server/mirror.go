@@ -0,0 +1,286 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/nats-io/go-nats-streaming/pb"
+	"github.com/nats-io/nats"
+	"github.com/nats-io/nats-streaming-server/stores"
+	"github.com/nats-io/nuid"
+)
+
+const (
+	// Interval between two attempts to replicate a channel after an error.
+	mirrorRetryInterval = time.Second
+
+	// Timeout of the requests sent to the source cluster.
+	mirrorRequestTimeout = 2 * time.Second
+
+	// Number of messages the source cluster sends before waiting for acks.
+	mirrorMaxInFlight = 1024
+
+	// Time the source cluster waits for the ack of a message before
+	// sending it again.
+	mirrorAckWait = 30
+)
+
+// errMirrorDisconnected is returned when the connection to the source
+// cluster of a mirror is lost.
+var errMirrorDisconnected = errors.New("connection to source cluster lost")
+
+// Mirror replicates a channel of a remote NATS Streaming cluster into a
+// local channel, keeping the sequences and timestamps of the messages.
+// The local channel is read-only: messages published to it are rejected.
+type Mirror struct {
+	Channel       string `json:"channel"`                  // Local channel
+	SourceURL     string `json:"source_url"`               // URL(s) of the NATS server(s) of the source cluster
+	SourceCluster string `json:"source_cluster"`           // Cluster ID of the source cluster
+	SourceChannel string `json:"source_channel,omitempty"` // Channel in the source cluster, Channel if empty
+}
+
+// LoadMirrorsFile reads the mirrored channels from a JSON file containing
+// an array of mirrors, for instance:
+//
+//	[{"channel": "orders", "source_url": "nats://dc1:4222", "source_cluster": "dc1"},
+//	 {"channel": "dc1.invoices", "source_url": "nats://dc1:4222",
+//	  "source_cluster": "dc1", "source_channel": "invoices"}]
+func LoadMirrorsFile(path string) ([]*Mirror, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var mirrors []*Mirror
+	if err := json.Unmarshal(b, &mirrors); err != nil {
+		return nil, fmt.Errorf("error parsing mirrors file %q: %v", path, err)
+	}
+	if err := validateMirrors(mirrors); err != nil {
+		return nil, fmt.Errorf("error parsing mirrors file %q: %v", path, err)
+	}
+	return mirrors, nil
+}
+
+// validateMirrors checks that the mirrored channels are valid and that a
+// channel is not mirrored twice.
+func validateMirrors(mirrors []*Mirror) error {
+	channels := make(map[string]struct{}, len(mirrors))
+	for _, m := range mirrors {
+		if !isValidSubject(m.Channel) {
+			return fmt.Errorf("invalid mirror channel %q", m.Channel)
+		}
+		if m.SourceChannel != "" && !isValidSubject(m.SourceChannel) {
+			return fmt.Errorf("invalid source channel %q for mirror %q", m.SourceChannel, m.Channel)
+		}
+		if m.SourceURL == "" || m.SourceCluster == "" {
+			return fmt.Errorf("missing source URL or cluster for mirror %q", m.Channel)
+		}
+		if _, dup := channels[m.Channel]; dup {
+			return fmt.Errorf("channel %q is mirrored twice", m.Channel)
+		}
+		channels[m.Channel] = struct{}{}
+	}
+	return nil
+}
+
+// sourceChannel returns the name of the mirrored channel in the source cluster.
+func (m *Mirror) sourceChannel() string {
+	if m.SourceChannel != "" {
+		return m.SourceChannel
+	}
+	return m.Channel
+}
+
+// isMirror returns true if the channel is a mirror of a remote channel.
+func (s *StanServer) isMirror(channel string) bool {
+	_, ok := s.mirrorChannels[channel]
+	return ok
+}
+
+// startMirrors starts replicating the mirrored channels.
+func (s *StanServer) startMirrors() {
+	if len(s.opts.Mirrors) == 0 {
+		return
+	}
+	s.mirrorsQuit = make(chan struct{})
+	for _, m := range s.opts.Mirrors {
+		s.mirrorsWg.Add(1)
+		go s.runMirror(m)
+	}
+}
+
+// stopMirrors stops the replication and waits for the go routines to return.
+func (s *StanServer) stopMirrors() {
+	if s.mirrorsQuit == nil {
+		return
+	}
+	close(s.mirrorsQuit)
+	s.mirrorsWg.Wait()
+}
+
+// runMirror replicates the channel until the server shuts down. After an
+// error, the replication resumes from the last sequence stored locally.
+func (s *StanServer) runMirror(m *Mirror) {
+	defer s.mirrorsWg.Done()
+	for {
+		if err := s.replicate(m); err != nil {
+			Errorf("STAN: Unable to replicate channel=%s from cluster %q: %v", m.Channel, m.SourceCluster, err)
+		} else {
+			return
+		}
+		select {
+		case <-s.mirrorsQuit:
+			return
+		case <-time.After(mirrorRetryInterval):
+		}
+	}
+}
+
+// replicate connects to the source cluster and stores the messages of the
+// source channel in the local channel, until the server shuts down (in
+// which case nil is returned) or an error occurs.
+func (s *StanServer) replicate(m *Mirror) error {
+	cs, err := s.createChannel(m.Channel, "")
+	if err != nil {
+		return err
+	}
+	closed := make(chan struct{}, 1)
+	nc, err := nats.Connect(m.SourceURL, nats.NoReconnect(),
+		nats.ClosedHandler(func(_ *nats.Conn) {
+			select {
+			case closed <- struct{}{}:
+			default:
+			}
+		}))
+	if err != nil {
+		return err
+	}
+	defer nc.Close()
+
+	// Connect to the source cluster as a regular client.
+	clientID := "mirror_" + nuid.Next()
+	hbInbox := nats.NewInbox()
+	if _, err := nc.Subscribe(hbInbox, func(hb *nats.Msg) {
+		nc.Publish(hb.Reply, nil)
+	}); err != nil {
+		return err
+	}
+	creq := &pb.ConnectRequest{ClientID: clientID, HeartbeatInbox: hbInbox}
+	b, _ := creq.Marshal()
+	reply, err := nc.Request(fmt.Sprintf("%s.%s", DefaultDiscoverPrefix, m.SourceCluster), b, mirrorRequestTimeout)
+	if err != nil {
+		return err
+	}
+	cresp := &pb.ConnectResponse{}
+	if err := cresp.Unmarshal(reply.Data); err != nil {
+		return err
+	}
+	if cresp.Error != "" {
+		return errors.New(cresp.Error)
+	}
+	defer func() {
+		req := &pb.CloseRequest{ClientID: clientID}
+		b, _ := req.Marshal()
+		nc.Request(cresp.CloseRequests, b, mirrorRequestTimeout)
+	}()
+
+	msgs := make(chan *nats.Msg, mirrorMaxInFlight)
+	inbox := nats.NewInbox()
+	if _, err := nc.ChanSubscribe(inbox, msgs); err != nil {
+		return err
+	}
+	sreq := &pb.SubscriptionRequest{
+		ClientID:      clientID,
+		Subject:       m.sourceChannel(),
+		Inbox:         inbox,
+		MaxInFlight:   mirrorMaxInFlight,
+		AckWaitInSecs: mirrorAckWait,
+	}
+	// Resume after the last message stored locally. If the source no longer
+	// has the next message, or does not have it yet, start from its first
+	// message, those already stored being skipped.
+	last := cs.Msgs.LastSequence()
+	if last > 0 {
+		sreq.StartPosition = pb.StartPosition_SequenceStart
+		sreq.StartSequence = last + 1
+	} else {
+		sreq.StartPosition = pb.StartPosition_First
+	}
+	sresp, err := s.mirrorSubscribe(nc, cresp.SubRequests, sreq)
+	if err == nil && sresp.Error == ErrInvalidSequence.Error() {
+		sreq.StartPosition = pb.StartPosition_First
+		sreq.StartSequence = 0
+		sresp, err = s.mirrorSubscribe(nc, cresp.SubRequests, sreq)
+	}
+	if err != nil {
+		return err
+	}
+	if sresp.Error != "" {
+		return errors.New(sresp.Error)
+	}
+	Noticef("STAN: Replicating channel=%s from cluster %q after seq=%d", m.Channel, m.SourceCluster, last)
+
+	for {
+		select {
+		case <-s.mirrorsQuit:
+			return nil
+		case <-closed:
+			return errMirrorDisconnected
+		case raw := <-msgs:
+			seq, err := s.storeMirroredMsg(cs, m, raw.Data)
+			if err != nil {
+				return err
+			}
+			ack := &pb.Ack{Subject: sreq.Subject, Sequence: seq}
+			b, _ := ack.Marshal()
+			if err := nc.Publish(sresp.AckInbox, b); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// mirrorSubscribe sends the subscription request to the source cluster.
+func (s *StanServer) mirrorSubscribe(nc *nats.Conn, subject string, sreq *pb.SubscriptionRequest) (*pb.SubscriptionResponse, error) {
+	b, _ := sreq.Marshal()
+	reply, err := nc.Request(subject, b, mirrorRequestTimeout)
+	if err != nil {
+		return nil, err
+	}
+	sresp := &pb.SubscriptionResponse{}
+	if err := sresp.Unmarshal(reply.Data); err != nil {
+		return nil, err
+	}
+	return sresp, nil
+}
+
+// storeMirroredMsg stores the message received from the source cluster,
+// unless it is already stored, delivers it to the local subscribers and
+// returns its sequence.
+func (s *StanServer) storeMirroredMsg(cs *stores.ChannelStore, m *Mirror, data []byte) (uint64, error) {
+	msg := &pb.MsgProto{}
+	if err := msg.Unmarshal(data); err != nil {
+		return 0, err
+	}
+	if msg.Sequence <= cs.Msgs.LastSequence() {
+		return msg.Sequence, nil
+	}
+	msg.Subject = m.Channel
+	msg.Redelivered = false
+	msg.CRC32 = 0
+	if err := cs.Msgs.StoreMsg(msg, parseMsgExt(data)); err != nil {
+		return 0, err
+	}
+	if err := cs.Msgs.Flush(); err != nil {
+		return 0, err
+	}
+	s.processMsg(cs)
+	if err := cs.Subs.Flush(); err != nil {
+		return 0, err
+	}
+	return msg.Sequence, nil
+}
@@ -0,0 +1,155 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/nats-io/go-nats-streaming"
+	"github.com/nats-io/nats-streaming-server/stores"
+)
+
+func TestLoadMirrorsFile(t *testing.T) {
+	f, err := ioutil.TempFile("", "mirrors")
+	if err != nil {
+		t.Fatalf("Unable to create file: %v", err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(`[{"channel": "foo", "source_url": "nats://localhost:4333", "source_cluster": "dc1"},
+		{"channel": "dc1.bar", "source_url": "nats://localhost:4333", "source_cluster": "dc1", "source_channel": "bar"}]`)
+	f.Close()
+
+	mirrors, err := LoadMirrorsFile(f.Name())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(mirrors) != 2 || mirrors[0].sourceChannel() != "foo" || mirrors[1].sourceChannel() != "bar" ||
+		mirrors[1].Channel != "dc1.bar" || mirrors[1].SourceCluster != "dc1" {
+		t.Fatalf("Unexpected mirrors: %v", mirrors)
+	}
+
+	for _, content := range []string{
+		"not json",
+		`[{"channel": "foo.*", "source_url": "nats://localhost:4333", "source_cluster": "dc1"}]`,
+		`[{"channel": "foo", "source_url": "nats://localhost:4333", "source_cluster": "dc1", "source_channel": ">"}]`,
+		`[{"channel": "foo", "source_cluster": "dc1"}]`,
+		`[{"channel": "foo", "source_url": "nats://localhost:4333"}]`,
+		`[{"channel": "foo", "source_url": "nats://localhost:4333", "source_cluster": "dc1"},
+		  {"channel": "foo", "source_url": "nats://localhost:4333", "source_cluster": "dc1", "source_channel": "bar"}]`,
+	} {
+		if err := ioutil.WriteFile(f.Name(), []byte(content), 0600); err != nil {
+			t.Fatalf("Unable to write file: %v", err)
+		}
+		if _, err := LoadMirrorsFile(f.Name()); err == nil {
+			t.Fatalf("Expected error loading %q", content)
+		}
+	}
+}
+
+// waitForMirror waits for the last sequence of the mirrored channel to be
+// `expected`, then checks that the messages match those of the source.
+func waitForMirror(t *testing.T, source, mirror *StanServer, channel string, expected uint64) {
+	var mcs *stores.ChannelStore
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if mcs = mirror.store.LookupChannel(channel); mcs != nil && mcs.Msgs.LastSequence() == expected {
+			break
+		}
+		if time.Now().After(deadline) {
+			stackFatalf(t, "Channel %s was not replicated up to seq=%v", channel, expected)
+		}
+		time.Sleep(15 * time.Millisecond)
+	}
+	scs := source.store.LookupChannel(channel)
+	for seq := uint64(1); seq <= expected; seq++ {
+		sm, _ := scs.Msgs.Lookup(seq)
+		mm, _ := mcs.Msgs.Lookup(seq)
+		if mm == nil || mm.Timestamp != sm.Timestamp || string(mm.Data) != string(sm.Data) {
+			stackFatalf(t, "Unexpected mirrored message %v, expected %v", mm, sm)
+		}
+	}
+}
+
+func TestMirror(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	// The source cluster stores its messages in files so that they survive
+	// a restart.
+	sourceOpts := GetDefaultOptions()
+	sourceOpts.ID = "source"
+	sourceOpts.StoreType = stores.TypeFile
+	sourceOpts.FilestoreDir = defaultDataStore
+	sourceNOpts := DefaultNatsServerOptions
+	sourceNOpts.Port = 4333
+	source := RunServerWithOpts(sourceOpts, &sourceNOpts)
+	defer source.Shutdown()
+
+	sourceURL := fmt.Sprintf("nats://localhost:%d", sourceNOpts.Port)
+	publish := func(from, to int) {
+		sc, err := stan.Connect("source", clientName, stan.NatsURL(sourceURL))
+		if err != nil {
+			stackFatalf(t, "Unexpected error on connect: %v", err)
+		}
+		defer sc.Close()
+		for i := from; i <= to; i++ {
+			if err := sc.Publish("foo", []byte(fmt.Sprintf("msg%d", i))); err != nil {
+				stackFatalf(t, "Unexpected error on publish: %v", err)
+			}
+		}
+	}
+	publish(1, 3)
+
+	opts := GetDefaultOptions()
+	opts.ID = clusterName
+	opts.Mirrors = []*Mirror{{Channel: "foo", SourceURL: sourceURL, SourceCluster: "source"}}
+	s := RunServerWithOpts(opts, nil)
+	defer s.Shutdown()
+
+	waitForMirror(t, source, s, "foo", 3)
+
+	// Local subscribers receive the mirrored messages, but can't publish
+	// on the mirror.
+	sc := NewDefaultConnection(t)
+	defer sc.Close()
+	received := make(chan *stan.Msg, 10)
+	if _, err := sc.Subscribe("foo", func(m *stan.Msg) {
+		received <- m
+	}, stan.DeliverAllAvailable()); err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+	for i := 1; i <= 3; i++ {
+		select {
+		case m := <-received:
+			if m.Sequence != uint64(i) {
+				t.Fatalf("Expected seq %v, got %v", i, m.Sequence)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("Did not receive mirrored message")
+		}
+	}
+	if err := sc.Publish("foo", []byte("hello")); err == nil || err.Error() != ErrMirrorChannel.Error() {
+		t.Fatalf("Expected error %v, got %v", ErrMirrorChannel, err)
+	}
+
+	// Replication resumes after the source is restarted.
+	source.Shutdown()
+	source = RunServerWithOpts(sourceOpts, &sourceNOpts)
+	defer source.Shutdown()
+	publish(4, 5)
+	waitForMirror(t, source, s, "foo", 5)
+	for i := 4; i <= 5; i++ {
+		select {
+		case m := <-received:
+			if m.Sequence != uint64(i) {
+				t.Fatalf("Expected seq %v, got %v", i, m.Sequence)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("Did not receive mirrored message")
+		}
+	}
+}
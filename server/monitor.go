@@ -0,0 +1,442 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats-streaming-server/stores"
+)
+
+// Paths of the monitoring endpoints.
+const (
+	// ChannelszPath returns the channels, with their latency histograms.
+	ChannelszPath = "/streaming/channelsz"
+	// SubszPath returns the subscriptions, with their redelivery counts.
+	SubszPath = "/streaming/subsz"
+	// RuntimezPath returns the last samples of the runtime statistics.
+	RuntimezPath = "/streaming/runtimez"
+	// HealthzPath returns 200 as long as the server is running.
+	HealthzPath = "/healthz"
+	// ReadyzPath returns 200 if the server is ready to serve clients, 503
+	// otherwise.
+	ReadyzPath = "/readyz"
+	// MetricsPath returns the gauges of the channels and subscriptions in
+	// the Prometheus text format.
+	MetricsPath = "/metrics"
+	// ProfilingPath is the prefix of the net/http/pprof endpoints, served
+	// only if profiling is enabled.
+	ProfilingPath = "/debug/pprof/"
+)
+
+// Number of runtime statistics samples kept for the RuntimezPath endpoint.
+const runtimeStatsSamples = 60
+
+// channelStats holds the latency histograms of a channel.
+type channelStats struct {
+	storeLatency histogram // from the reception of a message to its flush in the store
+	ackLatency   histogram // from the (re)delivery of a message to its ack
+	deliveryLag  histogram // from the storage of a message to its first delivery
+}
+
+// Channelsz is the response of the ChannelszPath endpoint.
+type Channelsz struct {
+	ClusterID string          `json:"cluster_id"`
+	Now       time.Time       `json:"now"`
+	Channels  []*ChannelStats `json:"channels"`
+}
+
+// ChannelStats describes a channel and its latency histograms.
+type ChannelStats struct {
+	Name          string     `json:"name"`
+	Created       time.Time  `json:"created,omitempty"`
+	Msgs          int        `json:"msgs"`
+	Bytes         uint64     `json:"bytes"`
+	FirstSequence uint64     `json:"first_seq"`
+	LastSequence  uint64     `json:"last_seq"`
+	Subscriptions int        `json:"subscriptions"`
+	StoreLatency  *Histogram `json:"store_latency"`
+	AckLatency    *Histogram `json:"ack_latency"`
+	DeliveryLag   *Histogram `json:"delivery_lag"`
+	// Retention is set when the limits are enforced in the background.
+	Retention *RetentionStats `json:"retention,omitempty"`
+}
+
+// RetentionStats describes the progress of the background enforcement of
+// the limits of a channel.
+type RetentionStats struct {
+	ExcessMsgs   int    `json:"excess_msgs"`
+	ExcessBytes  uint64 `json:"excess_bytes"`
+	RemovedMsgs  uint64 `json:"removed_msgs"`
+	RemovedBytes uint64 `json:"removed_bytes"`
+}
+
+// Subsz is the response of the SubszPath endpoint.
+type Subsz struct {
+	ClusterID     string               `json:"cluster_id"`
+	Now           time.Time            `json:"now"`
+	Subscriptions []*SubscriptionStats `json:"subscriptions"`
+}
+
+// SubscriptionStats describes a subscription and its redeliveries.
+// Redeliveries counts the redeliveries since the subscription was created
+// or, if it was recovered, since the server started. MaxDeliveries is the
+// highest number of deliveries of the messages not acknowledged yet. Lag is
+// the number of messages of the channel after the last one acknowledged.
+type SubscriptionStats struct {
+	Channel       string `json:"channel"`
+	ClientID      string `json:"client_id"`
+	Inbox         string `json:"inbox"`
+	QueueName     string `json:"queue_name,omitempty"`
+	DurableName   string `json:"durable_name,omitempty"`
+	LastSent      uint64 `json:"last_sent"`
+	PendingCount  int    `json:"pending_count"`
+	MaxInFlight   int32  `json:"max_inflight"`
+	Redeliveries  uint64 `json:"redeliveries"`
+	MaxDeliveries uint32 `json:"max_deliveries"`
+	Lag           uint64 `json:"lag"`
+}
+
+// Runtimez is the response of the RuntimezPath endpoint.
+type Runtimez struct {
+	Now     time.Time       `json:"now"`
+	Samples []*RuntimeStats `json:"samples"`
+}
+
+// RuntimeStats is a sample of the Go runtime statistics. GC pauses are
+// those of the garbage collections that occurred since the previous sample.
+type RuntimeStats struct {
+	Time         time.Time     `json:"time"`
+	Goroutines   int           `json:"goroutines"`
+	HeapAlloc    uint64        `json:"heap_alloc"`
+	HeapInuse    uint64        `json:"heap_inuse"`
+	HeapObjects  uint64        `json:"heap_objects"`
+	Sys          uint64        `json:"sys"`
+	NumGC        uint32        `json:"num_gc"`
+	GCPauseTotal time.Duration `json:"gc_pause_total"`
+	GCPauses     uint32        `json:"gc_pauses"`
+	GCMaxPause   time.Duration `json:"gc_max_pause"`
+}
+
+// startMonitoring starts serving the monitoring endpoints on the
+// MonitorListen address.
+func (s *StanServer) startMonitoring() error {
+	if s.opts.MonitorListen == "" {
+		return nil
+	}
+	l, err := listen(s.opts.MonitorListen)
+	if err != nil {
+		return err
+	}
+	s.monitorListener = l
+	s.monitorServer = &http.Server{Handler: s.monitorHandler()}
+	Noticef("STAN: Listening for monitoring requests on %s", l.Addr())
+	if s.opts.MonitorProfiling {
+		Noticef("STAN: Profiling enabled on http://%s%s", l.Addr(), ProfilingPath)
+	}
+	s.monitorWg.Add(1)
+	go func() {
+		defer s.monitorWg.Done()
+		s.monitorServer.Serve(l)
+	}()
+	interval := s.opts.RuntimeStatsInterval
+	if interval <= 0 {
+		interval = DefaultRuntimeStatsInterval
+	}
+	s.runtimeQuit = make(chan struct{})
+	s.monitorWg.Add(1)
+	go s.sampleRuntimeStats(interval)
+	return nil
+}
+
+// monitorHandler returns the handler of the monitoring endpoints.
+func (s *StanServer) monitorHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(ChannelszPath, s.handleChannelsz)
+	mux.HandleFunc(SubszPath, s.handleSubsz)
+	mux.HandleFunc(RuntimezPath, s.handleRuntimez)
+	mux.HandleFunc(HealthzPath, s.handleHealthz)
+	mux.HandleFunc(ReadyzPath, s.handleReadyz)
+	mux.HandleFunc(MetricsPath, s.handleMetrics)
+	if s.opts.MonitorProfiling {
+		mux.HandleFunc(ProfilingPath, pprof.Index)
+		mux.HandleFunc(ProfilingPath+"cmdline", pprof.Cmdline)
+		mux.HandleFunc(ProfilingPath+"profile", pprof.Profile)
+		mux.HandleFunc(ProfilingPath+"symbol", pprof.Symbol)
+		mux.HandleFunc(ProfilingPath+"trace", pprof.Trace)
+	}
+	return mux
+}
+
+// stopMonitoring stops serving the monitoring endpoints.
+func (s *StanServer) stopMonitoring() {
+	if s.monitorListener == nil {
+		return
+	}
+	s.monitorServer.SetKeepAlivesEnabled(false)
+	s.monitorListener.Close()
+	close(s.runtimeQuit)
+	s.monitorWg.Wait()
+}
+
+// sampleRuntimeStats samples the runtime statistics at the given interval,
+// keeping the last runtimeStatsSamples samples, until stopMonitoring is
+// called.
+func (s *StanServer) sampleRuntimeStats(interval time.Duration) {
+	defer s.monitorWg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var prevNumGC uint32
+	for {
+		ms := &runtime.MemStats{}
+		runtime.ReadMemStats(ms)
+		rs := &RuntimeStats{
+			Time:         time.Now(),
+			Goroutines:   runtime.NumGoroutine(),
+			HeapAlloc:    ms.HeapAlloc,
+			HeapInuse:    ms.HeapInuse,
+			HeapObjects:  ms.HeapObjects,
+			Sys:          ms.Sys,
+			NumGC:        ms.NumGC,
+			GCPauseTotal: time.Duration(ms.PauseTotalNs),
+			GCPauses:     ms.NumGC - prevNumGC,
+		}
+		// PauseNs is a circular buffer of the most recent pauses, the
+		// latest being at (NumGC+255)%256.
+		for i := uint32(0); i < rs.GCPauses && i < uint32(len(ms.PauseNs)); i++ {
+			pause := time.Duration(ms.PauseNs[(ms.NumGC-1-i)%uint32(len(ms.PauseNs))])
+			if pause > rs.GCMaxPause {
+				rs.GCMaxPause = pause
+			}
+		}
+		prevNumGC = ms.NumGC
+		s.runtimeLock.Lock()
+		if len(s.runtimeStats) == runtimeStatsSamples {
+			s.runtimeStats = append(s.runtimeStats[:0], s.runtimeStats[1:]...)
+		}
+		s.runtimeStats = append(s.runtimeStats, rs)
+		s.runtimeLock.Unlock()
+		select {
+		case <-ticker.C:
+		case <-s.runtimeQuit:
+			return
+		}
+	}
+}
+
+// handleChannelsz returns the channels sorted by name, or only the one
+// given by the `channel` query parameter.
+func (s *StanServer) handleChannelsz(w http.ResponseWriter, r *http.Request) {
+	channels, err := s.ChannelsStats(r.URL.Query().Get("channel"))
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, err)
+		return
+	}
+	httpJSON(w, http.StatusOK, &Channelsz{ClusterID: s.info.ClusterID, Now: time.Now(), Channels: channels})
+}
+
+// handleSubsz returns the subscriptions sorted by channel, client ID and
+// inbox, or only those of the channel given by the `channel` query
+// parameter.
+func (s *StanServer) handleSubsz(w http.ResponseWriter, r *http.Request) {
+	subs, err := s.SubscriptionsStats(r.URL.Query().Get("channel"))
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, err)
+		return
+	}
+	httpJSON(w, http.StatusOK, &Subsz{ClusterID: s.info.ClusterID, Now: time.Now(), Subscriptions: subs})
+}
+
+// handleRuntimez returns the samples of the runtime statistics, oldest first.
+func (s *StanServer) handleRuntimez(w http.ResponseWriter, r *http.Request) {
+	s.runtimeLock.Lock()
+	samples := make([]*RuntimeStats, len(s.runtimeStats))
+	copy(samples, s.runtimeStats)
+	s.runtimeLock.Unlock()
+	httpJSON(w, http.StatusOK, &Runtimez{Now: time.Now(), Samples: samples})
+}
+
+// metricsLabelEscaper escapes the values of the labels of the metrics.
+var metricsLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// handleMetrics returns the gauges of the channels and subscriptions in the
+// Prometheus text exposition format.
+func (s *StanServer) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	channels, err := s.ChannelsStats("")
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, err)
+		return
+	}
+	subs, err := s.SubscriptionsStats("")
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	bw := bufio.NewWriter(w)
+	gauge := func(name, help string, n int, labels func(int) string, value func(int) uint64) {
+		fmt.Fprintf(bw, "# HELP %s %s\n# TYPE %s gauge\n", name, help, name)
+		for i := 0; i < n; i++ {
+			fmt.Fprintf(bw, "%s{%s} %d\n", name, labels(i), value(i))
+		}
+	}
+	channelLabels := func(i int) string {
+		return fmt.Sprintf(`channel="%s"`, metricsLabelEscaper.Replace(channels[i].Name))
+	}
+	gauge("stan_channel_msgs", "Number of messages in the channel.", len(channels), channelLabels,
+		func(i int) uint64 { return uint64(channels[i].Msgs) })
+	gauge("stan_channel_bytes", "Size of the messages in the channel.", len(channels), channelLabels,
+		func(i int) uint64 { return channels[i].Bytes })
+	gauge("stan_channel_last_seq", "Sequence of the last message of the channel.", len(channels), channelLabels,
+		func(i int) uint64 { return channels[i].LastSequence })
+	subLabels := func(i int) string {
+		sub := subs[i]
+		return fmt.Sprintf(`channel="%s",client_id="%s",inbox="%s",durable="%s",queue="%s"`,
+			metricsLabelEscaper.Replace(sub.Channel), metricsLabelEscaper.Replace(sub.ClientID),
+			metricsLabelEscaper.Replace(sub.Inbox), metricsLabelEscaper.Replace(sub.DurableName),
+			metricsLabelEscaper.Replace(sub.QueueName))
+	}
+	gauge("stan_subscription_pending", "Number of messages sent to the subscription and not acknowledged yet.", len(subs), subLabels,
+		func(i int) uint64 { return uint64(subs[i].PendingCount) })
+	gauge("stan_subscription_lag", "Number of messages of the channel after the last one acknowledged by the subscription.", len(subs), subLabels,
+		func(i int) uint64 { return subs[i].Lag })
+	rejected := s.RejectedOps()
+	fmt.Fprintf(bw, "# HELP stan_rejected_total Number of operations rejected because a limit is reached.\n# TYPE stan_rejected_total counter\n")
+	for _, code := range []string{ErrCodeMaxChannels, ErrCodeMaxSubs} {
+		fmt.Fprintf(bw, "stan_rejected_total{code=\"%s\"} %d\n", code, rejected[code])
+	}
+	bw.Flush()
+}
+
+// ChannelsStats returns the statistics of the channels, or of the given
+// channel only if not empty.
+func (s *StanServer) ChannelsStats(channel string) ([]*ChannelStats, error) {
+	infos, err := s.store.GetChannels()
+	if err != nil {
+		return nil, err
+	}
+	channels := []*ChannelStats{}
+	for _, info := range infos {
+		if channel != "" && info.Name != channel {
+			continue
+		}
+		cs := s.store.LookupChannel(info.Name)
+		if cs == nil {
+			continue
+		}
+		ss := cs.UserData.(*subStore)
+		ss.RLock()
+		subsCount := len(ss.psubs)
+		for _, qs := range ss.qsubs {
+			qs.RLock()
+			subsCount += len(qs.subs)
+			qs.RUnlock()
+		}
+		ss.RUnlock()
+		stats := &ChannelStats{
+			Name:          info.Name,
+			Created:       info.Created,
+			Msgs:          info.Msgs,
+			Bytes:         info.Bytes,
+			FirstSequence: info.FirstSeq,
+			LastSequence:  info.LastSeq,
+			Subscriptions: subsCount,
+			StoreLatency:  ss.stats.storeLatency.summary(),
+			AckLatency:    ss.stats.ackLatency.summary(),
+			DeliveryLag:   ss.stats.deliveryLag.summary(),
+		}
+		if rs := info.Retention; rs != nil {
+			stats.Retention = &RetentionStats{
+				ExcessMsgs:   rs.ExcessMsgs,
+				ExcessBytes:  rs.ExcessBytes,
+				RemovedMsgs:  rs.RemovedMsgs,
+				RemovedBytes: rs.RemovedBytes,
+			}
+		}
+		channels = append(channels, stats)
+	}
+	return channels, nil
+}
+
+// SubscriptionsStats returns the statistics of the subscriptions, or of
+// the subscriptions of the given channel only if not empty.
+func (s *StanServer) SubscriptionsStats(channel string) ([]*SubscriptionStats, error) {
+	infos, err := s.store.GetChannels()
+	if err != nil {
+		return nil, err
+	}
+	subs := []*SubscriptionStats{}
+	for _, info := range infos {
+		if channel != "" && info.Name != channel {
+			continue
+		}
+		cs := s.store.LookupChannel(info.Name)
+		if cs == nil {
+			continue
+		}
+		for _, sub := range cs.UserData.(*subStore).getAllSubs() {
+			qsent := sub.queueLastSent()
+			sub.RLock()
+			stats := &SubscriptionStats{
+				Channel:      info.Name,
+				ClientID:     sub.ClientID,
+				Inbox:        sub.Inbox,
+				QueueName:    sub.QGroup,
+				DurableName:  sub.DurableName,
+				LastSent:     sub.LastSent,
+				PendingCount: len(sub.acksPending) + len(sub.spilled),
+				MaxInFlight:  sub.MaxInFlight,
+				Redeliveries: sub.redeliveries,
+				Lag:          sub.lag(info.LastSeq, qsent),
+			}
+			for _, count := range sub.deliveries {
+				if count > stats.MaxDeliveries {
+					stats.MaxDeliveries = count
+				}
+			}
+			sub.RUnlock()
+			subs = append(subs, stats)
+		}
+	}
+	sort.Sort(subscriptionStatsByName(subs))
+	return subs, nil
+}
+
+// subscriptionStatsByName is used to sort subscriptions by channel, client
+// ID and inbox.
+type subscriptionStatsByName []*SubscriptionStats
+
+func (a subscriptionStatsByName) Len() int      { return len(a) }
+func (a subscriptionStatsByName) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a subscriptionStatsByName) Less(i, j int) bool {
+	if a[i].Channel != a[j].Channel {
+		return a[i].Channel < a[j].Channel
+	}
+	if a[i].ClientID != a[j].ClientID {
+		return a[i].ClientID < a[j].ClientID
+	}
+	return a[i].Inbox < a[j].Inbox
+}
+
+// channelStats returns the latency histograms of the channel, or nil if
+// the channel does not exist.
+func (s *StanServer) channelStats(channel string) *channelStats {
+	cs := s.store.LookupChannel(channel)
+	if cs == nil {
+		return nil
+	}
+	return cs.UserData.(*subStore).stats
+}
+
+// recordStoreLatency records, in the histogram of the channel, the time
+// elapsed since the message was received.
+func recordStoreLatency(cs *stores.ChannelStore, received time.Time) {
+	cs.UserData.(*subStore).stats.storeLatency.record(time.Since(received))
+}
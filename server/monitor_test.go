@@ -0,0 +1,317 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nats-io/go-nats-streaming"
+	"github.com/nats-io/go-nats-streaming/pb"
+	"github.com/nats-io/nats"
+	"github.com/nats-io/nats-streaming-server/spb"
+)
+
+func TestHistogram(t *testing.T) {
+	h := &histogram{}
+	if hs := h.summary(); hs.Count != 0 || hs.Mean != 0 || hs.P99 != 0 || hs.Max != 0 {
+		t.Fatalf("Unexpected summary of empty histogram: %+v", hs)
+	}
+	// 90 durations of 10µs, 9 of 1ms and 1 of 1s.
+	for i := 0; i < 90; i++ {
+		h.record(10 * time.Microsecond)
+	}
+	for i := 0; i < 9; i++ {
+		h.record(time.Millisecond)
+	}
+	h.record(time.Second)
+	h.record(-time.Second)
+	hs := h.summary()
+	if hs.Count != 101 || hs.Max != time.Second {
+		t.Fatalf("Unexpected summary: %+v", hs)
+	}
+	if hs.P50 < 10*time.Microsecond || hs.P50 > 20*time.Microsecond {
+		t.Fatalf("Unexpected p50: %v", hs.P50)
+	}
+	if hs.P90 < 10*time.Microsecond || hs.P90 > 20*time.Microsecond {
+		t.Fatalf("Unexpected p90: %v", hs.P90)
+	}
+	if hs.P99 < time.Millisecond || hs.P99 > 2*time.Millisecond {
+		t.Fatalf("Unexpected p99: %v", hs.P99)
+	}
+	if expected := (90*10*time.Microsecond + 9*time.Millisecond + time.Second) / 101; hs.Mean != expected {
+		t.Fatalf("Expected mean %v, got %v", expected, hs.Mean)
+	}
+}
+
+func getChannelsz(t *testing.T, s *StanServer, query string) *Channelsz {
+	resp, err := http.Get(fmt.Sprintf("http://%s%s%s", s.monitorListener.Addr(), ChannelszPath, query))
+	if err != nil {
+		stackFatalf(t, "Unexpected error on GET: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		stackFatalf(t, "Unexpected status: %v", resp.Status)
+	}
+	channelsz := &Channelsz{}
+	if err := json.NewDecoder(resp.Body).Decode(channelsz); err != nil {
+		stackFatalf(t, "Unexpected error decoding response: %v", err)
+	}
+	return channelsz
+}
+
+func TestChannelsz(t *testing.T) {
+	opts := GetDefaultOptions()
+	opts.MonitorListen = "localhost:0"
+	s := RunServerWithOpts(opts, nil)
+	defer s.Shutdown()
+
+	sc := NewDefaultConnection(t)
+	defer sc.Close()
+
+	total := 10
+	acked := make(chan struct{}, total)
+	if _, err := sc.Subscribe("foo", func(m *stan.Msg) {
+		m.Ack()
+		acked <- struct{}{}
+	}, stan.SetManualAckMode(), stan.DeliverAllAvailable()); err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+	for i := 0; i < total; i++ {
+		if err := sc.Publish("foo", []byte("hello")); err != nil {
+			t.Fatalf("Unexpected error on publish: %v", err)
+		}
+	}
+	if err := sc.Publish("bar", []byte("world")); err != nil {
+		t.Fatalf("Unexpected error on publish: %v", err)
+	}
+	for i := 0; i < total; i++ {
+		select {
+		case <-acked:
+		case <-time.After(5 * time.Second):
+			t.Fatal("Did not get our messages")
+		}
+	}
+	sub := checkSubs(t, s, clientName, 1)[0]
+	waitForCount(t, 0, func() (string, int) {
+		sub.RLock()
+		defer sub.RUnlock()
+		return "pending acks", len(sub.acksPending)
+	})
+
+	channelsz := getChannelsz(t, s, "")
+	if channelsz.ClusterID != clusterName || len(channelsz.Channels) != 2 {
+		t.Fatalf("Unexpected response: %+v", channelsz)
+	}
+	bar, foo := channelsz.Channels[0], channelsz.Channels[1]
+	if bar.Name != "bar" || bar.Msgs != 1 || bar.Subscriptions != 0 || bar.StoreLatency.Count != 1 ||
+		bar.DeliveryLag.Count != 0 || bar.AckLatency.Count != 0 {
+		t.Fatalf("Unexpected stats: %+v", bar)
+	}
+	if foo.Name != "foo" || foo.Msgs != total || foo.FirstSequence != 1 || foo.LastSequence != uint64(total) ||
+		foo.Subscriptions != 1 || foo.Created.IsZero() || foo.Created.After(time.Now()) {
+		t.Fatalf("Unexpected stats: %+v", foo)
+	}
+	for name, h := range map[string]*Histogram{"store": foo.StoreLatency, "delivery": foo.DeliveryLag, "ack": foo.AckLatency} {
+		if h.Count != int64(total) || h.Max <= 0 || h.P99 > h.Max {
+			t.Fatalf("Unexpected %s histogram: %+v", name, h)
+		}
+	}
+
+	channelsz = getChannelsz(t, s, "?channel=foo")
+	if len(channelsz.Channels) != 1 || channelsz.Channels[0].Name != "foo" {
+		t.Fatalf("Unexpected response: %+v", channelsz)
+	}
+	if channelsz = getChannelsz(t, s, "?channel=baz"); len(channelsz.Channels) != 0 {
+		t.Fatalf("Unexpected response: %+v", channelsz)
+	}
+}
+
+func TestSubszRedeliveries(t *testing.T) {
+	opts := GetDefaultOptions()
+	opts.MonitorListen = "localhost:0"
+	s := runServerWithOpts(t, opts, nil)
+	defer s.Shutdown()
+
+	sc, nc := createConnectionWithNatsOpts(t, clientName)
+	defer nc.Close()
+	defer sc.Close()
+
+	// Subscriber that never acks.
+	inbox := nats.NewInbox()
+	rawSub, err := nc.SubscribeSync(inbox)
+	if err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+	sendSubRequest(t, s, nc, &pb.SubscriptionRequest{
+		Subject:       "foo",
+		Inbox:         inbox,
+		AckWaitInSecs: 1,
+		StartPosition: pb.StartPosition_First,
+	})
+	if err := sc.Publish("foo", []byte("hello")); err != nil {
+		t.Fatalf("Unexpected error on publish: %v", err)
+	}
+	for i := 1; i <= 3; i++ {
+		rawMsg, err := rawSub.NextMsg(5 * time.Second)
+		if err != nil {
+			t.Fatalf("Did not get our message: %v", err)
+		}
+		m := &pb.MsgProto{}
+		if err := m.Unmarshal(rawMsg.Data); err != nil {
+			t.Fatalf("Error decoding message: %v", err)
+		}
+		ext := &spb.MsgExt{}
+		if err := ext.Unmarshal(rawMsg.Data); err != nil {
+			t.Fatalf("Error decoding message attributes: %v", err)
+		}
+		// The count is only set on redeliveries.
+		expected := uint32(i)
+		if i == 1 {
+			expected = 0
+		}
+		if m.Redelivered != (i > 1) || ext.DeliveryCount != expected {
+			t.Fatalf("Delivery %v: unexpected redelivered flag %v and delivery count %v",
+				i, m.Redelivered, ext.DeliveryCount)
+		}
+	}
+
+	resp, err := http.Get(fmt.Sprintf("http://%s%s?channel=foo", s.monitorListener.Addr(), SubszPath))
+	if err != nil {
+		t.Fatalf("Unexpected error on GET: %v", err)
+	}
+	defer resp.Body.Close()
+	subsz := &Subsz{}
+	if err := json.NewDecoder(resp.Body).Decode(subsz); err != nil {
+		t.Fatalf("Unexpected error decoding response: %v", err)
+	}
+	if len(subsz.Subscriptions) != 1 {
+		t.Fatalf("Expected 1 subscription, got %+v", subsz.Subscriptions)
+	}
+	sub := subsz.Subscriptions[0]
+	if sub.Channel != "foo" || sub.Inbox != inbox || sub.PendingCount != 1 || sub.Lag != 1 {
+		t.Fatalf("Unexpected subscription: %+v", sub)
+	}
+	// The message may have been redelivered again since.
+	if sub.Redeliveries < 2 || sub.MaxDeliveries != uint32(sub.Redeliveries)+1 {
+		t.Fatalf("Unexpected redeliveries: %+v", sub)
+	}
+}
+
+func TestRuntimez(t *testing.T) {
+	opts := GetDefaultOptions()
+	opts.MonitorListen = "localhost:0"
+	opts.RuntimeStatsInterval = 10 * time.Millisecond
+	s := runServerWithOpts(t, opts, nil)
+	defer s.Shutdown()
+
+	runtimez := &Runtimez{}
+	waitForCount(t, runtimeStatsSamples, func() (string, int) {
+		resp, err := http.Get(fmt.Sprintf("http://%s%s", s.monitorListener.Addr(), RuntimezPath))
+		if err != nil {
+			stackFatalf(t, "Unexpected error on GET: %v", err)
+		}
+		defer resp.Body.Close()
+		runtimez = &Runtimez{}
+		if err := json.NewDecoder(resp.Body).Decode(runtimez); err != nil {
+			stackFatalf(t, "Unexpected error decoding response: %v", err)
+		}
+		return "samples", len(runtimez.Samples)
+	})
+	for i, rs := range runtimez.Samples {
+		if rs.Goroutines == 0 || rs.HeapAlloc == 0 || rs.Sys == 0 {
+			t.Fatalf("Unexpected sample: %+v", rs)
+		}
+		if i > 0 && rs.Time.Before(runtimez.Samples[i-1].Time) {
+			t.Fatalf("Samples are not ordered: %v before %v", rs.Time, runtimez.Samples[i-1].Time)
+		}
+	}
+	// The profiling endpoints are disabled by default.
+	resp, err := http.Get(fmt.Sprintf("http://%s%s", s.monitorListener.Addr(), ProfilingPath))
+	if err != nil {
+		t.Fatalf("Unexpected error on GET: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("Expected profiling to be disabled, got %v", resp.Status)
+	}
+}
+
+func TestMonitorProfiling(t *testing.T) {
+	opts := GetDefaultOptions()
+	opts.MonitorListen = "localhost:0"
+	opts.MonitorProfiling = true
+	s := runServerWithOpts(t, opts, nil)
+	defer s.Shutdown()
+
+	for _, path := range []string{ProfilingPath, ProfilingPath + "goroutine?debug=1", ProfilingPath + "cmdline"} {
+		resp, err := http.Get(fmt.Sprintf("http://%s%s", s.monitorListener.Addr(), path))
+		if err != nil {
+			t.Fatalf("Unexpected error on GET %v: %v", path, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("Unexpected status for %v: %v", path, resp.Status)
+		}
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	opts := GetDefaultOptions()
+	opts.MonitorListen = "localhost:0"
+	s := runServerWithOpts(t, opts, nil)
+	defer s.Shutdown()
+
+	sc := NewDefaultConnection(t)
+	defer sc.Close()
+
+	// This subscription gets the first message and does not ack it.
+	received := make(chan struct{}, 10)
+	if _, err := sc.Subscribe("foo", func(_ *stan.Msg) { received <- struct{}{} },
+		stan.SetManualAckMode(), stan.MaxInflight(1), stan.DurableName("dur")); err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := sc.Publish("foo", []byte("hello")); err != nil {
+			t.Fatalf("Unexpected error on publish: %v", err)
+		}
+	}
+	select {
+	case <-received:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Did not get our message")
+	}
+
+	resp, err := http.Get(fmt.Sprintf("http://%s%s", s.monitorListener.Addr(), MetricsPath))
+	if err != nil {
+		t.Fatalf("Unexpected error on GET: %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("Unexpected error reading response: %v", err)
+	}
+	subLabels := fmt.Sprintf(`channel="foo",client_id="%s",inbox=`, clientName)
+	for _, expected := range []string{
+		"# TYPE stan_channel_msgs gauge\n",
+		`stan_channel_msgs{channel="foo"} 3` + "\n",
+		`stan_channel_bytes{channel="foo"} 15` + "\n",
+		`stan_channel_last_seq{channel="foo"} 3` + "\n",
+		"# TYPE stan_subscription_lag gauge\n",
+		"stan_subscription_pending{" + subLabels,
+		"stan_subscription_lag{" + subLabels,
+		`durable="dur",queue=""} 1` + "\n",
+		`durable="dur",queue=""} 3` + "\n",
+		"# TYPE stan_rejected_total counter\n",
+		`stan_rejected_total{code="max_channels"} 0` + "\n",
+	} {
+		if !strings.Contains(string(body), expected) {
+			t.Fatalf("Expected %q in metrics:\n%s", expected, body)
+		}
+	}
+}
@@ -0,0 +1,508 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats-streaming-server/spb"
+)
+
+// MQTT control packet types.
+const (
+	mqttConnect     = 1
+	mqttConnAck     = 2
+	mqttPublish     = 3
+	mqttPubAck      = 4
+	mqttPubRec      = 5
+	mqttPubRel      = 6
+	mqttPubComp     = 7
+	mqttSubscribe   = 8
+	mqttSubAck      = 9
+	mqttUnsubscribe = 10
+	mqttUnsubAck    = 11
+	mqttPingReq     = 12
+	mqttPingResp    = 13
+	mqttDisconnect  = 14
+)
+
+// MQTT CONNACK return codes.
+const (
+	mqttConnAccepted          = 0
+	mqttConnBadProtocol       = 1
+	mqttConnBadClientID       = 2
+	mqttConnBadUserOrPassword = 4
+)
+
+const (
+	// Maximum size of an MQTT packet, larger packets close the connection.
+	mqttMaxPacketSize = 1024 * 1024
+
+	// Time a client has to send its CONNECT packet.
+	mqttConnectTimeout = 10 * time.Second
+)
+
+var errMQTTProtocol = errors.New("protocol violation")
+
+// MQTTMapping maps the MQTT topics matching Topic, which may contain the
+// `+` and `#` wildcards, to a channel. Each `*` token of Channel is
+// replaced by the topic level matched by the corresponding `+`, and a
+// trailing `>` by the levels matched by `#`. For instance, with the topic
+// `devices/+/#` and the channel `telemetry.*.>`, messages published on
+// `devices/d42/temp/c` are stored in the channel `telemetry.d42.temp.c`.
+type MQTTMapping struct {
+	Topic   string `json:"topic"`
+	Channel string `json:"channel"`
+}
+
+// LoadMQTTMappingsFile reads the topic to channel mappings from a JSON file
+// containing an array of mappings, for instance:
+//
+//	[{"topic": "devices/+/telemetry", "channel": "telemetry.*"},
+//	 {"topic": "alerts/#", "channel": "alerts.>"}]
+func LoadMQTTMappingsFile(path string) ([]*MQTTMapping, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var mappings []*MQTTMapping
+	if err := json.Unmarshal(b, &mappings); err != nil {
+		return nil, fmt.Errorf("error parsing MQTT mappings file %q: %v", path, err)
+	}
+	if err := validateMQTTMappings(mappings); err != nil {
+		return nil, fmt.Errorf("error parsing MQTT mappings file %q: %v", path, err)
+	}
+	return mappings, nil
+}
+
+// validateMQTTMappings checks that the wildcards of the topic of each
+// mapping match the wildcards of its channel.
+func validateMQTTMappings(mappings []*MQTTMapping) error {
+	for _, m := range mappings {
+		levels := strings.Split(m.Topic, "/")
+		tokens := strings.Split(m.Channel, ".")
+		plus, stars := 0, 0
+		for i, l := range levels {
+			if l == "+" {
+				plus++
+			} else if l == "#" && i != len(levels)-1 || l != "#" && strings.ContainsAny(l, "+#") {
+				return fmt.Errorf("invalid MQTT topic %q", m.Topic)
+			}
+		}
+		for i, t := range tokens {
+			if t == "*" {
+				stars++
+			} else if t == "" || t == ">" && i != len(tokens)-1 || t != ">" && strings.ContainsAny(t, "*>") {
+				return fmt.Errorf("invalid channel %q for MQTT topic %q", m.Channel, m.Topic)
+			}
+		}
+		hasHash := levels[len(levels)-1] == "#"
+		hasGT := tokens[len(tokens)-1] == ">"
+		if plus != stars || hasHash != hasGT {
+			return fmt.Errorf("wildcards of channel %q don't match those of MQTT topic %q", m.Channel, m.Topic)
+		}
+	}
+	return nil
+}
+
+// channelForTopic returns the channel in which the messages published on
+// the MQTT topic are stored, or "" if there is none. Without mappings,
+// the topic levels become the channel tokens (`a/b` is stored in `a.b`).
+func (s *StanServer) channelForTopic(topic string) string {
+	levels := strings.Split(topic, "/")
+	for _, l := range levels {
+		if strings.ContainsAny(l, ".*> \t") {
+			return ""
+		}
+	}
+	if len(s.opts.MQTTMappings) == 0 {
+		channel := strings.Join(levels, ".")
+		if !isValidSubject(channel) {
+			return ""
+		}
+		return channel
+	}
+	for _, m := range s.opts.MQTTMappings {
+		if channel, ok := m.channel(levels); ok && isValidSubject(channel) {
+			return channel
+		}
+	}
+	return ""
+}
+
+// channel returns the channel for the topic levels, if the topic matches
+// the mapping.
+func (m *MQTTMapping) channel(levels []string) (string, bool) {
+	var matched []string
+	var rest []string
+	filter := strings.Split(m.Topic, "/")
+	for i, f := range filter {
+		if f == "#" {
+			rest = levels[i:]
+			break
+		}
+		if i >= len(levels) {
+			return "", false
+		}
+		if f == "+" {
+			matched = append(matched, levels[i])
+		} else if f != levels[i] {
+			return "", false
+		}
+		if i == len(filter)-1 && len(levels) != len(filter) {
+			return "", false
+		}
+	}
+	tokens := strings.Split(m.Channel, ".")
+	for i, t := range tokens {
+		if t == "*" {
+			tokens[i], matched = matched[0], matched[1:]
+		} else if t == ">" {
+			if len(rest) == 0 {
+				return "", false
+			}
+			tokens = append(tokens[:i], rest...)
+		}
+	}
+	return strings.Join(tokens, "."), true
+}
+
+// startMQTT starts accepting MQTT connections on the MQTTListen address.
+func (s *StanServer) startMQTT() error {
+	if s.opts.MQTTListen == "" {
+		return nil
+	}
+	l, err := net.Listen("tcp", s.opts.MQTTListen)
+	if err != nil {
+		return err
+	}
+	s.mqttListener = l
+	s.mqttConns = make(map[net.Conn]struct{})
+	Noticef("STAN: Listening for MQTT clients on %s", l.Addr())
+	s.mqttWg.Add(1)
+	go s.mqttAcceptLoop(l)
+	return nil
+}
+
+// stopMQTT stops accepting MQTT connections, closes the existing ones and
+// waits for their go routines to return.
+func (s *StanServer) stopMQTT() {
+	if s.mqttListener == nil {
+		return
+	}
+	s.mqttListener.Close()
+	s.mqttLock.Lock()
+	for c := range s.mqttConns {
+		c.Close()
+	}
+	s.mqttConns = nil
+	s.mqttLock.Unlock()
+	s.mqttWg.Wait()
+}
+
+func (s *StanServer) mqttAcceptLoop(l net.Listener) {
+	defer s.mqttWg.Done()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		s.mqttLock.Lock()
+		if s.mqttConns == nil {
+			s.mqttLock.Unlock()
+			conn.Close()
+			return
+		}
+		s.mqttConns[conn] = struct{}{}
+		s.mqttLock.Unlock()
+		s.mqttWg.Add(1)
+		go s.handleMQTTConn(conn)
+	}
+}
+
+// mqttConn is a connection from an MQTT client.
+type mqttConn struct {
+	conn      net.Conn
+	br        *bufio.Reader
+	clientID  string
+	keepAlive time.Duration
+	perms     *Permissions // nil if there are no users configured
+	// Packet identifiers of the QoS 2 messages stored but not released.
+	qos2 map[uint16]struct{}
+}
+
+func (s *StanServer) handleMQTTConn(conn net.Conn) {
+	defer s.mqttWg.Done()
+	defer func() {
+		conn.Close()
+		s.mqttLock.Lock()
+		if s.mqttConns != nil {
+			delete(s.mqttConns, conn)
+		}
+		s.mqttLock.Unlock()
+	}()
+	c := &mqttConn{conn: conn, br: bufio.NewReader(conn), clientID: "?", qos2: make(map[uint16]struct{})}
+	if err := s.mqttConnect(c); err != nil {
+		Errorf("MQTT: [Client:%s] Unable to accept connection from %s: %v", c.clientID, conn.RemoteAddr(), err)
+		return
+	}
+	Debugf("MQTT: [Client:%s] Connected from %s", c.clientID, conn.RemoteAddr())
+	for {
+		// The client must send a packet within one and a half times the
+		// keep alive interval.
+		if c.keepAlive > 0 {
+			conn.SetReadDeadline(time.Now().Add(c.keepAlive * 3 / 2))
+		}
+		ptype, flags, body, err := c.readPacket()
+		if err != nil {
+			if err != io.EOF {
+				Errorf("MQTT: [Client:%s] Closing connection: %v", c.clientID, err)
+			}
+			return
+		}
+		switch ptype {
+		case mqttPublish:
+			err = s.processMQTTPublish(c, flags, body)
+		case mqttPubRel:
+			if len(body) != 2 {
+				err = errMQTTProtocol
+				break
+			}
+			delete(c.qos2, binary.BigEndian.Uint16(body))
+			err = c.writePacket(mqttPubComp<<4, body)
+		case mqttSubscribe:
+			// Only publishing is supported, so every subscription fails.
+			err = c.replySubscribe(body)
+		case mqttUnsubscribe:
+			if len(body) < 2 {
+				err = errMQTTProtocol
+				break
+			}
+			err = c.writePacket(mqttUnsubAck<<4, body[:2])
+		case mqttPingReq:
+			err = c.writePacket(mqttPingResp<<4, nil)
+		case mqttDisconnect:
+			Debugf("MQTT: [Client:%s] Disconnected", c.clientID)
+			return
+		default:
+			err = errMQTTProtocol
+		}
+		if err != nil {
+			Errorf("MQTT: [Client:%s] Closing connection: %v", c.clientID, err)
+			return
+		}
+	}
+}
+
+// mqttConnect reads the CONNECT packet, authenticates the client if users
+// are configured, and sends the CONNACK packet.
+func (s *StanServer) mqttConnect(c *mqttConn) error {
+	c.conn.SetReadDeadline(time.Now().Add(mqttConnectTimeout))
+	ptype, _, body, err := c.readPacket()
+	if err != nil {
+		return err
+	}
+	if ptype != mqttConnect {
+		return errMQTTProtocol
+	}
+	r := &mqttReader{buf: body}
+	protocol := r.readString()
+	level := r.readByte()
+	flags := r.readByte()
+	c.keepAlive = time.Duration(r.readUint16()) * time.Second
+	c.clientID = r.readString()
+	if flags&0x04 != 0 {
+		// Will topic and message, not supported but must be read.
+		r.readString()
+		r.readString()
+	}
+	creds := &spb.ConnectRequestExt{}
+	if flags&0x80 != 0 {
+		creds.User = r.readString()
+	}
+	if flags&0x40 != 0 {
+		creds.Password = r.readString()
+	}
+	if r.err != nil {
+		return r.err
+	}
+	c.conn.SetReadDeadline(time.Time{})
+	if protocol != "MQTT" || level != 4 {
+		c.writePacket(mqttConnAck<<4, []byte{0, mqttConnBadProtocol})
+		return fmt.Errorf("unsupported protocol %q level %d", protocol, level)
+	}
+	if len(s.opts.Users) > 0 {
+		// Without a user name, the password is used as a token.
+		if creds.User == "" {
+			creds.Token, creds.Password = creds.Password, ""
+		}
+		u := s.authenticate(creds)
+		if u == nil {
+			c.writePacket(mqttConnAck<<4, []byte{0, mqttConnBadUserOrPassword})
+			return ErrAuthorization
+		}
+		if !s.isClientIDAllowed(u, c.clientID) {
+			c.writePacket(mqttConnAck<<4, []byte{0, mqttConnBadClientID})
+			return ErrClientIDBinding
+		}
+		c.perms = &u.Permissions
+	}
+	return c.writePacket(mqttConnAck<<4, []byte{0, mqttConnAccepted})
+}
+
+// processMQTTPublish stores the published message in the channel mapped
+// from its topic, and acknowledges it according to its QoS. Since MQTT
+// 3.1.1 has no negative acknowledgement, the connection is closed if the
+// message can't be stored, so that the client sends it again later.
+func (s *StanServer) processMQTTPublish(c *mqttConn, flags byte, body []byte) error {
+	qos := (flags >> 1) & 0x03
+	r := &mqttReader{buf: body}
+	topic := r.readString()
+	var id []byte
+	if qos > 0 {
+		id = r.readBytes(2)
+	}
+	if r.err != nil || qos > 2 {
+		return errMQTTProtocol
+	}
+	data := r.buf[r.pos:]
+	if qos == 2 {
+		// The message has already been stored, the client did not get
+		// our PUBREC.
+		if _, dup := c.qos2[binary.BigEndian.Uint16(id)]; dup {
+			return c.writePacket(mqttPubRec<<4, id)
+		}
+	}
+	channel := s.channelForTopic(topic)
+	if channel == "" {
+		return fmt.Errorf("no channel for topic %q", topic)
+	}
+	if _, err := s.storeGatewayMsg(c.clientID, c.perms, channel, data); err != nil {
+		return fmt.Errorf("unable to store message published on topic %q, subject=%s: %v", topic, channel, err)
+	}
+	switch qos {
+	case 1:
+		return c.writePacket(mqttPubAck<<4, id)
+	case 2:
+		c.qos2[binary.BigEndian.Uint16(id)] = struct{}{}
+		return c.writePacket(mqttPubRec<<4, id)
+	}
+	return nil
+}
+
+// replySubscribe sends a SUBACK packet with a failure for each topic
+// filter of the SUBSCRIBE packet.
+func (c *mqttConn) replySubscribe(body []byte) error {
+	r := &mqttReader{buf: body}
+	id := r.readBytes(2)
+	resp := append([]byte{}, id...)
+	for r.err == nil && r.pos < len(r.buf) {
+		r.readString()
+		r.readByte()
+		resp = append(resp, 0x80)
+	}
+	if r.err != nil || len(resp) == 2 {
+		return errMQTTProtocol
+	}
+	return c.writePacket(mqttSubAck<<4, resp)
+}
+
+// readPacket reads an MQTT control packet and returns its type, flags and
+// variable header plus payload.
+func (c *mqttConn) readPacket() (byte, byte, []byte, error) {
+	header, err := c.br.ReadByte()
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	// The remaining length is encoded on up to 4 bytes, 7 bits per byte.
+	size := 0
+	for i, shift := 0, uint(0); ; i, shift = i+1, shift+7 {
+		if i == 4 {
+			return 0, 0, nil, errMQTTProtocol
+		}
+		b, err := c.br.ReadByte()
+		if err != nil {
+			return 0, 0, nil, err
+		}
+		size |= int(b&0x7f) << shift
+		if b&0x80 == 0 {
+			break
+		}
+	}
+	if size > mqttMaxPacketSize {
+		return 0, 0, nil, fmt.Errorf("packet too big (%d bytes)", size)
+	}
+	body := make([]byte, size)
+	if _, err := io.ReadFull(c.br, body); err != nil {
+		return 0, 0, nil, err
+	}
+	return header >> 4, header & 0x0f, body, nil
+}
+
+// writePacket writes an MQTT control packet with the given fixed header
+// first byte and body.
+func (c *mqttConn) writePacket(header byte, body []byte) error {
+	buf := make([]byte, 0, 5+len(body))
+	buf = append(buf, header)
+	size := len(body)
+	for {
+		b := byte(size & 0x7f)
+		size >>= 7
+		if size > 0 {
+			b |= 0x80
+		}
+		buf = append(buf, b)
+		if size == 0 {
+			break
+		}
+	}
+	buf = append(buf, body...)
+	_, err := c.conn.Write(buf)
+	return err
+}
+
+// mqttReader decodes the fields of an MQTT packet. After an error, all
+// reads return zero values and the error is kept in `err`.
+type mqttReader struct {
+	buf []byte
+	pos int
+	err error
+}
+
+func (r *mqttReader) readBytes(n int) []byte {
+	if r.err != nil || r.pos+n > len(r.buf) {
+		r.err = errMQTTProtocol
+		return nil
+	}
+	b := r.buf[r.pos : r.pos+n]
+	r.pos += n
+	return b
+}
+
+func (r *mqttReader) readByte() byte {
+	if b := r.readBytes(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (r *mqttReader) readUint16() uint16 {
+	if b := r.readBytes(2); b != nil {
+		return binary.BigEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (r *mqttReader) readString() string {
+	n := r.readUint16()
+	return string(r.readBytes(int(n)))
+}
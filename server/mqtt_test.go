@@ -0,0 +1,255 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestLoadMQTTMappingsFile(t *testing.T) {
+	f, err := ioutil.TempFile("", "mqtt")
+	if err != nil {
+		t.Fatalf("Unable to create file: %v", err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(`[{"topic": "devices/+/telemetry", "channel": "telemetry.*"},
+		{"topic": "alerts/#", "channel": "alerts.>"}]`)
+	f.Close()
+
+	mappings, err := LoadMQTTMappingsFile(f.Name())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(mappings) != 2 || mappings[0].Topic != "devices/+/telemetry" || mappings[1].Channel != "alerts.>" {
+		t.Fatalf("Unexpected mappings: %v", mappings)
+	}
+
+	for _, content := range []string{
+		"not json",
+		`[{"topic": "devices/+", "channel": "devices"}]`,
+		`[{"topic": "devices/#", "channel": "devices.*"}]`,
+		`[{"topic": "devices/#/temp", "channel": "devices.>"}]`,
+		`[{"topic": "devices/a+", "channel": "devices.*"}]`,
+		`[{"topic": "devices/+", "channel": "devices..*"}]`,
+		`[{"topic": "devices/+", "channel": "devices.>.*"}]`,
+	} {
+		if err := ioutil.WriteFile(f.Name(), []byte(content), 0600); err != nil {
+			t.Fatalf("Unable to write file: %v", err)
+		}
+		if _, err := LoadMQTTMappingsFile(f.Name()); err == nil {
+			t.Fatalf("Expected error loading %q", content)
+		}
+	}
+}
+
+func TestMQTTChannelForTopic(t *testing.T) {
+	s := &StanServer{opts: GetDefaultOptions()}
+	for topic, expected := range map[string]string{
+		"foo":       "foo",
+		"foo/bar":   "foo.bar",
+		"foo/b.r":   "",
+		"foo//bar":  "",
+		"foo/b*r":   "",
+		"/foo":      "",
+		"foo/>/bar": "",
+	} {
+		if channel := s.channelForTopic(topic); channel != expected {
+			t.Fatalf("Expected channel %q for topic %q, got %q", expected, topic, channel)
+		}
+	}
+
+	s.opts.MQTTMappings = []*MQTTMapping{
+		{Topic: "devices/+/telemetry/+", Channel: "telemetry.*.*"},
+		{Topic: "devices/+/#", Channel: "devices.*.>"},
+		{Topic: "alerts/#", Channel: "alerts.>"},
+		{Topic: "status", Channel: "devices.status"},
+	}
+	for topic, expected := range map[string]string{
+		"devices/d1/telemetry/temp": "telemetry.d1.temp",
+		"devices/d1/telemetry":      "devices.d1.telemetry",
+		"devices/d1/a/b":            "devices.d1.a.b",
+		"devices/d1":                "",
+		"alerts/fire":               "alerts.fire",
+		"alerts":                    "",
+		"status":                    "devices.status",
+		"status/d1":                 "",
+		"other":                     "",
+	} {
+		if channel := s.channelForTopic(topic); channel != expected {
+			t.Fatalf("Expected channel %q for topic %q, got %q", expected, topic, channel)
+		}
+	}
+}
+
+// mqttTestClient connects to the MQTT listener of the server and sends
+// the CONNECT packet, returning the connection and the CONNACK return code.
+func mqttTestClient(t *testing.T, s *StanServer, user, password string) (*mqttConn, byte) {
+	conn, err := net.Dial("tcp", s.mqttListener.Addr().String())
+	if err != nil {
+		stackFatalf(t, "Unable to connect: %v", err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	c := &mqttConn{conn: conn, br: bufio.NewReader(conn)}
+	var flags byte
+	body := append(mqttTestString("MQTT"), 4, 0, 0, 0)
+	body = append(body, mqttTestString("device1")...)
+	if user != "" {
+		flags |= 0x80
+		body = append(body, mqttTestString(user)...)
+	}
+	if password != "" {
+		flags |= 0x40
+		body = append(body, mqttTestString(password)...)
+	}
+	body[7] = flags
+	if err := c.writePacket(mqttConnect<<4, body); err != nil {
+		stackFatalf(t, "Unable to send CONNECT: %v", err)
+	}
+	ptype, _, resp := mqttTestRead(t, c)
+	if ptype != mqttConnAck || len(resp) != 2 {
+		stackFatalf(t, "Unexpected CONNECT response: %v %v", ptype, resp)
+	}
+	return c, resp[1]
+}
+
+func mqttTestString(s string) []byte {
+	b := make([]byte, 2, 2+len(s))
+	binary.BigEndian.PutUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
+
+func mqttTestRead(t *testing.T, c *mqttConn) (byte, byte, []byte) {
+	ptype, flags, body, err := c.readPacket()
+	if err != nil {
+		stackFatalf(t, "Unable to read packet: %v", err)
+	}
+	return ptype, flags, body
+}
+
+func mqttTestPublish(t *testing.T, c *mqttConn, topic string, qos byte, id uint16, data string) {
+	body := mqttTestString(topic)
+	if qos > 0 {
+		body = append(body, byte(id>>8), byte(id))
+	}
+	body = append(body, data...)
+	if err := c.writePacket(mqttPublish<<4|qos<<1, body); err != nil {
+		stackFatalf(t, "Unable to send PUBLISH: %v", err)
+	}
+}
+
+func checkMQTTMsgs(t *testing.T, s *StanServer, channel string, expected ...string) {
+	cs := s.store.LookupChannel(channel)
+	if cs == nil {
+		stackFatalf(t, "Channel %s should have been created", channel)
+	}
+	if last := cs.Msgs.LastSequence(); last != uint64(len(expected)) {
+		stackFatalf(t, "Expected %d messages in %s, got %d", len(expected), channel, last)
+	}
+	for i, data := range expected {
+		if m, _ := cs.Msgs.Lookup(uint64(i + 1)); m == nil || string(m.Data) != data {
+			stackFatalf(t, "Expected message %q, got %v", data, m)
+		}
+	}
+}
+
+func TestMQTTPublish(t *testing.T) {
+	opts := GetDefaultOptions()
+	opts.MQTTListen = "localhost:0"
+	opts.MQTTMappings = []*MQTTMapping{{Topic: "devices/+/telemetry", Channel: "telemetry.*"}}
+	s := RunServerWithOpts(opts, nil)
+	defer s.Shutdown()
+
+	c, rc := mqttTestClient(t, s, "", "")
+	defer c.conn.Close()
+	if rc != mqttConnAccepted {
+		t.Fatalf("Unexpected return code: %v", rc)
+	}
+
+	// QoS 1, acknowledged with a PUBACK.
+	mqttTestPublish(t, c, "devices/d1/telemetry", 1, 1, "msg1")
+	if ptype, _, body := mqttTestRead(t, c); ptype != mqttPubAck || binary.BigEndian.Uint16(body) != 1 {
+		t.Fatalf("Unexpected response: %v %v", ptype, body)
+	}
+	// QoS 2, sent twice because the client did not get the PUBREC, must be
+	// stored once.
+	mqttTestPublish(t, c, "devices/d1/telemetry", 2, 2, "msg2")
+	mqttTestPublish(t, c, "devices/d1/telemetry", 2, 2, "msg2")
+	for i := 0; i < 2; i++ {
+		if ptype, _, body := mqttTestRead(t, c); ptype != mqttPubRec || binary.BigEndian.Uint16(body) != 2 {
+			t.Fatalf("Unexpected response: %v %v", ptype, body)
+		}
+	}
+	c.writePacket(mqttPubRel<<4|0x02, []byte{0, 2})
+	if ptype, _, body := mqttTestRead(t, c); ptype != mqttPubComp || binary.BigEndian.Uint16(body) != 2 {
+		t.Fatalf("Unexpected response: %v %v", ptype, body)
+	}
+	// QoS 0, no response, so send a PINGREQ to make sure it's processed.
+	mqttTestPublish(t, c, "devices/d1/telemetry", 0, 0, "msg3")
+	c.writePacket(mqttPingReq<<4, nil)
+	if ptype, _, _ := mqttTestRead(t, c); ptype != mqttPingResp {
+		t.Fatalf("Unexpected response: %v", ptype)
+	}
+	checkMQTTMsgs(t, s, "telemetry.d1", "msg1", "msg2", "msg3")
+
+	// Subscriptions are refused.
+	body := append([]byte{0, 3}, mqttTestString("devices/#")...)
+	c.writePacket(mqttSubscribe<<4|0x02, append(body, 1))
+	if ptype, _, body := mqttTestRead(t, c); ptype != mqttSubAck || len(body) != 3 || body[2] != 0x80 {
+		t.Fatalf("Unexpected response: %v %v", ptype, body)
+	}
+
+	// A topic without mapping closes the connection.
+	mqttTestPublish(t, c, "devices/d1/other", 1, 4, "msg4")
+	if _, _, _, err := c.readPacket(); err == nil {
+		t.Fatal("Expected connection to be closed")
+	}
+}
+
+func TestMQTTAuthorization(t *testing.T) {
+	opts := GetDefaultOptions()
+	opts.MQTTListen = "localhost:0"
+	opts.Users = []*User{
+		{Username: "alice", Password: "foo", Permissions: Permissions{Publish: []string{"alice.>"}}},
+		{Token: "s3cr3t", Permissions: Permissions{Publish: []string{">"}}},
+	}
+	s := RunServerWithOpts(opts, nil)
+	defer s.Shutdown()
+
+	for _, creds := range [][2]string{{"", ""}, {"alice", "bar"}, {"", "foo"}} {
+		c, rc := mqttTestClient(t, s, creds[0], creds[1])
+		c.conn.Close()
+		if rc != mqttConnBadUserOrPassword {
+			t.Fatalf("Expected connection with %v to be refused, got %v", creds, rc)
+		}
+	}
+
+	c, rc := mqttTestClient(t, s, "", "s3cr3t")
+	c.conn.Close()
+	if rc != mqttConnAccepted {
+		t.Fatalf("Unexpected return code: %v", rc)
+	}
+
+	c, rc = mqttTestClient(t, s, "alice", "foo")
+	defer c.conn.Close()
+	if rc != mqttConnAccepted {
+		t.Fatalf("Unexpected return code: %v", rc)
+	}
+	mqttTestPublish(t, c, "alice/foo", 1, 1, "msg1")
+	if ptype, _, _ := mqttTestRead(t, c); ptype != mqttPubAck {
+		t.Fatalf("Unexpected response: %v", ptype)
+	}
+	checkMQTTMsgs(t, s, "alice.foo", "msg1")
+	mqttTestPublish(t, c, "bob/foo", 1, 2, "msg2")
+	if _, _, _, err := c.readPacket(); err == nil {
+		t.Fatal("Expected connection to be closed")
+	}
+	if s.store.LookupChannel("bob.foo") != nil {
+		t.Fatal("Channel bob.foo should not have been created")
+	}
+}
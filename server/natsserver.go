@@ -0,0 +1,144 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/nats-io/gnatsd/server"
+	natsd "github.com/nats-io/gnatsd/test"
+)
+
+// Number of consecutive failed checks after which the embedded NATS Server
+// is considered dead.
+const natsMaxFailedChecks = 3
+
+// runNATSServer starts a NATS Server with the given options. The server
+// panics if it can't start, which is turned into an error.
+func runNATSServer(opts *server.Options, a server.Auth) (ns *server.Server, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			ns, err = nil, fmt.Errorf("%v", r)
+		}
+	}()
+	return natsd.RunServerWithAuth(opts, a), nil
+}
+
+// startNATSSupervision starts checking, if enabled, that the embedded NATS
+// Server accepts connections, every NATSCheckInterval.
+func (s *StanServer) startNATSSupervision() {
+	if s.natsServer == nil || s.opts.NATSCheckInterval <= 0 {
+		return
+	}
+	s.natsCheckQuit = make(chan struct{})
+	s.natsCheckWg.Add(1)
+	go s.superviseNATSServer(s.opts.NATSCheckInterval)
+}
+
+// stopNATSSupervision stops the checks and waits for them to return.
+func (s *StanServer) stopNATSSupervision() {
+	if s.natsCheckQuit == nil {
+		return
+	}
+	close(s.natsCheckQuit)
+	s.natsCheckWg.Wait()
+}
+
+// superviseNATSServer checks the embedded NATS Server every `interval`,
+// and logs the changes in its number of routes. After natsMaxFailedChecks
+// consecutive failed checks, the server is restarted, or the streaming
+// server is shut down, depending on the NATSFailurePolicy.
+func (s *StanServer) superviseNATSServer(interval time.Duration) {
+	defer s.natsCheckWg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	failed := 0
+	routes := s.numNATSRoutes()
+	for {
+		select {
+		case <-s.natsCheckQuit:
+			return
+		case <-ticker.C:
+		}
+		if s.isNATSServerAlive(interval) {
+			failed = 0
+			if n := s.numNATSRoutes(); n != routes {
+				Noticef("STAN: Embedded NATS Server has %d route(s), was %d", n, routes)
+				routes = n
+			}
+			continue
+		}
+		if failed++; failed < natsMaxFailedChecks {
+			continue
+		}
+		if s.opts.NATSFailurePolicy != NATSFailureRestart {
+			Errorf("STAN: Embedded NATS Server does not accept connections, shutting down")
+			// Shutdown waits for this routine to return.
+			go func() {
+				s.Shutdown()
+				Fatalf("STAN: Exiting since the embedded NATS Server is not running")
+			}()
+			return
+		}
+		Errorf("STAN: Embedded NATS Server does not accept connections, restarting it")
+		if err := s.restartNATSServer(); err != nil {
+			Errorf("STAN: Unable to restart the embedded NATS Server: %v", err)
+			continue
+		}
+		failed = 0
+		routes = s.numNATSRoutes()
+	}
+}
+
+// isNATSServerAlive returns true if the embedded NATS Server accepts
+// connections within the given timeout.
+func (s *StanServer) isNATSServerAlive(timeout time.Duration) bool {
+	addr := net.JoinHostPort(s.natsOpts.Host, strconv.Itoa(s.natsOpts.Port))
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+// numNATSRoutes returns the number of routes of the embedded NATS Server.
+func (s *StanServer) numNATSRoutes() int {
+	s.RLock()
+	ns := s.natsServer
+	s.RUnlock()
+	return ns.NumRoutes()
+}
+
+// restartNATSServer shuts down the embedded NATS Server and starts a new
+// one with the same options. The connection of the streaming server
+// reconnects to it on its own.
+func (s *StanServer) restartNATSServer() error {
+	s.RLock()
+	if s.shutdown {
+		s.RUnlock()
+		return nil
+	}
+	old := s.natsServer
+	s.RUnlock()
+	old.Shutdown()
+	ns, err := runNATSServer(s.natsOpts, s.natsAuth)
+	if err != nil {
+		return err
+	}
+	s.Lock()
+	if s.shutdown {
+		s.Unlock()
+		ns.Shutdown()
+		return nil
+	}
+	s.natsServer = ns
+	s.natsRestarts++
+	restarts := s.natsRestarts
+	s.Unlock()
+	Noticef("STAN: Embedded NATS Server restarted (%d restart(s) so far)", restarts)
+	return nil
+}
@@ -0,0 +1,14 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+//go:build !grpc
+// +build !grpc
+
+package server
+
+// grpcSupported is false: the server is built without the `grpc` tag.
+const grpcSupported = false
+
+// newGRPCService returns ErrNoGRPC: the gRPC API requires the `grpc` tag.
+func (s *StanServer) newGRPCService(auth bool) (grpcService, error) {
+	return nil, ErrNoGRPC
+}
@@ -0,0 +1,23 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+//go:build !grpc
+// +build !grpc
+
+package server
+
+import (
+	"testing"
+)
+
+func TestGRPCNotSupported(t *testing.T) {
+	opts := GetDefaultOptions()
+	opts.GRPCListen = "localhost:0"
+	if err := validateOptions(opts); err != ErrNoGRPC {
+		t.Fatalf("Expected error %v, got %v", ErrNoGRPC, err)
+	}
+	opts = GetDefaultOptions()
+	opts.Listeners = []*Listener{{Service: ListenerGRPC, Address: "localhost:0"}}
+	if err := validateOptions(opts); err != ErrNoGRPC {
+		t.Fatalf("Expected error %v, got %v", ErrNoGRPC, err)
+	}
+}
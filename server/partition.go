@@ -0,0 +1,126 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/nats-io/go-nats-streaming/pb"
+	"github.com/nats-io/nats-streaming-server/util"
+)
+
+// Maximum number of partitions of a channel.
+const maxChannelPartitions = 1024
+
+// ChannelPartitions declares the channels matching Channel, a channel or
+// a wildcard subject, as made of Partitions partitions. A message
+// published with a partition key belongs to the partition given by the
+// hash of its key, and each partition is delivered to a single member of
+// a queue group, so that the messages with the same key are processed in
+// order. The first matching entry applies.
+type ChannelPartitions struct {
+	Channel    string
+	Partitions int
+}
+
+// ParseChannelPartitions parses a comma separated list of
+// `channel=partitions`, for instance `orders.>=8,payments=4`.
+func ParseChannelPartitions(list string) ([]*ChannelPartitions, error) {
+	var parts []*ChannelPartitions
+	for _, p := range strings.Split(list, ",") {
+		if p = strings.TrimSpace(p); p == "" {
+			continue
+		}
+		i := strings.LastIndex(p, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("invalid channel partitions %q, expected channel=partitions", p)
+		}
+		cp := &ChannelPartitions{Channel: p[:i]}
+		n, err := strconv.Atoi(p[i+1:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid number of partitions in %q", p)
+		}
+		cp.Partitions = n
+		if err := validateChannelPartitions([]*ChannelPartitions{cp}); err != nil {
+			return nil, err
+		}
+		parts = append(parts, cp)
+	}
+	return parts, nil
+}
+
+// validateChannelPartitions checks the channels and numbers of partitions.
+func validateChannelPartitions(parts []*ChannelPartitions) error {
+	for _, p := range parts {
+		if !isValidSubject(p.Channel) && !isValidWildcardSubject(p.Channel) {
+			return fmt.Errorf("invalid channel %q in channel partitions", p.Channel)
+		}
+		if p.Partitions < 1 || p.Partitions > maxChannelPartitions {
+			return fmt.Errorf("invalid number of partitions %v for %q, must be between 1 and %v",
+				p.Partitions, p.Channel, maxChannelPartitions)
+		}
+	}
+	return nil
+}
+
+// channelPartitions returns the number of partitions of the channel, 0 if
+// it is not partitioned.
+func (s *StanServer) channelPartitions(channel string) int {
+	for _, p := range s.opts.PartitionedChannels {
+		if util.SubjectMatches(p.Channel, channel) {
+			return p.Partitions
+		}
+	}
+	return 0
+}
+
+// keyPartition returns the partition, among n, of a partition key.
+func keyPartition(key string, n int) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % uint32(n))
+}
+
+// msgPartition returns the partition of a message, or -1 if the channel
+// is not partitioned or the message has no partition key.
+func (s *StanServer) msgPartition(m *pb.MsgProto) int {
+	n := s.channelPartitions(m.Subject)
+	if n == 0 {
+		return -1
+	}
+	cs := s.store.LookupChannel(m.Subject)
+	if cs == nil {
+		return -1
+	}
+	ext := cs.Msgs.LookupExt(m.Sequence)
+	if ext == nil || ext.PartitionKey == "" {
+		return -1
+	}
+	return keyPartition(ext.PartitionKey, n)
+}
+
+// bySubID is used to sort the members of a queue group by subscription ID.
+type bySubID []*subState
+
+func (a bySubID) Len() int           { return len(a) }
+func (a bySubID) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a bySubID) Less(i, j int) bool { return a[i].ID < a[j].ID }
+
+// partitionOwner returns the member of the queue group to which the
+// partition is assigned. Partitions are assigned in turn to the members
+// ordered by subscription ID, so that the assignment only changes when
+// members join or leave the group.
+// Assumes qs lock held
+func partitionOwner(qs *queueState, partition int) *subState {
+	if len(qs.subs) == 0 {
+		return nil
+	}
+	members := make([]*subState, len(qs.subs))
+	copy(members, qs.subs)
+	sort.Sort(bySubID(members))
+	return members[partition%len(members)]
+}
@@ -0,0 +1,105 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/nats-io/go-nats-streaming"
+	"github.com/nats-io/nats-streaming-server/spb"
+)
+
+func TestParseChannelPartitions(t *testing.T) {
+	parts, err := ParseChannelPartitions("orders.>=8, payments=1,")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(parts) != 2 || *parts[0] != (ChannelPartitions{"orders.>", 8}) || *parts[1] != (ChannelPartitions{"payments", 1}) {
+		t.Fatalf("Unexpected partitions: %v", parts)
+	}
+	for _, invalid := range []string{"orders", "orders=x", "orders=0", "orders=1025", "foo..bar=2"} {
+		if _, err := ParseChannelPartitions(invalid); err == nil {
+			t.Fatalf("Expected error for %q", invalid)
+		}
+	}
+}
+
+func TestPartitionedChannels(t *testing.T) {
+	opts := GetDefaultOptions()
+	opts.PartitionedChannels = []*ChannelPartitions{{Channel: "foo", Partitions: 4}}
+	s := runServerWithOpts(t, opts, nil)
+	defer s.Shutdown()
+
+	sc, nc := createConnectionWithNatsOpts(t, clientName)
+	defer nc.Close()
+	defer sc.Close()
+
+	type delivery struct {
+		member int
+		msg    *stan.Msg
+	}
+	ch := make(chan delivery, 100)
+	var subs []stan.Subscription
+	for i := 0; i < 2; i++ {
+		member := i
+		sub, err := sc.QueueSubscribe("foo", "group", func(m *stan.Msg) {
+			ch <- delivery{member, m}
+		}, stan.MaxInflight(100))
+		if err != nil {
+			t.Fatalf("Unexpected error on subscribe: %v", err)
+		}
+		subs = append(subs, sub)
+	}
+	waitForNumSubs(t, s, clientName, 2)
+
+	publish := func(count int) {
+		for i := 0; i < count; i++ {
+			key := fmt.Sprintf("key%d", i%10)
+			if err := sendPubMsgWithExt(t, s, nc, "foo", []byte(key), &spb.MsgExt{PartitionKey: key}); err != nil {
+				stackFatalf(t, "Unexpected error on publish: %v", err)
+			}
+		}
+	}
+	// Checks that each keyed message is received by the owner of its
+	// partition, `owner` returning the member owning the partition.
+	check := func(count int, owner func(partition int) int) {
+		lastSeq := make(map[string]uint64)
+		for i := 0; i < count; i++ {
+			select {
+			case d := <-ch:
+				key := string(d.msg.Data)
+				if expected := owner(keyPartition(key, 4)); d.member != expected {
+					stackFatalf(t, "Expected key %q to be delivered to member %v, got %v", key, expected, d.member)
+				}
+				if d.msg.Sequence <= lastSeq[key] {
+					stackFatalf(t, "Key %q delivered out of order", key)
+				}
+				lastSeq[key] = d.msg.Sequence
+			case <-time.After(5 * time.Second):
+				stackFatalf(t, "Did not get our message")
+			}
+		}
+	}
+	publish(50)
+	check(50, func(p int) int { return p % 2 })
+
+	// Once the first member leaves, the second one owns all the partitions.
+	if err := subs[0].Unsubscribe(); err != nil {
+		t.Fatalf("Unexpected error on unsubscribe: %v", err)
+	}
+	waitForNumSubs(t, s, clientName, 1)
+	publish(20)
+	check(20, func(p int) int { return 1 })
+
+	// Messages without a key can go to any member.
+	if err := sc.Publish("foo", []byte("nokey")); err != nil {
+		t.Fatalf("Unexpected error on publish: %v", err)
+	}
+	select {
+	case <-ch:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Did not get our message")
+	}
+}
@@ -0,0 +1,160 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"math"
+
+	"github.com/nats-io/go-nats-streaming/pb"
+	"github.com/nats-io/nats-streaming-server/spb"
+	"github.com/nats-io/nats-streaming-server/stores"
+	"github.com/nats-io/nats-streaming-server/util"
+)
+
+const (
+	// Highest priority of a message. Higher priorities are lowered to it.
+	maxMsgPriority = 9
+
+	// Number of messages following the last one sent to a subscription
+	// among which the one with the highest priority is sent first. This
+	// bounds the cost of selecting each message.
+	priorityLookahead = 256
+
+	// Delivery time, in the scheduled map of a subscription, of the
+	// messages held back by the delivery of a message with a higher
+	// priority. They are sent by sendAvailablePriorityMessages(), not by
+	// the timer of the scheduled messages.
+	heldForPriority = math.MaxInt64
+)
+
+// isPriorityChannel returns true if the channel matches one of the
+// priority channels of the options.
+func (s *StanServer) isPriorityChannel(channel string) bool {
+	for _, pattern := range s.opts.PriorityChannels {
+		if util.SubjectMatches(pattern, channel) {
+			return true
+		}
+	}
+	return false
+}
+
+// msgPriority returns the priority of a message with the given attributes.
+func msgPriority(ext *spb.MsgExt) uint32 {
+	if ext == nil {
+		return 0
+	}
+	return ext.Priority
+}
+
+// sendAvailablePriorityMessages sends the messages that are ready to be
+// sent to a subscription on a priority channel, highest priority first.
+// Messages of the same priority are sent in sequence order.
+// Sub lock should be held before calling.
+func (s *StanServer) sendAvailablePriorityMessages(cs *stores.ChannelStore, sub *subState) {
+	for {
+		// Don't hold back messages for a message that can't be sent.
+		if sub.newOnHold || sub.Paused || s.isLameDuck() {
+			return
+		}
+		if sub.inFlightFull() {
+			sub.stalled = true
+			return
+		}
+		m := s.nextPriorityMsg(cs, sub)
+		if m == nil || !s.sendMsgToSub(sub, m, honorMaxInFlight) {
+			return
+		}
+	}
+}
+
+// nextPriorityMsg returns the message to send next to the subscription:
+// the one with the highest priority among the messages held back and the
+// messages following the last one sent, the oldest one if several have
+// this priority. The messages not sent yet that precede it are held back.
+// Sub lock should be held before calling.
+func (s *StanServer) nextPriorityMsg(cs *stores.ChannelStore, sub *subState) *pb.MsgProto {
+	var (
+		best     *pb.MsgProto
+		bestPrio uint32
+		removed  []uint64
+	)
+	for seq, deliverAt := range sub.scheduled {
+		if deliverAt != heldForPriority {
+			continue
+		}
+		m, err := cs.Msgs.Lookup(seq)
+		if err != nil {
+			Errorf("STAN: [Client:%s] Unable to read held message %v, subject=%s: %v", sub.ClientID, seq, sub.subject, err)
+			continue
+		}
+		if m == nil {
+			// The message has been removed from the store, forget about it.
+			delete(sub.scheduled, seq)
+			removed = append(removed, seq)
+			continue
+		}
+		prio := msgPriority(cs.Msgs.LookupExt(seq))
+		if best == nil || prio > bestPrio || (prio == bestPrio && seq < best.Sequence) {
+			best, bestPrio = m, prio
+		}
+	}
+	if len(removed) > 0 {
+		sub.store.AckSeqPendingBatch(sub.ID, removed...)
+	}
+	// The messages held back precede the ones not sent yet, so one of
+	// those is sent first only if its priority is strictly higher.
+	var ahead []*pb.MsgProto
+	bestAhead := -1
+	for m := nextAvailableMsg(cs, sub.subject, sub.LastSent); m != nil && len(ahead) < priorityLookahead; m = nextAvailableMsg(cs, sub.subject, m.Sequence) {
+		ahead = append(ahead, m)
+		ext := cs.Msgs.LookupExt(m.Sequence)
+		if sub.filter != nil && !sub.filter.match(m, ext) {
+			continue
+		}
+		if prio := msgPriority(ext); best == nil || prio > bestPrio {
+			best, bestPrio, bestAhead = m, prio, len(ahead)-1
+		}
+		if bestPrio == maxMsgPriority {
+			break
+		}
+	}
+	// Let sendMsgToSub() skip the messages not delivered to the subscription.
+	if best == nil && len(ahead) > 0 {
+		return ahead[0]
+	}
+	for i := 0; i < bestAhead; i++ {
+		if !s.holdMsgForPriority(sub, ahead[i], cs.Msgs.LookupExt(ahead[i].Sequence)) {
+			return nil
+		}
+	}
+	return best
+}
+
+// holdMsgForPriority holds back the message `m`, which precedes a message
+// with a higher priority. As a scheduled message, it is recorded as pending
+// for the subscription but does not count against MaxInFlight until it is
+// sent. Messages that would not be delivered to the subscription are only
+// skipped, and those not due yet are scheduled.
+// Sub lock should be held before calling.
+func (s *StanServer) holdMsgForPriority(sub *subState, m *pb.MsgProto, ext *spb.MsgExt) bool {
+	if (sub.filter != nil && !sub.filter.match(m, ext)) || sub.superseded(m.Sequence, ext) {
+		sub.LastSent = m.Sequence
+		return true
+	}
+	if ext != nil && ext.DeliverAt > s.clock.Now().UnixNano() {
+		return s.scheduleMsgForSub(sub, m, ext.DeliverAt)
+	}
+	if err := s.retryStoreWrite(func() error { return stores.AddSeqPendingBefore(sub.store, s.storeDeadline(), sub.ID, m.Sequence) }); err != nil {
+		Errorf("STAN: [Client:%s] Unable to update subscription for %s:%v (%v)",
+			sub.ClientID, m.Subject, m.Sequence, err)
+		return false
+	}
+	if sub.scheduled == nil {
+		sub.scheduled = make(map[uint64]int64)
+	}
+	sub.scheduled[m.Sequence] = heldForPriority
+	sub.LastSent = m.Sequence
+	Tracef("STAN: [Client:%s] Held msgseq %s:%d to %s for a higher priority message.",
+		sub.ClientID, m.Subject, m.Sequence, sub.Inbox)
+	return true
+}
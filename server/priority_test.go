@@ -0,0 +1,77 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nats-io/go-nats-streaming"
+	"github.com/nats-io/nats-streaming-server/spb"
+)
+
+func TestPriorityChannels(t *testing.T) {
+	opts := GetDefaultOptions()
+	opts.PriorityChannels = []string{"foo"}
+	s := runServerWithOpts(t, opts, nil)
+	defer s.Shutdown()
+
+	sc, nc := createConnectionWithNatsOpts(t, clientName)
+	defer nc.Close()
+	defer sc.Close()
+
+	publish := func(channel string, prio uint32) {
+		if err := sendPubMsgWithExt(t, s, nc, channel, []byte("hello"), &spb.MsgExt{Priority: prio}); err != nil {
+			stackFatalf(t, "Unexpected error on publish: %v", err)
+		}
+	}
+	checkOrder := func(ch chan *stan.Msg, expected ...uint64) {
+		for _, seq := range expected {
+			select {
+			case m := <-ch:
+				if m.Sequence != seq {
+					stackFatalf(t, "Expected sequence %v, got %v", seq, m.Sequence)
+				}
+				m.Ack()
+			case <-time.After(5 * time.Second):
+				stackFatalf(t, "Did not get our message")
+			}
+		}
+	}
+
+	for _, channel := range []string{"foo", "bar"} {
+		ch := make(chan *stan.Msg, 10)
+		if _, err := sc.Subscribe(channel, func(m *stan.Msg) { ch <- m },
+			stan.SetManualAckMode(), stan.MaxInflight(1), stan.AckWait(time.Minute)); err != nil {
+			t.Fatalf("Unexpected error on subscribe: %v", err)
+		}
+		// The first message is sent right away, the others wait for its ack.
+		publish(channel, 0)
+		time.Sleep(100 * time.Millisecond)
+		publish(channel, 0)
+		publish(channel, 0)
+		publish(channel, 5)
+		publish(channel, 5)
+		// Priorities above the maximum are lowered to it.
+		publish(channel, 12)
+		if channel == "foo" {
+			checkOrder(ch, 1, 6, 4, 5, 2, 3)
+		} else {
+			checkOrder(ch, 1, 2, 3, 4, 5, 6)
+		}
+	}
+	if ext := s.store.LookupChannel("foo").Msgs.LookupExt(6); ext == nil || ext.Priority != maxMsgPriority {
+		t.Fatalf("Unexpected attributes: %v", ext)
+	}
+
+	// The messages held back are recorded as pending, and no longer once
+	// they are acknowledged.
+	subs := s.clients.GetSubs(clientName)
+	for _, sub := range subs {
+		waitForCount(t, 0, func() (string, int) {
+			sub.RLock()
+			defer sub.RUnlock()
+			return "pending and held messages", len(sub.acksPending) + len(sub.scheduled)
+		})
+	}
+}
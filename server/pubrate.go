@@ -0,0 +1,158 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats-streaming-server/util"
+)
+
+// PublishRateLimit limits the rate at which a client, or all clients
+// together on a channel, can publish. ClientID is either a client ID or
+// `*` for each client not listed, Channel a channel or a wildcard subject
+// matching the limited channels. Each client and each channel has its own
+// token bucket, which can hold up to one second worth of messages and
+// bytes, allowing short bursts.
+type PublishRateLimit struct {
+	ClientID       string `json:"client_id,omitempty"`
+	Channel        string `json:"channel,omitempty"`
+	MaxMsgsPerSec  int64  `json:"max_msgs_per_sec,omitempty"`  // 0 if not limited
+	MaxBytesPerSec int64  `json:"max_bytes_per_sec,omitempty"` // 0 if not limited
+}
+
+// LoadPublishRateLimitsFile reads the publish rate limits from a JSON file
+// containing an array of limits, for instance:
+//
+//	[{"client_id": "*", "max_msgs_per_sec": 1000},
+//	 {"client_id": "importer", "max_msgs_per_sec": 10000, "max_bytes_per_sec": 10485760},
+//	 {"channel": "orders.>", "max_msgs_per_sec": 500}]
+func LoadPublishRateLimitsFile(path string) ([]*PublishRateLimit, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var limits []*PublishRateLimit
+	if err := json.Unmarshal(b, &limits); err != nil {
+		return nil, fmt.Errorf("error parsing publish rate limits file %q: %v", path, err)
+	}
+	if err := validatePublishRateLimits(limits); err != nil {
+		return nil, fmt.Errorf("error parsing publish rate limits file %q: %v", path, err)
+	}
+	return limits, nil
+}
+
+// validatePublishRateLimits checks that each limit applies to either a
+// client or a channel, and sets a rate.
+func validatePublishRateLimits(limits []*PublishRateLimit) error {
+	for _, l := range limits {
+		if (l.ClientID == "") == (l.Channel == "") {
+			return fmt.Errorf("publish rate limit must have either a client ID or a channel")
+		}
+		if l.Channel != "" && !isValidSubject(l.Channel) && !isValidWildcardSubject(l.Channel) {
+			return fmt.Errorf("invalid channel %q in publish rate limit", l.Channel)
+		}
+		if l.MaxMsgsPerSec < 0 || l.MaxBytesPerSec < 0 || (l.MaxMsgsPerSec == 0 && l.MaxBytesPerSec == 0) {
+			return fmt.Errorf("invalid rates in publish rate limit of %q", l.ClientID+l.Channel)
+		}
+	}
+	return nil
+}
+
+// pubRates holds the token buckets of the clients and channels whose
+// publish rate is limited.
+type pubRates struct {
+	sync.Mutex
+	limits   []*PublishRateLimit
+	clients  map[string]*rateLimiter
+	channels map[string]*rateLimiter
+}
+
+func newPubRates(limits []*PublishRateLimit) *pubRates {
+	if len(limits) == 0 {
+		return nil
+	}
+	return &pubRates{
+		limits:   limits,
+		clients:  make(map[string]*rateLimiter),
+		channels: make(map[string]*rateLimiter),
+	}
+}
+
+// clientLimit returns the limit of the client, the one of `*` if the
+// client is not listed, or nil.
+func (pr *pubRates) clientLimit(clientID string) *PublishRateLimit {
+	var any *PublishRateLimit
+	for _, l := range pr.limits {
+		if l.ClientID == clientID {
+			return l
+		} else if l.ClientID == "*" && any == nil {
+			any = l
+		}
+	}
+	return any
+}
+
+// channelLimit returns the first limit matching the channel, or nil.
+func (pr *pubRates) channelLimit(channel string) *PublishRateLimit {
+	for _, l := range pr.limits {
+		if l.Channel != "" && util.SubjectMatches(l.Channel, channel) {
+			return l
+		}
+	}
+	return nil
+}
+
+// limiter returns the token bucket keyed by `key` in `buckets`, created
+// from the limit if needed, or nil if there is no limit.
+func limiter(buckets map[string]*rateLimiter, key string, l *PublishRateLimit) *rateLimiter {
+	if l == nil {
+		return nil
+	}
+	rl := buckets[key]
+	if rl == nil {
+		rl = newRateLimiter(l.MaxMsgsPerSec, l.MaxBytesPerSec)
+		buckets[key] = rl
+	}
+	return rl
+}
+
+// checkPublishRate returns ErrPubRateLimit if publishing a message of the
+// given size would exceed the rate of the client or of the channel.
+// Otherwise, the message is accounted for in both rates.
+func (s *StanServer) checkPublishRate(clientID, channel string, size int) error {
+	pr := s.pubRates
+	if pr == nil {
+		return nil
+	}
+	pr.Lock()
+	defer pr.Unlock()
+	now := time.Now()
+	crl := limiter(pr.clients, clientID, pr.clientLimit(clientID))
+	chrl := limiter(pr.channels, channel, pr.channelLimit(channel))
+	// Check both before consuming, so that a message rejected because of
+	// one rate is not accounted for in the other.
+	if (crl != nil && crl.wait(size, now) > 0) || (chrl != nil && chrl.wait(size, now) > 0) {
+		return ErrPubRateLimit
+	}
+	if crl != nil {
+		crl.reserve(size, now)
+	}
+	if chrl != nil {
+		chrl.reserve(size, now)
+	}
+	return nil
+}
+
+// removeClientPublishRate forgets the token bucket of a closed client.
+func (s *StanServer) removeClientPublishRate(clientID string) {
+	if pr := s.pubRates; pr != nil {
+		pr.Lock()
+		delete(pr.clients, clientID)
+		pr.Unlock()
+	}
+}
@@ -0,0 +1,142 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/nats-io/go-nats-streaming"
+)
+
+func TestLoadPublishRateLimitsFile(t *testing.T) {
+	f, err := ioutil.TempFile("", "publish_limits")
+	if err != nil {
+		t.Fatalf("Unable to create file: %v", err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(`[{"client_id": "*", "max_msgs_per_sec": 1000},
+		{"channel": "orders.>", "max_msgs_per_sec": 500, "max_bytes_per_sec": 1024}]`)
+	f.Close()
+
+	limits, err := LoadPublishRateLimitsFile(f.Name())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(limits) != 2 || limits[0].ClientID != "*" || limits[0].MaxMsgsPerSec != 1000 ||
+		limits[1].Channel != "orders.>" || limits[1].MaxBytesPerSec != 1024 {
+		t.Fatalf("Unexpected limits: %v", limits)
+	}
+
+	for _, content := range []string{
+		"not json",
+		`[{"max_msgs_per_sec": 1000}]`,
+		`[{"client_id": "me", "channel": "foo", "max_msgs_per_sec": 1000}]`,
+		`[{"channel": "foo..bar", "max_msgs_per_sec": 1000}]`,
+		`[{"client_id": "me"}]`,
+		`[{"client_id": "me", "max_msgs_per_sec": -1}]`,
+	} {
+		if err := ioutil.WriteFile(f.Name(), []byte(content), 0600); err != nil {
+			t.Fatalf("Unable to write file: %v", err)
+		}
+		if _, err := LoadPublishRateLimitsFile(f.Name()); err == nil {
+			t.Fatalf("Expected error loading %q", content)
+		}
+	}
+}
+
+func TestPublishRateLimit(t *testing.T) {
+	opts := GetDefaultOptions()
+	opts.PublishRateLimits = []*PublishRateLimit{
+		{ClientID: "*", MaxMsgsPerSec: 3},
+		{ClientID: "otherClient", MaxMsgsPerSec: 100},
+		{Channel: "bar.*", MaxMsgsPerSec: 5},
+	}
+	s := RunServerWithOpts(opts, nil)
+	defer s.Shutdown()
+
+	sc := NewDefaultConnection(t)
+	defer sc.Close()
+	sc2, err := stan.Connect(clusterName, "otherClient")
+	if err != nil {
+		t.Fatalf("Unexpected error on connect: %v", err)
+	}
+	defer sc2.Close()
+
+	publish := func(sc stan.Conn, channel string, count int) {
+		for i := 0; i < count; i++ {
+			if err := sc.Publish(channel, []byte("hello")); err != nil {
+				stackFatalf(t, "Unexpected error on publish %v: %v", i+1, err)
+			}
+		}
+		if err := sc.Publish(channel, []byte("hello")); err == nil || err.Error() != ErrPubRateLimit.Error() {
+			stackFatalf(t, "Expected error %q, got %v", ErrPubRateLimit, err)
+		}
+	}
+	// Each client has its own rate.
+	publish(sc, "foo", 3)
+	// The rate of a channel applies to all clients together, and a message
+	// rejected because of the client's rate is not counted in the channel's.
+	publish(sc2, "bar.baz", 5)
+	publish(sc, "bar.bat", 0)
+	if err := sc2.Publish("bar.bat", []byte("hello")); err != nil {
+		t.Fatalf("Unexpected error on publish: %v", err)
+	}
+	cs := s.store.LookupChannel("bar.bat")
+	if n, _, _ := cs.Msgs.State(); n != 1 {
+		t.Fatalf("Expected 1 message, got %v", n)
+	}
+}
+
+func TestMaxPubInFlight(t *testing.T) {
+	for _, block := range []bool{false, true} {
+		opts := GetDefaultOptions()
+		opts.MaxPubInFlight = 1
+		opts.PubInFlightBlock = block
+		// Keep the first message in the IO channel for a while.
+		opts.IOSleepTime = int64(250 * time.Millisecond / time.Microsecond)
+		s := RunServerWithOpts(opts, nil)
+
+		sc := NewDefaultConnection(t)
+		errs := make(chan error, 2)
+		ah := func(_ string, err error) { errs <- err }
+		if _, err := sc.PublishAsync("foo", []byte("hello"), ah); err != nil {
+			t.Fatalf("Unexpected error on publish: %v", err)
+		}
+		time.Sleep(50 * time.Millisecond)
+		if _, err := sc.PublishAsync("foo", []byte("hello"), ah); err != nil {
+			t.Fatalf("Unexpected error on publish: %v", err)
+		}
+		for i := 0; i < 2; i++ {
+			select {
+			case err := <-errs:
+				// Without blocking, the second message is rejected, and
+				// its error is received first.
+				if !block && i == 0 {
+					if err == nil || err.Error() != ErrMaxPubInFlight.Error() {
+						t.Fatalf("Expected error %q, got %v", ErrMaxPubInFlight, err)
+					}
+				} else if err != nil {
+					t.Fatalf("Unexpected error on publish: %v", err)
+				}
+			case <-time.After(2 * time.Second):
+				t.Fatal("Did not get our publish ack")
+			}
+		}
+		// Once acknowledged, the client can publish again.
+		if err := sc.Publish("foo", []byte("hello")); err != nil {
+			t.Fatalf("Unexpected error on publish: %v", err)
+		}
+		expected := 2
+		if block {
+			expected = 3
+		}
+		if n, _, _ := s.store.LookupChannel("foo").Msgs.State(); n != expected {
+			t.Fatalf("Expected %v messages, got %v", expected, n)
+		}
+		sc.Close()
+		s.Shutdown()
+	}
+}
@@ -0,0 +1,93 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"time"
+)
+
+// rateLimiter limits the delivery rate of a subscription, or the publish
+// rate of a client or channel, in messages and/or bytes per second. It is
+// a token bucket that can hold up to one second worth of messages and
+// bytes, allowing short bursts.
+// It is not safe for concurrent use, the sub's lock protects it.
+type rateLimiter struct {
+	msgsPerSec  int64 // 0 if not limited
+	bytesPerSec int64 // 0 if not limited
+	msgTokens   float64
+	byteTokens  float64
+	last        time.Time
+}
+
+// newRateLimiter returns a rateLimiter for the given rates, or nil if
+// none of them is set.
+func newRateLimiter(msgsPerSec, bytesPerSec int64) *rateLimiter {
+	if msgsPerSec <= 0 && bytesPerSec <= 0 {
+		return nil
+	}
+	return &rateLimiter{
+		msgsPerSec:  msgsPerSec,
+		bytesPerSec: bytesPerSec,
+		msgTokens:   float64(msgsPerSec),
+		byteTokens:  float64(bytesPerSec),
+		last:        time.Now(),
+	}
+}
+
+// reserve consumes the tokens needed to send a message of the given size
+// and returns 0, or returns how long to wait before the message can be sent.
+// A message larger than the bytes rate is sent when the bucket is full.
+func (rl *rateLimiter) reserve(size int, now time.Time) time.Duration {
+	if wait := rl.wait(size, now); wait > 0 {
+		return wait
+	}
+	rl.msgTokens--
+	rl.byteTokens -= float64(size)
+	return 0
+}
+
+// wait returns how long to wait before a message of the given size can be
+// sent, without consuming tokens.
+func (rl *rateLimiter) wait(size int, now time.Time) time.Duration {
+	if elapsed := now.Sub(rl.last).Seconds(); elapsed > 0 {
+		rl.msgTokens = refill(rl.msgTokens, rl.msgsPerSec, elapsed)
+		rl.byteTokens = refill(rl.byteTokens, rl.bytesPerSec, elapsed)
+		rl.last = now
+	}
+	wait := time.Duration(0)
+	if rl.msgsPerSec > 0 && rl.msgTokens < 1 {
+		wait = tokensWait(1-rl.msgTokens, rl.msgsPerSec)
+	}
+	if rl.bytesPerSec > 0 {
+		needed := float64(size)
+		if needed > float64(rl.bytesPerSec) {
+			needed = float64(rl.bytesPerSec)
+		}
+		if rl.byteTokens < needed {
+			if w := tokensWait(needed-rl.byteTokens, rl.bytesPerSec); w > wait {
+				wait = w
+			}
+		}
+	}
+	return wait
+}
+
+// refill returns the number of tokens after `elapsed` seconds, capped
+// to one second worth of tokens.
+func refill(tokens float64, rate int64, elapsed float64) float64 {
+	tokens += elapsed * float64(rate)
+	if tokens > float64(rate) {
+		tokens = float64(rate)
+	}
+	return tokens
+}
+
+// tokensWait returns how long it takes to get the missing tokens, rounded
+// up to the millisecond.
+func tokensWait(missing float64, rate int64) time.Duration {
+	wait := time.Duration(missing / float64(rate) * float64(time.Second))
+	if r := wait % time.Millisecond; r != 0 {
+		wait += time.Millisecond - r
+	}
+	return wait
+}
@@ -0,0 +1,67 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	if rl := newRateLimiter(0, 0); rl != nil {
+		t.Fatalf("Expected no rate limiter, got %v", rl)
+	}
+
+	now := time.Now()
+	rl := newRateLimiter(10, 0)
+	rl.last = now
+	// The bucket allows a burst of one second worth of messages.
+	for i := 0; i < 10; i++ {
+		if wait := rl.reserve(100, now); wait != 0 {
+			t.Fatalf("Expected message %v to be sent, got wait=%v", i+1, wait)
+		}
+	}
+	if wait := rl.reserve(100, now); wait != 100*time.Millisecond {
+		t.Fatalf("Expected wait of 100ms, got %v", wait)
+	}
+	now = now.Add(50 * time.Millisecond)
+	if wait := rl.reserve(100, now); wait != 50*time.Millisecond {
+		t.Fatalf("Expected wait of 50ms, got %v", wait)
+	}
+	now = now.Add(50 * time.Millisecond)
+	if wait := rl.reserve(100, now); wait != 0 {
+		t.Fatalf("Expected message to be sent, got wait=%v", wait)
+	}
+
+	rl = newRateLimiter(0, 1000)
+	rl.last = now
+	if wait := rl.reserve(600, now); wait != 0 {
+		t.Fatalf("Expected message to be sent, got wait=%v", wait)
+	}
+	if wait := rl.reserve(600, now); wait != 200*time.Millisecond {
+		t.Fatalf("Expected wait of 200ms, got %v", wait)
+	}
+	// A message bigger than the rate is sent once the bucket is full.
+	if wait := rl.reserve(5000, now); wait != 600*time.Millisecond {
+		t.Fatalf("Expected wait of 600ms, got %v", wait)
+	}
+	now = now.Add(600 * time.Millisecond)
+	if wait := rl.reserve(5000, now); wait != 0 {
+		t.Fatalf("Expected message to be sent, got wait=%v", wait)
+	}
+	// Which leaves the bucket in debt.
+	now = now.Add(time.Second)
+	if wait := rl.reserve(100, now); wait != 3100*time.Millisecond {
+		t.Fatalf("Expected wait of 3.1s, got %v", wait)
+	}
+
+	// Both limits apply.
+	rl = newRateLimiter(1, 1000)
+	rl.last = now
+	if wait := rl.reserve(10, now); wait != 0 {
+		t.Fatalf("Expected message to be sent, got wait=%v", wait)
+	}
+	if wait := rl.reserve(10, now); wait != time.Second {
+		t.Fatalf("Expected wait of 1s, got %v", wait)
+	}
+}
@@ -0,0 +1,237 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// jsonSchema is the subset of JSON Schema (draft 4) supported by the
+// payload validators: the type, enum, numeric and length bounds, pattern,
+// properties, required, additionalProperties and items keywords. The other
+// keywords are ignored.
+type jsonSchema struct {
+	Type                 json.RawMessage        `json:"type"`
+	Enum                 []interface{}          `json:"enum"`
+	Minimum              *float64               `json:"minimum"`
+	Maximum              *float64               `json:"maximum"`
+	MinLength            *int                   `json:"minLength"`
+	MaxLength            *int                   `json:"maxLength"`
+	Pattern              string                 `json:"pattern"`
+	Properties           map[string]*jsonSchema `json:"properties"`
+	Required             []string               `json:"required"`
+	AdditionalProperties json.RawMessage        `json:"additionalProperties"`
+	Items                *jsonSchema            `json:"items"`
+	MinItems             *int                   `json:"minItems"`
+	MaxItems             *int                   `json:"maxItems"`
+
+	types        []string       // from Type
+	pattern      *regexp.Regexp // from Pattern
+	additional   *jsonSchema    // from AdditionalProperties, if a schema
+	noAdditional bool           // from AdditionalProperties, if false
+}
+
+// schemaValidator validates that the payloads are JSON documents matching
+// a JSON Schema.
+type schemaValidator struct {
+	schema *jsonSchema
+}
+
+// loadSchemaValidator reads the JSON Schema file and returns its validator.
+func loadSchemaValidator(path string) (*schemaValidator, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	schema := &jsonSchema{}
+	if err := json.Unmarshal(b, schema); err != nil {
+		return nil, fmt.Errorf("error parsing schema file %q: %v", path, err)
+	}
+	if err := schema.compile(); err != nil {
+		return nil, fmt.Errorf("error parsing schema file %q: %v", path, err)
+	}
+	return &schemaValidator{schema: schema}, nil
+}
+
+// Validate implements the PayloadValidator interface.
+func (sv *schemaValidator) Validate(channel string, data []byte) error {
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return fmt.Errorf("not a JSON document: %v", err)
+	}
+	return sv.schema.validate(v, "$")
+}
+
+// compile checks the keywords of the schema and its subschemas, and
+// converts those that can have several forms.
+func (js *jsonSchema) compile() error {
+	if len(js.Type) > 0 {
+		var t string
+		if err := json.Unmarshal(js.Type, &t); err == nil {
+			js.types = []string{t}
+		} else if err := json.Unmarshal(js.Type, &js.types); err != nil {
+			return fmt.Errorf("invalid type %s", js.Type)
+		}
+		for _, t := range js.types {
+			switch t {
+			case "object", "array", "string", "number", "integer", "boolean", "null":
+			default:
+				return fmt.Errorf("invalid type %q", t)
+			}
+		}
+	}
+	if js.Pattern != "" {
+		re, err := regexp.Compile(js.Pattern)
+		if err != nil {
+			return fmt.Errorf("invalid pattern %q: %v", js.Pattern, err)
+		}
+		js.pattern = re
+	}
+	if len(js.AdditionalProperties) > 0 {
+		var allowed bool
+		if err := json.Unmarshal(js.AdditionalProperties, &allowed); err == nil {
+			js.noAdditional = !allowed
+		} else {
+			js.additional = &jsonSchema{}
+			if err := json.Unmarshal(js.AdditionalProperties, js.additional); err != nil {
+				return fmt.Errorf("invalid additionalProperties: %v", err)
+			}
+			if err := js.additional.compile(); err != nil {
+				return err
+			}
+		}
+	}
+	for name, prop := range js.Properties {
+		if prop == nil {
+			return fmt.Errorf("invalid schema of property %q", name)
+		}
+		if err := prop.compile(); err != nil {
+			return err
+		}
+	}
+	if js.Items != nil {
+		return js.Items.compile()
+	}
+	return nil
+}
+
+// validate returns an error describing the first mismatch between the
+// value and the schema. `path` locates the value in the document.
+func (js *jsonSchema) validate(v interface{}, path string) error {
+	if len(js.types) > 0 && !js.hasType(v) {
+		return fmt.Errorf("%s: expected %s, got %s", path, strings.Join(js.types, " or "), jsonType(v))
+	}
+	if len(js.Enum) > 0 {
+		found := false
+		for _, e := range js.Enum {
+			if reflect.DeepEqual(e, v) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("%s: value not in enum", path)
+		}
+	}
+	switch v := v.(type) {
+	case float64:
+		if js.Minimum != nil && v < *js.Minimum {
+			return fmt.Errorf("%s: %v is less than %v", path, v, *js.Minimum)
+		}
+		if js.Maximum != nil && v > *js.Maximum {
+			return fmt.Errorf("%s: %v is greater than %v", path, v, *js.Maximum)
+		}
+	case string:
+		n := utf8.RuneCountInString(v)
+		if js.MinLength != nil && n < *js.MinLength {
+			return fmt.Errorf("%s: shorter than %d characters", path, *js.MinLength)
+		}
+		if js.MaxLength != nil && n > *js.MaxLength {
+			return fmt.Errorf("%s: longer than %d characters", path, *js.MaxLength)
+		}
+		if js.pattern != nil && !js.pattern.MatchString(v) {
+			return fmt.Errorf("%s: does not match %q", path, js.Pattern)
+		}
+	case []interface{}:
+		if js.MinItems != nil && len(v) < *js.MinItems {
+			return fmt.Errorf("%s: fewer than %d items", path, *js.MinItems)
+		}
+		if js.MaxItems != nil && len(v) > *js.MaxItems {
+			return fmt.Errorf("%s: more than %d items", path, *js.MaxItems)
+		}
+		if js.Items != nil {
+			for i, item := range v {
+				if err := js.Items.validate(item, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+					return err
+				}
+			}
+		}
+	case map[string]interface{}:
+		for _, name := range js.Required {
+			if _, ok := v[name]; !ok {
+				return fmt.Errorf("%s: missing property %q", path, name)
+			}
+		}
+		// Sorted, so that the same document always reports the same error.
+		names := make([]string, 0, len(v))
+		for name := range v {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			prop := js.Properties[name]
+			if prop == nil {
+				if js.noAdditional {
+					return fmt.Errorf("%s: unexpected property %q", path, name)
+				}
+				prop = js.additional
+			}
+			if prop != nil {
+				if err := prop.validate(v[name], path+"."+name); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// hasType returns true if the value is of one of the types of the schema.
+func (js *jsonSchema) hasType(v interface{}) bool {
+	t := jsonType(v)
+	for _, expected := range js.types {
+		if expected == t || (expected == "number" && t == "integer") {
+			return true
+		}
+	}
+	return false
+}
+
+// jsonType returns the JSON Schema type of a decoded JSON value, integer
+// for the numbers without a fractional part.
+func jsonType(v interface{}) string {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		return "object"
+	case []interface{}:
+		return "array"
+	case string:
+		return "string"
+	case float64:
+		if v == math.Trunc(v) {
+			return "integer"
+		}
+		return "number"
+	case bool:
+		return "boolean"
+	}
+	return "null"
+}
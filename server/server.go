@@ -6,6 +6,7 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"net/http"
 	"net/url"
 	"sort"
 	"strings"
@@ -20,8 +21,6 @@ import (
 	"github.com/nats-io/nats-streaming-server/spb"
 	"github.com/nats-io/nuid"
 
-	natsd "github.com/nats-io/gnatsd/test"
-
 	stores "github.com/nats-io/nats-streaming-server/stores"
 
 	"regexp"
@@ -41,6 +40,15 @@ const (
 	DefaultSubPrefix      = "_STAN.sub"
 	DefaultUnSubPrefix    = "_STAN.unsub"
 	DefaultClosePrefix    = "_STAN.close"
+	DefaultAdminPrefix    = "_STAN.admin"
+	DefaultPausePrefix    = "_STAN.pause"
+	DefaultLastPrefix     = "_STAN.last"
+	DefaultFetchPrefix    = "_STAN.fetch"
+	DefaultSeqTimePrefix  = "_STAN.seqtime"
+	DefaultHWMPrefix      = "_STAN.hwm"
+	DefaultBatchPrefix    = "_STAN.batch"
+	DefaultTxPrefix       = "_STAN.tx"
+	DefaultAdvisoryPrefix = "_STAN.advisory"
 	DefaultStoreType      = stores.TypeMemory
 
 	// DefaultChannelLimit defines how many channels (literal subjects) we allow
@@ -57,12 +65,29 @@ const (
 	DefaultClientHBTimeout     = 10 * time.Second
 	DefaultMaxFailedHeartBeats = int((5 * time.Minute) / DefaultHeartBeatInterval)
 
+	// DefaultDupClientIDTimeout is how long the known client has to answer
+	// a heartbeat when processing a connection request for a duplicate
+	// client ID.
+	DefaultDupClientIDTimeout = 500 * time.Millisecond
+
+	// Minimum interval between two updates of the persisted last contact
+	// of a client answering heartbeats.
+	clientLastContactInterval = time.Minute
+
 	// Max number of outstanding go-routines handling connect requests for
 	// duplicate client IDs.
 	defaultMaxDupCIDRoutines = 100
-	// Timeout used to ping the known client when processing a connection
-	// request for a duplicate client ID.
-	defaultCheckDupCIDTimeout = 500 * time.Millisecond
+
+	// Maximum number of messages returned by a fetch request.
+	maxFetchMsgs = 1000
+
+	// Maximum number of messages of a batch publish request, or of all
+	// channels of a transactional publish request.
+	maxBatchMsgs = 1000
+
+	// Minimum interval between two checks of the total size of the
+	// stored messages against the watermarks.
+	defaultStorageCheckInterval = time.Second
 
 	// Number of times the redelivery callback is allowed to stall, because
 	// the susbcriber hit the MaxInFlight limit, before forcing redelivery.
@@ -74,6 +99,71 @@ const (
 	// DefaultIOSleepTime is the duration (in micro-seconds) the server waits for more messages
 	// before starting processing. Set to 0 (or negative) to disable the wait.
 	DefaultIOSleepTime = int64(0)
+
+	// DefaultLameDuckTimeout is how long the server waits, in lame duck mode,
+	// for the messages in flight to be acknowledged before shutting down.
+	DefaultLameDuckTimeout = 30 * time.Second
+
+	// DefaultRuntimeStatsInterval is the interval at which the runtime
+	// statistics served by the monitoring endpoints are sampled.
+	DefaultRuntimeStatsInterval = 10 * time.Second
+
+	// DefaultArchiveInterval is the interval at which the messages of the
+	// archive channels are exported, when archiving is enabled.
+	DefaultArchiveInterval = time.Hour
+
+	// DefaultServiceName is the name under which the server is installed
+	// as a Windows service.
+	DefaultServiceName = "nats-streaming-server"
+
+	// MemoryBudgetReject is the policy rejecting the messages published
+	// while the memory budget is exceeded.
+	MemoryBudgetReject = "reject"
+	// MemoryBudgetTrim is the policy removing the oldest messages of a
+	// channel, when a message is stored on it, while the memory budget is
+	// exceeded.
+	MemoryBudgetTrim = "trim"
+
+	// DupClientIDReject is the policy rejecting a client connecting with
+	// the ID of a registered client.
+	DupClientIDReject = "reject"
+	// DupClientIDVerify is the policy replacing the registered client only
+	// if it does not answer a heartbeat within the DupClientIDTimeout.
+	DupClientIDVerify = "verify"
+	// DupClientIDReplace is the policy replacing the registered client
+	// right away.
+	DupClientIDReplace = "replace"
+
+	// NATSFailureExit is the policy shutting down the streaming server, and
+	// exiting, when the embedded NATS Server stops accepting connections.
+	NATSFailureExit = "exit"
+	// NATSFailureRestart is the policy restarting the embedded NATS Server
+	// when it stops accepting connections.
+	NATSFailureRestart = "restart"
+
+	// StoreErrorReport is the policy reporting the write errors of the
+	// store, in the logs and the readiness, and carrying on.
+	StoreErrorReport = "report"
+	// StoreErrorReadOnly is the policy rejecting the published messages
+	// after a write error of the store, until the server is restarted.
+	// Existing subscriptions are still served.
+	StoreErrorReadOnly = "readonly"
+	// StoreErrorRetry is the policy retrying the failed writes of the
+	// store, with an exponential backoff, before reporting the error.
+	StoreErrorRetry = "retry"
+	// StoreErrorPanic is the policy making the server panic on a write
+	// error of the store.
+	StoreErrorPanic = "panic"
+
+	// DefaultStoreErrorRetries is the number of times a failed write of the
+	// store is retried with the StoreErrorRetry policy.
+	DefaultStoreErrorRetries = 5
+	// DefaultStoreErrorBackoff is the delay before retrying a failed write
+	// of the store, doubled after each attempt, with StoreErrorRetry.
+	DefaultStoreErrorBackoff = 100 * time.Millisecond
+
+	// Interval at which pending acknowledgements are checked in lame duck mode.
+	lameDuckCheckInterval = 100 * time.Millisecond
 )
 
 // Constant to indicate that sendMsgToSub() should check number of acks pending
@@ -104,6 +194,60 @@ var (
 	ErrDupDurable      = errors.New("stan: duplicate durable registration")
 	ErrDurableQueue    = errors.New("stan: queue subscribers can't be durable")
 	ErrUnknownClient   = errors.New("stan: unkwown clientID")
+	ErrInvalidFilter   = errors.New("stan: invalid subscription filter")
+	ErrFilterQueue     = errors.New("stan: queue subscribers can't have a filter")
+	ErrDurableWildcard = errors.New("stan: wildcard subscribers can't be durable")
+	ErrQueueWildcard   = errors.New("stan: wildcard subscribers can't be queue subscribers")
+	ErrInvalidAdminReq = errors.New("stan: invalid administrative request")
+	ErrUnknownChannel  = errors.New("stan: unknown channel")
+	ErrUnknownDurable  = errors.New("stan: unknown durable subscription")
+	ErrDurableActive   = errors.New("stan: durable subscription is active")
+	ErrInvalidPauseReq = errors.New("stan: invalid pause request")
+	ErrPauseQueue      = errors.New("stan: queue subscribers can't be paused")
+	ErrInvalidLastReq  = errors.New("stan: invalid last value request")
+	ErrInvalidFetchReq = errors.New("stan: invalid fetch request")
+	ErrInvalidTimeReq  = errors.New("stan: invalid sequence at time request")
+	ErrInvalidHWMReq   = errors.New("stan: invalid high-water mark request")
+	ErrInvalidBatchReq = errors.New("stan: invalid batch publish request")
+	ErrInvalidTxReq    = errors.New("stan: invalid transactional publish request")
+	ErrChannelExists   = errors.New("stan: channel already exists")
+	ErrInvalidChannel  = errors.New("stan: invalid channel name")
+	ErrReservedChannel = errors.New("stan: channel is reserved")
+	ErrInvalidRate     = errors.New("stan: invalid delivery rate")
+	ErrRateQueue       = errors.New("stan: queue subscribers can't be rate limited")
+	ErrDedupQueue      = errors.New("stan: queue subscribers can't suppress redeliveries")
+	ErrSnapshotQueue   = errors.New("stan: queue subscribers can't start with a snapshot")
+	ErrInvalidWorkers  = errors.New("stan: invalid number of workers")
+	ErrRecoveredFilter = errors.New("stan: invalid filter recovered, the subscription must be resumed with a new filter or none")
+	ErrWorkersQueue    = errors.New("stan: queue subscribers can't have workers")
+	ErrTLSCertRequired = errors.New("stan: TLS requires a server certificate and key")
+	ErrAuthorization   = errors.New("stan: authorization violation")
+	ErrClientIDBinding = errors.New("stan: client ID not allowed for this user")
+	ErrLameDuck        = errors.New("stan: server is in lame duck mode")
+	ErrPubPermission   = errors.New("stan: not allowed to publish on this channel")
+	ErrSubPermission   = errors.New("stan: not allowed to subscribe on this subject")
+	ErrAdminPermission = errors.New("stan: not allowed to send administrative requests")
+	ErrInvalidSession  = errors.New("stan: invalid session for this client")
+	ErrDeliverSubject  = errors.New("stan: invalid delivery subject")
+	ErrDeliverPerm     = errors.New("stan: not allowed to deliver to this subject")
+	ErrStorageFull     = errors.New("stan: storage full")
+	ErrMirrorChannel   = errors.New("stan: channel is a mirror, publish to its source instead")
+	ErrPubRateLimit    = errors.New("stan: publish rate limit exceeded")
+	ErrTooManyClients  = errors.New("stan: too many clients")
+	ErrMaxClientSubs   = errors.New("stan: too many subscriptions for this client")
+	ErrMaxClientChans  = errors.New("stan: too many channels created by this client")
+	ErrMaxQueueMembers = errors.New("stan: too many members in this queue group")
+	ErrAckWaitBounds   = errors.New("stan: ack wait out of the allowed range")
+	ErrInFlightBounds  = errors.New("stan: max in flight out of the allowed range")
+	ErrMaxPubInFlight  = errors.New("stan: too many published messages in flight for this client")
+	ErrNoService       = errors.New("stan: services are only supported on Windows")
+	ErrNoGRPC          = errors.New("stan: gRPC API requires a server built with the grpc tag")
+	ErrMemoryBudget    = errors.New("stan: memory budget exceeded")
+	ErrReadOnly        = errors.New("stan: server is read-only after a store error")
+	ErrInvalidPayload  = errors.New("stan: invalid payload")
+	ErrValidatorDown   = errors.New("stan: payload validator unavailable")
+	ErrMaxChannels     = errors.New("stan: too many channels [" + ErrCodeMaxChannels + "]")
+	ErrMaxSubs         = errors.New("stan: too many subscriptions on this channel [" + ErrCodeMaxSubs + "]")
 )
 
 // Shared regular expression to check clientID validity.
@@ -120,8 +264,17 @@ func init() {
 }
 
 type ioPendingMsg struct {
-	pm *pb.PubMsg
-	m  *nats.Msg
+	pm  *pb.PubMsg
+	ext *spb.MsgExt
+	m   *nats.Msg
+
+	received time.Time            // for the store latency
+	cs       *stores.ChannelStore // set once stored
+	window   chan struct{}        // slot of the message in its client's publish window, nil if none
+
+	// Publish and store spans, nil if the message is not traced.
+	span      *span
+	storeSpan *span
 }
 
 // Constant that defines the size of the channel that feeds the IO thread.
@@ -133,7 +286,9 @@ type StanServer struct {
 	// struct and make sure they are all 64bits (or use padding if necessary).
 	// atomic.* functions crash on 32bit machines if operand is not aligned
 	// at 64bit. See https://github.com/golang/go/issues/599
-	ioChannelStatsMaxBatchSize int64 // stats of the max number of messages than went into a single batch
+	ioChannelStatsMaxBatchSize int64  // stats of the max number of messages than went into a single batch
+	rejectedChannels           uint64 // operations rejected because of the MaxChannels limit
+	rejectedSubs               uint64 // subscriptions rejected because of the MaxSubscriptions limit
 
 	sync.RWMutex
 	shutdown   bool
@@ -143,9 +298,10 @@ type StanServer struct {
 	opts       *Options
 	nc         *nats.Conn
 	wg         sync.WaitGroup // Wait on go routines during shutdown
+	clock      Clock          // Options.Clock, or the system clock
 
-	// For now, these will be set to the constants DefaultHeartBeatInterval, etc...
-	// but allow to override in tests.
+	// Set from the options, or DefaultHeartBeatInterval, etc... if not set,
+	// and overridden in tests.
 	hbInterval  time.Duration
 	hbTimeout   time.Duration
 	maxFailedHB int
@@ -161,9 +317,130 @@ type StanServer struct {
 	// Clients
 	clients *clientStore
 
+	// Publish rates of clients and channels, nil if not limited.
+	pubRates *pubRates
+
+	// Payload validators of the channels, see validatePayload().
+	validators []*channelValidator
+
+	// Number of channels created by each client, if limited.
+	channelsLock     sync.Mutex
+	channelsByClient map[string]int
+
 	// Store
 	store stores.Store
 
+	// Wildcard subscriptions
+	wildcards *wildcardStore
+
+	// Audit log, nil if not enabled
+	audit *auditLog
+
+	// Advisories waiting to be stored, nil if not enabled
+	advisories *advisories
+
+	// Tracer of the messages published with a trace context, nil if not enabled
+	tracer *tracer
+
+	// Lame duck mode, set atomically, and closed once the server has shut
+	// down at the end of it.
+	lameDuck     int32
+	lameDuckDone chan struct{}
+
+	// Storage watermarks, see isStorageFull().
+	storageLock          sync.Mutex
+	storageFull          bool
+	storageLastCheck     time.Time
+	budgetExceeded       int32 // accessed atomically, see isMemoryBudgetExceeded().
+	storageCheckInterval time.Duration
+
+	// Set atomically once the server is started, see handleReadyz().
+	ready int32
+
+	// Last error reported by the store when writing, see recordStoreError().
+	storeErrorLock sync.Mutex
+	storeError     error
+	storeErrorTime time.Time
+	readOnly       int32 // accessed atomically, see isReadOnly().
+
+	// Names of the channels created by clients must match this, if set.
+	channelNameRE *regexp.Regexp
+
+	// Channels of the aliases of the channels file, by alias.
+	channelAliases map[string]string
+
+	// Channels replicated from remote clusters.
+	mirrorChannels map[string]struct{}
+	mirrorsQuit    chan struct{}
+	mirrorsWg      sync.WaitGroup
+
+	// Webhooks and the NATS connection they share.
+	webhookNc    *nats.Conn
+	webhooksQuit chan struct{}
+	webhooksWg   sync.WaitGroup
+
+	// Slow consumer check, see checkSlowConsumers().
+	slowConsumerQuit chan struct{}
+	slowConsumerWg   sync.WaitGroup
+
+	// Scheduled archiving, see archiveChannels().
+	archiveQuit chan struct{}
+	archiveWg   sync.WaitGroup
+
+	// Consumer lag check, see checkConsumerLag().
+	consumerLagQuit chan struct{}
+	consumerLagWg   sync.WaitGroup
+
+	// Embedded NATS Server options and supervision, see superviseNATSServer().
+	natsOpts      *server.Options
+	natsAuth      server.Auth
+	natsRestarts  int
+	natsCheckQuit chan struct{}
+	natsCheckWg   sync.WaitGroup
+
+	// MQTT listener and connections.
+	mqttListener net.Listener
+	mqttLock     sync.Mutex
+	mqttConns    map[net.Conn]struct{}
+	mqttWg       sync.WaitGroup
+
+	// HTTP gateway.
+	httpListener net.Listener
+	httpServer   *http.Server
+	httpWg       sync.WaitGroup
+
+	// gRPC API.
+	grpcListener net.Listener
+	grpcServer   grpcService
+	grpcWg       sync.WaitGroup
+
+	// WebSocket listener, connections and the NATS connection they share.
+	wsNc       *nats.Conn
+	wsListener net.Listener
+	wsLock     sync.Mutex
+	wsConns    map[net.Conn]struct{}
+	wsWg       sync.WaitGroup
+
+	// Monitoring endpoints.
+	monitorListener net.Listener
+	monitorServer   *http.Server
+	monitorWg       sync.WaitGroup
+	runtimeLock     sync.Mutex
+	runtimeStats    []*RuntimeStats
+	runtimeQuit     chan struct{}
+
+	// Additional listeners and the NATS connections they forward.
+	listeners     []*extraListener
+	listenerLock  sync.Mutex
+	listenerConns map[net.Conn]struct{}
+	listenerWg    sync.WaitGroup
+
+	// Admin socket and its connections.
+	adminSockListener net.Listener
+	adminSockLock     sync.Mutex
+	adminSockConns    map[net.Conn]struct{}
+	adminSockWg       sync.WaitGroup
+
 	// IO Channel
 	ioChannel     chan (*ioPendingMsg)
 	ioChannelQuit chan bool
@@ -176,6 +453,9 @@ type subStore struct {
 	qsubs    map[string]*queueState // queue subscribers
 	durables map[string]*subState   // durables lookup
 	acks     map[string]*subState   // ack inbox lookup
+	stats    *channelStats          // latency histograms of the channel
+	dedup    *dedupKeys             // dedup keys within the channel's dedup window, if any
+	dedupSet bool                   // true once `dedup` has been set up
 }
 
 // Holds all queue subsribers for a subject/group and
@@ -194,28 +474,89 @@ type subState struct {
 	subject      string
 	qstate       *queueState
 	ackWait      time.Duration // SubState.AckWaitInSecs expressed as a time.Duration
-	ackTimer     *time.Timer
+	ackTimer     Timer
 	ackTimeFloor int64
 	ackSub       *nats.Subscription
 	acksPending  map[uint64]*pb.MsgProto
-	stalledRdlv  int32 // number of times the redelivery cb ended with a stalled subscriber (due to MaxInFlight)
+	sentTimes    map[uint64]int64  // time of the last (re)delivery of the pending messages, for the ack latency
+	deliveries   map[uint64]uint32 // number of (re)deliveries of the pending messages
+	expirations  map[uint64]int64  // expiration of the pending messages that have one, which outlives their removal from the store
+	redeliveries uint64            // number of redeliveries since the subscription was created or recovered
+	lastAck      int64             // time (UnixNano) of the last ack received, 0 if none
+	stalledRdlv  int32             // number of times the redelivery cb ended with a stalled subscriber (due to MaxInFlight)
 	stalled      bool
-	newOnHold    bool            // Prevents delivery of new msgs until old are redelivered (on restart)
-	store        stores.SubStore // for easy access to the store interface
+	stalledSince time.Time        // first time the subscription was seen stalled by the slow consumer check
+	slowReported bool             // the subscription was reported as slow since it is stalled
+	laggingSince time.Time        // first time the lag of the subscription was seen above ConsumerLagThreshold
+	lagReported  bool             // the lag of the subscription was reported since it is above the threshold
+	newOnHold    bool             // Prevents delivery of new msgs until old are redelivered (on restart)
+	spilled      []uint64         // recovered pending messages beyond MaxRecoveredPending, sorted, not in acksPending yet
+	store        stores.SubStore  // for easy access to the store interface
+	msgs         stores.MsgStore  // for easy access to the messages attributes
+	scheduled    map[uint64]int64 // messages withheld until their delivery time, keyed by sequence
+	schedTimer   Timer
+	filter       *msgFilter   // parsed from SubState.Filter, nil if none
+	filterPaused bool         // paused because SubState.Filter could not be parsed on recovery
+	rate         *rateLimiter // created from SubState.MaxMsgsPerSec/MaxBytesPerSec, nil if none
+	rateTimer    Timer
+	recentAcks   map[uint64]struct{} // acknowledged sequences above SubState.AckFloor, if SubState.Dedup
+	naks         map[uint64]struct{} // scheduled messages whose redelivery was delayed by a negative ack
+	snapshot     map[uint64]struct{} // latest message of each key up to SubState.SnapshotSeq, nil once sent
+	workers      workerState         // worker of the pending messages, if SubState.Workers > 1
 }
 
-// Looks up, or create a new channel if it does not exist
-func (s *StanServer) lookupOrCreateChannel(channel string) (*stores.ChannelStore, error) {
+// Looks up, or create a new channel if it does not exist. The client ID is
+// the one of the client causing the creation of the channel.
+func (s *StanServer) lookupOrCreateChannel(channel, clientID string) (*stores.ChannelStore, error) {
 	if cs := s.store.LookupChannel(channel); cs != nil {
 		return cs, nil
 	}
+	// Channels created by the server itself, such as the advisory
+	// channels, are not subject to the creation policy.
+	if clientID != "" {
+		if s.opts.NoImplicitChannels {
+			return nil, ErrUnknownChannel
+		}
+		if err := s.checkChannelName(channel); err != nil {
+			return nil, err
+		}
+	}
+	return s.createChannel(channel, clientID)
+}
+
+// createChannel creates the channel, or returns it if it already exists.
+// The channel counts against the channels created by the client, if any.
+func (s *StanServer) createChannel(channel, clientID string) (*stores.ChannelStore, error) {
+	if max := s.opts.MaxChannelsPerClient; max > 0 && clientID != "" {
+		// Hold the lock until the channel is created so that the client
+		// can't exceed the limit with concurrent requests.
+		s.channelsLock.Lock()
+		defer s.channelsLock.Unlock()
+		if s.channelsByClient[clientID] >= max {
+			s.recordEvent(&auditRecord{Event: auditLimitViolation, Client: clientID,
+				Channel: channel, Reason: ErrMaxClientChans.Error()})
+			return nil, ErrMaxClientChans
+		}
+	}
 	// It's possible that more than one go routine comes here at the same
 	// time. `ss` will then be simply gc'ed.
 	ss := createSubStore()
-	cs, _, err := s.store.CreateChannel(channel, ss)
+	cs, isNew, err := s.store.CreateChannel(channel, ss)
 	if err != nil {
+		if err == stores.ErrTooManyChannels {
+			return nil, s.rejectLimit(ErrMaxChannels, &auditRecord{Event: auditLimitViolation,
+				Client: clientID, Channel: channel, Reason: err.Error()})
+		}
 		return nil, err
 	}
+	if isNew {
+		if s.opts.MaxChannelsPerClient > 0 && clientID != "" {
+			s.channelsByClient[clientID]++
+		}
+		s.recordEvent(&auditRecord{Event: auditChannelCreate, Client: clientID, Channel: channel})
+		// Existing wildcard subscriptions may match this new channel.
+		s.addWildcardSubsToChannel(cs, channel)
+	}
 	return cs, nil
 }
 
@@ -226,6 +567,7 @@ func createSubStore() *subStore {
 		qsubs:    make(map[string]*queueState),
 		durables: make(map[string]*subState),
 		acks:     make(map[string]*subState),
+		stats:    &channelStats{},
 	}
 	return subs
 }
@@ -300,6 +642,8 @@ func (ss *subStore) Remove(sub *subState, force bool) {
 
 	sub.Lock()
 	sub.clearAckTimer()
+	sub.clearScheduleTimer()
+	sub.clearRateTimer()
 	// Clear the subscriptions clientID
 	sub.ClientID = ""
 	if sub.ackSub != nil {
@@ -344,6 +688,32 @@ func (ss *subStore) Remove(sub *subState, force bool) {
 	ss.Unlock()
 }
 
+// getAllSubs returns the plain and queue subscriptions of the channel.
+func (ss *subStore) getAllSubs() []*subState {
+	ss.RLock()
+	defer ss.RUnlock()
+	subs := append([]*subState(nil), ss.psubs...)
+	for _, qs := range ss.qsubs {
+		qs.RLock()
+		subs = append(subs, qs.subs...)
+		qs.RUnlock()
+	}
+	return subs
+}
+
+// queueMembersCount returns the number of members of the given queue group.
+func (ss *subStore) queueMembersCount(qgroup string) int {
+	ss.RLock()
+	qs := ss.qsubs[qgroup]
+	ss.RUnlock()
+	if qs == nil {
+		return 0
+	}
+	qs.RLock()
+	defer qs.RUnlock()
+	return len(qs.subs)
+}
+
 // Lookup by durable name.
 func (ss *subStore) LookupByDurable(durableName string) *subState {
 	ss.RLock()
@@ -362,35 +732,117 @@ func (ss *subStore) LookupByAckInbox(ackInbox string) *subState {
 
 // Options for STAN Server
 type Options struct {
-	ID               string
-	DiscoverPrefix   string
-	StoreType        string
-	FilestoreDir     string
-	FileStoreOpts    stores.FileStoreOptions
-	MaxChannels      int
-	MaxMsgs          int    // Maximum number of messages per channel
-	MaxBytes         uint64 // Maximum number of bytes used by messages per channel
-	MaxSubscriptions int    // Maximum number of subscriptions per channel
-	Trace            bool   // Verbose trace
-	Debug            bool   // Debug trace
-	Secure           bool   // Create a TLS enabled connection w/o server verification
-	ClientCert       string // Client Certificate for TLS
-	ClientKey        string // Client Key for TLS
-	ClientCA         string // Client CAs for TLS
-	IOBatchSize      int    // Number of messages we collect from clients before processing them.
-	IOSleepTime      int64  // Duration (in micro-seconds) the server waits for more message to fill up a batch.
-	NATSServerURL    string // URL for external NATS Server to connect to. If empty, NATS Server is embedded.
+	ID                   string
+	DiscoverPrefix       string
+	StoreType            string
+	FilestoreDir         string
+	FileStoreOpts        stores.FileStoreOptions
+	SnapshotInterval     time.Duration // Interval at which the MEMORY store is snapshotted in FilestoreDir. 0 disables the snapshots.
+	MaxChannels          int
+	MaxMsgs              int                   // Maximum number of messages per channel
+	MaxBytes             uint64                // Maximum number of bytes used by messages per channel
+	MaxSubscriptions     int                   // Maximum number of subscriptions per channel
+	MaxClients           int                   // Maximum number of connected clients. 0 means no limit.
+	MaxSubsPerClient     int                   // Maximum number of subscriptions of a client, a wildcard subscription counting as one. 0 means no limit.
+	MaxChannelsPerClient int                   // Maximum number of channels created by a client since the server started. 0 means no limit.
+	MaxQueueMembers      int                   // Maximum number of members of a queue group. 0 means no limit.
+	MinAckWait           time.Duration         // Minimum AckWait of the subscriptions. 0 means no minimum.
+	MaxAckWait           time.Duration         // Maximum AckWait of the subscriptions. 0 means no maximum.
+	MinSubInFlight       int                   // Minimum MaxInFlight of the subscriptions. 0 means no minimum.
+	MaxSubInFlight       int                   // Maximum MaxInFlight of the subscriptions. 0 means no maximum.
+	ClampSubBounds       bool                  // Bring the AckWait and MaxInFlight of subscriptions within bounds, instead of rejecting them.
+	HeartbeatInterval    time.Duration         // Interval at which the server sends heartbeats to the clients.
+	HeartbeatTimeout     time.Duration         // How long the server waits for a client to answer a heartbeat.
+	MaxFailedHeartbeats  int                   // Number of consecutive heartbeats a client can fail before being considered unreachable.
+	ClientPurgeDelay     time.Duration         // How long an unreachable client, with its subscriptions, is kept before being closed. 0 closes it right away.
+	ClientRecoveryMaxAge time.Duration         // Recovered clients whose last contact is older than this are closed on startup. 0 keeps them all.
+	MaxRecoveredPending  int                   // Maximum number of recovered pending messages of a subscription kept in memory, the others are redelivered as these are acknowledged. 0 means unlimited.
+	DupClientIDPolicy    string                // What to do when a client connects with the ID of a registered client: DupClientIDReject, DupClientIDVerify (default) or DupClientIDReplace.
+	DupClientIDTimeout   time.Duration         // How long the registered client has to answer a heartbeat with DupClientIDVerify.
+	NATSCheckInterval    time.Duration         // Interval at which the embedded NATS Server is checked. 0 disables the checks.
+	NATSFailurePolicy    string                // What to do when the embedded NATS Server stops accepting connections: NATSFailureExit (default) or NATSFailureRestart.
+	PublishRateLimits    []*PublishRateLimit   // Publish rates of clients and channels.
+	Validators           []*Validator          // Payload validators of the channels, the first one matching a channel applies.
+	MaxPubInFlight       int                   // Maximum number of messages of a client being stored and not yet acknowledged. 0 means no limit.
+	PubInFlightBlock     bool                  // Wait for a slot, instead of rejecting the message, when a client is at MaxPubInFlight.
+	CompactedChannels    []string              // Channels (wildcards allowed) on which only the latest message per key is kept
+	PriorityChannels     []string              // Channels (wildcards allowed) whose messages are delivered highest priority first
+	InterestChannels     []string              // Channels (wildcards allowed) whose messages are removed once acknowledged by all their subscriptions
+	PartitionedChannels  []*ChannelPartitions  // Channels (wildcards allowed) whose messages are delivered to queue members by partition key
+	DedupWindows         []*DedupWindow        // Channels (wildcards allowed) on which messages with a dedup key already seen within the window are dropped
+	Channels             []*ChannelConfig      // Channels created on startup, with their own limits.
+	NoImplicitChannels   bool                  // Reject publishes and subscriptions on channels that do not exist, instead of creating them.
+	ChannelNamePattern   string                // Regular expression the whole name of a channel created by a client must match. Any name if empty.
+	MaxChannelNameLen    int                   // Maximum length of the name of a channel created by a client. 0 means no limit.
+	ReservedPrefixes     []string              // Prefixes of the channels on which clients can't publish, in addition to "_STAN.".
+	Trace                bool                  // Verbose trace
+	Debug                bool                  // Debug trace
+	Secure               bool                  // Create a TLS enabled connection w/o server verification
+	ClientCert           string                // Client Certificate for TLS
+	ClientKey            string                // Client Key for TLS
+	ClientCA             string                // Client CAs for TLS
+	IOBatchSize          int                   // Number of messages we collect from clients before processing them.
+	IOSleepTime          int64                 // Duration (in micro-seconds) the server waits for more message to fill up a batch.
+	NATSServerURL        string                // URL for external NATS Server to connect to. If empty, NATS Server is embedded.
+	Users                []*User               // Users allowed to connect, with their channel permissions. If empty, no authorization.
+	BindClientIDs        bool                  // Users without client IDs can only connect with their user name as client ID.
+	Tenants              []stores.TenantLimits // Tenants, with their own channel namespace and limits.
+	LogJSON              bool                  // Log in JSON format, with component, client and channel tags.
+	LogFile              string                // Log file, rotated based on LogFileMaxSize and LogFileMaxAge.
+	LogFileMaxSize       int64                 // Size (in bytes) after which the log file is rotated. 0 means no limit.
+	LogFileMaxAge        time.Duration         // Age after which the log file is rotated. 0 means no limit.
+	AuditLogFile         string                // File in which client, subscription and channel events are recorded. Disabled if empty.
+	LameDuckTimeout      time.Duration         // How long to wait, in lame duck mode, for messages in flight to be acknowledged.
+	StoreHighWatermark   int64                 // Total size (in bytes) of the stored messages above which messages are rejected. 0 means no limit.
+	StoreLowWatermark    int64                 // Total size (in bytes) of the stored messages below which messages are accepted again. Defaults to StoreHighWatermark.
+	Mirrors              []*Mirror             // Channels replicated from remote clusters.
+	Webhooks             []*Webhook            // Channels whose messages are posted to HTTP endpoints.
+	MQTTListen           string                // Address (host:port) on which MQTT clients can publish. Disabled if empty.
+	MQTTMappings         []*MQTTMapping        // MQTT topics to channels mappings. If empty, `/` in topics is replaced with `.`.
+	HTTPListen           string                // Address (host:port) of the HTTP publish and fetch gateway. Disabled if empty.
+	GRPCListen           string                // Address (host:port) of the gRPC admin and data API. Disabled if empty.
+	WebSocketListen      string                // Address (host:port) on which streaming clients can connect over WebSocket. Disabled if empty.
+	TraceEndpoint        string                // OTLP/HTTP endpoint to which the spans of traced messages are exported. Disabled if empty.
+	MonitorListen        string                // Address (host:port) of the monitoring endpoints. Disabled if empty.
+	MonitorProfiling     bool                  // Serve the net/http/pprof endpoints on the monitoring address.
+	Listeners            []*Listener           // Additional addresses of the NATS, monitoring, HTTP and gRPC listeners, each with its own TLS and authorization.
+	AdminSocket          string                // Path of the Unix domain socket accepting administrative requests without credentials. Disabled if empty.
+	RuntimeStatsInterval time.Duration         // Interval at which the runtime statistics are sampled. Defaults to DefaultRuntimeStatsInterval.
+	SlowConsumerTimeout  time.Duration         // How long a subscription can stay at its MaxInFlight before being reported as slow. 0 disables the check.
+	SlowConsumerClose    bool                  // Close the slow subscriptions (durables can be resumed).
+	ConsumerLagThreshold uint64                // Report subscriptions whose lag exceeds this number of messages. 0 disables the check.
+	ConsumerLagDuration  time.Duration         // How long the lag of a subscription must exceed ConsumerLagThreshold before being reported.
+	Advisories           bool                  // Store client, subscription and channel events in the _STAN.advisory.<event> channels.
+	Clock                Clock                 // Source of time of the redelivery, delayed delivery and expiration of messages. System time if nil.
+	MsgStamper           stores.MsgStamper     // Assigns the sequence and timestamp of the published messages. stores.SystemStamper if nil.
+	MonotonicTimestamps  bool                  // If MsgStamper is nil, never let the timestamps of a channel go back, using the Clock.
+	SystemdNotify        bool                  // Notify systemd of the readiness of the server, and feed its watchdog from the store IO loop.
+	MemoryBudget         int64                 // Memory (in bytes) the messages kept in memory by the store can use. 0 means no limit.
+	MemoryBudgetPolicy   string                // What to do when the MemoryBudget is exceeded: MemoryBudgetReject (default) or MemoryBudgetTrim.
+	StoreErrorPolicy     string                // What to do when the store fails to write: StoreErrorReport (default), StoreErrorReadOnly, StoreErrorRetry or StoreErrorPanic.
+	StoreErrorRetries    int                   // Number of retries of a failed write with StoreErrorRetry. 0 means DefaultStoreErrorRetries.
+	StoreErrorBackoff    time.Duration         // Delay before the first retry with StoreErrorRetry, doubled after each one. 0 means DefaultStoreErrorBackoff.
+	StoreTimeout         time.Duration         // Maximum duration of a write of the store for a publish, delivery or ack, after which it fails. 0 means no limit.
+	ArchiveDir           string                // Directory in which the messages of ArchiveChannels are exported at each ArchiveInterval. Disabled if empty.
+	ArchiveChannels      []string              // Channels (wildcards allowed) whose messages are archived.
+	ArchiveInterval      time.Duration         // Interval between two archives of a channel. Defaults to DefaultArchiveInterval.
+	ArchiveFormat        string                // Format of the archives: stores.ArchiveJSON (default) or stores.ArchiveProto.
 }
 
 // DefaultOptions are default options for the STAN server
 var defaultOptions = Options{
-	ID:             DefaultClusterID,
-	DiscoverPrefix: DefaultDiscoverPrefix,
-	StoreType:      DefaultStoreType,
-	FileStoreOpts:  stores.DefaultFileStoreOptions,
-	IOBatchSize:    DefaultIOBatchSize,
-	IOSleepTime:    DefaultIOSleepTime,
-	NATSServerURL:  "",
+	ID:              DefaultClusterID,
+	DiscoverPrefix:  DefaultDiscoverPrefix,
+	StoreType:       DefaultStoreType,
+	FileStoreOpts:   stores.DefaultFileStoreOptions,
+	IOBatchSize:     DefaultIOBatchSize,
+	IOSleepTime:     DefaultIOSleepTime,
+	NATSServerURL:   "",
+	LameDuckTimeout: DefaultLameDuckTimeout,
+
+	HeartbeatInterval:   DefaultHeartBeatInterval,
+	HeartbeatTimeout:    DefaultClientHBTimeout,
+	MaxFailedHeartbeats: DefaultMaxFailedHeartBeats,
 }
 
 // GetDefaultOptions returns default options for the STAN server
@@ -413,6 +865,10 @@ func stanDisconnectedHandler(nc *nats.Conn) {
 	}
 }
 
+func stanReconnectedHandler(nc *nats.Conn) {
+	Noticef("STAN: connection has been reconnected to %s", nc.ConnectedUrl())
+}
+
 func stanClosedHandler(_ *nats.Conn) {
 	Debugf("STAN: connection has been closed")
 }
@@ -423,6 +879,7 @@ func stanErrorHandler(_ *nats.Conn, sub *nats.Subscription, err error) {
 
 func buildServerURLs(sOpts *Options, opts *server.Options) ([]string, error) {
 	var hostport string
+	scheme := "nats"
 	natsURL := sOpts.NATSServerURL
 	// If the URL to an external NATS is provided...
 	if natsURL != "" {
@@ -438,12 +895,13 @@ func buildServerURLs(sOpts *Options, opts *server.Options) ([]string, error) {
 		// Otherwise, prepare the host and port and continue to see
 		// if user/pass needs to be added.
 
-		// First trim the protocol.
+		// First trim the protocol, which is kept so that "tls://"
+		// can be used to require a secure connection.
 		parts := strings.Split(natsURL, "://")
 		if len(parts) != 2 {
 			return nil, fmt.Errorf("malformed url: %v", natsURL)
 		}
-		natsURL = parts[1]
+		scheme, natsURL = parts[0], parts[1]
 		host, port, err := net.SplitHostPort(natsURL)
 		if err != nil {
 			return nil, err
@@ -461,9 +919,9 @@ func buildServerURLs(sOpts *Options, opts *server.Options) ([]string, error) {
 		userpart = fmt.Sprintf("%s:%s", opts.Username, opts.Password)
 	}
 	if userpart != "" {
-		return []string{fmt.Sprintf("nats://%s@%s", userpart, hostport)}, nil
+		return []string{fmt.Sprintf("%s://%s@%s", scheme, userpart, hostport)}, nil
 	}
-	return []string{fmt.Sprintf("nats://%s", hostport)}, nil
+	return []string{fmt.Sprintf("%s://%s", scheme, hostport)}, nil
 }
 
 // createNatsClientConn creates a connection to the NATS server, using
@@ -491,6 +949,16 @@ func createNatsClientConn(sOpts *Options, nOpts *server.Options) (*nats.Conn, er
 	if err = nats.DisconnectHandler(stanDisconnectedHandler)(&ncOpts); err != nil {
 		return nil, err
 	}
+	if err = nats.ReconnectHandler(stanReconnectedHandler)(&ncOpts); err != nil {
+		return nil, err
+	}
+	// When attached to an external NATS cluster, the streaming server
+	// must survive the restart of the NATS Server(s) it is connected to.
+	if sOpts.NATSServerURL != "" {
+		if err = nats.MaxReconnects(-1)(&ncOpts); err != nil {
+			return nil, err
+		}
+	}
 	if sOpts.Secure {
 		if err = nats.Secure()(&ncOpts); err != nil {
 			return nil, err
@@ -525,7 +993,21 @@ func RunServer(ID string) *StanServer {
 }
 
 // RunServerWithOpts will startup an embedded STAN server and a nats-server to support it.
+// It panics if the server can't be started, use StartServerWithOpts to get
+// the error instead.
 func RunServerWithOpts(stanOpts *Options, natsOpts *server.Options) *StanServer {
+	s, err := StartServerWithOpts(stanOpts, natsOpts)
+	if err != nil {
+		panic(err)
+	}
+	return s
+}
+
+// StartServerWithOpts will startup an embedded STAN server and a nats-server
+// to support it. If nil, default options are used. If the server can't be
+// started, the resources that were allocated, such as the store, are
+// released and an error is returned.
+func StartServerWithOpts(stanOpts *Options, natsOpts *server.Options) (newServer *StanServer, returnedError error) {
 	// Run a nats server by default
 	sOpts := stanOpts
 	nOpts := natsOpts
@@ -538,7 +1020,7 @@ func RunServerWithOpts(stanOpts *Options, natsOpts *server.Options) *StanServer
 		nOpts = &no
 	}
 
-	Noticef("Starting nats-streaming-server[%s] version %s", sOpts.ID, VERSION)
+	Noticef("STAN: Starting nats-streaming-server[%s] version %s", sOpts.ID, VERSION)
 
 	s := StanServer{
 		serverID:          nuid.Next(),
@@ -548,77 +1030,133 @@ func RunServerWithOpts(stanOpts *Options, natsOpts *server.Options) *StanServer
 		maxFailedHB:       DefaultMaxFailedHeartBeats,
 		dupCIDMap:         make(map[string]struct{}),
 		dupMaxCIDRoutines: defaultMaxDupCIDRoutines,
-		dupCIDTimeout:     defaultCheckDupCIDTimeout,
+		dupCIDTimeout:     DefaultDupClientIDTimeout,
 		ioChannelQuit:     make(chan bool, 1),
+		wildcards:         newWildcardStore(),
+		channelsByClient:  make(map[string]int),
+		lameDuckDone:      make(chan struct{}),
+
+		storageCheckInterval: defaultStorageCheckInterval,
+	}
+	if s.clock = sOpts.Clock; s.clock == nil {
+		s.clock = systemClock{}
 	}
 
-	// Set limits
-	limits := &stores.ChannelLimits{
-		MaxChannels: DefaultChannelLimit,
-		MaxNumMsgs:  DefaultMsgStoreLimit,
-		MaxMsgBytes: DefaultMsgStoreLimit * 1024,
-		MaxSubs:     DefaultSubStoreLimit,
+	// Ensure that we shutdown the server if there is an error during
+	// startup. This will ensure that stores are closed (which otherwise
+	// would cause issues during testing) and that the NATS Server (if
+	// started) is also properly shutdown. Some of the startup steps panic
+	// instead of returning an error, so we recover from the panic and
+	// return it as an error.
+	defer func() {
+		if r := recover(); r != nil {
+			if err, ok := r.(error); ok {
+				returnedError = err
+			} else {
+				returnedError = fmt.Errorf("%v", r)
+			}
+		}
+		if returnedError != nil {
+			s.Shutdown()
+			newServer = nil
+		}
+	}()
+
+	if sOpts.HeartbeatInterval > 0 {
+		s.hbInterval = sOpts.HeartbeatInterval
+	}
+	if sOpts.HeartbeatTimeout > 0 {
+		s.hbTimeout = sOpts.HeartbeatTimeout
+	}
+	if sOpts.MaxFailedHeartbeats > 0 {
+		s.maxFailedHB = sOpts.MaxFailedHeartbeats
+	}
+	if sOpts.DupClientIDTimeout > 0 {
+		s.dupCIDTimeout = sOpts.DupClientIDTimeout
 	}
 
-	// Override with Options if needed
-	overrideLimits(limits, sOpts)
+	// Set limits, overridden with Options if needed
+	limits := storeLimits(sOpts)
+	if err := validateOptions(sOpts); err != nil {
+		return nil, err
+	}
+	s.pubRates = newPubRates(sOpts.PublishRateLimits)
+	if sOpts.ChannelNamePattern != "" {
+		// Validated above.
+		s.channelNameRE = regexp.MustCompile("^(?:" + sOpts.ChannelNamePattern + ")$")
+	}
+	s.channelAliases = make(map[string]string)
+	for _, c := range sOpts.Channels {
+		for _, alias := range c.Aliases {
+			s.channelAliases[alias] = c.Name
+		}
+	}
+	s.mirrorChannels = make(map[string]struct{}, len(sOpts.Mirrors))
+	for _, m := range sOpts.Mirrors {
+		s.mirrorChannels[m.Channel] = struct{}{}
+	}
 
 	var err error
+	if s.validators, err = newChannelValidators(sOpts.Validators); err != nil {
+		return nil, err
+	}
+	if sOpts.TraceEndpoint != "" {
+		s.tracer = newTracer(sOpts.TraceEndpoint, sOpts.ID)
+	}
+	if sOpts.AuditLogFile != "" {
+		if s.audit, err = openAuditLog(sOpts.AuditLogFile); err != nil {
+			return nil, fmt.Errorf("unable to open audit log: %v", err)
+		}
+	}
 	var recoveredState *stores.RecoveredState
 	var recoveredSubs []*subState
 
 	// Ensure store type option is in upper-case
 	sOpts.StoreType = strings.ToUpper(sOpts.StoreType)
 
-	// Create the store. So far either memory or file-based.
-	switch sOpts.StoreType {
-	case stores.TypeFile:
-		// The dir must be specified
-		if sOpts.FilestoreDir == "" {
-			err = fmt.Errorf("for %v stores, root directory must be specified", stores.TypeFile)
-			break
-		}
-		s.store, recoveredState, err = stores.NewFileStore(sOpts.FilestoreDir, limits,
-			stores.AllOptions(&sOpts.FileStoreOpts))
-	case stores.TypeMemory:
-		s.store, err = stores.NewMemoryStore(limits)
-	default:
-		err = fmt.Errorf("unsupported store type: %v", sOpts.StoreType)
+	// Create the store, of one of the registered types.
+	s.store, recoveredState, err = stores.NewStore(sOpts.StoreType, &stores.StoreConfig{
+		Dir:                    sOpts.FilestoreDir,
+		Limits:                 limits,
+		FileStoreOpts:          &sOpts.FileStoreOpts,
+		MemorySnapshotInterval: sOpts.SnapshotInterval,
+	})
+	if err == stores.ErrUpgradeRequired {
+		return nil, fmt.Errorf("%v, restart with -upgrade_store (after backing up %s)", err, sOpts.FilestoreDir)
 	}
 	if err != nil {
-		panic(fmt.Sprintf("%v", err))
+		return nil, err
+	}
+	s.store.MemoryBudget().SetLimit(sOpts.MemoryBudget, sOpts.MemoryBudgetPolicy == MemoryBudgetTrim)
+	if sOpts.MsgStamper != nil {
+		s.store.SetMsgStamper(sOpts.MsgStamper)
+	} else if sOpts.MonotonicTimestamps {
+		s.store.SetMsgStamper(&stores.MonotonicStamper{Now: s.clock.Now})
 	}
 
 	// Create clientStore
 	s.clients = &clientStore{store: s.store}
 
-	// Ensure that we shutdown the server if there is a panic during startup.
-	// This will ensure that stores are closed (which otherwise would cause
-	// issues during testing) and that the NATS Server (if started) is also
-	// properly shutdown. Tod do so, we recover from the panic in order to
-	// call Shutdown, then issue the original panic.
-	defer func() {
-		if r := recover(); r != nil {
-			s.Shutdown()
-			// Issue the original panic now that the store is closed.
-			panic(r)
-		}
-	}()
-
 	if recoveredState != nil {
 		// Copy content
 		s.info = *recoveredState.Info
 		// Check cluster IDs match
 		if s.opts.ID != s.info.ClusterID {
-			panic(fmt.Errorf("Cluster ID %q does not match recovered value of %q",
-				s.opts.ID, s.info.ClusterID))
+			return nil, fmt.Errorf("Cluster ID %q does not match recovered value of %q",
+				s.opts.ID, s.info.ClusterID)
 		}
 
 		// Restore clients state
 		s.processRecoveredClients(recoveredState.Clients)
 
 		// Process recovered channels (if any).
-		recoveredSubs = s.processRecoveredChannels(recoveredState.Subs)
+		recoveredSubs, err = s.processRecoveredChannels(recoveredState)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to recover subscriptions: %v", err)
+		}
+		if err := s.checkChannelAliases(); err != nil {
+			return nil, err
+		}
 	} else {
 		s.info.ClusterID = s.opts.ID
 		// Generate Subjects
@@ -631,35 +1169,48 @@ func RunServerWithOpts(stanOpts *Options, natsOpts *server.Options) *StanServer
 
 		// Initialize the store with the server info
 		if err := s.store.Init(&s.info); err != nil {
-			panic(fmt.Errorf("Unable to initialize the store: %v", err))
+			return nil, fmt.Errorf("Unable to initialize the store: %v", err)
 		}
 	}
 
 	// If no NATS server url is provided, it means that we embed the NATS Server
 	if sOpts.NATSServerURL == "" {
-		s.startNATSServer(nOpts)
+		if err := s.startNATSServer(nOpts); err != nil {
+			return nil, fmt.Errorf("Can't start the NATS server: %v", err)
+		}
 	}
 
 	if s.nc, err = createNatsClientConn(sOpts, nOpts); err != nil {
-		panic(fmt.Sprintf("Can't connect to NATS server: %v\n", err))
+		return nil, fmt.Errorf("Can't connect to NATS server: %v", err)
 	}
 
 	s.ensureRunningStandAlone()
 
+	s.startAdvisories()
+
+	if err := s.createConfiguredChannels(); err != nil {
+		return nil, fmt.Errorf("Unable to create channels: %v", err)
+	}
+
 	s.initSubscriptions()
 
 	if recoveredState != nil {
+		// Close the clients that have not been in contact for too long.
+		recoveredSubs = s.closeExpiredClients(recoveredState.Clients, recoveredSubs)
 		// Do some post recovery processing (create subs on AckInbox, setup
 		// some timers, etc...)
 		if err := s.postRecoveryProcessing(recoveredState.Clients, recoveredSubs); err != nil {
-			panic(fmt.Errorf("error during post recovery processing: %v\n", err))
+			return nil, fmt.Errorf("error during post recovery processing: %v", err)
+		}
+		if err := s.purgeAckedMsgsOnStartup(); err != nil {
+			return nil, fmt.Errorf("error removing acknowledged messages: %v", err)
 		}
 	}
 
 	// Flush to make sure all subscriptions are processed before
 	// we return control to the user.
 	if err := s.nc.Flush(); err != nil {
-		panic(fmt.Sprintf("Could not flush the subscriptions, %v\n", err))
+		return nil, fmt.Errorf("Could not flush the subscriptions, %v", err)
 	}
 
 	Noticef("STAN: Message store is %s", s.store.Name())
@@ -670,7 +1221,57 @@ func RunServerWithOpts(stanOpts *Options, natsOpts *server.Options) *StanServer
 	s.wg.Add(1)
 	go s.performRedeliveryOnStartup(recoveredSubs)
 
-	return &s
+	s.startMirrors()
+
+	if err := s.startMQTT(); err != nil {
+		return nil, fmt.Errorf("Can't listen for MQTT clients: %v", err)
+	}
+	if err := s.startHTTPGateway(); err != nil {
+		return nil, fmt.Errorf("Can't listen for HTTP requests: %v", err)
+	}
+	if err := s.startGRPC(); err != nil {
+		return nil, fmt.Errorf("Can't listen for gRPC requests: %v", err)
+	}
+	if err := s.startWebSocket(nOpts); err != nil {
+		return nil, fmt.Errorf("Can't listen for WebSocket clients: %v", err)
+	}
+	if err := s.startWebhooks(nOpts); err != nil {
+		return nil, fmt.Errorf("Can't start webhooks: %v", err)
+	}
+	if err := s.startMonitoring(); err != nil {
+		return nil, fmt.Errorf("Can't listen for monitoring requests: %v", err)
+	}
+	if err := s.startListeners(); err != nil {
+		return nil, fmt.Errorf("Can't start additional listeners: %v", err)
+	}
+	if err := s.startAdminSocket(); err != nil {
+		return nil, fmt.Errorf("Can't listen for admin requests: %v", err)
+	}
+	if err := s.startArchiver(); err != nil {
+		return nil, fmt.Errorf("Can't start archiving: %v", err)
+	}
+	s.startSlowConsumerCheck()
+	s.startConsumerLagCheck()
+	s.startNATSSupervision()
+
+	// The store is recovered and clients can connect.
+	atomic.StoreInt32(&s.ready, 1)
+	s.notifySystemd(sdReady)
+
+	return &s, nil
+}
+
+// storeLimits returns the channel limits of the store, the defaults
+// overridden with the options.
+func storeLimits(opts *Options) *stores.ChannelLimits {
+	limits := &stores.ChannelLimits{
+		MaxChannels: DefaultChannelLimit,
+		MaxNumMsgs:  DefaultMsgStoreLimit,
+		MaxMsgBytes: DefaultMsgStoreLimit * 1024,
+		MaxSubs:     DefaultSubStoreLimit,
+	}
+	overrideLimits(limits, opts)
+	return limits
 }
 
 func overrideLimits(limits *stores.ChannelLimits, opts *Options) {
@@ -686,18 +1287,111 @@ func overrideLimits(limits *stores.ChannelLimits, opts *Options) {
 	if opts.MaxSubscriptions != 0 {
 		limits.MaxSubs = opts.MaxSubscriptions
 	}
+	if len(opts.CompactedChannels) > 0 {
+		limits.CompactedChannels = opts.CompactedChannels
+	}
+	if len(opts.Tenants) > 0 {
+		limits.Tenants = opts.Tenants
+	}
+	for _, c := range opts.Channels {
+		limits.PerChannel = append(limits.PerChannel, stores.PerChannelLimits{
+			Name:        c.Name,
+			MaxNumMsgs:  c.MaxMsgs,
+			MaxMsgBytes: c.MaxBytes,
+			MaxSubs:     c.MaxSubs,
+		})
+	}
+}
+
+// validateOptions returns an error if the options of the server are
+// invalid, before anything is started.
+func validateOptions(sOpts *Options) error {
+	if err := validateTenants(sOpts.Tenants); err != nil {
+		return err
+	}
+	if err := validateChannels(sOpts.Channels); err != nil {
+		return err
+	}
+	if err := validateMirrors(sOpts.Mirrors); err != nil {
+		return err
+	}
+	if err := validateMQTTMappings(sOpts.MQTTMappings); err != nil {
+		return err
+	}
+	if err := validateChannelPartitions(sOpts.PartitionedChannels); err != nil {
+		return err
+	}
+	if err := validateWebhooks(sOpts.Webhooks); err != nil {
+		return err
+	}
+	if err := validateListenerOptions(sOpts); err != nil {
+		return err
+	}
+	if err := validatePublishRateLimits(sOpts.PublishRateLimits); err != nil {
+		return err
+	}
+	if err := validateSubBounds(sOpts); err != nil {
+		return err
+	}
+	if err := validateArchiveOptions(sOpts); err != nil {
+		return err
+	}
+	if sOpts.BindClientIDs && len(sOpts.Users) == 0 {
+		return fmt.Errorf("binding client IDs requires users")
+	}
+	if err := validateValidators(sOpts.Validators); err != nil {
+		return err
+	}
+	switch sOpts.MemoryBudgetPolicy {
+	case "", MemoryBudgetReject, MemoryBudgetTrim:
+	default:
+		return fmt.Errorf("invalid memory budget policy %q (should be %s or %s)",
+			sOpts.MemoryBudgetPolicy, MemoryBudgetReject, MemoryBudgetTrim)
+	}
+	switch sOpts.DupClientIDPolicy {
+	case "", DupClientIDReject, DupClientIDVerify, DupClientIDReplace:
+	default:
+		return fmt.Errorf("invalid duplicate client ID policy %q (should be %s, %s or %s)",
+			sOpts.DupClientIDPolicy, DupClientIDReject, DupClientIDVerify, DupClientIDReplace)
+	}
+	switch sOpts.NATSFailurePolicy {
+	case "", NATSFailureExit, NATSFailureRestart:
+	default:
+		return fmt.Errorf("invalid NATS failure policy %q (should be %s or %s)",
+			sOpts.NATSFailurePolicy, NATSFailureExit, NATSFailureRestart)
+	}
+	switch sOpts.StoreErrorPolicy {
+	case "", StoreErrorReport, StoreErrorReadOnly, StoreErrorRetry, StoreErrorPanic:
+	default:
+		return fmt.Errorf("invalid store error policy %q (should be %s, %s, %s or %s)",
+			sOpts.StoreErrorPolicy, StoreErrorReport, StoreErrorReadOnly, StoreErrorRetry, StoreErrorPanic)
+	}
+	if sOpts.ChannelNamePattern != "" {
+		if _, err := regexp.Compile("^(?:" + sOpts.ChannelNamePattern + ")$"); err != nil {
+			return fmt.Errorf("invalid channel name pattern: %v", err)
+		}
+	}
+	return nil
 }
 
 // TODO:  Explore parameter passing in gnatsd.  Keep seperate for now.
 func (s *StanServer) configureClusterOpts(opts *server.Options) error {
+	// If we have routes but no config file, fill in here.
+	if opts.RoutesStr != "" && opts.Routes == nil {
+		opts.Routes = server.RoutesFromStr(opts.RoutesStr)
+	}
 	if opts.ClusterListenStr == "" {
-		if opts.RoutesStr != "" {
-			Fatalf("Solicited routes require cluster capabilities, e.g. --cluster.")
+		// The cluster may be configured in the config file instead.
+		if len(opts.Routes) > 0 && opts.ClusterPort == 0 {
+			return fmt.Errorf("solicited routes require cluster capabilities, e.g. --cluster")
 		}
 		return nil
 	}
 
 	clusterURL, err := url.Parse(opts.ClusterListenStr)
+	if err != nil {
+		return err
+	}
 	h, p, err := net.SplitHostPort(clusterURL.Host)
 	if err != nil {
 		return err
@@ -718,46 +1412,75 @@ func (s *StanServer) configureClusterOpts(opts *server.Options) error {
 		user := clusterURL.User.Username()
 		opts.ClusterUsername = user
 	}
-
-	// If we have routes but no config file, fill in here.
-	if opts.RoutesStr != "" && opts.Routes == nil {
-		opts.Routes = server.RoutesFromStr(opts.RoutesStr)
-	}
-
 	return nil
 }
 
 // configureNATSServerTLS sets up TLS for the NATS Server.
 // Additional TLS parameters (e.g. cipher suites) will need to be placed
 // in a configuration file specified through the -config parameter.
+// If none of the TLS options is set, the TLS configuration coming from
+// that file (if any) is used as-is.
 func (s *StanServer) configureNATSServerTLS(opts *server.Options) {
-	tlsSet := false
-	tc := server.TLSConfigOpts{}
-	if opts.TLSCert != "" {
-		tc.CertFile = opts.TLSCert
-		tlsSet = true
+	if !opts.TLS && !opts.TLSVerify && opts.TLSCert == "" &&
+		opts.TLSKey == "" && opts.TLSCaCert == "" {
+		return
 	}
-	if opts.TLSKey != "" {
-		tc.KeyFile = opts.TLSKey
-		tlsSet = true
+	// Fail now instead of starting a server clients can't connect to.
+	if opts.TLSCert == "" || opts.TLSKey == "" {
+		panic(ErrTLSCertRequired)
 	}
-	if opts.TLSCaCert != "" {
-		tc.CaFile = opts.TLSCaCert
-		tlsSet = true
+	tc := server.TLSConfigOpts{
+		CertFile: opts.TLSCert,
+		KeyFile:  opts.TLSKey,
+		CaFile:   opts.TLSCaCert,
+		Verify:   opts.TLSVerify,
 	}
-
-	if opts.TLSVerify {
-		tc.Verify = true
-		tlsSet = true
+	var err error
+	if opts.TLSConfig, err = server.GenTLSConfig(&tc); err != nil {
+		panic(fmt.Errorf("Unable to setup NATS Server TLS: %v", err))
 	}
+}
 
-	var err error
-	if tlsSet {
-		if opts.TLSConfig, err = server.GenTLSConfig(&tc); err != nil {
-			// The connection will fail later if the problem is severe enough.
-			Errorf("STAN:  Unable to setup NATS Server TLS:  %v", err)
-		}
+// MergeNATSOptions merges the NATS Server options parsed from a configuration
+// file with the ones from the command line, the latter taking precedence.
+// Unlike server.MergeOptions, this includes the TLS, HTTPS and syslog options.
+func MergeNATSOptions(fileOpts, flagOpts *server.Options) *server.Options {
+	opts := server.MergeOptions(fileOpts, flagOpts)
+	if fileOpts == nil || flagOpts == nil {
+		return opts
+	}
+	if flagOpts.TLS {
+		opts.TLS = true
 	}
+	if flagOpts.TLSVerify {
+		opts.TLSVerify = true
+	}
+	if flagOpts.TLSCert != "" {
+		opts.TLSCert = flagOpts.TLSCert
+	}
+	if flagOpts.TLSKey != "" {
+		opts.TLSKey = flagOpts.TLSKey
+	}
+	if flagOpts.TLSCaCert != "" {
+		opts.TLSCaCert = flagOpts.TLSCaCert
+	}
+	if flagOpts.HTTPSPort != 0 {
+		opts.HTTPSPort = flagOpts.HTTPSPort
+	}
+	if flagOpts.Syslog {
+		opts.Syslog = true
+	}
+	if flagOpts.RemoteSyslog != "" {
+		opts.RemoteSyslog = flagOpts.RemoteSyslog
+	}
+	if flagOpts.ClusterListenStr != "" {
+		opts.ClusterListenStr = flagOpts.ClusterListenStr
+	}
+	if flagOpts.RoutesStr != "" {
+		opts.RoutesStr = flagOpts.RoutesStr
+		opts.Routes = server.RoutesFromStr(flagOpts.RoutesStr)
+	}
+	return opts
 }
 
 // configureNATSServerAuth sets up user authentication for the NATS Server.
@@ -777,15 +1500,23 @@ func (s *StanServer) configureNATSServerAuth(opts *server.Options) server.Auth {
 }
 
 // startNATSServer massages options as necessary, and starts the embedded
-// NATS server.  No errors, only panics upon error conditions.
-func (s *StanServer) startNATSServer(opts *server.Options) {
+// NATS server. The options are kept so that the server can be restarted.
+func (s *StanServer) startNATSServer(opts *server.Options) error {
 	if opts.Host == "" {
 		opts.Host = "localhost"
 	}
-	s.configureClusterOpts(opts)
+	if err := s.configureClusterOpts(opts); err != nil {
+		return err
+	}
 	s.configureNATSServerTLS(opts)
-	a := s.configureNATSServerAuth(opts)
-	s.natsServer = natsd.RunServerWithAuth(opts, a)
+	s.natsOpts = opts
+	s.natsAuth = s.configureNATSServerAuth(opts)
+	ns, err := runNATSServer(opts, s.natsAuth)
+	if err != nil {
+		return err
+	}
+	s.natsServer = ns
+	return nil
 }
 
 // ensureRunningStandAlone prevents this streaming server from starting
@@ -803,7 +1534,7 @@ func (s *StanServer) ensureRunningStandAlone() {
 	b, _ := req.Marshal()
 	reply, err := s.nc.Request(s.info.Discovery, b, timeout)
 	if err == nats.ErrTimeout {
-		Debugf("Did not detect another server instance.")
+		Debugf("STAN: Did not detect another server instance.")
 		return
 	}
 	if err != nil {
@@ -840,46 +1571,203 @@ func (s *StanServer) processRecoveredClients(clients []*stores.Client) {
 // We don't use locking in there because there is no communication
 // with the NATS server and/or clients, so no chance that the state
 // changes while we are doing this.
-func (s *StanServer) processRecoveredChannels(subscriptions stores.RecoveredSubscriptions) []*subState {
+func (s *StanServer) processRecoveredChannels(state *stores.RecoveredState) ([]*subState, error) {
 	// We will return the recovered subscriptions
 	allSubs := make([]*subState, 0, 16)
 
-	for channelName, recoveredSubs := range subscriptions {
+	// Create the subStore of every recovered channel, since a channel
+	// without subscriptions is not visited by Recover.
+	channels := s.store.GetChannelNames()
+	for _, channelName := range channels {
+		s.store.LookupChannel(channelName).UserData = createSubStore()
+	}
+	recoveredCount := make(map[string]int, len(channels))
+	err := state.Recover(func(channelName string, recSub *stores.RecoveredSubState) error {
+		recoveredCount[channelName]++
 		// Lookup the ChannelStore from the store
 		channel := s.store.LookupChannel(channelName)
-		// Create the subStore for this channel
-		ss := createSubStore()
-		// Set it into the channel store
-		channel.UserData = ss
-		// Get the recovered subscriptions for this channel.
-		for _, recSub := range recoveredSubs {
-			// Create a subState
-			sub := &subState{
-				subject:     channelName,
-				ackWait:     time.Duration(recSub.Sub.AckWaitInSecs) * time.Second,
-				acksPending: recSub.Pending,
-				store:       channel.Subs,
-			}
-			// Ensure acksPending is not nil
-			if sub.acksPending == nil {
-				// Create an empty map
-				sub.acksPending = make(map[uint64]*pb.MsgProto)
-			} else if len(sub.acksPending) > 0 {
+		ss := channel.UserData.(*subStore)
+		// Create a subState
+		sub := &subState{
+			subject:     channelName,
+			ackWait:     time.Duration(recSub.Sub.AckWaitInSecs) * time.Second,
+			acksPending: recSub.Pending,
+			store:       channel.Subs,
+			msgs:        channel.Msgs,
+		}
+		// Copy over fields from SubState protobuf
+		sub.SubState = *recSub.Sub
+		// Ensure acksPending is not nil
+		if sub.acksPending == nil {
+			// Create an empty map
+			sub.acksPending = make(map[uint64]*pb.MsgProto)
+		} else {
+			// Messages not yet due are scheduled, not pending.
+			recoverScheduledMsgs(sub, s.clock.Now().UnixNano())
+			// Acknowledged messages are not redelivered if so requested.
+			dropAckedPending(sub)
+			// Keep only the oldest pending messages in memory.
+			spillRecoveredPending(sub, s.opts.MaxRecoveredPending)
+			if len(sub.acksPending) > 0 {
 				// Prevent delivery of new messages until resent of old ones
 				sub.newOnHold = true
 			}
-			// Copy over fields from SubState protobuf
-			sub.SubState = *recSub.Sub
-			// Add the subscription to the corresponding client
-			if s.clients.AddSub(sub.ClientID, sub) || sub.DurableName != "" {
-				// Add this subscription to subStore.
-				ss.updateState(sub)
-				// Add to the array
-				allSubs = append(allSubs, sub)
+		}
+		if sub.Filter != "" {
+			f, err := parseFilter(sub.Filter)
+			if err != nil {
+				// Don't deliver every message to a subscription that
+				// asked for some of them only.
+				Errorf("STAN: Unable to restore filter of subscription %v on subject=%s, the subscription is paused until its filter is replaced or cleared: %v",
+					sub.ID, channelName, err)
+				sub.Paused = true
+				sub.filterPaused = true
+			}
+			sub.filter = f
+		}
+		sub.rate = newRateLimiter(sub.MaxMsgsPerSec, sub.MaxBytesPerSec)
+		loadSnapshot(sub)
+		// Add the subscription to the corresponding client
+		if s.clients.AddSub(sub.ClientID, sub) || sub.DurableName != "" {
+			// Add this subscription to subStore.
+			ss.updateState(sub)
+			// And to its wildcard subscription, if any.
+			if sub.Wildcard != "" {
+				s.wildcards.addRecovered(sub)
 			}
+			// Add to the array
+			allSubs = append(allSubs, sub)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, channelName := range channels {
+		Debugf("STAN: Recovered channel=%s, subscriptions=%d", channelName, recoveredCount[channelName])
+	}
+	return allSubs, nil
+}
+
+// Moves the recovered pending messages that are scheduled for a later
+// delivery from the acksPending map to the scheduled map.
+func recoverScheduledMsgs(sub *subState, now int64) {
+	for seq := range sub.acksPending {
+		ext := sub.msgs.LookupExt(seq)
+		if ext == nil || ext.DeliverAt <= now {
+			continue
+		}
+		if sub.scheduled == nil {
+			sub.scheduled = make(map[uint64]int64)
+		}
+		sub.scheduled[seq] = ext.DeliverAt
+		delete(sub.acksPending, seq)
+	}
+}
+
+// spillRecoveredPending keeps in acksPending at most `max` of the recovered
+// pending messages of the subscription, the oldest ones, and only records
+// the sequences of the others, so that they don't hold their messages in
+// memory. They are redelivered by releaseSpilledPending() as the messages
+// kept are acknowledged. It does nothing if `max` is 0.
+func spillRecoveredPending(sub *subState, max int) {
+	if max <= 0 || len(sub.acksPending) <= max {
+		return
+	}
+	seqs := make([]uint64, 0, len(sub.acksPending))
+	for seq := range sub.acksPending {
+		seqs = append(seqs, seq)
+	}
+	sort.Sort(bySeqNo(seqs))
+	for _, seq := range seqs[max:] {
+		delete(sub.acksPending, seq)
+	}
+	// Don't keep the large array alive.
+	sub.spilled = append([]uint64(nil), seqs[max:]...)
+	Noticef("STAN: [Client:%s] Recovered %d pending messages on subject=%s, keeping %d in memory",
+		sub.ClientID, len(seqs), sub.subject, max)
+}
+
+// releaseSpilledPending moves the oldest spilled pending messages of the
+// subscription to acksPending, as long as there are less than
+// MaxRecoveredPending, looking them up from the store, and redelivers them.
+// Once they have all been released, new messages can be delivered to the
+// subscription, in which case it returns true.
+// Sub lock should be held before calling.
+func (s *StanServer) releaseSpilledPending(sub *subState) bool {
+	if len(sub.spilled) == 0 {
+		return false
+	}
+	var removed []uint64
+	n := 0
+	for ; n < len(sub.spilled) && len(sub.acksPending) < s.opts.MaxRecoveredPending; n++ {
+		seq := sub.spilled[n]
+		m, err := sub.msgs.Lookup(seq)
+		if err != nil {
+			Errorf("STAN: [Client:%s] Unable to read pending message %v, subject=%s: %v", sub.ClientID, seq, sub.subject, err)
+			break
+		}
+		if m == nil {
+			// The message has been removed from the store, forget about it.
+			removed = append(removed, seq)
+			continue
+		}
+		m.Redelivered = true
+		sub.acksPending[seq] = m
+		s.sendMsgToSub(sub, m, true)
+	}
+	if len(removed) > 0 {
+		sub.store.AckSeqPendingBatch(sub.ID, removed...)
+	}
+	sub.spilled = sub.spilled[n:]
+	if len(sub.acksPending) > 0 && sub.ackTimer == nil {
+		s.setupAckTimer(sub, sub.ackWait)
+	}
+	if len(sub.spilled) > 0 {
+		return false
+	}
+	sub.spilled = nil
+	sub.newOnHold = false
+	return true
+}
+
+// closeExpiredClients closes the recovered clients whose last contact is
+// older than ClientRecoveryMaxAge, which removes their non-durable
+// subscriptions. The recovered subscriptions that are still in use are
+// returned. Clients recovered from a store that did not persist their
+// last contact are kept.
+func (s *StanServer) closeExpiredClients(recoveredClients []*stores.Client, recoveredSubs []*subState) []*subState {
+	maxAge := s.opts.ClientRecoveryMaxAge
+	if maxAge <= 0 {
+		return recoveredSubs
+	}
+	closed := 0
+	for _, sc := range recoveredClients {
+		if sc.LastContact == 0 {
+			continue
+		}
+		lastContact := time.Unix(0, sc.LastContact)
+		if time.Since(lastContact) <= maxAge {
+			continue
+		}
+		Noticef("STAN: [Client:%s] Last contact on %v, closing it", sc.ID, lastContact.Format(time.RFC3339))
+		if s.closeClient(sc.ID, closeReasonExpired) {
+			closed++
+		}
+	}
+	if closed == 0 {
+		return recoveredSubs
+	}
+	subs := recoveredSubs[:0]
+	for _, sub := range recoveredSubs {
+		sub.RLock()
+		keep := sub.ClientID != "" || sub.DurableName != ""
+		sub.RUnlock()
+		if keep {
+			subs = append(subs, sub)
 		}
 	}
-	return allSubs
+	return subs
 }
 
 // Do some final setup. Be minded of locking here since the server
@@ -890,7 +1778,9 @@ func (s *StanServer) postRecoveryProcessing(recoveredClients []*stores.Client, r
 		sub.Lock()
 		// To be on the safe side, just check that the ackSub has not
 		// been created (may happen with durables that may reconnect maybe?)
-		if sub.ackSub == nil {
+		// Subscriptions part of a wildcard subscription share the ackSub
+		// of the wildcard subscription.
+		if sub.ackSub == nil && sub.Wildcard == "" {
 			// Subscribe to acks
 			sub.ackSub, err = s.nc.Subscribe(sub.AckInbox, s.processAckMsg)
 			if err != nil {
@@ -898,8 +1788,24 @@ func (s *StanServer) postRecoveryProcessing(recoveredClients []*stores.Client, r
 				return err
 			}
 		}
+		// Start the timer for scheduled messages, if any.
+		s.setupScheduleTimer(sub)
 		sub.Unlock()
 	}
+	// Subscribe to acks of the wildcard subscriptions.
+	s.wildcards.RLock()
+	for _, wsub := range s.wildcards.subs {
+		wsub.Lock()
+		if wsub.ackSub == nil {
+			wsub.ackSub, err = s.nc.Subscribe(wsub.template.AckInbox, s.processAckMsg)
+		}
+		wsub.Unlock()
+		if err != nil {
+			s.wildcards.RUnlock()
+			return err
+		}
+	}
+	s.wildcards.RUnlock()
 	// Go through the list of clients and ensure their Hb timer is set.
 	for _, sc := range recoveredClients {
 		c := sc.UserData.(*client)
@@ -940,8 +1846,9 @@ func (s *StanServer) performRedeliveryOnStartup(recoveredSubs []*subState) {
 		s.performAckExpirationRedelivery(sub)
 		// Regrab lock
 		sub.Lock()
-		// Allow new messages to be delivered
-		sub.newOnHold = false
+		// Allow new messages to be delivered, unless there are still
+		// recovered messages to redeliver.
+		sub.newOnHold = len(sub.spilled) > 0
 		subject := sub.subject
 		qs := sub.qstate
 		sub.Unlock()
@@ -989,12 +1896,61 @@ func (s *StanServer) initSubscriptions() {
 	if err != nil {
 		panic(fmt.Sprintf("Could not subscribe to close request subject, %v\n", err))
 	}
-
+	// Receive pause/resume requests from clients.
+	pauseSubject := fmt.Sprintf("%s.%s", DefaultPausePrefix, s.info.ClusterID)
+	_, err = s.nc.Subscribe(pauseSubject, s.processPauseRequest)
+	if err != nil {
+		panic(fmt.Sprintf("Could not subscribe to pause request subject, %v\n", err))
+	}
+	// Receive last value requests.
+	lastSubject := fmt.Sprintf("%s.%s", DefaultLastPrefix, s.info.ClusterID)
+	_, err = s.nc.Subscribe(lastSubject, s.processLastValueRequest)
+	if err != nil {
+		panic(fmt.Sprintf("Could not subscribe to last value request subject, %v\n", err))
+	}
+	// Receive fetch requests.
+	fetchSubject := fmt.Sprintf("%s.%s", DefaultFetchPrefix, s.info.ClusterID)
+	_, err = s.nc.Subscribe(fetchSubject, s.processFetchRequest)
+	if err != nil {
+		panic(fmt.Sprintf("Could not subscribe to fetch request subject, %v\n", err))
+	}
+	// Receive sequence at time requests.
+	seqTimeSubject := fmt.Sprintf("%s.%s", DefaultSeqTimePrefix, s.info.ClusterID)
+	_, err = s.nc.Subscribe(seqTimeSubject, s.processSeqAtTimeRequest)
+	if err != nil {
+		panic(fmt.Sprintf("Could not subscribe to sequence at time request subject, %v\n", err))
+	}
+	// Receive high-water mark requests.
+	hwmSubject := fmt.Sprintf("%s.%s", DefaultHWMPrefix, s.info.ClusterID)
+	_, err = s.nc.Subscribe(hwmSubject, s.processHighWaterMarkRequest)
+	if err != nil {
+		panic(fmt.Sprintf("Could not subscribe to high-water mark request subject, %v\n", err))
+	}
+	// Receive batch publish requests.
+	batchSubject := fmt.Sprintf("%s.%s", DefaultBatchPrefix, s.info.ClusterID)
+	_, err = s.nc.Subscribe(batchSubject, s.processPubBatchRequest)
+	if err != nil {
+		panic(fmt.Sprintf("Could not subscribe to batch publish request subject, %v\n", err))
+	}
+	// Receive transactional publish requests.
+	txSubject := fmt.Sprintf("%s.%s", DefaultTxPrefix, s.info.ClusterID)
+	_, err = s.nc.Subscribe(txSubject, s.processPubTxRequest)
+	if err != nil {
+		panic(fmt.Sprintf("Could not subscribe to transactional publish request subject, %v\n", err))
+	}
+
 	Debugf("STAN: Discover subject:    %s", s.info.Discovery)
 	Debugf("STAN: Publish subject:     %s", pubSubject)
 	Debugf("STAN: Subscribe subject:   %s", s.info.Subscribe)
 	Debugf("STAN: Unsubscribe subject: %s", s.info.Unsubscribe)
 	Debugf("STAN: Close subject:       %s", s.info.Close)
+	Debugf("STAN: Pause subject:       %s", pauseSubject)
+	Debugf("STAN: Last value subject:  %s", lastSubject)
+	Debugf("STAN: Fetch subject:       %s", fetchSubject)
+	Debugf("STAN: Batch subject:       %s", batchSubject)
+	Debugf("STAN: Tx subject:          %s", txSubject)
+
+	s.initAdminSubscriptions()
 
 }
 
@@ -1009,14 +1965,68 @@ func (s *StanServer) connectCB(m *nats.Msg) {
 		return
 	}
 
+	if s.isLameDuck() {
+		Debugf("STAN: [Client:%s] Connect failed; server in lame duck mode", req.ClientID)
+		s.sendConnectErr(m.Reply, ErrLameDuck.Error())
+		return
+	}
+
+	// Check the credentials, if the server has users configured.
+	ext := parseConnectRequestExt(m.Data)
+	md := &spb.ClientMetadata{ConnectTime: time.Now().UnixNano()}
+	var protocol uint32
+	if ext != nil {
+		md.Version = ext.Version
+		protocol = ext.Protocol
+	}
+	var perms *Permissions
+	if len(s.opts.Users) > 0 {
+		user := s.authenticate(ext)
+		if user == nil {
+			Errorf("STAN: [Client:%s] Connect failed; authorization violation", req.ClientID)
+			s.recordEvent(&auditRecord{Event: auditPermissionViolation, Client: req.ClientID,
+				Reason: ErrAuthorization.Error()})
+			s.sendConnectErr(m.Reply, ErrAuthorization.Error())
+			return
+		}
+		// Prevent a client from taking over the client ID, and so the
+		// durable subscriptions, of another user.
+		if !s.isClientIDAllowed(user, req.ClientID) {
+			Errorf("STAN: [Client:%s] Connect failed; client ID not allowed for this user", req.ClientID)
+			s.recordEvent(&auditRecord{Event: auditPermissionViolation, Client: req.ClientID,
+				Reason: ErrClientIDBinding.Error()})
+			s.sendConnectErr(m.Reply, ErrClientIDBinding.Error())
+			return
+		}
+		perms = &user.Permissions
+		md.User = user.Username
+	}
+	metadata, _ := md.Marshal()
+
+	// A client replacing one with the same ID is not counted.
+	if s.opts.MaxClients > 0 && !s.clients.IsValid(req.ClientID) &&
+		s.store.GetClientsCount() >= s.opts.MaxClients {
+		Errorf("STAN: [Client:%s] Connect failed; too many clients", req.ClientID)
+		s.recordEvent(&auditRecord{Event: auditLimitViolation, Client: req.ClientID,
+			Reason: ErrTooManyClients.Error()})
+		s.sendConnectErr(m.Reply, ErrTooManyClients.Error())
+		return
+	}
+
 	// Try to register
-	client, isNew, err := s.clients.Register(req.ClientID, req.HeartbeatInbox)
+	client, isNew, err := s.clients.Register(req.ClientID, req.HeartbeatInbox, perms)
 	if err != nil {
 		Debugf("STAN: [Client:%s] Error registering client: %v", req.ClientID, err)
 		s.sendConnectErr(m.Reply, err.Error())
 		return
 	}
-	// Handle duplicate IDs in a dedicated go-routine
+	// Handle duplicate IDs in a dedicated go-routine, unless the policy is
+	// to reject them.
+	if !isNew && s.opts.DupClientIDPolicy == DupClientIDReject {
+		Debugf("STAN: [Client:%s] Connect failed; already connected", req.ClientID)
+		s.sendConnectErr(m.Reply, ErrInvalidClient.Error())
+		return
+	}
 	if !isNew {
 		// Do we have a routine in progress for this client ID?
 		s.dupCIDGuard.RLock()
@@ -1066,24 +2076,46 @@ func (s *StanServer) connectCB(m *nats.Msg) {
 		}
 		// Start a go-routine to handle this connect request
 		go func() {
-			s.processConnectRequestWithDupID(client, req, m.Reply)
+			s.processConnectRequestWithDupID(client, req, perms, metadata, protocol, m.Reply)
 		}()
 		return
 	}
 
 	// Here, we accept this client's incoming connect request.
-	s.finishConnectRequest(client, req, m.Reply)
+	s.finishConnectRequest(client, req, metadata, protocol, m.Reply)
 }
 
-func (s *StanServer) finishConnectRequest(sc *stores.Client, req *pb.ConnectRequest, replyInbox string) {
+// finishConnectRequest replies to the connect request of a client that
+// supports up to the given version of the protocol, 0 if it did not say.
+func (s *StanServer) finishConnectRequest(sc *stores.Client, req *pb.ConnectRequest,
+	metadata []byte, protocol uint32, replyInbox string) {
+	// The metadata is persisted once the client is registered.
+	if _, err := s.store.UpdateClient(req.ClientID, req.HeartbeatInbox, metadata); err != nil {
+		Errorf("STAN: [Client:%s] Unable to persist client metadata: %v", req.ClientID, err)
+	}
+
 	cr := &pb.ConnectResponse{
 		PubPrefix:     s.info.Publish,
 		SubRequests:   s.info.Subscribe,
 		UnsubRequests: s.info.Unsubscribe,
 		CloseRequests: s.info.Close,
 	}
+	// Record before replying, so that the event precedes any other one
+	// caused by this client.
+	s.recordEvent(&auditRecord{Event: auditClientConnect, Client: req.ClientID,
+		Inbox: req.HeartbeatInbox})
+
+	client := sc.UserData.(*client)
+
+	// The version of the protocol, the features and the session are
+	// appended, older clients ignore them.
+	ext := connectResponseExt(protocol)
+	client.RLock()
+	ext.Session = client.session
+	client.RUnlock()
 	b, _ := cr.Marshal()
-	s.nc.Publish(replyInbox, b)
+	eb, _ := ext.Marshal()
+	s.nc.Publish(replyInbox, append(b, eb...))
 
 	s.RLock()
 	hbInterval := s.hbInterval
@@ -1091,7 +2123,6 @@ func (s *StanServer) finishConnectRequest(sc *stores.Client, req *pb.ConnectRequ
 
 	clientID := req.ClientID
 	hbInbox := req.HeartbeatInbox
-	client := sc.UserData.(*client)
 
 	// Heartbeat timer.
 	client.Lock()
@@ -1101,7 +2132,8 @@ func (s *StanServer) finishConnectRequest(sc *stores.Client, req *pb.ConnectRequ
 	Debugf("STAN: [Client:%s] Connected (Inbox=%v)", clientID, hbInbox)
 }
 
-func (s *StanServer) processConnectRequestWithDupID(sc *stores.Client, req *pb.ConnectRequest, replyInbox string) {
+func (s *StanServer) processConnectRequestWithDupID(sc *stores.Client, req *pb.ConnectRequest,
+	perms *Permissions, metadata []byte, protocol uint32, replyInbox string) {
 	sendErr := true
 
 	hbInbox := sc.HbInbox
@@ -1118,11 +2150,18 @@ func (s *StanServer) processConnectRequestWithDupID(sc *stores.Client, req *pb.C
 		s.wg.Done()
 	}()
 
-	// This is the HbInbox from the "old" client. See if it is up and
-	// running by sending a ping to that inbox.
-	if _, err := s.nc.Request(hbInbox, nil, s.dupCIDTimeout); err != nil {
+	// This is the HbInbox from the "old" client. Unless the policy is to
+	// replace it right away, see if it is up and running by sending a ping
+	// to that inbox.
+	reason := "replace policy"
+	var err error
+	if s.opts.DupClientIDPolicy != DupClientIDReplace {
+		reason = "no heartbeat answer"
+		_, err = s.nc.Request(hbInbox, nil, s.dupCIDTimeout)
+	}
+	if s.opts.DupClientIDPolicy == DupClientIDReplace || err != nil {
 		// The old client didn't reply, assume it is dead, close it and continue.
-		s.closeClient(clientID)
+		s.closeClient(clientID, closeReasonReplaced)
 
 		// Between the close and the new registration below, it is possible
 		// that a connection request came in (in connectCB) and since the
@@ -1132,10 +2171,12 @@ func (s *StanServer) processConnectRequestWithDupID(sc *stores.Client, req *pb.C
 
 		// Need to re-register now based on the new request info.
 		var isNew bool
-		sc, isNew, err = s.clients.Register(req.ClientID, req.HeartbeatInbox)
+		sc, isNew, err = s.clients.Register(req.ClientID, req.HeartbeatInbox, perms)
 		if err == nil && isNew {
 			// We could register the new client.
 			Debugf("STAN: [Client:%s] Replaced old client (Inbox=%v)", req.ClientID, hbInbox)
+			s.recordEvent(&auditRecord{Event: auditClientReplaced, Client: req.ClientID,
+				Inbox: req.HeartbeatInbox, Reason: reason})
 			sendErr = false
 		}
 	}
@@ -1147,7 +2188,7 @@ func (s *StanServer) processConnectRequestWithDupID(sc *stores.Client, req *pb.C
 		return
 	}
 	// We have replaced the old with the new.
-	s.finishConnectRequest(sc, req, replyInbox)
+	s.finishConnectRequest(sc, req, metadata, protocol, replyInbox)
 }
 
 func (s *StanServer) sendConnectErr(replyInbox, err string) {
@@ -1156,7 +2197,10 @@ func (s *StanServer) sendConnectErr(replyInbox, err string) {
 	s.nc.Publish(replyInbox, b)
 }
 
-// Send a heartbeat call to the client.
+// Send a heartbeat call to the client. A client failing more than the
+// allowed number of heartbeats is considered unreachable. It is closed
+// if it still does not answer after the purge delay. The time since which
+// it is unreachable is persisted so that a restart does not reset the delay.
 func (s *StanServer) checkClientHealth(clientID string) {
 	sc := s.store.GetClient(clientID)
 	if sc == nil {
@@ -1164,14 +2208,13 @@ func (s *StanServer) checkClientHealth(clientID string) {
 	}
 	client := sc.UserData.(*client)
 	hbInbox := sc.HbInbox
-	// Capture these under lock (as of now, there are not configurable,
-	// but we tweak them in tests and maybe they will be settable in
-	// the future)
+	// Capture these under lock since tests tweak them.
 	s.RLock()
 	hbInterval := s.hbInterval
 	hbTimeout := s.hbTimeout
 	maxFailedHB := s.maxFailedHB
 	s.RUnlock()
+	purgeDelay := s.opts.ClientPurgeDelay
 
 	client.Lock()
 	if client.unregistered {
@@ -1180,21 +2223,40 @@ func (s *StanServer) checkClientHealth(clientID string) {
 	}
 	if _, err := s.nc.Request(hbInbox, nil, hbTimeout); err != nil {
 		client.fhb++
-		if client.fhb > maxFailedHB {
-			Debugf("STAN: [Client:%s]  Timed out on hearbeats.", clientID)
-			client.Unlock()
-			s.closeClient(clientID)
-			return
+		unreachable := sc.UnreachableSince != 0
+		if client.fhb > maxFailedHB || unreachable {
+			if !unreachable && purgeDelay > 0 {
+				Noticef("STAN: [Client:%s] Unreachable, closing it if it does not answer heartbeats within %v", clientID, purgeDelay)
+				if err := s.store.SetClientUnreachable(clientID, time.Now().UnixNano()); err != nil {
+					Errorf("STAN: [Client:%s] Unable to persist unreachable state: %v", clientID, err)
+				}
+			} else if purgeDelay == 0 || time.Since(time.Unix(0, sc.UnreachableSince)) >= purgeDelay {
+				Debugf("STAN: [Client:%s]  Timed out on hearbeats.", clientID)
+				client.Unlock()
+				s.closeClient(clientID, closeReasonHeartbeat)
+				return
+			}
 		}
 	} else {
 		client.fhb = 0
+		if sc.UnreachableSince != 0 {
+			Noticef("STAN: [Client:%s] Reachable again", clientID)
+			if err := s.store.SetClientUnreachable(clientID, 0); err != nil {
+				Errorf("STAN: [Client:%s] Unable to persist unreachable state: %v", clientID, err)
+			}
+		}
+		if now := time.Now().UnixNano(); now-sc.LastContact >= int64(clientLastContactInterval) {
+			if err := s.store.SetClientLastContact(clientID, now); err != nil {
+				Errorf("STAN: [Client:%s] Unable to persist last contact: %v", clientID, err)
+			}
+		}
 	}
 	client.hbt.Reset(hbInterval)
 	client.Unlock()
 }
 
-// Close a client
-func (s *StanServer) closeClient(clientID string) bool {
+// Close a client, for the given reason.
+func (s *StanServer) closeClient(clientID, reason string) bool {
 	// Remove from our clientStore.
 	sc := s.clients.Unregister(clientID)
 	if sc == nil {
@@ -1213,7 +2275,11 @@ func (s *StanServer) closeClient(clientID string) bool {
 
 	// Remove all non-durable subscribers.
 	s.removeAllNonDurableSubscribers(client)
+	s.removeClientWildcardSubs(clientID)
+	s.removeClientPublishRate(clientID)
 
+	s.recordEvent(&auditRecord{Event: auditClientDisconnect, Client: clientID,
+		Inbox: hbInbox, Reason: reason})
 	Debugf("STAN: [Client:%s] Closed (Inbox=%v)", clientID, hbInbox)
 	return true
 }
@@ -1227,8 +2293,13 @@ func (s *StanServer) processCloseRequest(m *nats.Msg) {
 		s.sendCloseErr(m.Reply, ErrInvalidCloseReq.Error())
 		return
 	}
+	if !s.isSessionValid(req.ClientID, requestSession(m.Data)) {
+		Errorf("STAN: [Client:%s] close request with an invalid session", req.ClientID)
+		s.sendCloseErr(m.Reply, ErrInvalidSession.Error())
+		return
+	}
 
-	if !s.closeClient(req.ClientID) {
+	if !s.closeClient(req.ClientID, closeReasonRequest) {
 		Errorf("STAN: Unknown client %q in close request", req.ClientID)
 		s.sendCloseErr(m.Reply, ErrUnknownClient.Error())
 		return
@@ -1250,6 +2321,7 @@ func (s *StanServer) sendCloseErr(subj, err string) {
 func (s *StanServer) processClientPublish(m *nats.Msg) {
 	pm := &pb.PubMsg{}
 	pm.Unmarshal(m.Data)
+	pm.Subject = s.resolveChannel(pm.Subject)
 
 	// TODO (cls) error check.
 
@@ -1260,8 +2332,478 @@ func (s *StanServer) processClientPublish(m *nats.Msg) {
 		return
 	}
 
+	if s.isMirror(pm.Subject) {
+		s.sendPublishErr(m.Reply, pm.Guid, ErrMirrorChannel)
+		return
+	}
+
+	if s.isReservedChannel(pm.Subject) {
+		s.sendPublishErr(m.Reply, pm.Guid, ErrReservedChannel)
+		return
+	}
+
+	if s.isStorageFull() {
+		s.sendPublishErr(m.Reply, pm.Guid, ErrStorageFull)
+		return
+	}
+
+	if s.isMemoryBudgetExceeded() {
+		s.sendPublishErr(m.Reply, pm.Guid, ErrMemoryBudget)
+		return
+	}
+
+	if s.isReadOnly() {
+		s.sendPublishErr(m.Reply, pm.Guid, ErrReadOnly)
+		return
+	}
+
+	// The session, if any, is with the optional message attributes.
+	ext := parseMsgExt(m.Data)
+	session := ""
+	if ext != nil {
+		session = ext.Session
+	}
+	if !s.isAllowed(pm.ClientID, session, pm.Subject, true) {
+		Errorf("STAN: [Client:%s] Not allowed to publish on %s", pm.ClientID, pm.Subject)
+		s.recordEvent(&auditRecord{Event: auditPermissionViolation, Client: pm.ClientID,
+			Channel: pm.Subject, Reason: ErrPubPermission.Error()})
+		s.sendPublishErr(m.Reply, pm.Guid, ErrPubPermission)
+		return
+	}
+
+	// Not recorded as a limit violation, which would flood the audit log.
+	if err := s.checkPublishRate(pm.ClientID, pm.Subject, len(pm.Data)); err != nil {
+		Debugf("STAN: [Client:%s] Publish rate limit exceeded on %s", pm.ClientID, pm.Subject)
+		s.sendPublishErr(m.Reply, pm.Guid, err)
+		return
+	}
+
+	if err := s.validatePayload(pm.Subject, pm.Data); err != nil {
+		Debugf("STAN: [Client:%s] Rejected payload on %s: %v", pm.ClientID, pm.Subject, err)
+		s.sendPublishErr(m.Reply, pm.Guid, err)
+		return
+	}
+
+	// Bound the number of messages of this client in the IO channel.
+	var window chan struct{}
+	if max := s.opts.MaxPubInFlight; max > 0 {
+		if c := s.clients.Lookup(pm.ClientID); c != nil {
+			window = c.pubWindow(max)
+		}
+	}
+	if window != nil {
+		if s.opts.PubInFlightBlock {
+			window <- struct{}{}
+		} else {
+			select {
+			case window <- struct{}{}:
+			default:
+				// Not recorded as a limit violation either.
+				Debugf("STAN: [Client:%s] Too many published messages in flight", pm.ClientID)
+				s.sendPublishErr(m.Reply, pm.Guid, ErrMaxPubInFlight)
+				return
+			}
+		}
+	}
+
+	ext = resolveMsgExt(ext, s.clock.Now().UnixNano())
+
 	// add the message to the IO channel for batching
-	s.addMessageToIOChannel(pm, m)
+	s.addMessageToIOChannel(pm, ext, m, window)
+}
+
+// resolveMsgExt converts the relative durations of the message attributes,
+// if any, into absolute times, and returns the attributes to store, nil if
+// there are none left.
+func resolveMsgExt(ext *spb.MsgExt, now int64) *spb.MsgExt {
+	if ext == nil {
+		return nil
+	}
+	if ext.DeliverDelay > 0 {
+		ext.DeliverAt = now + ext.DeliverDelay
+		ext.DeliverDelay = 0
+	}
+	if ext.Ttl > 0 {
+		ext.Expiration = now + ext.Ttl
+		ext.Ttl = 0
+	}
+	if ext.Priority > maxMsgPriority {
+		ext.Priority = maxMsgPriority
+	}
+	// Only set by the file store.
+	ext.BatchNext = 0
+	// Only used to authorize the publish.
+	ext.Session = ""
+	if ext.Size() == 0 {
+		return nil
+	}
+	return ext
+}
+
+// processPubBatchRequest stores the messages of the request atomically:
+// either all of them are stored, with consecutive sequences, and delivered,
+// or none is. The publish checks apply to each message.
+func (s *StanServer) processPubBatchRequest(m *nats.Msg) {
+	req := &spb.PubBatchRequest{}
+	resp := &spb.PubBatchResponse{}
+	if err := req.Unmarshal(m.Data); err != nil || len(req.Msgs) == 0 || len(req.Msgs) > maxBatchMsgs ||
+		!s.clients.IsValid(req.ClientID) || !isValidSubject(req.Channel) {
+		Errorf("STAN: Invalid batch publish request from %s.", m.Subject)
+		resp.Error = ErrInvalidBatchReq.Error()
+		s.sendAdminResponse(m.Reply, resp)
+		return
+	}
+	req.Channel = s.resolveChannel(req.Channel)
+	if err := s.checkPubBatch(req); err != nil {
+		resp.Error = err.Error()
+		s.sendAdminResponse(m.Reply, resp)
+		return
+	}
+	msgs, err := toBatchMsgs(req.Msgs, s.clock.Now().UnixNano())
+	if err != nil {
+		resp.Error = ErrInvalidBatchReq.Error()
+		s.sendAdminResponse(m.Reply, resp)
+		return
+	}
+	received := time.Now()
+	cs, err := s.lookupOrCreateChannel(req.Channel, req.ClientID)
+	var stored []*pb.MsgProto
+	if err == nil {
+		stored, err = cs.Msgs.StoreBatch(msgs)
+	}
+	if err == nil {
+		err = cs.Msgs.Flush()
+	}
+	if err != nil {
+		Errorf("STAN: [Client:%s] Error storing batch for subject %q: %v", req.ClientID, req.Channel, err)
+		resp.Error = err.Error()
+		s.sendAdminResponse(m.Reply, resp)
+		return
+	}
+	recordStoreLatency(cs, received)
+	s.processMsg(cs)
+	if err := cs.Subs.Flush(); err != nil {
+		Errorf("STAN: [Client:%s] Unable to flush subscriptions of %q: %v", req.ClientID, req.Channel, err)
+	}
+	resp.FirstSequence = stored[0].Sequence
+	resp.LastSequence = stored[len(stored)-1].Sequence
+	s.sendAdminResponse(m.Reply, resp)
+}
+
+// toBatchMsgs returns the messages to store for the messages of a batch
+// or transactional publish request.
+func toBatchMsgs(bms []*spb.PubBatchMsg, now int64) ([]*stores.BatchMsg, error) {
+	msgs := make([]*stores.BatchMsg, len(bms))
+	for i, bm := range bms {
+		var ext *spb.MsgExt
+		if len(bm.Ext) > 0 {
+			ext = &spb.MsgExt{}
+			if err := ext.Unmarshal(bm.Ext); err != nil {
+				return nil, err
+			}
+			ext = resolveMsgExt(ext, now)
+		}
+		msgs[i] = &stores.BatchMsg{Data: bm.Data, Ext: ext}
+	}
+	return msgs, nil
+}
+
+// processPubTxRequest stores the messages of the request, published on
+// several channels, atomically: either all of them are stored, with
+// consecutive sequences per channel, and delivered, or none is. This
+// requires a store supporting transactions, the others fail the request
+// with stores.ErrTxNotSupported. The publish checks apply to each message.
+func (s *StanServer) processPubTxRequest(m *nats.Msg) {
+	req := &spb.PubTxRequest{}
+	resp := &spb.PubTxResponse{}
+	if err := req.Unmarshal(m.Data); err != nil || !s.isValidTxRequest(req) {
+		Errorf("STAN: Invalid transactional publish request from %s.", m.Subject)
+		resp.Error = ErrInvalidTxReq.Error()
+		s.sendAdminResponse(m.Reply, resp)
+		return
+	}
+	now := s.clock.Now().UnixNano()
+	msgs := make([][]*stores.BatchMsg, len(req.Batches))
+	for i, b := range req.Batches {
+		b.ClientID, b.Session = req.ClientID, req.Session
+		if err := s.checkPubBatch(b); err != nil {
+			resp.Error = err.Error()
+			s.sendAdminResponse(m.Reply, resp)
+			return
+		}
+		var err error
+		if msgs[i], err = toBatchMsgs(b.Msgs, now); err != nil {
+			resp.Error = ErrInvalidTxReq.Error()
+			s.sendAdminResponse(m.Reply, resp)
+			return
+		}
+	}
+	received := time.Now()
+	stored, channels, err := s.storeTx(req, msgs)
+	if err != nil {
+		Errorf("STAN: [Client:%s] Error storing transaction: %v", req.ClientID, err)
+		resp.Error = err.Error()
+		s.sendAdminResponse(m.Reply, resp)
+		return
+	}
+	for i, cs := range channels {
+		recordStoreLatency(cs, received)
+		s.processMsg(cs)
+		if err := cs.Subs.Flush(); err != nil {
+			Errorf("STAN: [Client:%s] Unable to flush subscriptions of %q: %v", req.ClientID, req.Batches[i].Channel, err)
+		}
+		n := len(msgs[i])
+		resp.Batches = append(resp.Batches, &spb.PubBatchResponse{
+			FirstSequence: stored[0].Sequence,
+			LastSequence:  stored[n-1].Sequence,
+		})
+		stored = stored[n:]
+	}
+	s.sendAdminResponse(m.Reply, resp)
+}
+
+// isValidTxRequest returns true if the request publishes on distinct
+// valid channels, with at most maxBatchMsgs messages in total. The aliases
+// of the request are replaced by their channels.
+func (s *StanServer) isValidTxRequest(req *spb.PubTxRequest) bool {
+	if !s.clients.IsValid(req.ClientID) || len(req.Batches) == 0 {
+		return false
+	}
+	total := 0
+	channels := make(map[string]struct{}, len(req.Batches))
+	for _, b := range req.Batches {
+		b.Channel = s.resolveChannel(b.Channel)
+		if _, dup := channels[b.Channel]; dup || len(b.Msgs) == 0 || !isValidSubject(b.Channel) {
+			return false
+		}
+		channels[b.Channel] = struct{}{}
+		total += len(b.Msgs)
+	}
+	return total <= maxBatchMsgs
+}
+
+// storeTx stores the messages of the transactional publish request in a
+// single transaction, creating the channels if needed. It returns the
+// stored messages in the order of the request, and the channels.
+func (s *StanServer) storeTx(req *spb.PubTxRequest, msgs [][]*stores.BatchMsg) ([]*pb.MsgProto, []*stores.ChannelStore, error) {
+	tx, err := stores.BeginTx(s.store)
+	if err != nil {
+		return nil, nil, err
+	}
+	channels := make([]*stores.ChannelStore, len(req.Batches))
+	for i, b := range req.Batches {
+		if channels[i], err = s.lookupOrCreateChannel(b.Channel, req.ClientID); err != nil {
+			tx.Rollback()
+			return nil, nil, err
+		}
+		for _, bm := range msgs[i] {
+			if err := tx.Store(b.Channel, bm); err != nil {
+				tx.Rollback()
+				return nil, nil, err
+			}
+		}
+	}
+	stored, err := tx.Commit()
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, cs := range channels {
+		if err := cs.Msgs.Flush(); err != nil {
+			return nil, nil, err
+		}
+	}
+	return stored, channels, nil
+}
+
+// checkPubBatch applies the checks of a published message to the messages
+// of the batch, returning the first error.
+func (s *StanServer) checkPubBatch(req *spb.PubBatchRequest) error {
+	if s.isMirror(req.Channel) {
+		return ErrMirrorChannel
+	}
+	if s.isReservedChannel(req.Channel) {
+		return ErrReservedChannel
+	}
+	if s.isStorageFull() {
+		return ErrStorageFull
+	}
+	if s.isMemoryBudgetExceeded() {
+		return ErrMemoryBudget
+	}
+	if s.isReadOnly() {
+		return ErrReadOnly
+	}
+	if !s.isAllowed(req.ClientID, req.Session, req.Channel, true) {
+		Errorf("STAN: [Client:%s] Not allowed to publish on %s", req.ClientID, req.Channel)
+		s.recordEvent(&auditRecord{Event: auditPermissionViolation, Client: req.ClientID,
+			Channel: req.Channel, Reason: ErrPubPermission.Error()})
+		return ErrPubPermission
+	}
+	for _, bm := range req.Msgs {
+		if err := s.checkPublishRate(req.ClientID, req.Channel, len(bm.Data)); err != nil {
+			Debugf("STAN: [Client:%s] Publish rate limit exceeded on %s", req.ClientID, req.Channel)
+			return err
+		}
+	}
+	for _, bm := range req.Msgs {
+		if err := s.validatePayload(req.Channel, bm.Data); err != nil {
+			Debugf("STAN: [Client:%s] Rejected payload on %s: %v", req.ClientID, req.Channel, err)
+			return err
+		}
+	}
+	return nil
+}
+
+// storeGatewayMsg stores a message published through the MQTT or HTTP
+// gateway, delivers it to the subscribers and returns it. The permissions
+// are nil if there are no users configured.
+func (s *StanServer) storeGatewayMsg(clientID string, perms *Permissions, channel string, data []byte) (*pb.MsgProto, error) {
+	channel = s.resolveChannel(channel)
+	if s.isMirror(channel) {
+		return nil, ErrMirrorChannel
+	}
+	if s.isReservedChannel(channel) {
+		return nil, ErrReservedChannel
+	}
+	if s.isStorageFull() {
+		return nil, ErrStorageFull
+	}
+	if s.isMemoryBudgetExceeded() {
+		return nil, ErrMemoryBudget
+	}
+	if s.isReadOnly() {
+		return nil, ErrReadOnly
+	}
+	if perms != nil && !perms.canPublish(channel) {
+		s.recordEvent(&auditRecord{Event: auditPermissionViolation, Client: clientID,
+			Channel: channel, Reason: ErrPubPermission.Error()})
+		return nil, ErrPubPermission
+	}
+	if err := s.checkPublishRate(clientID, channel, len(data)); err != nil {
+		return nil, err
+	}
+	if err := s.validatePayload(channel, data); err != nil {
+		return nil, err
+	}
+	return s.storeAndDeliver(channel, clientID, data)
+}
+
+// storeAndDeliver stores the message in the channel, created if needed,
+// and delivers it to the subscribers.
+func (s *StanServer) storeAndDeliver(channel, clientID string, data []byte) (*pb.MsgProto, error) {
+	received := time.Now()
+	cs, err := s.lookupOrCreateChannel(channel, clientID)
+	if err != nil {
+		return nil, err
+	}
+	msg, err := cs.Msgs.Store("", data, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := cs.Msgs.Flush(); err != nil {
+		return nil, err
+	}
+	recordStoreLatency(cs, received)
+	s.processMsg(cs)
+	if err := cs.Subs.Flush(); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// parseMsgExt returns the optional message attributes appended to the
+// given PubMsg bytes, or nil if there are none.
+func parseMsgExt(data []byte) *spb.MsgExt {
+	ext := &spb.MsgExt{}
+	if err := ext.Unmarshal(data); err != nil || ext.Size() == 0 {
+		return nil
+	}
+	return ext
+}
+
+// parseAckExt returns the optional attributes appended to the given Ack
+// bytes, or nil if there are none.
+func parseAckExt(data []byte) *spb.AckExt {
+	ext := &spb.AckExt{}
+	if err := ext.Unmarshal(data); err != nil || ext.Size() == 0 {
+		return nil
+	}
+	return ext
+}
+
+// parseConnectRequestExt returns the optional credentials appended to the
+// given ConnectRequest bytes, or nil if there are none.
+func parseConnectRequestExt(data []byte) *spb.ConnectRequestExt {
+	ext := &spb.ConnectRequestExt{}
+	if err := ext.Unmarshal(data); err != nil || ext.Size() == 0 {
+		return nil
+	}
+	return ext
+}
+
+// requestSession returns the session appended, in a RequestExt, to the
+// given UnsubscribeRequest or CloseRequest bytes, if any.
+func requestSession(data []byte) string {
+	ext := &spb.RequestExt{}
+	if err := ext.Unmarshal(data); err != nil {
+		return ""
+	}
+	return ext.Session
+}
+
+// parseSubRequestExt returns the optional subscription attributes appended
+// to the given SubscriptionRequest bytes, or nil if there are none.
+func parseSubRequestExt(data []byte) *spb.SubRequestExt {
+	ext := &spb.SubRequestExt{}
+	if err := ext.Unmarshal(data); err != nil || ext.Size() == 0 {
+		return nil
+	}
+	return ext
+}
+
+// withDeliveryCount returns a copy of the message attributes, which may be
+// nil, with the given delivery count.
+func withDeliveryCount(ext *spb.MsgExt, count uint32) *spb.MsgExt {
+	e := &spb.MsgExt{}
+	if ext != nil {
+		*e = *ext
+	}
+	e.DeliveryCount = count
+	return e
+}
+
+// Buffers larger than this are not put back in the pool of delivery
+// buffers, so that a few large messages don't keep memory in use.
+const maxPooledDeliveryBuf = 1024 * 1024
+
+// Pool of the buffers in which the messages are marshaled to be sent to
+// the subscriptions. Since the NATS connection copies the bytes of a
+// published message, the buffer can be reused as soon as Publish returns,
+// which saves an allocation for every delivery, in particular during the
+// replay of a large backlog.
+var deliveryBufPool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, 0, 1024)
+		return &b
+	},
+}
+
+// marshalMsgTo returns the bytes of the MsgProto, followed by the bytes of
+// the message attributes, if any, marshaled into `buf` if it is big enough.
+func marshalMsgTo(buf []byte, m *pb.MsgProto, ext *spb.MsgExt) []byte {
+	size := m.Size()
+	if ext != nil {
+		size += ext.Size()
+	}
+	if cap(buf) < size {
+		buf = make([]byte, size)
+	}
+	b := buf[:size]
+	n, _ := m.MarshalTo(b)
+	if ext != nil {
+		ext.MarshalTo(b[n:])
+	}
+	return b
 }
 
 func (s *StanServer) sendPublishErr(subj, guid string, err error) {
@@ -1273,8 +2815,12 @@ func (s *StanServer) sendPublishErr(subj, guid string, err error) {
 
 // FIXME(dlc) - place holder to pick sub that has least outstanding, should just sort,
 // or use insertion sort, etc.
-func findBestQueueSub(sl []*subState) (rsub *subState) {
+func findBestQueueSub(sl []*subState, avoid *subState) (rsub *subState) {
 	for _, sub := range sl {
+		// Skip the member to avoid, unless it is the only one.
+		if sub == avoid && len(sl) > 1 {
+			continue
+		}
 
 		if rsub == nil {
 			rsub = sub
@@ -1306,13 +2852,20 @@ func findBestQueueSub(sl []*subState) (rsub *subState) {
 	return
 }
 
-// Send a message to the queue group
+// Send a message to the queue group, to a member other than `avoid`
+// if possible (`avoid` can be nil). On partitioned channels, a message
+// with a partition key is always sent to the owner of its partition.
 // Assumes qs lock held for write
-func (s *StanServer) sendMsgToQueueGroup(qs *queueState, m *pb.MsgProto, force bool) (*subState, bool) {
+func (s *StanServer) sendMsgToQueueGroup(qs *queueState, m *pb.MsgProto, force bool, avoid *subState) (*subState, bool) {
 	if qs == nil {
 		return nil, false
 	}
-	sub := findBestQueueSub(qs.subs)
+	var sub *subState
+	if p := s.msgPartition(m); p >= 0 {
+		sub = partitionOwner(qs, p)
+	} else {
+		sub = findBestQueueSub(qs.subs, avoid)
+	}
 	if sub == nil {
 		return nil, false
 	}
@@ -1355,6 +2908,13 @@ func (a bySeq) Len() int           { return (len(a)) }
 func (a bySeq) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
 func (a bySeq) Less(i, j int) bool { return a[i].Sequence < a[j].Sequence }
 
+// Used for sorting sequence numbers
+type bySeqNo []uint64
+
+func (a bySeqNo) Len() int           { return (len(a)) }
+func (a bySeqNo) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a bySeqNo) Less(i, j int) bool { return a[i] < a[j] }
+
 func makeSortedMsgs(msgs map[uint64]*pb.MsgProto) []*pb.MsgProto {
 	results := make([]*pb.MsgProto, 0, len(msgs))
 	for _, m := range msgs {
@@ -1374,7 +2934,7 @@ func (s *StanServer) performDurableRedelivery(sub *subState) {
 	durName := sub.DurableName
 	sub.RUnlock()
 
-	Debugf("STAN: [Client:%s] Redelivering to durable %s", clientID, durName)
+	Debugf("STAN: [Client:%s] Redelivering to durable %s, subject=%s", clientID, durName, sub.subject)
 
 	// If we don't find the client, we are done.
 	client := s.clients.Lookup(clientID)
@@ -1394,10 +2954,24 @@ func (s *StanServer) performDurableRedelivery(sub *subState) {
 		s.sendMsgToSub(sub, m, true)
 		sub.Unlock()
 	}
+	// Restart the timer for scheduled messages, if any.
+	sub.Lock()
+	s.setupScheduleTimer(sub)
+	sub.Unlock()
 }
 
 // Redeliver all outstanding messages that have expired.
 func (s *StanServer) performAckExpirationRedelivery(sub *subState) {
+	// Nothing is redelivered to a paused subscription, the timer will
+	// be restarted when the subscription is resumed.
+	sub.Lock()
+	if sub.Paused {
+		sub.clearAckTimer()
+		sub.Unlock()
+		return
+	}
+	sub.Unlock()
+
 	// Sort our messages outstanding from acksPending, grab some state and unlock.
 	sub.RLock()
 	expTime := int64(sub.ackWait)
@@ -1418,11 +2992,13 @@ func (s *StanServer) performAckExpirationRedelivery(sub *subState) {
 	if client == nil {
 		return
 	}
-	// If the client has some failed heartbeats, ignore this request.
+	// If the client has some failed heartbeats, ignore this request, unless
+	// this is a queue subscriber, in which case the messages are redelivered
+	// to the other members of the group.
 	client.RLock()
 	fhbs := client.fhb
 	client.RUnlock()
-	if fhbs != 0 {
+	if fhbs != 0 && qs == nil {
 		// Reset the timer.
 		sub.Lock()
 		if sub.ackTimer != nil {
@@ -1439,7 +3015,7 @@ func (s *StanServer) performAckExpirationRedelivery(sub *subState) {
 		cs = s.store.LookupChannel(subject)
 	}
 
-	now := time.Now().UnixNano()
+	now := s.clock.Now().UnixNano()
 
 	// Check if we should force redelivery, even if subscriber is stalled.
 	shouldForce := stalledRedeliveries >= atomic.LoadInt32(&maxStalledRedeliveries)
@@ -1462,7 +3038,7 @@ func (s *StanServer) performAckExpirationRedelivery(sub *subState) {
 			// unexpired message, and we're done. Reset the sub's ack
 			// timer to fire on the next message expiration.
 			Tracef("STAN: [Client:%s] redelivery, skipping seqno=%d.", clientID, m.Sequence)
-			sub.adjustAckTimer(m.Timestamp)
+			sub.adjustAckTimer(m.Timestamp, now)
 			return
 		}
 
@@ -1472,13 +3048,13 @@ func (s *StanServer) performAckExpirationRedelivery(sub *subState) {
 		Tracef("STAN: [Client:%s] Redelivery, sending seqno=%d", clientID, m.Sequence)
 
 		// Handle QueueSubscribers differently, since we will choose best subscriber
-		// to redeliver to, not necessarily the same one.
+		// to redeliver to, preferably not the same one.
 		if qs != nil {
 			qs.Lock()
-			pick, didSend := s.sendMsgToQueueGroup(qs, m, shouldForce)
+			pick, didSend := s.sendMsgToQueueGroup(qs, m, shouldForce, sub)
 			qs.Unlock()
 			if pick == nil {
-				Errorf("STAN: [Client:%s] Unable to find queue subscriber", clientID)
+				Errorf("STAN: [Client:%s] Unable to find queue subscriber, subject=%s", clientID, subject)
 				break
 			}
 			// If the message is redelivered to a different queue subscriber,
@@ -1509,7 +3085,7 @@ func (s *StanServer) performAckExpirationRedelivery(sub *subState) {
 	}
 
 	// Adjust the timer
-	sub.adjustAckTimer(firstUnacked)
+	sub.adjustAckTimer(firstUnacked, s.clock.Now().UnixNano())
 }
 
 // Sends the message to the subscriber
@@ -1518,34 +3094,157 @@ func (s *StanServer) performAckExpirationRedelivery(sub *subState) {
 // are not sent and subscriber is marked as stalled.
 // Sub lock should be held before calling.
 func (s *StanServer) sendMsgToSub(sub *subState, m *pb.MsgProto, force bool) bool {
-	if sub == nil || m == nil || (sub.newOnHold && !m.Redelivered) {
+	if sub == nil || m == nil || (sub.newOnHold && !m.Redelivered) || sub.Paused {
+		return false
+	}
+	// In lame duck mode, only messages in flight are (re)delivered.
+	if s.isLameDuck() && sub.acksPending[m.Sequence] == nil {
 		return false
 	}
 
+	var ext *spb.MsgExt
+	if sub.msgs != nil {
+		ext = sub.msgs.LookupExt(m.Sequence)
+	}
+
+	// Skip messages that do not match the subscription's filter, unless
+	// they have already been accepted for this subscription.
+	if sub.filter != nil && sub.acksPending[m.Sequence] == nil {
+		if _, scheduled := sub.scheduled[m.Sequence]; !scheduled && !sub.filter.match(m, ext) {
+			if m.Sequence > sub.LastSent {
+				sub.LastSent = m.Sequence
+			}
+			return true
+		}
+	}
+
+	// Skip messages of the snapshot that have been superseded.
+	if sub.superseded(m.Sequence, ext) && sub.acksPending[m.Sequence] == nil {
+		if _, scheduled := sub.scheduled[m.Sequence]; !scheduled {
+			if m.Sequence > sub.LastSent {
+				sub.LastSent = m.Sequence
+			}
+			return true
+		}
+	}
+
+	// Skip messages that have already been acknowledged, if so requested.
+	if sub.isAcked(m.Sequence) {
+		s.skipMsg(sub, m, "acknowledged")
+		return true
+	}
+
+	// The attributes of a pending message are gone once the store has
+	// removed it, which it does in the background once it has expired.
+	expiration := sub.expirations[m.Sequence]
+	if ext != nil {
+		expiration = ext.Expiration
+	}
+	if ext != nil || expiration > 0 {
+		now := s.clock.Now().UnixNano()
+		// Expired messages are no longer delivered.
+		if expiration > 0 && expiration <= now {
+			s.skipMsg(sub, m, "expired")
+			return true
+		}
+		// Withhold messages that should not be delivered yet.
+		if ext != nil && ext.DeliverAt > now {
+			return s.scheduleMsgForSub(sub, m, ext.DeliverAt)
+		}
+	}
+
 	Tracef("STAN: [Client:%s] Sending msg subject=%s inbox=%s seqno=%d.",
 		sub.ClientID, m.Subject, sub.Inbox, m.Sequence)
 
 	// Don't send if we have too many outstanding already, unless forced to send.
-	if !force && (int32(len(sub.acksPending)) >= sub.MaxInFlight) {
+	if !force && sub.inFlightFull() {
 		sub.stalled = true
 		Debugf("STAN: [Client:%s] Stalled msgseq %s:%d to %s.",
 			sub.ClientID, m.Subject, m.Sequence, sub.Inbox)
 		return false
 	}
 
-	b, _ := m.Marshal()
-	if err := s.nc.Publish(sub.Inbox, b); err != nil {
-		Errorf("STAN: [Client:%s] Failed Sending msgseq %s:%d to %s (%s).",
-			sub.ClientID, m.Subject, m.Sequence, sub.Inbox, err)
-		return false
+	// Honor the delivery rate of the subscription, if any.
+	if sub.rate != nil {
+		if wait := sub.rate.reserve(len(m.Data), s.clock.Now()); wait > 0 {
+			s.setupRateTimer(sub, wait)
+			return false
+		}
 	}
 
-	// If this message is already pending, nothing else to do.
-	if sub.acksPending[m.Sequence] != nil {
-		return true
+	// On redeliveries, let the subscriber know how many times the message
+	// has been delivered. A message redelivered after a restart of the
+	// server has been delivered at least twice.
+	count := sub.deliveries[m.Sequence] + 1
+	sendExt := ext
+	if m.Redelivered {
+		if count < 2 {
+			count = 2
+		}
+		sendExt = withDeliveryCount(ext, count)
 	}
-	// Store in storage
-	if err := sub.store.AddSeqPending(sub.ID, m.Sequence); err != nil {
+	// With workers, let the subscriber know to which worker the message
+	// goes. A redelivered message goes to the same worker.
+	var worker uint32
+	if sub.hasWorkers() {
+		worker = sub.workerOf(m.Sequence)
+		sendExt = withWorker(sendExt, worker)
+	}
+
+	start := time.Now().UnixNano()
+	bp := deliveryBufPool.Get().(*[]byte)
+	b := marshalMsgTo(*bp, m, sendExt)
+	err := s.nc.Publish(sub.Inbox, b)
+	if cap(b) <= maxPooledDeliveryBuf {
+		*bp = b[:0]
+		deliveryBufPool.Put(bp)
+	}
+	if err != nil {
+		Errorf("STAN: [Client:%s] Failed Sending msgseq %s:%d to %s (%s).",
+			sub.ClientID, m.Subject, m.Sequence, sub.Inbox, err)
+		return false
+	}
+	if ext != nil && s.tracer != nil {
+		name := "deliver"
+		if m.Redelivered {
+			name = "redeliver"
+		}
+		s.tracer.traceMsg(name, spanKindProducer, start, sub, m, ext)
+	}
+	if !m.Redelivered {
+		if stats := s.channelStats(m.Subject); stats != nil {
+			stats.deliveryLag.record(time.Duration(start - m.Timestamp))
+		}
+	}
+	if sub.sentTimes == nil {
+		sub.sentTimes = make(map[uint64]int64)
+	}
+	sub.sentTimes[m.Sequence] = start
+	if sub.deliveries == nil {
+		sub.deliveries = make(map[uint64]uint32)
+	}
+	sub.deliveries[m.Sequence] = count
+	if expiration > 0 {
+		if sub.expirations == nil {
+			sub.expirations = make(map[uint64]int64)
+		}
+		sub.expirations[m.Sequence] = expiration
+	}
+	if sub.hasWorkers() {
+		sub.assignWorker(m.Sequence, worker)
+	}
+	if m.Redelivered {
+		sub.redeliveries++
+	}
+
+	// If this message is already pending, nothing else to do.
+	if sub.acksPending[m.Sequence] != nil {
+		return true
+	}
+	// Store in storage, unless this was done when the message was scheduled.
+	if _, scheduled := sub.scheduled[m.Sequence]; scheduled {
+		delete(sub.scheduled, m.Sequence)
+	} else if err := s.retryStoreWrite(func() error { return stores.AddSeqPendingBefore(sub.store, s.storeDeadline(), sub.ID, m.Sequence) }); err != nil {
 		Errorf("STAN: [Client:%s] Unable to update subscription for %s:%v (%v)",
 			sub.ClientID, m.Subject, m.Sequence, err)
 		return false
@@ -1571,11 +3270,195 @@ func (s *StanServer) sendMsgToSub(sub *subState, m *pb.MsgProto, force bool) boo
 // Sets up the ackTimer to fire at the given duration.
 // sub's lock held on entry.
 func (s *StanServer) setupAckTimer(sub *subState, d time.Duration) {
-	sub.ackTimer = time.AfterFunc(d, func() {
+	sub.ackTimer = s.clock.AfterFunc(d, func() {
 		s.performAckExpirationRedelivery(sub)
 	})
 }
 
+// Withholds the delivery of the message `m` to the subscriber until `deliverAt`.
+// The message is recorded as pending in the store so that it is not lost if
+// the server restarts, but it does not count against MaxInFlight and no
+// redelivery timer is started until the message is actually sent.
+// Sub lock should be held before calling.
+func (s *StanServer) scheduleMsgForSub(sub *subState, m *pb.MsgProto, deliverAt int64) bool {
+	if _, scheduled := sub.scheduled[m.Sequence]; !scheduled {
+		if sub.acksPending[m.Sequence] != nil {
+			// Already sent, let the redelivery handle it.
+			return true
+		}
+		if err := s.retryStoreWrite(func() error { return stores.AddSeqPendingBefore(sub.store, s.storeDeadline(), sub.ID, m.Sequence) }); err != nil {
+			Errorf("STAN: [Client:%s] Unable to update subscription for %s:%v (%v)",
+				sub.ClientID, m.Subject, m.Sequence, err)
+			return false
+		}
+		if sub.scheduled == nil {
+			sub.scheduled = make(map[uint64]int64)
+		}
+		sub.scheduled[m.Sequence] = deliverAt
+		Tracef("STAN: [Client:%s] Scheduled msgseq %s:%d to %s for %v.",
+			sub.ClientID, m.Subject, m.Sequence, sub.Inbox, time.Unix(0, deliverAt))
+	}
+	// Update LastSent if applicable
+	if m.Sequence > sub.LastSent {
+		sub.LastSent = m.Sequence
+	}
+	s.setupScheduleTimer(sub)
+	return true
+}
+
+// Skips the delivery of the message `m`, expired or already acknowledged
+// as indicated by `why`. If the message was pending or scheduled for this
+// subscriber, it is removed as if it was acknowledged.
+// Sub lock should be held before calling.
+func (s *StanServer) skipMsg(sub *subState, m *pb.MsgProto, why string) {
+	Tracef("STAN: [Client:%s] Skipping %s msgseq %s:%d to %s.",
+		sub.ClientID, why, m.Subject, m.Sequence, sub.Inbox)
+
+	_, scheduled := sub.scheduled[m.Sequence]
+	if scheduled || sub.acksPending[m.Sequence] != nil {
+		if err := s.retryStoreWrite(func() error { return stores.AckSeqPendingBefore(sub.store, s.storeDeadline(), sub.ID, m.Sequence) }); err != nil {
+			Errorf("STAN: [Client:%s] Unable to persist ack for %s:%v (%v)",
+				sub.ClientID, m.Subject, m.Sequence, err)
+		}
+		delete(sub.scheduled, m.Sequence)
+		delete(sub.naks, m.Sequence)
+		delete(sub.acksPending, m.Sequence)
+		delete(sub.sentTimes, m.Sequence)
+		delete(sub.deliveries, m.Sequence)
+		delete(sub.expirations, m.Sequence)
+		sub.releaseWorker(m.Sequence)
+		if !sub.inFlightFull() {
+			sub.stalled = false
+		}
+	}
+	// Update LastSent if applicable
+	if m.Sequence > sub.LastSent {
+		sub.LastSent = m.Sequence
+	}
+}
+
+// Sets up the schedTimer to fire when the earliest scheduled message
+// is due, or clears it if there is no scheduled message.
+// Sub lock should be held before calling.
+func (s *StanServer) setupScheduleTimer(sub *subState) {
+	next := int64(0)
+	for _, deliverAt := range sub.scheduled {
+		if deliverAt == heldForPriority {
+			continue
+		}
+		if next == 0 || deliverAt < next {
+			next = deliverAt
+		}
+	}
+	if next == 0 || sub.ClientID == "" || sub.Paused {
+		sub.clearScheduleTimer()
+		return
+	}
+	fireIn := time.Duration(next - s.clock.Now().UnixNano())
+	if fireIn < 0 {
+		fireIn = 0
+	}
+	if sub.schedTimer == nil {
+		sub.schedTimer = s.clock.AfterFunc(fireIn, func() {
+			s.performScheduledDelivery(sub)
+		})
+	} else {
+		sub.schedTimer.Reset(fireIn)
+	}
+}
+
+// Sends the scheduled messages that are now due.
+func (s *StanServer) performScheduledDelivery(sub *subState) {
+	sub.Lock()
+	defer sub.Unlock()
+
+	// Possible that the subscriber has been destroyed, and timer cleared
+	if sub.schedTimer == nil {
+		return
+	}
+	now := s.clock.Now().UnixNano()
+	due := make([]uint64, 0, len(sub.scheduled))
+	for seq, deliverAt := range sub.scheduled {
+		if deliverAt <= now {
+			due = append(due, seq)
+		}
+	}
+	sort.Sort(bySeqNo(due))
+	var removed []uint64
+	for _, seq := range due {
+		m, err := sub.msgs.Lookup(seq)
+		if err != nil {
+			// Don't forget about a message that can't be read.
+			Errorf("STAN: [Client:%s] Unable to read scheduled message %v, subject=%s: %v", sub.ClientID, seq, sub.subject, err)
+			sub.scheduled[seq] = now + int64(sub.ackWait)
+			continue
+		}
+		if m == nil {
+			// The message has been removed from the store, forget about it.
+			delete(sub.scheduled, seq)
+			delete(sub.naks, seq)
+			removed = append(removed, seq)
+			continue
+		}
+		// Redelivery of a message that was negatively acknowledged.
+		if _, nak := sub.naks[seq]; nak {
+			mCopy := *m // copy since we need to set redelivered flag.
+			mCopy.Redelivered = true
+			m = &mCopy
+		}
+		// The message has been accepted for this subscriber when it
+		// was scheduled, so force the delivery.
+		if !s.sendMsgToSub(sub, m, true) {
+			// Try again later.
+			sub.scheduled[seq] = now + int64(sub.ackWait)
+		} else {
+			delete(sub.naks, seq)
+		}
+	}
+	if len(removed) > 0 {
+		sub.store.AckSeqPendingBatch(sub.ID, removed...)
+	}
+	s.setupScheduleTimer(sub)
+}
+
+// Sets up the rateTimer to resume the delivery after the given duration,
+// unless it is already set.
+// Sub lock should be held before calling.
+func (s *StanServer) setupRateTimer(sub *subState, d time.Duration) {
+	if sub.rateTimer != nil {
+		return
+	}
+	sub.rateTimer = s.clock.AfterFunc(d, func() {
+		s.performRateLimitedDelivery(sub)
+	})
+}
+
+// Resumes the delivery of the messages that were held back by the
+// delivery rate of the subscription, starting with the redeliveries.
+func (s *StanServer) performRateLimitedDelivery(sub *subState) {
+	sub.Lock()
+	// Possible that the subscriber has been destroyed, and timer cleared
+	if sub.rateTimer == nil {
+		sub.Unlock()
+		return
+	}
+	sub.rateTimer = nil
+	subject := sub.subject
+	redeliver := len(sub.acksPending) > 0
+	if redeliver && sub.ackTimer == nil {
+		// performAckExpirationRedelivery needs the timer to be set.
+		s.setupAckTimer(sub, sub.ackWait)
+	}
+	sub.Unlock()
+
+	if redeliver {
+		s.performAckExpirationRedelivery(sub)
+	}
+	if cs := s.store.LookupChannel(subject); cs != nil {
+		s.sendAvailableMessages(cs, sub)
+	}
+}
+
 func (s *StanServer) startStoreIOWriter() {
 	s.wg.Add(1)
 	s.ioChannel = make(chan (*ioPendingMsg), ioChannelSize)
@@ -1601,11 +3484,18 @@ func (s *StanServer) storeIOLoop() {
 	var pendingMsgs = _pendingMsgs[:0]
 
 	storeIOPendingMsg := func(iopm *ioPendingMsg) {
-		cs, err := s.assignAndStore(iopm.pm)
+		if iopm.span != nil {
+			iopm.storeSpan = iopm.span.child("store", spanKindInternal, time.Now().UnixNano())
+		}
+		cs, err := s.assignAndStore(iopm.pm, iopm.ext)
 		if err != nil {
 			Errorf("STAN: [Client:%s] Error processing message for subject %q: %v", iopm.pm.ClientID, iopm.m.Subject, err)
 			s.sendPublishErr(iopm.m.Reply, iopm.pm.Guid, err)
+			iopm.releaseWindow()
+			s.tracer.finish(iopm.storeSpan, err)
+			s.tracer.finish(iopm.span, err)
 		} else {
+			iopm.cs = cs
 			pendingMsgs = append(pendingMsgs, iopm)
 			storesToFlush[cs] = struct{}{}
 		}
@@ -1616,8 +3506,20 @@ func (s *StanServer) storeIOLoop() {
 	sleepDur := time.Duration(sleepTime) * time.Microsecond
 	max := 0
 
+	// The systemd watchdog is fed from this loop, between batches, so that
+	// the server is restarted if storing messages hangs.
+	var watchdog <-chan time.Time
+	if interval := sdWatchdogInterval(); s.opts.SystemdNotify && interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		watchdog = ticker.C
+	}
+
 	for {
 		select {
+		case <-watchdog:
+			s.notifySystemd(sdWatchdog)
+
 		case iopm := <-s.ioChannel:
 			// Create a new map (probably faster than deleting elements down below)
 			storesToFlush = make(map[*stores.ChannelStore]struct{})
@@ -1663,22 +3565,36 @@ func (s *StanServer) storeIOLoop() {
 			}
 
 			// flush all the stores with messages written to them...
-			for cs := range storesToFlush {
-				if err := cs.Msgs.Flush(); err != nil {
-					// TODO: Attempt recovery, notify publishers of error.
-					panic(fmt.Errorf("Unable to flush msg store: %v", err))
+			flushErr := s.retryStoreWrite(func() error { return flushStores(storesToFlush, true, s.storeDeadline()) })
+			if flushErr != nil {
+				// The messages may not be persisted, their publishers are
+				// notified of the error and may send them again.
+				Errorf("STAN: Unable to flush msg store: %v", flushErr)
+			}
+			for _, iopm := range pendingMsgs {
+				if flushErr == nil {
+					recordStoreLatency(iopm.cs, iopm.received)
 				}
-				// Call this here, so messages are sent to subscribers,
-				// which means that msg seq is added to subscription file
+				s.tracer.finish(iopm.storeSpan, flushErr)
+			}
+			// Call this here, so messages are sent to subscribers,
+			// which means that msg seq is added to subscription file
+			for cs := range storesToFlush {
 				s.processMsg(cs)
-				if err := cs.Subs.Flush(); err != nil {
-					panic(fmt.Errorf("Unable to flush sub store: %v", err))
-				}
+			}
+			if err := s.retryStoreWrite(func() error { return flushStores(storesToFlush, false, s.storeDeadline()) }); err != nil {
+				Errorf("STAN: Unable to flush sub store: %v", err)
 			}
 
 			// Ack our messages back to the publisher
 			for _, iopm := range pendingMsgs {
-				s.ackPublisher(iopm.pm, iopm.m.Reply)
+				if flushErr != nil {
+					s.sendPublishErr(iopm.m.Reply, iopm.pm.Guid, flushErr)
+				} else {
+					s.ackPublisher(iopm.pm, iopm.m.Reply)
+				}
+				iopm.releaseWindow()
+				s.tracer.finish(iopm.span, flushErr)
 			}
 
 			// clear out pending messages and store map
@@ -1690,22 +3606,140 @@ func (s *StanServer) storeIOLoop() {
 	}
 }
 
+// flushStores flushes the message stores (or the subscription stores if
+// `msgs` is false) of the given channels, before the deadline unless it is
+// zero. When there are several, they are flushed concurrently, so that a
+// store that supports group commit can sync their files in a single commit.
+func flushStores(storesToFlush map[*stores.ChannelStore]struct{}, msgs bool, deadline time.Time) error {
+	flush := func(cs *stores.ChannelStore) error {
+		if msgs {
+			return stores.FlushMsgsBefore(cs.Msgs, deadline)
+		}
+		return stores.FlushSubsBefore(cs.Subs, deadline)
+	}
+	if len(storesToFlush) == 1 {
+		for cs := range storesToFlush {
+			return flush(cs)
+		}
+	}
+	var (
+		wg       sync.WaitGroup
+		errLock  sync.Mutex
+		firstErr error
+	)
+	wg.Add(len(storesToFlush))
+	for cs := range storesToFlush {
+		go func(cs *stores.ChannelStore) {
+			defer wg.Done()
+			if err := flush(cs); err != nil {
+				errLock.Lock()
+				if firstErr == nil {
+					firstErr = err
+				}
+				errLock.Unlock()
+			}
+		}(cs)
+	}
+	wg.Wait()
+	return firstErr
+}
+
+// isStorageFull returns true if the total size of the stored messages has
+// gone above the high watermark, and has not dropped below the low
+// watermark since. The size is checked at most every storageCheckInterval.
+func (s *StanServer) isStorageFull() bool {
+	high := s.opts.StoreHighWatermark
+	if high <= 0 {
+		return false
+	}
+	s.storageLock.Lock()
+	defer s.storageLock.Unlock()
+	now := time.Now()
+	if now.Sub(s.storageLastCheck) < s.storageCheckInterval {
+		return s.storageFull
+	}
+	s.storageLastCheck = now
+	_, bytes, err := s.store.MsgsState(stores.AllChannels)
+	if err != nil {
+		return s.storageFull
+	}
+	low := s.opts.StoreLowWatermark
+	if low <= 0 || low > high {
+		low = high
+	}
+	if !s.storageFull && int64(bytes) > high {
+		s.storageFull = true
+		Errorf("STAN: Storage full (%v bytes), rejecting messages until below %v bytes", bytes, low)
+	} else if s.storageFull && int64(bytes) < low {
+		s.storageFull = false
+		Noticef("STAN: Storage below low watermark (%v bytes), accepting messages", bytes)
+	}
+	return s.storageFull
+}
+
+// isMemoryBudgetExceeded returns true if the messages kept in memory by
+// the store use more than the memory budget and the policy is to reject
+// messages. With the trim policy, the store removes the oldest messages
+// itself, so messages are always accepted.
+func (s *StanServer) isMemoryBudgetExceeded() bool {
+	if s.opts.MemoryBudget <= 0 || s.opts.MemoryBudgetPolicy == MemoryBudgetTrim {
+		return false
+	}
+	budget := s.store.MemoryBudget()
+	exceeded := budget.Exceeded()
+	if exceeded && atomic.CompareAndSwapInt32(&s.budgetExceeded, 0, 1) {
+		Errorf("STAN: Memory budget exceeded (%v bytes), rejecting messages", budget.Used())
+	} else if !exceeded && atomic.CompareAndSwapInt32(&s.budgetExceeded, 1, 0) {
+		Noticef("STAN: Memory back within budget (%v bytes), accepting messages", budget.Used())
+	}
+	return exceeded
+}
+
 // addMessageToIOChannel passes the message to the IO go routine
-func (s *StanServer) addMessageToIOChannel(publishMsg *pb.PubMsg, natsMsg *nats.Msg) {
+func (s *StanServer) addMessageToIOChannel(publishMsg *pb.PubMsg, ext *spb.MsgExt, natsMsg *nats.Msg, window chan struct{}) {
 	// TODO:  Pool/Preallocate here?
-	iopm := ioPendingMsg{pm: publishMsg, m: natsMsg}
+	iopm := ioPendingMsg{pm: publishMsg, ext: ext, m: natsMsg, window: window, received: time.Now()}
+	iopm.span = s.tracer.startPublish(publishMsg, ext)
 	s.ioChannel <- &iopm
 }
 
+// releaseWindow frees the slot of the message in its client's publish
+// window, once the publisher has been acknowledged.
+func (iopm *ioPendingMsg) releaseWindow() {
+	if iopm.window != nil {
+		<-iopm.window
+	}
+}
+
 // assignAndStore will assign a sequence ID and then store the message.
-func (s *StanServer) assignAndStore(pm *pb.PubMsg) (*stores.ChannelStore, error) {
-	cs, err := s.lookupOrCreateChannel(pm.Subject)
+func (s *StanServer) assignAndStore(pm *pb.PubMsg, ext *spb.MsgExt) (*stores.ChannelStore, error) {
+	// The server may have become read-only since the message was queued.
+	if s.isReadOnly() {
+		return nil, ErrReadOnly
+	}
+	cs, err := s.lookupOrCreateChannel(pm.Subject, pm.ClientID)
 	if err != nil {
 		return nil, err
 	}
-	if _, err := cs.Msgs.Store(pm.Reply, pm.Data); err != nil {
+	var dk *dedupKeys
+	if ext != nil && ext.DedupKey != "" {
+		dk = s.channelDedupKeys(cs, pm.Subject)
+		if dk != nil && dk.isDuplicate(ext.DedupKey, time.Now().UnixNano()) {
+			// Dropped, but acknowledged as if it had been stored.
+			Debugf("STAN: [Client:%s] Dropping duplicate message with key %q on %s", pm.ClientID, ext.DedupKey, pm.Subject)
+			return cs, nil
+		}
+	}
+	var m *pb.MsgProto
+	if err := s.retryStoreWrite(func() (err error) {
+		m, err = stores.StoreBefore(cs.Msgs, s.storeDeadline(), pm.Reply, pm.Data, ext)
+		return err
+	}); err != nil {
 		return nil, err
 	}
+	if dk != nil {
+		dk.add(ext.DedupKey, m.Timestamp)
+	}
 	return cs, nil
 }
 
@@ -1766,11 +3800,43 @@ func (s *StanServer) removeAllNonDurableSubscribers(client *client) {
 		}
 		// Get the subStore from the ChannelStore
 		ss := cs.UserData.(*subStore)
+		s.auditSub(auditSubClose, sub, "")
 		// Don't remove durables
 		ss.Remove(sub, false)
+		s.redeliverQueueSubPending(sub)
 	}
 }
 
+// redeliverQueueSubPending sends the messages that were pending on the
+// removed queue subscriber `sub` to the remaining members of its group,
+// so that they are not lost.
+func (s *StanServer) redeliverQueueSubPending(sub *subState) {
+	sub.Lock()
+	qs := sub.qstate
+	if qs == nil || len(sub.acksPending) == 0 {
+		sub.Unlock()
+		return
+	}
+	sortedMsgs := makeSortedMsgs(sub.acksPending)
+	sub.acksPending = make(map[uint64]*pb.MsgProto)
+	sub.sentTimes = nil
+	sub.deliveries = nil
+	sub.expirations = nil
+	sub.Unlock()
+
+	qs.Lock()
+	for _, m := range sortedMsgs {
+		m.Redelivered = true
+		// Force delivery since these messages were already accepted
+		// for the group.
+		if pick, _ := s.sendMsgToQueueGroup(qs, m, true, nil); pick == nil {
+			// No member left.
+			break
+		}
+	}
+	qs.Unlock()
+}
+
 // processUnSubscribeRequest will process a unsubscribe request.
 func (s *StanServer) processUnSubscribeRequest(m *nats.Msg) {
 	req := &pb.UnsubscribeRequest{}
@@ -1780,6 +3846,19 @@ func (s *StanServer) processUnSubscribeRequest(m *nats.Msg) {
 		s.sendSubscriptionResponseErr(m.Reply, ErrInvalidUnsubReq)
 		return
 	}
+	// The subscription is removed from the client of the request, so the
+	// request must come from the connection of this client.
+	if !s.isSessionValid(req.ClientID, requestSession(m.Data)) {
+		Errorf("STAN: [Client:%s] unsub request with an invalid session", req.ClientID)
+		s.sendSubscriptionResponseErr(m.Reply, ErrInvalidSession)
+		return
+	}
+
+	if isValidWildcardSubject(req.Subject) {
+		s.processWildcardUnSubscribeRequest(m, req)
+		return
+	}
+	req.Subject = s.resolveChannel(req.Subject)
 
 	cs := s.store.LookupChannel(req.Subject)
 	if cs == nil {
@@ -1807,8 +3886,11 @@ func (s *StanServer) processUnSubscribeRequest(m *nats.Msg) {
 		return
 	}
 
+	s.auditSub(auditSubUnsubscribe, sub, "")
+
 	// Remove the subscription, force removal if durable.
 	ss.Remove(sub, true)
+	s.redeliverQueueSubPending(sub)
 
 	Debugf("STAN: [Client:%s] Unsubscribing subject=%s.", req.ClientID, sub.subject)
 
@@ -1818,6 +3900,328 @@ func (s *StanServer) processUnSubscribeRequest(m *nats.Msg) {
 	s.nc.Publish(m.Reply, b)
 }
 
+// processPauseRequest pauses or resumes a subscription. While paused, a
+// subscription keeps its position and pending messages, but nothing is
+// delivered nor redelivered to it. The state is persisted, so a paused
+// durable is still paused when restarted.
+func (s *StanServer) processPauseRequest(m *nats.Msg) {
+	req := &spb.PauseRequest{}
+	if err := req.Unmarshal(m.Data); err != nil {
+		Errorf("STAN: Invalid pause request from %s.", m.Subject)
+		s.sendSubscriptionResponseErr(m.Reply, ErrInvalidPauseReq)
+		return
+	}
+	// The subscription is looked up by client ID, so the request must come
+	// from the connection of this client.
+	if !s.isSessionValid(req.ClientID, req.Session) {
+		Errorf("STAN: [Client:%s] pause request with an invalid session", req.ClientID)
+		s.sendSubscriptionResponseErr(m.Reply, ErrInvalidSession)
+		return
+	}
+
+	if isValidWildcardSubject(req.Subject) {
+		s.processWildcardPauseRequest(m, req)
+		return
+	}
+	req.Subject = s.resolveChannel(req.Subject)
+
+	var sub *subState
+	cs := s.store.LookupChannel(req.Subject)
+	if cs != nil {
+		sub = cs.UserData.(*subStore).LookupByAckInbox(req.Inbox)
+	}
+	if sub == nil {
+		Errorf("STAN: [Client:%s] pause request for missing inbox %s.",
+			req.ClientID, req.Inbox)
+		s.sendSubscriptionResponseErr(m.Reply, ErrInvalidSub)
+		return
+	}
+	sub.RLock()
+	clientID, qgroup := sub.ClientID, sub.QGroup
+	sub.RUnlock()
+	if clientID != req.ClientID {
+		Errorf("STAN: [Client:%s] pause request for subscription of another client", req.ClientID)
+		s.sendSubscriptionResponseErr(m.Reply, ErrInvalidSub)
+		return
+	}
+	if qgroup != "" {
+		Debugf("STAN: [Client:%s] Invalid pause request; queue subscribers can't be paused.",
+			req.ClientID)
+		s.sendSubscriptionResponseErr(m.Reply, ErrPauseQueue)
+		return
+	}
+	if err := s.setSubPaused(cs, sub, !req.Resume); err != nil {
+		Errorf("STAN: [Client:%s] Unable to update subscription for %s: %v",
+			req.ClientID, req.Subject, err)
+		s.sendSubscriptionResponseErr(m.Reply, err)
+		return
+	}
+
+	Debugf("STAN: [Client:%s] Subscription on subject=%s paused=%v.",
+		req.ClientID, req.Subject, !req.Resume)
+
+	// Create a non-error response
+	resp := &pb.SubscriptionResponse{AckInbox: req.Inbox}
+	b, _ := resp.Marshal()
+	s.nc.Publish(m.Reply, b)
+}
+
+// processLastValueRequest sends the latest message of the channel, or the
+// latest message with the requested key, without creating a subscription.
+func (s *StanServer) processLastValueRequest(m *nats.Msg) {
+	req := &spb.LastValueRequest{}
+	resp := &spb.LastValueResponse{}
+	if err := req.Unmarshal(m.Data); err != nil || req.Channel == "" {
+		Errorf("STAN: Invalid last value request from %s.", m.Subject)
+		resp.Error = ErrInvalidLastReq.Error()
+		s.sendAdminResponse(m.Reply, resp)
+		return
+	}
+	channel := s.resolveChannel(req.Channel)
+	if err := s.checkReadAllowed(req.ClientID, req.Session, channel); err != nil {
+		resp.Error = err.Error()
+		s.sendAdminResponse(m.Reply, resp)
+		return
+	}
+	cs := s.store.LookupChannel(channel)
+	if cs == nil {
+		resp.Error = ErrUnknownChannel.Error()
+		s.sendAdminResponse(m.Reply, resp)
+		return
+	}
+	var (
+		msg *pb.MsgProto
+		err error
+	)
+	if req.Key != "" {
+		msg, err = cs.Msgs.LastMsgForKey(req.Key)
+	} else {
+		msg, err = cs.Msgs.LastMsg()
+	}
+	if err != nil {
+		Errorf("STAN: Unable to read last message, subject=%s: %v", req.Channel, err)
+		resp.Error = err.Error()
+	} else if msg != nil {
+		resp.Msg, _ = msg.Marshal()
+	}
+	s.sendAdminResponse(m.Reply, resp)
+}
+
+// checkReadAllowed returns ErrSubPermission if the client is not allowed
+// to read the messages of the channel without a subscription, as with the
+// fetch and last value requests, which require the same permissions as a
+// subscription.
+func (s *StanServer) checkReadAllowed(clientID, session, channel string) error {
+	if s.isAllowed(clientID, session, channel, false) {
+		return nil
+	}
+	Errorf("STAN: [Client:%s] Not allowed to read %s", clientID, channel)
+	s.recordEvent(&auditRecord{Event: auditPermissionViolation, Client: clientID,
+		Channel: channel, Reason: ErrSubPermission.Error()})
+	return ErrSubPermission
+}
+
+// processSeqAtTimeRequest sends, for each channel of the request, the
+// sequence of the first message stored at or after the requested time, or
+// the next sequence of the channel if there is none. Since the stores
+// timestamp the messages when they are stored, a message stored after the
+// sequence is resolved has a later timestamp, so the sequences are
+// consistent across the channels.
+func (s *StanServer) processSeqAtTimeRequest(m *nats.Msg) {
+	req := &spb.SeqAtTimeRequest{}
+	resp := &spb.SeqAtTimeResponse{}
+	if err := req.Unmarshal(m.Data); err != nil || len(req.Channels) == 0 || req.Time < 0 {
+		Errorf("STAN: Invalid sequence at time request from %s.", m.Subject)
+		resp.Error = ErrInvalidTimeReq.Error()
+		s.sendAdminResponse(m.Reply, resp)
+		return
+	}
+	channels := make([]*stores.ChannelStore, len(req.Channels))
+	for i, channel := range req.Channels {
+		channel = s.resolveChannel(channel)
+		if err := s.checkReadAllowed(req.ClientID, req.Session, channel); err != nil {
+			resp.Error = err.Error()
+			s.sendAdminResponse(m.Reply, resp)
+			return
+		}
+		if channels[i] = s.store.LookupChannel(channel); channels[i] == nil {
+			resp.Error = ErrUnknownChannel.Error()
+			s.sendAdminResponse(m.Reply, resp)
+			return
+		}
+	}
+	resp.Time = req.Time
+	if resp.Time == 0 {
+		resp.Time = time.Now().UnixNano()
+	}
+	resp.Sequences = make([]uint64, len(channels))
+	for i, cs := range channels {
+		seq := cs.Msgs.GetSequenceFromTimestamp(resp.Time)
+		if seq == 0 {
+			seq = cs.Msgs.LastSequence() + 1
+		}
+		resp.Sequences[i] = seq
+	}
+	s.sendAdminResponse(m.Reply, resp)
+}
+
+// processHighWaterMarkRequest sends, for each channel of the request, the
+// sequences of its first and last messages and the timestamp of the last
+// one, so that producers can check that their messages are stored and
+// consumers can measure their lag without subscribing.
+func (s *StanServer) processHighWaterMarkRequest(m *nats.Msg) {
+	req := &spb.HighWaterMarkRequest{}
+	resp := &spb.HighWaterMarkResponse{}
+	if err := req.Unmarshal(m.Data); err != nil || len(req.Channels) == 0 {
+		Errorf("STAN: Invalid high-water mark request from %s.", m.Subject)
+		resp.Error = ErrInvalidHWMReq.Error()
+		s.sendAdminResponse(m.Reply, resp)
+		return
+	}
+	for _, channel := range req.Channels {
+		if err := s.checkReadAllowed(req.ClientID, req.Session, s.resolveChannel(channel)); err != nil {
+			resp.Error = err.Error()
+			s.sendAdminResponse(m.Reply, resp)
+			return
+		}
+	}
+	resp.Now = time.Now().UnixNano()
+	resp.Channels = make([]*spb.ChannelHighWaterMark, len(req.Channels))
+	for i, channel := range req.Channels {
+		cs := s.store.LookupChannel(s.resolveChannel(channel))
+		if cs == nil {
+			resp.Error = ErrUnknownChannel.Error()
+			resp.Channels = nil
+			s.sendAdminResponse(m.Reply, resp)
+			return
+		}
+		hwm := &spb.ChannelHighWaterMark{Channel: channel}
+		// Read the last message first: the sequences are then at least
+		// those of this message.
+		last, err := cs.Msgs.LastMsg()
+		if err != nil {
+			Errorf("STAN: Unable to read last message, subject=%s: %v", channel, err)
+			resp.Error = err.Error()
+			resp.Channels = nil
+			s.sendAdminResponse(m.Reply, resp)
+			return
+		}
+		if last != nil {
+			hwm.LastSequence = last.Sequence
+			hwm.LastTimestamp = last.Timestamp
+			hwm.FirstSequence = cs.Msgs.FirstSequence()
+		}
+		resp.Channels[i] = hwm
+	}
+	s.sendAdminResponse(m.Reply, resp)
+}
+
+// processFetchRequest sends a batch of messages of the channel, from the
+// requested sequence or time, without creating a subscription. The batch
+// is bounded by the requested number of messages, maxFetchMsgs and the
+// maximum payload of the NATS connection. Expired messages are skipped and
+// the batch stops at messages whose delivery time is not reached yet.
+func (s *StanServer) processFetchRequest(m *nats.Msg) {
+	req := &spb.FetchRequest{}
+	resp := &spb.FetchResponse{}
+	if err := req.Unmarshal(m.Data); err != nil || req.Channel == "" || req.MaxMsgs < 0 ||
+		(req.StartSequence != 0 && req.StartTime != 0) {
+		Errorf("STAN: Invalid fetch request from %s.", m.Subject)
+		resp.Error = ErrInvalidFetchReq.Error()
+		s.sendAdminResponse(m.Reply, resp)
+		return
+	}
+	channel := s.resolveChannel(req.Channel)
+	if err := s.checkReadAllowed(req.ClientID, req.Session, channel); err != nil {
+		resp.Error = err.Error()
+		s.sendAdminResponse(m.Reply, resp)
+		return
+	}
+	s.fetchMsgs(channel, req, resp)
+	s.sendAdminResponse(m.Reply, resp)
+}
+
+// fetchMsgs adds to the response the messages of the channel requested by
+// the fetch request, up to the maximum payload of the NATS connection.
+func (s *StanServer) fetchMsgs(channel string, req *spb.FetchRequest, resp *spb.FetchResponse) {
+	cs := s.store.LookupChannel(channel)
+	if cs == nil {
+		resp.Error = ErrUnknownChannel.Error()
+		return
+	}
+	maxMsgs := int(req.MaxMsgs)
+	if maxMsgs == 0 || maxMsgs > maxFetchMsgs {
+		maxMsgs = maxFetchMsgs
+	}
+	// Leave room for the other fields and the encoding of each message.
+	maxBytes := int(s.nc.MaxPayload()) - 64
+	seq := req.StartSequence
+	if req.StartTime != 0 {
+		seq = cs.Msgs.GetSequenceFromTimestamp(req.StartTime)
+	}
+	if seq == 0 {
+		seq = 1
+	}
+	now := s.clock.Now().UnixNano()
+	size := 0
+	for msg := nextAvailableMsg(cs, req.Channel, seq-1); msg != nil && len(resp.Msgs) < maxMsgs; msg = nextAvailableMsg(cs, req.Channel, msg.Sequence) {
+		if ext := cs.Msgs.LookupExt(msg.Sequence); ext != nil {
+			if ext.Expiration > 0 && ext.Expiration <= now {
+				seq = msg.Sequence + 1
+				continue
+			}
+			if ext.DeliverAt > now {
+				break
+			}
+		}
+		b, _ := msg.Marshal()
+		size += len(b) + 8
+		if len(resp.Msgs) > 0 && size > maxBytes {
+			break
+		}
+		resp.Msgs = append(resp.Msgs, b)
+		seq = msg.Sequence + 1
+	}
+	resp.NextSequence = seq
+}
+
+// setSubPaused pauses or resumes the subscription and persists this state.
+// When the subscription is resumed, the pending messages are redelivered if
+// their ack wait has expired, and the delivery of new messages resumes.
+func (s *StanServer) setSubPaused(cs *stores.ChannelStore, sub *subState, paused bool) error {
+	sub.Lock()
+	if !paused && sub.filterPaused {
+		sub.Unlock()
+		return ErrRecoveredFilter
+	}
+	if sub.Paused == paused {
+		sub.Unlock()
+		return nil
+	}
+	sub.Paused = paused
+	subUpdate := sub.SubState
+	if err := cs.Subs.UpdateSub(&subUpdate); err != nil {
+		sub.Paused = !paused
+		sub.Unlock()
+		return err
+	}
+	if paused {
+		sub.clearAckTimer()
+		sub.clearScheduleTimer()
+		sub.clearRateTimer()
+		sub.Unlock()
+		return nil
+	}
+	if len(sub.acksPending) > 0 && sub.ackTimer == nil {
+		// Let the redelivery callback find out what has expired.
+		s.setupAckTimer(sub, 0)
+	}
+	s.setupScheduleTimer(sub)
+	sub.Unlock()
+	s.sendAvailableMessages(cs, sub)
+	return nil
+}
+
 func (s *StanServer) sendSubscriptionResponseErr(reply string, err error) {
 	resp := &pb.SubscriptionResponse{Error: err.Error()}
 	b, _ := resp.Marshal()
@@ -1848,13 +4252,31 @@ func (sub *subState) clearAckTimer() {
 	}
 }
 
+// clearScheduleTimer stops the timer used for scheduled messages.
+// Sub lock held on entry.
+func (sub *subState) clearScheduleTimer() {
+	if sub.schedTimer != nil {
+		sub.schedTimer.Stop()
+		sub.schedTimer = nil
+	}
+}
+
+// clearRateTimer stops the timer used to resume a rate limited delivery.
+// Sub lock held on entry.
+func (sub *subState) clearRateTimer() {
+	if sub.rateTimer != nil {
+		sub.rateTimer.Stop()
+		sub.rateTimer = nil
+	}
+}
+
 // adjustAckTimer adjusts the timer based on a given timestamp
 // The timer will be stopped if there is no more pending ack.
 // If there are pending acks, the timer will be reset to the
 // default sub.ackWait value if the given timestamp is
 // 0 or in the past. Otherwise, it is set to the remaining time
 // between the given timestamp and now.
-func (sub *subState) adjustAckTimer(firstUnackedTimestamp int64) {
+func (sub *subState) adjustAckTimer(firstUnackedTimestamp, now int64) {
 	sub.Lock()
 	defer sub.Unlock()
 
@@ -1883,9 +4305,6 @@ func (sub *subState) adjustAckTimer(firstUnackedTimestamp int64) {
 			sub.stalledRdlv = 0
 		}
 
-		// Capture time
-		now := time.Now().UnixNano()
-
 		// ackWait in int64
 		expTime := int64(sub.ackWait)
 
@@ -1927,6 +4346,28 @@ func durableKey(sr *pb.SubscriptionRequest) string {
 	return fmt.Sprintf("%s-%s-%s", sr.ClientID, sr.Subject, sr.DurableName)
 }
 
+// clientSubsCount returns the number of subscriptions of the client. A
+// wildcard subscription counts as one, whatever the number of channels it
+// matches.
+func (s *StanServer) clientSubsCount(clientID string) int {
+	count := 0
+	for _, sub := range s.clients.GetSubs(clientID) {
+		sub.RLock()
+		if sub.Wildcard == "" {
+			count++
+		}
+		sub.RUnlock()
+	}
+	s.wildcards.RLock()
+	for _, wsub := range s.wildcards.subs {
+		if wsub.template.ClientID == clientID {
+			count++
+		}
+	}
+	s.wildcards.RUnlock()
+	return count
+}
+
 // addSubscription adds `sub` to the client and store.
 func (s *StanServer) addSubscription(ss *subStore, sub *subState) error {
 	// Store in client
@@ -1935,6 +4376,9 @@ func (s *StanServer) addSubscription(ss *subStore, sub *subState) error {
 	}
 	// Store this subscription in subStore
 	if err := ss.Store(sub); err != nil {
+		if err == stores.ErrTooManySubs {
+			return s.rejectLimit(ErrMaxSubs, subAuditRecord(auditLimitViolation, sub, err.Error()))
+		}
 		return err
 	}
 	return nil
@@ -1965,6 +4409,53 @@ func (s *StanServer) updateDurable(cs *stores.ChannelStore, ss *subStore, sub *s
 	return nil
 }
 
+// validateSubBounds checks the bounds of the AckWait and MaxInFlight of
+// the subscriptions. Since AckWait is expressed in seconds, its maximum
+// can't be less than a second.
+func validateSubBounds(opts *Options) error {
+	if opts.MinAckWait < 0 || opts.MaxAckWait < 0 || opts.MinSubInFlight < 0 || opts.MaxSubInFlight < 0 {
+		return fmt.Errorf("subscription bounds can't be negative")
+	}
+	if opts.MaxAckWait > 0 && (opts.MaxAckWait < time.Second || opts.MaxAckWait < opts.MinAckWait) {
+		return fmt.Errorf("invalid max ack wait %v (should be at least 1s and the min ack wait)", opts.MaxAckWait)
+	}
+	if opts.MaxSubInFlight > 0 && opts.MaxSubInFlight < opts.MinSubInFlight {
+		return fmt.Errorf("invalid max in flight %v (should be at least the min in flight)", opts.MaxSubInFlight)
+	}
+	return nil
+}
+
+// applySubBounds returns an error if the AckWait or the MaxInFlight of the
+// subscription request is out of the configured bounds, unless the server
+// is configured to clamp them, in which case the request is updated.
+func (s *StanServer) applySubBounds(sr *pb.SubscriptionRequest) error {
+	ackWait := time.Duration(sr.AckWaitInSecs) * time.Second
+	if s.opts.MinAckWait > 0 && ackWait < s.opts.MinAckWait {
+		if !s.opts.ClampSubBounds {
+			return ErrAckWaitBounds
+		}
+		// Round up to the next second.
+		sr.AckWaitInSecs = int32((s.opts.MinAckWait + time.Second - 1) / time.Second)
+	} else if s.opts.MaxAckWait > 0 && ackWait > s.opts.MaxAckWait {
+		if !s.opts.ClampSubBounds {
+			return ErrAckWaitBounds
+		}
+		sr.AckWaitInSecs = int32(s.opts.MaxAckWait / time.Second)
+	}
+	if s.opts.MinSubInFlight > 0 && int(sr.MaxInFlight) < s.opts.MinSubInFlight {
+		if !s.opts.ClampSubBounds {
+			return ErrInFlightBounds
+		}
+		sr.MaxInFlight = int32(s.opts.MinSubInFlight)
+	} else if s.opts.MaxSubInFlight > 0 && int(sr.MaxInFlight) > s.opts.MaxSubInFlight {
+		if !s.opts.ClampSubBounds {
+			return ErrInFlightBounds
+		}
+		sr.MaxInFlight = int32(s.opts.MaxSubInFlight)
+	}
+	return nil
+}
+
 // processSubscriptionRequest will process a subscription request.
 func (s *StanServer) processSubscriptionRequest(m *nats.Msg) {
 	sr := &pb.SubscriptionRequest{}
@@ -1974,9 +4465,84 @@ func (s *StanServer) processSubscriptionRequest(m *nats.Msg) {
 		s.sendSubscriptionResponseErr(m.Reply, ErrInvalidSubReq)
 		return
 	}
+	sr.Subject = s.resolveChannel(sr.Subject)
 
 	// FIXME(dlc) check for multiple errors, mis-configurations, etc.
 
+	// Optional server side filter
+	var filter *msgFilter
+	filterExpr := ""
+	srExt := parseSubRequestExt(m.Data)
+	if srExt == nil {
+		srExt = &spb.SubRequestExt{}
+	}
+	if srExt.Filter != "" {
+		// Can't be a queue subscriber
+		if sr.QGroup != "" {
+			Debugf("STAN: [Client:%s] Invalid subscription request; cannot have a filter and be a queue subscriber.",
+				sr.ClientID)
+			s.sendSubscriptionResponseErr(m.Reply, ErrFilterQueue)
+			return
+		}
+		if srExt.ClearFilter {
+			Debugf("STAN: [Client:%s] Invalid subscription request; cannot both set and clear a filter.",
+				sr.ClientID)
+			s.sendSubscriptionResponseErr(m.Reply, ErrInvalidFilter)
+			return
+		}
+		if filter, err = parseFilter(srExt.Filter); err != nil {
+			Debugf("STAN: [Client:%s] Invalid filter in subscription request from %s: %v",
+				sr.ClientID, m.Subject, err)
+			s.sendSubscriptionResponseErr(m.Reply, ErrInvalidFilter)
+			return
+		}
+		filterExpr = srExt.Filter
+	}
+	// Optional delivery rate
+	if srExt.MaxMsgsPerSec != 0 || srExt.MaxBytesPerSec != 0 {
+		if srExt.MaxMsgsPerSec < 0 || srExt.MaxBytesPerSec < 0 {
+			Debugf("STAN: [Client:%s] Invalid delivery rate in subscription request from %s.",
+				sr.ClientID, m.Subject)
+			s.sendSubscriptionResponseErr(m.Reply, ErrInvalidRate)
+			return
+		}
+		// Can't be a queue subscriber
+		if sr.QGroup != "" {
+			Debugf("STAN: [Client:%s] Invalid subscription request; cannot have a delivery rate and be a queue subscriber.",
+				sr.ClientID)
+			s.sendSubscriptionResponseErr(m.Reply, ErrRateQueue)
+			return
+		}
+	}
+	// Suppression of redeliveries is per subscriber
+	if srExt.Dedup && sr.QGroup != "" {
+		Debugf("STAN: [Client:%s] Invalid subscription request; cannot suppress redeliveries and be a queue subscriber.",
+			sr.ClientID)
+		s.sendSubscriptionResponseErr(m.Reply, ErrDedupQueue)
+		return
+	}
+	// Optional workers, which can't be combined with a queue group since
+	// its members already are the workers.
+	if srExt.Workers > maxSubWorkers {
+		Debugf("STAN: [Client:%s] Invalid number of workers in subscription request from %s.",
+			sr.ClientID, m.Subject)
+		s.sendSubscriptionResponseErr(m.Reply, ErrInvalidWorkers)
+		return
+	}
+	if srExt.Workers > 1 && sr.QGroup != "" {
+		Debugf("STAN: [Client:%s] Invalid subscription request; cannot have workers and be a queue subscriber.",
+			sr.ClientID)
+		s.sendSubscriptionResponseErr(m.Reply, ErrWorkersQueue)
+		return
+	}
+	// Same for the snapshot
+	if srExt.Snapshot && sr.QGroup != "" {
+		Debugf("STAN: [Client:%s] Invalid subscription request; cannot start with a snapshot and be a queue subscriber.",
+			sr.ClientID)
+		s.sendSubscriptionResponseErr(m.Reply, ErrSnapshotQueue)
+		return
+	}
+
 	// AckWait must be >= 1s
 	if sr.AckWaitInSecs <= 0 {
 		Debugf("STAN: [Client:%s] Invalid AckWait in subscription request from %s.",
@@ -1985,8 +4551,17 @@ func (s *StanServer) processSubscriptionRequest(m *nats.Msg) {
 		return
 	}
 
+	// AckWait and MaxInFlight must be within the configured bounds.
+	if err := s.applySubBounds(sr); err != nil {
+		Debugf("STAN: [Client:%s] Invalid subscription request from %s: %v",
+			sr.ClientID, m.Subject, err)
+		s.sendSubscriptionResponseErr(m.Reply, err)
+		return
+	}
+
 	// Make sure subject is valid
-	if !isValidSubject(sr.Subject) {
+	wildcard := isValidWildcardSubject(sr.Subject)
+	if !wildcard && !isValidSubject(sr.Subject) {
 		Debugf("STAN: [Client:%s] Invalid subject <%s> in subscription request from %s.",
 			sr.ClientID, sr.Subject, m.Subject)
 		s.sendSubscriptionResponseErr(m.Reply, ErrInvalidSubject)
@@ -2001,8 +4576,57 @@ func (s *StanServer) processSubscriptionRequest(m *nats.Msg) {
 		return
 	}
 
+	if s.isLameDuck() {
+		Debugf("STAN: [Client:%s] Subscription on %s rejected; server in lame duck mode",
+			sr.ClientID, sr.Subject)
+		s.sendSubscriptionResponseErr(m.Reply, ErrLameDuck)
+		return
+	}
+
+	// Check permissions before creating the channel.
+	if !s.isAllowed(sr.ClientID, srExt.Session, sr.Subject, false) {
+		Errorf("STAN: [Client:%s] Not allowed to subscribe on %s", sr.ClientID, sr.Subject)
+		s.recordEvent(&auditRecord{Event: auditPermissionViolation, Client: sr.ClientID,
+			Channel: sr.Subject, Reason: ErrSubPermission.Error()})
+		s.sendSubscriptionResponseErr(m.Reply, ErrSubPermission)
+		return
+	}
+
+	// The messages can be delivered to a subject chosen by the application
+	// instead of an inbox, as long as it is a plain subject that is not
+	// used by the server, and the client is allowed to.
+	if !isInbox(sr.Inbox) {
+		if !isValidSubject(sr.Inbox) || s.isInternalSubject(sr.Inbox) {
+			Debugf("STAN: [Client:%s] Invalid delivery subject <%s> in subscription request from %s.",
+				sr.ClientID, sr.Inbox, m.Subject)
+			s.sendSubscriptionResponseErr(m.Reply, ErrDeliverSubject)
+			return
+		}
+		if !s.isDeliverAllowed(sr.ClientID, srExt.Session, sr.Inbox) {
+			Errorf("STAN: [Client:%s] Not allowed to deliver %s to %s", sr.ClientID, sr.Subject, sr.Inbox)
+			s.recordEvent(&auditRecord{Event: auditPermissionViolation, Client: sr.ClientID,
+				Channel: sr.Subject, Inbox: sr.Inbox, Reason: ErrDeliverPerm.Error()})
+			s.sendSubscriptionResponseErr(m.Reply, ErrDeliverPerm)
+			return
+		}
+	}
+
+	if s.opts.MaxSubsPerClient > 0 && s.clientSubsCount(sr.ClientID) >= s.opts.MaxSubsPerClient {
+		Errorf("STAN: [Client:%s] Subscription on %s rejected; too many subscriptions", sr.ClientID, sr.Subject)
+		s.recordEvent(&auditRecord{Event: auditLimitViolation, Client: sr.ClientID,
+			Channel: sr.Subject, Reason: ErrMaxClientSubs.Error()})
+		s.sendSubscriptionResponseErr(m.Reply, ErrMaxClientSubs)
+		return
+	}
+
+	// A wildcard subscription is made of a subscription per matching channel.
+	if wildcard {
+		s.processWildcardSubscriptionRequest(m, sr, srExt, filter)
+		return
+	}
+
 	// Grab channel state, create a new one if needed.
-	cs, err := s.lookupOrCreateChannel(sr.Subject)
+	cs, err := s.lookupOrCreateChannel(sr.Subject, sr.ClientID)
 	if err != nil {
 		Errorf("STAN: Unable to create store for subject %s.", sr.Subject)
 		s.sendSubscriptionResponseErr(m.Reply, err)
@@ -2011,6 +4635,15 @@ func (s *StanServer) processSubscriptionRequest(m *nats.Msg) {
 	// Get the subStore
 	ss := cs.UserData.(*subStore)
 
+	if sr.QGroup != "" && s.opts.MaxQueueMembers > 0 && ss.queueMembersCount(sr.QGroup) >= s.opts.MaxQueueMembers {
+		Errorf("STAN: [Client:%s] Subscription on %s rejected; too many members in queue group %s",
+			sr.ClientID, sr.Subject, sr.QGroup)
+		s.recordEvent(&auditRecord{Event: auditLimitViolation, Client: sr.ClientID,
+			Channel: sr.Subject, Reason: ErrMaxQueueMembers.Error()})
+		s.sendSubscriptionResponseErr(m.Reply, ErrMaxQueueMembers)
+		return
+	}
+
 	var sub *subState
 
 	ackInbox := nats.NewInbox()
@@ -2028,6 +4661,7 @@ func (s *StanServer) processSubscriptionRequest(m *nats.Msg) {
 		if sub = ss.LookupByDurable(durableKey(sr)); sub != nil {
 			sub.RLock()
 			clientID := sub.ClientID
+			filterPaused := sub.filterPaused
 			sub.RUnlock()
 			if clientID != "" {
 				Debugf("STAN: [Client:%s] Invalid client id in subscription request from %s.",
@@ -2035,16 +4669,16 @@ func (s *StanServer) processSubscriptionRequest(m *nats.Msg) {
 				s.sendSubscriptionResponseErr(m.Reply, ErrDupDurable)
 				return
 			}
-			// ok we have a remembered subscription
-			// FIXME(dlc) - Do we error on options? They should be ignored if the new conflicts with old.
-			sub.Lock()
-			// Set ClientID and new AckInbox but leave LastSent to the
-			// remembered value.
-			sub.AckInbox = ackInbox
-			sub.ClientID = sr.ClientID
-			sub.Inbox = sr.Inbox
-			sub.stalled = false
-			sub.Unlock()
+			// A durable whose filter could not be restored can only be
+			// resumed with a new filter, or with its filter removed.
+			if filterPaused && filter == nil && !srExt.ClearFilter {
+				Debugf("STAN: [Client:%s] Invalid subscription request; the filter of the durable must be replaced or cleared.",
+					sr.ClientID)
+				s.sendSubscriptionResponseErr(m.Reply, ErrRecoveredFilter)
+				return
+			}
+			// ok we have a remembered subscription, which is updated
+			// once the request is validated.
 		}
 	}
 
@@ -2057,6 +4691,17 @@ func (s *StanServer) processSubscriptionRequest(m *nats.Msg) {
 			return
 		}
 	}
+	// The start sequence of the extension can also be the next sequence
+	// of the channel, as returned by a sequence at time request.
+	if srExt.StartSequence != 0 {
+		first, last := cs.Msgs.FirstAndLastSequence()
+		if srExt.StartSequence > last+1 || (first != 0 && srExt.StartSequence < first) {
+			Debugf("STAN: [Client:%s] Invalid start sequence in subscription request from %s.",
+				sr.ClientID, m.Subject)
+			s.sendSubscriptionResponseErr(m.Reply, ErrInvalidSequence)
+			return
+		}
+	}
 	// Check for SequenceTime out of range
 	if sr.StartPosition == pb.StartPosition_TimeDeltaStart {
 		startTime := time.Now().UnixNano() - sr.StartTimeDelta
@@ -2072,27 +4717,80 @@ func (s *StanServer) processSubscriptionRequest(m *nats.Msg) {
 	if sub == nil {
 		sub = &subState{
 			SubState: spb.SubState{
-				ClientID:      sr.ClientID,
-				QGroup:        sr.QGroup,
-				Inbox:         sr.Inbox,
-				AckInbox:      ackInbox,
-				MaxInFlight:   sr.MaxInFlight,
-				AckWaitInSecs: sr.AckWaitInSecs,
-				DurableName:   sr.DurableName,
+				ClientID:       sr.ClientID,
+				QGroup:         sr.QGroup,
+				Inbox:          sr.Inbox,
+				AckInbox:       ackInbox,
+				MaxInFlight:    sr.MaxInFlight,
+				AckWaitInSecs:  sr.AckWaitInSecs,
+				DurableName:    sr.DurableName,
+				Filter:         filterExpr,
+				MaxMsgsPerSec:  srExt.MaxMsgsPerSec,
+				MaxBytesPerSec: srExt.MaxBytesPerSec,
+				Dedup:          srExt.Dedup,
+				Workers:        srExt.Workers,
 			},
 			subject:     sr.Subject,
+			filter:      filter,
+			rate:        newRateLimiter(srExt.MaxMsgsPerSec, srExt.MaxBytesPerSec),
 			ackWait:     time.Duration(sr.AckWaitInSecs) * time.Second,
 			acksPending: make(map[uint64]*pb.MsgProto),
 			store:       cs.Subs,
+			msgs:        cs.Msgs,
 		}
 
 		// set the start sequence of the subscriber.
 		s.setSubStartSequence(cs, sub, sr)
+		if srExt.StartSequence != 0 {
+			sub.LastSent = srExt.StartSequence - 1
+		}
+		if srExt.Snapshot {
+			s.startSnapshot(sub)
+		}
 
 		// add the subscription to stan
 		err = s.addSubscription(ss, sub)
 	} else {
-		// Case of restarted durable subscriber
+		// Case of restarted durable subscriber, updated in one step now
+		// that the request is validated.
+		// FIXME(dlc) - Do we error on options? They should be ignored if the new conflicts with old.
+		sub.Lock()
+		// Set ClientID and new AckInbox but leave LastSent to the
+		// remembered value.
+		sub.AckInbox = ackInbox
+		sub.ClientID = sr.ClientID
+		sub.Inbox = sr.Inbox
+		sub.stalled = false
+		// The filter of the new request, if any, replaces the old one,
+		// unless the request removes it.
+		if filter != nil {
+			sub.Filter = filterExpr
+			sub.filter = filter
+		} else if srExt.ClearFilter {
+			sub.Filter = ""
+			sub.filter = nil
+		}
+		if sub.filterPaused {
+			sub.filterPaused = false
+			sub.Paused = false
+		}
+		// Same for the delivery rate.
+		if srExt.MaxMsgsPerSec != 0 || srExt.MaxBytesPerSec != 0 {
+			sub.MaxMsgsPerSec = srExt.MaxMsgsPerSec
+			sub.MaxBytesPerSec = srExt.MaxBytesPerSec
+			sub.rate = newRateLimiter(sub.MaxMsgsPerSec, sub.MaxBytesPerSec)
+		}
+		// Redeliveries can be suppressed from now on, but this can't be undone.
+		if srExt.Dedup {
+			sub.Dedup = true
+		}
+		// And the number of workers, if any, whose pending messages
+		// are assigned again on redelivery.
+		if srExt.Workers != 0 && srExt.Workers != sub.Workers {
+			sub.Workers = srExt.Workers
+			sub.resetWorkers()
+		}
+		sub.Unlock()
 		err = s.updateDurable(cs, ss, sub)
 	}
 	if err != nil {
@@ -2100,6 +4798,7 @@ func (s *StanServer) processSubscriptionRequest(m *nats.Msg) {
 		s.sendSubscriptionResponseErr(m.Reply, err)
 		return
 	}
+	s.auditSub(auditSubCreate, sub, "")
 	Debugf("STAN: [Client:%s] Added subscription on subject=%s, inbox=%s",
 		sr.ClientID, sr.Subject, sr.Inbox)
 
@@ -2146,7 +4845,87 @@ func (s *StanServer) processAckMsg(m *nats.Msg) {
 		Errorf("STAN: [Client:?] Ack received, invalid channel (%s)", ack.Subject)
 		return
 	}
-	s.processAck(cs, cs.UserData.(*subStore).LookupByAckInbox(m.Subject), ack.Sequence)
+	sub := cs.UserData.(*subStore).LookupByAckInbox(m.Subject)
+	if ext := parseAckExt(m.Data); ext != nil && ext.Nak {
+		s.processNak(cs, sub, ack.Sequence, time.Duration(ext.Delay))
+		return
+	}
+	s.processAck(cs, sub, ack.Sequence)
+}
+
+// processNak processes a negative ack. The message is redelivered right
+// away or, if a delay is given, once the delay has elapsed.
+func (s *StanServer) processNak(cs *stores.ChannelStore, sub *subState, sequence uint64, delay time.Duration) {
+	if sub == nil {
+		return
+	}
+
+	sub.Lock()
+	pm := sub.acksPending[sequence]
+	if pm == nil {
+		// Already acknowledged, or not sent yet.
+		sub.Unlock()
+		return
+	}
+	Tracef("STAN: [Client:%s] Negative ack, subj=%s, seq=%d, delay=%v",
+		sub.ClientID, sub.subject, sequence, delay)
+
+	m := *pm // copy since we need to set redelivered flag.
+	m.Redelivered = true
+	qs := sub.qstate
+
+	if delay > 0 {
+		// The message is still pending in the store, but is withheld
+		// until the delay has elapsed, as a scheduled message.
+		delete(sub.acksPending, sequence)
+		delete(sub.sentTimes, sequence)
+		sub.releaseWorker(sequence)
+		if sub.scheduled == nil {
+			sub.scheduled = make(map[uint64]int64)
+		}
+		sub.scheduled[sequence] = s.clock.Now().Add(delay).UnixNano()
+		if sub.naks == nil {
+			sub.naks = make(map[uint64]struct{})
+		}
+		sub.naks[sequence] = struct{}{}
+		s.setupScheduleTimer(sub)
+		stalled := sub.stalled
+		if !sub.inFlightFull() {
+			sub.stalled = false
+		}
+		sub.Unlock()
+		// Other messages may now be sent.
+		if qs != nil {
+			qs.Lock()
+			stalled = qs.stalled
+			qs.stalled = false
+			qs.Unlock()
+		}
+		if !stalled {
+			return
+		}
+		if qs != nil {
+			s.sendAvailableMessagesToQueue(cs, qs)
+		} else {
+			s.sendAvailableMessages(cs, sub)
+		}
+		return
+	}
+
+	if qs == nil {
+		s.sendMsgToSub(sub, &m, true)
+		sub.Unlock()
+		return
+	}
+	sub.Unlock()
+
+	// Redeliver to another member of the queue group, if possible.
+	qs.Lock()
+	pick, didSend := s.sendMsgToQueueGroup(qs, &m, true, sub)
+	qs.Unlock()
+	if pick != nil && pick != sub && didSend {
+		s.processAck(cs, sub, sequence)
+	}
 }
 
 // processAck processes an ack and if needed sends more messages.
@@ -2160,16 +4939,43 @@ func (s *StanServer) processAck(cs *stores.ChannelStore, sub *subState, sequence
 	Tracef("STAN: [Client:%s] removing pending ack, subj=%s, seq=%d",
 		sub.ClientID, sub.subject, sequence)
 
-	if err := sub.store.AckSeqPending(sub.ID, sequence); err != nil {
+	if err := s.retryStoreWrite(func() error { return stores.AckSeqPendingBefore(sub.store, s.storeDeadline(), sub.ID, sequence) }); err != nil {
 		Errorf("STAN: [Client:%s] Unable to persist ack for %s:%v (%v)",
 			sub.ClientID, sub.subject, sequence, err)
 		sub.Unlock()
 		return
 	}
+	if m := sub.acksPending[sequence]; m != nil && sub.msgs != nil && s.tracer != nil {
+		s.tracer.traceMsg("ack", spanKindServer, time.Now().UnixNano(), sub, m, sub.msgs.LookupExt(sequence))
+	}
+	// The subject of the message, not the one of the (wildcard) subscription.
+	channel := sub.subject
+	if m := sub.acksPending[sequence]; m != nil {
+		channel = m.Subject
+	}
+	if sent, ok := sub.sentTimes[sequence]; ok {
+		if stats := s.channelStats(channel); stats != nil {
+			stats.ackLatency.record(time.Duration(time.Now().UnixNano() - sent))
+		}
+		delete(sub.sentTimes, sequence)
+	}
 
 	delete(sub.acksPending, sequence)
+	delete(sub.deliveries, sequence)
+	delete(sub.expirations, sequence)
+	sub.releaseWorker(sequence)
+	// A message acknowledged while its redelivery is delayed by a negative
+	// ack does not need to be redelivered.
+	if _, nak := sub.naks[sequence]; nak {
+		delete(sub.naks, sequence)
+		delete(sub.scheduled, sequence)
+	}
+	s.recordAck(sub, sequence)
+	sub.lastAck = time.Now().UnixNano()
+	// New messages can be sent once the recovered ones have been released.
+	released := s.releaseSpilledPending(sub)
 	stalled := sub.stalled
-	if int32(len(sub.acksPending)) < sub.MaxInFlight {
+	if !sub.inFlightFull() {
 		sub.stalled = false
 	}
 
@@ -2178,6 +4984,10 @@ func (s *StanServer) processAck(cs *stores.ChannelStore, sub *subState, sequence
 	qs := sub.qstate
 	sub.Unlock()
 
+	if s.isInterestChannel(channel) {
+		s.purgeAckedMsgs(cs, channel)
+	}
+
 	if qs != nil {
 		qs.Lock()
 		stalled = qs.stalled
@@ -2185,7 +4995,7 @@ func (s *StanServer) processAck(cs *stores.ChannelStore, sub *subState, sequence
 		qs.Unlock()
 	}
 
-	if !stalled {
+	if !stalled && !released {
 		return
 	}
 
@@ -2203,12 +5013,12 @@ func (s *StanServer) sendAvailableMessagesToQueue(cs *stores.ChannelStore, qs *q
 	}
 
 	qs.Lock()
-	for nextSeq := qs.lastSent + 1; ; nextSeq++ {
-		nextMsg := cs.Msgs.Lookup(nextSeq)
-		if nextMsg == nil {
-			break
-		}
-		if _, sent := s.sendMsgToQueueGroup(qs, nextMsg, honorMaxInFlight); !sent {
+	subject := ""
+	if len(qs.subs) > 0 {
+		subject = qs.subs[0].subject
+	}
+	for nextMsg := nextAvailableMsg(cs, subject, qs.lastSent); nextMsg != nil; nextMsg = nextAvailableMsg(cs, subject, nextMsg.Sequence) {
+		if _, sent := s.sendMsgToQueueGroup(qs, nextMsg, honorMaxInFlight, nil); !sent {
 			break
 		}
 	}
@@ -2218,23 +5028,67 @@ func (s *StanServer) sendAvailableMessagesToQueue(cs *stores.ChannelStore, qs *q
 // Send any messages that are ready to be sent that have been queued.
 func (s *StanServer) sendAvailableMessages(cs *stores.ChannelStore, sub *subState) {
 	sub.Lock()
-	for nextSeq := sub.LastSent + 1; ; nextSeq++ {
-		nextMsg := cs.Msgs.Lookup(nextSeq)
-		if nextMsg == nil || s.sendMsgToSub(sub, nextMsg, honorMaxInFlight) == false {
+	if s.isPriorityChannel(sub.subject) {
+		s.sendAvailablePriorityMessages(cs, sub)
+		sub.Unlock()
+		return
+	}
+	for nextMsg := nextAvailableMsg(cs, sub.subject, sub.LastSent); nextMsg != nil; nextMsg = nextAvailableMsg(cs, sub.subject, nextMsg.Sequence) {
+		if s.sendMsgToSub(sub, nextMsg, honorMaxInFlight) == false {
 			break
 		}
 	}
 	sub.Unlock()
 }
 
+// nextAvailableMsg returns the first message stored after sequence `seq`,
+// or nil if there is none. Sequences may have gaps on compacted channels,
+// or if messages were removed due to limits. A message that can't be read
+// is not skipped: the error is logged and nil is returned, so that the
+// delivery stops there and is attempted again later.
+func nextAvailableMsg(cs *stores.ChannelStore, subject string, seq uint64) *pb.MsgProto {
+	m, err := cs.Msgs.Lookup(seq + 1)
+	if m != nil || err != nil {
+		return checkLookup(m, err, subject, seq+1)
+	}
+	first, last := cs.Msgs.FirstAndLastSequence()
+	if seq < first {
+		seq = first - 1
+	}
+	for seq++; seq <= last; seq++ {
+		if m, err := cs.Msgs.Lookup(seq); m != nil || err != nil {
+			return checkLookup(m, err, subject, seq)
+		}
+	}
+	return nil
+}
+
+// checkLookup logs the error, if any, returned by the lookup of the
+// message `seq`, and returns the message, or nil if there was an error.
+func checkLookup(m *pb.MsgProto, err error, subject string, seq uint64) *pb.MsgProto {
+	if err != nil {
+		Errorf("STAN: Unable to read message %v, delivery stopped, subject=%s: %v", seq, subject, err)
+		return nil
+	}
+	return m
+}
+
 // Check if a startTime is valid.
 func (s *StanServer) startTimeValid(cs *stores.ChannelStore, subject string, start int64) bool {
-	firstMsg := cs.Msgs.FirstMsg()
+	firstMsg, err := cs.Msgs.FirstMsg()
+	if err != nil {
+		Errorf("STAN: Unable to read first message, subject=%s: %v", subject, err)
+		return false
+	}
 	// simply no messages to return
 	if firstMsg == nil {
 		return false
 	}
-	lastMsg := cs.Msgs.LastMsg()
+	lastMsg, err := cs.Msgs.LastMsg()
+	if err != nil {
+		Errorf("STAN: Unable to read last message, subject=%s: %v", subject, err)
+		return false
+	}
 	if start > lastMsg.Timestamp || start < firstMsg.Timestamp {
 		return false
 	}
@@ -2306,6 +5160,71 @@ func (s *StanServer) ClusterID() string {
 	return s.info.ClusterID
 }
 
+// Store returns the store used by the server. Applications embedding the
+// server can use it to inspect channels, but should not modify them.
+func (s *StanServer) Store() stores.Store {
+	return s.store
+}
+
+// LameDuck puts the server in lame duck mode: new clients and subscriptions
+// are rejected and no new message is delivered, but the messages in flight
+// can still be acknowledged. Once they all are, or after the timeout (the
+// LameDuckTimeout option if 0), the store is flushed and the server shuts
+// down. This call returns once the server has shut down.
+func (s *StanServer) LameDuck(timeout time.Duration) {
+	if !atomic.CompareAndSwapInt32(&s.lameDuck, 0, 1) {
+		return
+	}
+	if timeout <= 0 {
+		timeout = s.opts.LameDuckTimeout
+	}
+	Noticef("STAN: Entering lame duck mode, waiting up to %v for messages in flight to be acknowledged", timeout)
+	deadline := time.Now().Add(timeout)
+	for s.hasPendingAcks() {
+		if time.Now().After(deadline) {
+			Noticef("STAN: Lame duck timeout reached with messages not acknowledged")
+			break
+		}
+		time.Sleep(lameDuckCheckInterval)
+	}
+	// Persist the acks received while waiting before shutting down.
+	if err := s.store.Flush(); err != nil {
+		Errorf("STAN: Unable to flush the store in lame duck mode: %v", err)
+	}
+	s.Shutdown()
+	close(s.lameDuckDone)
+}
+
+// LameDuckDone returns a channel that is closed when the server has shut
+// down at the end of the lame duck mode.
+func (s *StanServer) LameDuckDone() <-chan struct{} {
+	return s.lameDuckDone
+}
+
+func (s *StanServer) isLameDuck() bool {
+	return atomic.LoadInt32(&s.lameDuck) == 1
+}
+
+// hasPendingAcks returns true if an active subscription has messages that
+// are not yet acknowledged.
+func (s *StanServer) hasPendingAcks() bool {
+	for _, channel := range s.store.GetChannelNames() {
+		cs := s.store.LookupChannel(channel)
+		if cs == nil {
+			continue
+		}
+		for _, sub := range cs.UserData.(*subStore).getAllSubs() {
+			sub.RLock()
+			pending := len(sub.acksPending) + len(sub.spilled)
+			sub.RUnlock()
+			if pending > 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 // Shutdown will close our NATS connection and shutdown any embedded NATS server.
 func (s *StanServer) Shutdown() {
 	Debugf("STAN: Shutting down.")
@@ -2318,6 +5237,8 @@ func (s *StanServer) Shutdown() {
 
 	// Allows Shutdown() to be idempotent
 	s.shutdown = true
+	atomic.StoreInt32(&s.ready, 0)
+	s.notifySystemd(sdStopping)
 
 	// Capture under lock
 	store := s.store
@@ -2329,6 +5250,23 @@ func (s *StanServer) Shutdown() {
 	s.ioChannelQuit <- true
 	s.Unlock()
 
+	// Stop the replication and gateways before closing the store they
+	// write to.
+	s.stopMirrors()
+	s.stopMQTT()
+	s.stopHTTPGateway()
+	s.stopGRPC()
+	s.stopWebSocket()
+	s.stopWebhooks()
+	s.stopMonitoring()
+	s.stopListeners()
+	s.stopAdminSocket()
+	s.stopArchiver()
+	s.stopSlowConsumerCheck()
+	s.stopConsumerLagCheck()
+	s.stopNATSSupervision()
+	s.stopAdvisories()
+
 	// Close/Shutdown resources. Note that unless one instantiates StanServer
 	// directly (instead of calling RunServer() and the like), these should
 	// not be nil.
@@ -2344,4 +5282,7 @@ func (s *StanServer) Shutdown() {
 
 	// Wait for go-routines to return
 	s.wg.Wait()
+
+	s.audit.close()
+	s.tracer.close()
 }
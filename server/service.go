@@ -0,0 +1,33 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+//go:build !windows
+// +build !windows
+
+package server
+
+import (
+	natsd "github.com/nats-io/gnatsd/server"
+)
+
+// IsWindowsService returns true if the process was started by the Windows
+// service control manager, which is never the case on other platforms.
+func IsWindowsService() bool {
+	return false
+}
+
+// RunService returns ErrNoService: services are only supported on Windows.
+// Use the init system of the platform (systemd, launchd, ...) instead.
+func RunService(name string, stanOpts *Options, natsOpts *natsd.Options) error {
+	return ErrNoService
+}
+
+// ControlService returns ErrNoService: services are only supported on
+// Windows.
+func ControlService(name, command string, args []string) error {
+	return ErrNoService
+}
+
+// newServiceLogger returns nil, there is no event log on this platform.
+func newServiceLogger(debug, trace bool) natsd.Logger {
+	return nil
+}
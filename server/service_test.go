@@ -0,0 +1,25 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+//go:build !windows
+// +build !windows
+
+package server
+
+import (
+	"testing"
+)
+
+func TestServiceNotSupported(t *testing.T) {
+	if IsWindowsService() {
+		t.Fatal("Should not be running as a Windows service")
+	}
+	if err := ControlService(DefaultServiceName, "install", nil); err != ErrNoService {
+		t.Fatalf("Expected error %v, got %v", ErrNoService, err)
+	}
+	if err := RunService(DefaultServiceName, GetDefaultOptions(), nil); err != ErrNoService {
+		t.Fatalf("Expected error %v, got %v", ErrNoService, err)
+	}
+	if l := newServiceLogger(true, true); l != nil {
+		t.Fatalf("Expected no service logger, got %v", l)
+	}
+}
@@ -0,0 +1,211 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	natsd "github.com/nats-io/gnatsd/server"
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/eventlog"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+// Commands accepted by ControlService.
+const (
+	ServiceInstall   = "install"
+	ServiceUninstall = "uninstall"
+	ServiceStart     = "start"
+	ServiceStop      = "stop"
+)
+
+// How long ControlService waits for the service to stop.
+const serviceStopTimeout = 30 * time.Second
+
+// Name of the service, and source of the event log, set by RunService.
+var serviceName string
+
+// IsWindowsService returns true if the process was started by the Windows
+// service control manager.
+func IsWindowsService() bool {
+	interactive, err := svc.IsAnInteractiveSession()
+	return err == nil && !interactive
+}
+
+// RunService runs the server as the Windows service with the given name,
+// logging to the event log (unless a log file is configured), until the
+// service is stopped. It must be invoked from the main goroutine of a
+// process started by the service control manager.
+func RunService(name string, stanOpts *Options, natsOpts *natsd.Options) error {
+	serviceName = name
+	ConfigureLogger(stanOpts, natsOpts)
+	return svc.Run(name, &service{sOpts: stanOpts, nOpts: natsOpts})
+}
+
+// service is the handler of the requests of the service control manager.
+type service struct {
+	sOpts *Options
+	nOpts *natsd.Options
+}
+
+// Execute starts the server and reports it as running, then shuts it down
+// on a stop or shutdown request, or returns once its lame duck mode
+// completes.
+func (ws *service) Execute(args []string, requests <-chan svc.ChangeRequest, changes chan<- svc.Status) (bool, uint32) {
+	changes <- svc.Status{State: svc.StartPending}
+	s, err := StartServerWithOpts(ws.sOpts, ws.nOpts)
+	if err != nil {
+		Errorf("STAN: Unable to start the service: %v", err)
+		return true, 1
+	}
+	running := svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+	changes <- running
+	for {
+		select {
+		case r := <-requests:
+			switch r.Cmd {
+			case svc.Interrogate:
+				changes <- r.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				Noticef("STAN: Service stop requested")
+				changes <- svc.Status{State: svc.StopPending}
+				s.Shutdown()
+				return false, 0
+			default:
+				Errorf("STAN: Unexpected service control request: %v", r.Cmd)
+			}
+		case <-s.LameDuckDone():
+			changes <- svc.Status{State: svc.StopPending}
+			return false, 0
+		}
+	}
+}
+
+// ControlService installs, uninstalls, starts or stops the Windows service
+// with the given name. On install, the service is registered to run the
+// current executable with the given arguments, and to start automatically.
+func ControlService(name, command string, args []string) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("unable to connect to the service manager: %v", err)
+	}
+	defer m.Disconnect()
+	if command == ServiceInstall {
+		return installService(m, name, args)
+	}
+	s, err := m.OpenService(name)
+	if err != nil {
+		return fmt.Errorf("unable to open service %q: %v", name, err)
+	}
+	defer s.Close()
+	switch command {
+	case ServiceUninstall:
+		if err := s.Delete(); err != nil {
+			return err
+		}
+		return eventlog.Remove(name)
+	case ServiceStart:
+		return s.Start()
+	case ServiceStop:
+		status, err := s.Control(svc.Stop)
+		if err != nil {
+			return err
+		}
+		timeout := time.Now().Add(serviceStopTimeout)
+		for status.State != svc.Stopped {
+			if time.Now().After(timeout) {
+				return fmt.Errorf("service %q did not stop in %v", name, serviceStopTimeout)
+			}
+			time.Sleep(300 * time.Millisecond)
+			if status, err = s.Query(); err != nil {
+				return err
+			}
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown service command %q (should be %s, %s, %s or %s)",
+			command, ServiceInstall, ServiceUninstall, ServiceStart, ServiceStop)
+	}
+}
+
+// installService registers the service and its event log source.
+func installService(m *mgr.Mgr, name string, args []string) error {
+	exe, err := filepath.Abs(os.Args[0])
+	if err != nil {
+		return err
+	}
+	if filepath.Ext(exe) == "" {
+		exe += ".exe"
+	}
+	if s, err := m.OpenService(name); err == nil {
+		s.Close()
+		return fmt.Errorf("service %q already exists", name)
+	}
+	s, err := m.CreateService(name, exe, mgr.Config{
+		DisplayName: "NATS Streaming Server",
+		Description: "NATS Streaming Server (" + name + ")",
+		StartType:   mgr.StartAutomatic,
+	}, args...)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	if err := eventlog.InstallAsEventCreate(name, eventlog.Error|eventlog.Warning|eventlog.Info); err != nil {
+		s.Delete()
+		return fmt.Errorf("unable to register the event log source: %v", err)
+	}
+	return nil
+}
+
+// eventLogger is a NATS logger writing to the Windows event log.
+type eventLogger struct {
+	log   *eventlog.Log
+	debug bool
+	trace bool
+}
+
+// newServiceLogger returns a logger writing to the event log of the
+// service, or nil if not running as a service.
+func newServiceLogger(debug, trace bool) natsd.Logger {
+	if serviceName == "" {
+		return nil
+	}
+	el, err := eventlog.Open(serviceName)
+	if err != nil {
+		return nil
+	}
+	return &eventLogger{log: el, debug: debug, trace: trace}
+}
+
+// Noticef logs a notice as an information event.
+func (l *eventLogger) Noticef(format string, v ...interface{}) {
+	l.log.Info(1, fmt.Sprintf(format, v...))
+}
+
+// Errorf logs an error event.
+func (l *eventLogger) Errorf(format string, v ...interface{}) {
+	l.log.Error(2, fmt.Sprintf(format, v...))
+}
+
+// Fatalf logs an error event and exits.
+func (l *eventLogger) Fatalf(format string, v ...interface{}) {
+	l.log.Error(3, fmt.Sprintf(format, v...))
+	os.Exit(1)
+}
+
+// Debugf logs a debug statement as an information event, if enabled.
+func (l *eventLogger) Debugf(format string, v ...interface{}) {
+	if l.debug {
+		l.log.Info(4, fmt.Sprintf(format, v...))
+	}
+}
+
+// Tracef logs a trace statement as an information event, if enabled.
+func (l *eventLogger) Tracef(format string, v ...interface{}) {
+	if l.trace {
+		l.log.Info(5, fmt.Sprintf(format, v...))
+	}
+}
@@ -0,0 +1,34 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+//go:build !windows
+// +build !windows
+
+package server
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// HandleLameDuckSignal puts the server in lame duck mode on reception of
+// SIGUSR2.
+func HandleLameDuckSignal(s *StanServer) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGUSR2)
+	go func() {
+		<-c
+		s.LameDuck(0)
+	}()
+}
+
+// handleLogFileSignal reopens the log file on reception of SIGUSR1.
+func handleLogFileSignal() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGUSR1)
+	go func() {
+		for range c {
+			ReopenLogFile()
+		}
+	}()
+}
@@ -0,0 +1,11 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+// HandleLameDuckSignal is a no-op on Windows, which has no SIGUSR2. Lame
+// duck mode can be requested with the AdminLameDuck request instead.
+func HandleLameDuckSignal(s *StanServer) {}
+
+// handleLogFileSignal is a no-op on Windows, which has no SIGUSR1.
+// ReopenLogFile() can be invoked directly instead.
+func handleLogFileSignal() {}
@@ -0,0 +1,142 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"fmt"
+	"time"
+)
+
+// Minimum interval between two checks of the stalled subscriptions.
+const minSlowConsumerCheckInterval = 10 * time.Millisecond
+
+// SlowConsumerAdvisory describes a subscription that has not acknowledged
+// its messages fast enough.
+type SlowConsumerAdvisory struct {
+	Time          time.Time     `json:"time"`
+	ClientID      string        `json:"client_id"`
+	Channel       string        `json:"channel"`
+	Durable       string        `json:"durable,omitempty"`
+	Queue         string        `json:"queue,omitempty"`
+	Inbox         string        `json:"inbox"`
+	Pending       int           `json:"pending"`
+	MaxInFlight   int32         `json:"max_inflight"`
+	StalledFor    time.Duration `json:"stalled_for"`
+	OldestPending time.Duration `json:"oldest_pending"` // time since the oldest pending message was (re)delivered
+	Closed        bool          `json:"closed"`
+}
+
+// startSlowConsumerCheck starts checking, if enabled, for subscriptions
+// that stay at their MaxInFlight for longer than SlowConsumerTimeout.
+func (s *StanServer) startSlowConsumerCheck() {
+	if s.opts.SlowConsumerTimeout <= 0 {
+		return
+	}
+	interval := s.opts.SlowConsumerTimeout / 4
+	if interval < minSlowConsumerCheckInterval {
+		interval = minSlowConsumerCheckInterval
+	}
+	s.slowConsumerQuit = make(chan struct{})
+	s.slowConsumerWg.Add(1)
+	go func() {
+		defer s.slowConsumerWg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-s.slowConsumerQuit:
+				return
+			case <-ticker.C:
+				s.checkSlowConsumers(time.Now())
+			}
+		}
+	}()
+}
+
+// stopSlowConsumerCheck stops the check and waits for it to return.
+func (s *StanServer) stopSlowConsumerCheck() {
+	if s.slowConsumerQuit == nil {
+		return
+	}
+	close(s.slowConsumerQuit)
+	s.slowConsumerWg.Wait()
+}
+
+// checkSlowConsumers reports, once per stall, the subscriptions that are
+// stalled for longer than SlowConsumerTimeout, and closes them if the
+// SlowConsumerClose option is set. A subscription is stalled when it has
+// MaxInFlight messages not yet acknowledged while more are waiting.
+func (s *StanServer) checkSlowConsumers(now time.Time) {
+	for _, channel := range s.store.GetChannelNames() {
+		cs := s.store.LookupChannel(channel)
+		if cs == nil {
+			continue
+		}
+		ss := cs.UserData.(*subStore)
+		for _, sub := range ss.getAllSubs() {
+			sub.Lock()
+			if !sub.stalled || sub.Paused || sub.ClientID == "" {
+				sub.stalledSince = time.Time{}
+				sub.slowReported = false
+				sub.Unlock()
+				continue
+			}
+			if sub.stalledSince.IsZero() {
+				sub.stalledSince = now
+			}
+			if sub.slowReported || now.Sub(sub.stalledSince) < s.opts.SlowConsumerTimeout {
+				sub.Unlock()
+				continue
+			}
+			sub.slowReported = true
+			adv := &SlowConsumerAdvisory{
+				Time:        now.UTC(),
+				ClientID:    sub.ClientID,
+				Channel:     channel,
+				Durable:     sub.DurableName,
+				Queue:       sub.QGroup,
+				Inbox:       sub.Inbox,
+				Pending:     len(sub.acksPending) + len(sub.spilled),
+				MaxInFlight: sub.MaxInFlight,
+				StalledFor:  now.Sub(sub.stalledSince),
+				// Wildcard subscriptions span several channels, they are
+				// only reported.
+				Closed: s.opts.SlowConsumerClose && sub.Wildcard == "",
+			}
+			for _, sent := range sub.sentTimes {
+				if age := time.Duration(now.UnixNano() - sent); age > adv.OldestPending {
+					adv.OldestPending = age
+				}
+			}
+			sub.Unlock()
+
+			Noticef("STAN: [Client:%s] Slow consumer on subject=%s inbox=%s: %d messages pending for %v",
+				adv.ClientID, channel, adv.Inbox, adv.Pending, adv.StalledFor)
+			// The advisory has more details than the audit record.
+			s.audit.record(&auditRecord{Event: auditSlowConsumer, Client: adv.ClientID, Channel: channel,
+				Durable: adv.Durable, Queue: adv.Queue, Inbox: adv.Inbox,
+				Reason: fmt.Sprintf("%d messages pending for %v", adv.Pending, adv.StalledFor)})
+			if adv.Closed {
+				s.closeSlowConsumer(ss, sub, adv.ClientID)
+			}
+			s.publishAdvisory(AdvisorySlowConsumer, adv)
+		}
+	}
+}
+
+// closeSlowConsumer closes the subscription, as if its client had closed
+// it: a durable can be resumed, and the messages pending on a queue
+// subscriber are sent to the other members of its group.
+func (s *StanServer) closeSlowConsumer(ss *subStore, sub *subState, clientID string) {
+	if !s.clients.RemoveSub(clientID, sub) {
+		// Already removed by the client.
+		return
+	}
+	s.auditSub(auditSubClose, sub, closeReasonSlowConsumer)
+	sub.RLock()
+	durable := sub.DurableName != ""
+	sub.RUnlock()
+	// Keep the durable, remove other subscriptions from the store.
+	ss.Remove(sub, !durable)
+	s.redeliverQueueSubPending(sub)
+}
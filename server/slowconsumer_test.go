@@ -0,0 +1,140 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/nats-io/go-nats-streaming"
+)
+
+// subscribeToSlowConsumerAdvisories returns a channel receiving the
+// advisories of the slow consumers.
+func subscribeToSlowConsumerAdvisories(t *testing.T, sc stan.Conn) chan *SlowConsumerAdvisory {
+	ch := make(chan *SlowConsumerAdvisory, 10)
+	if _, err := sc.Subscribe(AdvisoryChannel(AdvisorySlowConsumer), func(m *stan.Msg) {
+		adv := &SlowConsumerAdvisory{}
+		if err := json.Unmarshal(m.Data, adv); err != nil {
+			t.Errorf("Invalid advisory: %v", err)
+		}
+		ch <- adv
+	}); err != nil {
+		stackFatalf(t, "Unexpected error on subscribe: %v", err)
+	}
+	return ch
+}
+
+func waitForSlowConsumerAdvisory(t *testing.T, ch chan *SlowConsumerAdvisory) *SlowConsumerAdvisory {
+	select {
+	case adv := <-ch:
+		return adv
+	case <-time.After(5 * time.Second):
+		stackFatalf(t, "Did not get the advisory")
+	}
+	return nil
+}
+
+func TestSlowConsumerReport(t *testing.T) {
+	opts := GetDefaultOptions()
+	opts.SlowConsumerTimeout = 250 * time.Millisecond
+	opts.Advisories = true
+	s := RunServerWithOpts(opts, nil)
+	defer s.Shutdown()
+
+	sc := NewDefaultConnection(t)
+	defer sc.Close()
+
+	advisories := subscribeToSlowConsumerAdvisories(t, sc)
+	// This subscription does not ack its messages.
+	received := make(chan struct{}, 10)
+	if _, err := sc.Subscribe("foo", func(_ *stan.Msg) { received <- struct{}{} },
+		stan.SetManualAckMode(), stan.MaxInflight(1), stan.DurableName("dur")); err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		if err := sc.Publish("foo", []byte("hello")); err != nil {
+			t.Fatalf("Unexpected error on publish: %v", err)
+		}
+	}
+	adv := waitForSlowConsumerAdvisory(t, advisories)
+	if elapsed := time.Since(start); elapsed < opts.SlowConsumerTimeout {
+		t.Fatalf("Advisory sent too soon: %v", elapsed)
+	}
+	if adv.ClientID != clientName || adv.Channel != "foo" || adv.Durable != "dur" || adv.Pending != 1 ||
+		adv.MaxInFlight != 1 || adv.StalledFor < opts.SlowConsumerTimeout || adv.OldestPending <= 0 || adv.Closed {
+		t.Fatalf("Unexpected advisory: %+v", adv)
+	}
+	// Reported once per stall.
+	select {
+	case <-advisories:
+		t.Fatal("Advisory should be sent only once")
+	case <-time.After(500 * time.Millisecond):
+	}
+	// The subscription is not closed.
+	checkSubs(t, s, clientName, 2)
+	if len(received) != 1 {
+		t.Fatalf("Expected 1 message, got %v", len(received))
+	}
+}
+
+func TestSlowConsumerClose(t *testing.T) {
+	opts := GetDefaultOptions()
+	opts.SlowConsumerTimeout = 250 * time.Millisecond
+	opts.Advisories = true
+	opts.SlowConsumerClose = true
+	s := RunServerWithOpts(opts, nil)
+	defer s.Shutdown()
+
+	sc := NewDefaultConnection(t)
+	defer sc.Close()
+
+	advisories := subscribeToSlowConsumerAdvisories(t, sc)
+	// The first member of the group does not ack its messages, it is
+	// stalled by the second message.
+	slow := make(chan uint64, 10)
+	if _, err := sc.QueueSubscribe("foo", "group", func(m *stan.Msg) { slow <- m.Sequence },
+		stan.SetManualAckMode(), stan.MaxInflight(1)); err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := sc.Publish("foo", []byte("hello")); err != nil {
+			t.Fatalf("Unexpected error on publish: %v", err)
+		}
+	}
+	select {
+	case <-slow:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Did not get our message")
+	}
+	// The second member acks its messages.
+	fast := make(chan uint64, 10)
+	if _, err := sc.QueueSubscribe("foo", "group", func(m *stan.Msg) { fast <- m.Sequence }); err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+	if err := sc.Publish("foo", []byte("hello")); err != nil {
+		t.Fatalf("Unexpected error on publish: %v", err)
+	}
+	adv := waitForSlowConsumerAdvisory(t, advisories)
+	if adv.Queue != "group" || adv.Pending != 1 || !adv.Closed {
+		t.Fatalf("Unexpected advisory: %+v", adv)
+	}
+	// The slow member is removed from the group and its pending message
+	// is sent to the other member. (The second message was skipped by the
+	// group when it could not be sent to the stalled member.)
+	checkSubs(t, s, clientName, 2)
+	received := map[uint64]bool{}
+	for !received[1] || !received[3] {
+		select {
+		case seq := <-fast:
+			received[seq] = true
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Did not get all messages: %v", received)
+		}
+	}
+	if len(slow) != 0 {
+		t.Fatal("Slow member should not get more messages")
+	}
+}
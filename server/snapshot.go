@@ -0,0 +1,65 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import "github.com/nats-io/nats-streaming-server/spb"
+
+// startSnapshot makes the subscription start with a snapshot of the
+// messages stored after its start position: of the messages with a key,
+// only the latest of each key is delivered. The messages stored after
+// the snapshot are all delivered.
+// The subscription must not have been added yet.
+func (s *StanServer) startSnapshot(sub *subState) {
+	sub.Lock()
+	sub.SnapshotSeq = sub.msgs.LastSequence()
+	loadSnapshot(sub)
+	sub.Unlock()
+	Debugf("STAN: [Client:%s] Sending snapshot, subject=%s seq=%d keys=%d.",
+		sub.ClientID, sub.subject, sub.SnapshotSeq, len(sub.snapshot))
+}
+
+// loadSnapshot builds the set of the messages of the snapshot that have
+// not been sent yet, that is the latest message of each key between
+// SubState.LastSent and SubState.SnapshotSeq. This is used when the
+// snapshot starts and when a subscription is recovered or imported.
+// Sub lock should be held before calling.
+func loadSnapshot(sub *subState) {
+	sub.snapshot = nil
+	if sub.LastSent >= sub.SnapshotSeq {
+		return
+	}
+	start := sub.LastSent + 1
+	if first := sub.msgs.FirstSequence(); start < first {
+		start = first
+	}
+	latest := make(map[string]uint64)
+	for seq := start; seq <= sub.SnapshotSeq; seq++ {
+		if ext := sub.msgs.LookupExt(seq); ext != nil && ext.Key != "" {
+			latest[ext.Key] = seq
+		}
+	}
+	sub.snapshot = make(map[uint64]struct{}, len(latest))
+	for _, seq := range latest {
+		sub.snapshot[seq] = struct{}{}
+	}
+}
+
+// superseded returns true if the message with the given sequence and
+// attributes is part of the snapshot of the subscription, but is not the
+// latest message of its key. The snapshot is released once it has been
+// sent.
+// Sub lock should be held before calling.
+func (sub *subState) superseded(seq uint64, ext *spb.MsgExt) bool {
+	if sub.snapshot == nil {
+		return false
+	}
+	if sub.LastSent >= sub.SnapshotSeq {
+		sub.snapshot = nil
+		return false
+	}
+	if seq > sub.SnapshotSeq || ext == nil || ext.Key == "" {
+		return false
+	}
+	_, latest := sub.snapshot[seq]
+	return !latest
+}
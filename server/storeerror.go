@@ -0,0 +1,87 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/nats-io/nats-streaming-server/stores"
+)
+
+// retryStoreWrite performs a write of the store and, with the
+// StoreErrorRetry policy, retries it up to StoreErrorRetries times if it
+// fails, doubling the delay between attempts from StoreErrorBackoff. The
+// caller is blocked while retrying. A write that did not complete before
+// its deadline (see storeDeadline()) is not retried, since it may still
+// complete. The last error, if any, is recorded with recordStoreError()
+// and returned.
+func (s *StanServer) retryStoreWrite(write func() error) error {
+	err := write()
+	if err != nil && err != stores.ErrDeadlineExceeded && s.opts.StoreErrorPolicy == StoreErrorRetry {
+		retries := s.opts.StoreErrorRetries
+		if retries <= 0 {
+			retries = DefaultStoreErrorRetries
+		}
+		delay := s.opts.StoreErrorBackoff
+		if delay <= 0 {
+			delay = DefaultStoreErrorBackoff
+		}
+		for i := 0; err != nil && err != stores.ErrDeadlineExceeded && i < retries; i++ {
+			Errorf("STAN: Store write error, retrying in %v: %v", delay, err)
+			time.Sleep(delay)
+			delay *= 2
+			err = write()
+		}
+	}
+	if err != nil {
+		s.recordStoreError(err)
+	}
+	return err
+}
+
+// storeDeadline returns the deadline of a write of the store started now,
+// or the zero time if the StoreTimeout option is not set.
+func (s *StanServer) storeDeadline() time.Time {
+	if s.opts.StoreTimeout <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(s.opts.StoreTimeout)
+}
+
+// recordStoreError records a write error of the store, which makes the
+// server report itself as degraded for storeErrorWindow, and applies the
+// StoreErrorPolicy: with StoreErrorReadOnly, the server rejects the
+// published messages from now on, and with StoreErrorPanic, it panics.
+// An event is recorded for the first error after storeErrorWindow without
+// errors, and when the server becomes read-only.
+func (s *StanServer) recordStoreError(err error) {
+	now := time.Now()
+	s.storeErrorLock.Lock()
+	first := s.storeError == nil || now.Sub(s.storeErrorTime) >= storeErrorWindow
+	s.storeError = err
+	s.storeErrorTime = now
+	s.storeErrorLock.Unlock()
+
+	switch s.opts.StoreErrorPolicy {
+	case StoreErrorPanic:
+		s.recordEvent(&auditRecord{Event: auditStoreError, Reason: err.Error()})
+		panic(fmt.Errorf("store write error: %v", err))
+	case StoreErrorReadOnly:
+		if atomic.CompareAndSwapInt32(&s.readOnly, 0, 1) {
+			Errorf("STAN: Store write error, rejecting messages until restarted: %v", err)
+			s.recordEvent(&auditRecord{Event: auditStoreError, Reason: err.Error() + " (read-only)"})
+			return
+		}
+	}
+	if first {
+		s.recordEvent(&auditRecord{Event: auditStoreError, Reason: err.Error()})
+	}
+}
+
+// isReadOnly returns true if the server rejects the published messages
+// after a write error of the store, with the StoreErrorReadOnly policy.
+func (s *StanServer) isReadOnly() bool {
+	return atomic.LoadInt32(&s.readOnly) == 1
+}
@@ -0,0 +1,61 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// States sent to systemd, see sd_notify(3).
+const (
+	sdReady    = "READY=1"
+	sdStopping = "STOPPING=1"
+	sdWatchdog = "WATCHDOG=1"
+)
+
+// sdNotify sends the given state to the service manager through the
+// datagram socket named by $NOTIFY_SOCKET. It does nothing if the variable
+// is not set, that is, if the server was not started by systemd with
+// `Type=notify`.
+func sdNotify(state string) error {
+	name := os.Getenv("NOTIFY_SOCKET")
+	if name == "" {
+		return nil
+	}
+	// A name starting with `@` is an abstract socket, which the net package
+	// handles.
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: name, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// sdWatchdogInterval returns the interval at which the systemd watchdog
+// must be fed, which is half of the timeout given by $WATCHDOG_USEC, or 0
+// if the watchdog is not enabled for this process.
+func sdWatchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond / 2
+}
+
+// notifySystemd sends the given state to systemd, if enabled.
+func (s *StanServer) notifySystemd(state string) {
+	if s.opts == nil || !s.opts.SystemdNotify {
+		return
+	}
+	if err := sdNotify(state); err != nil {
+		Errorf("STAN: Unable to notify systemd of %q: %v", state, err)
+	}
+}
@@ -0,0 +1,115 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// setEnv sets the environment variable and returns a function restoring
+// its previous value.
+func setEnv(t *testing.T, name, value string) func() {
+	prev, wasSet := os.LookupEnv(name)
+	if err := os.Setenv(name, value); err != nil {
+		t.Fatalf("Unable to set %s: %v", name, err)
+	}
+	return func() {
+		if wasSet {
+			os.Setenv(name, prev)
+		} else {
+			os.Unsetenv(name)
+		}
+	}
+}
+
+func TestSystemdNotify(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stan_systemd")
+	if err != nil {
+		t.Fatalf("Unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: name, Net: "unixgram"})
+	if err != nil {
+		t.Fatalf("Unable to listen on %v: %v", name, err)
+	}
+	defer conn.Close()
+	defer setEnv(t, "NOTIFY_SOCKET", name)()
+	defer setEnv(t, "WATCHDOG_USEC", "100000")()
+	defer setEnv(t, "WATCHDOG_PID", "")()
+
+	if interval := sdWatchdogInterval(); interval != 50*time.Millisecond {
+		t.Fatalf("Expected watchdog interval of 50ms, got %v", interval)
+	}
+
+	states := make(chan string, 100)
+	go func() {
+		buf := make([]byte, 256)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				return
+			}
+			states <- string(buf[:n])
+		}
+	}()
+	waitForState := func(expected string) {
+		timeout := time.After(5 * time.Second)
+		for {
+			select {
+			case state := <-states:
+				if state == expected {
+					return
+				}
+			case <-timeout:
+				stackFatalf(t, "Did not get state %q", expected)
+			}
+		}
+	}
+
+	// Nothing is sent unless enabled.
+	s := runServerWithOpts(t, GetDefaultOptions(), nil)
+	s.Shutdown()
+	select {
+	case state := <-states:
+		t.Fatalf("Unexpected state: %q", state)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	opts := GetDefaultOptions()
+	opts.SystemdNotify = true
+	s = runServerWithOpts(t, opts, nil)
+	defer s.Shutdown()
+	select {
+	case state := <-states:
+		if state != sdReady {
+			t.Fatalf("Expected %q first, got %q", sdReady, state)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Server did not notify its readiness")
+	}
+	// The watchdog is fed periodically.
+	for i := 0; i < 3; i++ {
+		waitForState(sdWatchdog)
+	}
+	s.Shutdown()
+	waitForState(sdStopping)
+}
+
+func TestSystemdWatchdogPID(t *testing.T) {
+	defer setEnv(t, "WATCHDOG_USEC", "1000000")()
+	defer setEnv(t, "WATCHDOG_PID", strconv.Itoa(os.Getpid()+1))()
+	if interval := sdWatchdogInterval(); interval != 0 {
+		t.Fatalf("Watchdog of another process should be ignored, got %v", interval)
+	}
+	os.Setenv("WATCHDOG_USEC", "invalid")
+	if interval := sdWatchdogInterval(); interval != 0 {
+		t.Fatalf("Invalid watchdog timeout should be ignored, got %v", interval)
+	}
+}
@@ -0,0 +1,85 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/nats-io/nats-streaming-server/stores"
+)
+
+// tenantConfig is the representation of a tenant in a tenants file. The
+// limits have the name of the corresponding command line parameters.
+type tenantConfig struct {
+	Name        string `json:"name"`
+	MaxChannels int    `json:"max_channels,omitempty"`
+	MaxMsgs     int    `json:"max_msgs,omitempty"`
+	MaxBytes    uint64 `json:"max_bytes,omitempty"`
+	MaxSubs     int    `json:"max_subs,omitempty"`
+}
+
+// LoadTenantsFile reads the tenants and their limits from a JSON file
+// containing an array of tenants, for instance:
+//
+//	[{"name": "acme", "max_channels": 10, "max_msgs": 10000},
+//	 {"name": "globex", "max_bytes": 1048576}]
+func LoadTenantsFile(path string) ([]stores.TenantLimits, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var configs []tenantConfig
+	if err := json.Unmarshal(b, &configs); err != nil {
+		return nil, fmt.Errorf("error parsing tenants file %q: %v", path, err)
+	}
+	tenants := make([]stores.TenantLimits, 0, len(configs))
+	for _, c := range configs {
+		tenants = append(tenants, stores.TenantLimits{
+			Name:        c.Name,
+			MaxChannels: c.MaxChannels,
+			MaxNumMsgs:  c.MaxMsgs,
+			MaxMsgBytes: c.MaxBytes,
+			MaxSubs:     c.MaxSubs,
+		})
+	}
+	if err := validateTenants(tenants); err != nil {
+		return nil, fmt.Errorf("error parsing tenants file %q: %v", path, err)
+	}
+	return tenants, nil
+}
+
+// validateTenants checks that tenant names are valid, and that a tenant
+// namespace is not included in another one.
+func validateTenants(tenants []stores.TenantLimits) error {
+	for i, t := range tenants {
+		// A tenant name is the prefix of its channels, so it can't have
+		// empty tokens.
+		if !isValidSubject(t.Name) || hasEmptyToken(t.Name) {
+			return fmt.Errorf("invalid tenant name %q", t.Name)
+		}
+		if t.MaxChannels < 0 || t.MaxNumMsgs < 0 || t.MaxSubs < 0 {
+			return fmt.Errorf("invalid limits for tenant %q", t.Name)
+		}
+		for _, other := range tenants[:i] {
+			if t.Name == other.Name || strings.HasPrefix(t.Name, other.Name+".") ||
+				strings.HasPrefix(other.Name, t.Name+".") {
+				return fmt.Errorf("tenants %q and %q overlap", other.Name, t.Name)
+			}
+		}
+	}
+	return nil
+}
+
+// hasEmptyToken returns true if the subject is empty, or if one of its
+// tokens is.
+func hasEmptyToken(subject string) bool {
+	for _, token := range strings.Split(subject, ".") {
+		if token == "" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,100 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/nats-io/nats-streaming-server/stores"
+)
+
+func TestLoadTenantsFile(t *testing.T) {
+	f, err := ioutil.TempFile("", "tenants")
+	if err != nil {
+		t.Fatalf("Unable to create file: %v", err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(`[{"name": "acme", "max_channels": 10, "max_msgs": 100, "max_bytes": 1024, "max_subs": 5},
+		{"name": "globex"}]`)
+	f.Close()
+
+	tenants, err := LoadTenantsFile(f.Name())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expected := []stores.TenantLimits{
+		{Name: "acme", MaxChannels: 10, MaxNumMsgs: 100, MaxMsgBytes: 1024, MaxSubs: 5},
+		{Name: "globex"},
+	}
+	if len(tenants) != len(expected) || tenants[0] != expected[0] || tenants[1] != expected[1] {
+		t.Fatalf("Expected %v, got %v", expected, tenants)
+	}
+
+	for _, content := range []string{
+		"not json",
+		`[{"name": ""}]`,
+		`[{"name": "acme."}]`,
+		`[{"name": "acme..eu"}]`,
+		`[{"name": "acme.*"}]`,
+		`[{"name": "acme", "max_msgs": -1}]`,
+		`[{"name": "acme"}, {"name": "acme"}]`,
+		`[{"name": "acme"}, {"name": "acme.eu"}]`,
+	} {
+		if err := ioutil.WriteFile(f.Name(), []byte(content), 0600); err != nil {
+			t.Fatalf("Unable to write file: %v", err)
+		}
+		if _, err := LoadTenantsFile(f.Name()); err == nil {
+			t.Fatalf("Expected error loading %q", content)
+		}
+	}
+}
+
+func TestTenantLimits(t *testing.T) {
+	sOpts := GetDefaultOptions()
+	sOpts.ID = clusterName
+	sOpts.MaxChannels = 1
+	sOpts.Tenants = []stores.TenantLimits{{Name: "acme", MaxChannels: 2, MaxNumMsgs: 1}}
+	s := RunServerWithOpts(sOpts, nil)
+	defer s.Shutdown()
+
+	sc := NewDefaultConnection(t)
+	defer sc.Close()
+
+	// The tenant reaching its limit does not prevent others from
+	// creating channels.
+	for _, channel := range []string{"acme.foo", "acme.bar", "foo"} {
+		if err := sc.Publish(channel, []byte("hello")); err != nil {
+			t.Fatalf("Unexpected error publishing on %s: %v", channel, err)
+		}
+	}
+	for _, channel := range []string{"acme.baz", "bar"} {
+		if err := sc.Publish(channel, []byte("hello")); err == nil {
+			t.Fatalf("Expected error publishing on %s", channel)
+		}
+	}
+	if err := sc.Publish("acme.foo", []byte("hello")); err != nil {
+		t.Fatalf("Unexpected error on publish: %v", err)
+	}
+	if count, _, _ := s.store.MsgsState("acme.foo"); count != 1 {
+		t.Fatalf("Expected 1 message, got %v", count)
+	}
+}
+
+func TestTenantInvalidOptions(t *testing.T) {
+	sOpts := GetDefaultOptions()
+	sOpts.ID = clusterName
+	sOpts.Tenants = []stores.TenantLimits{{Name: "acme.>"}}
+
+	var failedServer *StanServer
+	defer func() {
+		if r := recover(); r == nil {
+			if failedServer != nil {
+				failedServer.Shutdown()
+			}
+			t.Fatal("Server did not fail with invalid tenant")
+		}
+	}()
+	failedServer = RunServerWithOpts(sOpts, nil)
+}
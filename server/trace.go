@@ -0,0 +1,338 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/go-nats-streaming/pb"
+	"github.com/nats-io/nats-streaming-server/spb"
+)
+
+// Name of the message header carrying the W3C trace context of a message.
+const traceParentHeader = "traceparent"
+
+const (
+	// Maximum number of spans waiting to be exported, spans are dropped
+	// beyond that.
+	traceQueueSize = 8192
+
+	// Maximum number of spans sent in one export request.
+	traceBatchSize = 512
+
+	// Interval at which the pending spans are exported.
+	traceFlushInterval = time.Second
+
+	// Timeout of an export request.
+	traceExportTimeout = 5 * time.Second
+)
+
+// OTLP span kinds.
+const (
+	spanKindInternal = 1
+	spanKindServer   = 2
+	spanKindProducer = 4
+)
+
+// span is an operation on a traced message.
+type span struct {
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+	name     string
+	kind     int
+	start    int64
+	end      int64
+	attrs    []spanAttr
+	err      string
+}
+
+type spanAttr struct {
+	key   string
+	value string
+}
+
+// tracer records the spans of the messages published with a `traceparent`
+// header (whose sampled flag is set) and exports them to an OTLP/HTTP
+// endpoint. The header of the stored message is updated to refer to the
+// publish span, so that subscribers can continue the trace.
+type tracer struct {
+	endpoint  string
+	clusterID string
+	client    *http.Client
+	spans     chan *span
+	quit      chan struct{}
+	wg        sync.WaitGroup
+}
+
+// newTracer returns a tracer exporting the spans to the given endpoint,
+// for instance `http://localhost:4318/v1/traces`.
+func newTracer(endpoint, clusterID string) *tracer {
+	t := &tracer{
+		endpoint:  endpoint,
+		clusterID: clusterID,
+		client:    &http.Client{Timeout: traceExportTimeout},
+		spans:     make(chan *span, traceQueueSize),
+		quit:      make(chan struct{}),
+	}
+	t.wg.Add(1)
+	go t.exportLoop()
+	return t
+}
+
+// close exports the pending spans and stops the tracer.
+func (t *tracer) close() {
+	if t == nil {
+		return
+	}
+	close(t.quit)
+	t.wg.Wait()
+}
+
+// parseTraceParent returns the trace and parent span IDs of a W3C
+// `traceparent` header value, and false if it is invalid or not sampled.
+func parseTraceParent(v string) ([16]byte, [8]byte, bool) {
+	var traceID [16]byte
+	var spanID [8]byte
+	parts := strings.Split(v, "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || len(parts[1]) != 32 ||
+		len(parts[2]) != 16 || len(parts[3]) != 2 || (parts[0] == "00" && len(parts) != 4) {
+		return traceID, spanID, false
+	}
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil || flags[0]&0x01 == 0 {
+		return traceID, spanID, false
+	}
+	if _, err := hex.Decode(traceID[:], []byte(parts[1])); err != nil || traceID == [16]byte{} {
+		return traceID, spanID, false
+	}
+	if _, err := hex.Decode(spanID[:], []byte(parts[2])); err != nil || spanID == [8]byte{} {
+		return traceID, spanID, false
+	}
+	return traceID, spanID, true
+}
+
+// traceParent returns the `traceparent` header of the message, or nil.
+func traceParent(ext *spb.MsgExt) *spb.MsgHeader {
+	if ext == nil {
+		return nil
+	}
+	for _, h := range ext.Headers {
+		if h != nil && h.Key == traceParentHeader {
+			return h
+		}
+	}
+	return nil
+}
+
+// newSpan returns a span whose parent is the span of the message's
+// `traceparent` header, or nil if the message is not traced.
+func (t *tracer) newSpan(ext *spb.MsgExt, name string, kind int, start int64) *span {
+	if t == nil {
+		return nil
+	}
+	h := traceParent(ext)
+	if h == nil {
+		return nil
+	}
+	traceID, parentID, ok := parseTraceParent(h.Value)
+	if !ok {
+		return nil
+	}
+	sp := &span{traceID: traceID, parentID: parentID, name: name, kind: kind, start: start}
+	rand.Read(sp.spanID[:])
+	return sp
+}
+
+// startPublish returns the span of the publish of the message, or nil if
+// the message is not traced. The `traceparent` header of the message is
+// updated to refer to this span.
+func (t *tracer) startPublish(pm *pb.PubMsg, ext *spb.MsgExt) *span {
+	sp := t.newSpan(ext, "publish", spanKindServer, time.Now().UnixNano())
+	if sp == nil {
+		return nil
+	}
+	sp.attrs = msgSpanAttrs(pm.Subject, pm.ClientID)
+	sp.attrs = append(sp.attrs, spanAttr{"messaging.message.id", pm.Guid})
+	traceParent(ext).Value = fmt.Sprintf("00-%x-%x-01", sp.traceID, sp.spanID)
+	return sp
+}
+
+// child returns a span whose parent is the given span.
+func (sp *span) child(name string, kind int, start int64) *span {
+	c := &span{traceID: sp.traceID, parentID: sp.spanID, name: name, kind: kind, start: start, attrs: sp.attrs}
+	rand.Read(c.spanID[:])
+	return c
+}
+
+// msgSpanAttrs returns the attributes common to the spans of a message.
+func msgSpanAttrs(subject, clientID string) []spanAttr {
+	return []spanAttr{
+		{"messaging.system", "nats-streaming"},
+		{"messaging.destination.name", subject},
+		{"messaging.client_id", clientID},
+	}
+}
+
+// traceMsg records a delivery, redelivery or ack of a stored message, if
+// it is traced.
+func (t *tracer) traceMsg(name string, kind int, start int64, sub *subState, m *pb.MsgProto, ext *spb.MsgExt) {
+	sp := t.newSpan(ext, name, kind, start)
+	if sp == nil {
+		return
+	}
+	sp.attrs = append(msgSpanAttrs(m.Subject, sub.ClientID),
+		spanAttr{"messaging.nats_streaming.sequence", strconv.FormatUint(m.Sequence, 10)},
+		spanAttr{"messaging.nats_streaming.inbox", sub.Inbox})
+	if sub.DurableName != "" {
+		sp.attrs = append(sp.attrs, spanAttr{"messaging.nats_streaming.durable", sub.DurableName})
+	}
+	if sub.QGroup != "" {
+		sp.attrs = append(sp.attrs, spanAttr{"messaging.nats_streaming.queue", sub.QGroup})
+	}
+	t.finish(sp, nil)
+}
+
+// finish ends the span and queues it for export. Spans are dropped if the
+// endpoint does not keep up.
+func (t *tracer) finish(sp *span, err error) {
+	if t == nil || sp == nil {
+		return
+	}
+	sp.end = time.Now().UnixNano()
+	if err != nil {
+		sp.err = err.Error()
+	}
+	select {
+	case t.spans <- sp:
+	default:
+	}
+}
+
+func (t *tracer) exportLoop() {
+	defer t.wg.Done()
+	ticker := time.NewTicker(traceFlushInterval)
+	defer ticker.Stop()
+	batch := make([]*span, 0, traceBatchSize)
+	flush := func() {
+		if len(batch) > 0 {
+			if err := t.export(batch); err != nil {
+				Errorf("STAN: Unable to export %d spans to %s: %v", len(batch), t.endpoint, err)
+			}
+			batch = batch[:0]
+		}
+	}
+	for {
+		select {
+		case sp := <-t.spans:
+			batch = append(batch, sp)
+			if len(batch) == traceBatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-t.quit:
+			for {
+				select {
+				case sp := <-t.spans:
+					batch = append(batch, sp)
+					if len(batch) == traceBatchSize {
+						flush()
+					}
+				default:
+					flush()
+					return
+				}
+			}
+		}
+	}
+}
+
+// OTLP/JSON representation of the spans (see the OpenTelemetry protocol
+// specification). IDs are hex encoded and times are strings.
+type otlpKeyValue struct {
+	Key   string            `json:"key"`
+	Value map[string]string `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes"`
+	Status            *otlpStatus    `json:"status,omitempty"`
+}
+
+func otlpAttrs(attrs []spanAttr) []otlpKeyValue {
+	kvs := make([]otlpKeyValue, 0, len(attrs))
+	for _, a := range attrs {
+		kvs = append(kvs, otlpKeyValue{Key: a.key, Value: map[string]string{"stringValue": a.value}})
+	}
+	return kvs
+}
+
+// export sends the spans to the endpoint.
+func (t *tracer) export(batch []*span) error {
+	spans := make([]*otlpSpan, 0, len(batch))
+	for _, sp := range batch {
+		s := &otlpSpan{
+			TraceID:           hex.EncodeToString(sp.traceID[:]),
+			SpanID:            hex.EncodeToString(sp.spanID[:]),
+			ParentSpanID:      hex.EncodeToString(sp.parentID[:]),
+			Name:              sp.name,
+			Kind:              sp.kind,
+			StartTimeUnixNano: strconv.FormatInt(sp.start, 10),
+			EndTimeUnixNano:   strconv.FormatInt(sp.end, 10),
+			Attributes:        otlpAttrs(sp.attrs),
+		}
+		if sp.err != "" {
+			s.Status = &otlpStatus{Code: 2, Message: sp.err}
+		}
+		spans = append(spans, s)
+	}
+	req := map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": otlpAttrs([]spanAttr{
+					{"service.name", "nats-streaming-server"},
+					{"service.instance.id", t.clusterID},
+				}),
+			},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]string{"name": "nats-streaming-server", "version": VERSION},
+				"spans": spans,
+			}},
+		}},
+	}
+	b, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	resp, err := t.client.Post(t.endpoint, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,146 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nats-io/go-nats-streaming/pb"
+	"github.com/nats-io/nats"
+	"github.com/nats-io/nats-streaming-server/spb"
+)
+
+func TestParseTraceParent(t *testing.T) {
+	for v, ok := range map[string]bool{
+		"00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01":     true,
+		"00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-00":     false,
+		"01-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01-xyz": true,
+		"00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01-xyz": false,
+		"ff-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01":     false,
+		"00-00000000000000000000000000000000-b7ad6b7169203331-01":     false,
+		"00-0af7651916cd43dd8448eb211c80319c-0000000000000000-01":     false,
+		"00-0af7651916cd43dd8448eb211c80319c-b7ad6b716920333x-01":     false,
+		"00-0af7651916cd43dd8448eb211c80319c-01":                      false,
+		"":                                                            false,
+	} {
+		if _, _, valid := parseTraceParent(v); valid != ok {
+			t.Fatalf("Expected %q to be valid=%v", v, ok)
+		}
+	}
+}
+
+func TestTracing(t *testing.T) {
+	var mu sync.Mutex
+	var spans []*otlpSpan
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			ResourceSpans []struct {
+				ScopeSpans []struct {
+					Spans []*otlpSpan `json:"spans"`
+				} `json:"scopeSpans"`
+			} `json:"resourceSpans"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		for _, rs := range req.ResourceSpans {
+			for _, ss := range rs.ScopeSpans {
+				spans = append(spans, ss.Spans...)
+			}
+		}
+		mu.Unlock()
+	}))
+	defer collector.Close()
+
+	opts := GetDefaultOptions()
+	opts.TraceEndpoint = collector.URL
+	s := RunServerWithOpts(opts, nil)
+	defer s.Shutdown()
+
+	sc, nc := createConnectionWithNatsOpts(t, clientName)
+	defer nc.Close()
+	defer sc.Close()
+
+	inbox := nats.NewInbox()
+	rawSub, err := nc.SubscribeSync(inbox)
+	if err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+	ackInbox := sendSubRequest(t, s, nc, &pb.SubscriptionRequest{
+		Subject:       "foo",
+		Inbox:         inbox,
+		AckWaitInSecs: 1,
+		StartPosition: pb.StartPosition_First,
+	})
+
+	traceID := "0af7651916cd43dd8448eb211c80319c"
+	ext := &spb.MsgExt{Headers: []*spb.MsgHeader{{Key: "traceparent", Value: "00-" + traceID + "-b7ad6b7169203331-01"}}}
+	if err := sendPubMsgWithExt(t, s, nc, "foo", []byte("traced"), ext); err != nil {
+		t.Fatalf("Unexpected error on publish: %v", err)
+	}
+	if err := sendPubMsgWithExt(t, s, nc, "foo", []byte("not traced"), nil); err != nil {
+		t.Fatalf("Unexpected error on publish: %v", err)
+	}
+
+	// The message is delivered with a trace context referring to the
+	// publish span. It is not acked the first time, so it is redelivered.
+	var traceParent string
+	for i := 0; i < 3; i++ {
+		rawMsg, err := rawSub.NextMsg(5 * time.Second)
+		if err != nil {
+			t.Fatalf("Did not get our message: %v", err)
+		}
+		m := &pb.MsgProto{}
+		m.Unmarshal(rawMsg.Data)
+		if m.Sequence != 1 {
+			b, _ := (&pb.Ack{Subject: "foo", Sequence: m.Sequence}).Marshal()
+			nc.Publish(ackInbox, b)
+			continue
+		}
+		rext := &spb.MsgExt{}
+		rext.Unmarshal(rawMsg.Data)
+		if len(rext.Headers) != 1 || !strings.HasPrefix(rext.Headers[0].Value, "00-"+traceID+"-") ||
+			rext.Headers[0].Value == ext.Headers[0].Value {
+			t.Fatalf("Unexpected trace context: %v", rext.Headers)
+		}
+		traceParent = rext.Headers[0].Value
+		if m.Redelivered {
+			b, _ := (&pb.Ack{Subject: "foo", Sequence: 1}).Marshal()
+			nc.Publish(ackInbox, b)
+		}
+	}
+	nc.Flush()
+	sc.Close()
+	s.Shutdown()
+
+	mu.Lock()
+	defer mu.Unlock()
+	publishSpanID := strings.Split(traceParent, "-")[2]
+	expected := map[string]string{
+		"publish":   "b7ad6b7169203331",
+		"store":     publishSpanID,
+		"deliver":   publishSpanID,
+		"redeliver": publishSpanID,
+		"ack":       publishSpanID,
+	}
+	if len(spans) != len(expected) {
+		t.Fatalf("Expected %d spans, got %d", len(expected), len(spans))
+	}
+	for _, sp := range spans {
+		if sp.TraceID != traceID || sp.ParentSpanID != expected[sp.Name] {
+			t.Fatalf("Unexpected span: %+v", sp)
+		}
+		if sp.Name == "publish" && sp.SpanID != publishSpanID {
+			t.Fatalf("Expected publish span ID %v, got %v", publishSpanID, sp.SpanID)
+		}
+		delete(expected, sp.Name)
+	}
+}
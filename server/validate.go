@@ -0,0 +1,226 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/nats-io/gnatsd/server"
+	"github.com/nats-io/nats-streaming-server/stores"
+)
+
+// ValidationReport is the result of ValidateConfig: the state the server
+// would recover from its store, and the conflicts between the limits of
+// the configuration, and between these limits and the recovered state.
+type ValidationReport struct {
+	StoreType     string
+	Recovered     bool          // false if the store has no state that can be checked without writing to it
+	Channels      int           // recovered channels
+	Subscriptions int           // recovered subscriptions
+	Clients       int           // recovered clients
+	Msgs          uint64        // messages of the recovered channels
+	Bytes         uint64        // bytes of the messages of the recovered channels
+	RecoveryTime  time.Duration // time taken to open the store and recover the subscriptions, which a start takes at least
+	Conflicts     []string
+}
+
+// ValidateConfig checks the options of the server and, for a FILE store,
+// opens the store read-only to report what would be recovered, without
+// starting anything. Invalid options are returned as an error, while
+// limits that would reject operations or remove messages on startup are
+// reported as conflicts.
+func ValidateConfig(stanOpts *Options, natsOpts *server.Options) (*ValidationReport, error) {
+	if err := validateOptions(stanOpts); err != nil {
+		return nil, err
+	}
+	if stanOpts.NATSServerURL == "" && natsOpts != nil {
+		// Checked on a copy, since they are completed by the check.
+		var s StanServer
+		nOpts := *natsOpts
+		if err := s.configureClusterOpts(&nOpts); err != nil {
+			return nil, err
+		}
+	}
+	limits := storeLimits(stanOpts)
+	r := &ValidationReport{StoreType: strings.ToUpper(stanOpts.StoreType)}
+	r.checkLimits(stanOpts, limits)
+	if r.StoreType != stores.TypeFile {
+		// Other store types can't be opened without writing to them.
+		return r, nil
+	}
+	if _, err := os.Stat(stanOpts.FilestoreDir); os.IsNotExist(err) {
+		// Nothing to recover, the store is created on startup.
+		r.Recovered = true
+		return r, nil
+	}
+	if err := r.recover(stanOpts, limits); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// conflict adds a conflict to the report.
+func (r *ValidationReport) conflict(format string, args ...interface{}) {
+	r.Conflicts = append(r.Conflicts, fmt.Sprintf(format, args...))
+}
+
+// byteBudget is a limit of the total size of the messages of the store.
+type byteBudget struct {
+	name  string
+	value int64
+}
+
+// checkLimits reports the limits of the configuration that exceed the
+// global byte budgets of the store, or its maximum number of channels.
+func (r *ValidationReport) checkLimits(opts *Options, limits *stores.ChannelLimits) {
+	if len(opts.Channels) > limits.MaxChannels {
+		r.conflict("%d channels are configured, above the max channels limit of %d",
+			len(opts.Channels), limits.MaxChannels)
+	}
+	budgets := []byteBudget{{"store high watermark", opts.StoreHighWatermark}}
+	if r.StoreType == stores.TypeMemory {
+		// All the messages of a memory store are kept in memory.
+		budgets = append(budgets, byteBudget{"memory budget", opts.MemoryBudget})
+	}
+	for _, b := range budgets {
+		if b.value <= 0 {
+			continue
+		}
+		budget := uint64(b.value)
+		if limits.MaxMsgBytes > budget {
+			r.conflict("max bytes per channel (%d) exceeds the %s (%d)", limits.MaxMsgBytes, b.name, budget)
+		}
+		for _, t := range limits.Tenants {
+			if t.MaxMsgBytes > budget {
+				r.conflict("max bytes of the channels of tenant %q (%d) exceed the %s (%d)",
+					t.Name, t.MaxMsgBytes, b.name, budget)
+			}
+		}
+		total := uint64(0)
+		for _, c := range opts.Channels {
+			channelBytes := limits.ForChannel(c.Name).MaxMsgBytes
+			if c.MaxBytes > budget {
+				r.conflict("max bytes of channel %q (%d) exceed the %s (%d)", c.Name, c.MaxBytes, b.name, budget)
+			}
+			total += channelBytes
+		}
+		if len(opts.Channels) > 1 && total > budget {
+			r.conflict("the configured channels can hold %d bytes, above the %s (%d)", total, b.name, budget)
+		}
+	}
+}
+
+// recover opens the FILE store read-only, recovers its state as a start
+// would, and reports the state that would be rejected or trimmed by the
+// limits.
+func (r *ValidationReport) recover(opts *Options, limits *stores.ChannelLimits) error {
+	fileOpts := opts.FileStoreOpts
+	fileOpts.ReadOnly = true
+	fileOpts.Upgrade = false
+	// Open without limits, so that the recovered state can be compared
+	// with them.
+	noLimits := &stores.ChannelLimits{
+		MaxChannels: math.MaxInt32,
+		MaxNumMsgs:  math.MaxInt32,
+		MaxMsgBytes: math.MaxUint64,
+		MaxSubs:     math.MaxInt32,
+	}
+	start := time.Now()
+	store, state, err := stores.NewStore(stores.TypeFile, &stores.StoreConfig{
+		Dir:           opts.FilestoreDir,
+		Limits:        noLimits,
+		FileStoreOpts: &fileOpts,
+	})
+	if err == stores.ErrUpgradeRequired {
+		return fmt.Errorf("%v, restart with -upgrade_store (after backing up %s)", err, opts.FilestoreDir)
+	}
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	subs := make(map[string]int)
+	if state != nil {
+		if err := state.Recover(func(channel string, sub *stores.RecoveredSubState) error {
+			subs[channel]++
+			return nil
+		}); err != nil {
+			return fmt.Errorf("unable to recover subscriptions: %v", err)
+		}
+	}
+	r.RecoveryTime = time.Since(start)
+	r.Recovered = true
+	if state == nil {
+		return nil
+	}
+	if state.Info.ClusterID != opts.ID {
+		r.conflict("cluster ID %q does not match the recovered value of %q", opts.ID, state.Info.ClusterID)
+	}
+	r.Clients = len(state.Clients)
+	if opts.MaxClients > 0 && r.Clients > opts.MaxClients {
+		r.conflict("%d clients are recovered, above the max clients limit of %d", r.Clients, opts.MaxClients)
+	}
+	channels := store.GetChannelNames()
+	sort.Strings(channels)
+	r.Channels = len(channels)
+	if r.Channels > limits.MaxChannels {
+		r.conflict("%d channels are recovered, above the max channels limit of %d", r.Channels, limits.MaxChannels)
+	}
+	for _, channel := range channels {
+		cs := store.LookupChannel(channel)
+		if cs == nil {
+			continue
+		}
+		msgs, bytes, err := cs.Msgs.State()
+		if err != nil {
+			return fmt.Errorf("unable to get the state of channel %q: %v", channel, err)
+		}
+		r.Msgs += uint64(msgs)
+		r.Bytes += bytes
+		r.Subscriptions += subs[channel]
+		cl := limits.ForChannel(channel)
+		if cl.MaxNumMsgs > 0 && msgs > cl.MaxNumMsgs {
+			r.conflict("channel %q holds %d messages, above its limit of %d: the oldest would be removed",
+				channel, msgs, cl.MaxNumMsgs)
+		}
+		if cl.MaxMsgBytes > 0 && bytes > cl.MaxMsgBytes {
+			r.conflict("channel %q holds %d bytes, above its limit of %d: the oldest messages would be removed",
+				channel, bytes, cl.MaxMsgBytes)
+		}
+		if cl.MaxSubs > 0 && subs[channel] > cl.MaxSubs {
+			r.conflict("channel %q has %d subscriptions, above its limit of %d", channel, subs[channel], cl.MaxSubs)
+		}
+	}
+	if opts.StoreHighWatermark > 0 && r.Bytes > uint64(opts.StoreHighWatermark) {
+		r.conflict("the store holds %d bytes, above the store high watermark (%d): messages would be rejected",
+			r.Bytes, opts.StoreHighWatermark)
+	}
+	return nil
+}
+
+// Print writes the report in a human readable form.
+func (r *ValidationReport) Print(w io.Writer) {
+	fmt.Fprintf(w, "Store type:    %s\n", r.StoreType)
+	if r.Recovered {
+		fmt.Fprintf(w, "Channels:      %d\n", r.Channels)
+		fmt.Fprintf(w, "Subscriptions: %d\n", r.Subscriptions)
+		fmt.Fprintf(w, "Clients:       %d\n", r.Clients)
+		fmt.Fprintf(w, "Messages:      %d (%d bytes)\n", r.Msgs, r.Bytes)
+		fmt.Fprintf(w, "Recovery time: %v\n", r.RecoveryTime)
+	} else {
+		fmt.Fprintf(w, "Recovery:      not checked for %s stores\n", r.StoreType)
+	}
+	if len(r.Conflicts) == 0 {
+		fmt.Fprintf(w, "Conflicts:     none\n")
+		return
+	}
+	fmt.Fprintf(w, "Conflicts:     %d\n", len(r.Conflicts))
+	for _, c := range r.Conflicts {
+		fmt.Fprintf(w, "  - %s\n", c)
+	}
+}
@@ -0,0 +1,90 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/nats-io/go-nats-streaming"
+	"github.com/nats-io/nats-streaming-server/stores"
+)
+
+func TestValidateConfig(t *testing.T) {
+	opts := GetDefaultOptions()
+	opts.ChannelNamePattern = "("
+	if _, err := ValidateConfig(opts, nil); err == nil {
+		t.Fatal("Expected error for invalid channel name pattern")
+	}
+
+	// A channel allowed more bytes than the store can hold.
+	opts = GetDefaultOptions()
+	opts.StoreHighWatermark = 1000
+	opts.MaxBytes = 500
+	opts.Channels = []*ChannelConfig{{Name: "foo", MaxBytes: 2000}}
+	report, err := ValidateConfig(opts, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if report.Recovered {
+		t.Fatal("Memory store should not be recovered")
+	}
+	if len(report.Conflicts) != 1 || !strings.Contains(report.Conflicts[0], `"foo"`) {
+		t.Fatalf("Unexpected conflicts: %v", report.Conflicts)
+	}
+	opts.Channels[0].MaxBytes = 400
+	if report, err = ValidateConfig(opts, nil); err != nil || len(report.Conflicts) != 0 {
+		t.Fatalf("Unexpected conflicts: %v, %v", report.Conflicts, err)
+	}
+}
+
+func TestValidateConfigRecovery(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	opts := GetDefaultOptions()
+	opts.StoreType = stores.TypeFile
+	opts.FilestoreDir = defaultDataStore
+
+	// Without a store yet, there is nothing to recover.
+	report, err := ValidateConfig(opts, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !report.Recovered || report.Channels != 0 || len(report.Conflicts) != 0 {
+		t.Fatalf("Unexpected report: %+v", report)
+	}
+
+	s := runServerWithOpts(t, opts, nil)
+	sc := NewDefaultConnection(t)
+	for i := 0; i < 5; i++ {
+		if err := sc.Publish("foo", []byte("hello")); err != nil {
+			t.Fatalf("Unexpected error on publish: %v", err)
+		}
+	}
+	if _, err := sc.Subscribe("foo", func(_ *stan.Msg) {}, stan.DurableName("dur")); err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+	sc.Close()
+	s.Shutdown()
+
+	opts.MaxMsgs = 2
+	report, err = ValidateConfig(opts, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !report.Recovered || report.Channels != 1 || report.Msgs != 5 || report.Subscriptions != 1 {
+		t.Fatalf("Unexpected report: %+v", report)
+	}
+	if len(report.Conflicts) != 1 || !strings.Contains(report.Conflicts[0], "holds 5 messages") {
+		t.Fatalf("Unexpected conflicts: %v", report.Conflicts)
+	}
+
+	// The store was not modified.
+	opts.MaxMsgs = 0
+	s = runServerWithOpts(t, opts, nil)
+	defer s.Shutdown()
+	if n, _, _ := s.store.LookupChannel("foo").Msgs.State(); n != 5 {
+		t.Fatalf("Expected 5 messages, got %v", n)
+	}
+}
@@ -0,0 +1,181 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats-streaming-server/util"
+)
+
+const (
+	// Timeout of a request to a validation webhook.
+	validatorWebhookTimeout = 2 * time.Second
+
+	// Maximum length of the reason of a rejection read from the response
+	// of a validation webhook.
+	maxValidatorReasonLen = 256
+
+	// Header of the requests to a validation or delivery webhook giving
+	// the channel of the message.
+	channelHeader = "Stan-Channel"
+)
+
+// PayloadValidator validates the payloads of the messages published on
+// some channels, before they are stored.
+type PayloadValidator interface {
+	// Validate returns an error, sent to the publisher, if the payload of
+	// a message published on the channel is invalid.
+	Validate(channel string, data []byte) error
+}
+
+// Validator sets how the payloads of the messages published on the
+// channels matching Channel, which can contain wildcards, are validated:
+// with a JSON Schema file, a webhook, or, for applications embedding the
+// server, a PayloadValidator.
+type Validator struct {
+	Channel   string           `json:"channel"`
+	Schema    string           `json:"schema,omitempty"` // Path of a JSON Schema file
+	URL       string           `json:"url,omitempty"`    // URL of a validation webhook
+	Validator PayloadValidator `json:"-"`
+}
+
+// webhookValidator posts the payloads to a URL, which answers with a 2xx
+// status if the payload is valid, and with a 4xx status, with the reason
+// in the body, otherwise.
+type webhookValidator struct {
+	url    string
+	client *http.Client
+}
+
+// payloadError is returned for the messages whose payload is invalid. Its
+// message is ErrInvalidPayload followed by the reason.
+type payloadError struct {
+	reason error
+}
+
+func (e *payloadError) Error() string {
+	return fmt.Sprintf("%v: %v", ErrInvalidPayload, e.reason)
+}
+
+// channelValidator is a validator of the channels matching a pattern.
+type channelValidator struct {
+	channel   string
+	validator PayloadValidator
+}
+
+// LoadValidatorsFile reads the payload validators from a JSON file
+// containing an array of validators, for instance:
+//
+//	[{"channel": "orders.>", "schema": "/etc/stan/order.schema.json"},
+//	 {"channel": "events", "url": "https://validator.local/events"}]
+func LoadValidatorsFile(path string) ([]*Validator, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var validators []*Validator
+	if err := json.Unmarshal(b, &validators); err != nil {
+		return nil, fmt.Errorf("error parsing validators file %q: %v", path, err)
+	}
+	if err := validateValidators(validators); err != nil {
+		return nil, fmt.Errorf("error parsing validators file %q: %v", path, err)
+	}
+	return validators, nil
+}
+
+// validateValidators checks that each validator has a valid channel and
+// exactly one way of validating the payloads.
+func validateValidators(validators []*Validator) error {
+	for _, v := range validators {
+		if !isValidSubject(v.Channel) && !isValidWildcardSubject(v.Channel) {
+			return fmt.Errorf("invalid channel %q in validator", v.Channel)
+		}
+		n := 0
+		for _, set := range []bool{v.Schema != "", v.URL != "", v.Validator != nil} {
+			if set {
+				n++
+			}
+		}
+		if n != 1 {
+			return fmt.Errorf("validator of %q must have exactly one of a schema, a URL or a validator", v.Channel)
+		}
+	}
+	return nil
+}
+
+// newChannelValidators returns the validators of the options, loading
+// their schema files.
+func newChannelValidators(validators []*Validator) ([]*channelValidator, error) {
+	var cvs []*channelValidator
+	for _, v := range validators {
+		cv := &channelValidator{channel: v.Channel, validator: v.Validator}
+		switch {
+		case v.Schema != "":
+			sv, err := loadSchemaValidator(v.Schema)
+			if err != nil {
+				return nil, err
+			}
+			cv.validator = sv
+		case v.URL != "":
+			cv.validator = &webhookValidator{url: v.URL, client: &http.Client{Timeout: validatorWebhookTimeout}}
+		}
+		cvs = append(cvs, cv)
+	}
+	return cvs, nil
+}
+
+// validatePayload validates the payload of a message published on the
+// channel with the first validator matching the channel, if any. It
+// returns ErrValidatorDown if the validator could not be reached, and a
+// *payloadError with the reason if the payload is invalid.
+func (s *StanServer) validatePayload(channel string, data []byte) error {
+	for _, cv := range s.validators {
+		if !util.SubjectMatches(cv.channel, channel) {
+			continue
+		}
+		err := cv.validator.Validate(channel, data)
+		if err == nil || err == ErrValidatorDown {
+			return err
+		}
+		return &payloadError{reason: err}
+	}
+	return nil
+}
+
+// Validate implements the PayloadValidator interface. Errors reaching the
+// webhook and 5xx statuses are logged and reported as ErrValidatorDown,
+// so that the message is rejected.
+func (wv *webhookValidator) Validate(channel string, data []byte) error {
+	req, err := http.NewRequest("POST", wv.url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set(channelHeader, channel)
+	resp, err := wv.client.Do(req)
+	if err != nil {
+		Errorf("STAN: Unable to validate payload on %s: %v", channel, err)
+		return ErrValidatorDown
+	}
+	defer resp.Body.Close()
+	reason, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxValidatorReasonLen))
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode >= 400 && resp.StatusCode < 500:
+		if r := strings.TrimSpace(string(reason)); r != "" {
+			return fmt.Errorf("%s", r)
+		}
+		return fmt.Errorf("rejected by validator with status %d", resp.StatusCode)
+	}
+	Errorf("STAN: Unable to validate payload on %s: validator returned status %d", channel, resp.StatusCode)
+	return ErrValidatorDown
+}
@@ -0,0 +1,151 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestJSONSchema(t *testing.T) {
+	schema := &jsonSchema{}
+	if err := json.Unmarshal([]byte(`{
+		"type": "object",
+		"required": ["id", "amount"],
+		"additionalProperties": false,
+		"properties": {
+			"id":     {"type": "string", "pattern": "^o-[0-9]+$"},
+			"amount": {"type": "number", "minimum": 0, "maximum": 1000},
+			"qty":    {"type": "integer"},
+			"status": {"enum": ["new", "paid"]},
+			"tags":   {"type": "array", "maxItems": 2, "items": {"type": "string", "minLength": 1}},
+			"note":   {"type": ["string", "null"], "maxLength": 5}
+		}
+	}`), schema); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := schema.compile(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	sv := &schemaValidator{schema: schema}
+	for _, test := range []struct {
+		doc   string
+		valid bool
+	}{
+		{`{"id": "o-1", "amount": 10}`, true},
+		{`{"id": "o-1", "amount": 10, "qty": 2, "status": "paid", "tags": ["a"], "note": null}`, true},
+		{`{"id": "o-1", "amount": 10, "note": "hello"}`, true},
+		{`not json`, false},
+		{`[]`, false},
+		{`{"id": "o-1"}`, false},
+		{`{"id": "x-1", "amount": 10}`, false},
+		{`{"id": "o-1", "amount": -1}`, false},
+		{`{"id": "o-1", "amount": 1001}`, false},
+		{`{"id": "o-1", "amount": "10"}`, false},
+		{`{"id": "o-1", "amount": 10, "qty": 1.5}`, false},
+		{`{"id": "o-1", "amount": 10, "status": "lost"}`, false},
+		{`{"id": "o-1", "amount": 10, "tags": ["a", "b", "c"]}`, false},
+		{`{"id": "o-1", "amount": 10, "tags": [""]}`, false},
+		{`{"id": "o-1", "amount": 10, "note": "too long"}`, false},
+		{`{"id": "o-1", "amount": 10, "other": 1}`, false},
+	} {
+		if err := sv.Validate("orders", []byte(test.doc)); (err == nil) != test.valid {
+			t.Fatalf("Unexpected result for %s: %v", test.doc, err)
+		}
+	}
+	for _, invalid := range []string{`{"type": "float"}`, `{"pattern": "("}`, `{"properties": {"a": {"type": 1}}}`} {
+		schema := &jsonSchema{}
+		if err := json.Unmarshal([]byte(invalid), schema); err == nil {
+			if err := schema.compile(); err == nil {
+				t.Fatalf("Expected error for schema %s", invalid)
+			}
+		}
+	}
+}
+
+// funcValidator is a PayloadValidator rejecting empty payloads.
+type funcValidator struct{}
+
+func (funcValidator) Validate(channel string, data []byte) error {
+	if len(data) == 0 {
+		return fmt.Errorf("empty payload")
+	}
+	return nil
+}
+
+func TestPayloadValidators(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "stan_server_validator_")
+	if err != nil {
+		t.Fatalf("Unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	schemaFile := filepath.Join(tmpDir, "order.schema.json")
+	if err := ioutil.WriteFile(schemaFile, []byte(`{"type": "object", "required": ["id"]}`), 0600); err != nil {
+		t.Fatalf("Unable to write schema: %v", err)
+	}
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		if r.Header.Get(channelHeader) != "events" || string(b) != "ok" {
+			http.Error(w, "bad event", http.StatusBadRequest)
+		}
+	}))
+	defer webhook.Close()
+
+	opts := GetDefaultOptions()
+	opts.Validators = []*Validator{
+		{Channel: "orders.>", Schema: schemaFile},
+		{Channel: "events", URL: webhook.URL},
+		{Channel: "down", URL: "http://127.0.0.1:1"},
+		{Channel: "*", Validator: funcValidator{}},
+	}
+	s := runServerWithOpts(t, opts, nil)
+	defer s.Shutdown()
+
+	sc := NewDefaultConnection(t)
+	defer sc.Close()
+
+	for _, test := range []struct {
+		channel, data, err string
+	}{
+		{"orders.eu", `{"id": 1}`, ""},
+		{"orders.eu", `{"amount": 1}`, ErrInvalidPayload.Error() + `: $: missing property "id"`},
+		{"events", "ok", ""},
+		{"events", "ko", ErrInvalidPayload.Error() + ": bad event"},
+		{"down", "ok", ErrValidatorDown.Error()},
+		{"foo", "x", ""},
+		{"foo", "", ErrInvalidPayload.Error() + ": empty payload"},
+		{"foo.bar", "", ""},
+	} {
+		err := sc.Publish(test.channel, []byte(test.data))
+		if test.err == "" && err != nil {
+			t.Fatalf("Unexpected error publishing %q on %s: %v", test.data, test.channel, err)
+		} else if test.err != "" && (err == nil || err.Error() != test.err) {
+			t.Fatalf("Expected error %q publishing %q on %s, got %v", test.err, test.data, test.channel, err)
+		}
+	}
+	if n, _, _ := s.store.MsgsState("orders.eu"); n != 1 {
+		t.Fatalf("Expected 1 message, got %v", n)
+	}
+
+	for _, invalid := range []*Validator{
+		{Channel: "foo..bar", URL: webhook.URL},
+		{Channel: "foo"},
+		{Channel: "foo", URL: webhook.URL, Schema: schemaFile},
+	} {
+		if err := validateValidators([]*Validator{invalid}); err == nil {
+			t.Fatalf("Expected error for validator %+v", invalid)
+		}
+	}
+	opts = GetDefaultOptions()
+	opts.Validators = []*Validator{{Channel: "foo", Schema: filepath.Join(tmpDir, "missing.json")}}
+	if _, err := StartServerWithOpts(opts, nil); err == nil || !strings.Contains(err.Error(), "missing.json") {
+		t.Fatalf("Expected error about the missing schema, got %v", err)
+	}
+}
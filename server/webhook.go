@@ -0,0 +1,310 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nats-io/gnatsd/server"
+	"github.com/nats-io/go-nats-streaming/pb"
+	"github.com/nats-io/nats"
+	"github.com/nats-io/nats-streaming-server/spb"
+)
+
+const (
+	// Prefix of the client ID of the subscription of a webhook, followed
+	// by the name of the webhook.
+	webhookClientIDPrefix = "webhook_"
+
+	// Interval between two attempts to subscribe a webhook after an error.
+	webhookRetryInterval = time.Second
+
+	// Timeout of the requests sent to the server for a webhook.
+	webhookRequestTimeout = 2 * time.Second
+
+	// Timeout of a POST of a message to a webhook.
+	webhookPostTimeout = 10 * time.Second
+
+	// Time the server waits for a webhook to accept a message before
+	// sending it again, in seconds. Longer than webhookPostTimeout, so
+	// that a message is not sent again while it is being posted.
+	webhookAckWait = 30
+
+	// Default number of messages sent to a webhook before waiting for acks.
+	webhookDefaultMaxInFlight = 1
+
+	// Delay before the first redelivery of a message the webhook did not
+	// accept, doubled after each attempt up to webhookMaxBackoff.
+	webhookMinBackoff = time.Second
+	webhookMaxBackoff = time.Minute
+)
+
+// Headers of the requests posting a message to a webhook, besides
+// channelHeader.
+const (
+	sequenceHeader    = "Stan-Sequence"
+	timestampHeader   = "Stan-Timestamp"
+	redeliveredHeader = "Stan-Redelivered"
+)
+
+// Webhook delivers the messages of a channel to an HTTP endpoint, for
+// consumers that can't hold a NATS connection. Each message is posted to
+// URL, with the message as the body and its channel, sequence and
+// timestamp in headers, and is acknowledged if the endpoint answers with
+// a 2xx status. Otherwise, it is redelivered after a delay growing with
+// the number of attempts. The position of the webhook is kept by a durable
+// subscription, named after the webhook, so delivery resumes where it
+// stopped after a restart.
+type Webhook struct {
+	Name        string `json:"name"`                   // Name of the durable subscription
+	Channel     string `json:"channel"`                // Channel whose messages are delivered
+	URL         string `json:"url"`                    // HTTP or HTTPS endpoint
+	MaxInFlight int32  `json:"max_inflight,omitempty"` // Messages sent before waiting for acks, webhookDefaultMaxInFlight if 0
+	DeliverAll  bool   `json:"deliver_all,omitempty"`  // Start with the first message stored, instead of new ones, when created
+}
+
+// LoadWebhooksFile reads the webhooks from a JSON file containing an array
+// of webhooks, for instance:
+//
+//	[{"name": "billing", "channel": "orders", "url": "https://billing.local/orders"},
+//	 {"name": "audit", "channel": "events", "url": "https://audit.local/in",
+//	  "max_inflight": 16, "deliver_all": true}]
+func LoadWebhooksFile(path string) ([]*Webhook, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var webhooks []*Webhook
+	if err := json.Unmarshal(b, &webhooks); err != nil {
+		return nil, fmt.Errorf("error parsing webhooks file %q: %v", path, err)
+	}
+	if err := validateWebhooks(webhooks); err != nil {
+		return nil, fmt.Errorf("error parsing webhooks file %q: %v", path, err)
+	}
+	return webhooks, nil
+}
+
+// validateWebhooks checks that the webhooks have a unique name usable in
+// a client ID, a channel and an HTTP URL.
+func validateWebhooks(webhooks []*Webhook) error {
+	names := make(map[string]struct{}, len(webhooks))
+	for _, w := range webhooks {
+		if !clientIDRegEx.MatchString(w.Name) {
+			return fmt.Errorf("invalid webhook name %q", w.Name)
+		}
+		if _, dup := names[w.Name]; dup {
+			return fmt.Errorf("duplicate webhook name %q", w.Name)
+		}
+		names[w.Name] = struct{}{}
+		if !isValidSubject(w.Channel) {
+			return fmt.Errorf("invalid channel %q for webhook %q", w.Channel, w.Name)
+		}
+		if !strings.HasPrefix(w.URL, "http://") && !strings.HasPrefix(w.URL, "https://") {
+			return fmt.Errorf("invalid URL %q for webhook %q", w.URL, w.Name)
+		}
+		if w.MaxInFlight < 0 {
+			return fmt.Errorf("invalid max in flight for webhook %q", w.Name)
+		}
+	}
+	return nil
+}
+
+// webhookBackoff returns the delay before the redelivery of a message the
+// webhook did not accept after `attempts` attempts.
+func webhookBackoff(attempts int) time.Duration {
+	delay := webhookMinBackoff
+	for i := 1; i < attempts && delay < webhookMaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > webhookMaxBackoff {
+		delay = webhookMaxBackoff
+	}
+	return delay
+}
+
+// startWebhooks starts delivering the messages of the webhooks' channels.
+// Each webhook acts as a streaming client connected to the embedded or
+// external NATS Server, as the WebSocket gateway does.
+func (s *StanServer) startWebhooks(nOpts *server.Options) error {
+	if len(s.opts.Webhooks) == 0 {
+		return nil
+	}
+	nc, err := createNatsClientConn(s.opts, nOpts)
+	if err != nil {
+		return err
+	}
+	s.webhookNc = nc
+	s.webhooksQuit = make(chan struct{})
+	for _, w := range s.opts.Webhooks {
+		s.webhooksWg.Add(1)
+		go s.runWebhook(w)
+	}
+	return nil
+}
+
+// stopWebhooks stops the delivery and waits for the go routines to return.
+func (s *StanServer) stopWebhooks() {
+	if s.webhooksQuit == nil {
+		return
+	}
+	close(s.webhooksQuit)
+	s.webhooksWg.Wait()
+	s.webhookNc.Close()
+}
+
+// runWebhook delivers the messages to the webhook until the server shuts
+// down. After an error, the durable subscription is resumed.
+func (s *StanServer) runWebhook(w *Webhook) {
+	defer s.webhooksWg.Done()
+	client := &http.Client{Timeout: webhookPostTimeout}
+	for {
+		if err := s.pushToWebhook(w, client); err != nil {
+			Errorf("STAN: Unable to deliver channel=%s to webhook %q: %v", w.Channel, w.Name, err)
+		} else {
+			return
+		}
+		select {
+		case <-s.webhooksQuit:
+			return
+		case <-time.After(webhookRetryInterval):
+		}
+	}
+}
+
+// pushToWebhook connects as the client of the webhook, resumes its durable
+// subscription and posts the messages, until the server shuts down (in
+// which case nil is returned) or an error occurs.
+func (s *StanServer) pushToWebhook(w *Webhook, client *http.Client) error {
+	nc := s.webhookNc
+	clientID := webhookClientIDPrefix + w.Name
+	hbInbox := nats.NewInbox()
+	hbSub, err := nc.Subscribe(hbInbox, func(hb *nats.Msg) {
+		nc.Publish(hb.Reply, nil)
+	})
+	if err != nil {
+		return err
+	}
+	defer hbSub.Unsubscribe()
+	creq := &pb.ConnectRequest{ClientID: clientID, HeartbeatInbox: hbInbox}
+	b, _ := creq.Marshal()
+	reply, err := nc.Request(s.info.Discovery, b, webhookRequestTimeout)
+	if err != nil {
+		return err
+	}
+	cresp := &pb.ConnectResponse{}
+	if err := cresp.Unmarshal(reply.Data); err != nil {
+		return err
+	}
+	if cresp.Error != "" {
+		return errors.New(cresp.Error)
+	}
+	// Closing the client keeps the durable subscription.
+	defer func() {
+		req := &pb.CloseRequest{ClientID: clientID}
+		b, _ := req.Marshal()
+		nc.Request(cresp.CloseRequests, b, webhookRequestTimeout)
+	}()
+
+	maxInFlight := w.MaxInFlight
+	if maxInFlight == 0 {
+		maxInFlight = webhookDefaultMaxInFlight
+	}
+	msgs := make(chan *nats.Msg, maxInFlight)
+	inbox := nats.NewInbox()
+	sub, err := nc.ChanSubscribe(inbox, msgs)
+	if err != nil {
+		return err
+	}
+	defer sub.Unsubscribe()
+	sreq := &pb.SubscriptionRequest{
+		ClientID:      clientID,
+		Subject:       w.Channel,
+		Inbox:         inbox,
+		MaxInFlight:   maxInFlight,
+		AckWaitInSecs: webhookAckWait,
+		DurableName:   w.Name,
+		StartPosition: pb.StartPosition_NewOnly,
+	}
+	if w.DeliverAll {
+		sreq.StartPosition = pb.StartPosition_First
+	}
+	b, _ = sreq.Marshal()
+	reply, err = nc.Request(cresp.SubRequests, b, webhookRequestTimeout)
+	if err != nil {
+		return err
+	}
+	sresp := &pb.SubscriptionResponse{}
+	if err := sresp.Unmarshal(reply.Data); err != nil {
+		return err
+	}
+	if sresp.Error != "" {
+		return errors.New(sresp.Error)
+	}
+	Noticef("STAN: Delivering channel=%s to webhook %q", w.Channel, w.Name)
+
+	// Number of failed attempts of the messages not accepted yet.
+	attempts := make(map[uint64]int)
+	for {
+		select {
+		case <-s.webhooksQuit:
+			return nil
+		case raw := <-msgs:
+			m := &pb.MsgProto{}
+			if err := m.Unmarshal(raw.Data); err != nil {
+				continue
+			}
+			ack := &pb.Ack{Subject: m.Subject, Sequence: m.Sequence}
+			b, _ := ack.Marshal()
+			if err := postToWebhook(client, w.URL, m); err != nil {
+				attempts[m.Sequence]++
+				delay := webhookBackoff(attempts[m.Sequence])
+				Debugf("STAN: Webhook %q did not accept msgseq %s:%d, retrying in %v: %v",
+					w.Name, m.Subject, m.Sequence, delay, err)
+				nak := &spb.AckExt{Nak: true, Delay: int64(delay)}
+				ext, _ := nak.Marshal()
+				b = append(b, ext...)
+			} else {
+				delete(attempts, m.Sequence)
+			}
+			if err := nc.Publish(sresp.AckInbox, b); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// postToWebhook posts the message to the URL, returning an error unless
+// the response has a 2xx status.
+func postToWebhook(client *http.Client, url string, m *pb.MsgProto) error {
+	req, err := http.NewRequest("POST", url, bytes.NewReader(m.Data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set(channelHeader, m.Subject)
+	req.Header.Set(sequenceHeader, strconv.FormatUint(m.Sequence, 10))
+	req.Header.Set(timestampHeader, strconv.FormatInt(m.Timestamp, 10))
+	if m.Redelivered {
+		req.Header.Set(redeliveredHeader, "true")
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	// Read the body so that the connection can be reused.
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+type webhookPost struct {
+	channel, seq, data string
+	redelivered        bool
+}
+
+func TestWebhooks(t *testing.T) {
+	posts := make(chan webhookPost, 10)
+	var mu sync.Mutex
+	failed := false
+	endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		posts <- webhookPost{
+			channel:     r.Header.Get(channelHeader),
+			seq:         r.Header.Get(sequenceHeader),
+			data:        string(b),
+			redelivered: r.Header.Get(redeliveredHeader) == "true",
+		}
+		// Fail the first request only.
+		mu.Lock()
+		defer mu.Unlock()
+		if !failed {
+			failed = true
+			http.Error(w, "try again", http.StatusServiceUnavailable)
+		}
+	}))
+	defer endpoint.Close()
+
+	opts := GetDefaultOptions()
+	opts.Webhooks = []*Webhook{{Name: "orders", Channel: "foo", URL: endpoint.URL, DeliverAll: true}}
+	s := runServerWithOpts(t, opts, nil)
+	defer s.Shutdown()
+
+	sc := NewDefaultConnection(t)
+	defer sc.Close()
+	for _, data := range []string{"first", "second"} {
+		if err := sc.Publish("foo", []byte(data)); err != nil {
+			t.Fatalf("Unexpected error on publish: %v", err)
+		}
+	}
+	for _, expected := range []webhookPost{
+		{"foo", "1", "first", false},
+		{"foo", "1", "first", true},
+		{"foo", "2", "second", false},
+	} {
+		select {
+		case p := <-posts:
+			if p != expected {
+				t.Fatalf("Expected post %+v, got %+v", expected, p)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Did not get post %+v", expected)
+		}
+	}
+	waitForCount(t, 0, func() (string, int) {
+		count := 0
+		for _, sub := range s.clients.GetSubs(webhookClientIDPrefix + "orders") {
+			sub.RLock()
+			count += len(sub.acksPending)
+			sub.RUnlock()
+		}
+		return "ack pending", count
+	})
+	select {
+	case p := <-posts:
+		t.Fatalf("Unexpected post %+v", p)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	for _, invalid := range [][]*Webhook{
+		{{Name: "a b", Channel: "foo", URL: endpoint.URL}},
+		{{Name: "a", Channel: "foo.*", URL: endpoint.URL}},
+		{{Name: "a", Channel: "foo", URL: "ftp://host/path"}},
+		{{Name: "a", Channel: "foo", URL: endpoint.URL, MaxInFlight: -1}},
+		{{Name: "a", Channel: "foo", URL: endpoint.URL}, {Name: "a", Channel: "bar", URL: endpoint.URL}},
+	} {
+		if err := validateWebhooks(invalid); err == nil {
+			t.Fatalf("Expected error for webhooks %+v", invalid)
+		}
+	}
+	for attempts, expected := range map[int]time.Duration{
+		1:  webhookMinBackoff,
+		2:  2 * webhookMinBackoff,
+		4:  8 * webhookMinBackoff,
+		20: webhookMaxBackoff,
+	} {
+		if d := webhookBackoff(attempts); d != expected {
+			t.Fatalf("Expected backoff %v after %v attempts, got %v", expected, attempts, d)
+		}
+	}
+}
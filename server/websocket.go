@@ -0,0 +1,505 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/gnatsd/server"
+	"github.com/nats-io/go-nats-streaming/pb"
+	"github.com/nats-io/nats"
+	"github.com/nats-io/nats-streaming-server/spb"
+)
+
+// Operations of the streaming protocol over WebSocket. Each binary
+// WebSocket message starts with one of these bytes, followed by the
+// protocol buffer message of the operation. For wsAck and wsMsg, the
+// operation byte is followed by the ack inbox of the subscription (a
+// 2 bytes big endian length then the inbox) before the protocol buffer.
+const (
+	wsConnect     = 1 // pb.ConnectRequest, answered with pb.ConnectResponse
+	wsPublish     = 2 // pb.PubMsg, answered with pb.PubAck
+	wsSubscribe   = 3 // pb.SubscriptionRequest, answered with pb.SubscriptionResponse
+	wsUnsubscribe = 4 // pb.UnsubscribeRequest, answered with pb.SubscriptionResponse
+	wsAck         = 5 // pb.Ack, not answered
+	wsMsg         = 6 // pb.MsgProto, sent by the server
+	wsClose       = 7 // pb.CloseRequest, answered with pb.CloseResponse
+)
+
+// WebSocket frame opcodes (RFC 6455).
+const (
+	wsOpContinuation = 0x0
+	wsOpBinary       = 0x2
+	wsOpClose        = 0x8
+	wsOpPing         = 0x9
+	wsOpPong         = 0xA
+)
+
+const (
+	// Appended to the client key to compute the accept key of the handshake.
+	wsAcceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+	// Maximum size of a WebSocket message, larger messages close the
+	// connection.
+	wsMaxMessageSize = server.MAX_PAYLOAD_SIZE + 64*1024
+
+	// Timeout of the requests forwarded to the server.
+	wsRequestTimeout = 2 * time.Second
+)
+
+var (
+	errWSProtocol      = errors.New("protocol violation")
+	errWSNotConnected  = errors.New("client not connected")
+	errWSUnknownSubscr = errors.New("unknown subscription")
+)
+
+// startWebSocket starts accepting WebSocket connections on the
+// WebSocketListen address. Each connection acts as a streaming client
+// connected to the embedded or external NATS Server, so that clients
+// have the same client ID, ack and durable semantics as other clients.
+func (s *StanServer) startWebSocket(nOpts *server.Options) error {
+	if s.opts.WebSocketListen == "" {
+		return nil
+	}
+	nc, err := createNatsClientConn(s.opts, nOpts)
+	if err != nil {
+		return err
+	}
+	l, err := net.Listen("tcp", s.opts.WebSocketListen)
+	if err != nil {
+		nc.Close()
+		return err
+	}
+	s.wsNc = nc
+	s.wsListener = l
+	s.wsConns = make(map[net.Conn]struct{})
+	Noticef("STAN: Listening for WebSocket clients on %s", l.Addr())
+	s.wsWg.Add(1)
+	go func() {
+		defer s.wsWg.Done()
+		(&http.Server{Handler: http.HandlerFunc(s.handleWebSocketUpgrade)}).Serve(l)
+	}()
+	return nil
+}
+
+// stopWebSocket stops accepting WebSocket connections, closes the existing
+// ones and waits for their go routines to return.
+func (s *StanServer) stopWebSocket() {
+	if s.wsListener == nil {
+		return
+	}
+	s.wsListener.Close()
+	s.wsLock.Lock()
+	for c := range s.wsConns {
+		c.Close()
+	}
+	s.wsConns = nil
+	s.wsLock.Unlock()
+	s.wsWg.Wait()
+	s.wsNc.Close()
+}
+
+// handleWebSocketUpgrade performs the WebSocket opening handshake and
+// then processes the messages of the connection.
+func (s *StanServer) handleWebSocketUpgrade(w http.ResponseWriter, r *http.Request) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if r.Method != "GET" || key == "" || r.Header.Get("Sec-WebSocket-Version") != "13" ||
+		!strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		http.Error(w, "not a WebSocket handshake", http.StatusBadRequest)
+		return
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "WebSocket not supported", http.StatusInternalServerError)
+		return
+	}
+	conn, brw, err := hj.Hijack()
+	if err != nil {
+		return
+	}
+	s.wsLock.Lock()
+	if s.wsConns == nil {
+		s.wsLock.Unlock()
+		conn.Close()
+		return
+	}
+	s.wsConns[conn] = struct{}{}
+	s.wsWg.Add(1)
+	s.wsLock.Unlock()
+	defer s.wsWg.Done()
+	defer func() {
+		conn.Close()
+		s.wsLock.Lock()
+		if s.wsConns != nil {
+			delete(s.wsConns, conn)
+		}
+		s.wsLock.Unlock()
+	}()
+
+	h := sha1.New()
+	io.WriteString(h, key+wsAcceptGUID)
+	fmt.Fprintf(brw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"+
+		"Sec-WebSocket-Accept: %s\r\n\r\n", base64.StdEncoding.EncodeToString(h.Sum(nil)))
+	if err := brw.Flush(); err != nil {
+		return
+	}
+	c := &wsConn{conn: conn, br: brw.Reader, subs: make(map[string]*nats.Subscription)}
+	s.processWebSocketConn(c)
+}
+
+// wsConn is a connection from a WebSocket client.
+type wsConn struct {
+	sync.Mutex // protects writes
+	conn       net.Conn
+	br         *bufio.Reader
+	clientID   string
+	cresp      *pb.ConnectResponse
+	session    string                        // session of the client, when the server has users
+	closed     bool                          // the client sent its CloseRequest
+	pubAckSub  *nats.Subscription            // receives the PubAcks
+	pubAckIn   string                        // inbox of pubAckSub
+	hbSub      *nats.Subscription            // answers the server heartbeats
+	subs       map[string]*nats.Subscription // NATS subscriptions keyed by ack inbox
+}
+
+func (s *StanServer) processWebSocketConn(c *wsConn) {
+	defer s.closeWebSocketClient(c)
+	for {
+		msg, err := c.readMessage()
+		if err != nil {
+			if err != io.EOF {
+				Errorf("STAN: [Client:%s] Closing WebSocket connection: %v", c.clientID, err)
+			}
+			return
+		}
+		if len(msg) == 0 {
+			Errorf("STAN: [Client:%s] Closing WebSocket connection: %v", c.clientID, errWSProtocol)
+			return
+		}
+		op, data := msg[0], msg[1:]
+		if op != wsConnect && c.cresp == nil {
+			err = errWSNotConnected
+		} else {
+			switch op {
+			case wsConnect:
+				err = s.processWebSocketConnect(c, data)
+			case wsPublish:
+				err = s.processWebSocketPublish(c, data)
+			case wsSubscribe:
+				err = s.processWebSocketSubscribe(c, data)
+			case wsUnsubscribe:
+				err = s.processWebSocketUnsubscribe(c, data)
+			case wsAck:
+				err = s.processWebSocketAck(c, data)
+			case wsClose:
+				err = s.processWebSocketClose(c, data)
+			default:
+				err = errWSProtocol
+			}
+		}
+		if err != nil {
+			Errorf("STAN: [Client:%s] Closing WebSocket connection: %v", c.clientID, err)
+			return
+		}
+	}
+}
+
+// forwardedRequest returns the request bytes with the given fields
+// appended. Fields appended to a protocol buffer message override those
+// of the message, while the rest of the message, including the extensions
+// this server understands, is left untouched.
+func forwardedRequest(data []byte, override interface {
+	Marshal() ([]byte, error)
+}) []byte {
+	b, _ := override.Marshal()
+	return append(append([]byte(nil), data...), b...)
+}
+
+func (s *StanServer) processWebSocketConnect(c *wsConn, data []byte) error {
+	req := &pb.ConnectRequest{}
+	if c.cresp != nil || req.Unmarshal(data) != nil {
+		return errWSProtocol
+	}
+	// Heartbeats are answered by the gateway as long as the WebSocket
+	// connection is open.
+	hbInbox := nats.NewInbox()
+	hbSub, err := s.wsNc.Subscribe(hbInbox, func(m *nats.Msg) {
+		s.wsNc.Publish(m.Reply, nil)
+	})
+	if err != nil {
+		return err
+	}
+	reply, err := s.wsNc.Request(s.info.Discovery, forwardedRequest(data, &pb.ConnectRequest{HeartbeatInbox: hbInbox}), wsRequestTimeout)
+	if err != nil {
+		hbSub.Unsubscribe()
+		return err
+	}
+	cresp := &pb.ConnectResponse{}
+	if err := cresp.Unmarshal(reply.Data); err != nil {
+		hbSub.Unsubscribe()
+		return err
+	}
+	if cresp.Error != "" {
+		hbSub.Unsubscribe()
+		return c.writeMessage(wsConnect, "", reply.Data)
+	}
+	c.pubAckIn = nats.NewInbox()
+	c.pubAckSub, err = s.wsNc.Subscribe(c.pubAckIn, func(m *nats.Msg) {
+		c.writeMessage(wsPublish, "", m.Data)
+	})
+	if err != nil {
+		hbSub.Unsubscribe()
+		return err
+	}
+	// Kept to close the client when the connection is lost.
+	ext := &spb.ConnectResponseExt{}
+	if ext.Unmarshal(reply.Data) == nil {
+		c.session = ext.Session
+	}
+	c.clientID, c.cresp, c.hbSub = req.ClientID, cresp, hbSub
+	Debugf("STAN: [Client:%s] Connected over WebSocket from %s", c.clientID, c.conn.RemoteAddr())
+	return c.writeMessage(wsConnect, "", reply.Data)
+}
+
+func (s *StanServer) processWebSocketPublish(c *wsConn, data []byte) error {
+	pm := &pb.PubMsg{}
+	if err := pm.Unmarshal(data); err != nil || !isValidSubject(pm.Subject) {
+		return errWSProtocol
+	}
+	return s.wsNc.PublishRequest(c.cresp.PubPrefix+"."+pm.Subject, c.pubAckIn, data)
+}
+
+func (s *StanServer) processWebSocketSubscribe(c *wsConn, data []byte) error {
+	if (&pb.SubscriptionRequest{}).Unmarshal(data) != nil {
+		return errWSProtocol
+	}
+	inbox := nats.NewInbox()
+	var ackInbox string
+	var ready sync.WaitGroup
+	ready.Add(1)
+	sub, err := s.wsNc.Subscribe(inbox, func(m *nats.Msg) {
+		// Wait for the subscription response to know the ack inbox.
+		ready.Wait()
+		c.writeMessage(wsMsg, ackInbox, m.Data)
+	})
+	if err != nil {
+		return err
+	}
+	defer ready.Done()
+	reply, err := s.wsNc.Request(c.cresp.SubRequests, forwardedRequest(data, &pb.SubscriptionRequest{Inbox: inbox}), wsRequestTimeout)
+	if err != nil {
+		sub.Unsubscribe()
+		return err
+	}
+	sresp := &pb.SubscriptionResponse{}
+	if err := sresp.Unmarshal(reply.Data); err != nil {
+		sub.Unsubscribe()
+		return err
+	}
+	if sresp.Error != "" {
+		sub.Unsubscribe()
+	} else {
+		ackInbox = sresp.AckInbox
+		c.subs[ackInbox] = sub
+	}
+	return c.writeMessage(wsSubscribe, "", reply.Data)
+}
+
+func (s *StanServer) processWebSocketUnsubscribe(c *wsConn, data []byte) error {
+	req := &pb.UnsubscribeRequest{}
+	if err := req.Unmarshal(data); err != nil {
+		return errWSProtocol
+	}
+	sub, ok := c.subs[req.Inbox]
+	if !ok {
+		return errWSUnknownSubscr
+	}
+	reply, err := s.wsNc.Request(c.cresp.UnsubRequests, data, wsRequestTimeout)
+	if err != nil {
+		return err
+	}
+	sresp := &pb.SubscriptionResponse{}
+	if err := sresp.Unmarshal(reply.Data); err != nil {
+		return err
+	}
+	if sresp.Error == "" {
+		sub.Unsubscribe()
+		delete(c.subs, req.Inbox)
+	}
+	return c.writeMessage(wsUnsubscribe, "", reply.Data)
+}
+
+func (s *StanServer) processWebSocketAck(c *wsConn, data []byte) error {
+	if len(data) < 2 || len(data) < 2+int(binary.BigEndian.Uint16(data)) {
+		return errWSProtocol
+	}
+	n := 2 + int(binary.BigEndian.Uint16(data))
+	ackInbox := string(data[2:n])
+	// Acks are only published on the ack inboxes of the client's own
+	// subscriptions.
+	if _, ok := c.subs[ackInbox]; !ok {
+		return errWSUnknownSubscr
+	}
+	return s.wsNc.Publish(ackInbox, data[n:])
+}
+
+func (s *StanServer) processWebSocketClose(c *wsConn, data []byte) error {
+	reply, err := s.wsNc.Request(c.cresp.CloseRequests, data, wsRequestTimeout)
+	if err != nil {
+		return err
+	}
+	cresp := &pb.CloseResponse{}
+	if err := cresp.Unmarshal(reply.Data); err != nil {
+		return err
+	}
+	if cresp.Error == "" {
+		c.closed = true
+	}
+	return c.writeMessage(wsClose, "", reply.Data)
+}
+
+// closeWebSocketClient releases the NATS subscriptions of the connection
+// and, if the client did not close itself, closes it so that its
+// non-durable subscriptions are removed without waiting for heartbeats
+// to fail. When the server shuts down, the client is kept so that it can
+// resume after the restart.
+func (s *StanServer) closeWebSocketClient(c *wsConn) {
+	if c.cresp == nil {
+		return
+	}
+	c.hbSub.Unsubscribe()
+	c.pubAckSub.Unsubscribe()
+	for _, sub := range c.subs {
+		sub.Unsubscribe()
+	}
+	s.RLock()
+	shutdown := s.shutdown
+	s.RUnlock()
+	if !c.closed && !shutdown {
+		req := &pb.CloseRequest{ClientID: c.clientID}
+		b, _ := req.Marshal()
+		eb, _ := (&spb.RequestExt{Session: c.session}).Marshal()
+		s.wsNc.Request(c.cresp.CloseRequests, append(b, eb...), wsRequestTimeout)
+	}
+	Debugf("STAN: [Client:%s] WebSocket connection closed", c.clientID)
+}
+
+// readMessage returns the next binary message, answering the pings and
+// reassembling fragmented messages. It returns io.EOF when the client
+// closes the connection.
+func (c *wsConn) readMessage() ([]byte, error) {
+	var msg []byte
+	for {
+		var header [2]byte
+		if _, err := io.ReadFull(c.br, header[:]); err != nil {
+			return nil, err
+		}
+		fin, op, masked := header[0]&0x80 != 0, header[0]&0x0f, header[1]&0x80 != 0
+		size := uint64(header[1] & 0x7f)
+		switch size {
+		case 126:
+			var ext [2]byte
+			if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+				return nil, err
+			}
+			size = uint64(binary.BigEndian.Uint16(ext[:]))
+		case 127:
+			var ext [8]byte
+			if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+				return nil, err
+			}
+			size = binary.BigEndian.Uint64(ext[:])
+		}
+		// Frames sent by clients must be masked.
+		if !masked {
+			return nil, errWSProtocol
+		}
+		if size > wsMaxMessageSize || uint64(len(msg))+size > wsMaxMessageSize {
+			return nil, fmt.Errorf("message too big")
+		}
+		var mask [4]byte
+		if _, err := io.ReadFull(c.br, mask[:]); err != nil {
+			return nil, err
+		}
+		payload := make([]byte, size)
+		if _, err := io.ReadFull(c.br, payload); err != nil {
+			return nil, err
+		}
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+		switch op {
+		case wsOpPing:
+			if err := c.writeFrame(wsOpPong, payload); err != nil {
+				return nil, err
+			}
+		case wsOpPong:
+		case wsOpClose:
+			c.writeFrame(wsOpClose, nil)
+			return nil, io.EOF
+		case wsOpBinary, wsOpContinuation:
+			if (op == wsOpBinary) != (msg == nil) {
+				return nil, errWSProtocol
+			}
+			if msg == nil {
+				msg = make([]byte, 0, len(payload))
+			}
+			msg = append(msg, payload...)
+			if fin {
+				return msg, nil
+			}
+		default:
+			// Text messages are not supported.
+			return nil, errWSProtocol
+		}
+	}
+}
+
+// writeMessage sends a binary message with the given operation, ack inbox
+// (for wsMsg only) and protocol buffer message.
+func (c *wsConn) writeMessage(op byte, ackInbox string, data []byte) error {
+	msg := make([]byte, 0, 3+len(ackInbox)+len(data))
+	msg = append(msg, op)
+	if op == wsMsg {
+		msg = append(msg, byte(len(ackInbox)>>8), byte(len(ackInbox)))
+		msg = append(msg, ackInbox...)
+	}
+	msg = append(msg, data...)
+	return c.writeFrame(wsOpBinary, msg)
+}
+
+// writeFrame sends an unfragmented, unmasked frame.
+func (c *wsConn) writeFrame(op byte, payload []byte) error {
+	header := make([]byte, 2, 10)
+	header[0] = 0x80 | op
+	switch size := len(payload); {
+	case size < 126:
+		header[1] = byte(size)
+	case size <= 0xffff:
+		header[1] = 126
+		header = append(header, byte(size>>8), byte(size))
+	default:
+		header[1] = 127
+		var ext [8]byte
+		binary.BigEndian.PutUint64(ext[:], uint64(size))
+		header = append(header, ext[:]...)
+	}
+	c.Lock()
+	defer c.Unlock()
+	if _, err := c.conn.Write(header); err != nil {
+		return err
+	}
+	_, err := c.conn.Write(payload)
+	return err
+}
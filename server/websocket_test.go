@@ -0,0 +1,181 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/nats-io/go-nats-streaming/pb"
+	"github.com/nats-io/nuid"
+)
+
+// wsTestClient performs the WebSocket handshake with the server.
+func wsTestClient(t *testing.T, s *StanServer) *wsConn {
+	conn, err := net.Dial("tcp", s.wsListener.Addr().String())
+	if err != nil {
+		stackFatalf(t, "Unable to connect: %v", err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: localhost\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"+
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n")
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		stackFatalf(t, "Unable to read handshake response: %v", err)
+	}
+	// Expected accept key from the example of RFC 6455.
+	if resp.StatusCode != http.StatusSwitchingProtocols ||
+		resp.Header.Get("Sec-WebSocket-Accept") != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		stackFatalf(t, "Unexpected handshake response: %v", resp)
+	}
+	return &wsConn{conn: conn, br: br}
+}
+
+// wsTestSend sends a masked binary message, as a browser does.
+func wsTestSend(t *testing.T, c *wsConn, op byte, ackInbox string, m interface {
+	Marshal() ([]byte, error)
+}) {
+	payload := []byte{op}
+	if op == wsAck {
+		payload = append(payload, byte(len(ackInbox)>>8), byte(len(ackInbox)))
+		payload = append(payload, ackInbox...)
+	}
+	b, _ := m.Marshal()
+	payload = append(payload, b...)
+	mask := []byte{1, 2, 3, 4}
+	frame := []byte{0x80 | wsOpBinary, 0x80 | 126, byte(len(payload) >> 8), byte(len(payload))}
+	frame = append(frame, mask...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+	if _, err := c.conn.Write(frame); err != nil {
+		stackFatalf(t, "Unable to send message: %v", err)
+	}
+}
+
+// wsTestRead reads a message sent by the server and returns its operation,
+// ack inbox (for wsMsg) and protocol buffer bytes.
+func wsTestRead(t *testing.T, c *wsConn) (byte, string, []byte) {
+	var header [2]byte
+	if _, err := c.br.Read(header[:1]); err != nil {
+		stackFatalf(t, "Unable to read message: %v", err)
+	}
+	header[1], _ = c.br.ReadByte()
+	size := int(header[1] & 0x7f)
+	if size == 126 {
+		var ext [2]byte
+		ext[0], _ = c.br.ReadByte()
+		ext[1], _ = c.br.ReadByte()
+		size = int(binary.BigEndian.Uint16(ext[:]))
+	}
+	msg := make([]byte, size)
+	for i := range msg {
+		msg[i], _ = c.br.ReadByte()
+	}
+	if header[0] != 0x80|wsOpBinary || len(msg) == 0 {
+		stackFatalf(t, "Unexpected frame: %v %v", header, msg)
+	}
+	if msg[0] != wsMsg {
+		return msg[0], "", msg[1:]
+	}
+	n := 3 + int(binary.BigEndian.Uint16(msg[1:]))
+	return msg[0], string(msg[3:n]), msg[n:]
+}
+
+func TestWebSocket(t *testing.T) {
+	opts := GetDefaultOptions()
+	opts.WebSocketListen = "localhost:0"
+	s := RunServerWithOpts(opts, nil)
+	defer s.Shutdown()
+
+	c := wsTestClient(t, s)
+	defer c.conn.Close()
+
+	wsTestSend(t, c, wsConnect, "", &pb.ConnectRequest{ClientID: "browser"})
+	cresp := &pb.ConnectResponse{}
+	if op, _, b := wsTestRead(t, c); op != wsConnect || cresp.Unmarshal(b) != nil || cresp.Error != "" {
+		t.Fatalf("Unexpected connect response: %v %v", op, cresp)
+	}
+	if !s.clients.IsValid("browser") {
+		t.Fatal("Client should be registered")
+	}
+
+	wsTestSend(t, c, wsSubscribe, "", &pb.SubscriptionRequest{ClientID: "browser", Subject: "foo",
+		MaxInFlight: 10, AckWaitInSecs: 30, DurableName: "dur", StartPosition: pb.StartPosition_First})
+	sresp := &pb.SubscriptionResponse{}
+	if op, _, b := wsTestRead(t, c); op != wsSubscribe || sresp.Unmarshal(b) != nil || sresp.Error != "" {
+		t.Fatalf("Unexpected subscription response: %v %v", op, sresp)
+	}
+
+	// Messages published from a regular client and over WebSocket are
+	// delivered over WebSocket.
+	sc := NewDefaultConnection(t)
+	defer sc.Close()
+	if err := sc.Publish("foo", []byte("msg1")); err != nil {
+		t.Fatalf("Unexpected error on publish: %v", err)
+	}
+	guid := nuid.Next()
+	wsTestSend(t, c, wsPublish, "", &pb.PubMsg{ClientID: "browser", Guid: guid, Subject: "foo", Data: []byte("msg2")})
+	acked, received := false, 0
+	for !acked || received < 2 {
+		op, ackInbox, b := wsTestRead(t, c)
+		switch op {
+		case wsPublish:
+			pubAck := &pb.PubAck{}
+			if pubAck.Unmarshal(b) != nil || pubAck.Guid != guid || pubAck.Error != "" {
+				t.Fatalf("Unexpected PubAck: %v", pubAck)
+			}
+			acked = true
+		case wsMsg:
+			m := &pb.MsgProto{}
+			received++
+			if m.Unmarshal(b) != nil || ackInbox != sresp.AckInbox || string(m.Data) != fmt.Sprintf("msg%d", received) {
+				t.Fatalf("Unexpected message: %v", m)
+			}
+			wsTestSend(t, c, wsAck, ackInbox, &pb.Ack{Subject: "foo", Sequence: m.Sequence})
+		default:
+			t.Fatalf("Unexpected operation: %v", op)
+		}
+	}
+	sub := checkSubs(t, s, "browser", 1)[0]
+	waitForCount(t, 0, func() (string, int) {
+		sub.RLock()
+		defer sub.RUnlock()
+		return "pending acks", len(sub.acksPending)
+	})
+
+	// Acks on subscriptions of other clients are refused.
+	wsTestSend(t, c, wsAck, "_INBOX.foo", &pb.Ack{Subject: "foo", Sequence: 1})
+	if _, err := c.br.ReadByte(); err == nil {
+		t.Fatal("Expected connection to be closed")
+	}
+	// Closing the WebSocket connection closes the client, the durable
+	// subscription is kept.
+	waitForNumClients(t, s, 1)
+	ss := s.store.LookupChannel("foo").UserData.(*subStore)
+	ss.RLock()
+	durablesCount := len(ss.durables)
+	ss.RUnlock()
+	if durablesCount != 1 {
+		t.Fatal("Durable should still exist")
+	}
+
+	c = wsTestClient(t, s)
+	defer c.conn.Close()
+	wsTestSend(t, c, wsConnect, "", &pb.ConnectRequest{ClientID: "browser"})
+	if op, _, b := wsTestRead(t, c); op != wsConnect || cresp.Unmarshal(b) != nil || cresp.Error != "" {
+		t.Fatalf("Unexpected connect response: %v %v", op, cresp)
+	}
+	wsTestSend(t, c, wsClose, "", &pb.CloseRequest{ClientID: "browser"})
+	closeResp := &pb.CloseResponse{}
+	if op, _, b := wsTestRead(t, c); op != wsClose || closeResp.Unmarshal(b) != nil || closeResp.Error != "" {
+		t.Fatalf("Unexpected close response: %v %v", op, closeResp)
+	}
+	waitForNumClients(t, s, 1)
+}
@@ -0,0 +1,373 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/go-nats-streaming/pb"
+	"github.com/nats-io/nats"
+	"github.com/nats-io/nats-streaming-server/spb"
+	"github.com/nats-io/nats-streaming-server/stores"
+	"github.com/nats-io/nats-streaming-server/util"
+)
+
+// wildcardSub is a subscription on a wildcard subject, such as `orders.*`
+// or `telemetry.>`. It is made of a regular subscription on each matching
+// channel, including channels created after the wildcard subscription.
+// These subscriptions share the same Inbox and AckInbox, but each keeps
+// track of its own position in its channel. Acks are routed to the proper
+// subscription thanks to the subject of the Ack, which is the channel of
+// the acknowledged message.
+type wildcardSub struct {
+	sync.Mutex
+	template spb.SubState // used to create the subscription on a channel
+	filter   *msgFilter
+	snapshot bool // start the subscriptions on existing channels with a snapshot
+	ackSub   *nats.Subscription
+	subs     map[string]*subState // subscriptions keyed by channel
+	closed   bool
+}
+
+// wildcardStore holds the wildcard subscriptions, keyed by AckInbox.
+type wildcardStore struct {
+	sync.RWMutex
+	subs map[string]*wildcardSub
+}
+
+// newWildcardStore creates a new instance of `wildcardStore`.
+func newWildcardStore() *wildcardStore {
+	return &wildcardStore{subs: make(map[string]*wildcardSub)}
+}
+
+// Lookup by ackInbox name.
+func (ws *wildcardStore) LookupByAckInbox(ackInbox string) *wildcardSub {
+	ws.RLock()
+	wsub := ws.subs[ackInbox]
+	ws.RUnlock()
+	return wsub
+}
+
+// matching returns the wildcard subscriptions whose subject matches
+// the given channel.
+func (ws *wildcardStore) matching(channel string) []*wildcardSub {
+	ws.RLock()
+	var wsubs []*wildcardSub
+	for _, wsub := range ws.subs {
+		if util.SubjectMatches(wsub.template.Wildcard, channel) {
+			wsubs = append(wsubs, wsub)
+		}
+	}
+	ws.RUnlock()
+	return wsubs
+}
+
+// addRecovered adds a recovered subscription to the wildcard subscription
+// it is part of, creating the wildcard subscription if needed.
+func (ws *wildcardStore) addRecovered(sub *subState) {
+	ws.Lock()
+	wsub := ws.subs[sub.AckInbox]
+	if wsub == nil {
+		wsub = &wildcardSub{
+			template: sub.SubState,
+			filter:   sub.filter,
+			subs:     make(map[string]*subState),
+		}
+		wsub.template.ID = 0
+		wsub.template.LastSent = 0
+		ws.subs[sub.AckInbox] = wsub
+	}
+	wsub.subs[sub.subject] = sub
+	ws.Unlock()
+}
+
+// Check for valid wildcard subjects. The subject must contain at least
+// one wildcard, and the full wildcard '>' can only be the last token.
+func isValidWildcardSubject(subject string) bool {
+	tokens := strings.Split(subject, ".")
+	hasWildcard := false
+	for i, token := range tokens {
+		switch {
+		case token == "":
+			return false
+		case token == "*":
+			hasWildcard = true
+		case token == ">":
+			if i != len(tokens)-1 {
+				return false
+			}
+			hasWildcard = true
+		case strings.ContainsAny(token, ">*"):
+			return false
+		}
+	}
+	return hasWildcard
+}
+
+// processWildcardSubscriptionRequest creates a subscription on every
+// existing channel matching the wildcard subject of the request.
+func (s *StanServer) processWildcardSubscriptionRequest(m *nats.Msg, sr *pb.SubscriptionRequest,
+	srExt *spb.SubRequestExt, filter *msgFilter) {
+	// Can't be durable or a queue subscriber
+	if sr.DurableName != "" {
+		Debugf("STAN: [Client:%s] Invalid subscription request; wildcard subscribers can't be durable.",
+			sr.ClientID)
+		s.sendSubscriptionResponseErr(m.Reply, ErrDurableWildcard)
+		return
+	}
+	if sr.QGroup != "" {
+		Debugf("STAN: [Client:%s] Invalid subscription request; wildcard subscribers can't be queue subscribers.",
+			sr.ClientID)
+		s.sendSubscriptionResponseErr(m.Reply, ErrQueueWildcard)
+		return
+	}
+	// Sequences are specific to a channel.
+	if srExt.StartSequence != 0 {
+		Debugf("STAN: [Client:%s] Invalid subscription request; wildcard subscribers can't start at a sequence.",
+			sr.ClientID)
+		s.sendSubscriptionResponseErr(m.Reply, ErrInvalidSequence)
+		return
+	}
+	// There may be no matching channel yet, so check the client here.
+	if s.clients.Lookup(sr.ClientID) == nil {
+		Debugf("STAN: [Client:%s] Unknown client in subscription request from %s.",
+			sr.ClientID, m.Subject)
+		s.sendSubscriptionResponseErr(m.Reply, ErrUnknownClient)
+		return
+	}
+
+	ackInbox := nats.NewInbox()
+	wsub := &wildcardSub{
+		template: spb.SubState{
+			ClientID:       sr.ClientID,
+			Inbox:          sr.Inbox,
+			AckInbox:       ackInbox,
+			MaxInFlight:    sr.MaxInFlight,
+			AckWaitInSecs:  sr.AckWaitInSecs,
+			Filter:         srExt.Filter,
+			Wildcard:       sr.Subject,
+			MaxMsgsPerSec:  srExt.MaxMsgsPerSec,
+			MaxBytesPerSec: srExt.MaxBytesPerSec,
+			Dedup:          srExt.Dedup,
+			Workers:        srExt.Workers,
+		},
+		filter:   filter,
+		snapshot: srExt.Snapshot,
+		subs:     make(map[string]*subState),
+	}
+
+	var err error
+	// Subscribe to acks, which are shared by all channel subscriptions.
+	wsub.ackSub, err = s.nc.Subscribe(ackInbox, s.processAckMsg)
+	if err != nil {
+		Errorf("STAN: [Client:%s] Unable to subscribe to ack subject for %s: %v",
+			sr.ClientID, sr.Subject, err)
+		s.sendSubscriptionResponseErr(m.Reply, err)
+		return
+	}
+
+	// Register first so that channels created from now on are handled.
+	s.wildcards.Lock()
+	s.wildcards.subs[ackInbox] = wsub
+	s.wildcards.Unlock()
+
+	type channelSub struct {
+		cs  *stores.ChannelStore
+		sub *subState
+	}
+	var subs []channelSub
+	for _, channel := range s.store.GetChannelNames() {
+		if !util.SubjectMatches(sr.Subject, channel) {
+			continue
+		}
+		cs := s.store.LookupChannel(channel)
+		sub, err := s.addWildcardChannelSub(wsub, cs, channel, sr)
+		if err != nil {
+			Errorf("STAN: Unable to add subscription for %s on %s: %v", sr.Subject, channel, err)
+			s.removeWildcardSub(wsub, true)
+			s.sendSubscriptionResponseErr(m.Reply, err)
+			return
+		}
+		if sub != nil {
+			subs = append(subs, channelSub{cs, sub})
+		}
+	}
+	s.recordEvent(&auditRecord{Event: auditSubCreate, Client: sr.ClientID,
+		Channel: sr.Subject, Inbox: sr.Inbox})
+	Debugf("STAN: [Client:%s] Added wildcard subscription on subject=%s, inbox=%s, channels=%d",
+		sr.ClientID, sr.Subject, sr.Inbox, len(subs))
+
+	// Create a non-error response
+	resp := &pb.SubscriptionResponse{AckInbox: ackInbox}
+	b, _ := resp.Marshal()
+	s.nc.Publish(m.Reply, b)
+
+	// publish messages to this subscriber
+	for _, csub := range subs {
+		s.sendAvailableMessages(csub.cs, csub.sub)
+	}
+}
+
+// addWildcardChannelSub creates the subscription on the given channel for
+// the wildcard subscription, with a start position based on the request.
+// Returns nil if the wildcard subscription has been removed or already has
+// a subscription on this channel.
+func (s *StanServer) addWildcardChannelSub(wsub *wildcardSub, cs *stores.ChannelStore,
+	channel string, sr *pb.SubscriptionRequest) (*subState, error) {
+	wsub.Lock()
+	defer wsub.Unlock()
+	if wsub.closed || wsub.subs[channel] != nil {
+		return nil, nil
+	}
+	sub := &subState{
+		SubState:    wsub.template,
+		subject:     channel,
+		ackWait:     time.Duration(wsub.template.AckWaitInSecs) * time.Second,
+		acksPending: make(map[uint64]*pb.MsgProto),
+		store:       cs.Subs,
+		msgs:        cs.Msgs,
+		filter:      wsub.filter,
+		rate:        newRateLimiter(wsub.template.MaxMsgsPerSec, wsub.template.MaxBytesPerSec),
+	}
+	// set the start sequence of the subscriber.
+	s.setSubStartSequence(cs, sub, sr)
+	if wsub.snapshot {
+		s.startSnapshot(sub)
+	}
+	// add the subscription to stan
+	if err := s.addSubscription(cs.UserData.(*subStore), sub); err != nil {
+		return nil, err
+	}
+	wsub.subs[channel] = sub
+	return sub, nil
+}
+
+// addWildcardSubsToChannel creates a subscription on the new channel for
+// every wildcard subscription matching this channel. These subscriptions
+// start at the first message of the channel, whatever the start position
+// of the wildcard subscription request: the channel did not exist when the
+// request was made, so all its messages are new to the subscriber.
+func (s *StanServer) addWildcardSubsToChannel(cs *stores.ChannelStore, channel string) {
+	sr := &pb.SubscriptionRequest{StartPosition: pb.StartPosition_First}
+	for _, wsub := range s.wildcards.matching(channel) {
+		sub, err := s.addWildcardChannelSub(wsub, cs, channel, sr)
+		if err != nil {
+			Errorf("STAN: [Client:%s] Unable to add subscription for %s on %s: %v",
+				wsub.template.ClientID, wsub.template.Wildcard, channel, err)
+			continue
+		}
+		if sub != nil {
+			s.sendAvailableMessages(cs, sub)
+		}
+	}
+}
+
+// removeWildcardSub removes the wildcard subscription. If `removeSubs` is
+// true, its subscriptions on each channel are removed too (this is not
+// needed when the client is closed since they are removed with all other
+// client subscriptions).
+func (s *StanServer) removeWildcardSub(wsub *wildcardSub, removeSubs bool) {
+	wsub.Lock()
+	s.wildcards.Lock()
+	delete(s.wildcards.subs, wsub.template.AckInbox)
+	s.wildcards.Unlock()
+	wsub.closed = true
+	if wsub.ackSub != nil {
+		wsub.ackSub.Unsubscribe()
+		wsub.ackSub = nil
+	}
+	subs := wsub.subs
+	wsub.subs = make(map[string]*subState)
+	wsub.Unlock()
+
+	if !removeSubs {
+		return
+	}
+	for channel, sub := range subs {
+		s.clients.RemoveSub(wsub.template.ClientID, sub)
+		if cs := s.store.LookupChannel(channel); cs != nil {
+			cs.UserData.(*subStore).Remove(sub, true)
+		}
+	}
+}
+
+// removeClientWildcardSubs removes all wildcard subscriptions of the
+// given client.
+func (s *StanServer) removeClientWildcardSubs(clientID string) {
+	var wsubs []*wildcardSub
+	s.wildcards.RLock()
+	for _, wsub := range s.wildcards.subs {
+		if wsub.template.ClientID == clientID {
+			wsubs = append(wsubs, wsub)
+		}
+	}
+	s.wildcards.RUnlock()
+	for _, wsub := range wsubs {
+		s.removeWildcardSub(wsub, false)
+	}
+}
+
+// processWildcardUnSubscribeRequest removes the wildcard subscription
+// identified by the request.
+func (s *StanServer) processWildcardUnSubscribeRequest(m *nats.Msg, req *pb.UnsubscribeRequest) {
+	wsub := s.wildcards.LookupByAckInbox(req.Inbox)
+	if wsub == nil || wsub.template.ClientID != req.ClientID {
+		Errorf("STAN: [Client:%s] unsub request for missing inbox %s.",
+			req.ClientID, req.Inbox)
+		s.sendSubscriptionResponseErr(m.Reply, ErrInvalidSub)
+		return
+	}
+	s.removeWildcardSub(wsub, true)
+
+	s.recordEvent(&auditRecord{Event: auditSubUnsubscribe, Client: req.ClientID,
+		Channel: req.Subject, Inbox: wsub.template.Inbox})
+	Debugf("STAN: [Client:%s] Unsubscribing subject=%s.", req.ClientID, req.Subject)
+
+	// Create a non-error response
+	resp := &pb.SubscriptionResponse{AckInbox: req.Inbox}
+	b, _ := resp.Marshal()
+	s.nc.Publish(m.Reply, b)
+}
+
+// processWildcardPauseRequest pauses or resumes all subscriptions of the
+// wildcard subscription identified by the request. Subscriptions created
+// on new channels inherit this state.
+func (s *StanServer) processWildcardPauseRequest(m *nats.Msg, req *spb.PauseRequest) {
+	wsub := s.wildcards.LookupByAckInbox(req.Inbox)
+	if wsub == nil || wsub.template.ClientID != req.ClientID {
+		Errorf("STAN: [Client:%s] pause request for missing inbox %s.",
+			req.ClientID, req.Inbox)
+		s.sendSubscriptionResponseErr(m.Reply, ErrInvalidSub)
+		return
+	}
+	wsub.Lock()
+	wsub.template.Paused = !req.Resume
+	subs := make(map[string]*subState, len(wsub.subs))
+	for channel, sub := range wsub.subs {
+		subs[channel] = sub
+	}
+	wsub.Unlock()
+
+	for channel, sub := range subs {
+		cs := s.store.LookupChannel(channel)
+		if cs == nil {
+			continue
+		}
+		if err := s.setSubPaused(cs, sub, !req.Resume); err != nil {
+			Errorf("STAN: [Client:%s] Unable to update subscription for %s on %s: %v",
+				req.ClientID, req.Subject, channel, err)
+			s.sendSubscriptionResponseErr(m.Reply, err)
+			return
+		}
+	}
+
+	Debugf("STAN: [Client:%s] Wildcard subscription on subject=%s paused=%v.",
+		req.ClientID, req.Subject, !req.Resume)
+
+	// Create a non-error response
+	resp := &pb.SubscriptionResponse{AckInbox: req.Inbox}
+	b, _ := resp.Marshal()
+	s.nc.Publish(m.Reply, b)
+}
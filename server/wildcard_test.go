@@ -0,0 +1,277 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nats-io/go-nats-streaming"
+	"github.com/nats-io/nats"
+	"github.com/nats-io/nats-streaming-server/spb"
+	"github.com/nats-io/nats-streaming-server/stores"
+)
+
+func checkWildcardSubs(t *testing.T, s *StanServer, expected int) {
+	s.wildcards.RLock()
+	count := len(s.wildcards.subs)
+	s.wildcards.RUnlock()
+	if count != expected {
+		stackFatalf(t, "Expected %v wildcard subscriptions, got %v", expected, count)
+	}
+}
+
+func waitForWildcardMsg(t *testing.T, ch chan *stan.Msg, subject, data string) {
+	select {
+	case m := <-ch:
+		if m.Subject != subject || string(m.Data) != data {
+			stackFatalf(t, "Expected %s on %s, got %v", data, subject, m)
+		}
+	case <-time.After(5 * time.Second):
+		stackFatalf(t, "Did not get our message")
+	}
+}
+
+func TestIsValidWildcardSubject(t *testing.T) {
+	for _, subject := range []string{"foo.*", "*", ">", "foo.>", "*.bar", "foo.*.>"} {
+		if !isValidWildcardSubject(subject) {
+			t.Fatalf("Subject %q should be valid", subject)
+		}
+	}
+	for _, subject := range []string{"foo", "foo.bar", "foo.>.bar", "foo*", "foo.b>", "foo..*", ""} {
+		if isValidWildcardSubject(subject) {
+			t.Fatalf("Subject %q should not be valid", subject)
+		}
+	}
+}
+
+func TestWildcardSubscription(t *testing.T) {
+	s := RunServer(clusterName)
+	defer s.Shutdown()
+
+	sc := NewDefaultConnection(t)
+	defer sc.Close()
+
+	if err := sc.Publish("orders.a", []byte("a1")); err != nil {
+		t.Fatalf("Unexpected error on publish: %v", err)
+	}
+	if err := sc.Publish("orders.b", []byte("b1")); err != nil {
+		t.Fatalf("Unexpected error on publish: %v", err)
+	}
+
+	ch := make(chan *stan.Msg, 10)
+	sub, err := sc.Subscribe("orders.*", func(m *stan.Msg) {
+		ch <- m
+	}, stan.DeliverAllAvailable())
+	if err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+	checkWildcardSubs(t, s, 1)
+	// One subscription per existing channel.
+	waitForNumSubs(t, s, clientName, 2)
+
+	received := map[string]string{}
+	for i := 0; i < 2; i++ {
+		select {
+		case m := <-ch:
+			received[m.Subject] = string(m.Data)
+		case <-time.After(5 * time.Second):
+			t.Fatal("Did not get our message")
+		}
+	}
+	if received["orders.a"] != "a1" || received["orders.b"] != "b1" {
+		t.Fatalf("Unexpected messages: %v", received)
+	}
+
+	// A new matching channel should be picked up.
+	if err := sc.Publish("orders.c", []byte("c1")); err != nil {
+		t.Fatalf("Unexpected error on publish: %v", err)
+	}
+	waitForWildcardMsg(t, ch, "orders.c", "c1")
+	waitForNumSubs(t, s, clientName, 3)
+
+	// Non matching channels should not.
+	if err := sc.Publish("orders.c.d", []byte("cd1")); err != nil {
+		t.Fatalf("Unexpected error on publish: %v", err)
+	}
+	if err := sc.Publish("orders.a", []byte("a2")); err != nil {
+		t.Fatalf("Unexpected error on publish: %v", err)
+	}
+	waitForWildcardMsg(t, ch, "orders.a", "a2")
+
+	// Acks should have been routed to the proper subscription.
+	waitForAcks(t, s, clientName, 1, 0)
+
+	if err := sub.Unsubscribe(); err != nil {
+		t.Fatalf("Unexpected error on unsubscribe: %v", err)
+	}
+	checkWildcardSubs(t, s, 0)
+	waitForNumSubs(t, s, clientName, 0)
+	if err := sc.Publish("orders.d", []byte("d1")); err != nil {
+		t.Fatalf("Unexpected error on publish: %v", err)
+	}
+	select {
+	case m := <-ch:
+		t.Fatalf("Unexpected message: %v", m)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestWildcardSubscriptionStartPosition(t *testing.T) {
+	s := RunServer(clusterName)
+	defer s.Shutdown()
+
+	sc := NewDefaultConnection(t)
+	defer sc.Close()
+
+	for _, data := range []string{"a1", "a2"} {
+		if err := sc.Publish("orders.a", []byte(data)); err != nil {
+			t.Fatalf("Unexpected error on publish: %v", err)
+		}
+	}
+	ch := make(chan *stan.Msg, 10)
+	if _, err := sc.Subscribe("orders.*", func(m *stan.Msg) {
+		ch <- m
+	}, stan.StartWithLastReceived()); err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+	// The start position applies to the existing channels.
+	waitForWildcardMsg(t, ch, "orders.a", "a2")
+
+	// A channel created afterwards is consumed from its first message.
+	for _, data := range []string{"b1", "b2"} {
+		if err := sc.Publish("orders.b", []byte(data)); err != nil {
+			t.Fatalf("Unexpected error on publish: %v", err)
+		}
+	}
+	waitForWildcardMsg(t, ch, "orders.b", "b1")
+	waitForWildcardMsg(t, ch, "orders.b", "b2")
+	select {
+	case m := <-ch:
+		t.Fatalf("Unexpected message: %v", m)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestWildcardSubscriptionErrors(t *testing.T) {
+	s := RunServer(clusterName)
+	defer s.Shutdown()
+
+	sc := NewDefaultConnection(t)
+	defer sc.Close()
+
+	cb := func(m *stan.Msg) {}
+	if _, err := sc.Subscribe("orders.*", cb, stan.DurableName("dur")); err == nil || err.Error() != ErrDurableWildcard.Error() {
+		t.Fatalf("Expected error %v, got %v", ErrDurableWildcard, err)
+	}
+	if _, err := sc.QueueSubscribe("orders.*", "queue", cb); err == nil || err.Error() != ErrQueueWildcard.Error() {
+		t.Fatalf("Expected error %v, got %v", ErrQueueWildcard, err)
+	}
+	if _, err := sc.Subscribe("orders.>.a", cb); err == nil || err.Error() != ErrInvalidSubject.Error() {
+		t.Fatalf("Expected error %v, got %v", ErrInvalidSubject, err)
+	}
+	checkWildcardSubs(t, s, 0)
+
+	// Closing the client removes its wildcard subscriptions.
+	if _, err := sc.Subscribe("orders.*", cb); err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+	checkWildcardSubs(t, s, 1)
+	sc.Close()
+	checkWildcardSubs(t, s, 0)
+}
+
+func TestFileStoreWildcardSubscriptionRecovery(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	opts := GetDefaultOptions()
+	opts.StoreType = stores.TypeFile
+	opts.FilestoreDir = defaultDataStore
+	s := RunServerWithOpts(opts, nil)
+	defer shutdownRestartedServerOnTestExit(&s)
+
+	sc, nc := createConnectionWithNatsOpts(t, clientName,
+		nats.ReconnectWait(100*time.Millisecond))
+	defer nc.Close()
+	defer sc.Close()
+
+	if err := sc.Publish("orders.a", []byte("a1")); err != nil {
+		t.Fatalf("Unexpected error on publish: %v", err)
+	}
+	ch := make(chan *stan.Msg, 10)
+	if _, err := sc.Subscribe("orders.*", func(m *stan.Msg) {
+		ch <- m
+	}, stan.DeliverAllAvailable()); err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+	waitForWildcardMsg(t, ch, "orders.a", "a1")
+	waitForAcks(t, s, clientName, 1, 0)
+
+	s.Shutdown()
+	s = RunServerWithOpts(opts, nil)
+
+	checkWildcardSubs(t, s, 1)
+	// The wildcard subscription should still pick up new channels,
+	// and continue from its position on existing ones.
+	if err := sc.Publish("orders.b", []byte("b1")); err != nil {
+		t.Fatalf("Unexpected error on publish: %v", err)
+	}
+	waitForWildcardMsg(t, ch, "orders.b", "b1")
+	if err := sc.Publish("orders.a", []byte("a2")); err != nil {
+		t.Fatalf("Unexpected error on publish: %v", err)
+	}
+	waitForWildcardMsg(t, ch, "orders.a", "a2")
+}
+
+func TestWildcardPauseResume(t *testing.T) {
+	s := RunServer(clusterName)
+	defer s.Shutdown()
+
+	sc, nc := createConnectionWithNatsOpts(t, clientName)
+	defer nc.Close()
+	defer sc.Close()
+
+	if err := sc.Publish("orders.a", []byte("a1")); err != nil {
+		t.Fatalf("Unexpected error on publish: %v", err)
+	}
+	ch := make(chan *stan.Msg, 10)
+	if _, err := sc.Subscribe("orders.*", func(m *stan.Msg) {
+		ch <- m
+	}); err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+	ackInbox := getSubAckInbox(t, s, "orders.a")
+	req := &spb.PauseRequest{ClientID: clientName, Subject: "orders.*", Inbox: ackInbox}
+	if err := sendPauseRequest(t, nc, req); err != nil {
+		t.Fatalf("Unexpected error on pause: %v", err)
+	}
+	// Neither existing nor new channels get messages.
+	if err := sc.Publish("orders.a", []byte("a2")); err != nil {
+		t.Fatalf("Unexpected error on publish: %v", err)
+	}
+	if err := sc.Publish("orders.b", []byte("b1")); err != nil {
+		t.Fatalf("Unexpected error on publish: %v", err)
+	}
+	select {
+	case m := <-ch:
+		t.Fatalf("Unexpected message: %v", m)
+	case <-time.After(100 * time.Millisecond):
+	}
+	req.Resume = true
+	if err := sendPauseRequest(t, nc, req); err != nil {
+		t.Fatalf("Unexpected error on resume: %v", err)
+	}
+	received := map[string]string{}
+	for i := 0; i < 2; i++ {
+		select {
+		case m := <-ch:
+			received[m.Subject] = string(m.Data)
+		case <-time.After(5 * time.Second):
+			t.Fatal("Did not get our message")
+		}
+	}
+	if received["orders.a"] != "a2" || received["orders.b"] != "b1" {
+		t.Fatalf("Unexpected messages: %v", received)
+	}
+}
@@ -0,0 +1,117 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"github.com/nats-io/nats-streaming-server/spb"
+)
+
+// Maximum number of workers of a subscription.
+const maxSubWorkers = 1024
+
+// workerState tracks, for a subscription with workers, the worker to which
+// each pending message was delivered and the number of messages pending on
+// each worker. Each worker is a separate ack domain: MaxInFlight applies to
+// each of them, so that a slow batch on one worker does not stall the
+// others.
+type workerState struct {
+	of      map[uint64]uint32 // worker of the pending messages, keyed by sequence
+	pending []int32           // number of pending messages of each worker
+}
+
+// hasWorkers returns true if the deliveries of the subscription are
+// interleaved across several client workers.
+func (sub *subState) hasWorkers() bool {
+	return sub.Workers > 1
+}
+
+// resetWorkers forgets the workers of the pending messages, which are
+// assigned again when they are redelivered. This is used when a durable
+// subscription is restarted with a different number of workers.
+// Sub lock should be held before calling.
+func (sub *subState) resetWorkers() {
+	sub.workers = workerState{}
+}
+
+// nextWorker returns the worker to which the next new message is sent: the
+// one with the fewest pending messages, the lowest one on ties, so that
+// deliveries are interleaved.
+// Sub lock should be held before calling.
+func (sub *subState) nextWorker() uint32 {
+	if len(sub.workers.pending) != int(sub.Workers) {
+		return 0
+	}
+	next := 0
+	for w, n := range sub.workers.pending {
+		if n < sub.workers.pending[next] {
+			next = w
+		}
+	}
+	return uint32(next)
+}
+
+// workerOf returns the worker to which the message with the given sequence
+// is (re)delivered: the one of its previous delivery, if any, otherwise
+// the next worker.
+// Sub lock should be held before calling.
+func (sub *subState) workerOf(seq uint64) uint32 {
+	if w, ok := sub.workers.of[seq]; ok {
+		return w
+	}
+	return sub.nextWorker()
+}
+
+// assignWorker records that the message with the given sequence was
+// delivered to worker `w`.
+// Sub lock should be held before calling.
+func (sub *subState) assignWorker(seq uint64, w uint32) {
+	if _, ok := sub.workers.of[seq]; ok {
+		return
+	}
+	if sub.workers.of == nil {
+		sub.workers.of = make(map[uint64]uint32)
+	}
+	if len(sub.workers.pending) != int(sub.Workers) {
+		sub.workers.pending = make([]int32, sub.Workers)
+	}
+	sub.workers.of[seq] = w
+	sub.workers.pending[w]++
+}
+
+// releaseWorker removes the message with the given sequence, acknowledged
+// or skipped, from its worker.
+// Sub lock should be held before calling.
+func (sub *subState) releaseWorker(seq uint64) {
+	w, ok := sub.workers.of[seq]
+	if !ok {
+		return
+	}
+	delete(sub.workers.of, seq)
+	sub.workers.pending[w]--
+}
+
+// inFlightFull returns true if no new message can be sent to the
+// subscription because it has MaxInFlight messages pending or, with
+// workers, because each of its workers has.
+// Sub lock should be held before calling.
+func (sub *subState) inFlightFull() bool {
+	if sub.hasWorkers() {
+		if len(sub.workers.pending) != int(sub.Workers) {
+			// No message assigned yet, or they were reset.
+			return false
+		}
+		return sub.workers.pending[sub.nextWorker()] >= sub.MaxInFlight
+	}
+	return int32(len(sub.acksPending)) >= sub.MaxInFlight
+}
+
+// withWorker returns a copy of the message extension `ext`, which may be
+// nil, with the worker to which the message is delivered.
+func withWorker(ext *spb.MsgExt, w uint32) *spb.MsgExt {
+	e := &spb.MsgExt{}
+	if ext != nil {
+		*e = *ext
+	}
+	e.Worker = w
+	return e
+}
@@ -0,0 +1,98 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nats-io/go-nats-streaming/pb"
+	"github.com/nats-io/nats"
+	"github.com/nats-io/nats-streaming-server/spb"
+)
+
+func TestSubWorkers(t *testing.T) {
+	s := RunServer(clusterName)
+	defer s.Shutdown()
+
+	sc, nc := createConnectionWithNatsOpts(t, clientName)
+	defer nc.Close()
+	defer sc.Close()
+
+	sr := &pb.SubscriptionRequest{Subject: "foo", Inbox: nats.NewInbox(), QGroup: "queue", StartPosition: pb.StartPosition_First}
+	if _, err := sendSubRequestWithExt(t, s, nc, sr, &spb.SubRequestExt{Workers: 2}); err == nil || err.Error() != ErrWorkersQueue.Error() {
+		t.Fatalf("Expected error %v, got %v", ErrWorkersQueue, err)
+	}
+	sr = &pb.SubscriptionRequest{Subject: "foo", Inbox: nats.NewInbox(), StartPosition: pb.StartPosition_First}
+	if _, err := sendSubRequestWithExt(t, s, nc, sr, &spb.SubRequestExt{Workers: maxSubWorkers + 1}); err == nil || err.Error() != ErrInvalidWorkers.Error() {
+		t.Fatalf("Expected error %v, got %v", ErrInvalidWorkers, err)
+	}
+
+	for i := 0; i < 10; i++ {
+		if err := sc.Publish("foo", []byte("hello")); err != nil {
+			t.Fatalf("Unexpected error on publish: %v", err)
+		}
+	}
+
+	inbox := nats.NewInbox()
+	rawSub, err := nc.SubscribeSync(inbox)
+	if err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+	sr = &pb.SubscriptionRequest{Subject: "foo", Inbox: inbox, DurableName: "dur", MaxInFlight: 2, StartPosition: pb.StartPosition_First}
+	ackInbox, err := sendSubRequestWithExt(t, s, nc, sr, &spb.SubRequestExt{Workers: 3})
+	if err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+	nextMsg := func() (*pb.MsgProto, uint32) {
+		rawMsg, err := rawSub.NextMsg(5 * time.Second)
+		if err != nil {
+			stackFatalf(t, "Did not get our message: %v", err)
+		}
+		m := &pb.MsgProto{}
+		if err := m.Unmarshal(rawMsg.Data); err != nil {
+			stackFatalf(t, "Error decoding message: %v", err)
+		}
+		ext := &spb.MsgExt{}
+		if err := ext.Unmarshal(rawMsg.Data); err != nil {
+			stackFatalf(t, "Error decoding message attributes: %v", err)
+		}
+		return m, ext.Worker
+	}
+	// Deliveries are interleaved across the workers, MaxInFlight each.
+	for seq := uint64(1); seq <= 6; seq++ {
+		m, worker := nextMsg()
+		if m.Sequence != seq || worker != uint32((seq-1)%3) {
+			t.Fatalf("Unexpected message %v for worker %v", m.Sequence, worker)
+		}
+	}
+	if _, err := rawSub.NextMsg(100 * time.Millisecond); err == nil {
+		t.Fatal("No message should be sent while all workers are full")
+	}
+
+	// Once a message of worker 1 is acknowledged, the next message goes
+	// to this worker.
+	ack := &pb.Ack{Subject: "foo", Sequence: 2}
+	b, _ := ack.Marshal()
+	if err := nc.Publish(ackInbox, b); err != nil {
+		t.Fatalf("Unexpected error on ack: %v", err)
+	}
+	if m, worker := nextMsg(); m.Sequence != 7 || worker != 1 {
+		t.Fatalf("Unexpected message %v for worker %v", m.Sequence, worker)
+	}
+	if _, err := rawSub.NextMsg(100 * time.Millisecond); err == nil {
+		t.Fatal("No message should be sent while all workers are full")
+	}
+
+	// The number of workers is persisted.
+	subs := s.store.LookupChannel("foo").UserData.(*subStore).getAllSubs()
+	if len(subs) != 1 {
+		t.Fatalf("Expected one subscription, got %v", len(subs))
+	}
+	subs[0].RLock()
+	workers := subs[0].Workers
+	subs[0].RUnlock()
+	if workers != 3 {
+		t.Fatalf("Expected 3 workers, got %v", workers)
+	}
+}
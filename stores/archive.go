@@ -0,0 +1,357 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package stores
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/nats-io/go-nats-streaming/pb"
+	"github.com/nats-io/nats-streaming-server/spb"
+)
+
+// Formats of the archives written by ExportChannel.
+const (
+	// ArchiveJSON is newline delimited JSON: one object per message, with
+	// the payload encoded in base64.
+	ArchiveJSON = "json"
+	// ArchiveProto is length-prefixed protobuf: for each message, its size
+	// on 4 bytes (big endian), then the MsgProto followed by its MsgExt, if
+	// any, as the server sends them to subscriptions.
+	ArchiveProto = "proto"
+)
+
+const (
+	// Suffix of the manifest files.
+	archiveManifestSuffix = ".manifest.json"
+
+	// Number of messages read from the store at once during an export.
+	archiveBatchSize = 1000
+
+	// Maximum size of a record of a protobuf archive.
+	maxArchiveRecordSize = 64 * 1024 * 1024
+)
+
+// ArchiveManifest describes an archive of the messages of a channel stored
+// within a time range. It is written, next to the data file, once the data
+// file is complete.
+type ArchiveManifest struct {
+	Channel  string `json:"channel"`
+	Format   string `json:"format"`
+	File     string `json:"file"`      // Name of the data file, in the directory of the manifest
+	Start    int64  `json:"start"`     // Time range (UnixNano) of the timestamps of the messages, start included
+	End      int64  `json:"end"`       // and end excluded
+	FirstSeq uint64 `json:"first_seq"` // Sequences of the first and last messages of the archive
+	LastSeq  uint64 `json:"last_seq"`
+	Count    int    `json:"count"`  // Number of messages
+	Size     int64  `json:"size"`   // Size of the data file
+	SHA256   string `json:"sha256"` // Hex encoded checksum of the data file
+	Created  int64  `json:"created"`
+}
+
+// archiveRecord is a message of a JSON archive.
+type archiveRecord struct {
+	Sequence  uint64      `json:"sequence"`
+	Timestamp int64       `json:"timestamp"`
+	Reply     string      `json:"reply,omitempty"`
+	Data      []byte      `json:"data"`
+	Ext       *spb.MsgExt `json:"ext,omitempty"`
+}
+
+// ExportChannel writes the messages of the channel whose timestamp is
+// within [start, end) to an archive in the directory `dir`, in the given
+// format, and returns its manifest. The data file is named after the
+// channel and the time range, and the manifest is named after the data
+// file, with the `.manifest.json` suffix. If there is no message in the range, nothing is
+// written and the returned manifest has a Count of 0.
+func ExportChannel(ms MsgStore, channel, dir, format string, start, end int64) (*ArchiveManifest, error) {
+	ext := ""
+	switch format {
+	case ArchiveJSON:
+		ext = ".ndjson"
+	case ArchiveProto:
+		ext = ".pb"
+	default:
+		return nil, fmt.Errorf("invalid archive format %q", format)
+	}
+	am := &ArchiveManifest{
+		Channel: channel,
+		Format:  format,
+		File:    fmt.Sprintf("%s.%d-%d%s", channel, start, end, ext),
+		Start:   start,
+		End:     end,
+	}
+	seq := ms.GetSequenceFromTimestamp(start)
+	if first := ms.FirstSequence(); seq < first {
+		seq = first
+	}
+	last := ms.LastSequence()
+	if seq == 0 || seq > last {
+		return am, nil
+	}
+
+	dataFile := filepath.Join(dir, am.File)
+	tmpFile := dataFile + ".tmp"
+	f, err := os.Create(tmpFile)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmpFile)
+	defer f.Close()
+	sum := sha256.New()
+	bw := bufio.NewWriter(io.MultiWriter(f, sum))
+	var buf []byte
+	done := false
+	for !done && seq <= last {
+		msgs, err := ms.LookupRange(seq, last, archiveBatchSize)
+		if err != nil {
+			return nil, err
+		}
+		if len(msgs) == 0 {
+			break
+		}
+		for _, m := range msgs {
+			if m.Timestamp >= end {
+				done = true
+				break
+			}
+			// Messages stored with their original timestamp, such as
+			// replicated ones, may be out of order.
+			if m.Timestamp < start {
+				continue
+			}
+			if buf, err = writeArchiveRecord(bw, buf, format, m, ms.LookupExt(m.Sequence)); err != nil {
+				return nil, err
+			}
+			if am.Count == 0 {
+				am.FirstSeq = m.Sequence
+			}
+			am.LastSeq = m.Sequence
+			am.Count++
+		}
+		seq = msgs[len(msgs)-1].Sequence + 1
+	}
+	if am.Count == 0 {
+		return am, nil
+	}
+	if err := bw.Flush(); err != nil {
+		return nil, err
+	}
+	if err := f.Sync(); err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	am.Size = fi.Size()
+	if err := f.Close(); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmpFile, dataFile); err != nil {
+		return nil, err
+	}
+	am.SHA256 = hex.EncodeToString(sum.Sum(nil))
+	am.Created = time.Now().UnixNano()
+	b, err := json.MarshalIndent(am, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	manifest := dataFile + archiveManifestSuffix
+	if err := ioutil.WriteFile(manifest+".tmp", b, 0644); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(manifest+".tmp", manifest); err != nil {
+		return nil, err
+	}
+	return am, nil
+}
+
+// writeArchiveRecord writes a message in the given format, using `buf`
+// to marshal it if big enough, and returns the buffer.
+func writeArchiveRecord(w io.Writer, buf []byte, format string, m *pb.MsgProto, ext *spb.MsgExt) ([]byte, error) {
+	if format == ArchiveJSON {
+		b, err := json.Marshal(&archiveRecord{
+			Sequence:  m.Sequence,
+			Timestamp: m.Timestamp,
+			Reply:     m.Reply,
+			Data:      m.Data,
+			Ext:       ext,
+		})
+		if err != nil {
+			return buf, err
+		}
+		_, err = w.Write(append(b, '\n'))
+		return buf, err
+	}
+	size := m.Size()
+	if ext != nil {
+		size += ext.Size()
+	}
+	if cap(buf) < 4+size {
+		buf = make([]byte, 4+size)
+	}
+	b := buf[:4+size]
+	binary.BigEndian.PutUint32(b, uint32(size))
+	n, err := m.MarshalTo(b[4:])
+	if err != nil {
+		return buf, err
+	}
+	if ext != nil {
+		if _, err := ext.MarshalTo(b[4+n:]); err != nil {
+			return buf, err
+		}
+	}
+	_, err = w.Write(b)
+	return buf, err
+}
+
+// ReadArchiveManifest reads the manifest of an archive.
+func ReadArchiveManifest(path string) (*ArchiveManifest, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	am := &ArchiveManifest{}
+	if err := json.Unmarshal(b, am); err != nil {
+		return nil, fmt.Errorf("error parsing archive manifest %q: %v", path, err)
+	}
+	if am.Format != ArchiveJSON && am.Format != ArchiveProto {
+		return nil, fmt.Errorf("invalid format %q in archive manifest %q", am.Format, path)
+	}
+	if am.File == "" || filepath.Base(am.File) != am.File {
+		return nil, fmt.Errorf("invalid file %q in archive manifest %q", am.File, path)
+	}
+	return am, nil
+}
+
+// LastArchiveEnds returns, for each channel archived in the directory, the
+// end of the time range of its latest archive.
+func LastArchiveEnds(dir string) (map[string]int64, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*"+archiveManifestSuffix))
+	if err != nil {
+		return nil, err
+	}
+	ends := make(map[string]int64)
+	for _, file := range files {
+		am, err := ReadArchiveManifest(file)
+		if err != nil {
+			return nil, err
+		}
+		if am.End > ends[am.Channel] {
+			ends[am.Channel] = am.End
+		}
+	}
+	return ends, nil
+}
+
+// ImportArchive stores the messages of the archive described by the
+// manifest in the given channel, or the archived channel if empty, which
+// is created if needed. The messages keep their sequence and timestamp, so
+// the messages whose sequence is not after the last one of the channel,
+// for instance because they were already imported, are skipped. The data
+// file is checked against the checksum of the manifest before anything is
+// stored. The number of messages stored is returned.
+func ImportArchive(s Store, manifest, channel string) (int, error) {
+	am, err := ReadArchiveManifest(manifest)
+	if err != nil {
+		return 0, err
+	}
+	if channel == "" {
+		channel = am.Channel
+	}
+	dataFile := filepath.Join(filepath.Dir(manifest), am.File)
+	f, err := os.Open(dataFile)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	sum := sha256.New()
+	if _, err := io.Copy(sum, f); err != nil {
+		return 0, err
+	}
+	if hex.EncodeToString(sum.Sum(nil)) != am.SHA256 {
+		return 0, fmt.Errorf("checksum of %q does not match its manifest", dataFile)
+	}
+	if _, err := f.Seek(0, 0); err != nil {
+		return 0, err
+	}
+	cs, _, err := s.CreateChannel(channel, nil)
+	if err != nil {
+		return 0, err
+	}
+	ms := cs.Msgs
+	stored := 0
+	br := bufio.NewReader(f)
+	for {
+		m, ext, err := readArchiveRecord(br, am.Format)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return stored, fmt.Errorf("error reading %q: %v", dataFile, err)
+		}
+		if m.Sequence <= ms.LastSequence() {
+			continue
+		}
+		m.Subject = channel
+		if err := ms.StoreMsg(m, ext); err != nil {
+			return stored, err
+		}
+		stored++
+	}
+	return stored, ms.Flush()
+}
+
+// readArchiveRecord reads the next message of an archive in the given
+// format, returning io.EOF at the end of the archive.
+func readArchiveRecord(br *bufio.Reader, format string) (*pb.MsgProto, *spb.MsgExt, error) {
+	if format == ArchiveJSON {
+		line, err := br.ReadBytes('\n')
+		if err == io.EOF && len(line) > 0 {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		rec := &archiveRecord{}
+		if err := json.Unmarshal(line, rec); err != nil {
+			return nil, nil, err
+		}
+		m := &pb.MsgProto{Sequence: rec.Sequence, Timestamp: rec.Timestamp, Reply: rec.Reply, Data: rec.Data}
+		return m, rec.Ext, nil
+	}
+	var header [4]byte
+	if _, err := io.ReadFull(br, header[:]); err != nil {
+		return nil, nil, err
+	}
+	size := binary.BigEndian.Uint32(header[:])
+	if size > maxArchiveRecordSize {
+		return nil, nil, ErrCorruptedData
+	}
+	b := make([]byte, size)
+	if _, err := io.ReadFull(br, b); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, nil, err
+	}
+	m := &pb.MsgProto{}
+	if err := m.Unmarshal(b); err != nil {
+		return nil, nil, err
+	}
+	ext := &spb.MsgExt{}
+	if err := ext.Unmarshal(b); err != nil || ext.Size() == 0 {
+		ext = nil
+	}
+	return m, ext, nil
+}
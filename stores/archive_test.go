@@ -0,0 +1,102 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package stores
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/nats-io/go-nats-streaming/pb"
+	"github.com/nats-io/nats-streaming-server/spb"
+)
+
+func TestArchiveExportImport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stan_archive_")
+	if err != nil {
+		t.Fatalf("Unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	src := createDefaultMemStore(t)
+	defer src.Close()
+	cs, _, err := src.CreateChannel("foo", nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	ext := &spb.MsgExt{Headers: []*spb.MsgHeader{{Key: "k", Value: "v"}}}
+	for i := uint64(1); i <= 10; i++ {
+		m := &pb.MsgProto{Sequence: i, Subject: "foo", Timestamp: int64(i * 100), Data: []byte{byte(i)}}
+		var e *spb.MsgExt
+		if i%2 == 0 {
+			e = ext
+		}
+		if err := cs.Msgs.StoreMsg(m, e); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+
+	for _, format := range []string{ArchiveJSON, ArchiveProto} {
+		// Messages 3 to 7.
+		am, err := ExportChannel(cs.Msgs, "foo", dir, format, 300, 800)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if am.Count != 5 || am.FirstSeq != 3 || am.LastSeq != 7 || am.Size == 0 || am.SHA256 == "" {
+			t.Fatalf("Unexpected manifest: %+v", am)
+		}
+		manifest := filepath.Join(dir, am.File+archiveManifestSuffix)
+		if read, err := ReadArchiveManifest(manifest); err != nil || !reflect.DeepEqual(read, am) {
+			t.Fatalf("Unexpected manifest: %+v, %v", read, err)
+		}
+
+		dst := createDefaultMemStore(t)
+		if n, err := ImportArchive(dst, manifest, "bar"); err != nil || n != 5 {
+			t.Fatalf("Unexpected import result: %v, %v", n, err)
+		}
+		ms := dst.LookupChannel("bar").Msgs
+		for seq := uint64(3); seq <= 7; seq++ {
+			m := msgStoreLookup(t, ms, seq)
+			if m == nil || m.Subject != "bar" || m.Timestamp != int64(seq*100) || m.Data[0] != byte(seq) {
+				t.Fatalf("Unexpected message: %v", m)
+			}
+			if e := ms.LookupExt(seq); (seq%2 == 0) != (e != nil && reflect.DeepEqual(e, ext)) {
+				t.Fatalf("Unexpected attributes of message %v: %v", seq, e)
+			}
+		}
+		// Importing again does not duplicate the messages.
+		if n, err := ImportArchive(dst, manifest, "bar"); err != nil || n != 0 {
+			t.Fatalf("Unexpected import result: %v, %v", n, err)
+		}
+		dst.Close()
+
+		// A modified archive is rejected.
+		dataFile := filepath.Join(dir, am.File)
+		b, _ := ioutil.ReadFile(dataFile)
+		b[len(b)-2]++
+		ioutil.WriteFile(dataFile, b, 0644)
+		dst = createDefaultMemStore(t)
+		if _, err := ImportArchive(dst, manifest, ""); err == nil || !strings.Contains(err.Error(), "checksum") {
+			t.Fatalf("Expected checksum error, got %v", err)
+		}
+		if dst.LookupChannel("foo") != nil {
+			t.Fatal("Channel should not have been created")
+		}
+		dst.Close()
+	}
+
+	// No file for an empty range.
+	if am, err := ExportChannel(cs.Msgs, "foo", dir, ArchiveJSON, 2000, 3000); err != nil || am.Count != 0 {
+		t.Fatalf("Unexpected result: %+v, %v", am, err)
+	}
+	ends, err := LastArchiveEnds(dir)
+	if err != nil || len(ends) != 1 || ends["foo"] != 800 {
+		t.Fatalf("Unexpected ends: %v, %v", ends, err)
+	}
+	if _, err := ExportChannel(cs.Msgs, "foo", dir, "xml", 0, 1); err == nil {
+		t.Fatal("Expected error for invalid format")
+	}
+}
@@ -34,7 +34,7 @@ func benchCreateDefaultFileStore(t *testing.B) *FileStore {
 }
 
 func benchStoreMsg(b *testing.B, ms MsgStore, data []byte) *pb.MsgProto {
-	m, err := ms.Store("", data)
+	m, err := ms.Store("", data, nil)
 	if err != nil {
 		stackFatalf(b, "Error storing message: %v", err)
 	}
@@ -136,7 +136,7 @@ func BenchmarkRecoverSubs(b *testing.B) {
 	if state == nil {
 		b.Fatal("State should have been recovered")
 	}
-	recoveredSubs := state.Subs["foo"]
+	recoveredSubs := getRecoveredSubs(b, state)["foo"]
 	if len(recoveredSubs) != numSubs {
 		b.Fatalf("Should have recovered %v subs, got %v", numSubs, len(recoveredSubs))
 	}
@@ -0,0 +1,138 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+//go:build bolt
+// +build bolt
+
+package stores
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+const (
+	// TypeBolt is the store type name for BoltDB based stores. This store
+	// type is only available when the server is built with the `bolt` tag.
+	TypeBolt = "BOLT"
+
+	// boltFileName is the name of the database file in the root directory.
+	boltFileName = "stan.db"
+)
+
+// boltBucket is the bucket holding all the keys of the store.
+var boltBucket = []byte("stan")
+
+func init() {
+	Register(TypeBolt, func(config *StoreConfig) (Store, *RecoveredState, error) {
+		if config.Dir == "" {
+			return nil, nil, fmt.Errorf("for %v stores, root directory must be specified", TypeBolt)
+		}
+		doSync := DefaultFileStoreOptions.DoSync
+		if config.FileStoreOpts != nil {
+			doSync = config.FileStoreOpts.DoSync
+		}
+		s, state, err := NewBoltStore(config.Dir, config.Limits, doSync)
+		if err != nil {
+			return nil, nil, err
+		}
+		return s, state, nil
+	})
+}
+
+// BoltStore is the storage interface for STAN servers, backed by a single
+// BoltDB file. Every write is a BoltDB transaction, so the file is always
+// in a consistent state, even after a crash, and can be backed up by
+// copying it while the server is stopped.
+type BoltStore struct {
+	kvStore
+}
+
+// boltDB adapts a BoltDB database to the kvDB interface.
+type boltDB struct {
+	db *bolt.DB
+}
+
+// NewBoltStore returns a factory for stores backed by the BoltDB file
+// `stan.db` located in `rootDir`, and the state recovered from it, if any.
+// If `doSync` is false, transactions are not synced to disk.
+// If not limits are provided, the store will be created with
+// DefaultChannelLimits.
+func NewBoltStore(rootDir string, limits *ChannelLimits, doSync bool) (*BoltStore, *RecoveredState, error) {
+	if err := os.MkdirAll(rootDir, os.ModeDir+os.ModePerm); err != nil && !os.IsExist(err) {
+		return nil, nil, err
+	}
+	// Fail instead of blocking forever if another server uses the file.
+	db, err := bolt.Open(filepath.Join(rootDir, boltFileName), 0666, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, nil, err
+	}
+	db.NoSync = !doSync
+	if err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(boltBucket)
+		return err
+	}); err != nil {
+		db.Close()
+		return nil, nil, err
+	}
+	s := &BoltStore{}
+	s.db = &boltDB{db: db}
+	s.init(TypeBolt, limits)
+
+	state, err := s.recover()
+	if err != nil {
+		s.Close()
+		return nil, nil, err
+	}
+	return s, state, nil
+}
+
+func (b *boltDB) get(key []byte) ([]byte, error) {
+	var buf []byte
+	err := b.db.View(func(tx *bolt.Tx) error {
+		// The value is only valid during the transaction.
+		if v := tx.Bucket(boltBucket).Get(key); v != nil {
+			buf = append([]byte{}, v...)
+		}
+		return nil
+	})
+	return buf, err
+}
+
+func (b *boltDB) write(batch *kvBatch) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltBucket)
+		for _, op := range batch.ops {
+			var err error
+			if op.del {
+				err = bucket.Delete(op.key)
+			} else {
+				err = bucket.Put(op.key, op.value)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (b *boltDB) iterate(prefix []byte, f func(key, value []byte) error) error {
+	return b.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(boltBucket).Cursor()
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			if err := f(k, v); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (b *boltDB) close() error {
+	return b.db.Close()
+}
@@ -0,0 +1,479 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+//go:build bolt
+// +build bolt
+
+package stores
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/nats-io/nats-streaming-server/spb"
+)
+
+func createDefaultBoltStore(t *testing.T) *BoltStore {
+	s, state, err := NewBoltStore(defaultDataStore, &testDefaultChannelLimits, false)
+	if err != nil {
+		stackFatalf(t, "Unable to create a BoltStore instance: %v", err)
+	}
+	if state == nil {
+		info := testDefaultServerInfo
+		if err := s.Init(&info); err != nil {
+			stackFatalf(t, "Unexpected error during Init: %v", err)
+		}
+	}
+	return s
+}
+
+func openDefaultBoltStore(t *testing.T) (*BoltStore, *RecoveredState) {
+	s, state, err := NewBoltStore(defaultDataStore, &testDefaultChannelLimits, false)
+	if err != nil {
+		stackFatalf(t, "Unable to create a BoltStore instance: %v", err)
+	}
+	return s, state
+}
+
+func TestBoltBasicCreate(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	s := createDefaultBoltStore(t)
+	defer s.Close()
+
+	testBasicCreate(t, s, TypeBolt)
+}
+
+func TestBoltNothingRecoveredOnFreshStart(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	s := createDefaultBoltStore(t)
+	defer s.Close()
+
+	testNothingRecoveredOnFreshStart(t, s)
+}
+
+func TestBoltNewChannel(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	s := createDefaultBoltStore(t)
+	defer s.Close()
+
+	testNewChannel(t, s)
+}
+
+func TestBoltCloseIdempotent(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	s := createDefaultBoltStore(t)
+	defer s.Close()
+
+	testCloseIdempotent(t, s)
+}
+
+func TestBoltBasicMsgStore(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	s := createDefaultBoltStore(t)
+	defer s.Close()
+
+	testBasicMsgStore(t, s)
+}
+
+func TestBoltMsgExt(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	s := createDefaultBoltStore(t)
+	defer s.Close()
+
+	testMsgExt(t, s)
+}
+
+func TestBoltStoreMsg(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	s := createDefaultBoltStore(t)
+	defer s.Close()
+
+	testStoreMsg(t, s)
+}
+
+func TestBoltStoreBatch(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	s := createDefaultBoltStore(t)
+	defer s.Close()
+
+	testStoreBatch(t, s)
+}
+
+func TestBoltStoreTx(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	s := createDefaultBoltStore(t)
+	defer s.Close()
+
+	testStoreTx(t, s)
+}
+
+func TestBoltMsgExpiration(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	s := createDefaultBoltStore(t)
+	defer s.Close()
+
+	testMsgExpiration(t, s)
+}
+
+func TestBoltPurgeBefore(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	s := createDefaultBoltStore(t)
+	defer s.Close()
+
+	testPurgeBefore(t, s)
+}
+
+func TestBoltMsgStamper(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	s := createDefaultBoltStore(t)
+	defer s.Close()
+
+	testMsgStamper(t, s)
+}
+
+func TestBoltKeyCompaction(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	s := createDefaultBoltStore(t)
+	defer s.Close()
+
+	testKeyCompaction(t, s)
+}
+
+func TestBoltMsgsState(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	s := createDefaultBoltStore(t)
+	defer s.Close()
+
+	testMsgsState(t, s)
+}
+
+func TestBoltGetChannels(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	s := createDefaultBoltStore(t)
+	defer s.Close()
+
+	testGetChannels(t, s)
+}
+
+func TestBoltMaxMsgs(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	s := createDefaultBoltStore(t)
+	defer s.Close()
+
+	testMaxMsgs(t, s)
+}
+
+func TestBoltMemoryBudget(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	s := createDefaultBoltStore(t)
+	defer s.Close()
+
+	testMemoryBudget(t, s)
+}
+
+func TestBoltMaxChannels(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	s := createDefaultBoltStore(t)
+	defer s.Close()
+
+	limitCount := 2
+
+	limits := testDefaultChannelLimits
+	limits.MaxChannels = limitCount
+
+	s.SetChannelLimits(limits)
+
+	testMaxChannels(t, s, limitCount)
+}
+
+func TestBoltMaxSubs(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	s := createDefaultBoltStore(t)
+	defer s.Close()
+
+	limitCount := 2
+
+	limits := testDefaultChannelLimits
+	limits.MaxSubs = limitCount
+
+	s.SetChannelLimits(limits)
+
+	testMaxSubs(t, s, limitCount)
+}
+
+func TestBoltTenantLimits(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	s := createDefaultBoltStore(t)
+	defer s.Close()
+
+	testTenantLimits(t, s)
+}
+
+func TestBoltBasicSubStore(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	s := createDefaultBoltStore(t)
+	defer s.Close()
+
+	testBasicSubStore(t, s)
+}
+
+func TestBoltGetSeqFromTimestamp(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	s := createDefaultBoltStore(t)
+	defer s.Close()
+
+	testGetSeqFromStartTime(t, s)
+}
+
+func TestBoltGetSeqFromTimestampIndex(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	s := createDefaultBoltStore(t)
+	defer s.Close()
+
+	testGetSeqFromTimestampIndex(t, s)
+}
+
+func TestBoltBatchAcks(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	s := createDefaultBoltStore(t)
+	defer s.Close()
+
+	subID := testBatchAcks(t, s)
+	s.Close()
+
+	s, state := openDefaultBoltStore(t)
+	defer s.Close()
+	checkBatchAcksRecovered(t, state, subID)
+}
+
+func TestBoltUpdateClient(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	s := createDefaultBoltStore(t)
+	defer s.Close()
+
+	testUpdateClient(t, s)
+	s.Close()
+
+	s, state := openDefaultBoltStore(t)
+	defer s.Close()
+	checkUpdateClientRecovered(t, state)
+}
+
+func TestBoltRecoverSubs(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	s := createDefaultBoltStore(t)
+	defer s.Close()
+
+	testRecoverSubs(t, s)
+	s.Close()
+
+	s, state := openDefaultBoltStore(t)
+	defer s.Close()
+	checkRecoverSubs(t, state)
+}
+
+func TestBoltClientAPIs(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	s := createDefaultBoltStore(t)
+	defer s.Close()
+
+	testClientAPIs(t, s)
+}
+
+func TestBoltFlush(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	s := createDefaultBoltStore(t)
+	defer s.Close()
+
+	testFlush(t, s)
+}
+
+func TestBoltRecovery(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	limits := testDefaultChannelLimits
+	limits.MaxNumMsgs = 3
+	s, state, err := NewBoltStore(defaultDataStore, &limits, false)
+	if err != nil {
+		t.Fatalf("Unable to create a BoltStore instance: %v", err)
+	}
+	defer s.Close()
+	if state != nil {
+		t.Fatal("Nothing should have been recovered")
+	}
+	info := testDefaultServerInfo
+	if err := s.Init(&info); err != nil {
+		t.Fatalf("Unexpected error during Init: %v", err)
+	}
+	if _, _, err := s.AddClient("me", "hbInbox", nil); err != nil {
+		t.Fatalf("Unexpected error adding client: %v", err)
+	}
+	if _, _, err := s.AddClient("other", "hbInbox", nil); err != nil {
+		t.Fatalf("Unexpected error adding client: %v", err)
+	}
+	s.DeleteClient("other")
+	for i := 0; i < 5; i++ {
+		storeMsg(t, s, "foo", []byte("hello"))
+	}
+	storeMsg(t, s, "foo.bar", []byte("hello"))
+	sub1 := storeSub(t, s, "foo")
+	sub2 := storeSub(t, s, "foo")
+	storeSubPending(t, s, "foo", sub1, 3, 4, 5)
+	storeSubAck(t, s, "foo", sub1, 4)
+	storeSubPending(t, s, "foo", sub2, 5)
+	storeSubDelete(t, s, "foo", sub2)
+	s.Close()
+
+	s, state, err = NewBoltStore(defaultDataStore, &limits, false)
+	if err != nil {
+		t.Fatalf("Unable to create a BoltStore instance: %v", err)
+	}
+	defer s.Close()
+	if state == nil || state.Info.ClusterID != testDefaultServerInfo.ClusterID {
+		t.Fatalf("Unexpected recovered state: %v", state)
+	}
+	if len(state.Clients) != 1 || state.Clients[0].ID != "me" || s.GetClient("me") == nil {
+		t.Fatalf("Unexpected recovered clients: %v", state.Clients)
+	}
+	infos, err := s.GetChannels()
+	if err != nil || len(infos) != 2 {
+		t.Fatalf("Unexpected recovered channels: %v (err=%v)", infos, err)
+	}
+	if foo := infos[0]; foo.Name != "foo" || foo.FirstSeq != 3 || foo.LastSeq != 5 || foo.Msgs != 3 || foo.Created.IsZero() {
+		t.Fatalf("Unexpected recovered channel: %+v", foo)
+	}
+	subs := getRecoveredSubs(t, state)["foo"]
+	if len(subs) != 1 || subs[0].Sub.ID != sub1 || len(subs[0].Pending) != 2 ||
+		subs[0].Pending[3] == nil || subs[0].Pending[5] == nil {
+		t.Fatalf("Unexpected recovered subscriptions: %v", subs)
+	}
+	// The ID of a new subscription does not collide with recovered ones.
+	if subID := storeSub(t, s, "foo"); subID <= sub1 {
+		t.Fatalf("Expected subscription ID greater than %v, got %v", sub1, subID)
+	}
+	// The store keeps enforcing the limits after recovery.
+	m := storeMsg(t, s, "foo", []byte("hello"))
+	if first, last := s.LookupChannel("foo").Msgs.FirstAndLastSequence(); first != 4 || last != m.Sequence {
+		t.Fatalf("Unexpected first and last sequences: %v, %v", first, last)
+	}
+	s.Close()
+
+	s, _ = openDefaultBoltStore(t)
+	defer s.Close()
+	if first, last := s.LookupChannel("foo").Msgs.FirstAndLastSequence(); first != 4 || last != 6 {
+		t.Fatalf("Unexpected first and last sequences: %v, %v", first, last)
+	}
+}
+
+func TestBoltKeyCompactionRecovery(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	limits := testDefaultChannelLimits
+	limits.CompactedChannels = []string{"prices"}
+	s, _, err := NewBoltStore(defaultDataStore, &limits, false)
+	if err != nil {
+		t.Fatalf("Unable to create a BoltStore instance: %v", err)
+	}
+	defer s.Close()
+	info := testDefaultServerInfo
+	if err := s.Init(&info); err != nil {
+		t.Fatalf("Unexpected error during Init: %v", err)
+	}
+	storeMsgWithExt(t, s, "prices", []byte("1"), &spb.MsgExt{Key: "a"})
+	storeMsgWithExt(t, s, "prices", []byte("2"), &spb.MsgExt{Key: "b"})
+	storeMsgWithExt(t, s, "prices", []byte("3"), &spb.MsgExt{Key: "a"})
+	s.Close()
+
+	s, _, err = NewBoltStore(defaultDataStore, &limits, false)
+	if err != nil {
+		t.Fatalf("Unable to create a BoltStore instance: %v", err)
+	}
+	defer s.Close()
+	ms := s.LookupChannel("prices").Msgs
+	if n, _, _ := ms.State(); n != 2 {
+		t.Fatalf("Expected 2 messages, got %v", n)
+	}
+	if m := msgStoreLookup(t, ms, 1); m != nil {
+		t.Fatalf("Superseded message should have been removed: %v", m)
+	}
+	if ext := ms.LookupExt(3); ext == nil || ext.Key != "a" {
+		t.Fatalf("Unexpected attributes: %v", ext)
+	}
+}
+
+func TestBoltSingleFile(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	s := createDefaultBoltStore(t)
+	defer s.Close()
+	storeMsg(t, s, "foo", []byte("hello"))
+	storeSub(t, s, "foo")
+	if _, _, err := s.AddClient("me", "hbInbox", nil); err != nil {
+		t.Fatalf("Unexpected error adding client: %v", err)
+	}
+	files, err := ioutil.ReadDir(defaultDataStore)
+	if err != nil {
+		t.Fatalf("Unable to read directory: %v", err)
+	}
+	if len(files) != 1 || files[0].Name() != boltFileName || files[0].IsDir() {
+		t.Fatalf("Expected only the %q file, got %v", boltFileName, files)
+	}
+}
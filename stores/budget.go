@@ -0,0 +1,78 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package stores
+
+import (
+	"sync/atomic"
+
+	"github.com/nats-io/go-nats-streaming/pb"
+	"github.com/nats-io/nats-streaming-server/spb"
+)
+
+// msgMemOverhead is the approximate memory (in bytes) used to keep a
+// message in memory, in addition to its encoded size: the map entry and
+// the fields of the MsgProto structure.
+const msgMemOverhead = 96
+
+// MemoryBudget accounts the memory used by the messages that a store keeps
+// in memory, which are all the messages for the MEMORY store and the
+// loaded ones for the FILE store, including the recovered messages and the
+// messages read back from a tier. If a limit is set, the stores do not keep
+// the messages read back from a tier once the limit is exceeded and, if
+// trimming is enabled, remove the oldest messages of a channel when a
+// message is stored on it, until the memory used is below the limit.
+// The memory used is an approximation of the heap used by the messages.
+type MemoryBudget struct {
+	used  int64 // accessed atomically
+	limit int64 // accessed atomically
+	trim  int32 // accessed atomically
+}
+
+// SetLimit sets the memory (in bytes) above which the budget is exceeded,
+// 0 for no limit, and whether the stores remove the oldest messages of the
+// channels when it is exceeded.
+func (b *MemoryBudget) SetLimit(limit int64, trim bool) {
+	atomic.StoreInt64(&b.limit, limit)
+	t := int32(0)
+	if trim {
+		t = 1
+	}
+	atomic.StoreInt32(&b.trim, t)
+}
+
+// Limit returns the limit of the budget, 0 if there is none.
+func (b *MemoryBudget) Limit() int64 {
+	return atomic.LoadInt64(&b.limit)
+}
+
+// Used returns the memory (in bytes) used by the messages kept in memory.
+func (b *MemoryBudget) Used() int64 {
+	return atomic.LoadInt64(&b.used)
+}
+
+// Exceeded returns true if there is a limit and the memory used is above.
+func (b *MemoryBudget) Exceeded() bool {
+	limit := atomic.LoadInt64(&b.limit)
+	return limit > 0 && atomic.LoadInt64(&b.used) > limit
+}
+
+// mustTrim returns true if the budget is exceeded and the stores must
+// remove the oldest messages of their channels.
+func (b *MemoryBudget) mustTrim() bool {
+	return atomic.LoadInt32(&b.trim) == 1 && b.Exceeded()
+}
+
+// add adds `delta` bytes (which can be negative) to the memory used.
+func (b *MemoryBudget) add(delta int64) {
+	atomic.AddInt64(&b.used, delta)
+}
+
+// msgMemSize returns the memory (in bytes) used to keep the message, with
+// its attributes, in memory.
+func msgMemSize(m *pb.MsgProto, ext *spb.MsgExt) int64 {
+	size := int64(m.Size() + msgMemOverhead)
+	if ext != nil {
+		size += int64(ext.Size())
+	}
+	return size
+}
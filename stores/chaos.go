@@ -0,0 +1,131 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+//go:build chaos
+// +build chaos
+
+package stores
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// When built with the `chaos` tag, the file store injects faults, at the
+// rates given by the STAN_FS_CHAOS environment variable, for instance
+// "sync=0.01,write=0.001,kill=0.0001,seed=42":
+//
+//	sync:  probability that a file sync fails
+//	write: probability that a write is partial and fails
+//	kill:  probability that the process exits at each kill point, without
+//	       flushing anything, as if it was killed
+//	seed:  seed of the random faults, the current time if not set
+//
+// The recovered state is then checked with CheckInvariants() each time a
+// file store is opened, which fails if it is inconsistent.
+const chaosEnabled = true
+
+// Name of the environment variable holding the fault rates.
+const chaosEnvVar = "STAN_FS_CHAOS"
+
+// Exit code of the process at a kill point, the one of a process killed
+// with SIGKILL.
+const chaosKillExitCode = 137
+
+var (
+	errChaosSync  = errors.New("chaos: injected sync failure")
+	errChaosWrite = errors.New("chaos: injected partial write")
+)
+
+var chaos = struct {
+	sync.Mutex
+	rnd   *rand.Rand
+	sync  float64
+	write float64
+	kill  float64
+}{}
+
+func init() {
+	seed := time.Now().UnixNano()
+	if spec := os.Getenv(chaosEnvVar); spec != "" {
+		for _, kv := range strings.Split(spec, ",") {
+			parts := strings.SplitN(strings.TrimSpace(kv), "=", 2)
+			if len(parts) != 2 {
+				panic(fmt.Errorf("invalid %s entry %q", chaosEnvVar, kv))
+			}
+			var err error
+			switch parts[0] {
+			case "sync":
+				chaos.sync, err = strconv.ParseFloat(parts[1], 64)
+			case "write":
+				chaos.write, err = strconv.ParseFloat(parts[1], 64)
+			case "kill":
+				chaos.kill, err = strconv.ParseFloat(parts[1], 64)
+			case "seed":
+				seed, err = strconv.ParseInt(parts[1], 10, 64)
+			default:
+				err = errors.New("unknown fault")
+			}
+			if err != nil {
+				panic(fmt.Errorf("invalid %s entry %q: %v", chaosEnvVar, kv, err))
+			}
+		}
+	}
+	chaos.rnd = rand.New(rand.NewSource(seed))
+	Noticef("Injecting faults: sync=%v write=%v kill=%v seed=%v", chaos.sync, chaos.write, chaos.kill, seed)
+}
+
+// chaosHit returns true, with the given probability, if a fault should be
+// injected.
+func chaosHit(rate float64) bool {
+	if rate <= 0 {
+		return false
+	}
+	chaos.Lock()
+	hit := chaos.rnd.Float64() < rate
+	chaos.Unlock()
+	return hit
+}
+
+// chaosWriter returns a writer that randomly writes only part of what it
+// is given to `w` and fails.
+func chaosWriter(w io.Writer) io.Writer {
+	return &partialWriter{w: w}
+}
+
+type partialWriter struct {
+	w io.Writer
+}
+
+func (pw *partialWriter) Write(p []byte) (int, error) {
+	if len(p) == 0 || !chaosHit(chaos.write) {
+		return pw.w.Write(p)
+	}
+	n, err := pw.w.Write(p[:len(p)/2])
+	if err == nil {
+		err = errChaosWrite
+	}
+	return n, err
+}
+
+// chaosSyncFault randomly returns an error for a file sync.
+func chaosSyncFault() error {
+	if chaosHit(chaos.sync) {
+		return errChaosSync
+	}
+	return nil
+}
+
+// chaosKillPoint randomly exits the process.
+func chaosKillPoint(name string) {
+	if chaosHit(chaos.kill) {
+		Noticef("Killing the process at %s", name)
+		os.Exit(chaosKillExitCode)
+	}
+}
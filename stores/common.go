@@ -3,18 +3,33 @@
 package stores
 
 import (
+	"fmt"
 	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/nats-io/go-nats-streaming/pb"
 	"github.com/nats-io/nats-streaming-server/spb"
+	"github.com/nats-io/nats-streaming-server/util"
 )
 
 // format string used to report that limit is reached when storing
 // messages.
-var droppingMsgsFmt = "WARNING: Reached limits for store %q (msgs=%v/%v bytes=%v/%v), " +
+var droppingMsgsFmt = "WARNING: Reached limits for channel=%s (msgs=%v/%v bytes=%v/%v), " +
 	"dropping old messages to make room for new ones."
 
+// timeIndexInterval is the number of sequences between two entries of the
+// timestamp index of a message store.
+const timeIndexInterval = 256
+
+// timeIndexEntry records the timestamp of the message with sequence `seq`.
+type timeIndexEntry struct {
+	seq       uint64
+	timestamp int64
+}
+
 // commonStore contains everything that is common to any type of store
 type commonStore struct {
 	sync.RWMutex
@@ -27,7 +42,10 @@ type genericStore struct {
 	commonStore
 	name     string
 	channels map[string]*ChannelStore
+	creating map[string]chan struct{} // channels being created, closed once done
 	clients  map[string]*Client
+	budget   *MemoryBudget
+	stamper  *sharedStamper
 }
 
 // genericSubStore is the generic store implementation that manages subscriptions
@@ -42,14 +60,27 @@ type genericSubStore struct {
 // genericMsgStore is the generic store implementation that manages messages
 // for a given channel.
 type genericMsgStore struct {
+	// The sequences are first for their alignment, since they are read
+	// atomically. They are only changed with the lock held, through
+	// setFirst() and setLast().
+	first uint64
+	last  uint64
 	commonStore
 	subject    string // Can't be wildcard
-	first      uint64
-	last       uint64
 	msgs       map[uint64]*pb.MsgProto
+	exts       map[uint64]*spb.MsgExt // only for messages with attributes
+	keys       map[string]uint64      // only for compacted channels
+	timeIndex  []timeIndexEntry       // sparse timestamp to sequence index
 	totalCount int
 	totalBytes uint64
-	hitLimit   bool // indicates if store had to drop messages due to limit
+	hitLimit   bool           // indicates if store had to drop messages due to limit
+	budget     *MemoryBudget  // shared with the other channels of the store
+	stamper    *sharedStamper // shared with the other channels of the store
+	maxTime    int64          // highest timestamp of the messages stored
+	// The expiry timer removes the expired messages at the head of the log
+	// when no message is stored. It is created on first use.
+	expireTimer *time.Timer
+	expireAt    int64 // expiration the timer is set for, 0 once fired
 }
 
 ////////////////////////////////////////////////////////////////////////////
@@ -67,6 +98,8 @@ func (gs *genericStore) init(name string, limits *ChannelLimits) {
 	// Do not use limits values to create the map.
 	gs.channels = make(map[string]*ChannelStore)
 	gs.clients = make(map[string]*Client)
+	gs.budget = &MemoryBudget{}
+	gs.stamper = &sharedStamper{}
 }
 
 // Init can be used to initialize the store with server's information.
@@ -79,6 +112,12 @@ func (gs *genericStore) Name() string {
 	return gs.name
 }
 
+// MemoryBudget returns the accounting of the memory used by the messages
+// kept in memory by this store.
+func (gs *genericStore) MemoryBudget() *MemoryBudget {
+	return gs.budget
+}
+
 // SetChannelLimits sets the limit for the messages and subscriptions stores.
 func (gs *genericStore) SetChannelLimits(limits ChannelLimits) {
 	gs.Lock()
@@ -86,6 +125,11 @@ func (gs *genericStore) SetChannelLimits(limits ChannelLimits) {
 	gs.Unlock()
 }
 
+// SetMsgStamper sets the MsgStamper of the message stores.
+func (gs *genericStore) SetMsgStamper(stamper MsgStamper) {
+	gs.stamper.set(stamper)
+}
+
 // LookupChannel returns a ChannelStore for the given channel.
 func (gs *genericStore) LookupChannel(channel string) *ChannelStore {
 	gs.RLock()
@@ -102,6 +146,64 @@ func (gs *genericStore) HasChannel() bool {
 	return l > 0
 }
 
+// GetChannelNames returns the names of all channels in this store.
+func (gs *genericStore) GetChannelNames() []string {
+	gs.RLock()
+	names := make([]string, 0, len(gs.channels))
+	for name := range gs.channels {
+		names = append(names, name)
+	}
+	gs.RUnlock()
+	return names
+}
+
+// GetChannels returns information about all channels in this store,
+// sorted by channel name.
+func (gs *genericStore) GetChannels() ([]*ChannelInfo, error) {
+	gs.RLock()
+	channels := make(map[string]*ChannelStore, len(gs.channels))
+	for name, cs := range gs.channels {
+		channels[name] = cs
+	}
+	gs.RUnlock()
+
+	infos := make([]*ChannelInfo, 0, len(channels))
+	for name, cs := range channels {
+		n, b, err := cs.Msgs.State()
+		if err != nil {
+			return nil, err
+		}
+		first, last := cs.Msgs.FirstAndLastSequence()
+		info := &ChannelInfo{
+			Name:     name,
+			Created:  cs.Created,
+			FirstSeq: first,
+			LastSeq:  last,
+			Msgs:     n,
+			Bytes:    b,
+		}
+		if rs, ok := cs.Msgs.(retentionStatser); ok {
+			info.Retention = rs.RetentionStats()
+		}
+		infos = append(infos, info)
+	}
+	sort.Sort(channelInfosByName(infos))
+	return infos, nil
+}
+
+// retentionStatser is implemented by the message stores that can enforce
+// their limits in the background.
+type retentionStatser interface {
+	RetentionStats() *RetentionStats
+}
+
+// channelInfosByName sorts channel infos by name.
+type channelInfosByName []*ChannelInfo
+
+func (c channelInfosByName) Len() int           { return len(c) }
+func (c channelInfosByName) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
+func (c channelInfosByName) Less(i, j int) bool { return c[i].Name < c[j].Name }
+
 // State returns message store statistics for a given channel ('*' for all)
 func (gs *genericStore) MsgsState(channel string) (numMessages int, byteSize uint64, err error) {
 	numMessages = 0
@@ -132,17 +234,84 @@ func (gs *genericStore) MsgsState(channel string) (numMessages int, byteSize uin
 }
 
 // canAddChannel returns true if the current number of channels is below the limit.
+// Channels of a tenant are counted against the tenant's limit only.
 // Store lock is assumed to be locked.
-func (gs *genericStore) canAddChannel() error {
-	if len(gs.channels) >= gs.limits.MaxChannels {
+func (gs *genericStore) canAddChannel(channel string) error {
+	// The channels being created count against the limits.
+	count := len(gs.channels) + len(gs.creating)
+	maxChannels := gs.limits.MaxChannels
+	if len(gs.limits.Tenants) > 0 {
+		tenant := gs.limits.tenantOf(channel)
+		if tenant != nil && tenant.MaxChannels > 0 {
+			maxChannels = tenant.MaxChannels
+		}
+		count = 0
+		for name := range gs.channels {
+			if gs.limits.tenantOf(name) == tenant {
+				count++
+			}
+		}
+		for name := range gs.creating {
+			if gs.limits.tenantOf(name) == tenant {
+				count++
+			}
+		}
+	}
+	if count >= maxChannels {
 		return ErrTooManyChannels
 	}
 	return nil
 }
 
+// tenantOf returns the limits of the tenant the channel belongs to, or nil
+// if the channel does not belong to any tenant.
+func (cl *ChannelLimits) tenantOf(channel string) *TenantLimits {
+	for i := range cl.Tenants {
+		tenant := &cl.Tenants[i]
+		if strings.HasPrefix(channel, tenant.Name+".") {
+			return tenant
+		}
+	}
+	return nil
+}
+
+// ForChannel returns the limits that apply to the given channel, which are
+// its own limits, if any, completed by the limits of its tenant, if any,
+// and by the store's limits.
+func (cl *ChannelLimits) ForChannel(channel string) ChannelLimits {
+	limits := *cl
+	if tenant := cl.tenantOf(channel); tenant != nil {
+		if tenant.MaxNumMsgs > 0 {
+			limits.MaxNumMsgs = tenant.MaxNumMsgs
+		}
+		if tenant.MaxMsgBytes > 0 {
+			limits.MaxMsgBytes = tenant.MaxMsgBytes
+		}
+		if tenant.MaxSubs > 0 {
+			limits.MaxSubs = tenant.MaxSubs
+		}
+	}
+	for _, pcl := range cl.PerChannel {
+		if pcl.Name != channel {
+			continue
+		}
+		if pcl.MaxNumMsgs > 0 {
+			limits.MaxNumMsgs = pcl.MaxNumMsgs
+		}
+		if pcl.MaxMsgBytes > 0 {
+			limits.MaxMsgBytes = pcl.MaxMsgBytes
+		}
+		if pcl.MaxSubs > 0 {
+			limits.MaxSubs = pcl.MaxSubs
+		}
+		break
+	}
+	return limits
+}
+
 // AddClient stores information about the client identified by `clientID`.
 func (gs *genericStore) AddClient(clientID, hbInbox string, userData interface{}) (*Client, bool, error) {
-	c := &Client{spb.ClientInfo{ID: clientID, HbInbox: hbInbox}, userData}
+	c := &Client{spb.ClientInfo{ID: clientID, HbInbox: hbInbox, LastContact: time.Now().UnixNano()}, userData}
 	gs.Lock()
 	oldClient := gs.clients[clientID]
 	if oldClient != nil {
@@ -192,6 +361,68 @@ func (gs *genericStore) DeleteClient(clientID string) *Client {
 	return c
 }
 
+// SetClientUnreachable records the time since which the client does not
+// answer heartbeats.
+func (gs *genericStore) SetClientUnreachable(clientID string, since int64) error {
+	gs.Lock()
+	defer gs.Unlock()
+	c := gs.clients[clientID]
+	if c == nil {
+		return fmt.Errorf("client %q not found", clientID)
+	}
+	c.UnreachableSince = since
+	return nil
+}
+
+// SetClientLastContact records the time at which the client last answered
+// a heartbeat.
+func (gs *genericStore) SetClientLastContact(clientID string, lastContact int64) error {
+	gs.Lock()
+	defer gs.Unlock()
+	c := gs.clients[clientID]
+	if c == nil {
+		return fmt.Errorf("client %q not found", clientID)
+	}
+	c.LastContact = lastContact
+	return nil
+}
+
+// UpdateClient replaces the heartbeat inbox and the metadata of the client.
+func (gs *genericStore) UpdateClient(clientID, hbInbox string, metadata []byte) (*Client, error) {
+	gs.Lock()
+	defer gs.Unlock()
+	c := gs.clients[clientID]
+	if c == nil {
+		return nil, fmt.Errorf("client %q not found", clientID)
+	}
+	c.HbInbox = hbInbox
+	c.Metadata = metadata
+	return c, nil
+}
+
+// Flush flushes the stores of all channels. The first error is returned,
+// but all channels are flushed.
+func (gs *genericStore) Flush() error {
+	gs.RLock()
+	if gs.closed {
+		gs.RUnlock()
+		return nil
+	}
+	channels := make([]*ChannelStore, 0, len(gs.channels))
+	for _, cs := range gs.channels {
+		channels = append(channels, cs)
+	}
+	gs.RUnlock()
+
+	var err error
+	for _, cs := range channels {
+		if lerr := cs.Flush(); lerr != nil && err == nil {
+			err = lerr
+		}
+	}
+	return err
+}
+
 // Close closes all stores
 func (gs *genericStore) Close() error {
 	gs.Lock()
@@ -226,15 +457,184 @@ func (gs *genericStore) close() error {
 ////////////////////////////////////////////////////////////////////////////
 
 // init initializes this generic message store
-func (gms *genericMsgStore) init(subject string, limits ChannelLimits) {
+func (gms *genericMsgStore) init(subject string, limits ChannelLimits, budget *MemoryBudget, stamper *sharedStamper) {
 	gms.subject = subject
-	gms.limits = limits
+	gms.budget = budget
+	gms.stamper = stamper
+	gms.limits = limits.ForChannel(subject)
 	// FIXME(ik) - Long term, msgs map should probably not be part of the
 	// generic store.
 	// We could use limits.MaxNumMsgs for the size of the map, but that
 	// may be too big if there is lots of channels with only few messages.
 	// The map will grow as needed.
 	gms.msgs = make(map[uint64]*pb.MsgProto, 64)
+	gms.exts = make(map[uint64]*spb.MsgExt)
+	if isCompactedChannel(subject, &limits) {
+		gms.keys = make(map[string]uint64)
+	}
+}
+
+// isCompactedChannel returns true if the given channel matches one of
+// the compacted channels from the given limits.
+func isCompactedChannel(channel string, limits *ChannelLimits) bool {
+	for _, pattern := range limits.CompactedChannels {
+		if util.SubjectMatches(pattern, channel) {
+			return true
+		}
+	}
+	return false
+}
+
+// addMsg adds the message `m` and its attributes, if any, to the cache.
+// The message must have a sequence greater than the last one.
+// Lock is held on entry.
+func (gms *genericMsgStore) addMsg(m *pb.MsgProto, ext *spb.MsgExt) {
+	gms.msgs[m.Sequence] = m
+	gms.storeExt(m.Sequence, ext)
+	gms.budget.add(msgMemSize(m, gms.exts[m.Sequence]))
+	if m.Timestamp > gms.maxTime {
+		gms.maxTime = m.Timestamp
+	}
+
+	n := len(gms.timeIndex)
+	if n > 0 && m.Sequence < gms.timeIndex[n-1].seq+timeIndexInterval {
+		return
+	}
+	// Drop the entries no longer needed to bound the search, that is,
+	// if the next one is still before the first message.
+	for len(gms.timeIndex) > 1 && gms.timeIndex[1].seq <= gms.first {
+		gms.timeIndex = gms.timeIndex[1:]
+	}
+	gms.timeIndex = append(gms.timeIndex, timeIndexEntry{seq: m.Sequence, timestamp: m.Timestamp})
+}
+
+// stamp returns the sequence and timestamp of the next message stored with
+// Store, StoreBatch or a transaction, from the MsgStamper of the store.
+// Lock is held on entry.
+func (gms *genericMsgStore) stamp() (uint64, int64, error) {
+	seq, timestamp := gms.stamper.get().Stamp(gms.subject, gms.last, gms.maxTime)
+	if seq <= gms.last {
+		return 0, 0, ErrSeqOutOfOrder
+	}
+	return seq, timestamp, nil
+}
+
+// storeExt keeps track of the attributes of the message with sequence `seq`,
+// if there are any.
+// Lock is held on entry.
+func (gms *genericMsgStore) storeExt(seq uint64, ext *spb.MsgExt) {
+	if ext != nil && ext.Size() > 0 {
+		gms.exts[seq] = ext
+	}
+}
+
+// isExpired returns true if the message with sequence `seq` has an
+// expiration time that is before `now`.
+// Lock is held on entry.
+func (gms *genericMsgStore) isExpired(seq uint64, now int64) bool {
+	if len(gms.exts) == 0 {
+		return false
+	}
+	return isExpiredExt(gms.exts[seq], now)
+}
+
+// isExpiredExt returns true if the attributes `ext` have an expiration
+// time that is before `now`.
+func isExpiredExt(ext *spb.MsgExt, now int64) bool {
+	return ext != nil && ext.Expiration > 0 && ext.Expiration <= now
+}
+
+// setExpiryTimer sets up the expiry timer to call `expire` when the first
+// message expires, so that the expired messages are removed even if no
+// message is stored in the channel. Messages expiring behind a message
+// that expires later, or never, stay in the store until they reach the
+// head of the log, but they are no longer returned by the lookups.
+// Lock is held on entry.
+func (gms *genericMsgStore) setExpiryTimer(expire func()) {
+	if gms.closed || len(gms.exts) == 0 {
+		return
+	}
+	ext := gms.exts[gms.first]
+	if ext == nil || ext.Expiration == 0 || ext.Expiration == gms.expireAt {
+		return
+	}
+	d := time.Duration(ext.Expiration - time.Now().UnixNano())
+	if d < 0 {
+		// The last message is kept, even if expired, as with the limits.
+		if gms.totalCount <= 1 {
+			return
+		}
+		d = 0
+	}
+	gms.expireAt = ext.Expiration
+	if gms.expireTimer == nil {
+		gms.expireTimer = time.AfterFunc(d, expire)
+	} else {
+		gms.expireTimer.Reset(d)
+	}
+}
+
+// stopExpiryTimer stops the expiry timer of a closed store.
+// Lock is held on entry.
+func (gms *genericMsgStore) stopExpiryTimer() {
+	if gms.expireTimer != nil {
+		gms.expireTimer.Stop()
+	}
+}
+
+// removeMsg removes the message with sequence `seq` from the cache.
+// Lock is held on entry.
+func (gms *genericMsgStore) removeMsg(seq uint64) {
+	if m := gms.msgs[seq]; m != nil {
+		gms.budget.add(-msgMemSize(m, gms.exts[seq]))
+	}
+	delete(gms.msgs, seq)
+	if len(gms.exts) > 0 {
+		if ext := gms.exts[seq]; ext != nil && gms.keys != nil && ext.Key != "" {
+			if gms.keys[ext.Key] == seq {
+				delete(gms.keys, ext.Key)
+			}
+		}
+		delete(gms.exts, seq)
+	}
+}
+
+// supersede records that the message with sequence `seq` is now the latest
+// one for its key and returns the message it replaces, nil if there is
+// none or if this store is not for a compacted channel. The returned
+// message has been removed from the cache and from the total counts, but
+// `first` is the responsibility of the caller.
+// Lock is held on entry.
+func (gms *genericMsgStore) supersede(seq uint64, ext *spb.MsgExt) *pb.MsgProto {
+	if gms.keys == nil || ext == nil || ext.Key == "" {
+		return nil
+	}
+	prevSeq := gms.keys[ext.Key]
+	gms.keys[ext.Key] = seq
+	if prevSeq == 0 {
+		return nil
+	}
+	prev := gms.msgs[prevSeq]
+	if prev == nil {
+		return nil
+	}
+	gms.totalCount--
+	gms.totalBytes -= uint64(len(prev.Data))
+	gms.removeMsg(prevSeq)
+	return prev
+}
+
+// nextSeq returns the sequence of the first message stored after `seq`,
+// or `last+1` if there is none. Sequences are contiguous unless messages
+// have been removed by key compaction.
+// Lock is held on entry.
+func (gms *genericMsgStore) nextSeq(seq uint64) uint64 {
+	for seq++; seq <= gms.last; seq++ {
+		if gms.msgs[seq] != nil {
+			break
+		}
+	}
+	return seq
 }
 
 // State returns some statistics related to this store
@@ -245,20 +645,28 @@ func (gms *genericMsgStore) State() (numMessages int, byteSize uint64, err error
 	return c, b, nil
 }
 
-// FirstSequence returns sequence for first message stored.
+// setFirst sets the sequence of the first message stored.
+// Lock is held on entry.
+func (gms *genericMsgStore) setFirst(seq uint64) {
+	atomic.StoreUint64(&gms.first, seq)
+}
+
+// setLast sets the sequence of the last message stored.
+// Lock is held on entry.
+func (gms *genericMsgStore) setLast(seq uint64) {
+	atomic.StoreUint64(&gms.last, seq)
+}
+
+// FirstSequence returns sequence for first message stored. It does not
+// acquire the lock, so that it is not blocked by a store in progress.
 func (gms *genericMsgStore) FirstSequence() uint64 {
-	gms.RLock()
-	first := gms.first
-	gms.RUnlock()
-	return first
+	return atomic.LoadUint64(&gms.first)
 }
 
-// LastSequence returns sequence for last message stored.
+// LastSequence returns sequence for last message stored. It does not
+// acquire the lock, so that it is not blocked by a store in progress.
 func (gms *genericMsgStore) LastSequence() uint64 {
-	gms.RLock()
-	last := gms.last
-	gms.RUnlock()
-	return last
+	return atomic.LoadUint64(&gms.last)
 }
 
 // FirstAndLastSequence returns sequences for the first and last messages stored.
@@ -269,28 +677,89 @@ func (gms *genericMsgStore) FirstAndLastSequence() (uint64, uint64) {
 	return first, last
 }
 
-// Lookup returns the stored message with given sequence number.
-func (gms *genericMsgStore) Lookup(seq uint64) *pb.MsgProto {
+// Lookup returns the stored message with given sequence number, nil if
+// it has expired, even if it has not been removed yet.
+func (gms *genericMsgStore) Lookup(seq uint64) (*pb.MsgProto, error) {
 	gms.RLock()
-	m := gms.msgs[seq]
+	m := gms.lookup(seq)
 	gms.RUnlock()
-	return m
+	return m, nil
+}
+
+// lookup returns the message with sequence `seq`, nil if there is none or
+// if it has expired.
+// Lock is held on entry.
+func (gms *genericMsgStore) lookup(seq uint64) *pb.MsgProto {
+	if len(gms.exts) > 0 && gms.isExpired(seq, time.Now().UnixNano()) {
+		return nil
+	}
+	return gms.msgs[seq]
+}
+
+// LookupExt returns the attributes stored with the message of given
+// sequence number, nil if there are none.
+func (gms *genericMsgStore) LookupExt(seq uint64) *spb.MsgExt {
+	gms.RLock()
+	ext := gms.exts[seq]
+	gms.RUnlock()
+	return ext
+}
+
+// LookupRange returns the messages stored with a sequence between first
+// and last included, at most max of them unless max is 0. The expired
+// messages are skipped.
+func (gms *genericMsgStore) LookupRange(first, last uint64, max int) ([]*pb.MsgProto, error) {
+	gms.RLock()
+	defer gms.RUnlock()
+	return lookupRange(first, last, gms.first, gms.last, max, func(seq uint64) (*pb.MsgProto, error) {
+		return gms.lookup(seq), nil
+	})
+}
+
+// lookupRange returns the messages found by lookup for the sequences
+// between first and last included, restricted to the sequences stored,
+// from storeFirst to storeLast.
+func lookupRange(first, last, storeFirst, storeLast uint64, max int, lookup func(seq uint64) (*pb.MsgProto, error)) ([]*pb.MsgProto, error) {
+	if storeFirst == 0 {
+		return nil, nil
+	}
+	if first < storeFirst {
+		first = storeFirst
+	}
+	if last > storeLast {
+		last = storeLast
+	}
+	var msgs []*pb.MsgProto
+	for seq := first; seq <= last; seq++ {
+		m, err := lookup(seq)
+		if err != nil {
+			return nil, err
+		}
+		if m == nil {
+			continue
+		}
+		msgs = append(msgs, m)
+		if max > 0 && len(msgs) == max {
+			break
+		}
+	}
+	return msgs, nil
 }
 
 // FirstMsg returns the first message stored.
-func (gms *genericMsgStore) FirstMsg() *pb.MsgProto {
+func (gms *genericMsgStore) FirstMsg() (*pb.MsgProto, error) {
 	gms.RLock()
 	m := gms.msgs[gms.first]
 	gms.RUnlock()
-	return m
+	return m, nil
 }
 
 // LastMsg returns the last message stored.
-func (gms *genericMsgStore) LastMsg() *pb.MsgProto {
+func (gms *genericMsgStore) LastMsg() (*pb.MsgProto, error) {
 	gms.RLock()
 	m := gms.msgs[gms.last]
 	gms.RUnlock()
-	return m
+	return m, nil
 }
 
 func (gms *genericMsgStore) Flush() error {
@@ -298,25 +767,61 @@ func (gms *genericMsgStore) Flush() error {
 	return nil
 }
 
+// LastMsgForKey returns the latest message stored with the given key.
+func (gms *genericMsgStore) LastMsgForKey(key string) (*pb.MsgProto, error) {
+	gms.RLock()
+	var m *pb.MsgProto
+	if seq := gms.keys[key]; seq != 0 {
+		m = gms.msgs[seq]
+	}
+	gms.RUnlock()
+	return m, nil
+}
+
 // GetSequenceFromTimestamp returns the sequence of the first message whose
 // timestamp is greater or equal to given timestamp.
 func (gms *genericMsgStore) GetSequenceFromTimestamp(timestamp int64) uint64 {
 	gms.RLock()
 	defer gms.RUnlock()
 
-	index := sort.Search(len(gms.msgs), func(i int) bool {
-		m := gms.msgs[uint64(i)+gms.first]
+	if gms.first == 0 {
+		return 0
+	}
+	// The timestamp index narrows the search to the sequences between
+	// the last entry before the timestamp and the next entry.
+	index := gms.timeIndex
+	i := sort.Search(len(index), func(i int) bool {
+		return index[i].timestamp >= timestamp
+	})
+	start, end := gms.first, gms.last
+	if i > 0 && index[i-1].seq > start {
+		start = index[i-1].seq
+	}
+	if i < len(index) && index[i].seq < end {
+		end = index[i].seq
+	}
+	// There may be gaps if messages have been removed by key compaction.
+	// A missing message is represented by the next available one.
+	seq := start
+	for s := start; s <= end; s++ {
+		m := gms.msgs[s]
+		if m == nil {
+			continue
+		}
 		if m.Timestamp >= timestamp {
-			return true
+			break
 		}
-		return false
-	})
-
-	return uint64(index) + gms.first
+		seq = s + 1
+	}
+	return seq
 }
 
 // Close closes this store.
 func (gms *genericMsgStore) Close() error {
+	gms.Lock()
+	gms.closed = true
+	gms.stopExpiryTimer()
+	gms.Unlock()
 	return nil
 }
 
@@ -327,7 +832,7 @@ func (gms *genericMsgStore) Close() error {
 // init initializes the structure of a generic sub store
 func (gss *genericSubStore) init(channel string, limits ChannelLimits) {
 	gss.subject = channel
-	gss.limits = limits
+	gss.limits = limits.ForChannel(channel)
 }
 
 // CreateSub records a new subscription represented by SubState. On success,
@@ -382,6 +887,20 @@ func (gss *genericSubStore) AckSeqPending(subid, seqno uint64) error {
 	return nil
 }
 
+// AckSeqPendingRange records that the messages from firstSeq to lastSeq
+// have been acknowledged by the given subscription.
+func (gss *genericSubStore) AckSeqPendingRange(subid, firstSeq, lastSeq uint64) error {
+	// no-op
+	return nil
+}
+
+// AckSeqPendingBatch records that the given messages have been acknowledged
+// by the given subscription.
+func (gss *genericSubStore) AckSeqPendingBatch(subid uint64, seqnos ...uint64) error {
+	// no-op
+	return nil
+}
+
 // Flush is for stores that may buffer operations and need them to be persisted.
 func (gss *genericSubStore) Flush() error {
 	// no-op
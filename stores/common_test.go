@@ -32,6 +32,20 @@ type tLogger interface {
 	Errorf(format string, args ...interface{})
 }
 
+// getRecoveredSubs collects the subscriptions handed out by state.Recover,
+// keyed by channel name.
+func getRecoveredSubs(t tLogger, state *RecoveredState) map[string][]*RecoveredSubState {
+	subs := make(map[string][]*RecoveredSubState)
+	err := state.Recover(func(channel string, sub *RecoveredSubState) error {
+		subs[channel] = append(subs[channel], sub)
+		return nil
+	})
+	if err != nil {
+		stackFatalf(t, "Error recovering subscriptions: %v", err)
+	}
+	return subs
+}
+
 func stackFatalf(t tLogger, f string, args ...interface{}) {
 	lines := make([]string, 0, 32)
 	msg := fmt.Sprintf(f, args...)
@@ -51,6 +65,10 @@ func stackFatalf(t tLogger, f string, args ...interface{}) {
 }
 
 func storeMsg(t *testing.T, s Store, channel string, data []byte) *pb.MsgProto {
+	return storeMsgWithExt(t, s, channel, data, nil)
+}
+
+func storeMsgWithExt(t *testing.T, s Store, channel string, data []byte, ext *spb.MsgExt) *pb.MsgProto {
 	cs := s.LookupChannel(channel)
 	if cs == nil {
 		var err error
@@ -60,13 +78,37 @@ func storeMsg(t *testing.T, s Store, channel string, data []byte) *pb.MsgProto {
 		}
 	}
 	ms := cs.Msgs
-	m, err := ms.Store("", data)
+	m, err := ms.Store("", data, ext)
 	if err != nil {
 		stackFatalf(t, "Error storing message into channel [%v]: %v", channel, err)
 	}
 	return m
 }
 
+func msgStoreLookup(t tLogger, ms MsgStore, seq uint64) *pb.MsgProto {
+	m, err := ms.Lookup(seq)
+	if err != nil {
+		stackFatalf(t, "Error looking up message %v: %v", seq, err)
+	}
+	return m
+}
+
+func msgStoreFirstMsg(t tLogger, ms MsgStore) *pb.MsgProto {
+	m, err := ms.FirstMsg()
+	if err != nil {
+		stackFatalf(t, "Error getting first message: %v", err)
+	}
+	return m
+}
+
+func msgStoreLastMsg(t tLogger, ms MsgStore) *pb.MsgProto {
+	m, err := ms.LastMsg()
+	if err != nil {
+		stackFatalf(t, "Error getting last message: %v", err)
+	}
+	return m
+}
+
 func storeSub(t *testing.T, s Store, channel string) uint64 {
 	cs := s.LookupChannel(channel)
 	if cs == nil {
@@ -172,6 +214,9 @@ func testNewChannel(t *testing.T, s Store) {
 	if cs != ncs {
 		t.Fatalf("Channel should exist: %v", ncs)
 	}
+	if names := s.GetChannelNames(); len(names) != 1 || names[0] != "foo" {
+		t.Fatalf("Unexpected channel names: %v", names)
+	}
 }
 
 func testCloseIdempotent(t *testing.T, s Store) {
@@ -212,12 +257,12 @@ func testBasicMsgStore(t *testing.T, s Store) {
 	ms := cs.Msgs
 
 	// No message is stored, verify expected values.
-	if ms.FirstMsg() != nil {
-		t.Fatalf("Unexpected first message: %v vs %v", ms.FirstMsg(), nil)
+	if msgStoreFirstMsg(t, ms) != nil {
+		t.Fatalf("Unexpected first message: %v vs %v", msgStoreFirstMsg(t, ms), nil)
 	}
 
-	if ms.LastMsg() != nil {
-		t.Fatalf("Unexpected first message: %v vs %v", ms.LastMsg(), nil)
+	if msgStoreLastMsg(t, ms) != nil {
+		t.Fatalf("Unexpected first message: %v vs %v", msgStoreLastMsg(t, ms), nil)
 	}
 
 	if ms.FirstSequence() != 0 {
@@ -245,12 +290,12 @@ func testBasicMsgStore(t *testing.T, s Store) {
 		t.Fatalf("Unexpected payload: %v", string(m1.Data))
 	}
 
-	if ms.FirstMsg() != m1 {
-		t.Fatalf("Unexpected first message: %v vs %v", ms.FirstMsg(), m1)
+	if msgStoreFirstMsg(t, ms) != m1 {
+		t.Fatalf("Unexpected first message: %v vs %v", msgStoreFirstMsg(t, ms), m1)
 	}
 
-	if ms.LastMsg() != m2 {
-		t.Fatalf("Unexpected first message: %v vs %v", ms.LastMsg(), m2)
+	if msgStoreLastMsg(t, ms) != m2 {
+		t.Fatalf("Unexpected first message: %v vs %v", msgStoreLastMsg(t, ms), m2)
 	}
 
 	if ms.FirstSequence() != m1.Sequence {
@@ -265,11 +310,11 @@ func testBasicMsgStore(t *testing.T, s Store) {
 		t.Fatalf("Unexpected sequences: %v,%v", s1, s2)
 	}
 
-	if lm1 := ms.Lookup(m1.Sequence); lm1 != m1 {
+	if lm1 := msgStoreLookup(t, ms, m1.Sequence); lm1 != m1 {
 		t.Fatalf("Unexpected lookup result: %v instead of %v", lm1, m1)
 	}
 
-	if lm2 := ms.Lookup(m2.Sequence); lm2 != m2 {
+	if lm2 := msgStoreLookup(t, ms, m2.Sequence); lm2 != m2 {
 		t.Fatalf("Unexpected lookup result: %v instead of %v", lm2, m2)
 	}
 
@@ -283,6 +328,431 @@ func testBasicMsgStore(t *testing.T, s Store) {
 	}
 }
 
+func checkMsgExt(t *testing.T, ms MsgStore, seq uint64, expected *spb.MsgExt) {
+	ext := ms.LookupExt(seq)
+	if expected == nil {
+		if ext != nil {
+			stackFatalf(t, "Expected no attributes for message %v, got %v", seq, ext)
+		}
+		return
+	}
+	if ext == nil {
+		stackFatalf(t, "Expected attributes for message %v, got none", seq)
+	}
+	if len(ext.Headers) != len(expected.Headers) {
+		stackFatalf(t, "Expected %v headers, got %v", len(expected.Headers), len(ext.Headers))
+	}
+	for i, h := range expected.Headers {
+		if ext.Headers[i].Key != h.Key || ext.Headers[i].Value != h.Value {
+			stackFatalf(t, "Expected header %v to be %v, got %v", i, h, ext.Headers[i])
+		}
+	}
+}
+
+func testMsgExt(t *testing.T, s Store) {
+	ext := &spb.MsgExt{
+		Headers: []*spb.MsgHeader{
+			&spb.MsgHeader{Key: "content-type", Value: "application/json"},
+			&spb.MsgHeader{Key: "trace-id", Value: "abc"},
+		},
+	}
+	m1 := storeMsgWithExt(t, s, "foo", []byte("{}"), ext)
+	m2 := storeMsg(t, s, "foo", []byte("hello"))
+	// An empty extension should not be kept.
+	m3 := storeMsgWithExt(t, s, "foo", []byte("hello"), &spb.MsgExt{})
+
+	ms := s.LookupChannel("foo").Msgs
+	checkMsgExt(t, ms, m1.Sequence, ext)
+	checkMsgExt(t, ms, m2.Sequence, nil)
+	checkMsgExt(t, ms, m3.Sequence, nil)
+	// Unknown sequence
+	checkMsgExt(t, ms, m3.Sequence+1, nil)
+
+	// Attributes are not accounted in the store's byte size.
+	_, bytes, err := ms.State()
+	if err != nil {
+		t.Fatalf("Unexpected error getting state: %v", err)
+	}
+	if expected := uint64(len("{}") + 2*len("hello")); bytes != expected {
+		t.Fatalf("Unexpected byte size: %v vs %v", bytes, expected)
+	}
+
+	// Attributes should be removed when the message is dropped due to limits.
+	limits := testDefaultChannelLimits
+	limits.MaxNumMsgs = 10
+	s.SetChannelLimits(limits)
+	storeMsgWithExt(t, s, "bar", []byte("m1"), ext)
+	var m *pb.MsgProto
+	for i := 0; i < limits.MaxNumMsgs; i++ {
+		m = storeMsg(t, s, "bar", []byte("m"))
+	}
+	bms := s.LookupChannel("bar").Msgs
+	if first := bms.FirstSequence(); first != 2 {
+		t.Fatalf("Expected first message to be 2, got %v", first)
+	}
+	checkMsgExt(t, bms, 1, nil)
+	checkMsgExt(t, bms, m.Sequence, nil)
+}
+
+func testStoreMsg(t *testing.T, s Store) {
+	cs, _, err := s.CreateChannel("foo", nil)
+	if err != nil {
+		t.Fatalf("Unexpected error creating channel: %v", err)
+	}
+	ext := &spb.MsgExt{Headers: []*spb.MsgHeader{&spb.MsgHeader{Key: "trace-id", Value: "abc"}}}
+	m1 := &pb.MsgProto{Sequence: 10, Subject: "foo", Data: []byte("hello"), Timestamp: 1000}
+	if err := cs.Msgs.StoreMsg(m1, ext); err != nil {
+		t.Fatalf("Unexpected error on store: %v", err)
+	}
+	// The sequence must be after the last one, gaps are allowed.
+	m2 := &pb.MsgProto{Sequence: 10, Subject: "foo", Data: []byte("world"), Timestamp: 2000}
+	if err := cs.Msgs.StoreMsg(m2, nil); err != ErrSeqOutOfOrder {
+		t.Fatalf("Expected error %v, got %v", ErrSeqOutOfOrder, err)
+	}
+	m2.Sequence = 12
+	if err := cs.Msgs.StoreMsg(m2, nil); err != nil {
+		t.Fatalf("Unexpected error on store: %v", err)
+	}
+	if first, last := cs.Msgs.FirstAndLastSequence(); first != 10 || last != 12 {
+		t.Fatalf("Unexpected first and last sequences: %v, %v", first, last)
+	}
+	if m := msgStoreLookup(t, cs.Msgs, 10); m == nil || m.Timestamp != 1000 || string(m.Data) != "hello" {
+		t.Fatalf("Unexpected message: %v", m)
+	}
+	checkMsgExt(t, cs.Msgs, 10, ext)
+	if m := msgStoreLookup(t, cs.Msgs, 11); m != nil {
+		t.Fatalf("Unexpected message: %v", m)
+	}
+	// Messages stored next are assigned the following sequence.
+	if m := storeMsg(t, s, "foo", []byte("next")); m.Sequence != 13 {
+		t.Fatalf("Expected sequence 13, got %v", m.Sequence)
+	}
+	if count, _, _ := cs.Msgs.State(); count != 3 {
+		t.Fatalf("Expected 3 messages, got %v", count)
+	}
+}
+
+func testStoreBatch(t *testing.T, s Store) {
+	storeMsg(t, s, "foo", []byte("first"))
+	ms := s.LookupChannel("foo").Msgs
+	ext := &spb.MsgExt{Headers: []*spb.MsgHeader{&spb.MsgHeader{Key: "trace-id", Value: "abc"}}}
+	stored, err := ms.StoreBatch([]*BatchMsg{
+		{Data: []byte("m1")},
+		{Data: []byte("m2"), Ext: ext},
+		{Reply: "inbox", Data: []byte("m3")},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error on store: %v", err)
+	}
+	if len(stored) != 3 {
+		t.Fatalf("Expected 3 messages, got %v", len(stored))
+	}
+	for i, m := range stored {
+		if m.Sequence != uint64(i+2) || string(m.Data) != fmt.Sprintf("m%d", i+1) || m.Timestamp != stored[0].Timestamp {
+			t.Fatalf("Unexpected message: %v", m)
+		}
+		if lm := msgStoreLookup(t, ms, m.Sequence); lm == nil || string(lm.Data) != string(m.Data) || lm.Timestamp != m.Timestamp {
+			t.Fatalf("Expected message %v, got %v", m, lm)
+		}
+	}
+	if stored[2].Reply != "inbox" {
+		t.Fatalf("Unexpected reply: %v", stored[2].Reply)
+	}
+	checkMsgExt(t, ms, 2, nil)
+	checkMsgExt(t, ms, 3, ext)
+	checkMsgExt(t, ms, 4, nil)
+	// Messages stored next are assigned the following sequence.
+	if m := storeMsg(t, s, "foo", []byte("next")); m.Sequence != 5 {
+		t.Fatalf("Expected sequence 5, got %v", m.Sequence)
+	}
+}
+
+func testStoreTx(t *testing.T, s Store) {
+	storeMsg(t, s, "foo", []byte("first"))
+	if _, _, err := s.CreateChannel("bar", nil); err != nil {
+		t.Fatalf("Unexpected error creating channel: %v", err)
+	}
+	tx, err := BeginTx(s)
+	if err != nil {
+		t.Fatalf("Unexpected error starting transaction: %v", err)
+	}
+	if err := tx.Store("baz", &BatchMsg{Data: []byte("m")}); err == nil {
+		t.Fatal("Expected error storing on unknown channel")
+	}
+	ext := &spb.MsgExt{Headers: []*spb.MsgHeader{&spb.MsgHeader{Key: "trace-id", Value: "abc"}}}
+	for _, tm := range []struct {
+		channel string
+		msg     *BatchMsg
+	}{
+		{"foo", &BatchMsg{Data: []byte("m1")}},
+		{"bar", &BatchMsg{Data: []byte("m2"), Ext: ext}},
+		{"foo", &BatchMsg{Data: []byte("m3")}},
+	} {
+		if err := tx.Store(tm.channel, tm.msg); err != nil {
+			t.Fatalf("Unexpected error on store: %v", err)
+		}
+	}
+	// Nothing is visible before the commit.
+	if last := s.LookupChannel("foo").Msgs.LastSequence(); last != 1 {
+		t.Fatalf("Expected last sequence 1, got %v", last)
+	}
+	stored, err := tx.Commit()
+	if err != nil {
+		t.Fatalf("Unexpected error on commit: %v", err)
+	}
+	expected := []struct {
+		channel string
+		seq     uint64
+	}{{"foo", 2}, {"bar", 1}, {"foo", 3}}
+	if len(stored) != len(expected) {
+		t.Fatalf("Expected %v messages, got %v", len(expected), len(stored))
+	}
+	for i, m := range stored {
+		if m.Subject != expected[i].channel || m.Sequence != expected[i].seq || string(m.Data) != fmt.Sprintf("m%d", i+1) {
+			t.Fatalf("Unexpected message: %v", m)
+		}
+		ms := s.LookupChannel(m.Subject).Msgs
+		if lm := msgStoreLookup(t, ms, m.Sequence); lm == nil || string(lm.Data) != string(m.Data) {
+			t.Fatalf("Expected message %v, got %v", m, lm)
+		}
+	}
+	checkMsgExt(t, s.LookupChannel("bar").Msgs, 1, ext)
+
+	// A rolled back transaction stores nothing.
+	tx, err = BeginTx(s)
+	if err != nil {
+		t.Fatalf("Unexpected error starting transaction: %v", err)
+	}
+	if err := tx.Store("bar", &BatchMsg{Data: []byte("discarded")}); err != nil {
+		t.Fatalf("Unexpected error on store: %v", err)
+	}
+	tx.Rollback()
+	if m := storeMsg(t, s, "bar", []byte("next")); m.Sequence != 2 {
+		t.Fatalf("Expected sequence 2, got %v", m.Sequence)
+	}
+}
+
+func testMsgExpiration(t *testing.T, s Store) {
+	now := time.Now()
+	expired := &spb.MsgExt{Expiration: now.Add(-time.Second).UnixNano()}
+	notExpired := &spb.MsgExt{Expiration: now.Add(time.Hour).UnixNano()}
+
+	// An expired message is kept if this is the only one.
+	storeMsgWithExt(t, s, "foo", []byte("m1"), expired)
+	ms := s.LookupChannel("foo").Msgs
+	if first, last := ms.FirstAndLastSequence(); first != 1 || last != 1 {
+		t.Fatalf("Unexpected sequences: %v,%v", first, last)
+	}
+	// Storing a new message should remove the expired one.
+	storeMsgWithExt(t, s, "foo", []byte("m2"), notExpired)
+	storeMsgWithExt(t, s, "foo", []byte("m3"), expired)
+	if first, last := ms.FirstAndLastSequence(); first != 2 || last != 3 {
+		t.Fatalf("Unexpected sequences: %v,%v", first, last)
+	}
+	if msgStoreLookup(t, ms, 1) != nil || ms.LookupExt(1) != nil {
+		t.Fatal("Expired message should have been removed")
+	}
+	// Only the head of the log is checked, the message 3 is still there
+	// since it is after message 2 which is not expired, but it can't be
+	// looked up.
+	storeMsg(t, s, "foo", []byte("m4"))
+	if first, last := ms.FirstAndLastSequence(); first != 2 || last != 4 {
+		t.Fatalf("Unexpected sequences: %v,%v", first, last)
+	}
+	count, bytes, err := ms.State()
+	if err != nil {
+		t.Fatalf("Unexpected error getting state: %v", err)
+	}
+	if count != 3 || bytes != 6 {
+		t.Fatalf("Unexpected counts: %v, %v", count, bytes)
+	}
+	if msgStoreLookup(t, ms, 3) != nil {
+		t.Fatal("Expired message should not be returned")
+	}
+	msgs, err := ms.LookupRange(1, 4, 0)
+	if err != nil {
+		t.Fatalf("Unexpected error on lookup: %v", err)
+	}
+	if len(msgs) != 2 || msgs[0].Sequence != 2 || msgs[1].Sequence != 4 {
+		t.Fatalf("Unexpected messages: %v", msgs)
+	}
+
+	// Messages are removed once the first one expires, even if no message
+	// is stored in the channel.
+	expiring := &spb.MsgExt{Expiration: time.Now().Add(50 * time.Millisecond).UnixNano()}
+	storeMsgWithExt(t, s, "bar", []byte("b1"), expiring)
+	storeMsgWithExt(t, s, "bar", []byte("b2"), expiring)
+	storeMsg(t, s, "bar", []byte("b3"))
+	bar := s.LookupChannel("bar").Msgs
+	deadline := time.Now().Add(2 * time.Second)
+	for bar.FirstSequence() != 3 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if first, last := bar.FirstAndLastSequence(); first != 3 || last != 3 {
+		t.Fatalf("Unexpected sequences: %v,%v", first, last)
+	}
+	if count, bytes, _ := bar.State(); count != 1 || bytes != 2 {
+		t.Fatalf("Unexpected counts: %v, %v", count, bytes)
+	}
+}
+
+// testStamper is a deterministic MsgStamper, skipping `gap` sequences.
+type testStamper struct {
+	gap       uint64
+	timestamp int64
+}
+
+func (st *testStamper) Stamp(channel string, lastSeq uint64, lastTimestamp int64) (uint64, int64) {
+	st.timestamp += 10
+	return lastSeq + 1 + st.gap, st.timestamp
+}
+
+func testMsgStamper(t *testing.T, s Store) {
+	stamper := &testStamper{gap: 1, timestamp: 1000}
+	s.SetMsgStamper(stamper)
+	if m := storeMsg(t, s, "foo", []byte("msg")); m.Sequence != 2 || m.Timestamp != 1010 {
+		t.Fatalf("Unexpected message: %v", m)
+	}
+	msgs := s.LookupChannel("foo").Msgs
+	stored, err := msgs.StoreBatch([]*BatchMsg{{Data: []byte("m1")}, {Data: []byte("m2")}})
+	if err != nil {
+		t.Fatalf("Unexpected error on store: %v", err)
+	}
+	if stored[0].Sequence != 4 || stored[1].Sequence != 5 || stored[0].Timestamp != 1020 || stored[1].Timestamp != 1020 {
+		t.Fatalf("Unexpected messages: %v", stored)
+	}
+	if m := msgStoreLookup(t, msgs, 5); m == nil || m.Timestamp != 1020 {
+		t.Fatalf("Unexpected message: %v", m)
+	}
+
+	// The monotonic stamper does not go back.
+	s.SetMsgStamper(&MonotonicStamper{Now: func() time.Time { return time.Unix(0, 500) }})
+	if m := storeMsg(t, s, "foo", []byte("msg")); m.Sequence != 6 || m.Timestamp != 1021 {
+		t.Fatalf("Unexpected message: %v", m)
+	}
+	s.SetMsgStamper(&MonotonicStamper{Now: func() time.Time { return time.Unix(0, 2000) }})
+	if m := storeMsg(t, s, "foo", []byte("msg")); m.Timestamp != 2000 {
+		t.Fatalf("Unexpected message: %v", m)
+	}
+
+	// A sequence that is not after the last one is rejected.
+	s.SetMsgStamper(stamperFunc(func(lastSeq uint64) uint64 { return lastSeq }))
+	if _, err := msgs.Store("", []byte("msg"), nil); err != ErrSeqOutOfOrder {
+		t.Fatalf("Expected error %v, got %v", ErrSeqOutOfOrder, err)
+	}
+
+	// Back to the system time.
+	s.SetMsgStamper(nil)
+	before := time.Now().UnixNano()
+	if m := storeMsg(t, s, "foo", []byte("msg")); m.Sequence != 8 || m.Timestamp < before {
+		t.Fatalf("Unexpected message: %v", m)
+	}
+}
+
+// stamperFunc is a MsgStamper returning the sequence of a function.
+type stamperFunc func(lastSeq uint64) uint64
+
+func (f stamperFunc) Stamp(channel string, lastSeq uint64, lastTimestamp int64) (uint64, int64) {
+	return f(lastSeq), lastTimestamp
+}
+
+func testPurgeBefore(t *testing.T, s Store) {
+	for i := 0; i < 5; i++ {
+		storeMsg(t, s, "foo", []byte("msg"))
+	}
+	ms := s.LookupChannel("foo").Msgs
+	if n, err := PurgeBefore(ms, 3); err != nil || n != 2 {
+		t.Fatalf("Unexpected result: %v, %v", n, err)
+	}
+	if first, last := ms.FirstAndLastSequence(); first != 3 || last != 5 {
+		t.Fatalf("Unexpected sequences: %v,%v", first, last)
+	}
+	if msgStoreLookup(t, ms, 2) != nil {
+		t.Fatal("Message should have been removed")
+	}
+	// Nothing to remove.
+	if n, err := PurgeBefore(ms, 2); err != nil || n != 0 {
+		t.Fatalf("Unexpected result: %v, %v", n, err)
+	}
+	// The last message is kept.
+	if n, err := PurgeBefore(ms, 10); err != nil || n != 2 {
+		t.Fatalf("Unexpected result: %v, %v", n, err)
+	}
+	if first, last := ms.FirstAndLastSequence(); first != 5 || last != 5 {
+		t.Fatalf("Unexpected sequences: %v,%v", first, last)
+	}
+	if count, bytes, _ := ms.State(); count != 1 || bytes != 3 {
+		t.Fatalf("Unexpected counts: %v, %v", count, bytes)
+	}
+	storeMsg(t, s, "foo", []byte("msg"))
+	if first, last := ms.FirstAndLastSequence(); first != 5 || last != 6 {
+		t.Fatalf("Unexpected sequences: %v,%v", first, last)
+	}
+}
+
+func testKeyCompaction(t *testing.T, s Store) {
+	limits := testDefaultChannelLimits
+	limits.CompactedChannels = []string{"prices.>"}
+	s.SetChannelLimits(limits)
+
+	k1 := &spb.MsgExt{Key: "k1"}
+	k2 := &spb.MsgExt{Key: "k2"}
+
+	m1 := storeMsgWithExt(t, s, "prices.a", []byte("m1"), k1)
+	m2 := storeMsgWithExt(t, s, "prices.a", []byte("m2"), k2)
+	m3 := storeMsgWithExt(t, s, "prices.a", []byte("m3"), k1)
+	m4 := storeMsg(t, s, "prices.a", []byte("m4"))
+	m5 := storeMsgWithExt(t, s, "prices.a", []byte("m5"), k2)
+
+	ms := s.LookupChannel("prices.a").Msgs
+	for _, m := range []*pb.MsgProto{m1, m2} {
+		if msgStoreLookup(t, ms, m.Sequence) != nil || ms.LookupExt(m.Sequence) != nil {
+			t.Fatalf("Message %v should have been removed", m.Sequence)
+		}
+	}
+	for _, m := range []*pb.MsgProto{m3, m4, m5} {
+		if msgStoreLookup(t, ms, m.Sequence) == nil {
+			t.Fatalf("Message %v should still be present", m.Sequence)
+		}
+	}
+	if first, last := ms.FirstAndLastSequence(); first != m3.Sequence || last != m5.Sequence {
+		t.Fatalf("Unexpected sequences: %v,%v", first, last)
+	}
+	if count, bytes, _ := ms.State(); count != 3 || bytes != 6 {
+		t.Fatalf("Unexpected counts: %v, %v", count, bytes)
+	}
+	// A new version of k1 removes the first message.
+	m6 := storeMsgWithExt(t, s, "prices.a", []byte("m6"), k1)
+	if first, last := ms.FirstAndLastSequence(); first != m4.Sequence || last != m6.Sequence {
+		t.Fatalf("Unexpected sequences: %v,%v", first, last)
+	}
+	// Sequences have gaps, the lookup by timestamp should still work.
+	if seq := ms.GetSequenceFromTimestamp(m4.Timestamp + 1); seq != m5.Sequence {
+		t.Fatalf("Expected sequence %v, got %v", m5.Sequence, seq)
+	}
+	if seq := ms.GetSequenceFromTimestamp(m6.Timestamp + 1); seq != m6.Sequence+1 {
+		t.Fatalf("Expected sequence %v, got %v", m6.Sequence+1, seq)
+	}
+	// The latest message of each key can be looked up.
+	for key, expected := range map[string]*pb.MsgProto{"k1": m6, "k2": m5, "k3": nil} {
+		m, err := ms.LastMsgForKey(key)
+		if err != nil || (expected == nil && m != nil) ||
+			(expected != nil && (m == nil || m.Sequence != expected.Sequence)) {
+			t.Fatalf("Unexpected last message for %s: %v (err=%v)", key, m, err)
+		}
+	}
+
+	// Channels not configured as compacted keep all messages.
+	storeMsgWithExt(t, s, "foo", []byte("m1"), k1)
+	storeMsgWithExt(t, s, "foo", []byte("m2"), k1)
+	if count, _, _ := s.LookupChannel("foo").Msgs.State(); count != 2 {
+		t.Fatalf("Expected 2 messages, got %v", count)
+	}
+	if m, err := s.LookupChannel("foo").Msgs.LastMsgForKey("k1"); m != nil || err != nil {
+		t.Fatalf("Expected no message, got %v (err=%v)", m, err)
+	}
+}
+
 func testMsgsState(t *testing.T, s Store) {
 	payload := []byte("hello")
 	lenPayload := uint64(len(payload))
@@ -306,6 +776,38 @@ func testMsgsState(t *testing.T, s Store) {
 	}
 }
 
+func testGetChannels(t *testing.T, s Store) {
+	infos, err := s.GetChannels()
+	if err != nil || len(infos) != 0 {
+		t.Fatalf("Expected no channel, got %v (err=%v)", infos, err)
+	}
+	start := time.Now()
+	storeMsg(t, s, "foo", []byte("hello"))
+	storeMsg(t, s, "foo", []byte("world"))
+	if _, _, err := s.CreateChannel("bar", nil); err != nil {
+		t.Fatalf("Unexpected error creating channel: %v", err)
+	}
+
+	infos, err = s.GetChannels()
+	if err != nil {
+		t.Fatalf("Unexpected error getting channels: %v", err)
+	}
+	if len(infos) != 2 || infos[0].Name != "bar" || infos[1].Name != "foo" {
+		t.Fatalf("Unexpected channels: %v", infos)
+	}
+	for _, info := range infos {
+		if info.Created.Before(start.Add(-time.Second)) || info.Created.After(time.Now()) {
+			t.Fatalf("Unexpected creation time for %s: %v", info.Name, info.Created)
+		}
+	}
+	if bar := infos[0]; bar.Msgs != 0 || bar.Bytes != 0 || bar.FirstSeq != 0 || bar.LastSeq != 0 {
+		t.Fatalf("Unexpected info for bar: %+v", bar)
+	}
+	if foo := infos[1]; foo.Msgs != 2 || foo.Bytes != 10 || foo.FirstSeq != 1 || foo.LastSeq != 2 {
+		t.Fatalf("Unexpected info for foo: %+v", foo)
+	}
+}
+
 func testMaxMsgs(t *testing.T, s Store) {
 	payload := []byte("hello")
 
@@ -337,13 +839,13 @@ func testMaxMsgs(t *testing.T, s Store) {
 	}
 
 	// Check that older messages are no longer avail.
-	if cs.Msgs.Lookup(1) != nil || cs.Msgs.Lookup(uint64(firstSeqAfterLimitReached-1)) != nil {
+	if msgStoreLookup(t, cs.Msgs, 1) != nil || msgStoreLookup(t, cs.Msgs, uint64(firstSeqAfterLimitReached-1)) != nil {
 		t.Fatal("Older messages still available")
 	}
 
-	firstMsg := cs.Msgs.FirstMsg()
+	firstMsg := msgStoreFirstMsg(t, cs.Msgs)
 	firstSeq := cs.Msgs.FirstSequence()
-	lastMsg := cs.Msgs.LastMsg()
+	lastMsg := msgStoreLastMsg(t, cs.Msgs)
 	lastSeq := cs.Msgs.LastSequence()
 
 	if firstMsg == nil || firstMsg.Sequence != firstSeq || firstSeq != firstSeqAfterLimitReached {
@@ -365,6 +867,69 @@ func testMaxMsgs(t *testing.T, s Store) {
 	}
 }
 
+func testMemoryBudget(t *testing.T, s Store) {
+	budget := s.MemoryBudget()
+	if used := budget.Used(); used != 0 {
+		t.Fatalf("Expected no memory used, got %v", used)
+	}
+	ext := &spb.MsgExt{Headers: []*spb.MsgHeader{&spb.MsgHeader{Key: "trace-id", Value: "abc"}}}
+	expected := msgMemSize(storeMsgWithExt(t, s, "bar", []byte("hello"), ext), ext)
+	for i := 0; i < 5; i++ {
+		expected += msgMemSize(storeMsg(t, s, "foo", []byte("hello")), nil)
+	}
+	if used := budget.Used(); used != expected {
+		t.Fatalf("Expected memory used to be %v, got %v", expected, used)
+	}
+
+	// Messages removed due to the limits are no longer accounted.
+	limits := testDefaultChannelLimits
+	limits.MaxNumMsgs = 1
+	s.SetChannelLimits(limits)
+	storeMsgWithExt(t, s, "baz", []byte("hello"), ext)
+	expected += msgMemSize(storeMsg(t, s, "baz", []byte("hello")), nil)
+	if used := budget.Used(); used != expected {
+		t.Fatalf("Expected memory used to be %v, got %v", expected, used)
+	}
+	s.SetChannelLimits(testDefaultChannelLimits)
+
+	// Without trimming, messages are kept when the budget is exceeded.
+	budget.SetLimit(expected, false)
+	if budget.Limit() != expected || budget.Exceeded() {
+		t.Fatalf("Budget should not be exceeded: used=%v limit=%v", budget.Used(), budget.Limit())
+	}
+	storeMsg(t, s, "foo", []byte("hello"))
+	if !budget.Exceeded() {
+		t.Fatalf("Budget should be exceeded: used=%v limit=%v", budget.Used(), budget.Limit())
+	}
+	if count, _, _ := s.MsgsState("foo"); count != 6 {
+		t.Fatalf("Expected 6 messages, got %v", count)
+	}
+
+	// With trimming, the oldest messages of the channel are removed until
+	// the memory used is back within the budget.
+	budget.SetLimit(expected, true)
+	m := storeMsg(t, s, "foo", []byte("hello"))
+	if budget.Exceeded() {
+		t.Fatalf("Budget should not be exceeded: used=%v limit=%v", budget.Used(), budget.Limit())
+	}
+	cs := s.LookupChannel("foo")
+	if count, _, _ := cs.Msgs.State(); count != 5 {
+		t.Fatalf("Expected 5 messages, got %v", count)
+	}
+	if first := cs.Msgs.FirstSequence(); first != 3 {
+		t.Fatalf("Expected first message to be 3, got %v", first)
+	}
+	if last := cs.Msgs.LastSequence(); last != m.Sequence {
+		t.Fatalf("Expected last message to be %v, got %v", m.Sequence, last)
+	}
+	// The last message of a channel is always kept.
+	budget.SetLimit(1, true)
+	storeMsg(t, s, "bar", []byte("hello"))
+	if count, _, _ := s.MsgsState("bar"); count != 1 {
+		t.Fatalf("Expected 1 message, got %v", count)
+	}
+}
+
 func testMaxChannels(t *testing.T, s Store, maxChannels int) {
 	var err error
 	numCh := 0
@@ -405,6 +970,67 @@ func testMaxSubs(t *testing.T, s Store, maxSubs int) {
 	}
 }
 
+func testTenantLimits(t *testing.T, s Store) {
+	limits := testDefaultChannelLimits
+	limits.MaxChannels = 2
+	limits.MaxNumMsgs = 10
+	limits.MaxSubs = 10
+	limits.Tenants = []TenantLimits{
+		{Name: "acme", MaxChannels: 3, MaxNumMsgs: 2, MaxSubs: 1},
+		{Name: "globex"},
+	}
+	limits.PerChannel = []PerChannelLimits{
+		{Name: "acme.foo1", MaxNumMsgs: 1},
+		{Name: "foo1", MaxSubs: 2},
+	}
+	s.SetChannelLimits(limits)
+
+	// Each tenant, and the channels outside of any tenant, have their own
+	// channels count.
+	for _, c := range []struct {
+		prefix string
+		max    int
+	}{{"acme.", 3}, {"", 2}, {"globex.", 2}} {
+		for i := 0; i < c.max; i++ {
+			if _, _, err := s.CreateChannel(fmt.Sprintf("%sfoo%d", c.prefix, i), nil); err != nil {
+				t.Fatalf("Unexpected error creating channel: %v", err)
+			}
+		}
+		if _, _, err := s.CreateChannel(fmt.Sprintf("%sfoo%d", c.prefix, c.max), nil); err != ErrTooManyChannels {
+			t.Fatalf("Error should have been ErrTooManyChannels, got %v", err)
+		}
+	}
+
+	// Tenant limits override the store's ones, which apply otherwise, and
+	// the limits of a channel override both.
+	for _, c := range []struct {
+		channel string
+		msgs    int
+		subs    int
+	}{{"acme.foo0", 2, 1}, {"foo0", 3, 3}, {"globex.foo0", 3, 3}, {"acme.foo1", 1, 1}, {"foo1", 3, 2}} {
+		for i := 0; i < 3; i++ {
+			storeMsg(t, s, c.channel, []byte("hello"))
+		}
+		if count, _, _ := s.MsgsState(c.channel); count != c.msgs {
+			t.Fatalf("Expected %v messages on %s, got %v", c.msgs, c.channel, count)
+		}
+		ss := s.LookupChannel(c.channel).Subs
+		numSubs := 0
+		for i := 0; i < 3; i++ {
+			if err := ss.CreateSub(&spb.SubState{}); err != nil {
+				if err != ErrTooManySubs {
+					t.Fatalf("Error should have been ErrTooManySubs, got %v", err)
+				}
+				break
+			}
+			numSubs++
+		}
+		if numSubs != c.subs {
+			t.Fatalf("Expected %v subscriptions on %s, got %v", c.subs, c.channel, numSubs)
+		}
+	}
+}
+
 func testBasicSubStore(t *testing.T, s Store) {
 	cs, _, err := s.CreateChannel("foo", nil)
 	if err != nil {
@@ -445,6 +1071,57 @@ func testBasicSubStore(t *testing.T, s Store) {
 	}
 }
 
+// testBatchAcks acknowledges pending messages of a subscription on "foo"
+// with the range and batch APIs, and returns the ID of the subscription.
+// The pending messages left are 1, 6, 8 and 10.
+func testBatchAcks(t *testing.T, s Store) uint64 {
+	for i := 0; i < 10; i++ {
+		storeMsg(t, s, "foo", []byte("hello"))
+	}
+	subID := storeSub(t, s, "foo")
+	storeSubPending(t, s, "foo", subID, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10)
+
+	ss := s.LookupChannel("foo").Subs
+	if err := ss.AckSeqPendingRange(subID, 2, 5); err != nil {
+		t.Fatalf("Unexpected error on AckSeqPendingRange: %v", err)
+	}
+	if err := ss.AckSeqPendingBatch(subID, 7, 9); err != nil {
+		t.Fatalf("Unexpected error on AckSeqPendingBatch: %v", err)
+	}
+	// Empty ranges and batches, or unknown subscriptions, are not errors.
+	if err := ss.AckSeqPendingRange(subID, 5, 4); err != nil {
+		t.Fatalf("Unexpected error on AckSeqPendingRange: %v", err)
+	}
+	if err := ss.AckSeqPendingBatch(subID); err != nil {
+		t.Fatalf("Unexpected error on AckSeqPendingBatch: %v", err)
+	}
+	if err := ss.AckSeqPendingRange(subID+1, 1, 10); err != nil {
+		t.Fatalf("Unexpected error on AckSeqPendingRange: %v", err)
+	}
+	return subID
+}
+
+// checkBatchAcksRecovered checks the pending messages recovered after
+// testBatchAcks.
+func checkBatchAcksRecovered(t *testing.T, state *RecoveredState, subID uint64) {
+	if state == nil {
+		stackFatalf(t, "Expected state to be recovered")
+	}
+	subs := getRecoveredSubs(t, state)["foo"]
+	if len(subs) != 1 || subs[0].Sub.ID != subID {
+		stackFatalf(t, "Unexpected recovered subscriptions: %v", subs)
+	}
+	pending := subs[0].Pending
+	if len(pending) != 4 {
+		stackFatalf(t, "Expected 4 pending messages, got %v", len(pending))
+	}
+	for _, seq := range []uint64{1, 6, 8, 10} {
+		if pending[seq] == nil {
+			stackFatalf(t, "Message %v should still be pending: %v", seq, pending)
+		}
+	}
+}
+
 func testGetSeqFromStartTime(t *testing.T, s Store) {
 	count := 100
 	msgs := make([]*pb.MsgProto, 0, count)
@@ -466,6 +1143,45 @@ func testGetSeqFromStartTime(t *testing.T, s Store) {
 	}
 }
 
+func testGetSeqFromTimestampIndex(t *testing.T, s Store) {
+	limits := testDefaultChannelLimits
+	limits.MaxNumMsgs = 600
+	s.SetChannelLimits(limits)
+
+	cs, _, err := s.CreateChannel("foo", nil)
+	if err != nil {
+		t.Fatalf("Unexpected error creating channel: %v", err)
+	}
+	// Store enough messages to span several entries of the index, with
+	// gaps in the sequences, and more than the limit.
+	count := 5 * timeIndexInterval
+	for seq := uint64(1); seq <= uint64(count); seq++ {
+		if seq%7 == 0 {
+			continue
+		}
+		m := &pb.MsgProto{Sequence: seq, Subject: "foo", Data: []byte("hello"), Timestamp: int64(seq) * 10}
+		if err := cs.Msgs.StoreMsg(m, nil); err != nil {
+			t.Fatalf("Unexpected error on store: %v", err)
+		}
+	}
+	first, last := cs.Msgs.FirstAndLastSequence()
+	if last != uint64(count) || first <= 1 {
+		t.Fatalf("Unexpected first and last sequences: %v, %v", first, last)
+	}
+	for ts := int64(0); ts <= int64(count+1)*10; ts += 3 {
+		// The expected sequence follows the last message before `ts`.
+		expected := first
+		for seq := first; seq <= last; seq++ {
+			if seq%7 != 0 && int64(seq)*10 < ts {
+				expected = seq + 1
+			}
+		}
+		if seq := cs.Msgs.GetSequenceFromTimestamp(ts); seq != expected {
+			t.Fatalf("Timestamp %v: expected sequence %v, got %v", ts, expected, seq)
+		}
+	}
+}
+
 func testClientAPIs(t *testing.T, s Store) {
 	// Delete client that does not exist
 	s.DeleteClient("client1")
@@ -504,6 +1220,18 @@ func testClientAPIs(t *testing.T, s Store) {
 		t.Fatalf("Expected delete to return %v, got %v", sc, dsc)
 	}
 
+	// Record that client3 is unreachable
+	if err := s.SetClientUnreachable("client3", 123); err != nil {
+		t.Fatalf("Unexpected error setting client unreachable: %v", err)
+	}
+	if err := s.SetClientUnreachable("client4", 123); err == nil {
+		t.Fatal("Expected error setting unknown client unreachable")
+	}
+	// And its last contact
+	if err := s.SetClientLastContact("client3", 456); err != nil {
+		t.Fatalf("Unexpected error setting client last contact: %v", err)
+	}
+
 	// Try to retrieve client3
 	if gc := s.GetClient("client3"); gc != sc3 {
 		t.Fatalf("Expected %v, got %v", sc3, gc)
@@ -525,6 +1253,87 @@ func testClientAPIs(t *testing.T, s Store) {
 		if cID == "client3" && sc.UserData != userData {
 			t.Fatalf("Expected user data to be %v, got %v", userData, sc.UserData)
 		}
+		if (cID == "client3") != (sc.UnreachableSince == 123) {
+			t.Fatalf("Unexpected unreachable time of %v: %v", cID, sc.UnreachableSince)
+		}
+		if (cID == "client3") != (sc.LastContact == 456) {
+			t.Fatalf("Unexpected last contact of %v: %v", cID, sc.LastContact)
+		}
+	}
+}
+
+func testUpdateClient(t *testing.T, s Store) {
+	if _, err := s.UpdateClient("me", "hbInbox", nil); err == nil {
+		t.Fatal("Expected error updating unknown client")
+	}
+	if _, _, err := s.AddClient("me", "hbInbox", "user data"); err != nil {
+		t.Fatalf("Unexpected error adding client: %v", err)
+	}
+	sc, err := s.UpdateClient("me", "newInbox", []byte("metadata"))
+	if err != nil {
+		t.Fatalf("Unexpected error updating client: %v", err)
+	}
+	if sc.HbInbox != "newInbox" || string(sc.Metadata) != "metadata" || sc.UserData != "user data" {
+		t.Fatalf("Unexpected updated client: %v", sc)
+	}
+	if sc := s.GetClient("me"); sc.HbInbox != "newInbox" || string(sc.Metadata) != "metadata" {
+		t.Fatalf("Unexpected client: %v", sc)
+	}
+}
+
+// checkUpdateClientRecovered checks the client recovered after
+// testUpdateClient.
+func checkUpdateClientRecovered(t *testing.T, state *RecoveredState) {
+	if state == nil || len(state.Clients) != 1 {
+		stackFatalf(t, "Unexpected recovered state: %v", state)
+	}
+	if c := state.Clients[0]; c.ID != "me" || c.HbInbox != "newInbox" || string(c.Metadata) != "metadata" {
+		stackFatalf(t, "Unexpected recovered client: %v", c)
+	}
+}
+
+func testRecoverSubs(t *testing.T, s Store) {
+	for _, channel := range []string{"foo", "bar"} {
+		m1 := storeMsg(t, s, channel, []byte("msg1"))
+		m2 := storeMsg(t, s, channel, []byte("msg2"))
+		subID := storeSub(t, s, channel)
+		storeSubPending(t, s, channel, subID, m1.Sequence, m2.Sequence)
+		storeSub(t, s, channel)
+	}
+}
+
+// checkRecoverSubs checks the subscriptions handed out by Recover
+// after testRecoverSubs.
+func checkRecoverSubs(t *testing.T, state *RecoveredState) {
+	if state == nil {
+		stackFatalf(t, "Expected state to be recovered")
+	}
+	// An error returned by the callback stops the recovery.
+	count := 0
+	errStop := fmt.Errorf("stop")
+	if err := state.Recover(func(string, *RecoveredSubState) error {
+		count++
+		return errStop
+	}); err != errStop || count != 1 {
+		stackFatalf(t, "Expected recovery to stop after 1 sub, got count=%v err=%v", count, err)
+	}
+	subs := getRecoveredSubs(t, state)
+	for _, channel := range []string{"foo", "bar"} {
+		if len(subs[channel]) != 2 {
+			stackFatalf(t, "Expected 2 subs on %s, got %v", channel, len(subs[channel]))
+		}
+		pending := 0
+		for _, rss := range subs[channel] {
+			for seq, m := range rss.Pending {
+				if m == nil || m.Sequence != seq || m.Subject != channel {
+					stackFatalf(t, "Unexpected pending message for seq %v: %v", seq, m)
+				}
+			}
+			pending += len(rss.Pending)
+		}
+		if pending != 2 {
+			stackFatalf(t, "Expected 2 pending messages on %s, got %v", channel, pending)
+		}
 	}
 }
 
@@ -533,7 +1342,7 @@ func testFlush(t *testing.T, s Store) {
 	if err != nil {
 		t.Fatalf("Unexpected error creating channel: %v", err)
 	}
-	msg, err := cs.Msgs.Store("", []byte("hello"))
+	msg, err := cs.Msgs.Store("", []byte("hello"), nil)
 	if err != nil {
 		t.Fatalf("Unexpected error on store: %v", err)
 	}
@@ -550,4 +1359,10 @@ func testFlush(t *testing.T, s Store) {
 	if err := cs.Subs.Flush(); err != nil {
 		t.Fatalf("Unexpected error on flush: %v", err)
 	}
+	if err := cs.Flush(); err != nil {
+		t.Fatalf("Unexpected error on channel flush: %v", err)
+	}
+	if err := s.Flush(); err != nil {
+		t.Fatalf("Unexpected error on store flush: %v", err)
+	}
 }
@@ -0,0 +1,127 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package stores
+
+import (
+	"time"
+
+	"github.com/nats-io/go-nats-streaming/pb"
+	"github.com/nats-io/nats-streaming-server/spb"
+)
+
+// DeadlineMsgStore is implemented by the message stores that can abandon
+// an operation at a deadline, for instance because their backend has its
+// own timeouts. The operations return ErrDeadlineExceeded if they are not
+// completed before the deadline. A zero deadline means no deadline.
+type DeadlineMsgStore interface {
+	StoreBefore(deadline time.Time, reply string, data []byte, ext *spb.MsgExt) (*pb.MsgProto, error)
+	LookupBefore(deadline time.Time, seq uint64) (*pb.MsgProto, error)
+	FlushBefore(deadline time.Time) error
+}
+
+// DeadlineSubStore is implemented by the subscriptions stores that can
+// abandon an operation at a deadline (see DeadlineMsgStore).
+type DeadlineSubStore interface {
+	AddSeqPendingBefore(deadline time.Time, subid, seqno uint64) error
+	AckSeqPendingBefore(deadline time.Time, subid, seqno uint64) error
+	FlushBefore(deadline time.Time) error
+}
+
+// StoreBefore stores a message with MsgStore.Store, returning
+// ErrDeadlineExceeded if it is not stored before the deadline. If the
+// store does not implement DeadlineMsgStore, the operation is not
+// cancelled: the caller no longer waits for it, but the message may be
+// stored after the deadline.
+func StoreBefore(ms MsgStore, deadline time.Time, reply string, data []byte, ext *spb.MsgExt) (*pb.MsgProto, error) {
+	if dms, ok := ms.(DeadlineMsgStore); ok {
+		return dms.StoreBefore(deadline, reply, data, ext)
+	}
+	var m *pb.MsgProto
+	err := runBefore(deadline, func() (err error) {
+		m, err = ms.Store(reply, data, ext)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// LookupBefore looks up a message with MsgStore.Lookup, returning
+// ErrDeadlineExceeded if the lookup does not complete before the deadline.
+func LookupBefore(ms MsgStore, deadline time.Time, seq uint64) (*pb.MsgProto, error) {
+	if dms, ok := ms.(DeadlineMsgStore); ok {
+		return dms.LookupBefore(deadline, seq)
+	}
+	var m *pb.MsgProto
+	err := runBefore(deadline, func() (err error) {
+		m, err = ms.Lookup(seq)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// FlushMsgsBefore flushes the message store, returning ErrDeadlineExceeded
+// if the flush does not complete before the deadline.
+func FlushMsgsBefore(ms MsgStore, deadline time.Time) error {
+	if dms, ok := ms.(DeadlineMsgStore); ok {
+		return dms.FlushBefore(deadline)
+	}
+	return runBefore(deadline, ms.Flush)
+}
+
+// AddSeqPendingBefore calls SubStore.AddSeqPending, returning
+// ErrDeadlineExceeded if it does not complete before the deadline.
+func AddSeqPendingBefore(ss SubStore, deadline time.Time, subid, seqno uint64) error {
+	if dss, ok := ss.(DeadlineSubStore); ok {
+		return dss.AddSeqPendingBefore(deadline, subid, seqno)
+	}
+	return runBefore(deadline, func() error { return ss.AddSeqPending(subid, seqno) })
+}
+
+// AckSeqPendingBefore calls SubStore.AckSeqPending, returning
+// ErrDeadlineExceeded if it does not complete before the deadline.
+func AckSeqPendingBefore(ss SubStore, deadline time.Time, subid, seqno uint64) error {
+	if dss, ok := ss.(DeadlineSubStore); ok {
+		return dss.AckSeqPendingBefore(deadline, subid, seqno)
+	}
+	return runBefore(deadline, func() error { return ss.AckSeqPending(subid, seqno) })
+}
+
+// FlushSubsBefore flushes the subscriptions store, returning
+// ErrDeadlineExceeded if the flush does not complete before the deadline.
+func FlushSubsBefore(ss SubStore, deadline time.Time) error {
+	if dss, ok := ss.(DeadlineSubStore); ok {
+		return dss.FlushBefore(deadline)
+	}
+	return runBefore(deadline, ss.Flush)
+}
+
+// runBefore runs `op` and returns its error, or ErrDeadlineExceeded if it
+// does not return before the deadline, in which case it keeps running in
+// the background and its result is discarded. With a zero deadline, `op`
+// is simply called.
+func runBefore(deadline time.Time, op func() error) error {
+	if deadline.IsZero() {
+		return op()
+	}
+	timeout := deadline.Sub(time.Now())
+	if timeout <= 0 {
+		return ErrDeadlineExceeded
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- op()
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case err := <-done:
+		return err
+	case <-timer.C:
+		return ErrDeadlineExceeded
+	}
+}
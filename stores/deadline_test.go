@@ -0,0 +1,92 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package stores
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nats-io/go-nats-streaming/pb"
+	"github.com/nats-io/nats-streaming-server/spb"
+)
+
+// slowMsgStore is a MsgStore whose Store takes `delay`.
+type slowMsgStore struct {
+	MsgStore
+	delay time.Duration
+}
+
+func (ms *slowMsgStore) Store(reply string, data []byte, ext *spb.MsgExt) (*pb.MsgProto, error) {
+	time.Sleep(ms.delay)
+	return ms.MsgStore.Store(reply, data, ext)
+}
+
+// deadlineMsgStore is a slowMsgStore implementing DeadlineMsgStore, which
+// does not store the message if the deadline is too close.
+type deadlineMsgStore struct {
+	slowMsgStore
+}
+
+func (ms *deadlineMsgStore) StoreBefore(deadline time.Time, reply string, data []byte, ext *spb.MsgExt) (*pb.MsgProto, error) {
+	if !deadline.IsZero() && time.Now().Add(ms.delay).After(deadline) {
+		return nil, ErrDeadlineExceeded
+	}
+	return ms.Store(reply, data, ext)
+}
+
+func (ms *deadlineMsgStore) LookupBefore(deadline time.Time, seq uint64) (*pb.MsgProto, error) {
+	return ms.Lookup(seq)
+}
+
+func (ms *deadlineMsgStore) FlushBefore(deadline time.Time) error {
+	return ms.Flush()
+}
+
+func TestStoreBefore(t *testing.T) {
+	s, err := NewMemoryStore(&testDefaultChannelLimits)
+	if err != nil {
+		t.Fatalf("Unexpected error creating store: %v", err)
+	}
+	defer s.Close()
+	cs, _, err := s.CreateChannel("foo", nil)
+	if err != nil {
+		t.Fatalf("Unexpected error creating channel: %v", err)
+	}
+	slow := &slowMsgStore{MsgStore: cs.Msgs, delay: 200 * time.Millisecond}
+
+	// No deadline, or a deadline far enough.
+	for i, deadline := range []time.Time{{}, time.Now().Add(time.Minute)} {
+		m, err := StoreBefore(slow, deadline, "", []byte("hello"), nil)
+		if err != nil || m == nil || m.Sequence != uint64(i+1) {
+			t.Fatalf("Unexpected result: %v, %v", m, err)
+		}
+	}
+	// The caller no longer waits once the deadline is exceeded, but the
+	// message is still stored.
+	start := time.Now()
+	if m, err := StoreBefore(slow, start.Add(50*time.Millisecond), "", []byte("hello"), nil); err != ErrDeadlineExceeded || m != nil {
+		t.Fatalf("Expected deadline exceeded, got %v, %v", m, err)
+	}
+	if elapsed := time.Since(start); elapsed >= slow.delay {
+		t.Fatalf("Should have returned at the deadline, took %v", elapsed)
+	}
+	time.Sleep(2 * slow.delay)
+	if last := cs.Msgs.LastSequence(); last != 3 {
+		t.Fatalf("Expected last sequence 3, got %v", last)
+	}
+	if _, err := StoreBefore(slow, time.Now().Add(-time.Second), "", []byte("hello"), nil); err != ErrDeadlineExceeded {
+		t.Fatalf("Expected deadline exceeded, got %v", err)
+	}
+
+	// A store implementing DeadlineMsgStore handles the deadline itself.
+	dms := &deadlineMsgStore{slowMsgStore: *slow}
+	if _, err := StoreBefore(dms, time.Now().Add(50*time.Millisecond), "", []byte("hello"), nil); err != ErrDeadlineExceeded {
+		t.Fatalf("Expected deadline exceeded, got %v", err)
+	}
+	if last := cs.Msgs.LastSequence(); last != 3 {
+		t.Fatalf("Expected last sequence 3, got %v", last)
+	}
+	if m, err := LookupBefore(dms, time.Now().Add(time.Minute), 3); err != nil || m == nil || m.Sequence != 3 {
+		t.Fatalf("Unexpected result: %v, %v", m, err)
+	}
+}
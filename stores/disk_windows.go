@@ -0,0 +1,10 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package stores
+
+import "errors"
+
+// freeDiskSpace is not supported on Windows.
+func freeDiskSpace(dir string) (uint64, error) {
+	return 0, errors.New("free disk space not supported on Windows")
+}
@@ -3,12 +3,19 @@
 package stores
 
 import (
+	"encoding/binary"
 	"fmt"
 	"hash/crc32"
+	"hash/fnv"
 	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"bufio"
@@ -34,6 +41,19 @@ const (
 	// Name of the server file.
 	serverFileName = "server.dat"
 
+	// Name of the file holding the creation time of a channel.
+	channelInfoFileName = "channel.dat"
+
+	// Name of the file holding the state of a message store, written when
+	// the store is closed.
+	msgsStateFileName = "msgs.state"
+
+	// Prefix of the directory holding the channels of a tenant. Channel
+	// names can't have empty tokens, so this does not collide with the
+	// directory of a channel. Still, unlike the directory of a channel,
+	// it does not contain a subscriptions file.
+	tenantDirPrefix = "."
+
 	// Number of bytes required to store a CRC-32 checksum
 	crcSize = crc32.Size
 
@@ -45,6 +65,15 @@ const (
 
 	// defaultBufSize is used for various buffered IO operations
 	defaultBufSize = 10 * 1024 * 1024
+
+	// Interval at which the progress of the channels recovery is logged.
+	recoveryProgressInterval = 5 * time.Second
+
+	// Minimum interval between two checks of the free disk space.
+	diskSpaceCheckInterval = time.Second
+
+	// Interval at which the limits are enforced when RetentionRate is set.
+	retentionInterval = 100 * time.Millisecond
 )
 
 // FileStoreOption is a function on the options for a File Store
@@ -78,6 +107,65 @@ type FileStoreOptions struct {
 
 	// DoSync indicates if `File.Sync()`` is called during a flush.
 	DoSync bool
+
+	// RecoveryParallelism is the number of channels recovered concurrently
+	// on startup.
+	RecoveryParallelism int
+
+	// LazyRecovery indicates that, on startup, the messages of a channel
+	// that was properly closed are not read until they are first accessed.
+	LazyRecovery bool
+
+	// GroupCommit indicates that the file syncs requested concurrently by
+	// the stores are coalesced, each file being synced once per commit.
+	GroupCommit bool
+
+	// AckFlushInterval, if not 0, is the interval (in milliseconds) at
+	// which acks are flushed to disk. By default, acks are flushed as
+	// they are stored.
+	AckFlushInterval int
+
+	// PreallocateSize, if not 0, is the disk space (in bytes) reserved for
+	// a message file when it is opened for writing.
+	PreallocateSize int64
+
+	// ReservedDiskSpace, if not 0, is the free disk space (in bytes) below
+	// which messages are rejected with ErrNoSpace.
+	ReservedDiskSpace int64
+
+	// RetentionRate, if not 0, moves the enforcement of the channel limits
+	// to a background task, which removes at most this many bytes of
+	// messages per second. By default, messages are removed as new ones
+	// are stored.
+	RetentionRate int64
+
+	// Tier, if set, is the object storage to which the message files are
+	// offloaded once their last message is older than TierAge (in seconds).
+	Tier    Tier
+	TierAge int
+
+	// ReadOnly opens an existing store without ever writing to its files.
+	// The state is the one found when the store is opened, the limits are
+	// not enforced, and the methods that would modify the store return
+	// ErrReadOnly. The options that only apply to writes are ignored.
+	ReadOnly bool
+
+	// ShardChannelDirs stores the directory of each channel under two
+	// levels of directories named after a hash of the channel name, instead
+	// of directly in the root (or tenant) directory, which keeps directories
+	// small when there are many channels. The channel directories that are
+	// not in the configured layout are moved when the store is opened.
+	ShardChannelDirs bool
+
+	// MaintenanceWindows, if set, are the periods during which the heavy
+	// maintenance (compaction of the files and offloading to the tier) is
+	// performed. Outside of them, it is deferred until the next window.
+	MaintenanceWindows []MaintenanceWindow
+
+	// Upgrade allows the files written in an older format to be upgraded,
+	// in place, when the store is opened. Without it, opening a store with
+	// such files fails with ErrUpgradeRequired.
+	Upgrade bool
 }
 
 // DefaultFileStoreOptions defines the default options for a File Store.
@@ -90,6 +178,7 @@ var DefaultFileStoreOptions = FileStoreOptions{
 	DoCRC:                true,
 	CRCPolynomial:        int64(crc32.IEEE),
 	DoSync:               true,
+	RecoveryParallelism:  runtime.NumCPU(),
 }
 
 // BufferSize is a FileStore option that sets the size of the buffer used
@@ -168,6 +257,159 @@ func DoSync(enableFileSync bool) FileStoreOption {
 	}
 }
 
+// RecoveryParallelism is a FileStore option that sets the number of channels
+// recovered concurrently on startup.
+func RecoveryParallelism(channels int) FileStoreOption {
+	return func(o *FileStoreOptions) error {
+		if channels < 1 {
+			return fmt.Errorf("recovery parallelism must be at least 1, got %v", channels)
+		}
+		o.RecoveryParallelism = channels
+		return nil
+	}
+}
+
+// LazyRecovery is a FileStore option that enables (or disables) the lazy
+// recovery of the messages.
+func LazyRecovery(enabled bool) FileStoreOption {
+	return func(o *FileStoreOptions) error {
+		o.LazyRecovery = enabled
+		return nil
+	}
+}
+
+// GroupCommit is a FileStore option that enables (or disables) the group
+// commit of the file syncs. This has no effect if DoSync is not set.
+func GroupCommit(enabled bool) FileStoreOption {
+	return func(o *FileStoreOptions) error {
+		o.GroupCommit = enabled
+		return nil
+	}
+}
+
+// AckFlushInterval is a FileStore option that sets the interval (in
+// milliseconds) at which the acks are flushed. Acks that are not flushed
+// are lost on a crash, causing the redelivery of the messages.
+func AckFlushInterval(millis int) FileStoreOption {
+	return func(o *FileStoreOptions) error {
+		if millis < 0 {
+			return fmt.Errorf("ack flush interval can't be negative, got %v", millis)
+		}
+		o.AckFlushInterval = millis
+		return nil
+	}
+}
+
+// PreallocateSize is a FileStore option that sets the disk space (in bytes)
+// reserved for a message file when it is opened for writing. This reduces
+// fragmentation, and a full disk is detected before messages are written.
+func PreallocateSize(size int64) FileStoreOption {
+	return func(o *FileStoreOptions) error {
+		if size < 0 {
+			return fmt.Errorf("preallocate size can't be negative, got %v", size)
+		}
+		o.PreallocateSize = size
+		return nil
+	}
+}
+
+// ReservedDiskSpace is a FileStore option that sets the free disk space (in
+// bytes) below which messages are rejected.
+func ReservedDiskSpace(size int64) FileStoreOption {
+	return func(o *FileStoreOptions) error {
+		if size < 0 {
+			return fmt.Errorf("reserved disk space can't be negative, got %v", size)
+		}
+		o.ReservedDiskSpace = size
+		return nil
+	}
+}
+
+// RetentionRate is a FileStore option that enforces the channel limits in
+// the background, removing at most `bytesPerSec` bytes of messages per
+// second, instead of as new messages are stored.
+func RetentionRate(bytesPerSec int64) FileStoreOption {
+	return func(o *FileStoreOptions) error {
+		if bytesPerSec < 0 {
+			return fmt.Errorf("retention rate can't be negative, got %v", bytesPerSec)
+		}
+		o.RetentionRate = bytesPerSec
+		return nil
+	}
+}
+
+// TieredStorage is a FileStore option that offloads the message files
+// whose last message is older than `ageSeconds` to the given tier.
+func TieredStorage(tier Tier, ageSeconds int) FileStoreOption {
+	return func(o *FileStoreOptions) error {
+		if ageSeconds < 0 {
+			return fmt.Errorf("tier age must be positive or 0")
+		}
+		o.Tier = tier
+		o.TierAge = ageSeconds
+		return nil
+	}
+}
+
+// MaintenanceWindows is a FileStore option that restricts the heavy
+// maintenance to the given windows.
+func MaintenanceWindows(windows []MaintenanceWindow) FileStoreOption {
+	return func(o *FileStoreOptions) error {
+		o.MaintenanceWindows = windows
+		return nil
+	}
+}
+
+// inMaintenanceWindow returns true if the heavy maintenance is allowed now.
+func (o *FileStoreOptions) inMaintenanceWindow() bool {
+	if len(o.MaintenanceWindows) == 0 {
+		return true
+	}
+	return inMaintenanceWindow(o.MaintenanceWindows, time.Now())
+}
+
+// ReadOnly is a FileStore option that opens the store in read-only mode.
+func ReadOnly(enabled bool) FileStoreOption {
+	return func(o *FileStoreOptions) error {
+		o.ReadOnly = enabled
+		return nil
+	}
+}
+
+// ShardChannelDirs is a FileStore option that stores the channel directories
+// under two levels of directories named after a hash of the channel name.
+func ShardChannelDirs(enabled bool) FileStoreOption {
+	return func(o *FileStoreOptions) error {
+		o.ShardChannelDirs = enabled
+		return nil
+	}
+}
+
+// Upgrade is a FileStore option that allows the files written in an older
+// format to be upgraded when the store is opened.
+func Upgrade(enabled bool) FileStoreOption {
+	return func(o *FileStoreOptions) error {
+		o.Upgrade = enabled
+		return nil
+	}
+}
+
+// fileModes returns the modes with which the existing files of the store
+// are opened: the default ones of openFile, unless the store is read-only.
+func (o *FileStoreOptions) fileModes() []int {
+	if o.ReadOnly {
+		return []int{os.O_RDONLY}
+	}
+	return nil
+}
+
+// isEndOfFile returns true if `err`, returned by readRecord, marks the end
+// of the file. In read-only mode, the last record may be partially written
+// by the server that owns the store.
+func (o *FileStoreOptions) isEndOfFile(err error) bool {
+	return err == io.EOF || (o.ReadOnly && err == io.ErrUnexpectedEOF)
+}
+
 // AllOptions is a convenient option to pass all options from a FileStoreOptions
 // structure to the constructor.
 func AllOptions(opts *FileStoreOptions) FileStoreOption {
@@ -191,6 +433,32 @@ type record interface {
 	MarshalTo([]byte) (int, error)
 }
 
+// msgRecord is the record written in the message files. It is the
+// MsgProto followed by the optional MsgExt. Since their field numbers
+// do not overlap, the record can be unmarshaled as a MsgProto by older
+// versions that ignore the extension.
+type msgRecord struct {
+	msg *pb.MsgProto
+	ext *spb.MsgExt
+}
+
+func (r *msgRecord) Size() int {
+	size := r.msg.Size()
+	if r.ext != nil {
+		size += r.ext.Size()
+	}
+	return size
+}
+
+func (r *msgRecord) MarshalTo(buf []byte) (int, error) {
+	n, err := r.msg.MarshalTo(buf)
+	if err != nil || r.ext == nil {
+		return n, err
+	}
+	en, err := r.ext.MarshalTo(buf[n:])
+	return n + en, err
+}
+
 // This is use for cases when the record is not typed
 const recNoType = recordType(0)
 
@@ -201,8 +469,13 @@ const (
 	subRecDel
 	subRecAck
 	subRecMsg
+	subRecUpdates
+	subRecAckRange
 )
 
+// Maximum number of updates in a subRecUpdates record.
+const maxSubUpdatesPerRecord = 1024
+
 // Record types for client store
 const (
 	addClient = recordType(iota) + 1
@@ -223,6 +496,11 @@ type FileStore struct {
 	cliDeleteRecs int // Number of deleted client records
 	cliCompactTS  time.Time
 	crcTable      *crc32.Table
+	commit        *groupCommit    // nil unless group commit is enabled
+	diskSpace     *diskSpaceCheck // nil unless disk space is reserved
+	maintQuit     chan struct{}   // nil unless there are maintenance windows
+	maintWg       sync.WaitGroup
+	maintStop     sync.Once
 }
 
 type subscription struct {
@@ -237,7 +515,8 @@ type FileSubStore struct {
 	file        *os.File
 	bw          *bufio.Writer
 	delSub      spb.SubStateDelete
-	updateSub   spb.SubStateUpdate
+	updates     []subUpdate      // pending and ack updates not yet written
+	updatesRec  subUpdatesRecord // used to write the updates
 	subs        map[uint64]*subscription
 	opts        *FileStoreOptions // points to options from FileStore
 	compactItvl time.Duration
@@ -246,7 +525,142 @@ type FileSubStore struct {
 	delRecs     int // Number of delete (or ack) records
 	rootDir     string
 	compactTS   time.Time
-	crcTable    *crc32.Table // reference to the one from FileStore
+	crcTable    *crc32.Table  // reference to the one from FileStore
+	commit      *groupCommit  // reference to the one from FileStore
+	ackPending  bool          // acks have been written but not flushed
+	ackQuit     chan struct{} // stops the periodic flush of acks
+	ackWg       sync.WaitGroup
+}
+
+// subUpdate is a pending message (or an ack if `ack` is true) of a
+// subscription.
+type subUpdate struct {
+	subID uint64
+	seqno uint64
+	ack   bool
+}
+
+// subUpdatesRecord is a batch of subscription updates written as a single
+// subRecUpdates record. Each update is encoded as two varints: the
+// subscription ID shifted left by one, with the low bit set for an ack,
+// followed by the difference between its sequence and the sequence of the
+// previous update in the batch.
+type subUpdatesRecord struct {
+	buf []byte
+}
+
+// encode encodes the updates in the record's buffer.
+func (r *subUpdatesRecord) encode(updates []subUpdate) {
+	var tmp [binary.MaxVarintLen64]byte
+	r.buf = r.buf[:0]
+	prev := uint64(0)
+	for _, u := range updates {
+		id := u.subID << 1
+		if u.ack {
+			id |= 1
+		}
+		n := binary.PutUvarint(tmp[:], id)
+		r.buf = append(r.buf, tmp[:n]...)
+		n = binary.PutVarint(tmp[:], int64(u.seqno-prev))
+		r.buf = append(r.buf, tmp[:n]...)
+		prev = u.seqno
+	}
+}
+
+func (r *subUpdatesRecord) Size() int {
+	return len(r.buf)
+}
+
+func (r *subUpdatesRecord) MarshalTo(buf []byte) (int, error) {
+	return copy(buf, r.buf), nil
+}
+
+// subAckRangeRecord acknowledges all the pending messages of a subscription
+// between two sequences, included. It is encoded as three varints: the
+// subscription ID, the first sequence and the number of sequences after it.
+type subAckRangeRecord struct {
+	subID    uint64
+	firstSeq uint64
+	lastSeq  uint64
+}
+
+func (r *subAckRangeRecord) Size() int {
+	var tmp [binary.MaxVarintLen64]byte
+	return binary.PutUvarint(tmp[:], r.subID) +
+		binary.PutUvarint(tmp[:], r.firstSeq) +
+		binary.PutUvarint(tmp[:], r.lastSeq-r.firstSeq)
+}
+
+func (r *subAckRangeRecord) MarshalTo(buf []byte) (int, error) {
+	n := binary.PutUvarint(buf, r.subID)
+	n += binary.PutUvarint(buf[n:], r.firstSeq)
+	n += binary.PutUvarint(buf[n:], r.lastSeq-r.firstSeq)
+	return n, nil
+}
+
+// Unmarshal decodes the record from `buf`.
+func (r *subAckRangeRecord) Unmarshal(buf []byte) error {
+	var vals [3]uint64
+	for i := range vals {
+		v, n := binary.Uvarint(buf)
+		if n <= 0 {
+			return ErrCorruptedData
+		}
+		vals[i] = v
+		buf = buf[n:]
+	}
+	r.subID, r.firstSeq, r.lastSeq = vals[0], vals[1], vals[1]+vals[2]
+	return nil
+}
+
+// ackRange removes the pending messages of `sub` from firstSeq to lastSeq
+// and returns how many were removed.
+func (sub *subscription) ackRange(firstSeq, lastSeq uint64) int {
+	removed := 0
+	if lastSeq-firstSeq < uint64(len(sub.seqnos)) {
+		for seqno := firstSeq; seqno <= lastSeq; seqno++ {
+			if _, ok := sub.seqnos[seqno]; ok {
+				delete(sub.seqnos, seqno)
+				removed++
+			}
+		}
+	} else {
+		for seqno := range sub.seqnos {
+			if seqno >= firstSeq && seqno <= lastSeq {
+				delete(sub.seqnos, seqno)
+				removed++
+			}
+		}
+	}
+	return removed
+}
+
+// uint64Slice sorts sequences in increasing order.
+type uint64Slice []uint64
+
+func (a uint64Slice) Len() int           { return len(a) }
+func (a uint64Slice) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a uint64Slice) Less(i, j int) bool { return a[i] < a[j] }
+
+// decodeSubUpdates invokes `f` for each update encoded in `buf`.
+func decodeSubUpdates(buf []byte, f func(u subUpdate)) error {
+	prev := uint64(0)
+	for len(buf) > 0 {
+		id, n := binary.Uvarint(buf)
+		if n <= 0 {
+			return fmt.Errorf("invalid subscription ID in updates record")
+		}
+		buf = buf[n:]
+		delta, n := binary.Varint(buf)
+		if n <= 0 {
+			return fmt.Errorf("invalid sequence in updates record")
+		}
+		buf = buf[n:]
+		u := subUpdate{subID: id >> 1, seqno: prev + uint64(delta), ack: id&1 == 1}
+		f(u)
+		prev = u.seqno
+	}
+	return nil
 }
 
 // fileSlice represents one of the message store file (there are a number
@@ -257,6 +671,7 @@ type fileSlice struct {
 	lastMsg   *pb.MsgProto
 	msgsCount int
 	msgsSize  uint64
+	rmCount   int // Number of records of messages removed by key compaction
 }
 
 // FileMsgStore is a per channel message file store.
@@ -269,6 +684,23 @@ type FileMsgStore struct {
 	currSliceIdx int
 	opts         *FileStoreOptions // points to FileStore options
 	crcTable     *crc32.Table      // reference to the one from FileStore
+	commit       *groupCommit      // reference to the one from FileStore
+	diskSpace    *diskSpaceCheck   // reference to the one from FileStore
+	compactQuit  chan struct{}     // stops the background compaction
+	compactWg    sync.WaitGroup
+	retainQuit   chan struct{} // stops the background retention
+	retainWg     sync.WaitGroup
+	retainMsgs   uint64        // messages removed by the background retention
+	retainBytes  uint64        // size of these messages
+	stateFile    string        // state is saved in this file on close, if set
+	loaded       bool          // false until the messages of a lazily recovered store are read
+	tierDir      string        // name of the channel directory in the tier
+	tierFile     string        // index of the files offloaded to the tier
+	tiered       []tieredSlice // ranges of sequences offloaded to the tier
+	tieredCount  int           // number of messages offloaded to the tier
+	tieredBytes  uint64        // size of these messages
+	tierLock     sync.Mutex    // protects tierCache
+	tierCache    *tierCache
 }
 
 // openFile opens the file specified by `filename`.
@@ -396,7 +828,7 @@ func readRecord(r io.Reader, buf []byte, recTyped bool, crcTable *crc32.Table, c
 	if checkCRC {
 		// check CRC against what was stored
 		if c := crc32.Checksum(buf[:recSize], crcTable); c != crc {
-			return buf, 0, recNoType, fmt.Errorf("corrupted data, expected crc to be 0x%08x, got 0x%08x", crc, c)
+			return buf, 0, recNoType, ErrCorruptedData
 		}
 	}
 	return buf, recSize, recType, nil
@@ -422,6 +854,17 @@ func NewFileStore(rootDir string, limits *ChannelLimits, options ...FileStoreOpt
 			return nil, nil, err
 		}
 	}
+	if fs.opts.ReadOnly {
+		// Disable everything that could write to the files.
+		fs.opts.CompactEnabled = false
+		fs.opts.DoSync = false
+		fs.opts.GroupCommit = false
+		fs.opts.AckFlushInterval = 0
+		fs.opts.PreallocateSize = 0
+		fs.opts.ReservedDiskSpace = 0
+		fs.opts.RetentionRate = 0
+		fs.opts.Tier = nil
+	}
 	// Convert the compact interval in time.Duration
 	fs.compactItvl = time.Duration(fs.opts.CompactInterval) * time.Second
 	// Create the table using polynomial in options
@@ -431,18 +874,29 @@ func NewFileStore(rootDir string, limits *ChannelLimits, options ...FileStoreOpt
 		fs.crcTable = crc32.MakeTable(uint32(fs.opts.CRCPolynomial))
 	}
 
-	if err := os.MkdirAll(rootDir, os.ModeDir+os.ModePerm); err != nil && !os.IsExist(err) {
+	if fs.opts.ReadOnly {
+		if _, err := os.Stat(rootDir); err != nil {
+			return nil, nil, fmt.Errorf("unable to open the root directory [%s]: %v", rootDir, err)
+		}
+	} else if err := os.MkdirAll(rootDir, os.ModeDir+os.ModePerm); err != nil && !os.IsExist(err) {
 		return nil, nil, fmt.Errorf("unable to create the root directory [%s]: %v", rootDir, err)
 	}
+	if err := upgradeFiles(rootDir, fs.opts.Upgrade && !fs.opts.ReadOnly, fileVersion, fileUpgrades); err != nil {
+		return nil, nil, err
+	}
+	if fs.opts.GroupCommit && fs.opts.DoSync {
+		fs.commit = newGroupCommit()
+	}
+	if fs.opts.ReservedDiskSpace > 0 {
+		fs.diskSpace = &diskSpaceCheck{dir: rootDir, reserved: uint64(fs.opts.ReservedDiskSpace)}
+	}
 
 	var err error
 	var recoveredState *RecoveredState
 	var serverInfo *spb.ServerInfo
 	var recoveredClients []*Client
-	var recoveredSubs = make(RecoveredSubscriptions)
-	var channels []os.FileInfo
-	var msgStore *FileMsgStore
-	var subStore *FileSubStore
+	var channels []channelDir
+	var recovered []*recoveredChannel
 
 	// Ensure store is closed in case of return with error
 	defer func() {
@@ -454,14 +908,18 @@ func NewFileStore(rootDir string, limits *ChannelLimits, options ...FileStoreOpt
 	// Open/Create the server file (note that this file must not be opened,
 	// in APPEND mode to allow truncate to work).
 	fileName := filepath.Join(fs.rootDir, serverFileName)
-	fs.serverFile, err = openFile(fileName, os.O_RDWR, os.O_CREATE)
+	if fs.opts.ReadOnly {
+		fs.serverFile, err = openFile(fileName, os.O_RDONLY)
+	} else {
+		fs.serverFile, err = openFile(fileName, os.O_RDWR, os.O_CREATE)
+	}
 	if err != nil {
 		return nil, nil, err
 	}
 
 	// Open/Create the client file.
 	fileName = filepath.Join(fs.rootDir, clientsFileName)
-	fs.clientsFile, err = openFile(fileName)
+	fs.clientsFile, err = openFile(fileName, fs.opts.fileModes()...)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -483,83 +941,279 @@ func NewFileStore(rootDir string, limits *ChannelLimits, options ...FileStoreOpt
 		return nil, nil, err
 	}
 
-	// Get the channels (there are subdirectories of rootDir)
-	channels, err = ioutil.ReadDir(rootDir)
+	// Get the channels (there are subdirectories of rootDir, or of
+	// the tenants directories)
+	channels, err = listChannelDirs(rootDir)
 	if err != nil {
 		return nil, nil, err
 	}
-	// Go through the list
-	for _, c := range channels {
-		// Channels are directories. Ignore simple files
-		if !c.IsDir() {
-			continue
+	if !fs.opts.ReadOnly {
+		if err = moveChannelDirs(channels, fs.opts.ShardChannelDirs); err != nil {
+			return nil, nil, err
 		}
-
-		channel := c.Name()
-		channelDirName := filepath.Join(rootDir, channel)
-
-		// Recover messages for this channel
-		msgStore, err = fs.newFileMsgStore(channelDirName, channel, true)
-		if err != nil {
-			break
+	}
+	// Recover the channels concurrently
+	recovered, err = fs.recoverChannels(channels)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, rc := range recovered {
+		fs.channels[rc.channel] = &ChannelStore{
+			Subs:    rc.subs,
+			Msgs:    rc.msgs,
+			Created: rc.created,
 		}
-		subStore, err = fs.newFileSubStore(channelDirName, channel, true)
-		if err != nil {
-			msgStore.Close()
-			break
+	}
+	// In soak runs, check the recovered state before it is used.
+	if chaosEnabled {
+		if err = fs.CheckInvariants(); err != nil {
+			return nil, nil, err
 		}
+	}
+	// Create the recovered state to return
+	recoveredState = &RecoveredState{
+		Info:    serverInfo,
+		Clients: recoveredClients,
+		RecoverSubs: func(f func(string, *RecoveredSubState) error) error {
+			return recoverFileSubs(recovered, f)
+		},
+	}
+	if len(fs.opts.MaintenanceWindows) > 0 && !fs.opts.ReadOnly {
+		fs.maintQuit = make(chan struct{})
+		fs.maintWg.Add(1)
+		go fs.maintenanceLoop()
+	}
+	return fs, recoveredState, nil
+}
 
-		// For this channel, construct an array of RecoveredSubState
-		rssArray := make([]*RecoveredSubState, 0, len(subStore.subs))
-
-		// Fill that array with what we got from newFileSubStore.
-		for _, sub := range subStore.subs {
+// recoverFileSubs invokes f for each subscription of the recovered channels,
+// constructing its RecoveredSubState from what we got from newFileSubStore.
+func recoverFileSubs(recovered []*recoveredChannel, f func(string, *RecoveredSubState) error) error {
+	for _, rc := range recovered {
+		for _, sub := range rc.subs.subs {
 			rss := &RecoveredSubState{
 				Sub:     sub.sub,
-				Pending: make(PendingAcks),
+				Pending: make(PendingAcks, len(sub.seqnos)),
+			}
+			// Lookup messages, and if we find those, update the
+			// Pending map.
+			for seq := range sub.seqnos {
+				// Access directly 'msgs' here. If we have a
+				// different implementation where we don't
+				// keep messages around, we would still have
+				// a cache of messages per channel that will
+				// then be cleared after this loop when we
+				// are done restoring the subscriptions.
+				if m := rc.msgs.msgs[seq]; m != nil {
+					rss.Pending[seq] = m
+				}
+			}
+			if err := f(rc.channel, rss); err != nil {
+				return err
 			}
-			// If we recovered any seqno...
-			if len(sub.seqnos) > 0 {
-				// Lookup messages, and if we find those, update the
-				// Pending map.
-				for seq := range sub.seqnos {
-					// Access directly 'msgs' here. If we have a
-					// different implementation where we don't
-					// keep messages around, we would still have
-					// a cache of messages per channel that will
-					// then be cleared after this loop when we
-					// are done restoring the subscriptions.
-					if m := msgStore.msgs[seq]; m != nil {
-						rss.Pending[seq] = m
+		}
+	}
+	// Now that the pending messages are handed out, the expired messages
+	// can be removed.
+	for _, rc := range recovered {
+		rc.msgs.Lock()
+		rc.msgs.startExpiryTimer()
+		rc.msgs.Unlock()
+	}
+	return nil
+}
+
+// recoveredChannel holds the stores of a channel recovered on startup.
+type recoveredChannel struct {
+	channel string
+	created time.Time
+	msgs    *FileMsgStore
+	subs    *FileSubStore
+}
+
+// recoverChannels recovers the message and subscription stores of the
+// channels, with up to RecoveryParallelism channels recovered at the same
+// time. On error, the stores that have been recovered are closed.
+func (fs *FileStore) recoverChannels(channels []channelDir) ([]*recoveredChannel, error) {
+	recovered := make([]*recoveredChannel, len(channels))
+	progress := newRecoveryProgress(len(channels))
+
+	workers := fs.opts.RecoveryParallelism
+	if workers > len(channels) {
+		workers = len(channels)
+	} else if workers < 1 {
+		workers = 1
+	}
+	var (
+		wg       sync.WaitGroup
+		errLock  sync.Mutex
+		firstErr error
+		failed   int32
+	)
+	work := make(chan int, len(channels))
+	for i := range channels {
+		work <- i
+	}
+	close(work)
+	wg.Add(workers)
+	for w := 0; w < workers; w++ {
+		go func() {
+			defer wg.Done()
+			for i := range work {
+				// Don't start new channels once one has failed.
+				if atomic.LoadInt32(&failed) == 1 {
+					return
+				}
+				rc, err := fs.recoverChannel(channels[i])
+				if err != nil {
+					errLock.Lock()
+					if firstErr == nil {
+						firstErr = err
 					}
+					errLock.Unlock()
+					atomic.StoreInt32(&failed, 1)
+					return
 				}
+				recovered[i] = rc
+				progress.channelDone(rc.msgs.totalCount)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		for _, rc := range recovered {
+			if rc != nil {
+				rc.msgs.Close()
+				rc.subs.Close()
 			}
-			// Add to the array of recovered subscriptions
-			rssArray = append(rssArray, rss)
 		}
+		return nil, firstErr
+	}
+	progress.done()
+	return recovered, nil
+}
 
-		// This is the recovered subscription state for this channel
-		recoveredSubs[channel] = rssArray
+// recoverChannel recovers the message and subscription stores of a channel.
+func (fs *FileStore) recoverChannel(c channelDir) (*recoveredChannel, error) {
+	info, err := fs.recoverChannelInfo(c.dir)
+	if err != nil {
+		return nil, err
+	}
+	msgStore, err := fs.newFileMsgStore(c.dir, c.channel, fs.limits, true)
+	if err != nil {
+		return nil, err
+	}
+	subStore, err := fs.newFileSubStore(c.dir, c.channel, fs.limits, true)
+	if err != nil {
+		msgStore.Close()
+		return nil, err
+	}
+	// The pending messages of the subscriptions are looked up once the
+	// channels are recovered, so they need to be read now.
+	for _, sub := range subStore.subs {
+		if len(sub.seqnos) > 0 {
+			err = msgStore.load()
+			break
+		}
+	}
+	if err != nil {
+		msgStore.Close()
+		subStore.Close()
+		return nil, err
+	}
+	rc := &recoveredChannel{channel: c.channel, msgs: msgStore, subs: subStore}
+	if info != nil {
+		rc.created = time.Unix(0, info.Created)
+	}
+	return rc, nil
+}
 
-		fs.channels[channel] = &ChannelStore{
-			Subs: subStore,
-			Msgs: msgStore,
+// recoverChannelInfo reads the channel information file located in `dir`.
+// It returns nil if there is no such file, which is the case for channels
+// created by an older version of the server.
+func (fs *FileStore) recoverChannelInfo(dir string) (*spb.ChannelInfo, error) {
+	file, err := os.Open(filepath.Join(dir, channelInfoFileName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
 		}
+		return nil, err
 	}
+	defer file.Close()
+	if err := checkFileVersion(file); err != nil {
+		return nil, err
+	}
+	// The channel info record is not typed.
+	buf, size, _, err := readRecord(file, nil, false, fs.crcTable, fs.opts.DoCRC)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
-	// Create the recovered state to return
-	recoveredState = &RecoveredState{
-		Info:    serverInfo,
-		Clients: recoveredClients,
-		Subs:    recoveredSubs,
+	info := &spb.ChannelInfo{}
+	if err := info.Unmarshal(buf[:size]); err != nil {
+		return nil, ErrCorruptedData
 	}
-	return fs, recoveredState, nil
+	return info, nil
+}
+
+// writeChannelInfo writes the channel information file in `dir`.
+func (fs *FileStore) writeChannelInfo(dir string, info *spb.ChannelInfo) error {
+	file, err := openFile(filepath.Join(dir, channelInfoFileName))
+	if err != nil {
+		return err
+	}
+	_, _, err = writeRecord(file, nil, recNoType, info, fs.crcTable)
+	if err == nil && fs.opts.DoSync {
+		err = file.Sync()
+	}
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// recoveryProgress logs the progress of the channels recovery, at most
+// every recoveryProgressInterval, so that the recovery of a large data
+// directory can be followed.
+type recoveryProgress struct {
+	sync.Mutex
+	total      int
+	channels   int
+	msgs       int
+	start      time.Time
+	lastReport time.Time
+	logf       func(format string, v ...interface{})
+}
+
+func newRecoveryProgress(total int) *recoveryProgress {
+	now := time.Now()
+	return &recoveryProgress{total: total, start: now, lastReport: now, logf: Noticef}
+}
+
+// channelDone records that a channel, with `msgs` messages, is recovered.
+func (p *recoveryProgress) channelDone(msgs int) {
+	p.Lock()
+	defer p.Unlock()
+	p.channels++
+	p.msgs += msgs
+	if now := time.Now(); now.Sub(p.lastReport) >= recoveryProgressInterval {
+		p.lastReport = now
+		p.logf("Recovering channels: %d/%d done, %d message(s) recovered", p.channels, p.total, p.msgs)
+	}
+}
+
+// done logs the result of the recovery.
+func (p *recoveryProgress) done() {
+	p.Lock()
+	defer p.Unlock()
+	p.logf("Recovered %d channel(s) and %d message(s) in %v", p.channels, p.msgs, time.Since(p.start))
 }
 
 // Init is used to persist server's information after the first start
 func (fs *FileStore) Init(info *spb.ServerInfo) error {
+	if fs.opts.ReadOnly {
+		return ErrReadOnly
+	}
 	fs.Lock()
 	defer fs.Unlock()
 
@@ -594,7 +1248,7 @@ func (fs *FileStore) recoverClients() ([]*Client, error) {
 	for {
 		buf, recSize, recType, err = readRecord(br, buf, true, fs.crcTable, fs.opts.DoCRC)
 		if err != nil {
-			if err == io.EOF {
+			if fs.opts.isEndOfFile(err) {
 				err = nil
 				break
 			}
@@ -605,15 +1259,19 @@ func (fs *FileStore) recoverClients() ([]*Client, error) {
 		case addClient:
 			c := &Client{}
 			if err := c.ClientInfo.Unmarshal(buf[:recSize]); err != nil {
-				return nil, err
+				return nil, ErrCorruptedData
+			}
+			// Add to the map. If one already exists, this is a more recent
+			// record of the client (see SetClientUnreachable) that replaces
+			// the previous one.
+			if fs.clients[c.ID] != nil {
+				fs.cliDeleteRecs++
 			}
-			// Add to the map. Note that if one already exists, which should
-			// not, just replace with this most recent one.
 			fs.clients[c.ID] = c
 		case delClient:
 			c := spb.ClientDelete{}
 			if err := c.Unmarshal(buf[:recSize]); err != nil {
-				return nil, err
+				return nil, ErrCorruptedData
 			}
 			delete(fs.clients, c.ID)
 			fs.cliDeleteRecs++
@@ -658,60 +1316,260 @@ func (fs *FileStore) recoverServerInfo() (*spb.ServerInfo, error) {
 	}
 	// Reconstruct now
 	if err := info.Unmarshal(buf[:size]); err != nil {
-		return nil, err
+		return nil, ErrCorruptedData
 	}
 	return info, nil
 }
 
 // CreateChannel creates a ChannelStore for the given channel, and returns
 // `true` to indicate that the channel is new, false if it already exists.
+// The files of the channel are created without holding the store's lock,
+// so that the other channels are not blocked in the meantime. The channel
+// is reserved so that it is created only once and counts against the limits.
 func (fs *FileStore) CreateChannel(channel string, userData interface{}) (*ChannelStore, bool, error) {
 	fs.Lock()
-	defer fs.Unlock()
-	channelStore := fs.channels[channel]
-	if channelStore != nil {
-		return channelStore, false, nil
+	for {
+		if channelStore := fs.channels[channel]; channelStore != nil {
+			fs.Unlock()
+			return channelStore, false, nil
+		}
+		wait := fs.creating[channel]
+		if wait == nil {
+			break
+		}
+		// Another call is creating the channel, wait for it and check
+		// again, since it may have failed.
+		fs.Unlock()
+		<-wait
+		fs.Lock()
+	}
+	if fs.opts.ReadOnly {
+		fs.Unlock()
+		return nil, false, ErrReadOnly
 	}
 
 	// Check for limits
-	if err := fs.canAddChannel(); err != nil {
+	if err := fs.canAddChannel(channel); err != nil {
+		fs.Unlock()
 		return nil, false, err
 	}
-
-	// We create the channel here...
-
-	channelDirName := filepath.Join(fs.rootDir, channel)
-	if err := os.MkdirAll(channelDirName, os.ModeDir+os.ModePerm); err != nil {
-		return nil, false, err
+	if fs.creating == nil {
+		fs.creating = make(map[string]chan struct{})
 	}
+	done := make(chan struct{})
+	fs.creating[channel] = done
+	parentDir := fs.rootDir
+	// The channels of a tenant are stored in the tenant's directory.
+	if tenant := fs.limits.tenantOf(channel); tenant != nil {
+		parentDir = filepath.Join(fs.rootDir, tenantDirPrefix+tenant.Name)
+	}
+	limits := fs.limits
+	fs.Unlock()
 
-	var err error
-	var msgStore MsgStore
-	var subStore SubStore
+	channelStore, err := fs.createChannelFiles(parentDir, channel, limits, userData)
 
-	msgStore, err = fs.newFileMsgStore(channelDirName, channel, false)
+	fs.Lock()
+	defer fs.Unlock()
+	delete(fs.creating, channel)
+	close(done)
 	if err != nil {
 		return nil, false, err
 	}
-	subStore, err = fs.newFileSubStore(channelDirName, channel, false)
-	if err != nil {
+	if fs.closed {
+		channelStore.Subs.Close()
+		channelStore.Msgs.Close()
+		return nil, false, fmt.Errorf("unable to create channel %q: store closed", channel)
+	}
+	fs.channels[channel] = channelStore
+
+	return channelStore, true, nil
+}
+
+// createChannelFiles creates the directory and the files of a new channel
+// in `parentDir`, with the given limits, and returns its ChannelStore.
+func (fs *FileStore) createChannelFiles(parentDir, channel string, limits ChannelLimits, userData interface{}) (*ChannelStore, error) {
+	channelDirName := channelDirPath(parentDir, channel, fs.opts.ShardChannelDirs)
+	if err := os.MkdirAll(channelDirName, os.ModeDir+os.ModePerm); err != nil {
+		return nil, err
+	}
+
+	created := time.Now()
+	if err := fs.writeChannelInfo(channelDirName, &spb.ChannelInfo{Created: created.UnixNano()}); err != nil {
+		return nil, err
+	}
+
+	msgStore, err := fs.newFileMsgStore(channelDirName, channel, limits, false)
+	if err != nil {
+		return nil, err
+	}
+	subStore, err := fs.newFileSubStore(channelDirName, channel, limits, false)
+	if err != nil {
 		msgStore.Close()
-		return nil, false, err
+		return nil, err
 	}
 
-	channelStore = &ChannelStore{
+	return &ChannelStore{
 		Subs:     subStore,
 		Msgs:     msgStore,
 		UserData: userData,
+		Created:  created,
+	}, nil
+}
+
+// isTenantDir returns true if the directory `dir`, named `name`, holds the
+// channels of a tenant.
+func isTenantDir(dir, name string) bool {
+	if !strings.HasPrefix(name, tenantDirPrefix) {
+		return false
 	}
+	_, err := os.Stat(filepath.Join(dir, subsFileName))
+	return os.IsNotExist(err)
+}
 
-	fs.channels[channel] = channelStore
+// channelShards returns the names of the two levels of directories under
+// which the directory of the channel is stored when sharding is enabled.
+func channelShards(channel string) (string, string) {
+	h := fnv.New32a()
+	h.Write([]byte(channel))
+	sum := fmt.Sprintf("%08x", h.Sum32())
+	return sum[0:2], sum[2:4]
+}
 
-	return channelStore, true, nil
+// channelDirPath returns the directory of the channel in `parentDir`, which
+// is the root directory or the directory of the channel's tenant.
+func channelDirPath(parentDir, channel string, sharded bool) string {
+	if !sharded {
+		return filepath.Join(parentDir, channel)
+	}
+	shard1, shard2 := channelShards(channel)
+	return filepath.Join(parentDir, shard1, shard2, channel)
+}
+
+// unshardedDir returns the directory of the channel, stored in `dir`, if
+// sharding was not enabled. The offloaded files of the channel are stored
+// in the tier under this path, so that they are found whatever the layout.
+func unshardedDir(dir, channel string) string {
+	shard1, shard2 := channelShards(channel)
+	parent := filepath.Dir(dir)
+	if filepath.Base(parent) != shard2 || filepath.Base(filepath.Dir(parent)) != shard1 {
+		return dir
+	}
+	return filepath.Join(filepath.Dir(filepath.Dir(parent)), channel)
+}
+
+// isShardName returns true if `name` could be the name of a level of the
+// sharded layout.
+func isShardName(name string) bool {
+	return len(name) == 2 && strings.Trim(name, "0123456789abcdef") == ""
+}
+
+// isShardDir returns true if the directory `dir`, named `name`, is a level
+// of the sharded layout, rather than the directory of a channel with a two
+// characters name.
+func isShardDir(dir, name string) bool {
+	if !isShardName(name) {
+		return false
+	}
+	_, err := os.Stat(filepath.Join(dir, subsFileName))
+	return os.IsNotExist(err)
+}
+
+// channelDir is a channel and its directory.
+type channelDir struct {
+	channel string
+	dir     string
+}
+
+// listChannelDirs returns the channels found in the root directory,
+// including the ones in the tenants directories, whether their directories
+// are sharded or not.
+func listChannelDirs(rootDir string) ([]channelDir, error) {
+	return appendChannelDirs(nil, rootDir, 0, true)
+}
+
+// appendChannelDirs appends the channels found in `dir` to `channels`.
+// `depth` is the number of levels of shard directories above `dir`.
+func appendChannelDirs(channels []channelDir, dir string, depth int, withTenants bool) ([]channelDir, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		// Channels are directories. Ignore simple files
+		if !f.IsDir() {
+			continue
+		}
+		path := filepath.Join(dir, f.Name())
+		switch {
+		case withTenants && isTenantDir(path, f.Name()):
+			channels, err = appendChannelDirs(channels, path, 0, false)
+		case depth < 2 && isShardDir(path, f.Name()):
+			channels, err = appendChannelDirs(channels, path, depth+1, false)
+		default:
+			channels = append(channels, channelDir{channel: f.Name(), dir: path})
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return channels, nil
+}
+
+// moveChannelDirs moves the directories of the channels that are not in the
+// requested layout, sharded or not, and updates `channels` accordingly.
+func moveChannelDirs(channels []channelDir, sharded bool) error {
+	// A channel named like a shard directory must be moved out of the root
+	// directory before the shard directory is created, and, when unsharding,
+	// moved back only once the shard directory has been removed.
+	var order []int
+	for pass := 0; pass < 2; pass++ {
+		for i, c := range channels {
+			if isShardName(c.channel) == (sharded == (pass == 0)) {
+				order = append(order, i)
+			}
+		}
+	}
+	moved := 0
+	for _, i := range order {
+		c := &channels[i]
+		unsharded := unshardedDir(c.dir, c.channel)
+		dir := channelDirPath(filepath.Dir(unsharded), c.channel, sharded)
+		if dir == c.dir {
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(dir), os.ModeDir+os.ModePerm); err != nil {
+			return err
+		}
+		if err := os.Rename(c.dir, dir); err != nil {
+			return fmt.Errorf("unable to move the directory of channel [%s]: %v", c.channel, err)
+		}
+		if !sharded {
+			// Remove the shard directories if now empty.
+			if os.Remove(filepath.Dir(c.dir)) == nil {
+				os.Remove(filepath.Dir(filepath.Dir(c.dir)))
+			}
+		}
+		c.dir = dir
+		moved++
+	}
+	if moved > 0 {
+		layout := "sharded"
+		if !sharded {
+			layout = "flat"
+		}
+		Noticef("Moved %v channel directories to the %s layout", moved, layout)
+	}
+	return nil
 }
 
 // AddClient stores information about the client identified by `clientID`.
 func (fs *FileStore) AddClient(clientID, hbInbox string, userData interface{}) (*Client, bool, error) {
+	if fs.opts.ReadOnly {
+		if sc := fs.GetClient(clientID); sc != nil {
+			return sc, false, nil
+		}
+		return nil, false, ErrReadOnly
+	}
 	sc, isNew, err := fs.genericStore.AddClient(clientID, hbInbox, userData)
 	if err != nil {
 		return nil, false, err
@@ -720,7 +1578,7 @@ func (fs *FileStore) AddClient(clientID, hbInbox string, userData interface{}) (
 		return sc, false, nil
 	}
 	fs.Lock()
-	fs.addClientRec = spb.ClientInfo{ID: clientID, HbInbox: hbInbox}
+	fs.addClientRec = sc.ClientInfo
 	_, size, err := writeRecord(fs.clientsFile, nil, addClient, &fs.addClientRec, fs.crcTable)
 	if err != nil {
 		delete(fs.clients, clientID)
@@ -732,8 +1590,12 @@ func (fs *FileStore) AddClient(clientID, hbInbox string, userData interface{}) (
 	return sc, true, nil
 }
 
-// DeleteClient invalidates the client identified by `clientID`.
+// DeleteClient invalidates the client identified by `clientID`. In read-only
+// mode, this is a no-op that returns nil.
 func (fs *FileStore) DeleteClient(clientID string) *Client {
+	if fs.opts.ReadOnly {
+		return nil
+	}
 	sc := fs.genericStore.DeleteClient(clientID)
 	if sc != nil {
 		fs.Lock()
@@ -750,11 +1612,76 @@ func (fs *FileStore) DeleteClient(clientID string) *Client {
 	return sc
 }
 
+// SetClientUnreachable records the time since which the client does not
+// answer heartbeats. The client is written again in the client file, its
+// most recent record replacing the previous one on recovery.
+func (fs *FileStore) SetClientUnreachable(clientID string, since int64) error {
+	if fs.opts.ReadOnly {
+		return ErrReadOnly
+	}
+	if err := fs.genericStore.SetClientUnreachable(clientID, since); err != nil {
+		return err
+	}
+	return fs.rewriteClient(clientID)
+}
+
+// SetClientLastContact records the time at which the client last answered
+// a heartbeat. As for SetClientUnreachable, the client is written again in
+// the client file.
+func (fs *FileStore) SetClientLastContact(clientID string, lastContact int64) error {
+	if fs.opts.ReadOnly {
+		return ErrReadOnly
+	}
+	if err := fs.genericStore.SetClientLastContact(clientID, lastContact); err != nil {
+		return err
+	}
+	return fs.rewriteClient(clientID)
+}
+
+// UpdateClient replaces the heartbeat inbox and the metadata of the client.
+// As for SetClientUnreachable, the client is written again in the client
+// file.
+func (fs *FileStore) UpdateClient(clientID, hbInbox string, metadata []byte) (*Client, error) {
+	if fs.opts.ReadOnly {
+		return nil, ErrReadOnly
+	}
+	sc, err := fs.genericStore.UpdateClient(clientID, hbInbox, metadata)
+	if err != nil {
+		return nil, err
+	}
+	if err := fs.rewriteClient(clientID); err != nil {
+		return nil, err
+	}
+	return sc, nil
+}
+
+// rewriteClient writes the current state of the client in the client file.
+func (fs *FileStore) rewriteClient(clientID string) error {
+	fs.Lock()
+	defer fs.Unlock()
+	c := fs.clients[clientID]
+	if c == nil {
+		return nil
+	}
+	fs.addClientRec = c.ClientInfo
+	_, size, err := writeRecord(fs.clientsFile, nil, addClient, &fs.addClientRec, fs.crcTable)
+	if err != nil {
+		return err
+	}
+	// The previous record of this client is now obsolete.
+	fs.cliDeleteRecs++
+	fs.cliFileSize += int64(size)
+	if fs.shouldCompactClientFile() {
+		fs.compactClientFile()
+	}
+	return nil
+}
+
 // shouldCompactClientFile returns true if the client file should be compacted
 // Lock is held by caller
 func (fs *FileStore) shouldCompactClientFile() bool {
 	// Global switch
-	if !fs.opts.CompactEnabled {
+	if !fs.opts.CompactEnabled || !fs.opts.inMaintenanceWindow() {
 		return false
 	}
 	// Check that if minimum file size is set, the client file
@@ -796,7 +1723,7 @@ func (fs *FileStore) compactClientFile() error {
 	buf := _buf[:]
 	// Dump the content of active clients into the temporary file.
 	for _, c := range fs.clients {
-		fs.addClientRec = spb.ClientInfo{ID: c.ID, HbInbox: c.HbInbox}
+		fs.addClientRec = c.ClientInfo
 		buf, size, err = writeRecord(bw, buf, addClient, &fs.addClientRec, fs.crcTable)
 		if err != nil {
 			return err
@@ -855,6 +1782,7 @@ func swapFiles(tempFile *os.File, activeFile *os.File) (*os.File, error) {
 	if err := activeFile.Close(); err != nil {
 		return activeFile, err
 	}
+	chaosKillPoint("compaction")
 	// Rename the tmp file to original file name
 	err := os.Rename(tempFileName, activeFileName)
 	// Need to re-open the active file anyway
@@ -867,6 +1795,13 @@ func swapFiles(tempFile *os.File, activeFile *os.File) (*os.File, error) {
 
 // Close closes all stores.
 func (fs *FileStore) Close() error {
+	// The maintenance takes the store lock, stop it first.
+	fs.maintStop.Do(func() {
+		if fs.maintQuit != nil {
+			close(fs.maintQuit)
+			fs.maintWg.Wait()
+		}
+	})
 	fs.Lock()
 	defer fs.Unlock()
 	if fs.closed {
@@ -884,26 +1819,184 @@ func (fs *FileStore) Close() error {
 		}
 	}
 	err = fs.genericStore.close()
+	// Stop the group commit once the stores are closed.
+	if fs.commit != nil {
+		fs.commit.close()
+	}
 	closeFile(fs.serverFile)
 	closeFile(fs.clientsFile)
 	return err
 }
 
+////////////////////////////////////////////////////////////////////////////
+// Group commit
+////////////////////////////////////////////////////////////////////////////
+
+// groupCommit coalesces the file syncs requested concurrently by the
+// stores. The requests made while a commit is in progress are grouped and
+// performed by the next commit, which syncs each file only once.
+type groupCommit struct {
+	commits int64 // number of commits performed (first for alignment)
+	sync.Mutex
+	next   *commitGroup  // group that new requests join
+	kick   chan struct{} // signals that a group is waiting
+	quit   chan struct{}
+	wg     sync.WaitGroup
+	closed bool
+}
+
+// commitGroup is the set of files synced by a single commit.
+type commitGroup struct {
+	files map[*os.File]error
+	done  chan struct{}
+}
+
+func newGroupCommit() *groupCommit {
+	gc := &groupCommit{
+		kick: make(chan struct{}, 1),
+		quit: make(chan struct{}),
+	}
+	gc.wg.Add(1)
+	go gc.loop()
+	return gc
+}
+
+// sync syncs the file as part of the next commit, and returns once that
+// commit is done. If group commit is not enabled, the file is synced
+// directly.
+func (gc *groupCommit) sync(f *os.File) error {
+	if err := chaosSyncFault(); err != nil {
+		return err
+	}
+	if gc == nil {
+		return f.Sync()
+	}
+	gc.Lock()
+	if gc.closed {
+		gc.Unlock()
+		return f.Sync()
+	}
+	g := gc.next
+	if g == nil {
+		g = &commitGroup{files: make(map[*os.File]error), done: make(chan struct{})}
+		gc.next = g
+		select {
+		case gc.kick <- struct{}{}:
+		default:
+		}
+	}
+	g.files[f] = nil
+	gc.Unlock()
+	<-g.done
+	return g.files[f]
+}
+
+// loop performs the commits until the group commit is closed.
+func (gc *groupCommit) loop() {
+	defer gc.wg.Done()
+	for {
+		select {
+		case <-gc.kick:
+			gc.commitNext()
+		case <-gc.quit:
+			return
+		}
+	}
+}
+
+// commitNext syncs the files of the group that is waiting, if any.
+func (gc *groupCommit) commitNext() {
+	gc.Lock()
+	g := gc.next
+	gc.next = nil
+	gc.Unlock()
+	if g == nil {
+		return
+	}
+	for f := range g.files {
+		g.files[f] = f.Sync()
+	}
+	atomic.AddInt64(&gc.commits, 1)
+	close(g.done)
+}
+
+// close stops the commit loop. A group that is still waiting is committed
+// before returning, and later syncs are performed directly.
+func (gc *groupCommit) close() {
+	gc.Lock()
+	gc.closed = true
+	gc.Unlock()
+	close(gc.quit)
+	gc.wg.Wait()
+	gc.commitNext()
+}
+
+////////////////////////////////////////////////////////////////////////////
+// Disk space check
+////////////////////////////////////////////////////////////////////////////
+
+// diskSpaceCheck reports if the free disk space is below the reserved
+// space. The free space is checked at most every diskSpaceCheckInterval.
+type diskSpaceCheck struct {
+	sync.Mutex
+	dir       string
+	reserved  uint64
+	lastCheck time.Time
+	full      bool
+}
+
+// hasSpace returns false if the free disk space is below the reserved
+// space. If the free space can't be checked, the disk is assumed to
+// have space.
+func (d *diskSpaceCheck) hasSpace() bool {
+	if d == nil {
+		return true
+	}
+	d.Lock()
+	defer d.Unlock()
+	if now := time.Now(); now.Sub(d.lastCheck) >= diskSpaceCheckInterval {
+		d.lastCheck = now
+		free, err := freeDiskSpace(d.dir)
+		d.full = err == nil && free < d.reserved
+	}
+	return !d.full
+}
+
 ////////////////////////////////////////////////////////////////////////////
 // FileMsgStore methods
 ////////////////////////////////////////////////////////////////////////////
 
-// newFileMsgStore returns a new instace of a file MsgStore.
-func (fs *FileStore) newFileMsgStore(channelDirName, channel string, doRecover bool) (*FileMsgStore, error) {
+// newFileMsgStore returns a new instace of a file MsgStore, with the given
+// limits of the store.
+func (fs *FileStore) newFileMsgStore(channelDirName, channel string, limits ChannelLimits, doRecover bool) (*FileMsgStore, error) {
 	var err error
 	var file *os.File
 
 	// Create an instance and initialize
 	ms := &FileMsgStore{
-		opts:     &fs.opts,
-		crcTable: fs.crcTable,
+		opts:      &fs.opts,
+		crcTable:  fs.crcTable,
+		commit:    fs.commit,
+		diskSpace: fs.diskSpace,
+	}
+	ms.init(channel, limits, fs.budget, fs.stamper)
+
+	// The saved state is valid only until the store is modified, so remove
+	// the file now, it is written again when the store is closed. This way,
+	// the messages are always read on startup after a crash.
+	stateFile := filepath.Join(channelDirName, msgsStateFileName)
+	var state *spb.MsgStoreState
+	// On compacted channels, the keys of the messages are needed to
+	// compact the files in the background, so the messages are read now.
+	if doRecover && ms.opts.LazyRecovery && ms.keys == nil {
+		state = ms.readState(stateFile)
+	}
+	if ms.opts.ReadOnly {
+		// Don't write the state file when the store is closed.
+		stateFile = ""
+	} else if err := os.Remove(stateFile); err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("unable to remove state file for [%s]: %v", channel, err)
 	}
-	ms.init(channel, fs.limits)
 
 	// Open/create all the files
 	for i := 0; i < numFiles; i++ {
@@ -911,7 +2004,7 @@ func (fs *FileStore) newFileMsgStore(channelDirName, channel string, doRecover b
 		fileName := filepath.Join(channelDirName, fmt.Sprintf("msgs.%d.dat", (i+1)))
 
 		// Open the file.
-		file, err = openFile(fileName)
+		file, err = openFile(fileName, ms.opts.fileModes()...)
 		if err != nil {
 			break
 		}
@@ -919,7 +2012,10 @@ func (fs *FileStore) newFileMsgStore(channelDirName, channel string, doRecover b
 		ms.files[i] = &fileSlice{fileName: fileName}
 
 		// Should we try to recover (startup case)
-		if doRecover {
+		if state != nil {
+			// The messages will be read on first access.
+			err = file.Close()
+		} else if doRecover {
 			err = ms.recoverOneMsgFile(file, i)
 		} else if i == 0 {
 			// Otherwise, keep the first file opened...
@@ -943,15 +2039,159 @@ func (fs *FileStore) newFileMsgStore(channelDirName, channel string, doRecover b
 		err = fmt.Errorf("unable to %s message store for [%s]: %v", action, channel, err)
 		return nil, err
 	}
+	if state != nil {
+		ms.setFirst(state.First)
+		ms.setLast(state.Last)
+		ms.totalCount = int(state.TotalCount)
+		ms.totalBytes = state.TotalBytes
+	} else {
+		ms.loaded = true
+	}
+	ms.stateFile = stateFile
+	if ms.opts.Tier != nil {
+		ms.tierFile = filepath.Join(channelDirName, tierIndexFileName)
+		if ms.tierDir, err = filepath.Rel(fs.rootDir, unshardedDir(channelDirName, channel)); err == nil {
+			ms.tierDir = filepath.ToSlash(ms.tierDir)
+			err = ms.recoverTierIndex()
+		}
+		if err != nil {
+			ms.Close()
+			return nil, fmt.Errorf("unable to recover tier index for [%s]: %v", channel, err)
+		}
+	}
+	if ms.file != nil {
+		if err := ms.preallocate(ms.file); err != nil {
+			ms.Close()
+			return nil, fmt.Errorf("unable to preallocate message store for [%s]: %v", channel, err)
+		}
+	}
+
+	// On compacted channels, records of superseded messages are removed
+	// from the files in the background.
+	if ms.keys != nil && ms.opts.CompactEnabled {
+		ms.compactQuit = make(chan struct{})
+		ms.compactWg.Add(1)
+		go ms.compactLoop(time.Duration(ms.opts.CompactInterval) * time.Second)
+	}
+	if ms.opts.RetentionRate > 0 {
+		ms.retainQuit = make(chan struct{})
+		ms.retainWg.Add(1)
+		go ms.retentionLoop(retentionInterval)
+	}
 
 	return ms, nil
 }
 
+// readState returns the state saved in the given file, or nil if the
+// file does not exist or can't be read.
+func (ms *FileMsgStore) readState(fileName string) *spb.MsgStoreState {
+	if _, err := os.Stat(fileName); err != nil {
+		return nil
+	}
+	file, err := openFile(fileName, os.O_RDONLY)
+	if err != nil {
+		return nil
+	}
+	defer file.Close()
+	buf, size, _, err := readRecord(file, nil, false, ms.crcTable, true)
+	if err != nil {
+		return nil
+	}
+	state := &spb.MsgStoreState{}
+	if err := state.Unmarshal(buf[:size]); err != nil {
+		return nil
+	}
+	return state
+}
+
+// writeState saves the state of the store in the state file.
+// Lock is held on entry.
+func (ms *FileMsgStore) writeState() error {
+	state := &spb.MsgStoreState{
+		First:      ms.first,
+		Last:       ms.last,
+		TotalCount: uint64(ms.totalCount),
+		TotalBytes: ms.totalBytes,
+	}
+	file, err := openFile(ms.stateFile)
+	if err != nil {
+		return err
+	}
+	if _, _, err = writeRecord(file, nil, recNoType, state, ms.crcTable); err == nil && ms.opts.DoSync {
+		err = file.Sync()
+	}
+	if lerr := file.Close(); lerr != nil && err == nil {
+		err = lerr
+	}
+	return err
+}
+
+// load reads the messages of a lazily recovered store. This is a no-op
+// if the messages have already been read.
+func (ms *FileMsgStore) load() error {
+	ms.RLock()
+	loaded := ms.loaded
+	ms.RUnlock()
+	if loaded {
+		return nil
+	}
+	ms.Lock()
+	err := ms.loadLocked()
+	ms.Unlock()
+	return err
+}
+
+// loadLocked reads the messages of a lazily recovered store.
+// Lock is held on entry.
+func (ms *FileMsgStore) loadLocked() error {
+	if ms.loaded || ms.closed {
+		return nil
+	}
+	// The state is recomputed from the messages.
+	ms.setFirst(0)
+	ms.setLast(0)
+	ms.totalCount, ms.totalBytes = 0, 0
+	ms.currSliceIdx = 0
+	for i := 0; i < numFiles; i++ {
+		ms.files[i] = &fileSlice{fileName: ms.files[i].fileName}
+	}
+	if ms.file != nil {
+		ms.file.Close()
+		ms.setFile(nil)
+	}
+	for i := 0; i < numFiles; i++ {
+		file, err := openFile(ms.files[i].fileName, ms.opts.fileModes()...)
+		if err == nil {
+			err = ms.recoverOneMsgFile(file, i)
+		}
+		if err != nil {
+			// Don't save a state that does not match the files.
+			ms.stateFile = ""
+			// The error is returned as is, so that callers can check
+			// for ErrCorruptedData.
+			Noticef("Unable to load message store for [%s]: %v", ms.subject, err)
+			return err
+		}
+	}
+	ms.loaded = true
+	ms.startExpiryTimer()
+	return nil
+}
+
+// preallocate reserves PreallocateSize bytes of disk space for the file,
+// if set.
+func (ms *FileMsgStore) preallocate(file *os.File) error {
+	if ms.opts.PreallocateSize <= 0 {
+		return nil
+	}
+	return preallocateFile(file, ms.opts.PreallocateSize)
+}
+
 func (ms *FileMsgStore) setFile(f *os.File) {
 	ms.bw = nil
 	ms.file = f
 	if ms.file != nil {
-		ms.bw = bufio.NewWriterSize(ms.file, ms.opts.BufferSize)
+		ms.bw = bufio.NewWriterSize(chaosWriter(ms.file), ms.opts.BufferSize)
 	}
 }
 
@@ -960,17 +2200,48 @@ func (ms *FileMsgStore) recoverOneMsgFile(file *os.File, numFile int) error {
 	var err error
 
 	msgSize := 0
+	numRecs := 0
 	var msg *pb.MsgProto
 
+	var ext *spb.MsgExt
+
 	fslice := ms.files[numFile]
 
+	recoverMsg := func(msg *pb.MsgProto, ext *spb.MsgExt) {
+		if fslice.firstMsg == nil {
+			fslice.firstMsg = msg
+		}
+		fslice.lastMsg = msg
+		fslice.msgsCount++
+		fslice.msgsSize += uint64(len(msg.Data))
+		numRecs++
+
+		if ms.first == 0 {
+			ms.setFirst(msg.Sequence)
+		}
+		ms.setLast(msg.Sequence)
+		ms.addMsg(msg, ext)
+		ms.totalCount++
+		ms.totalBytes += uint64(len(msg.Data))
+
+		// On compacted channels, a message may supersede one that was
+		// recovered earlier.
+		ms.supersedeMsg(msg.Sequence, ext)
+	}
+
+	// The messages of an atomic batch are recovered once its last
+	// message has been read.
+	var batch []*msgRecord
+	// The records start after the fileVersion (4 bytes).
+	offset, batchOffset := int64(4), int64(0)
+
 	// Create a buffered reader to speed-up recovery
 	br := bufio.NewReaderSize(file, defaultBufSize)
 
 	for {
 		ms.tmpMsgBuf, msgSize, _, err = readRecord(br, ms.tmpMsgBuf, false, ms.crcTable, ms.opts.DoCRC)
 		if err != nil {
-			if err == io.EOF {
+			if ms.opts.isEndOfFile(err) || (err == io.ErrUnexpectedEOF && batch != nil) {
 				// We are done, reset err
 				err = nil
 			}
@@ -981,28 +2252,49 @@ func (ms *FileMsgStore) recoverOneMsgFile(file *os.File, numFile int) error {
 		msg = &pb.MsgProto{}
 		err = msg.Unmarshal(ms.tmpMsgBuf[:msgSize])
 		if err != nil {
+			err = ErrCorruptedData
+			break
+		}
+		// Recover the message attributes, if any.
+		ext = &spb.MsgExt{}
+		err = ext.Unmarshal(ms.tmpMsgBuf[:msgSize])
+		if err != nil {
+			err = ErrCorruptedData
 			break
 		}
 
-		if fslice.firstMsg == nil {
-			fslice.firstMsg = msg
+		if batch == nil {
+			batchOffset = offset
 		}
-		fslice.lastMsg = msg
-		fslice.msgsCount++
-		fslice.msgsSize += uint64(len(msg.Data))
+		offset += int64(recordHeaderSize + msgSize)
+		if ext.BatchNext > 0 || batch != nil {
+			last := ext.BatchNext == 0
+			ext.BatchNext = 0
+			batch = append(batch, &msgRecord{msg: msg, ext: ext})
+			if !last {
+				continue
+			}
+			for _, rec := range batch {
+				recoverMsg(rec.msg, rec.ext)
+			}
+			batch = nil
+			continue
+		}
+		recoverMsg(msg, ext)
+	}
 
-		if ms.first == 0 {
-			ms.first = msg.Sequence
+	// Drop the messages of a batch that was not completely written,
+	// so that none of them is stored.
+	if err == nil && batch != nil {
+		Noticef("Dropping %v messages of an incomplete batch of channel=%s", len(batch), ms.subject)
+		if !ms.opts.ReadOnly {
+			err = file.Truncate(batchOffset)
 		}
-		ms.msgs[msg.Sequence] = msg
 	}
 
-	// Do more accounting and bump the current slice index if we recovered
-	// at least one message on that file.
-	if err == nil && fslice.msgsCount > 0 {
-		ms.last = fslice.lastMsg.Sequence
-		ms.totalCount += fslice.msgsCount
-		ms.totalBytes += fslice.msgsSize
+	// Bump the current slice index if we recovered at least one message
+	// on that file.
+	if err == nil && numRecs > 0 {
 		ms.currSliceIdx = numFile
 
 		// Close the previous file
@@ -1012,7 +2304,7 @@ func (ms *FileMsgStore) recoverOneMsgFile(file *os.File, numFile int) error {
 		}
 	}
 	// Keep the file opened if this is the first or messages were recovered
-	if err == nil && (fslice.msgsCount > 0 || numFile == 0) {
+	if err == nil && (numRecs > 0 || numFile == 0) {
 		ms.setFile(file)
 	} else {
 		// Close otherwise...
@@ -1026,10 +2318,128 @@ func (ms *FileMsgStore) recoverOneMsgFile(file *os.File, numFile int) error {
 }
 
 // Store a given message.
-func (ms *FileMsgStore) Store(reply string, data []byte) (*pb.MsgProto, error) {
+func (ms *FileMsgStore) Store(reply string, data []byte, ext *spb.MsgExt) (*pb.MsgProto, error) {
+	ms.Lock()
+	defer ms.Unlock()
+
+	if err := ms.loadLocked(); err != nil {
+		return nil, err
+	}
+	seq, now, err := ms.stamp()
+	if err != nil {
+		return nil, err
+	}
+	m := &pb.MsgProto{
+		Sequence:  seq,
+		Subject:   ms.subject,
+		Reply:     reply,
+		Data:      data,
+		Timestamp: now,
+	}
+	if err := ms.storeMsg(m, ext, m.Timestamp); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// StoreMsg stores the given message, keeping its sequence and timestamp.
+func (ms *FileMsgStore) StoreMsg(m *pb.MsgProto, ext *spb.MsgExt) error {
 	ms.Lock()
 	defer ms.Unlock()
 
+	if err := ms.loadLocked(); err != nil {
+		return err
+	}
+	if m.Sequence <= ms.last {
+		return ErrSeqOutOfOrder
+	}
+	return ms.storeMsg(m, ext, time.Now().UnixNano())
+}
+
+// StoreBatch stores the given messages atomically. They are written in the
+// same file slice, each record holding the number of messages that follow
+// it in the batch, so that an incomplete batch can be dropped on recovery.
+func (ms *FileMsgStore) StoreBatch(msgs []*BatchMsg) ([]*pb.MsgProto, error) {
+	ms.Lock()
+	defer ms.Unlock()
+
+	if err := ms.loadLocked(); err != nil {
+		return nil, err
+	}
+	if err := ms.checkWritable(); err != nil {
+		return nil, err
+	}
+	if err := ms.nextSliceIfNeeded(); err != nil {
+		return nil, err
+	}
+	seq, now, err := ms.stamp()
+	if err != nil {
+		return nil, err
+	}
+	stored := make([]*pb.MsgProto, len(msgs))
+	for i, bm := range msgs {
+		m := &pb.MsgProto{
+			Sequence:  seq + uint64(i),
+			Subject:   ms.subject,
+			Reply:     bm.Reply,
+			Data:      bm.Data,
+			Timestamp: now,
+		}
+		// The marker is only in the record, not in the attributes
+		// returned by LookupExt.
+		ext := bm.Ext
+		if next := len(msgs) - 1 - i; next > 0 {
+			recExt := spb.MsgExt{}
+			if ext != nil {
+				recExt = *ext
+			}
+			recExt.BatchNext = uint32(next)
+			ext = &recExt
+		}
+		if err := ms.writeMsg(m, ext); err != nil {
+			return nil, err
+		}
+		stored[i] = m
+	}
+	for i, m := range stored {
+		if err := ms.addStoredMsg(m, msgs[i].Ext, now); err != nil {
+			return nil, err
+		}
+	}
+	return stored, nil
+}
+
+// storeMsg writes the message in the current file slice, moving to the
+// next one if needed, and enforces the limits.
+// Lock is held on entry.
+func (ms *FileMsgStore) storeMsg(m *pb.MsgProto, ext *spb.MsgExt, now int64) error {
+	if err := ms.checkWritable(); err != nil {
+		return err
+	}
+	if err := ms.nextSliceIfNeeded(); err != nil {
+		return err
+	}
+	if err := ms.writeMsg(m, ext); err != nil {
+		return err
+	}
+	return ms.addStoredMsg(m, ext, now)
+}
+
+// checkWritable returns an error if messages can't be stored.
+// Lock is held on entry.
+func (ms *FileMsgStore) checkWritable() error {
+	if ms.opts.ReadOnly {
+		return ErrReadOnly
+	}
+	if !ms.diskSpace.hasSpace() {
+		return ErrNoSpace
+	}
+	return nil
+}
+
+// nextSliceIfNeeded moves to the next file slice if the current one is full.
+// Lock is held on entry.
+func (ms *FileMsgStore) nextSliceIfNeeded() error {
 	fslice := ms.files[ms.currSliceIdx]
 
 	// Check if we need to move to next file slice
@@ -1042,44 +2452,50 @@ func (ms *FileMsgStore) Store(reply string, data []byte) (*pb.MsgProto, error) {
 
 		// Close the file and open the next slice
 		if err := ms.flush(); err != nil {
-			return nil, err
+			return err
 		}
 		if err := ms.file.Close(); err != nil {
-			return nil, err
+			return err
 		}
 		file, err := openFile(ms.files[nextSlice].fileName)
 		if err != nil {
-			return nil, err
+			return err
+		}
+		if err := ms.preallocate(file); err != nil {
+			file.Close()
+			return err
 		}
 		// Success, update the store's variables
 		ms.setFile(file)
 		ms.currSliceIdx = nextSlice
-
-		fslice = ms.files[ms.currSliceIdx]
-	}
-
-	seq := ms.last + 1
-	m := &pb.MsgProto{
-		Sequence:  seq,
-		Subject:   ms.subject,
-		Reply:     reply,
-		Data:      data,
-		Timestamp: time.Now().UnixNano(),
 	}
+	return nil
+}
 
+// writeMsg writes the record of the message in the current file slice.
+// Lock is held on entry.
+func (ms *FileMsgStore) writeMsg(m *pb.MsgProto, ext *spb.MsgExt) error {
 	var err error
-	ms.tmpMsgBuf, _, err = writeRecord(ms.bw, ms.tmpMsgBuf, recNoType, m, ms.crcTable)
-	if err != nil {
-		return nil, err
-	}
+	rec := &msgRecord{msg: m, ext: ext}
+	ms.tmpMsgBuf, _, err = writeRecord(ms.bw, ms.tmpMsgBuf, recNoType, rec, ms.crcTable)
+	chaosKillPoint("message write")
+	return err
+}
 
+// addStoredMsg adds the written message to the store and the current file
+// slice, and enforces the limits.
+// Lock is held on entry.
+func (ms *FileMsgStore) addStoredMsg(m *pb.MsgProto, ext *spb.MsgExt, now int64) error {
+	fslice := ms.files[ms.currSliceIdx]
+
+	seq := m.Sequence
 	if ms.first == 0 {
-		ms.first = 1
+		ms.setFirst(seq)
 	}
-	ms.last = seq
-	ms.msgs[ms.last] = m
+	ms.setLast(seq)
+	ms.addMsg(m, ext)
 
-	msgSize := uint64(len(data))
+	msgSize := uint64(len(m.Data))
 
 	// Total stats
 	ms.totalCount++
@@ -1089,80 +2505,382 @@ func (ms *FileMsgStore) Store(reply string, data []byte) (*pb.MsgProto, error) {
 	fslice.msgsCount++
 	fslice.msgsSize += msgSize
 
-	// Save references to first and last message for this slice
-	if fslice.firstMsg == nil {
-		fslice.firstMsg = m
+	// Save references to first and last message for this slice
+	if fslice.firstMsg == nil {
+		fslice.firstMsg = m
+	}
+	fslice.lastMsg = m
+
+	// On compacted channels, remove the previous message with the same key.
+	ms.supersedeMsg(seq, ext)
+
+	// Enfore limits and update file slice if needed, unless this is
+	// done in the background.
+	if ms.retainQuit == nil {
+		if _, _, err := ms.enforceLimits(now, 0); err != nil {
+			return err
+		}
+	}
+	// The message is stored, failing to offload old files is not an error
+	// for the publisher, this will be attempted again on the next message.
+	if err := ms.offloadSlices(now); err != nil {
+		Noticef("Unable to offload messages of channel=%s: %v", ms.subject, err)
+	}
+	return nil
+}
+
+// Lookup returns the stored message with given sequence number, reading
+// it from the tier if it has been offloaded, nil if it has expired.
+func (ms *FileMsgStore) Lookup(seq uint64) (*pb.MsgProto, error) {
+	if err := ms.load(); err != nil {
+		return nil, err
+	}
+	if m, _ := ms.genericMsgStore.Lookup(seq); m != nil || ms.tierFile == "" {
+		return m, nil
+	}
+	m, ext, err := ms.lookupTiered(seq)
+	if isExpiredExt(ext, time.Now().UnixNano()) {
+		return nil, err
+	}
+	return m, err
+}
+
+// LookupExt returns the attributes stored with the message of given
+// sequence number, nil if there are none.
+func (ms *FileMsgStore) LookupExt(seq uint64) *spb.MsgExt {
+	if ms.load() != nil {
+		return nil
+	}
+	if ms.tierFile != "" && seq < ms.genericMsgStore.FirstSequence() {
+		_, ext, _ := ms.lookupTiered(seq)
+		return ext
+	}
+	return ms.genericMsgStore.LookupExt(seq)
+}
+
+// LookupRange returns the messages stored with a sequence between first
+// and last included, at most max of them unless max is 0, including the
+// messages offloaded to the tier.
+func (ms *FileMsgStore) LookupRange(first, last uint64, max int) ([]*pb.MsgProto, error) {
+	if err := ms.load(); err != nil {
+		return nil, err
+	}
+	if ms.tierFile == "" {
+		return ms.genericMsgStore.LookupRange(first, last, max)
+	}
+	storeFirst, storeLast := ms.FirstAndLastSequence()
+	return lookupRange(first, last, storeFirst, storeLast, max, ms.Lookup)
+}
+
+// FirstSequence returns sequence for first message stored, including
+// the messages offloaded to the tier.
+func (ms *FileMsgStore) FirstSequence() uint64 {
+	if ms.tierFile == "" {
+		return ms.genericMsgStore.FirstSequence()
+	}
+	first, _ := ms.FirstAndLastSequence()
+	return first
+}
+
+// FirstAndLastSequence returns sequences for the first and last messages
+// stored, including the messages offloaded to the tier.
+func (ms *FileMsgStore) FirstAndLastSequence() (uint64, uint64) {
+	ms.RLock()
+	first, last := ms.first, ms.last
+	if len(ms.tiered) > 0 {
+		first = ms.tiered[0].first
+	}
+	ms.RUnlock()
+	return first, last
+}
+
+// State returns the number and size of the messages stored, including
+// the messages offloaded to the tier.
+func (ms *FileMsgStore) State() (int, uint64, error) {
+	ms.RLock()
+	c, b := ms.totalCount+ms.tieredCount, ms.totalBytes+ms.tieredBytes
+	ms.RUnlock()
+	return c, b, nil
+}
+
+// FirstMsg returns the first message stored.
+func (ms *FileMsgStore) FirstMsg() (*pb.MsgProto, error) {
+	if err := ms.load(); err != nil {
+		return nil, err
+	}
+	return ms.genericMsgStore.FirstMsg()
+}
+
+// LastMsg returns the last message stored.
+func (ms *FileMsgStore) LastMsg() (*pb.MsgProto, error) {
+	if err := ms.load(); err != nil {
+		return nil, err
 	}
-	fslice.lastMsg = m
+	return ms.genericMsgStore.LastMsg()
+}
 
-	// Enfore limits and update file slice if needed.
-	if err := ms.enforceLimits(); err != nil {
+// LastMsgForKey returns the latest message stored with the given key.
+func (ms *FileMsgStore) LastMsgForKey(key string) (*pb.MsgProto, error) {
+	if err := ms.load(); err != nil {
 		return nil, err
 	}
-	return m, nil
+	return ms.genericMsgStore.LastMsgForKey(key)
+}
+
+// GetSequenceFromTimestamp returns the sequence of the first message whose
+// timestamp is greater or equal to given timestamp, including the messages
+// offloaded to the tier.
+func (ms *FileMsgStore) GetSequenceFromTimestamp(timestamp int64) uint64 {
+	if ms.load() != nil {
+		return 0
+	}
+	seq := ms.genericMsgStore.GetSequenceFromTimestamp(timestamp)
+	if ms.tierFile != "" && seq <= ms.genericMsgStore.FirstSequence() {
+		if tseq := ms.tieredSequenceFromTimestamp(timestamp); tseq != 0 {
+			return tseq
+		}
+	}
+	return seq
+}
+
+// supersedeMsg removes the message that has the same key than the message
+// with sequence `seq`, if this store is for a compacted channel. The file
+// slice that holds the removed message is updated, but the record stays
+// in the file until the slice is compacted.
+// Lock is held on entry.
+func (ms *FileMsgStore) supersedeMsg(seq uint64, ext *spb.MsgExt) {
+	prev := ms.supersede(seq, ext)
+	if prev == nil {
+		return
+	}
+	if prev.Sequence == ms.first {
+		ms.setFirst(ms.nextSeq(ms.first))
+	}
+	for _, slice := range ms.files {
+		if slice == nil || slice.msgsCount == 0 ||
+			prev.Sequence < slice.firstMsg.Sequence || prev.Sequence > slice.lastMsg.Sequence {
+			continue
+		}
+		slice.msgsCount--
+		slice.msgsSize -= uint64(len(prev.Data))
+		slice.rmCount++
+		if slice.msgsCount == 0 {
+			slice.firstMsg = nil
+			slice.lastMsg = nil
+		} else if prev.Sequence == slice.firstMsg.Sequence {
+			slice.firstMsg = ms.msgs[ms.nextSeq(prev.Sequence)]
+		} else if prev.Sequence == slice.lastMsg.Sequence {
+			seq := prev.Sequence - 1
+			for ms.msgs[seq] == nil {
+				seq--
+			}
+			slice.lastMsg = ms.msgs[seq]
+		}
+		return
+	}
 }
 
 // enforceLimits checks total counts with current msg store's limits,
 // removing a file slice and/or updating slices' count as necessary.
-func (ms *FileMsgStore) enforceLimits() error {
+// Messages that have expired at `now` are removed too. If `maxBytes` is
+// not 0, messages stop being removed once their size reaches it, at least
+// one message being removed. The files offloaded to the tier are trimmed
+// first (see enforceTierLimits). The number and size of the removed local
+// messages are returned.
+// Lock is held on entry.
+func (ms *FileMsgStore) enforceLimits(now int64, maxBytes uint64) (int, uint64, error) {
+	if len(ms.tiered) > 0 {
+		if err := ms.enforceTierLimits(now); err != nil {
+			return 0, 0, err
+		}
+	}
+	removed, removedBytes := 0, uint64(0)
 	// We may inspect several slices, start with the first at index 0.
 	idx := 0
 	// Check if we need to remove any (but leave at least the last added).
 	// Note that we may have to remove more than one msg if we are here
-	// after a restart with smaller limits than originally set.
-	for ms.totalCount > 1 &&
+	// after a restart with smaller limits than originally set, or
+	// while the memory budget is exceeded if trimming is enabled.
+	for (maxBytes == 0 || removedBytes < maxBytes) &&
+		ms.totalCount > 1 &&
 		((ms.totalCount > ms.limits.MaxNumMsgs) ||
-			(ms.totalBytes > ms.limits.MaxMsgBytes)) {
-
-		// slice we are inspecting
-		slice := ms.files[idx]
-		// Size of the first message in this slice
-		firstMsgSize := uint64(len(slice.firstMsg.Data))
-		// Update slice and total counts
-		slice.msgsCount--
-		slice.msgsSize -= firstMsgSize
-		ms.totalCount--
-		ms.totalBytes -= firstMsgSize
-
-		// Remove the first message from our cache
-		if !ms.hitLimit {
+			(ms.totalBytes > ms.limits.MaxMsgBytes) ||
+			ms.isExpired(ms.first, now) ||
+			ms.budget.mustTrim()) {
+
+		expired := ms.isExpired(ms.first, now)
+		firstMsgSize := uint64(len(ms.msgs[ms.first].Data))
+		var err error
+		idx, err = ms.removeFirstMsg(idx)
+		removed++
+		removedBytes += firstMsgSize
+		if err != nil {
+			return removed, removedBytes, err
+		}
+		if !expired && !ms.hitLimit {
 			ms.hitLimit = true
 			Noticef(droppingMsgsFmt, ms.subject, ms.totalCount, ms.limits.MaxNumMsgs, ms.totalBytes, ms.limits.MaxMsgBytes)
 		}
-		delete(ms.msgs, ms.first)
+		// This should not happen, but just in case...
+		if idx > ms.currSliceIdx {
+			break
+		}
+	}
+	ms.startExpiryTimer()
+	return removed, removedBytes, nil
+}
 
-		// Messages sequence is incremental with no gap on a given msgstore.
-		ms.first++
-		// Is file slice "empty"
-		if slice.msgsCount == 0 {
-			// If we are at the last file slice, remove the first.
-			if ms.currSliceIdx == numFiles-1 {
-				if err := ms.removeAndShiftFiles(); err != nil {
-					return err
-				}
-				// Decrement the current slice. It will be bumped if needed
-				// before storing the next message.
-				ms.currSliceIdx--
-				// The first slice is gone, go back to 0.
-				idx = 0
-			} else {
-				// No more message...
-				slice.firstMsg = nil
-				slice.lastMsg = nil
-
-				// We move the index to check the other slices if needed.
-				idx++
-				// This should not happen, but just in case...
-				if idx > ms.currSliceIdx {
-					break
-				}
+// startExpiryTimer sets up the expiry timer for the first message (see
+// setExpiryTimer), unless the store is read-only, its messages are not
+// read yet, or the background retention, which also removes the expired
+// messages, is enabled.
+// Lock is held on entry.
+func (ms *FileMsgStore) startExpiryTimer() {
+	if ms.loaded && ms.retainQuit == nil && !ms.opts.ReadOnly {
+		ms.setExpiryTimer(ms.expire)
+	}
+}
+
+// expire is called by the expiry timer to remove the expired messages
+// at the head of the log.
+func (ms *FileMsgStore) expire() {
+	var err error
+	ms.Lock()
+	if !ms.closed && ms.loaded {
+		ms.expireAt = 0
+		_, _, err = ms.enforceLimits(time.Now().UnixNano(), 0)
+	}
+	ms.Unlock()
+	if err != nil {
+		Noticef("Unable to remove expired messages of channel=%s: %v", ms.subject, err)
+	}
+}
+
+// removeFirstMsg removes the first message from the cache and from the
+// counts of its file slice, looked up from the slice at index `idx`. The
+// first slice is removed once empty if all the slices are in use. It
+// returns the index of the slice to look up the next message from.
+// Lock is held on entry.
+func (ms *FileMsgStore) removeFirstMsg(idx int) (int, error) {
+	// Skip slices that may have been emptied by key compaction.
+	for ms.files[idx].msgsCount == 0 && idx < ms.currSliceIdx {
+		idx++
+	}
+	// slice we are inspecting
+	slice := ms.files[idx]
+	// Size of the first message in this slice
+	firstMsgSize := uint64(len(ms.msgs[ms.first].Data))
+	// Update slice and total counts
+	slice.msgsCount--
+	slice.msgsSize -= firstMsgSize
+	ms.totalCount--
+	ms.totalBytes -= firstMsgSize
+
+	// Remove the first message from our cache
+	ms.removeMsg(ms.first)
+
+	// Messages sequence is incremental, but there may be gaps on
+	// compacted channels.
+	ms.setFirst(ms.nextSeq(ms.first))
+	// Is file slice "empty"
+	if slice.msgsCount == 0 {
+		slice.firstMsg = nil
+		slice.lastMsg = nil
+		// If we are at the last file slice, remove the first.
+		if ms.currSliceIdx == numFiles-1 {
+			if err := ms.removeAndShiftFiles(); err != nil {
+				return idx, err
 			}
-		} else {
-			// This is the new first message in this slice.
-			slice.firstMsg = ms.msgs[ms.first]
+			// Decrement the current slice. It will be bumped if needed
+			// before storing the next message.
+			ms.currSliceIdx--
+			// The first slice is gone, go back to 0.
+			return 0, nil
 		}
+		// We move the index to check the other slices if needed.
+		return idx + 1, nil
 	}
-	return nil
+	// This is the new first message in this slice.
+	slice.firstMsg = ms.msgs[ms.first]
+	return idx, nil
+}
+
+// PurgeBefore implements the PurgeMsgStore interface. As for the limits,
+// the records of the removed messages stay in the files until their file
+// slice is removed, so the messages may be recovered after a restart.
+func (ms *FileMsgStore) PurgeBefore(seq uint64) (int, error) {
+	ms.Lock()
+	defer ms.Unlock()
+	if ms.opts.ReadOnly {
+		return 0, ErrReadOnly
+	}
+	if err := ms.loadLocked(); err != nil {
+		return 0, err
+	}
+	removed, idx := 0, 0
+	for ms.totalCount > 1 && ms.first < seq && idx <= ms.currSliceIdx {
+		var err error
+		idx, err = ms.removeFirstMsg(idx)
+		removed++
+		if err != nil {
+			return removed, err
+		}
+	}
+	return removed, nil
+}
+
+// retentionLoop enforces the limits every `interval`, removing at most
+// RetentionRate bytes of messages per second, until the store is closed.
+func (ms *FileMsgStore) retentionLoop(interval time.Duration) {
+	defer ms.retainWg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	allowance := uint64(ms.opts.RetentionRate) * uint64(interval) / uint64(time.Second)
+	if allowance == 0 {
+		allowance = 1
+	}
+	for {
+		select {
+		case <-ms.retainQuit:
+			return
+		case <-ticker.C:
+			var err error
+			ms.Lock()
+			// The messages of a lazily recovered store are trimmed once read.
+			if !ms.closed && ms.loaded {
+				var n int
+				var b uint64
+				n, b, err = ms.enforceLimits(time.Now().UnixNano(), allowance)
+				ms.retainMsgs += uint64(n)
+				ms.retainBytes += b
+			}
+			ms.Unlock()
+			if err != nil {
+				Noticef("Unable to enforce limits of channel=%s: %v", ms.subject, err)
+			}
+		}
+	}
+}
+
+// RetentionStats returns the progress of the background enforcement of
+// the limits, or nil if the limits are enforced as messages are stored.
+func (ms *FileMsgStore) RetentionStats() *RetentionStats {
+	if ms.retainQuit == nil {
+		return nil
+	}
+	ms.RLock()
+	defer ms.RUnlock()
+	rs := &RetentionStats{
+		RemovedMsgs:  ms.retainMsgs,
+		RemovedBytes: ms.retainBytes,
+	}
+	if ms.totalCount > ms.limits.MaxNumMsgs {
+		rs.ExcessMsgs = ms.totalCount - ms.limits.MaxNumMsgs
+	}
+	if ms.totalBytes > ms.limits.MaxMsgBytes {
+		rs.ExcessBytes = ms.totalBytes - ms.limits.MaxMsgBytes
+	}
+	return rs
 }
 
 // removeAndShiftFiles
@@ -1183,8 +2901,9 @@ func (ms *FileMsgStore) removeAndShiftFiles() error {
 		if err := os.Rename(file2.fileName, file1.fileName); err != nil {
 			return err
 		}
-		// Update total stats for the first store being removed
-		if i == 0 {
+		// Update total stats for the first store being removed (if
+		// not already empty).
+		if i == 0 && file1.firstMsg != nil {
 			ms.totalCount -= file1.msgsCount
 			ms.totalBytes -= file1.msgsSize
 
@@ -1192,10 +2911,10 @@ func (ms *FileMsgStore) removeAndShiftFiles() error {
 			seqStart := file1.firstMsg.Sequence
 			seqEnd := file1.lastMsg.Sequence
 			for i := seqStart; i <= seqEnd; i++ {
-				delete(ms.msgs, i)
+				ms.removeMsg(i)
 			}
 			// Update sequence of first available message
-			ms.first = file2.firstMsg.Sequence
+			ms.setFirst(ms.nextSeq(seqEnd))
 		}
 
 		// Copy over values from the next slice
@@ -1203,6 +2922,7 @@ func (ms *FileMsgStore) removeAndShiftFiles() error {
 		file1.lastMsg = file2.lastMsg
 		file1.msgsCount = file2.msgsCount
 		file1.msgsSize = file2.msgsSize
+		file1.rmCount = file2.rmCount
 	}
 
 	var err error
@@ -1221,10 +2941,13 @@ func (ms *FileMsgStore) removeAndShiftFiles() error {
 	fslice.lastMsg = nil
 	fslice.msgsCount = 0
 	fslice.msgsSize = uint64(0)
+	fslice.rmCount = 0
 
-	// Now re-open the file we closed at the beginning, which is the one
-	// before last.
-	file, err = openFile(ms.files[numFiles-2].fileName)
+	// Now re-open the file we closed at the beginning, which has been
+	// shifted to the previous slice. This is the one before last, unless
+	// the first slice is removed before all the slices are in use, as
+	// when it is offloaded to the tier.
+	file, err = openFile(ms.files[ms.currSliceIdx-1].fileName)
 	if err != nil {
 		return err
 	}
@@ -1232,16 +2955,123 @@ func (ms *FileMsgStore) removeAndShiftFiles() error {
 	return nil
 }
 
+// compactLoop periodically compacts the file slices of a compacted
+// channel, until the store is closed.
+func (ms *FileMsgStore) compactLoop(interval time.Duration) {
+	defer ms.compactWg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ms.compactQuit:
+			return
+		case <-ticker.C:
+			if !ms.opts.inMaintenanceWindow() {
+				continue
+			}
+			ms.Lock()
+			err := ms.compactSlices()
+			ms.Unlock()
+			if err != nil {
+				Noticef("Unable to compact message store for channel=%s: %v", ms.subject, err)
+			}
+		}
+	}
+}
+
+// compactSlices rewrites the file slices that contain records of
+// messages removed by key compaction.
+// Lock is held on entry.
+func (ms *FileMsgStore) compactSlices() error {
+	if ms.closed {
+		return nil
+	}
+	for i := 0; i <= ms.currSliceIdx; i++ {
+		if ms.files[i].rmCount == 0 {
+			continue
+		}
+		if err := ms.compactSlice(i); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// compactSlice rewrites the remaining messages of the file slice at index
+// `idx` into a temporary file, then swaps back to the slice file.
+// Lock is held on entry.
+func (ms *FileMsgStore) compactSlice(idx int) error {
+	slice := ms.files[idx]
+	tmpFile, err := getTempFile(filepath.Dir(slice.fileName), filepath.Base(slice.fileName))
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if tmpFile != nil {
+			tmpFile.Close()
+			os.Remove(tmpFile.Name())
+		}
+	}()
+	bw := bufio.NewWriterSize(tmpFile, defaultBufSize)
+	if slice.msgsCount > 0 {
+		for seq := slice.firstMsg.Sequence; seq <= slice.lastMsg.Sequence; seq++ {
+			m := ms.msgs[seq]
+			if m == nil {
+				continue
+			}
+			rec := &msgRecord{msg: m, ext: ms.exts[seq]}
+			ms.tmpMsgBuf, _, err = writeRecord(bw, ms.tmpMsgBuf, recNoType, rec, ms.crcTable)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	// Flush the buffer on disk
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+	// Switch the temporary file with the original one.
+	if idx == ms.currSliceIdx {
+		if err := ms.flush(); err != nil {
+			return err
+		}
+		file, err := swapFiles(tmpFile, ms.file)
+		ms.setFile(file)
+		if err != nil {
+			return err
+		}
+	} else {
+		file, err := openFile(slice.fileName)
+		if err != nil {
+			return err
+		}
+		file, err = swapFiles(tmpFile, file)
+		if file != nil {
+			if lerr := file.Close(); lerr != nil && err == nil {
+				err = lerr
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	// Avoid unnecesary attempt to cleanup
+	tmpFile = nil
+
+	slice.rmCount = 0
+	return nil
+}
+
 // Close closes the store.
 func (ms *FileMsgStore) Close() error {
 	ms.Lock()
-	defer ms.Unlock()
-
 	if ms.closed {
+		ms.Unlock()
 		return nil
 	}
 
 	ms.closed = true
+	ms.stopExpiryTimer()
 
 	var err error
 	if ms.file != nil {
@@ -1250,6 +3080,20 @@ func (ms *FileMsgStore) Close() error {
 			err = lerr
 		}
 	}
+	if err == nil && ms.stateFile != "" {
+		err = ms.writeState()
+	}
+	ms.Unlock()
+
+	// Stop the background compaction and retention, if running.
+	if ms.compactQuit != nil {
+		close(ms.compactQuit)
+		ms.compactWg.Wait()
+	}
+	if ms.retainQuit != nil {
+		close(ms.retainQuit)
+		ms.retainWg.Wait()
+	}
 	return err
 }
 
@@ -1261,16 +3105,38 @@ func (ms *FileMsgStore) flush() error {
 		return err
 	}
 	if ms.opts.DoSync {
-		return ms.file.Sync()
+		return ms.commit.sync(ms.file)
 	}
 	return nil
 }
 
-// Flush flushes outstanding data into the store.
+// Flush flushes outstanding data into the store. The file is synced
+// without holding the lock, so lookups and stores on the channel are not
+// blocked while the sync is in progress.
 func (ms *FileMsgStore) Flush() error {
 	ms.Lock()
-	err := ms.flush()
+	if ms.bw == nil {
+		ms.Unlock()
+		return nil
+	}
+	if err := ms.bw.Flush(); err != nil || !ms.opts.DoSync {
+		ms.Unlock()
+		return err
+	}
+	file := ms.file
 	ms.Unlock()
+	chaosKillPoint("message flush")
+	err := ms.commit.sync(file)
+	if err != nil {
+		// The file is synced before being closed, either because the store
+		// is closed or because it was rotated, so the error can be ignored
+		// if this is what happened in the meantime.
+		ms.RLock()
+		if ms.closed || ms.file != file {
+			err = nil
+		}
+		ms.RUnlock()
+	}
 	return err
 }
 
@@ -1278,32 +3144,42 @@ func (ms *FileMsgStore) Flush() error {
 // FileSubStore methods
 ////////////////////////////////////////////////////////////////////////////
 
-// newFileSubStore returns a new instace of a file SubStore.
-func (fs *FileStore) newFileSubStore(channelDirName, channel string, doRecover bool) (*FileSubStore, error) {
+// newFileSubStore returns a new instace of a file SubStore, with the given
+// limits of the store.
+func (fs *FileStore) newFileSubStore(channelDirName, channel string, limits ChannelLimits, doRecover bool) (*FileSubStore, error) {
 	ss := &FileSubStore{
 		rootDir:  channelDirName,
 		subs:     make(map[uint64]*subscription),
 		opts:     &fs.opts,
 		crcTable: fs.crcTable,
+		commit:   fs.commit,
 	}
-	ss.init(channel, fs.limits)
+	ss.init(channel, limits)
 	// Convert the CompactInterval in time.Duration
 	ss.compactItvl = time.Duration(ss.opts.CompactInterval) * time.Second
 
 	var err error
 
 	fileName := filepath.Join(channelDirName, subsFileName)
-	ss.file, err = openFile(fileName)
+	ss.file, err = openFile(fileName, ss.opts.fileModes()...)
 	if err != nil {
 		return nil, err
 	}
-	ss.bw = bufio.NewWriterSize(ss.file, ss.opts.BufferSize)
+	// In read-only mode, there is nothing to flush.
+	if !ss.opts.ReadOnly {
+		ss.bw = bufio.NewWriterSize(chaosWriter(ss.file), ss.opts.BufferSize)
+	}
 	if doRecover {
 		if err := ss.recoverSubscriptions(); err != nil {
 			ss.Close()
 			return nil, fmt.Errorf("unable to create subscription store for [%s]: %v", channel, err)
 		}
 	}
+	if ss.opts.AckFlushInterval > 0 {
+		ss.ackQuit = make(chan struct{})
+		ss.ackWg.Add(1)
+		go ss.ackFlushLoop(ss.ackQuit, time.Duration(ss.opts.AckFlushInterval)*time.Millisecond)
+	}
 	return ss, nil
 }
 
@@ -1319,7 +3195,7 @@ func (ss *FileSubStore) recoverSubscriptions() error {
 	for {
 		ss.tmpSubBuf, recSize, recType, err = readRecord(br, ss.tmpSubBuf, true, ss.crcTable, ss.opts.DoCRC)
 		if err != nil {
-			if err == io.EOF {
+			if ss.opts.isEndOfFile(err) {
 				// We are done, reset err
 				err = nil
 				break
@@ -1333,7 +3209,7 @@ func (ss *FileSubStore) recoverSubscriptions() error {
 		case subRecNew:
 			newSub := &spb.SubState{}
 			if err := newSub.Unmarshal(ss.tmpSubBuf[:recSize]); err != nil {
-				return err
+				return ErrCorruptedData
 			}
 			sub := &subscription{
 				sub:    newSub,
@@ -1351,7 +3227,7 @@ func (ss *FileSubStore) recoverSubscriptions() error {
 		case subRecUpdate:
 			modifiedSub := &spb.SubState{}
 			if err := modifiedSub.Unmarshal(ss.tmpSubBuf[:recSize]); err != nil {
-				return err
+				return ErrCorruptedData
 			}
 			// Search if the create has been recovered.
 			sub, exists := ss.subs[modifiedSub.ID]
@@ -1375,7 +3251,7 @@ func (ss *FileSubStore) recoverSubscriptions() error {
 		case subRecDel:
 			delSub := spb.SubStateDelete{}
 			if err := delSub.Unmarshal(ss.tmpSubBuf[:recSize]); err != nil {
-				return err
+				return ErrCorruptedData
 			}
 			if s, exists := ss.subs[delSub.ID]; exists {
 				delete(ss.subs, delSub.ID)
@@ -1393,7 +3269,7 @@ func (ss *FileSubStore) recoverSubscriptions() error {
 		case subRecMsg:
 			updateSub := spb.SubStateUpdate{}
 			if err := updateSub.Unmarshal(ss.tmpSubBuf[:recSize]); err != nil {
-				return err
+				return ErrCorruptedData
 			}
 			if sub, exists := ss.subs[updateSub.ID]; exists {
 				seqno := updateSub.Seqno
@@ -1409,7 +3285,7 @@ func (ss *FileSubStore) recoverSubscriptions() error {
 		case subRecAck:
 			updateSub := spb.SubStateUpdate{}
 			if err := updateSub.Unmarshal(ss.tmpSubBuf[:recSize]); err != nil {
-				return err
+				return ErrCorruptedData
 			}
 			if sub, exists := ss.subs[updateSub.ID]; exists {
 				delete(sub.seqnos, updateSub.Seqno)
@@ -1417,6 +3293,36 @@ func (ss *FileSubStore) recoverSubscriptions() error {
 				ss.delRecs++
 			}
 			break
+		case subRecUpdates:
+			err := decodeSubUpdates(ss.tmpSubBuf[:recSize], func(u subUpdate) {
+				sub, exists := ss.subs[u.subID]
+				if !exists {
+					return
+				}
+				if u.ack {
+					delete(sub.seqnos, u.seqno)
+					ss.delRecs++
+				} else {
+					if u.seqno > sub.sub.LastSent {
+						sub.sub.LastSent = u.seqno
+					}
+					sub.seqnos[u.seqno] = struct{}{}
+					ss.numRecs++
+				}
+			})
+			if err != nil {
+				return err
+			}
+			break
+		case subRecAckRange:
+			ackRange := subAckRangeRecord{}
+			if err := ackRange.Unmarshal(ss.tmpSubBuf[:recSize]); err != nil {
+				return err
+			}
+			if sub, exists := ss.subs[ackRange.subID]; exists {
+				ss.delRecs += sub.ackRange(ackRange.firstSeq, ackRange.lastSeq)
+			}
+			break
 		default:
 			return fmt.Errorf("unexpected record type: %v", recType)
 		}
@@ -1427,6 +3333,9 @@ func (ss *FileSubStore) recoverSubscriptions() error {
 // CreateSub records a new subscription represented by SubState. On success,
 // it returns an id that is used by the other methods.
 func (ss *FileSubStore) CreateSub(sub *spb.SubState) error {
+	if ss.opts.ReadOnly {
+		return ErrReadOnly
+	}
 	// Check if we can create the subscription (check limits and update
 	// subscription count)
 	ss.Lock()
@@ -1444,6 +3353,9 @@ func (ss *FileSubStore) CreateSub(sub *spb.SubState) error {
 
 // UpdateSub updates a given subscription represented by SubState.
 func (ss *FileSubStore) UpdateSub(sub *spb.SubState) error {
+	if ss.opts.ReadOnly {
+		return ErrReadOnly
+	}
 	ss.Lock()
 	defer ss.Unlock()
 	if err := ss.writeRecord(ss.bw, subRecUpdate, sub); err != nil {
@@ -1459,13 +3371,18 @@ func (ss *FileSubStore) UpdateSub(sub *spb.SubState) error {
 	return nil
 }
 
-// DeleteSub invalidates this subscription.
+// DeleteSub invalidates this subscription. In read-only mode, this is a
+// no-op.
 func (ss *FileSubStore) DeleteSub(subid uint64) {
+	if ss.opts.ReadOnly {
+		return
+	}
 	ss.Lock()
 	ss.delSub.ID = subid
 	ss.writeRecord(ss.bw, subRecDel, &ss.delSub)
 	if s, exists := ss.subs[subid]; exists {
 		delete(ss.subs, subid)
+		ss.subsCount--
 		// writeRecord has already accounted for the count of the
 		// delete record. We add to this the number of pending messages
 		ss.delRecs += len(s.seqnos)
@@ -1481,7 +3398,7 @@ func (ss *FileSubStore) DeleteSub(subid uint64) {
 // Lock is held by caller
 func (ss *FileSubStore) shouldCompact() bool {
 	// Gobal switch
-	if !ss.opts.CompactEnabled {
+	if !ss.opts.CompactEnabled || !ss.opts.inMaintenanceWindow() {
 		return false
 	}
 	// Check that if minimum file size is set, the client file
@@ -1508,9 +3425,11 @@ func (ss *FileSubStore) shouldCompact() bool {
 
 // AddSeqPending adds the given message seqno to the given subscription.
 func (ss *FileSubStore) AddSeqPending(subid, seqno uint64) error {
+	if ss.opts.ReadOnly {
+		return ErrReadOnly
+	}
 	ss.Lock()
-	ss.updateSub.ID, ss.updateSub.Seqno = subid, seqno
-	if err := ss.writeRecord(ss.bw, subRecMsg, &ss.updateSub); err != nil {
+	if err := ss.addUpdate(subid, seqno, false); err != nil {
 		ss.Unlock()
 		return err
 	}
@@ -1525,9 +3444,18 @@ func (ss *FileSubStore) AddSeqPending(subid, seqno uint64) error {
 // AckSeqPending records that the given message seqno has been acknowledged
 // by the given subscription.
 func (ss *FileSubStore) AckSeqPending(subid, seqno uint64) error {
+	if ss.opts.ReadOnly {
+		return ErrReadOnly
+	}
 	ss.Lock()
-	ss.updateSub.ID, ss.updateSub.Seqno = subid, seqno
-	if err := ss.writeRecord(ss.bw, subRecAck, &ss.updateSub); err != nil {
+	if err := ss.addUpdate(subid, seqno, true); err != nil {
+		ss.Unlock()
+		return err
+	}
+	// Unless acks are flushed periodically, flush now.
+	if ss.opts.AckFlushInterval > 0 {
+		ss.ackPending = true
+	} else if err := ss.flush(); err != nil {
 		ss.Unlock()
 		return err
 	}
@@ -1543,6 +3471,113 @@ func (ss *FileSubStore) AckSeqPending(subid, seqno uint64) error {
 	return nil
 }
 
+// AckSeqPendingRange records that the messages from firstSeq to lastSeq
+// have been acknowledged by the given subscription. The acks are written
+// as a single record.
+func (ss *FileSubStore) AckSeqPendingRange(subid, firstSeq, lastSeq uint64) error {
+	if ss.opts.ReadOnly {
+		return ErrReadOnly
+	}
+	if lastSeq < firstSeq {
+		return nil
+	}
+	ss.Lock()
+	rec := &subAckRangeRecord{subID: subid, firstSeq: firstSeq, lastSeq: lastSeq}
+	if err := ss.writeRecord(ss.bw, subRecAckRange, rec); err != nil {
+		ss.Unlock()
+		return err
+	}
+	removed := 0
+	if s := ss.subs[subid]; s != nil {
+		removed = s.ackRange(firstSeq, lastSeq)
+	}
+	err := ss.afterAcks(removed)
+	ss.Unlock()
+	return err
+}
+
+// AckSeqPendingBatch records that the given messages have been acknowledged
+// by the given subscription. The acks are added to the batch of updates,
+// which is flushed once.
+func (ss *FileSubStore) AckSeqPendingBatch(subid uint64, seqnos ...uint64) error {
+	if ss.opts.ReadOnly {
+		return ErrReadOnly
+	}
+	if len(seqnos) == 0 {
+		return nil
+	}
+	ss.Lock()
+	for _, seqno := range seqnos {
+		if err := ss.addUpdate(subid, seqno, true); err != nil {
+			ss.Unlock()
+			return err
+		}
+	}
+	if s := ss.subs[subid]; s != nil {
+		for _, seqno := range seqnos {
+			delete(s.seqnos, seqno)
+		}
+	}
+	// The acks have already been counted by addUpdate.
+	err := ss.afterAcks(0)
+	ss.Unlock()
+	return err
+}
+
+// afterAcks counts `removed` acknowledged messages as free space, flushes
+// the acks unless they are flushed periodically, and compacts the file if
+// needed.
+// Lock is held on entry.
+func (ss *FileSubStore) afterAcks(removed int) error {
+	ss.delRecs += removed
+	if ss.opts.AckFlushInterval > 0 {
+		ss.ackPending = true
+	} else if err := ss.flush(); err != nil {
+		return err
+	}
+	if ss.shouldCompact() {
+		ss.compact()
+	}
+	return nil
+}
+
+// addUpdate adds a pending (or ack) update to the batch of updates, which
+// is written when the store is flushed, before any other record, or when
+// it is full. Lock is held on entry.
+func (ss *FileSubStore) addUpdate(subid, seqno uint64, ack bool) error {
+	ss.updates = append(ss.updates, subUpdate{subID: subid, seqno: seqno, ack: ack})
+	// Count the update as a record now, for the compaction decision.
+	if ack {
+		ss.delRecs++
+	} else {
+		ss.numRecs++
+	}
+	if len(ss.updates) >= maxSubUpdatesPerRecord {
+		return ss.writePendingUpdates()
+	}
+	return nil
+}
+
+// writePendingUpdates writes the batch of updates, if not empty.
+// Lock is held on entry.
+func (ss *FileSubStore) writePendingUpdates() error {
+	if len(ss.updates) == 0 {
+		return nil
+	}
+	if err := ss.writeUpdates(ss.bw, ss.updates); err != nil {
+		return err
+	}
+	ss.updates = ss.updates[:0]
+	return nil
+}
+
+// writeUpdates writes the updates as a single record.
+// Lock is held on entry.
+func (ss *FileSubStore) writeUpdates(w io.Writer, updates []subUpdate) error {
+	ss.updatesRec.encode(updates)
+	return ss.writeRecord(w, subRecUpdates, &ss.updatesRec)
+}
+
 // compact rewrites all subscriptions on a temporary file, reducing the size
 // since we get rid of deleted subscriptions and message sequences that have
 // been acknowledged. On success, the subscriptions file is replaced by this
@@ -1573,20 +3608,36 @@ func (ss *FileSubStore) compact() error {
 	ss.numRecs = 0
 	ss.delRecs = 0
 	ss.fileSize = 0
+	// The pending messages are written in batches of updates, sorted so
+	// that the sequences are encoded with small deltas.
+	var updates []subUpdate
+	var seqnos uint64Slice
 	for _, sub := range ss.subs {
 		err = ss.writeRecord(tmpBW, subRecNew, sub.sub)
 		if err != nil {
 			return err
 		}
-		ss.updateSub.ID = sub.sub.ID
+		seqnos = seqnos[:0]
 		for seqno := range sub.seqnos {
-			ss.updateSub.Seqno = seqno
-			err = ss.writeRecord(tmpBW, subRecMsg, &ss.updateSub)
-			if err != nil {
-				return err
+			seqnos = append(seqnos, seqno)
+		}
+		sort.Sort(seqnos)
+		for _, seqno := range seqnos {
+			updates = append(updates, subUpdate{subID: sub.sub.ID, seqno: seqno})
+			ss.numRecs++
+			if len(updates) == maxSubUpdatesPerRecord {
+				if err = ss.writeUpdates(tmpBW, updates); err != nil {
+					return err
+				}
+				updates = updates[:0]
 			}
 		}
 	}
+	if len(updates) > 0 {
+		if err = ss.writeUpdates(tmpBW, updates); err != nil {
+			return err
+		}
+	}
 	// Flush and sync the temporary file
 	err = tmpBW.Flush()
 	if err != nil {
@@ -1604,7 +3655,9 @@ func (ss *FileSubStore) compact() error {
 	// Prevent cleanup on success
 	tmpFile = nil
 
-	ss.bw = bufio.NewWriterSize(ss.file, ss.opts.BufferSize)
+	ss.bw = bufio.NewWriterSize(chaosWriter(ss.file), ss.opts.BufferSize)
+	// The updates not yet written are part of the new file.
+	ss.updates = ss.updates[:0]
 	// Update the timestamp of this last successful compact
 	ss.compactTS = time.Now()
 	return nil
@@ -1613,9 +3666,16 @@ func (ss *FileSubStore) compact() error {
 // writes a record in the subscriptions file.
 // store's lock is held on entry.
 func (ss *FileSubStore) writeRecord(w io.Writer, recType recordType, rec record) error {
+	// Write the pending updates first to preserve the order of the records.
+	if w == ss.bw && recType != subRecUpdates {
+		if err := ss.writePendingUpdates(); err != nil {
+			return err
+		}
+	}
 	var err error
 	totalSize := 0
 	ss.tmpSubBuf, totalSize, err = writeRecord(w, ss.tmpSubBuf, recType, rec, ss.crcTable)
+	chaosKillPoint("subscription write")
 	if err != nil {
 		return err
 	}
@@ -1633,6 +3693,8 @@ func (ss *FileSubStore) writeRecord(w io.Writer, recType recordType, rec record)
 		ss.delRecs++
 	case subRecDel:
 		ss.delRecs++
+	case subRecUpdates, subRecAckRange:
+		// Updates are counted when they are added
 	default:
 		panic(fmt.Errorf("Record type %v unknown", recType))
 	}
@@ -1644,15 +3706,43 @@ func (ss *FileSubStore) flush() error {
 	if ss.bw == nil {
 		return nil
 	}
+	if err := ss.writePendingUpdates(); err != nil {
+		return err
+	}
 	if err := ss.bw.Flush(); err != nil {
 		return err
 	}
+	ss.ackPending = false
 	if ss.opts.DoSync {
-		return ss.file.Sync()
+		return ss.commit.sync(ss.file)
 	}
 	return nil
 }
 
+// ackFlushLoop flushes the acks that have been written since the last
+// flush, at the given interval.
+func (ss *FileSubStore) ackFlushLoop(quit chan struct{}, interval time.Duration) {
+	defer ss.ackWg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-quit:
+			return
+		case <-ticker.C:
+			var err error
+			ss.Lock()
+			if ss.ackPending && !ss.closed {
+				err = ss.flush()
+			}
+			ss.Unlock()
+			if err != nil {
+				Noticef("Unable to flush acks for channel=%s: %v", ss.subject, err)
+			}
+		}
+	}
+}
+
 // Flush persists buffered operations to disk.
 func (ss *FileSubStore) Flush() error {
 	ss.Lock()
@@ -1663,6 +3753,17 @@ func (ss *FileSubStore) Flush() error {
 
 // Close closes this store
 func (ss *FileSubStore) Close() error {
+	// Stop the periodic flush of acks, if running. The acks not yet
+	// flushed are flushed below.
+	ss.Lock()
+	ackQuit := ss.ackQuit
+	ss.ackQuit = nil
+	ss.Unlock()
+	if ackQuit != nil {
+		close(ackQuit)
+		ss.ackWg.Wait()
+	}
+
 	ss.RLock()
 	defer ss.RUnlock()
 
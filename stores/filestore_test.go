@@ -8,6 +8,8 @@ import (
 	"path/filepath"
 	"reflect"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 
 	"github.com/nats-io/go-nats-streaming/pb"
@@ -224,6 +226,16 @@ func TestFSOptions(t *testing.T) {
 		DoCRC:                false,
 		CRCPolynomial:        int64(crc32.Castagnoli),
 		DoSync:               false,
+		RecoveryParallelism:  3,
+		LazyRecovery:         true,
+		GroupCommit:          true,
+		AckFlushInterval:     100,
+		PreallocateSize:      1024,
+		ReservedDiskSpace:    1,
+		Tier:                 NewDirTier(defaultDataStore),
+		TierAge:              3600,
+		ShardChannelDirs:     true,
+		Upgrade:              true,
 	}
 	// Create the file with custom options
 	fs, _, err := NewFileStore(defaultDataStore, &testDefaultChannelLimits,
@@ -234,7 +246,16 @@ func TestFSOptions(t *testing.T) {
 		CompactMinFileSize(expected.CompactMinFileSize),
 		DoCRC(expected.DoCRC),
 		CRCPolynomial(expected.CRCPolynomial),
-		DoSync(expected.DoSync))
+		DoSync(expected.DoSync),
+		RecoveryParallelism(expected.RecoveryParallelism),
+		LazyRecovery(expected.LazyRecovery),
+		GroupCommit(expected.GroupCommit),
+		AckFlushInterval(expected.AckFlushInterval),
+		PreallocateSize(expected.PreallocateSize),
+		ReservedDiskSpace(expected.ReservedDiskSpace),
+		TieredStorage(expected.Tier, expected.TierAge),
+		ShardChannelDirs(expected.ShardChannelDirs),
+		Upgrade(expected.Upgrade))
 	if err != nil {
 		t.Fatalf("Unexpected error on file store create: %v", err)
 	}
@@ -316,6 +337,303 @@ func TestFSBasicMsgStore(t *testing.T) {
 	testBasicMsgStore(t, fs)
 }
 
+func TestFSMsgExt(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	fs := createDefaultFileStore(t)
+	defer fs.Close()
+
+	testMsgExt(t, fs)
+}
+
+func TestFSStoreMsg(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	fs := createDefaultFileStore(t)
+	defer fs.Close()
+
+	testStoreMsg(t, fs)
+
+	// Sequences and timestamps are kept on recovery.
+	fs.Close()
+	fs, state, err := NewFileStore(defaultDataStore, &testDefaultChannelLimits)
+	if err != nil {
+		t.Fatalf("Unable to create a FileStore instance: %v", err)
+	}
+	defer fs.Close()
+	if state == nil {
+		t.Fatal("Expected state to be recovered")
+	}
+	ms := fs.LookupChannel("foo").Msgs
+	if first, last := ms.FirstAndLastSequence(); first != 10 || last != 13 {
+		t.Fatalf("Unexpected first and last sequences: %v, %v", first, last)
+	}
+	if m := msgStoreLookup(t, ms, 10); m == nil || m.Timestamp != 1000 {
+		t.Fatalf("Unexpected message: %v", m)
+	}
+}
+
+func TestFSStoreBatch(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	fs := createDefaultFileStore(t)
+	defer fs.Close()
+
+	testStoreBatch(t, fs)
+	ms := fs.LookupChannel("foo").Msgs
+	if _, err := ms.StoreBatch([]*BatchMsg{{Data: []byte("b1")}, {Data: []byte("b2")}}); err != nil {
+		t.Fatalf("Unexpected error on store: %v", err)
+	}
+	fileName := ms.(*FileMsgStore).files[0].fileName
+	fs.Close()
+
+	// The batches are recovered.
+	fs, _ = openDefaultFileStore(t)
+	ms = fs.LookupChannel("foo").Msgs
+	if first, last := ms.FirstAndLastSequence(); first != 1 || last != 7 {
+		t.Fatalf("Unexpected first and last sequences: %v, %v", first, last)
+	}
+	checkMsgExt(t, ms, 4, nil)
+	fs.Close()
+
+	// Remove the last message of the last batch, as if the server had
+	// stopped while writing it: none of the batch should be recovered.
+	stat, err := os.Stat(fileName)
+	if err != nil {
+		t.Fatalf("Unable to stat file: %v", err)
+	}
+	if err := os.Truncate(fileName, stat.Size()-3); err != nil {
+		t.Fatalf("Unable to truncate file: %v", err)
+	}
+	fs, _ = openDefaultFileStore(t)
+	defer fs.Close()
+	ms = fs.LookupChannel("foo").Msgs
+	if first, last := ms.FirstAndLastSequence(); first != 1 || last != 5 {
+		t.Fatalf("Unexpected first and last sequences: %v, %v", first, last)
+	}
+	// The incomplete batch has been removed from the file, so the sequences
+	// can be reused.
+	if m := storeMsg(t, fs, "foo", []byte("m6")); m.Sequence != 6 {
+		t.Fatalf("Expected sequence 6, got %v", m.Sequence)
+	}
+	fs.Close()
+	fs, _ = openDefaultFileStore(t)
+	defer fs.Close()
+	ms = fs.LookupChannel("foo").Msgs
+	if first, last := ms.FirstAndLastSequence(); first != 1 || last != 6 {
+		t.Fatalf("Unexpected first and last sequences: %v, %v", first, last)
+	}
+	if m := msgStoreLookup(t, ms, 6); m == nil || string(m.Data) != "m6" {
+		t.Fatalf("Unexpected message: %v", m)
+	}
+}
+
+func TestFSStoreTxNotSupported(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	fs := createDefaultFileStore(t)
+	defer fs.Close()
+
+	if _, err := BeginTx(fs); err != ErrTxNotSupported {
+		t.Fatalf("Expected error %v, got %v", ErrTxNotSupported, err)
+	}
+}
+
+func TestFSMsgExpiration(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	fs := createDefaultFileStore(t)
+	defer fs.Close()
+
+	testMsgExpiration(t, fs)
+}
+
+func TestFSPurgeBefore(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	fs := createDefaultFileStore(t)
+	defer fs.Close()
+
+	testPurgeBefore(t, fs)
+}
+
+func TestFSMsgStamper(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	fs := createDefaultFileStore(t)
+	defer fs.Close()
+
+	testMsgStamper(t, fs)
+}
+
+func TestFSKeyCompaction(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	fs := createDefaultFileStore(t)
+	defer fs.Close()
+
+	testKeyCompaction(t, fs)
+}
+
+func TestFSKeyCompactionFiles(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	limits := testDefaultChannelLimits
+	limits.MaxNumMsgs = 10
+	limits.CompactedChannels = []string{"foo"}
+
+	fs, _, err := NewFileStore(defaultDataStore, &limits, CompactEnabled(false))
+	if err != nil {
+		t.Fatalf("Unable to create a FileStore instance: %v", err)
+	}
+	defer fs.Close()
+	info := testDefaultServerInfo
+	if err := fs.Init(&info); err != nil {
+		t.Fatalf("Unexpected error durint Init: %v", err)
+	}
+
+	// With this limit, there are 2 messages per file slice. Cycle through
+	// 3 keys so that messages are removed from several slices.
+	keys := []string{"k0", "k1", "k2"}
+	for i := 0; i < 20; i++ {
+		storeMsgWithExt(t, fs, "foo", []byte(fmt.Sprintf("m%d", i)), &spb.MsgExt{Key: keys[i%3]})
+	}
+	check := func(ms MsgStore) {
+		if first, last := ms.FirstAndLastSequence(); first != 18 || last != 20 {
+			t.Fatalf("Unexpected sequences: %v,%v", first, last)
+		}
+		if count, bytes, _ := ms.State(); count != 3 || bytes != 9 {
+			t.Fatalf("Unexpected counts: %v, %v", count, bytes)
+		}
+		for seq := uint64(18); seq <= 20; seq++ {
+			checkMsgExt(t, ms, seq, &spb.MsgExt{Key: keys[(seq-1)%3]})
+		}
+	}
+	ms := fs.LookupChannel("foo").Msgs.(*FileMsgStore)
+	check(ms)
+
+	sizeOf := func() int64 {
+		size := int64(0)
+		for _, slice := range ms.files {
+			if stat, err := os.Stat(slice.fileName); err == nil {
+				size += stat.Size()
+			}
+		}
+		return size
+	}
+	sizeBefore := sizeOf()
+	ms.Lock()
+	err = ms.compactSlices()
+	ms.Unlock()
+	if err != nil {
+		t.Fatalf("Unexpected error on compaction: %v", err)
+	}
+	if sizeAfter := sizeOf(); sizeAfter >= sizeBefore {
+		t.Fatalf("Files should have been compacted, size before %v, after %v", sizeBefore, sizeAfter)
+	}
+	// Store a message after the compaction.
+	storeMsgWithExt(t, fs, "foo", []byte("m20"), &spb.MsgExt{Key: "k3"})
+	fs.Close()
+
+	fs, _, err = NewFileStore(defaultDataStore, &limits, CompactEnabled(false))
+	if err != nil {
+		t.Fatalf("Unable to create a FileStore instance: %v", err)
+	}
+	defer fs.Close()
+	ms = fs.LookupChannel("foo").Msgs.(*FileMsgStore)
+	if first, last := ms.FirstAndLastSequence(); first != 18 || last != 21 {
+		t.Fatalf("Unexpected sequences: %v,%v", first, last)
+	}
+	if count, _, _ := ms.State(); count != 4 {
+		t.Fatalf("Unexpected count: %v", count)
+	}
+	// Keys are recovered too.
+	storeMsgWithExt(t, fs, "foo", []byte("m21"), &spb.MsgExt{Key: "k2"})
+	if msgStoreLookup(t, ms, 18) != nil {
+		t.Fatal("Message 18 should have been removed")
+	}
+}
+
+func TestFSKeyCompactionRecovery(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	limits := testDefaultChannelLimits
+	limits.CompactedChannels = []string{"foo"}
+
+	fs, _, err := NewFileStore(defaultDataStore, &limits)
+	if err != nil {
+		t.Fatalf("Unable to create a FileStore instance: %v", err)
+	}
+	defer fs.Close()
+	info := testDefaultServerInfo
+	if err := fs.Init(&info); err != nil {
+		t.Fatalf("Unexpected error durint Init: %v", err)
+	}
+	storeMsgWithExt(t, fs, "foo", []byte("m1"), &spb.MsgExt{Key: "k1"})
+	storeMsgWithExt(t, fs, "foo", []byte("m2"), &spb.MsgExt{Key: "k2"})
+	storeMsgWithExt(t, fs, "foo", []byte("m3"), &spb.MsgExt{Key: "k1"})
+	fs.Close()
+
+	// The records of removed messages are still in the file, but should
+	// not be recovered.
+	fs, _, err = NewFileStore(defaultDataStore, &limits)
+	if err != nil {
+		t.Fatalf("Unable to create a FileStore instance: %v", err)
+	}
+	defer fs.Close()
+	ms := fs.LookupChannel("foo").Msgs
+	if msgStoreLookup(t, ms, 1) != nil {
+		t.Fatal("Message 1 should have been removed")
+	}
+	if first, last := ms.FirstAndLastSequence(); first != 2 || last != 3 {
+		t.Fatalf("Unexpected sequences: %v,%v", first, last)
+	}
+	if count, bytes, _ := ms.State(); count != 2 || bytes != 4 {
+		t.Fatalf("Unexpected counts: %v, %v", count, bytes)
+	}
+}
+
+func TestFSMsgExtRecovery(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	fs := createDefaultFileStore(t)
+	defer fs.Close()
+
+	ext := &spb.MsgExt{
+		Headers: []*spb.MsgHeader{&spb.MsgHeader{Key: "trace-id", Value: "123"}},
+	}
+	m1 := storeMsgWithExt(t, fs, "foo", []byte("m1"), ext)
+	m2 := storeMsg(t, fs, "foo", []byte("m2"))
+
+	fs.Close()
+
+	fs, state := openDefaultFileStore(t)
+	defer fs.Close()
+	if state == nil {
+		t.Fatal("Expected state to be recovered")
+	}
+	ms := fs.LookupChannel("foo").Msgs
+	if rm1 := msgStoreLookup(t, ms, m1.Sequence); rm1 == nil || !reflect.DeepEqual(*rm1, *m1) {
+		t.Fatalf("Expected message %v, got %v", m1, rm1)
+	}
+	if rm2 := msgStoreLookup(t, ms, m2.Sequence); rm2 == nil || !reflect.DeepEqual(*rm2, *m2) {
+		t.Fatalf("Expected message %v, got %v", m2, rm2)
+	}
+	checkMsgExt(t, ms, m1.Sequence, ext)
+	checkMsgExt(t, ms, m2.Sequence, nil)
+}
+
 func TestFSBasicRecovery(t *testing.T) {
 	cleanupDatastore(t, defaultDataStore)
 	defer cleanupDatastore(t, defaultDataStore)
@@ -363,7 +681,7 @@ func TestFSBasicRecovery(t *testing.T) {
 	if state == nil {
 		t.Fatal("Expected state to be recovered")
 	}
-	subs := state.Subs
+	subs := getRecoveredSubs(t, state)
 
 	// Check that subscriptions are restored
 	for channel, recoveredSubs := range subs {
@@ -405,7 +723,7 @@ func TestFSBasicRecovery(t *testing.T) {
 	}
 	// In message store, the first message should still be foo1,
 	// regardless of what has been consumed.
-	m := cs.Msgs.FirstMsg()
+	m := msgStoreFirstMsg(t, cs.Msgs)
 	if m == nil || m.Sequence != foo1.Sequence {
 		t.Fatalf("Unexpected message for foo channel: %v", m)
 	}
@@ -414,7 +732,7 @@ func TestFSBasicRecovery(t *testing.T) {
 	checkRedelivered := func(ms MsgStore) bool {
 		start, end := ms.FirstAndLastSequence()
 		for i := start; i <= end; i++ {
-			if m := ms.Lookup(i); m != nil && m.Redelivered {
+			if m := msgStoreLookup(t, ms, i); m != nil && m.Redelivered {
 				return true
 			}
 		}
@@ -430,7 +748,7 @@ func TestFSBasicRecovery(t *testing.T) {
 	}
 	// In message store, the first message should still be bar1,
 	// regardless of what has been consumed.
-	m = cs.Msgs.FirstMsg()
+	m = msgStoreFirstMsg(t, cs.Msgs)
 	if m == nil || m.Sequence != bar1.Sequence {
 		t.Fatalf("Unexpected message for bar channel: %v", m)
 	}
@@ -488,11 +806,11 @@ func TestFSRecoveryLimitsNotApplied(t *testing.T) {
 	if state == nil {
 		t.Fatal("Expected state to be recovered")
 	}
-	subs := state.Subs
+	subs := getRecoveredSubs(t, state)
 
 	// Make sure that all our channels are recovered.
 	if len(subs) != chanCount {
-		t.Fatalf("Unexpected count of recovered channels. Expected %v, got %v", chanCount, len(state.Subs))
+		t.Fatalf("Unexpected count of recovered channels. Expected %v, got %v", chanCount, len(subs))
 	}
 	// Make sure that all our subscriptions are recovered.
 	for _, recoveredSubs := range subs {
@@ -613,58 +931,1067 @@ func TestFSRecoveryFileSlices(t *testing.T) {
 	}
 }
 
-func TestFSMsgsState(t *testing.T) {
+func TestFSMsgsState(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	fs := createDefaultFileStore(t)
+	defer fs.Close()
+
+	testMsgsState(t, fs)
+}
+
+func TestFSGetChannels(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	fs := createDefaultFileStore(t)
+	defer fs.Close()
+
+	testGetChannels(t, fs)
+	before, err := fs.GetChannels()
+	if err != nil {
+		t.Fatalf("Unexpected error getting channels: %v", err)
+	}
+	fs.Close()
+
+	// The creation time is recovered.
+	fs, _ = openDefaultFileStore(t)
+	defer fs.Close()
+	after, err := fs.GetChannels()
+	if err != nil {
+		t.Fatalf("Unexpected error getting channels: %v", err)
+	}
+	if len(after) != 2 {
+		t.Fatalf("Expected 2 channels, got %v", after)
+	}
+	for i := range after {
+		if !after[i].Created.Equal(before[i].Created) {
+			t.Fatalf("Expected creation time %v, got %v", before[i].Created, after[i].Created)
+		}
+		// Creation times are equal, but not their monotonic clock reading.
+		after[i].Created = before[i].Created
+		if *after[i] != *before[i] {
+			t.Fatalf("Expected %+v, got %+v", before[i], after[i])
+		}
+	}
+	fs.Close()
+
+	// A channel created by an older version has no channel file, and its
+	// creation time is unknown.
+	if err := os.Remove(filepath.Join(defaultDataStore, "foo", channelInfoFileName)); err != nil {
+		t.Fatalf("Unable to remove channel file: %v", err)
+	}
+	fs, _ = openDefaultFileStore(t)
+	defer fs.Close()
+	infos, err := fs.GetChannels()
+	if err != nil {
+		t.Fatalf("Unexpected error getting channels: %v", err)
+	}
+	if len(infos) != 2 || infos[0].Created.IsZero() || !infos[1].Created.IsZero() || infos[1].Msgs != 2 {
+		t.Fatalf("Unexpected channels: %+v, %+v", infos[0], infos[1])
+	}
+}
+
+func TestFSMaxMsgs(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	fs := createDefaultFileStore(t)
+	defer fs.Close()
+
+	testMaxMsgs(t, fs)
+}
+
+func TestFSMemoryBudget(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	fs := createDefaultFileStore(t)
+	defer fs.Close()
+
+	testMemoryBudget(t, fs)
+}
+
+func TestFSMaxChannels(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	fs := createDefaultFileStore(t)
+	defer fs.Close()
+
+	limitCount := 2
+
+	limits := testDefaultChannelLimits
+	limits.MaxChannels = limitCount
+
+	fs.SetChannelLimits(limits)
+
+	testMaxChannels(t, fs, limitCount)
+}
+
+func TestFSMaxSubs(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	fs := createDefaultFileStore(t)
+	defer fs.Close()
+
+	limitCount := 2
+
+	limits := testDefaultChannelLimits
+	limits.MaxSubs = limitCount
+
+	fs.SetChannelLimits(limits)
+
+	testMaxSubs(t, fs, limitCount)
+}
+
+func TestFSTenantLimits(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	fs := createDefaultFileStore(t)
+	defer fs.Close()
+
+	testTenantLimits(t, fs)
+}
+
+func TestFSTenantRecovery(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	limits := testDefaultChannelLimits
+	limits.Tenants = []TenantLimits{{Name: "acme", MaxNumMsgs: 2}}
+
+	fs, _, err := NewFileStore(defaultDataStore, &limits)
+	if err != nil {
+		t.Fatalf("Unable to create a FileStore instance: %v", err)
+	}
+	defer fs.Close()
+	info := testDefaultServerInfo
+	if err := fs.Init(&info); err != nil {
+		t.Fatalf("Unexpected error durint Init: %v", err)
+	}
+	storeMsg(t, fs, "acme.orders", []byte("hello"))
+	storeMsg(t, fs, "acme", []byte("hello"))
+	// A channel created before channel names with empty tokens were
+	// rejected by the server is not mistaken for a tenant directory.
+	storeMsg(t, fs, ".foo", []byte("hello"))
+	fs.Close()
+
+	// The channel of the tenant is stored in the tenant's directory.
+	for _, dir := range []string{
+		filepath.Join(defaultDataStore, tenantDirPrefix+"acme", "acme.orders"),
+		filepath.Join(defaultDataStore, "acme"),
+	} {
+		if s, err := os.Stat(dir); err != nil || !s.IsDir() {
+			t.Fatalf("Expected directory %q: %v", dir, err)
+		}
+	}
+
+	fs, state, err := NewFileStore(defaultDataStore, &limits)
+	if err != nil {
+		t.Fatalf("Unable to create a FileStore instance: %v", err)
+	}
+	defer fs.Close()
+	if state == nil {
+		t.Fatal("Expected a recovered state")
+	}
+	if names := fs.GetChannelNames(); len(names) != 3 {
+		t.Fatalf("Expected 3 channels, got %v", names)
+	}
+	for _, channel := range []string{"acme.orders", "acme", ".foo"} {
+		if count, _, _ := fs.MsgsState(channel); count != 1 {
+			t.Fatalf("Expected 1 message on %s, got %v", channel, count)
+		}
+	}
+	// The tenant limits apply to the recovered channel.
+	for i := 0; i < 3; i++ {
+		storeMsg(t, fs, "acme.orders", []byte("hello"))
+	}
+	if count, _, _ := fs.MsgsState("acme.orders"); count != 2 {
+		t.Fatalf("Expected 2 messages, got %v", count)
+	}
+}
+
+func TestFSShardChannelDirs(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	limits := testDefaultChannelLimits
+	limits.Tenants = []TenantLimits{{Name: "acme"}}
+	tenantDir := filepath.Join(defaultDataStore, tenantDirPrefix+"acme")
+	// "ab" is named like a shard directory.
+	channels := []string{"foo", "ab", "acme.orders"}
+
+	open := func(sharded bool) *FileStore {
+		fs, state, err := NewFileStore(defaultDataStore, &limits, ShardChannelDirs(sharded))
+		if err != nil {
+			stackFatalf(t, "Unable to create a FileStore instance: %v", err)
+		}
+		if state == nil {
+			info := testDefaultServerInfo
+			if err := fs.Init(&info); err != nil {
+				stackFatalf(t, "Unexpected error durint Init: %v", err)
+			}
+		}
+		return fs
+	}
+	check := func(fs *FileStore, sharded bool) {
+		if names := fs.GetChannelNames(); len(names) != len(channels) {
+			stackFatalf(t, "Expected %v channels, got %v", len(channels), names)
+		}
+		for _, channel := range channels {
+			if count, _, _ := fs.MsgsState(channel); count != 1 {
+				stackFatalf(t, "Expected 1 message on %s, got %v", channel, count)
+			}
+			parentDir := defaultDataStore
+			if channel == "acme.orders" {
+				parentDir = tenantDir
+			}
+			dir := channelDirPath(parentDir, channel, sharded)
+			if s, err := os.Stat(filepath.Join(dir, subsFileName)); err != nil || s.IsDir() {
+				stackFatalf(t, "Expected channel %s in %q: %v", channel, dir, err)
+			}
+		}
+	}
+
+	fs := open(true)
+	defer fs.Close()
+	for _, channel := range channels {
+		storeMsg(t, fs, channel, []byte("hello"))
+	}
+	check(fs, true)
+	fs.Close()
+
+	fs = open(true)
+	check(fs, true)
+	fs.Close()
+
+	// The directories are moved back to the flat layout, and the shard
+	// directories removed.
+	fs = open(false)
+	check(fs, false)
+	fs.Close()
+	files, err := ioutil.ReadDir(defaultDataStore)
+	if err != nil {
+		t.Fatalf("Unable to read directory: %v", err)
+	}
+	if len(files) != 5 {
+		var names []string
+		for _, f := range files {
+			names = append(names, f.Name())
+		}
+		t.Fatalf("Unexpected files in the root directory: %v", names)
+	}
+
+	// And sharded again.
+	fs = open(true)
+	check(fs, true)
+	storeMsg(t, fs, "bar", []byte("hello"))
+	channels = append(channels, "bar")
+	check(fs, true)
+	fs.Close()
+
+	// A read-only store finds the channels without moving them.
+	fs, _, err = NewFileStore(defaultDataStore, &limits, ReadOnly(true))
+	if err != nil {
+		t.Fatalf("Unable to create a FileStore instance: %v", err)
+	}
+	defer fs.Close()
+	check(fs, true)
+}
+
+func TestFSParallelRecovery(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	if _, _, err := NewFileStore(defaultDataStore, &testDefaultChannelLimits, RecoveryParallelism(0)); err == nil {
+		t.Fatal("Expected error with invalid recovery parallelism")
+	}
+
+	fs := createDefaultFileStore(t)
+	defer fs.Close()
+	numChannels := 20
+	for i := 0; i < numChannels; i++ {
+		channel := fmt.Sprintf("foo.%d", i)
+		for j := 0; j <= i; j++ {
+			storeMsg(t, fs, channel, []byte("hello"))
+		}
+		subID := storeSub(t, fs, channel)
+		storeSubPending(t, fs, channel, subID, 1)
+	}
+	fs.Close()
+
+	for _, parallelism := range []int{1, 4, 2 * numChannels} {
+		fs, state, err := NewFileStore(defaultDataStore, &testDefaultChannelLimits, RecoveryParallelism(parallelism))
+		if err != nil {
+			t.Fatalf("Unable to create a FileStore instance: %v", err)
+		}
+		recoveredSubs := getRecoveredSubs(t, state)
+		if len(recoveredSubs) != numChannels {
+			t.Fatalf("Expected subscriptions of %v channels, got %v", numChannels, len(recoveredSubs))
+		}
+		for i := 0; i < numChannels; i++ {
+			channel := fmt.Sprintf("foo.%d", i)
+			if count, _, _ := fs.MsgsState(channel); count != i+1 {
+				t.Fatalf("Expected %v messages on %s, got %v", i+1, channel, count)
+			}
+			if subs := recoveredSubs[channel]; len(subs) != 1 || len(subs[0].Pending) != 1 {
+				t.Fatalf("Unexpected recovered subscriptions on %s: %v", channel, subs)
+			}
+		}
+		fs.Close()
+	}
+
+	// If a channel can't be recovered, the store fails to open.
+	fileName := filepath.Join(defaultDataStore, "foo.10", "msgs.1.dat")
+	if err := ioutil.WriteFile(fileName, []byte("bad content"), 0666); err != nil {
+		t.Fatalf("Unable to write file: %v", err)
+	}
+	if err := expectedErrorOpeningDefaultFileStore(t); !strings.Contains(err.Error(), "foo.10") {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
+
+func TestFSRecoveryProgress(t *testing.T) {
+	var logs []string
+	p := newRecoveryProgress(3)
+	p.logf = func(format string, v ...interface{}) {
+		logs = append(logs, fmt.Sprintf(format, v...))
+	}
+	p.channelDone(10)
+	// Pretend the last report is old enough.
+	p.lastReport = p.lastReport.Add(-recoveryProgressInterval)
+	p.channelDone(5)
+	p.channelDone(1)
+	p.done()
+	if len(logs) != 2 || logs[0] != "Recovering channels: 2/3 done, 15 message(s) recovered" ||
+		!strings.HasPrefix(logs[1], "Recovered 3 channel(s) and 16 message(s) in ") {
+		t.Fatalf("Unexpected progress logs: %q", logs)
+	}
+}
+
+func TestFSLazyRecovery(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	fs := createDefaultFileStore(t)
+	defer fs.Close()
+	for i := 0; i < 10; i++ {
+		storeMsg(t, fs, "foo", []byte("hello"))
+	}
+	storeMsg(t, fs, "bar", []byte("hello"))
+	storeSubPending(t, fs, "bar", storeSub(t, fs, "bar"), 1)
+	fs.Close()
+
+	openLazy := func() (*FileStore, *RecoveredState) {
+		fs, state, err := NewFileStore(defaultDataStore, &testDefaultChannelLimits, LazyRecovery(true))
+		if err != nil {
+			stackFatalf(t, "Unable to create a FileStore instance: %v", err)
+		}
+		return fs, state
+	}
+	isLoaded := func(fs *FileStore, channel string) bool {
+		ms := fs.LookupChannel(channel).Msgs.(*FileMsgStore)
+		ms.RLock()
+		defer ms.RUnlock()
+		return ms.loaded
+	}
+
+	fs, state := openLazy()
+	// The channel with pending messages is read right away.
+	if !isLoaded(fs, "bar") {
+		t.Fatal("Messages of channel with pending messages should have been read")
+	}
+	if subs := getRecoveredSubs(t, state)["bar"]; len(subs) != 1 || len(subs[0].Pending) != 1 {
+		t.Fatalf("Unexpected recovered subscriptions: %v", subs)
+	}
+	if isLoaded(fs, "foo") {
+		t.Fatal("Messages should not have been read")
+	}
+	ms := fs.LookupChannel("foo").Msgs
+	if count, bytes, _ := ms.State(); count != 10 || bytes != 50 {
+		t.Fatalf("Unexpected state: count=%v bytes=%v", count, bytes)
+	}
+	if first, last := ms.FirstAndLastSequence(); first != 1 || last != 10 {
+		t.Fatalf("Unexpected first/last: %v/%v", first, last)
+	}
+	// The state file is removed until the store is closed.
+	stateFile := filepath.Join(defaultDataStore, "foo", msgsStateFileName)
+	if _, err := os.Stat(stateFile); !os.IsNotExist(err) {
+		t.Fatalf("State file should have been removed: %v", err)
+	}
+	if m := msgStoreLookup(t, ms, 5); m == nil || m.Sequence != 5 {
+		t.Fatalf("Unexpected message: %v", m)
+	}
+	if !isLoaded(fs, "foo") {
+		t.Fatal("Messages should have been read")
+	}
+	if count, bytes, _ := ms.State(); count != 10 || bytes != 50 {
+		t.Fatalf("Unexpected state: count=%v bytes=%v", count, bytes)
+	}
+	fs.Close()
+
+	// Storing a message reads the messages first.
+	fs, _ = openLazy()
+	ms = fs.LookupChannel("foo").Msgs
+	if m, err := ms.Store("", []byte("hello"), nil); err != nil || m.Sequence != 11 {
+		t.Fatalf("Unexpected store result: %v, %v", m, err)
+	}
+	if m := msgStoreFirstMsg(t, ms); m == nil || m.Sequence != 1 {
+		t.Fatalf("Unexpected first message: %v", m)
+	}
+	if count, _, _ := ms.State(); count != 11 {
+		t.Fatalf("Expected 11 messages, got %v", count)
+	}
+	// Simulate a crash: the state file is not written.
+	ms.(*FileMsgStore).Lock()
+	ms.(*FileMsgStore).stateFile = ""
+	ms.(*FileMsgStore).Unlock()
+	fs.Close()
+
+	// Without state file, the messages are read on startup.
+	fs, _ = openLazy()
+	defer fs.Close()
+	if !isLoaded(fs, "foo") {
+		t.Fatal("Messages should have been read")
+	}
+	if first, last := fs.LookupChannel("foo").Msgs.FirstAndLastSequence(); first != 1 || last != 11 {
+		t.Fatalf("Unexpected first/last: %v/%v", first, last)
+	}
+}
+
+func TestFSGroupCommit(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	fs, _, err := NewFileStore(defaultDataStore, &testDefaultChannelLimits, GroupCommit(true))
+	if err != nil {
+		t.Fatalf("Unable to create a FileStore instance: %v", err)
+	}
+	defer fs.Close()
+	if fs.commit == nil {
+		t.Fatal("Group commit should be enabled")
+	}
+	info := testDefaultServerInfo
+	if err := fs.Init(&info); err != nil {
+		t.Fatalf("Unexpected error during Init: %v", err)
+	}
+
+	numChannels := 10
+	numFlushes := 20
+	var wg sync.WaitGroup
+	errs := make(chan error, numChannels)
+	wg.Add(numChannels)
+	for i := 0; i < numChannels; i++ {
+		cs, _, err := fs.CreateChannel(fmt.Sprintf("foo.%d", i), nil)
+		if err != nil {
+			t.Fatalf("Unexpected error creating channel: %v", err)
+		}
+		go func(cs *ChannelStore) {
+			defer wg.Done()
+			for j := 0; j < numFlushes; j++ {
+				if _, err := cs.Msgs.Store("", []byte("hello"), nil); err != nil {
+					errs <- err
+					return
+				}
+				if err := cs.Msgs.Flush(); err != nil {
+					errs <- err
+					return
+				}
+				if err := cs.Subs.Flush(); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(cs)
+	}
+	wg.Wait()
+	select {
+	case err := <-errs:
+		t.Fatalf("Unexpected error: %v", err)
+	default:
+	}
+	// Each flush syncs a file, but concurrent syncs are done in the same
+	// commit.
+	if commits := atomic.LoadInt64(&fs.commit.commits); commits == 0 || commits > int64(2*numChannels*numFlushes) {
+		t.Fatalf("Unexpected number of commits: %v", commits)
+	}
+	fs.Close()
+
+	// Syncs requested after the store is closed are done directly.
+	if err := fs.commit.sync(fs.serverFile); err == nil {
+		t.Fatal("Expected error syncing a closed file")
+	}
+
+	fs, _ = openDefaultFileStore(t)
+	defer fs.Close()
+	for i := 0; i < numChannels; i++ {
+		channel := fmt.Sprintf("foo.%d", i)
+		if count, _, _ := fs.MsgsState(channel); count != numFlushes {
+			t.Fatalf("Expected %v messages on %s, got %v", numFlushes, channel, count)
+		}
+	}
+}
+
+func TestFSAckFlushInterval(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	if _, _, err := NewFileStore(defaultDataStore, &testDefaultChannelLimits, AckFlushInterval(-1)); err == nil {
+		t.Fatal("Expected error with negative ack flush interval")
+	}
+
+	subsFile := filepath.Join(defaultDataStore, "foo", subsFileName)
+	fileSize := func() int64 {
+		fi, err := os.Stat(subsFile)
+		if err != nil {
+			stackFatalf(t, "Unable to stat file: %v", err)
+		}
+		return fi.Size()
+	}
+
+	// By default, acks are flushed right away.
+	fs := createDefaultFileStore(t)
+	defer fs.Close()
+	storeMsg(t, fs, "foo", []byte("hello"))
+	subID := storeSub(t, fs, "foo")
+	storeSubPending(t, fs, "foo", subID, 1)
+	size := fileSize()
+	storeSubAck(t, fs, "foo", subID, 1)
+	if fileSize() <= size {
+		t.Fatal("Ack should have been flushed")
+	}
+	fs.Close()
+
+	fs, _, err := NewFileStore(defaultDataStore, &testDefaultChannelLimits, AckFlushInterval(50))
+	if err != nil {
+		t.Fatalf("Unable to create a FileStore instance: %v", err)
+	}
+	defer fs.Close()
+	storeSubPending(t, fs, "foo", subID, 2)
+	fs.LookupChannel("foo").Subs.Flush()
+	size = fileSize()
+	storeSubAck(t, fs, "foo", subID, 2)
+	if fileSize() != size {
+		t.Fatal("Ack should not have been flushed yet")
+	}
+	time.Sleep(150 * time.Millisecond)
+	if fileSize() <= size {
+		t.Fatal("Ack should have been flushed")
+	}
+	// Acks not yet flushed are flushed on close.
+	storeSubPending(t, fs, "foo", subID, 3)
+	storeSubAck(t, fs, "foo", subID, 3)
+	fs.Close()
+
+	fs, state := openDefaultFileStore(t)
+	defer fs.Close()
+	if subs := getRecoveredSubs(t, state)["foo"]; len(subs) != 1 || len(subs[0].Pending) != 0 {
+		t.Fatalf("Unexpected recovered subscriptions: %v", subs)
+	}
+}
+
+func TestFSStoreFlush(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	fs, _, err := NewFileStore(defaultDataStore, &testDefaultChannelLimits, AckFlushInterval(60000))
+	if err != nil {
+		t.Fatalf("Unable to create a FileStore instance: %v", err)
+	}
+	defer fs.Close()
+	info := testDefaultServerInfo
+	if err := fs.Init(&info); err != nil {
+		t.Fatalf("Unexpected error during Init: %v", err)
+	}
+	subIDs := make(map[string]uint64)
+	for _, channel := range []string{"foo", "bar"} {
+		storeMsg(t, fs, channel, []byte("hello"))
+		subIDs[channel] = storeSub(t, fs, channel)
+		storeSubPending(t, fs, channel, subIDs[channel], 1)
+		fs.LookupChannel(channel).Subs.Flush()
+	}
+	sizes := make(map[string]int64)
+	fileSize := func(channel string) int64 {
+		fi, err := os.Stat(filepath.Join(defaultDataStore, channel, subsFileName))
+		if err != nil {
+			stackFatalf(t, "Unable to stat file: %v", err)
+		}
+		return fi.Size()
+	}
+	for channel, subID := range subIDs {
+		sizes[channel] = fileSize(channel)
+		storeSubAck(t, fs, channel, subID, 1)
+		if fileSize(channel) != sizes[channel] {
+			t.Fatal("Ack should not have been flushed yet")
+		}
+	}
+	// The acks of all channels are flushed at once.
+	if err := fs.Flush(); err != nil {
+		t.Fatalf("Unexpected error on flush: %v", err)
+	}
+	for channel := range subIDs {
+		if fileSize(channel) <= sizes[channel] {
+			t.Fatalf("Ack on %q should have been flushed", channel)
+		}
+	}
+}
+
+func TestFSSubUpdatesRecord(t *testing.T) {
+	updates := []subUpdate{
+		{subID: 1, seqno: 10},
+		{subID: 2, seqno: 1000000},
+		{subID: 1, seqno: 11, ack: true},
+		{subID: 300, seqno: 5, ack: true},
+	}
+	rec := &subUpdatesRecord{}
+	rec.encode(updates)
+	var decoded []subUpdate
+	if err := decodeSubUpdates(rec.buf, func(u subUpdate) { decoded = append(decoded, u) }); err != nil {
+		t.Fatalf("Unexpected error decoding updates: %v", err)
+	}
+	if !reflect.DeepEqual(decoded, updates) {
+		t.Fatalf("Expected %v, got %v", updates, decoded)
+	}
+	if err := decodeSubUpdates(rec.buf[:len(rec.buf)-1], func(u subUpdate) {}); err == nil {
+		t.Fatal("Expected error decoding truncated updates")
+	}
+
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	fs := createDefaultFileStore(t)
+	defer fs.Close()
+	subID := storeSub(t, fs, "foo")
+	ss := fs.LookupChannel("foo").Subs.(*FileSubStore)
+	ss.Flush()
+	fileSize := func() int64 {
+		ss.RLock()
+		defer ss.RUnlock()
+		return ss.fileSize
+	}
+	size := fileSize()
+	numSeqs := 100
+	for i := 0; i < numSeqs; i++ {
+		storeMsg(t, fs, "foo", []byte("hello"))
+		storeSubPending(t, fs, "foo", subID, uint64(i+1))
+	}
+	ss.Flush()
+	// The updates are written in a single record.
+	if written := fileSize() - size; written > int64(recordHeaderSize+2*numSeqs) {
+		t.Fatalf("Expected at most %v bytes to be written, got %v", recordHeaderSize+2*numSeqs, written)
+	}
+	storeSubAck(t, fs, "foo", subID, 1, 2, 3)
+	// Write a record in the format used before updates were batched.
+	ss.Lock()
+	if err := ss.writeRecord(ss.bw, subRecAck, &spb.SubStateUpdate{ID: subID, Seqno: 4}); err != nil {
+		t.Fatalf("Unexpected error writing record: %v", err)
+	}
+	ss.Unlock()
+	fs.Close()
+
+	fs, state := openDefaultFileStore(t)
+	defer fs.Close()
+	subs := getRecoveredSubs(t, state)["foo"]
+	if len(subs) != 1 || len(subs[0].Pending) != numSeqs-4 || subs[0].Sub.LastSent != uint64(numSeqs) {
+		t.Fatalf("Unexpected recovered subscriptions: %v", subs)
+	}
+	for seq := uint64(1); seq <= 4; seq++ {
+		if subs[0].Pending[seq] != nil {
+			t.Fatalf("Sequence %v should have been acked", seq)
+		}
+	}
+}
+
+func TestFSReservedDiskSpace(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	if _, _, err := NewFileStore(defaultDataStore, &testDefaultChannelLimits, ReservedDiskSpace(-1)); err == nil {
+		t.Fatal("Expected error with negative reserved disk space")
+	}
+
+	fs, _, err := NewFileStore(defaultDataStore, &testDefaultChannelLimits, ReservedDiskSpace(1))
+	if err != nil {
+		t.Fatalf("Unable to create a FileStore instance: %v", err)
+	}
+	defer fs.Close()
+	storeMsg(t, fs, "foo", []byte("hello"))
+
+	// Pretend that we need more space than available.
+	fs.diskSpace.Lock()
+	fs.diskSpace.reserved = 1 << 62
+	fs.diskSpace.lastCheck = time.Time{}
+	fs.diskSpace.Unlock()
+	cs := fs.LookupChannel("foo")
+	if _, err := cs.Msgs.Store("", []byte("hello"), nil); err != ErrNoSpace {
+		t.Fatalf("Expected error %v, got %v", ErrNoSpace, err)
+	}
+	if count, _, _ := cs.Msgs.State(); count != 1 {
+		t.Fatalf("Expected 1 message, got %v", count)
+	}
+
+	// The result is cached until the next check.
+	fs.diskSpace.Lock()
+	fs.diskSpace.reserved = 1
+	fs.diskSpace.Unlock()
+	if _, err := cs.Msgs.Store("", []byte("hello"), nil); err != ErrNoSpace {
+		t.Fatalf("Expected error %v, got %v", ErrNoSpace, err)
+	}
+	fs.diskSpace.Lock()
+	fs.diskSpace.lastCheck = time.Time{}
+	fs.diskSpace.Unlock()
+	if _, err := cs.Msgs.Store("", []byte("hello"), nil); err != nil {
+		t.Fatalf("Unexpected error on store: %v", err)
+	}
+}
+
+func TestFSRetentionRate(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	if _, _, err := NewFileStore(defaultDataStore, &testDefaultChannelLimits, RetentionRate(-1)); err == nil {
+		t.Fatal("Expected error with negative retention rate")
+	}
+
+	limits := testDefaultChannelLimits
+	limits.MaxNumMsgs = 10
+	// A single message of 10 bytes can be removed on each run.
+	fs, _, err := NewFileStore(defaultDataStore, &limits, RetentionRate(100))
+	if err != nil {
+		t.Fatalf("Unable to create a FileStore instance: %v", err)
+	}
+	defer fs.Close()
+	for i := 0; i < 30; i++ {
+		storeMsg(t, fs, "foo", []byte("0123456789"))
+	}
+	ms := fs.LookupChannel("foo").Msgs.(*FileMsgStore)
+	if count, _, _ := ms.State(); count <= 20 {
+		t.Fatalf("Expected limits to be enforced in the background, got %v messages", count)
+	}
+	if rs := ms.RetentionStats(); rs == nil || rs.ExcessMsgs == 0 || rs.ExcessBytes != 0 {
+		t.Fatalf("Unexpected retention stats: %v", rs)
+	}
+
+	timeout := time.Now().Add(5 * time.Second)
+	for {
+		count, _, _ := ms.State()
+		if count == 10 {
+			break
+		}
+		if time.Now().After(timeout) {
+			t.Fatalf("Expected 10 messages, got %v", count)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if first := ms.FirstSequence(); first != 21 {
+		t.Fatalf("Expected first sequence to be 21, got %v", first)
+	}
+	rs := ms.RetentionStats()
+	if rs.ExcessMsgs != 0 || rs.RemovedMsgs != 20 || rs.RemovedBytes != 200 {
+		t.Fatalf("Unexpected retention stats: %v", rs)
+	}
+	infos, err := fs.GetChannels()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(infos) != 1 || infos[0].Retention == nil || infos[0].Retention.RemovedMsgs != 20 {
+		t.Fatalf("Unexpected channel infos: %v", infos)
+	}
+}
+
+func TestFSLookupCorruptedData(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	fs := createDefaultFileStore(t)
+	defer fs.Close()
+	storeMsg(t, fs, "foo", []byte("hello"))
+	fileName := fs.LookupChannel("foo").Msgs.(*FileMsgStore).files[0].fileName
+	fs.Close()
+
+	// Alter the payload of the message, which is at the end of the file.
+	content, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		t.Fatalf("Unable to read file: %v", err)
+	}
+	content[len(content)-1] = 'X'
+	if err := ioutil.WriteFile(fileName, content, 0666); err != nil {
+		t.Fatalf("Unable to write file: %v", err)
+	}
+	// With lazy recovery, the error is returned when the message is read,
+	// and is not mistaken for a missing message.
+	fs, _, err = NewFileStore(defaultDataStore, &testDefaultChannelLimits, LazyRecovery(true))
+	if err != nil {
+		t.Fatalf("Unable to create a FileStore instance: %v", err)
+	}
+	defer fs.Close()
+	ms := fs.LookupChannel("foo").Msgs
+	if m, err := ms.Lookup(1); m != nil || err != ErrCorruptedData {
+		t.Fatalf("Expected error %v, got %v, %v", ErrCorruptedData, m, err)
+	}
+	if m, err := ms.FirstMsg(); m != nil || err != ErrCorruptedData {
+		t.Fatalf("Expected error %v, got %v, %v", ErrCorruptedData, m, err)
+	}
+	if m, err := ms.LastMsg(); m != nil || err != ErrCorruptedData {
+		t.Fatalf("Expected error %v, got %v, %v", ErrCorruptedData, m, err)
+	}
+	fs.Close()
+
+	// Otherwise, the store fails to open.
+	if err := expectedErrorOpeningDefaultFileStore(t); !strings.Contains(err.Error(), ErrCorruptedData.Error()) {
+		t.Fatalf("Expected corrupted data error, got %v", err)
+	}
+}
+
+func TestFSTieredStorage(t *testing.T) {
 	cleanupDatastore(t, defaultDataStore)
 	defer cleanupDatastore(t, defaultDataStore)
+	tierDir := defaultDataStore + "_tier"
+	cleanupDatastore(t, tierDir)
+	defer cleanupDatastore(t, tierDir)
 
-	fs := createDefaultFileStore(t)
-	defer fs.Close()
+	if _, _, err := NewFileStore(defaultDataStore, &testDefaultChannelLimits, TieredStorage(NewDirTier(tierDir), -1)); err == nil {
+		t.Fatal("Expected error with negative tier age")
+	}
 
-	testMsgsState(t, fs)
-}
+	// 10 messages per file slice.
+	limits := testDefaultChannelLimits
+	limits.MaxNumMsgs = 40
+	limits.MaxMsgBytes = 1024 * 1024
+	fs, _, err := NewFileStore(defaultDataStore, &limits, TieredStorage(NewDirTier(tierDir), 3600))
+	if err != nil {
+		t.Fatalf("Unable to create a FileStore instance: %v", err)
+	}
+	defer fs.Close()
+	if err := fs.Init(&testDefaultServerInfo); err != nil {
+		t.Fatalf("Unexpected error on init: %v", err)
+	}
+	for i := 1; i <= 25; i++ {
+		storeMsg(t, fs, "foo", []byte(fmt.Sprintf("msg%d", i)))
+	}
+	cs := fs.LookupChannel("foo")
+	ms := cs.Msgs.(*FileMsgStore)
+	// Nothing is offloaded until messages are old enough.
+	if first := ms.FirstSequence(); first != 1 {
+		t.Fatalf("Expected first sequence 1, got %v", first)
+	}
+	ms.Lock()
+	err = ms.offloadSlices(time.Now().Add(2 * time.Hour).UnixNano())
+	ms.Unlock()
+	if err != nil {
+		t.Fatalf("Unexpected error on offload: %v", err)
+	}
 
-func TestFSMaxMsgs(t *testing.T) {
-	cleanupDatastore(t, defaultDataStore)
-	defer cleanupDatastore(t, defaultDataStore)
+	check := func(ms *FileMsgStore) {
+		// The offloaded messages are counted, as they are in the range
+		// of sequences.
+		if count, _, _ := ms.State(); count != 25 {
+			stackFatalf(t, "Expected 25 messages, got %v", count)
+		}
+		if first, last := ms.FirstAndLastSequence(); first != 1 || last != 25 {
+			stackFatalf(t, "Expected sequences 1 to 25, got %v to %v", first, last)
+		}
+		for seq := uint64(1); seq <= 25; seq++ {
+			m := msgStoreLookup(t, ms, seq)
+			if m == nil || string(m.Data) != fmt.Sprintf("msg%d", seq) {
+				stackFatalf(t, "Unexpected message %v: %v", seq, m)
+			}
+		}
+		// Timestamps are resolved in the tier too.
+		for _, seq := range []uint64{5, 15} {
+			ts := msgStoreLookup(t, ms, seq).Timestamp
+			expected := seq
+			for expected > 1 && msgStoreLookup(t, ms, expected-1).Timestamp >= ts {
+				expected--
+			}
+			if got := ms.GetSequenceFromTimestamp(ts); got != expected {
+				stackFatalf(t, "Expected sequence %v for timestamp of message %v, got %v", expected, seq, got)
+			}
+		}
+	}
+	check(ms)
+	for _, name := range []string{"msgs.1-10.dat", "msgs.11-20.dat"} {
+		if _, err := os.Stat(filepath.Join(tierDir, "foo", name)); err != nil {
+			t.Fatalf("Expected %s in the tier: %v", name, err)
+		}
+	}
 
-	fs := createDefaultFileStore(t)
+	// The offloaded messages are still available after a restart.
+	fs.Close()
+	fs, _, err = NewFileStore(defaultDataStore, &limits, TieredStorage(NewDirTier(tierDir), 3600))
+	if err != nil {
+		t.Fatalf("Unable to create a FileStore instance: %v", err)
+	}
 	defer fs.Close()
+	check(fs.LookupChannel("foo").Msgs.(*FileMsgStore))
 
-	testMaxMsgs(t, fs)
+	// The offloaded files are still found once the channel directories are
+	// sharded.
+	fs.Close()
+	fs, _, err = NewFileStore(defaultDataStore, &limits, TieredStorage(NewDirTier(tierDir), 3600), ShardChannelDirs(true))
+	if err != nil {
+		t.Fatalf("Unable to create a FileStore instance: %v", err)
+	}
+	defer fs.Close()
+	check(fs.LookupChannel("foo").Msgs.(*FileMsgStore))
 }
 
-func TestFSMaxChannels(t *testing.T) {
+func TestFSTieredStorageLimits(t *testing.T) {
 	cleanupDatastore(t, defaultDataStore)
 	defer cleanupDatastore(t, defaultDataStore)
+	tierDir := defaultDataStore + "_tier"
+	cleanupDatastore(t, tierDir)
+	defer cleanupDatastore(t, tierDir)
 
-	fs := createDefaultFileStore(t)
+	// 10 messages per file slice.
+	limits := testDefaultChannelLimits
+	limits.MaxNumMsgs = 40
+	limits.MaxMsgBytes = 1024 * 1024
+	fs, _, err := NewFileStore(defaultDataStore, &limits, TieredStorage(NewDirTier(tierDir), 3600))
+	if err != nil {
+		t.Fatalf("Unable to create a FileStore instance: %v", err)
+	}
 	defer fs.Close()
+	if err := fs.Init(&testDefaultServerInfo); err != nil {
+		t.Fatalf("Unexpected error on init: %v", err)
+	}
+	expiration := time.Now().Add(time.Hour).UnixNano()
+	for i := 1; i <= 25; i++ {
+		storeMsg(t, fs, "foo", []byte(fmt.Sprintf("msg%d", i)))
+		storeMsgWithExt(t, fs, "bar", []byte("hello"), &spb.MsgExt{Expiration: expiration})
+	}
+	later := time.Now().Add(2 * time.Hour).UnixNano()
+	for _, channel := range []string{"foo", "bar"} {
+		ms := fs.LookupChannel(channel).Msgs.(*FileMsgStore)
+		ms.Lock()
+		err = ms.offloadSlices(later)
+		ms.Unlock()
+		if err != nil {
+			t.Fatalf("Unexpected error on offload: %v", err)
+		}
+	}
 
-	limitCount := 2
-
-	limits := testDefaultChannelLimits
-	limits.MaxChannels = limitCount
+	// The offloaded files are removed once all their messages are beyond
+	// the limits: the first one when the channel holds 50 messages.
+	for i := 26; i <= 49; i++ {
+		storeMsg(t, fs, "foo", []byte(fmt.Sprintf("msg%d", i)))
+	}
+	ms := fs.LookupChannel("foo").Msgs.(*FileMsgStore)
+	if first, _ := ms.FirstAndLastSequence(); first != 1 {
+		t.Fatalf("Expected first sequence 1, got %v", first)
+	}
+	storeMsg(t, fs, "foo", []byte("msg50"))
+	check := func(ms *FileMsgStore) {
+		if count, _, _ := ms.State(); count != 40 {
+			stackFatalf(t, "Expected 40 messages, got %v", count)
+		}
+		if first, last := ms.FirstAndLastSequence(); first != 11 || last != 50 {
+			stackFatalf(t, "Expected sequences 11 to 50, got %v to %v", first, last)
+		}
+		if m := msgStoreLookup(t, ms, 10); m != nil {
+			stackFatalf(t, "Message 10 should have been removed: %v", m)
+		}
+		if m := msgStoreLookup(t, ms, 11); m == nil || string(m.Data) != "msg11" {
+			stackFatalf(t, "Unexpected message 11: %v", m)
+		}
+	}
+	check(ms)
+	if _, err := os.Stat(filepath.Join(tierDir, "foo", "msgs.1-10.dat")); !os.IsNotExist(err) {
+		t.Fatalf("File should have been removed from the tier: %v", err)
+	}
 
-	fs.SetChannelLimits(limits)
+	// Files whose messages have all expired are removed too.
+	ms = fs.LookupChannel("bar").Msgs.(*FileMsgStore)
+	ms.Lock()
+	_, _, err = ms.enforceLimits(later, 0)
+	tiered := len(ms.tiered)
+	ms.Unlock()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if tiered != 0 {
+		t.Fatalf("Expected no file in the tier, got %v", tiered)
+	}
+	if count, _, _ := ms.State(); count != 1 {
+		t.Fatalf("Expected only the last message to be kept, got %v", count)
+	}
 
-	testMaxChannels(t, fs, limitCount)
+	// The tier index is updated.
+	fs.Close()
+	fs, _, err = NewFileStore(defaultDataStore, &limits, TieredStorage(NewDirTier(tierDir), 3600))
+	if err != nil {
+		t.Fatalf("Unable to create a FileStore instance: %v", err)
+	}
+	defer fs.Close()
+	check(fs.LookupChannel("foo").Msgs.(*FileMsgStore))
 }
 
-func TestFSMaxSubs(t *testing.T) {
+func TestFSRemoveAndShiftFilesBeforeLastSlice(t *testing.T) {
 	cleanupDatastore(t, defaultDataStore)
 	defer cleanupDatastore(t, defaultDataStore)
 
-	fs := createDefaultFileStore(t)
-	defer fs.Close()
-
-	limitCount := 2
-
+	// 10 messages per file slice.
 	limits := testDefaultChannelLimits
-	limits.MaxSubs = limitCount
+	limits.MaxNumMsgs = 40
+	limits.MaxMsgBytes = 1024 * 1024
+	fs, _, err := NewFileStore(defaultDataStore, &limits)
+	if err != nil {
+		t.Fatalf("Unable to create a FileStore instance: %v", err)
+	}
+	defer fs.Close()
+	if err := fs.Init(&testDefaultServerInfo); err != nil {
+		t.Fatalf("Unexpected error on init: %v", err)
+	}
+	for i := 1; i <= 25; i++ {
+		storeMsg(t, fs, "foo", []byte(fmt.Sprintf("msg%d", i)))
+	}
+	ms := fs.LookupChannel("foo").Msgs.(*FileMsgStore)
+	ms.Lock()
+	if ms.currSliceIdx != 2 {
+		ms.Unlock()
+		t.Fatalf("Expected current slice 2, got %v", ms.currSliceIdx)
+	}
+	// Remove the first slice while the current one is not the last.
+	err = ms.removeAndShiftFiles()
+	if err == nil {
+		ms.currSliceIdx--
+	}
+	fileName, expected := ms.file.Name(), ms.files[ms.currSliceIdx].fileName
+	ms.Unlock()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if fileName != expected {
+		t.Fatalf("Expected current file to be %v, got %v", expected, fileName)
+	}
+	storeMsg(t, fs, "foo", []byte("msg26"))
 
-	fs.SetChannelLimits(limits)
+	check := func(ms *FileMsgStore) {
+		if first, last := ms.FirstAndLastSequence(); first != 11 || last != 26 {
+			stackFatalf(t, "Expected sequences 11 to 26, got %v to %v", first, last)
+		}
+		for seq := uint64(11); seq <= 26; seq++ {
+			m := msgStoreLookup(t, ms, seq)
+			if m == nil || string(m.Data) != fmt.Sprintf("msg%d", seq) {
+				stackFatalf(t, "Unexpected message %v: %v", seq, m)
+			}
+		}
+	}
+	check(ms)
 
-	testMaxSubs(t, fs, limitCount)
+	// The new message was written in the current file, so the messages
+	// are recovered in order.
+	fs.Close()
+	fs, _, err = NewFileStore(defaultDataStore, &limits)
+	if err != nil {
+		t.Fatalf("Unable to create a FileStore instance: %v", err)
+	}
+	defer fs.Close()
+	check(fs.LookupChannel("foo").Msgs.(*FileMsgStore))
 }
 
 func TestFSBasicSubStore(t *testing.T) {
@@ -718,7 +2045,7 @@ func TestFSRecoverSubUpdatesForDeleteSubOK(t *testing.T) {
 	if state == nil {
 		t.Fatal("Expected state to be recovered")
 	}
-	subs := state.Subs
+	subs := getRecoveredSubs(t, state)
 
 	if !fs.HasChannel() || len(subs) != 1 || subs["foo"] == nil {
 		t.Fatal("Channel foo should have been recovered")
@@ -765,7 +2092,7 @@ func TestFSNoSubIdCollisionAfterRecovery(t *testing.T) {
 	if state == nil {
 		t.Fatal("Expected state to be recovered")
 	}
-	subs := state.Subs
+	subs := getRecoveredSubs(t, state)
 
 	if !fs.HasChannel() || len(subs) != 1 || subs["foo"] == nil {
 		t.Fatal("Channel foo should have been recovered")
@@ -798,7 +2125,7 @@ func TestFSNoSubIdCollisionAfterRecovery(t *testing.T) {
 	if state == nil {
 		t.Fatal("Expected state to be recovered")
 	}
-	subs = state.Subs
+	subs = getRecoveredSubs(t, state)
 
 	if !fs.HasChannel() || len(subs) != 1 || subs["foo"] == nil {
 		t.Fatal("Channel foo should have been recovered")
@@ -845,7 +2172,7 @@ func TestFSSubLastSentCorrectOnRecovery(t *testing.T) {
 	if state == nil {
 		t.Fatal("State should have been recovered")
 	}
-	subs := state.Subs["foo"]
+	subs := getRecoveredSubs(t, state)["foo"]
 	if subs == nil || len(subs) != 1 {
 		t.Fatalf("One subscription should have been recovered, got %v", len(subs))
 	}
@@ -915,7 +2242,7 @@ func TestFSUpdatedSub(t *testing.T) {
 	if state == nil {
 		t.Fatal("State should have been recovered")
 	}
-	subs := state.Subs["foo"]
+	subs := getRecoveredSubs(t, state)["foo"]
 	if subs == nil || len(subs) != 2 {
 		t.Fatalf("Two subscriptions should have been recovered, got %v", len(subs))
 	}
@@ -954,6 +2281,31 @@ func TestFSGetSeqFromTimestamp(t *testing.T) {
 	testGetSeqFromStartTime(t, fs)
 }
 
+func TestFSGetSeqFromTimestampIndex(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	fs := createDefaultFileStore(t)
+	defer fs.Close()
+
+	testGetSeqFromTimestampIndex(t, fs)
+}
+
+func TestFSBatchAcks(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	fs := createDefaultFileStore(t)
+	defer fs.Close()
+
+	subID := testBatchAcks(t, fs)
+	fs.Close()
+
+	fs, state := openDefaultFileStore(t)
+	defer fs.Close()
+	checkBatchAcksRecovered(t, state, subID)
+}
+
 func TestFSBadClientFile(t *testing.T) {
 	cleanupDatastore(t, defaultDataStore)
 	defer cleanupDatastore(t, defaultDataStore)
@@ -1091,6 +2443,36 @@ func TestFSBadClientFile(t *testing.T) {
 	expectedErrorOpeningDefaultFileStore(t)
 }
 
+func TestFSUpdateClient(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	fs := createDefaultFileStore(t)
+	defer fs.Close()
+
+	testUpdateClient(t, fs)
+	fs.Close()
+
+	fs, state := openDefaultFileStore(t)
+	defer fs.Close()
+	checkUpdateClientRecovered(t, state)
+}
+
+func TestFSRecoverSubs(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	fs := createDefaultFileStore(t)
+	defer fs.Close()
+
+	testRecoverSubs(t, fs)
+	fs.Close()
+
+	fs, state := openDefaultFileStore(t)
+	defer fs.Close()
+	checkRecoverSubs(t, state)
+}
+
 func TestFSClientAPIs(t *testing.T) {
 	cleanupDatastore(t, defaultDataStore)
 	defer cleanupDatastore(t, defaultDataStore)
@@ -1115,6 +2497,12 @@ func TestFSClientAPIs(t *testing.T) {
 		if c.ID != "client2" && c.ID != "client3" {
 			t.Fatalf("Unexpected recovered client: %v", c.ID)
 		}
+		if (c.ID == "client3") != (c.UnreachableSince == 123) {
+			t.Fatalf("Unexpected unreachable time of %v: %v", c.ID, c.UnreachableSince)
+		}
+		if (c.ID == "client3") != (c.LastContact == 456) {
+			t.Fatalf("Unexpected last contact of %v: %v", c.ID, c.LastContact)
+		}
 	}
 }
 
@@ -1433,7 +2821,7 @@ func TestFSBadSubFile(t *testing.T) {
 	expectedErrorOpeningDefaultFileStore(t)
 
 	// Test with various types
-	types := []recordType{subRecNew, subRecUpdate, subRecDel, subRecMsg, subRecAck, 99}
+	types := []recordType{subRecNew, subRecUpdate, subRecDel, subRecMsg, subRecAck, subRecUpdates, 99}
 	content := []byte("abc")
 	crc := crc32.ChecksumIEEE(content)
 	for _, oneType := range types {
@@ -2446,3 +3834,237 @@ func TestFSWriteRecord(t *testing.T) {
 		t.Fatalf("Size should be 0, got %v", size)
 	}
 }
+
+// readDataStoreFiles returns the content of all files in the default data
+// store, keyed by their path.
+func readDataStoreFiles(t *testing.T) map[string][]byte {
+	files := make(map[string][]byte)
+	err := filepath.Walk(defaultDataStore, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		buf, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		files[path] = buf
+		return nil
+	})
+	if err != nil {
+		stackFatalf(t, "Unable to read data store files: %v", err)
+	}
+	return files
+}
+
+func TestFSReadOnly(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	fs := createDefaultFileStore(t)
+	if _, _, err := fs.AddClient("me", "hbInbox", nil); err != nil {
+		t.Fatalf("Unexpected error adding client: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		storeMsg(t, fs, "foo", []byte("hello"))
+	}
+	sub := storeSub(t, fs, "foo")
+	storeSubPending(t, fs, "foo", sub, 1, 2, 3)
+	storeSubAck(t, fs, "foo", sub, 2)
+	fs.Close()
+
+	files := readDataStoreFiles(t)
+
+	fs, state, err := NewFileStore(defaultDataStore, &testDefaultChannelLimits, ReadOnly(true))
+	if err != nil {
+		t.Fatalf("Unable to open FileStore in read-only mode: %v", err)
+	}
+	defer fs.Close()
+	if state == nil || state.Info.ClusterID != testDefaultServerInfo.ClusterID {
+		t.Fatalf("Unexpected recovered state: %v", state)
+	}
+	if len(state.Clients) != 1 || state.Clients[0].ID != "me" {
+		t.Fatalf("Unexpected recovered clients: %v", state.Clients)
+	}
+	subs := getRecoveredSubs(t, state)["foo"]
+	if len(subs) != 1 || subs[0].Sub.ID != sub || len(subs[0].Pending) != 2 {
+		t.Fatalf("Unexpected recovered subscriptions: %v", subs)
+	}
+	cs := fs.LookupChannel("foo")
+	if n, _, _ := cs.Msgs.State(); n != 3 {
+		t.Fatalf("Expected 3 messages, got %v", n)
+	}
+	if m, err := cs.Msgs.Lookup(2); err != nil || m == nil || string(m.Data) != "hello" {
+		t.Fatalf("Unexpected message: %v", m)
+	}
+
+	// All writes are rejected.
+	info := testDefaultServerInfo
+	if err := fs.Init(&info); err != ErrReadOnly {
+		t.Fatalf("Expected error %v, got %v", ErrReadOnly, err)
+	}
+	if c, _, err := fs.AddClient("me", "hbInbox", nil); err != nil || c == nil {
+		t.Fatalf("Expected existing client, got %v - %v", c, err)
+	}
+	if _, _, err := fs.AddClient("other", "hbInbox", nil); err != ErrReadOnly {
+		t.Fatalf("Expected error %v, got %v", ErrReadOnly, err)
+	}
+	if _, _, err := fs.CreateChannel("bar", nil); err != ErrReadOnly {
+		t.Fatalf("Expected error %v, got %v", ErrReadOnly, err)
+	}
+	if _, err := cs.Msgs.Store("", []byte("hello"), nil); err != ErrReadOnly {
+		t.Fatalf("Expected error %v, got %v", ErrReadOnly, err)
+	}
+	subState := &spb.SubState{}
+	if err := cs.Subs.CreateSub(subState); err != ErrReadOnly {
+		t.Fatalf("Expected error %v, got %v", ErrReadOnly, err)
+	}
+	if err := cs.Subs.AddSeqPending(sub, 4); err != ErrReadOnly {
+		t.Fatalf("Expected error %v, got %v", ErrReadOnly, err)
+	}
+	if err := cs.Subs.AckSeqPending(sub, 1); err != ErrReadOnly {
+		t.Fatalf("Expected error %v, got %v", ErrReadOnly, err)
+	}
+	fs.DeleteClient("me")
+	cs.Subs.DeleteSub(sub)
+	fs.Close()
+
+	// Nothing was modified, created or removed.
+	if after := readDataStoreFiles(t); !reflect.DeepEqual(files, after) {
+		t.Fatal("Files should not have been modified by the read-only store")
+	}
+}
+
+func TestFSReadOnlyPartialRecord(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	fs := createDefaultFileStore(t)
+	storeMsg(t, fs, "foo", []byte("hello"))
+	storeMsg(t, fs, "foo", []byte("hello"))
+	fs.Close()
+
+	// Simulate a record being written by the primary.
+	f, err := os.OpenFile(filepath.Join(defaultDataStore, "foo", "msgs.1.dat"), os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		t.Fatalf("Unable to open file: %v", err)
+	}
+	f.Write([]byte{1, 2, 3, 4, 5, 6, 7, 8, 9})
+	f.Close()
+
+	fs, _, err = NewFileStore(defaultDataStore, &testDefaultChannelLimits, ReadOnly(true))
+	if err != nil {
+		t.Fatalf("Unable to open FileStore in read-only mode: %v", err)
+	}
+	defer fs.Close()
+	if n, _, _ := fs.LookupChannel("foo").Msgs.State(); n != 2 {
+		t.Fatalf("Expected 2 messages, got %v", n)
+	}
+}
+
+func TestFSReadOnlyMissingDir(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+
+	if fs, _, err := NewFileStore(defaultDataStore, &testDefaultChannelLimits, ReadOnly(true)); err == nil {
+		fs.Close()
+		t.Fatal("Expected error opening a missing store in read-only mode")
+	}
+	if _, err := os.Stat(defaultDataStore); !os.IsNotExist(err) {
+		t.Fatalf("Root directory should not have been created: %v", err)
+	}
+}
+
+func TestFSConcurrentCreateChannel(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	limits := testDefaultChannelLimits
+	limits.MaxChannels = 5
+	fs, _, err := NewFileStore(defaultDataStore, &limits)
+	if err != nil {
+		t.Fatalf("Unable to create a FileStore instance: %v", err)
+	}
+	defer fs.Close()
+
+	// Channels are created concurrently, each of them several times.
+	numChannels := 10
+	numCalls := 4
+	var (
+		wg      sync.WaitGroup
+		created int32
+		tooMany int32
+	)
+	errs := make(chan error, numChannels*numCalls)
+	wg.Add(numChannels * numCalls)
+	for i := 0; i < numChannels*numCalls; i++ {
+		go func(channel string) {
+			defer wg.Done()
+			_, isNew, err := fs.CreateChannel(channel, nil)
+			switch {
+			case err == ErrTooManyChannels:
+				atomic.AddInt32(&tooMany, 1)
+			case err != nil:
+				errs <- err
+			case isNew:
+				atomic.AddInt32(&created, 1)
+			}
+		}(fmt.Sprintf("foo.%d", i%numChannels))
+	}
+	wg.Wait()
+	select {
+	case err := <-errs:
+		t.Fatalf("Unexpected error: %v", err)
+	default:
+	}
+	if created != int32(limits.MaxChannels) {
+		t.Fatalf("Expected %v channels to be created, got %v", limits.MaxChannels, created)
+	}
+	if n := len(fs.GetChannelNames()); n != limits.MaxChannels {
+		t.Fatalf("Expected %v channels, got %v", limits.MaxChannels, n)
+	}
+	if tooMany == 0 {
+		t.Fatal("Expected some channels to be rejected")
+	}
+
+	// Reads of the sequences are not blocked by a write in progress.
+	cs := fs.LookupChannel("foo.0")
+	if cs == nil {
+		cs = fs.LookupChannel(fs.GetChannelNames()[0])
+	}
+	ms := cs.Msgs.(*FileMsgStore)
+	if _, err := ms.Store("", []byte("hello"), nil); err != nil {
+		t.Fatalf("Unexpected error on store: %v", err)
+	}
+	ms.Lock()
+	first, last := ms.FirstSequence(), ms.LastSequence()
+	ms.Unlock()
+	if first != 1 || last != 1 {
+		t.Fatalf("Unexpected first/last: %v/%v", first, last)
+	}
+}
+
+func TestFSCheckInvariants(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	fs := createDefaultFileStore(t)
+	defer fs.Close()
+
+	for i := 0; i < 5; i++ {
+		storeMsg(t, fs, "foo", []byte("hello"))
+	}
+	subID := storeSub(t, fs, "foo")
+	storeSubPending(t, fs, "foo", subID, 2, 3)
+	fs.Close()
+
+	fs, _ = openDefaultFileStore(t)
+	defer fs.Close()
+	if err := fs.CheckInvariants(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// A message pending for a subscription must have been stored.
+	storeSubPending(t, fs, "foo", subID, 10)
+	if err := fs.CheckInvariants(); err == nil || !strings.Contains(err.Error(), "message 10 pending") {
+		t.Fatalf("Expected error about the pending message, got %v", err)
+	}
+}
@@ -0,0 +1,90 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package stores
+
+import (
+	"fmt"
+	"sort"
+)
+
+// CheckInvariants checks that the state of the channels of the store is
+// consistent, and returns an error describing the first inconsistency
+// found, if any. For each channel:
+//
+//   - the messages between the first and last sequences can be read, and
+//     have the sequence they are looked up with,
+//   - their number and size are the ones reported by the store,
+//   - the subscriptions have distinct IDs not above the highest recorded,
+//   - the sequences of their pending messages are not above the last one.
+//
+// It is run when a file store is opened in the `chaos` build (see
+// chaos.go), after a crash may have been simulated. Since all the messages
+// are read, it can take a while on a large store.
+func (fs *FileStore) CheckInvariants() error {
+	fs.RLock()
+	names := make([]string, 0, len(fs.channels))
+	for name := range fs.channels {
+		names = append(names, name)
+	}
+	fs.RUnlock()
+	sort.Strings(names)
+	for _, name := range names {
+		cs := fs.LookupChannel(name)
+		if cs == nil {
+			continue
+		}
+		if err := checkChannelInvariants(cs); err != nil {
+			return fmt.Errorf("invariant violated on channel %q: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// checkChannelInvariants checks the invariants of one channel.
+func checkChannelInvariants(cs *ChannelStore) error {
+	first, last := cs.Msgs.FirstAndLastSequence()
+	count, bytes, err := cs.Msgs.State()
+	if err != nil {
+		return err
+	}
+	if count > 0 && (first == 0 || first > last) {
+		return fmt.Errorf("%v messages from %v to %v", count, first, last)
+	}
+	n, size := 0, uint64(0)
+	for seq := first; count > 0 && seq <= last; seq++ {
+		m, err := cs.Msgs.Lookup(seq)
+		if err != nil {
+			return fmt.Errorf("unable to read message %v: %v", seq, err)
+		}
+		// Messages removed by key compaction leave gaps.
+		if m == nil {
+			continue
+		}
+		if m.Sequence != seq {
+			return fmt.Errorf("message %v found with sequence %v", seq, m.Sequence)
+		}
+		n++
+		size += uint64(len(m.Data))
+	}
+	if n != count || size != bytes {
+		return fmt.Errorf("%v messages (%v bytes) found, %v (%v bytes) reported", n, size, count, bytes)
+	}
+
+	ss, ok := cs.Subs.(*FileSubStore)
+	if !ok {
+		return nil
+	}
+	ss.RLock()
+	defer ss.RUnlock()
+	for id, sub := range ss.subs {
+		if sub.sub.ID != id || id > ss.maxSubID {
+			return fmt.Errorf("subscription %v recorded as %v, highest ID is %v", sub.sub.ID, id, ss.maxSubID)
+		}
+		for seq := range sub.seqnos {
+			if seq == 0 || seq > last {
+				return fmt.Errorf("subscription %v has message %v pending, last message is %v", id, seq, last)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,819 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package stores
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/nats-io/go-nats-streaming/pb"
+	"github.com/nats-io/nats-streaming-server/spb"
+)
+
+// Keys of the key/value stores. Messages, subscriptions and pending messages
+// are keyed by the channel name, followed by a NUL byte, which can't be part
+// of a channel name, and by big endian sequences or subscription IDs, so
+// that they are iterated in order.
+var (
+	kvServerInfoKey = []byte("info")
+	kvClientPrefix  = []byte("client/")
+	kvChannelPrefix = []byte("channel/")
+	kvMsgPrefix     = []byte("msg/")
+	kvSubPrefix     = []byte("sub/")
+	kvPendingPrefix = []byte("pending/")
+)
+
+// kvDB is the ordered key/value database behind a key/value store. The
+// LEVELDB and BOLT store types are thin adapters of their database to
+// this interface.
+type kvDB interface {
+	// get returns the value of the key, or nil if the key does not exist.
+	get(key []byte) ([]byte, error)
+	// write atomically applies the batch.
+	write(b *kvBatch) error
+	// iterate calls `f` for the keys starting with `prefix`, in order. The
+	// key and value are only valid during the call, and `f` must not
+	// access the database.
+	iterate(prefix []byte, f func(key, value []byte) error) error
+	// close closes the database.
+	close() error
+}
+
+// kvOp is a put, or a delete if `del` is true, of a kvBatch.
+type kvOp struct {
+	key   []byte
+	value []byte
+	del   bool
+}
+
+// kvBatch is a list of writes applied atomically by kvDB.write().
+type kvBatch struct {
+	ops []kvOp
+}
+
+// put adds the write of `value` under `key` to the batch.
+func (b *kvBatch) put(key, value []byte) *kvBatch {
+	b.ops = append(b.ops, kvOp{key: key, value: value})
+	return b
+}
+
+// delete adds the removal of `key` to the batch.
+func (b *kvBatch) delete(key []byte) *kvBatch {
+	b.ops = append(b.ops, kvOp{key: key, del: true})
+	return b
+}
+
+// kvStore is the part of the key/value stores that does not depend on the
+// database. As for the other stores, messages are also kept in memory.
+type kvStore struct {
+	genericStore
+	db kvDB
+}
+
+// kvSubStore is a subscription store backed by a kvDB.
+type kvSubStore struct {
+	genericSubStore
+	db kvDB
+}
+
+// kvMsgStore is a per channel message store backed by a kvDB.
+type kvMsgStore struct {
+	genericMsgStore
+	db kvDB
+}
+
+// kvNameKey returns the key of the client or channel `name`.
+func kvNameKey(prefix []byte, name string) []byte {
+	key := make([]byte, 0, len(prefix)+len(name))
+	key = append(key, prefix...)
+	return append(key, name...)
+}
+
+// kvChannelKey returns the key made of the channel name and the given IDs.
+// Without IDs, it is the prefix of all the keys of the channel.
+func kvChannelKey(prefix []byte, channel string, ids ...uint64) []byte {
+	key := make([]byte, len(prefix)+len(channel)+1, len(prefix)+len(channel)+1+8*len(ids))
+	copy(key, prefix)
+	copy(key[len(prefix):], channel)
+	for _, id := range ids {
+		var b [8]byte
+		binary.BigEndian.PutUint64(b[:], id)
+		key = append(key, b[:]...)
+	}
+	return key
+}
+
+// kvLastID returns the ID at the end of the key.
+func kvLastID(key []byte) uint64 {
+	return binary.BigEndian.Uint64(key[len(key)-8:])
+}
+
+// kvMarshal returns the encoded record.
+func kvMarshal(r record) ([]byte, error) {
+	buf := make([]byte, r.Size())
+	n, err := r.MarshalTo(buf)
+	return buf[:n], err
+}
+
+////////////////////////////////////////////////////////////////////////////
+// kvStore methods
+////////////////////////////////////////////////////////////////////////////
+
+// recover recovers the server info, clients and channels. It returns nil
+// if the store has not been initialized yet.
+func (s *kvStore) recover() (*RecoveredState, error) {
+	buf, err := s.db.get(kvServerInfoKey)
+	if buf == nil || err != nil {
+		return nil, err
+	}
+	info := &spb.ServerInfo{}
+	if err := info.Unmarshal(buf); err != nil {
+		return nil, ErrCorruptedData
+	}
+	state := &RecoveredState{Info: info}
+
+	err = s.db.iterate(kvClientPrefix, func(key, value []byte) error {
+		c := &Client{}
+		if err := c.ClientInfo.Unmarshal(value); err != nil {
+			return ErrCorruptedData
+		}
+		s.clients[c.ID] = c
+		state.Clients = append(state.Clients, c)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Collect the channels first, since their messages and subscriptions
+	// can't be read while iterating.
+	created := make(map[string]time.Time)
+	err = s.db.iterate(kvChannelPrefix, func(key, value []byte) error {
+		info := &spb.ChannelInfo{}
+		if err := info.Unmarshal(value); err != nil {
+			return ErrCorruptedData
+		}
+		created[string(key[len(kvChannelPrefix):])] = time.Unix(0, info.Created)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	recovered := make(map[string][]*spb.SubState, len(created))
+	for channel := range created {
+		msgStore := s.newKVMsgStore(channel)
+		if err := msgStore.recover(); err != nil {
+			return nil, err
+		}
+		subStore := s.newKVSubStore(channel)
+		subs, err := subStore.recover()
+		if err != nil {
+			return nil, err
+		}
+		recovered[channel] = subs
+		s.channels[channel] = &ChannelStore{
+			Subs:    subStore,
+			Msgs:    msgStore,
+			Created: created[channel],
+		}
+	}
+	state.RecoverSubs = func(f func(string, *RecoveredSubState) error) error {
+		for channel, subs := range recovered {
+			cs := s.channels[channel]
+			subStore := cs.Subs.(*kvSubStore)
+			msgStore := cs.Msgs.(*kvMsgStore)
+			for _, sub := range subs {
+				rss, err := subStore.recoverPending(sub, msgStore)
+				if err != nil {
+					return err
+				}
+				if err := f(channel, rss); err != nil {
+					return err
+				}
+			}
+		}
+		// Now that the pending messages are handed out, the expired
+		// messages can be removed.
+		for _, cs := range s.channels {
+			ms := cs.Msgs.(*kvMsgStore)
+			ms.Lock()
+			ms.setExpiryTimer(ms.expire)
+			ms.Unlock()
+		}
+		return nil
+	}
+	return state, nil
+}
+
+// Init records the server's information.
+func (s *kvStore) Init(info *spb.ServerInfo) error {
+	buf, err := kvMarshal(info)
+	if err != nil {
+		return err
+	}
+	return s.db.write(new(kvBatch).put(kvServerInfoKey, buf))
+}
+
+// CreateChannel creates a ChannelStore for the given channel, and returns
+// `true` to indicate that the channel is new, false if it already exists.
+func (s *kvStore) CreateChannel(channel string, userData interface{}) (*ChannelStore, bool, error) {
+	s.Lock()
+	defer s.Unlock()
+	channelStore := s.channels[channel]
+	if channelStore != nil {
+		return channelStore, false, nil
+	}
+
+	if err := s.canAddChannel(channel); err != nil {
+		return nil, false, err
+	}
+
+	created := time.Now()
+	buf, err := kvMarshal(&spb.ChannelInfo{Created: created.UnixNano()})
+	if err != nil {
+		return nil, false, err
+	}
+	if err := s.db.write(new(kvBatch).put(kvNameKey(kvChannelPrefix, channel), buf)); err != nil {
+		return nil, false, err
+	}
+
+	channelStore = &ChannelStore{
+		Subs:     s.newKVSubStore(channel),
+		Msgs:     s.newKVMsgStore(channel),
+		UserData: userData,
+		Created:  created,
+	}
+
+	s.channels[channel] = channelStore
+
+	return channelStore, true, nil
+}
+
+// AddClient stores information about the client identified by `clientID`.
+func (s *kvStore) AddClient(clientID, hbInbox string, userData interface{}) (*Client, bool, error) {
+	sc, isNew, err := s.genericStore.AddClient(clientID, hbInbox, userData)
+	if err != nil || !isNew {
+		return sc, isNew, err
+	}
+	if err := s.putClient(&sc.ClientInfo); err != nil {
+		s.genericStore.DeleteClient(clientID)
+		return nil, false, err
+	}
+	return sc, true, nil
+}
+
+// DeleteClient invalidates the client identified by `clientID`.
+func (s *kvStore) DeleteClient(clientID string) *Client {
+	sc := s.genericStore.DeleteClient(clientID)
+	if sc != nil {
+		s.db.write(new(kvBatch).delete(kvNameKey(kvClientPrefix, clientID)))
+	}
+	return sc
+}
+
+// SetClientUnreachable records the time since which the client does not
+// answer heartbeats.
+func (s *kvStore) SetClientUnreachable(clientID string, since int64) error {
+	if err := s.genericStore.SetClientUnreachable(clientID, since); err != nil {
+		return err
+	}
+	return s.rewriteClient(clientID)
+}
+
+// SetClientLastContact records the time at which the client last answered
+// a heartbeat.
+func (s *kvStore) SetClientLastContact(clientID string, lastContact int64) error {
+	if err := s.genericStore.SetClientLastContact(clientID, lastContact); err != nil {
+		return err
+	}
+	return s.rewriteClient(clientID)
+}
+
+// UpdateClient replaces the heartbeat inbox and the metadata of the client.
+func (s *kvStore) UpdateClient(clientID, hbInbox string, metadata []byte) (*Client, error) {
+	sc, err := s.genericStore.UpdateClient(clientID, hbInbox, metadata)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.rewriteClient(clientID); err != nil {
+		return nil, err
+	}
+	return sc, nil
+}
+
+// rewriteClient writes the current state of the client in the database.
+func (s *kvStore) rewriteClient(clientID string) error {
+	s.RLock()
+	c := s.clients[clientID]
+	var info spb.ClientInfo
+	if c != nil {
+		info = c.ClientInfo
+	}
+	s.RUnlock()
+	if c == nil {
+		return nil
+	}
+	return s.putClient(&info)
+}
+
+// putClient writes the client information in the database.
+func (s *kvStore) putClient(info *spb.ClientInfo) error {
+	buf, err := kvMarshal(info)
+	if err != nil {
+		return err
+	}
+	return s.db.write(new(kvBatch).put(kvNameKey(kvClientPrefix, info.ID), buf))
+}
+
+// Close closes all stores and the database.
+func (s *kvStore) Close() error {
+	s.Lock()
+	defer s.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	err := s.genericStore.close()
+	if lerr := s.db.close(); lerr != nil && err == nil {
+		err = lerr
+	}
+	return err
+}
+
+////////////////////////////////////////////////////////////////////////////
+// kvMsgStore methods
+////////////////////////////////////////////////////////////////////////////
+
+// newKVMsgStore returns a new message store for the given channel.
+func (s *kvStore) newKVMsgStore(channel string) *kvMsgStore {
+	ms := &kvMsgStore{db: s.db}
+	ms.init(channel, s.limits, s.budget, s.stamper)
+	return ms
+}
+
+// recover reads the messages of the channel. As for the other stores, the
+// limits don't apply to recovered messages.
+func (ms *kvMsgStore) recover() error {
+	return ms.db.iterate(kvChannelKey(kvMsgPrefix, ms.subject), func(key, value []byte) error {
+		// The value is the message followed by its optional attributes,
+		// as for the records of the file store.
+		msg := &pb.MsgProto{}
+		if err := msg.Unmarshal(value); err != nil {
+			return ErrCorruptedData
+		}
+		ext := &spb.MsgExt{}
+		if err := ext.Unmarshal(value); err != nil {
+			return ErrCorruptedData
+		}
+		if ms.first == 0 {
+			ms.setFirst(msg.Sequence)
+		}
+		ms.setLast(msg.Sequence)
+		ms.addMsg(msg, ext)
+		ms.totalCount++
+		ms.totalBytes += uint64(len(msg.Data))
+		if prev := ms.supersede(msg.Sequence, ext); prev != nil && prev.Sequence == ms.first {
+			ms.setFirst(ms.nextSeq(ms.first))
+		}
+		return nil
+	})
+}
+
+// Store a given message.
+func (ms *kvMsgStore) Store(reply string, data []byte, ext *spb.MsgExt) (*pb.MsgProto, error) {
+	ms.Lock()
+	defer ms.Unlock()
+
+	seq, now, err := ms.stamp()
+	if err != nil {
+		return nil, err
+	}
+	m := &pb.MsgProto{
+		Sequence:  seq,
+		Subject:   ms.subject,
+		Reply:     reply,
+		Data:      data,
+		Timestamp: now,
+	}
+	if err := ms.storeMsg(m, ext, m.Timestamp); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// StoreBatch stores the given messages atomically, in a single write.
+func (ms *kvMsgStore) StoreBatch(msgs []*BatchMsg) ([]*pb.MsgProto, error) {
+	ms.Lock()
+	defer ms.Unlock()
+
+	seq, now, err := ms.stamp()
+	if err != nil {
+		return nil, err
+	}
+	recs := make([]*msgRecord, len(msgs))
+	stored := make([]*pb.MsgProto, len(msgs))
+	for i, bm := range msgs {
+		m := &pb.MsgProto{
+			Sequence:  seq + uint64(i),
+			Subject:   ms.subject,
+			Reply:     bm.Reply,
+			Data:      bm.Data,
+			Timestamp: now,
+		}
+		recs[i] = &msgRecord{msg: m, ext: bm.Ext}
+		stored[i] = m
+	}
+	if err := ms.storeMsgs(recs, now); err != nil {
+		return nil, err
+	}
+	return stored, nil
+}
+
+// StoreMsg stores the given message, keeping its sequence and timestamp.
+func (ms *kvMsgStore) StoreMsg(m *pb.MsgProto, ext *spb.MsgExt) error {
+	ms.Lock()
+	defer ms.Unlock()
+
+	if m.Sequence <= ms.last {
+		return ErrSeqOutOfOrder
+	}
+	return ms.storeMsg(m, ext, time.Now().UnixNano())
+}
+
+// storeMsg writes the message in the database, then enforces the limits.
+// Lock is held on entry.
+func (ms *kvMsgStore) storeMsg(m *pb.MsgProto, ext *spb.MsgExt, now int64) error {
+	return ms.storeMsgs([]*msgRecord{{msg: m, ext: ext}}, now)
+}
+
+// storeMsgs writes the messages in the database in a single batch, then
+// adds them.
+// Lock is held on entry.
+func (ms *kvMsgStore) storeMsgs(recs []*msgRecord, now int64) error {
+	puts := new(kvBatch)
+	if err := ms.putMsgs(puts, recs); err != nil {
+		return err
+	}
+	if err := ms.db.write(puts); err != nil {
+		return err
+	}
+	return ms.addMsgs(recs, now)
+}
+
+// putMsgs adds the writes of the messages to the batch.
+func (ms *kvMsgStore) putMsgs(puts *kvBatch, recs []*msgRecord) error {
+	for _, rec := range recs {
+		buf, err := kvMarshal(rec)
+		if err != nil {
+			return err
+		}
+		puts.put(kvChannelKey(kvMsgPrefix, ms.subject, rec.msg.Sequence), buf)
+	}
+	return nil
+}
+
+// addMsgs adds the messages written in the database, then enforces the
+// limits, deleting the messages that are removed in another batch.
+// Lock is held on entry.
+func (ms *kvMsgStore) addMsgs(recs []*msgRecord, now int64) error {
+	removed := new(kvBatch)
+
+	for _, rec := range recs {
+		m := rec.msg
+		if ms.first == 0 {
+			ms.setFirst(m.Sequence)
+		}
+		ms.setLast(m.Sequence)
+		ms.addMsg(m, rec.ext)
+		ms.totalCount++
+		ms.totalBytes += uint64(len(m.Data))
+
+		// On compacted channels, remove the previous message with the same key.
+		if prev := ms.supersede(ms.last, rec.ext); prev != nil {
+			removed.delete(kvChannelKey(kvMsgPrefix, ms.subject, prev.Sequence))
+			if prev.Sequence == ms.first {
+				ms.setFirst(ms.nextSeq(ms.first))
+			}
+		}
+	}
+
+	ms.enforceLimits(removed, now)
+	if len(removed.ops) == 0 {
+		return nil
+	}
+	return ms.db.write(removed)
+}
+
+// enforceLimits removes the first messages while the limits are exceeded
+// (but leaves at least the last added), including expired messages, and
+// while the memory budget is exceeded if trimming is enabled, adding their
+// deletion to the batch `removed`. The expiry timer is then set for the
+// new first message.
+// Lock is held on entry.
+func (ms *kvMsgStore) enforceLimits(removed *kvBatch, now int64) {
+	for ms.totalCount > ms.limits.MaxNumMsgs ||
+		((ms.totalCount > 1) && (ms.totalBytes > ms.limits.MaxMsgBytes || ms.isExpired(ms.first, now) || ms.budget.mustTrim())) {
+		expired := ms.isExpired(ms.first, now)
+		firstMsg := ms.msgs[ms.first]
+		ms.totalBytes -= uint64(len(firstMsg.Data))
+		ms.totalCount--
+		if !expired && !ms.hitLimit {
+			ms.hitLimit = true
+			Noticef(droppingMsgsFmt, ms.subject, ms.totalCount, ms.limits.MaxNumMsgs, ms.totalBytes, ms.limits.MaxMsgBytes)
+		}
+		removed.delete(kvChannelKey(kvMsgPrefix, ms.subject, ms.first))
+		ms.removeMsg(ms.first)
+		ms.setFirst(ms.nextSeq(ms.first))
+	}
+	ms.setExpiryTimer(ms.expire)
+}
+
+// expire is called by the expiry timer to remove the expired messages
+// at the head of the log.
+func (ms *kvMsgStore) expire() {
+	ms.Lock()
+	defer ms.Unlock()
+	if ms.closed {
+		return
+	}
+	ms.expireAt = 0
+	removed := new(kvBatch)
+	ms.enforceLimits(removed, time.Now().UnixNano())
+	if len(removed.ops) == 0 {
+		return
+	}
+	if err := ms.db.write(removed); err != nil {
+		Noticef("Unable to remove expired messages of channel=%s: %v", ms.subject, err)
+	}
+}
+
+// PurgeBefore implements the PurgeMsgStore interface. The messages are
+// deleted from the database in a single batch.
+func (ms *kvMsgStore) PurgeBefore(seq uint64) (int, error) {
+	ms.Lock()
+	defer ms.Unlock()
+
+	removed := new(kvBatch)
+	for ms.totalCount > 1 && ms.first < seq {
+		ms.totalBytes -= uint64(len(ms.msgs[ms.first].Data))
+		ms.totalCount--
+		removed.delete(kvChannelKey(kvMsgPrefix, ms.subject, ms.first))
+		ms.removeMsg(ms.first)
+		ms.setFirst(ms.nextSeq(ms.first))
+	}
+	if len(removed.ops) == 0 {
+		return 0, nil
+	}
+	return len(removed.ops), ms.db.write(removed)
+}
+
+////////////////////////////////////////////////////////////////////////////
+// kvTx methods
+////////////////////////////////////////////////////////////////////////////
+
+// kvTx is a transaction of a key/value store. The messages of all channels
+// are written in a single batch.
+type kvTx struct {
+	s    *kvStore
+	msgs []kvTxMsg
+}
+
+// kvTxMsg is a message of a kvTx, with the store of its channel.
+type kvTxMsg struct {
+	ms  *kvMsgStore
+	msg *BatchMsg
+}
+
+// kvMsgStoresByName sorts message stores by channel name.
+type kvMsgStoresByName []*kvMsgStore
+
+func (a kvMsgStoresByName) Len() int           { return len(a) }
+func (a kvMsgStoresByName) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a kvMsgStoresByName) Less(i, j int) bool { return a[i].subject < a[j].subject }
+
+// BeginTx starts a transaction.
+func (s *kvStore) BeginTx() (Tx, error) {
+	return &kvTx{s: s}, nil
+}
+
+// Store adds a message to store on the given channel.
+func (tx *kvTx) Store(channel string, msg *BatchMsg) error {
+	cs := tx.s.LookupChannel(channel)
+	if cs == nil {
+		return fmt.Errorf("channel %q does not exist", channel)
+	}
+	tx.msgs = append(tx.msgs, kvTxMsg{ms: cs.Msgs.(*kvMsgStore), msg: msg})
+	return nil
+}
+
+// Commit stores the messages of the transaction atomically.
+func (tx *kvTx) Commit() ([]*pb.MsgProto, error) {
+	// Lock the stores of the channels in name order, so that concurrent
+	// transactions can't deadlock.
+	recs := make(map[*kvMsgStore][]*msgRecord)
+	var mss []*kvMsgStore
+	for _, tm := range tx.msgs {
+		if _, ok := recs[tm.ms]; !ok {
+			recs[tm.ms] = nil
+			mss = append(mss, tm.ms)
+		}
+	}
+	sort.Sort(kvMsgStoresByName(mss))
+	for _, ms := range mss {
+		ms.Lock()
+		defer ms.Unlock()
+	}
+
+	// All the messages get the same timestamp, the highest of the ones
+	// assigned in their channels.
+	seqs := make(map[*kvMsgStore]uint64, len(mss))
+	var now int64
+	for _, ms := range mss {
+		seq, timestamp, err := ms.stamp()
+		if err != nil {
+			return nil, err
+		}
+		seqs[ms] = seq
+		if timestamp > now {
+			now = timestamp
+		}
+	}
+	stored := make([]*pb.MsgProto, len(tx.msgs))
+	for i, tm := range tx.msgs {
+		ms := tm.ms
+		m := &pb.MsgProto{
+			Sequence:  seqs[ms] + uint64(len(recs[ms])),
+			Subject:   ms.subject,
+			Reply:     tm.msg.Reply,
+			Data:      tm.msg.Data,
+			Timestamp: now,
+		}
+		recs[ms] = append(recs[ms], &msgRecord{msg: m, ext: tm.msg.Ext})
+		stored[i] = m
+	}
+	puts := new(kvBatch)
+	for _, ms := range mss {
+		if err := ms.putMsgs(puts, recs[ms]); err != nil {
+			return nil, err
+		}
+	}
+	if err := tx.s.db.write(puts); err != nil {
+		return nil, err
+	}
+	tx.msgs = nil
+	// The messages are stored, the removal of those beyond the limits
+	// failing only leaves them in the database.
+	var err error
+	for _, ms := range mss {
+		if aerr := ms.addMsgs(recs[ms], now); aerr != nil && err == nil {
+			err = aerr
+		}
+	}
+	if err != nil {
+		Noticef("Unable to remove messages beyond the limits: %v", err)
+	}
+	return stored, nil
+}
+
+// Rollback discards the transaction.
+func (tx *kvTx) Rollback() {
+	tx.msgs = nil
+}
+
+////////////////////////////////////////////////////////////////////////////
+// kvSubStore methods
+////////////////////////////////////////////////////////////////////////////
+
+// newKVSubStore returns a new subscription store for the given channel.
+func (s *kvStore) newKVSubStore(channel string) *kvSubStore {
+	ss := &kvSubStore{db: s.db}
+	ss.init(channel, s.limits)
+	return ss
+}
+
+// recover reads the subscriptions of the channel. Their pending messages
+// are read later, one subscription at a time, by recoverPending.
+func (ss *kvSubStore) recover() ([]*spb.SubState, error) {
+	var subs []*spb.SubState
+
+	err := ss.db.iterate(kvChannelKey(kvSubPrefix, ss.subject), func(key, value []byte) error {
+		sub := &spb.SubState{}
+		if err := sub.Unmarshal(value); err != nil {
+			return ErrCorruptedData
+		}
+		subs = append(subs, sub)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, sub := range subs {
+		if sub.ID > ss.maxSubID {
+			ss.maxSubID = sub.ID
+		}
+		ss.subsCount++
+	}
+	return subs, nil
+}
+
+// recoverPending returns the recovered state of the given subscription,
+// with its pending messages looked up in the given message store.
+func (ss *kvSubStore) recoverPending(sub *spb.SubState, msgStore *kvMsgStore) (*RecoveredSubState, error) {
+	rss := &RecoveredSubState{Sub: sub, Pending: make(PendingAcks)}
+	err := ss.db.iterate(kvChannelKey(kvPendingPrefix, ss.subject, sub.ID), func(key, value []byte) error {
+		seq := kvLastID(key)
+		if m := msgStore.msgs[seq]; m != nil {
+			rss.Pending[seq] = m
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return rss, nil
+}
+
+// CreateSub records a new subscription represented by SubState. On success,
+// it records the subscription's ID in SubState.ID. This ID is to be used
+// by the other SubStore methods.
+func (ss *kvSubStore) CreateSub(sub *spb.SubState) error {
+	ss.Lock()
+	defer ss.Unlock()
+	if err := ss.createSub(sub); err != nil {
+		return err
+	}
+	if err := ss.putSub(sub); err != nil {
+		ss.subsCount--
+		return err
+	}
+	return nil
+}
+
+// UpdateSub updates a given subscription represented by SubState.
+func (ss *kvSubStore) UpdateSub(sub *spb.SubState) error {
+	return ss.putSub(sub)
+}
+
+// putSub writes the subscription in the database.
+func (ss *kvSubStore) putSub(sub *spb.SubState) error {
+	buf, err := kvMarshal(sub)
+	if err != nil {
+		return err
+	}
+	return ss.db.write(new(kvBatch).put(kvChannelKey(kvSubPrefix, ss.subject, sub.ID), buf))
+}
+
+// DeleteSub invalidates this subscription, deleting it and its pending
+// messages from the database.
+func (ss *kvSubStore) DeleteSub(subid uint64) {
+	ss.genericSubStore.DeleteSub(subid)
+
+	b := new(kvBatch).delete(kvChannelKey(kvSubPrefix, ss.subject, subid))
+	ss.db.iterate(kvChannelKey(kvPendingPrefix, ss.subject, subid), func(key, value []byte) error {
+		b.delete(append([]byte(nil), key...))
+		return nil
+	})
+	ss.db.write(b)
+}
+
+// AddSeqPending adds the given message seqno to the given subscription.
+func (ss *kvSubStore) AddSeqPending(subid, seqno uint64) error {
+	return ss.db.write(new(kvBatch).put(kvChannelKey(kvPendingPrefix, ss.subject, subid, seqno), nil))
+}
+
+// AckSeqPending records that the given message seqno has been acknowledged
+// by the given subscription.
+func (ss *kvSubStore) AckSeqPending(subid, seqno uint64) error {
+	return ss.db.write(new(kvBatch).delete(kvChannelKey(kvPendingPrefix, ss.subject, subid, seqno)))
+}
+
+// AckSeqPendingRange records that the messages from firstSeq to lastSeq
+// have been acknowledged by the given subscription, with a single write.
+func (ss *kvSubStore) AckSeqPendingRange(subid, firstSeq, lastSeq uint64) error {
+	b := new(kvBatch)
+	err := ss.db.iterate(kvChannelKey(kvPendingPrefix, ss.subject, subid), func(key, value []byte) error {
+		if seqno := kvLastID(key); seqno >= firstSeq && seqno <= lastSeq {
+			b.delete(append([]byte(nil), key...))
+		}
+		return nil
+	})
+	if err != nil || len(b.ops) == 0 {
+		return err
+	}
+	return ss.db.write(b)
+}
+
+// AckSeqPendingBatch records that the given messages have been acknowledged
+// by the given subscription, with a single write.
+func (ss *kvSubStore) AckSeqPendingBatch(subid uint64, seqnos ...uint64) error {
+	if len(seqnos) == 0 {
+		return nil
+	}
+	b := new(kvBatch)
+	for _, seqno := range seqnos {
+		b.delete(kvChannelKey(kvPendingPrefix, ss.subject, subid, seqno))
+	}
+	return ss.db.write(b)
+}
@@ -0,0 +1,106 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+//go:build leveldb
+// +build leveldb
+
+package stores
+
+import (
+	"fmt"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// TypeLevelDB is the store type name for LevelDB based stores. This store
+// type is only available when the server is built with the `leveldb` tag.
+const TypeLevelDB = "LEVELDB"
+
+func init() {
+	Register(TypeLevelDB, func(config *StoreConfig) (Store, *RecoveredState, error) {
+		if config.Dir == "" {
+			return nil, nil, fmt.Errorf("for %v stores, root directory must be specified", TypeLevelDB)
+		}
+		doSync := DefaultFileStoreOptions.DoSync
+		if config.FileStoreOpts != nil {
+			doSync = config.FileStoreOpts.DoSync
+		}
+		s, state, err := NewLevelDBStore(config.Dir, config.Limits, doSync)
+		if err != nil {
+			return nil, nil, err
+		}
+		return s, state, nil
+	})
+}
+
+// LevelDBStore is the storage interface for STAN servers, backed by a
+// LevelDB database. Messages that are removed, because of limits or key
+// compaction, are deleted from the database and their space is reclaimed
+// by LevelDB's background compaction, instead of rewriting files.
+type LevelDBStore struct {
+	kvStore
+}
+
+// levelDB adapts a LevelDB database to the kvDB interface.
+type levelDB struct {
+	db *leveldb.DB
+	wo *opt.WriteOptions
+}
+
+// NewLevelDBStore returns a factory for stores backed by a LevelDB database
+// located in `rootDir`, and the state recovered from it, if any. If `doSync`
+// is true, every write is synced to disk.
+// If not limits are provided, the store will be created with
+// DefaultChannelLimits.
+func NewLevelDBStore(rootDir string, limits *ChannelLimits, doSync bool) (*LevelDBStore, *RecoveredState, error) {
+	db, err := leveldb.OpenFile(rootDir, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	s := &LevelDBStore{}
+	s.db = &levelDB{db: db, wo: &opt.WriteOptions{Sync: doSync}}
+	s.init(TypeLevelDB, limits)
+
+	state, err := s.recover()
+	if err != nil {
+		s.Close()
+		return nil, nil, err
+	}
+	return s, state, nil
+}
+
+func (l *levelDB) get(key []byte) ([]byte, error) {
+	buf, err := l.db.Get(key, nil)
+	if err == leveldb.ErrNotFound {
+		return nil, nil
+	}
+	return buf, err
+}
+
+func (l *levelDB) write(b *kvBatch) error {
+	lb := new(leveldb.Batch)
+	for _, op := range b.ops {
+		if op.del {
+			lb.Delete(op.key)
+		} else {
+			lb.Put(op.key, op.value)
+		}
+	}
+	return l.db.Write(lb, l.wo)
+}
+
+func (l *levelDB) iterate(prefix []byte, f func(key, value []byte) error) error {
+	iter := l.db.NewIterator(util.BytesPrefix(prefix), nil)
+	defer iter.Release()
+	for iter.Next() {
+		if err := f(iter.Key(), iter.Value()); err != nil {
+			return err
+		}
+	}
+	return iter.Error()
+}
+
+func (l *levelDB) close() error {
+	return l.db.Close()
+}
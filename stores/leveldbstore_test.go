@@ -0,0 +1,458 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+//go:build leveldb
+// +build leveldb
+
+package stores
+
+import (
+	"testing"
+
+	"github.com/nats-io/nats-streaming-server/spb"
+)
+
+func createDefaultLevelDBStore(t *testing.T) *LevelDBStore {
+	s, state, err := NewLevelDBStore(defaultDataStore, &testDefaultChannelLimits, false)
+	if err != nil {
+		stackFatalf(t, "Unable to create a LevelDBStore instance: %v", err)
+	}
+	if state == nil {
+		info := testDefaultServerInfo
+		if err := s.Init(&info); err != nil {
+			stackFatalf(t, "Unexpected error during Init: %v", err)
+		}
+	}
+	return s
+}
+
+func openDefaultLevelDBStore(t *testing.T) (*LevelDBStore, *RecoveredState) {
+	s, state, err := NewLevelDBStore(defaultDataStore, &testDefaultChannelLimits, false)
+	if err != nil {
+		stackFatalf(t, "Unable to create a LevelDBStore instance: %v", err)
+	}
+	return s, state
+}
+
+func TestLDBBasicCreate(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	s := createDefaultLevelDBStore(t)
+	defer s.Close()
+
+	testBasicCreate(t, s, TypeLevelDB)
+}
+
+func TestLDBNothingRecoveredOnFreshStart(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	s := createDefaultLevelDBStore(t)
+	defer s.Close()
+
+	testNothingRecoveredOnFreshStart(t, s)
+}
+
+func TestLDBNewChannel(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	s := createDefaultLevelDBStore(t)
+	defer s.Close()
+
+	testNewChannel(t, s)
+}
+
+func TestLDBCloseIdempotent(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	s := createDefaultLevelDBStore(t)
+	defer s.Close()
+
+	testCloseIdempotent(t, s)
+}
+
+func TestLDBBasicMsgStore(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	s := createDefaultLevelDBStore(t)
+	defer s.Close()
+
+	testBasicMsgStore(t, s)
+}
+
+func TestLDBMsgExt(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	s := createDefaultLevelDBStore(t)
+	defer s.Close()
+
+	testMsgExt(t, s)
+}
+
+func TestLDBStoreMsg(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	s := createDefaultLevelDBStore(t)
+	defer s.Close()
+
+	testStoreMsg(t, s)
+}
+
+func TestLDBStoreBatch(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	s := createDefaultLevelDBStore(t)
+	defer s.Close()
+
+	testStoreBatch(t, s)
+}
+
+func TestLDBStoreTx(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	s := createDefaultLevelDBStore(t)
+	defer s.Close()
+
+	testStoreTx(t, s)
+
+	// The messages of the transaction are recovered.
+	s.Close()
+	s, _ = openDefaultLevelDBStore(t)
+	defer s.Close()
+	for channel, last := range map[string]uint64{"foo": 3, "bar": 2} {
+		if seq := s.LookupChannel(channel).Msgs.LastSequence(); seq != last {
+			t.Fatalf("Expected last sequence %v on %q, got %v", last, channel, seq)
+		}
+	}
+}
+
+func TestLDBMsgExpiration(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	s := createDefaultLevelDBStore(t)
+	defer s.Close()
+
+	testMsgExpiration(t, s)
+}
+
+func TestLDBPurgeBefore(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	s := createDefaultLevelDBStore(t)
+	defer s.Close()
+
+	testPurgeBefore(t, s)
+}
+
+func TestLDBKeyCompaction(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	s := createDefaultLevelDBStore(t)
+	defer s.Close()
+
+	testKeyCompaction(t, s)
+}
+
+func TestLDBMsgsState(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	s := createDefaultLevelDBStore(t)
+	defer s.Close()
+
+	testMsgsState(t, s)
+}
+
+func TestLDBGetChannels(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	s := createDefaultLevelDBStore(t)
+	defer s.Close()
+
+	testGetChannels(t, s)
+}
+
+func TestLDBMaxMsgs(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	s := createDefaultLevelDBStore(t)
+	defer s.Close()
+
+	testMaxMsgs(t, s)
+}
+
+func TestLDBMemoryBudget(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	s := createDefaultLevelDBStore(t)
+	defer s.Close()
+
+	testMemoryBudget(t, s)
+}
+
+func TestLDBMaxChannels(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	s := createDefaultLevelDBStore(t)
+	defer s.Close()
+
+	limitCount := 2
+
+	limits := testDefaultChannelLimits
+	limits.MaxChannels = limitCount
+
+	s.SetChannelLimits(limits)
+
+	testMaxChannels(t, s, limitCount)
+}
+
+func TestLDBMaxSubs(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	s := createDefaultLevelDBStore(t)
+	defer s.Close()
+
+	limitCount := 2
+
+	limits := testDefaultChannelLimits
+	limits.MaxSubs = limitCount
+
+	s.SetChannelLimits(limits)
+
+	testMaxSubs(t, s, limitCount)
+}
+
+func TestLDBTenantLimits(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	s := createDefaultLevelDBStore(t)
+	defer s.Close()
+
+	testTenantLimits(t, s)
+}
+
+func TestLDBBasicSubStore(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	s := createDefaultLevelDBStore(t)
+	defer s.Close()
+
+	testBasicSubStore(t, s)
+}
+
+func TestLDBGetSeqFromTimestamp(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	s := createDefaultLevelDBStore(t)
+	defer s.Close()
+
+	testGetSeqFromStartTime(t, s)
+}
+
+func TestLDBGetSeqFromTimestampIndex(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	s := createDefaultLevelDBStore(t)
+	defer s.Close()
+
+	testGetSeqFromTimestampIndex(t, s)
+}
+
+func TestLDBBatchAcks(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	s := createDefaultLevelDBStore(t)
+	defer s.Close()
+
+	subID := testBatchAcks(t, s)
+	s.Close()
+
+	s, state := openDefaultLevelDBStore(t)
+	defer s.Close()
+	checkBatchAcksRecovered(t, state, subID)
+}
+
+func TestLDBUpdateClient(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	s := createDefaultLevelDBStore(t)
+	defer s.Close()
+
+	testUpdateClient(t, s)
+	s.Close()
+
+	s, state := openDefaultLevelDBStore(t)
+	defer s.Close()
+	checkUpdateClientRecovered(t, state)
+}
+
+func TestLDBRecoverSubs(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	s := createDefaultLevelDBStore(t)
+	defer s.Close()
+
+	testRecoverSubs(t, s)
+	s.Close()
+
+	s, state := openDefaultLevelDBStore(t)
+	defer s.Close()
+	checkRecoverSubs(t, state)
+}
+
+func TestLDBClientAPIs(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	s := createDefaultLevelDBStore(t)
+	defer s.Close()
+
+	testClientAPIs(t, s)
+}
+
+func TestLDBFlush(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	s := createDefaultLevelDBStore(t)
+	defer s.Close()
+
+	testFlush(t, s)
+}
+
+func TestLDBRecovery(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	limits := testDefaultChannelLimits
+	limits.MaxNumMsgs = 3
+	s, state, err := NewLevelDBStore(defaultDataStore, &limits, false)
+	if err != nil {
+		t.Fatalf("Unable to create a LevelDBStore instance: %v", err)
+	}
+	defer s.Close()
+	if state != nil {
+		t.Fatal("Nothing should have been recovered")
+	}
+	info := testDefaultServerInfo
+	if err := s.Init(&info); err != nil {
+		t.Fatalf("Unexpected error during Init: %v", err)
+	}
+	if _, _, err := s.AddClient("me", "hbInbox", nil); err != nil {
+		t.Fatalf("Unexpected error adding client: %v", err)
+	}
+	if _, _, err := s.AddClient("other", "hbInbox", nil); err != nil {
+		t.Fatalf("Unexpected error adding client: %v", err)
+	}
+	s.DeleteClient("other")
+	for i := 0; i < 5; i++ {
+		storeMsg(t, s, "foo", []byte("hello"))
+	}
+	storeMsg(t, s, "foo.bar", []byte("hello"))
+	sub1 := storeSub(t, s, "foo")
+	sub2 := storeSub(t, s, "foo")
+	storeSubPending(t, s, "foo", sub1, 3, 4, 5)
+	storeSubAck(t, s, "foo", sub1, 4)
+	storeSubPending(t, s, "foo", sub2, 5)
+	storeSubDelete(t, s, "foo", sub2)
+	s.Close()
+
+	s, state, err = NewLevelDBStore(defaultDataStore, &limits, false)
+	if err != nil {
+		t.Fatalf("Unable to create a LevelDBStore instance: %v", err)
+	}
+	defer s.Close()
+	if state == nil || state.Info.ClusterID != testDefaultServerInfo.ClusterID {
+		t.Fatalf("Unexpected recovered state: %v", state)
+	}
+	if len(state.Clients) != 1 || state.Clients[0].ID != "me" || s.GetClient("me") == nil {
+		t.Fatalf("Unexpected recovered clients: %v", state.Clients)
+	}
+	infos, err := s.GetChannels()
+	if err != nil || len(infos) != 2 {
+		t.Fatalf("Unexpected recovered channels: %v (err=%v)", infos, err)
+	}
+	if foo := infos[0]; foo.Name != "foo" || foo.FirstSeq != 3 || foo.LastSeq != 5 || foo.Msgs != 3 || foo.Created.IsZero() {
+		t.Fatalf("Unexpected recovered channel: %+v", foo)
+	}
+	subs := getRecoveredSubs(t, state)["foo"]
+	if len(subs) != 1 || subs[0].Sub.ID != sub1 || len(subs[0].Pending) != 2 ||
+		subs[0].Pending[3] == nil || subs[0].Pending[5] == nil {
+		t.Fatalf("Unexpected recovered subscriptions: %v", subs)
+	}
+	// The ID of a new subscription does not collide with recovered ones.
+	if subID := storeSub(t, s, "foo"); subID <= sub1 {
+		t.Fatalf("Expected subscription ID greater than %v, got %v", sub1, subID)
+	}
+	// The store keeps enforcing the limits after recovery.
+	m := storeMsg(t, s, "foo", []byte("hello"))
+	if first, last := s.LookupChannel("foo").Msgs.FirstAndLastSequence(); first != 4 || last != m.Sequence {
+		t.Fatalf("Unexpected first and last sequences: %v, %v", first, last)
+	}
+	s.Close()
+
+	s, _ = openDefaultLevelDBStore(t)
+	defer s.Close()
+	if first, last := s.LookupChannel("foo").Msgs.FirstAndLastSequence(); first != 4 || last != 6 {
+		t.Fatalf("Unexpected first and last sequences: %v, %v", first, last)
+	}
+}
+
+func TestLDBKeyCompactionRecovery(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	limits := testDefaultChannelLimits
+	limits.CompactedChannels = []string{"prices"}
+	s, _, err := NewLevelDBStore(defaultDataStore, &limits, false)
+	if err != nil {
+		t.Fatalf("Unable to create a LevelDBStore instance: %v", err)
+	}
+	defer s.Close()
+	info := testDefaultServerInfo
+	if err := s.Init(&info); err != nil {
+		t.Fatalf("Unexpected error during Init: %v", err)
+	}
+	storeMsgWithExt(t, s, "prices", []byte("1"), &spb.MsgExt{Key: "a"})
+	storeMsgWithExt(t, s, "prices", []byte("2"), &spb.MsgExt{Key: "b"})
+	storeMsgWithExt(t, s, "prices", []byte("3"), &spb.MsgExt{Key: "a"})
+	s.Close()
+
+	s, _, err = NewLevelDBStore(defaultDataStore, &limits, false)
+	if err != nil {
+		t.Fatalf("Unable to create a LevelDBStore instance: %v", err)
+	}
+	defer s.Close()
+	ms := s.LookupChannel("prices").Msgs
+	if n, _, _ := ms.State(); n != 2 {
+		t.Fatalf("Expected 2 messages, got %v", n)
+	}
+	if m := msgStoreLookup(t, ms, 1); m != nil {
+		t.Fatalf("Superseded message should have been removed: %v", m)
+	}
+	if ext := ms.LookupExt(3); ext == nil || ext.Key != "a" {
+		t.Fatalf("Unexpected attributes: %v", ext)
+	}
+}
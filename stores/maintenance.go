@@ -0,0 +1,209 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package stores
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Interval at which the file store checks whether it is in a maintenance
+// window, to perform the maintenance deferred outside of it.
+var maintenanceCheckInterval = time.Minute
+
+// MaintenanceWindow is a weekly period during which the file store
+// performs its heavy maintenance: compaction of the clients and
+// subscriptions files and of the message files of compacted channels, and
+// offloading to the tier. Outside of the windows, this maintenance is
+// deferred, while the limits are still enforced.
+type MaintenanceWindow struct {
+	// Days on which the window starts, indexed by time.Weekday.
+	Days [7]bool
+	// Start and End of the window, as durations since midnight, local
+	// time. If End is not after Start, the window ends the next day.
+	Start time.Duration
+	End   time.Duration
+}
+
+var weekdays = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// ParseMaintenanceWindows parses a list of maintenance windows separated
+// by semicolons, such as "Mon-Fri 01:00-05:00; Sat,Sun 00:00-24:00". Each
+// window is a list of days, or `*` for every day, followed by the start
+// and end of the window on these days. A window whose end is not after its
+// start, such as "* 22:00-04:00", ends the next day.
+func ParseMaintenanceWindows(list string) ([]MaintenanceWindow, error) {
+	var windows []MaintenanceWindow
+	for _, spec := range strings.Split(list, ";") {
+		if spec = strings.TrimSpace(spec); spec == "" {
+			continue
+		}
+		w, err := parseMaintenanceWindow(spec)
+		if err != nil {
+			return nil, err
+		}
+		windows = append(windows, w)
+	}
+	return windows, nil
+}
+
+func parseMaintenanceWindow(spec string) (MaintenanceWindow, error) {
+	var w MaintenanceWindow
+	fields := strings.Fields(spec)
+	if len(fields) != 2 {
+		return w, fmt.Errorf("invalid maintenance window %q, expected <days> <start>-<end>", spec)
+	}
+	if fields[0] == "*" {
+		for i := range w.Days {
+			w.Days[i] = true
+		}
+	} else {
+		for _, days := range strings.Split(fields[0], ",") {
+			bounds := strings.SplitN(days, "-", 2)
+			first, err := parseWeekday(bounds[0])
+			if err != nil {
+				return w, fmt.Errorf("invalid maintenance window %q: %v", spec, err)
+			}
+			last := first
+			if len(bounds) == 2 {
+				if last, err = parseWeekday(bounds[1]); err != nil {
+					return w, fmt.Errorf("invalid maintenance window %q: %v", spec, err)
+				}
+			}
+			// Ranges may wrap, such as Fri-Mon.
+			for d := first; ; d = (d + 1) % 7 {
+				w.Days[d] = true
+				if d == last {
+					break
+				}
+			}
+		}
+	}
+	times := strings.SplitN(fields[1], "-", 2)
+	if len(times) != 2 {
+		return w, fmt.Errorf("invalid maintenance window %q, expected <start>-<end>", spec)
+	}
+	var err error
+	if w.Start, err = parseTimeOfDay(times[0]); err == nil {
+		w.End, err = parseTimeOfDay(times[1])
+	}
+	if err != nil {
+		return w, fmt.Errorf("invalid maintenance window %q: %v", spec, err)
+	}
+	if w.Start == 24*time.Hour {
+		return w, fmt.Errorf("invalid maintenance window %q: start can't be 24:00", spec)
+	}
+	return w, nil
+}
+
+// parseWeekday parses the abbreviated or full name of a day, in any case.
+func parseWeekday(name string) (int, error) {
+	lower := strings.ToLower(name)
+	for i, day := range weekdays {
+		if lower == day || lower == strings.ToLower(time.Weekday(i).String()) {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid day %q", name)
+}
+
+// parseTimeOfDay parses a time of day in the HH:MM format, 24:00 included,
+// as a duration since midnight.
+func parseTimeOfDay(value string) (time.Duration, error) {
+	var h, m int
+	if n, err := fmt.Sscanf(value, "%d:%d", &h, &m); err != nil || n != 2 || len(value) != 5 {
+		return 0, fmt.Errorf("invalid time %q, expected HH:MM", value)
+	}
+	if h < 0 || m < 0 || m > 59 || h > 24 || (h == 24 && m != 0) {
+		return 0, fmt.Errorf("invalid time %q", value)
+	}
+	return time.Duration(h)*time.Hour + time.Duration(m)*time.Minute, nil
+}
+
+// contains returns true if the time is within the window.
+func (w *MaintenanceWindow) contains(t time.Time) bool {
+	y, mo, d := t.Date()
+	sinceMidnight := t.Sub(time.Date(y, mo, d, 0, 0, 0, 0, t.Location()))
+	day := int(t.Weekday())
+	if w.Start < w.End {
+		return w.Days[day] && sinceMidnight >= w.Start && sinceMidnight < w.End
+	}
+	// The window ends the next day.
+	return (w.Days[day] && sinceMidnight >= w.Start) || (w.Days[(day+6)%7] && sinceMidnight < w.End)
+}
+
+// inMaintenanceWindow returns true if the heavy maintenance is allowed at
+// time `t`, that is, if there is no maintenance window or if `t` is within
+// one of them.
+func inMaintenanceWindow(windows []MaintenanceWindow, t time.Time) bool {
+	if len(windows) == 0 {
+		return true
+	}
+	for i := range windows {
+		if windows[i].contains(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// maintenanceLoop performs, during the maintenance windows, the maintenance
+// deferred outside of them, until the store is closed.
+func (fs *FileStore) maintenanceLoop() {
+	defer fs.maintWg.Done()
+	ticker := time.NewTicker(maintenanceCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-fs.maintQuit:
+			return
+		case <-ticker.C:
+			if fs.opts.inMaintenanceWindow() {
+				fs.runMaintenance()
+			}
+		}
+	}
+}
+
+// runMaintenance compacts the clients and subscriptions files that need
+// it, and offloads the old message files to the tier. The message files of
+// compacted channels are compacted by their own loop.
+func (fs *FileStore) runMaintenance() {
+	fs.Lock()
+	if fs.closed {
+		fs.Unlock()
+		return
+	}
+	if fs.shouldCompactClientFile() {
+		if err := fs.compactClientFile(); err != nil {
+			Noticef("Unable to compact the clients file: %v", err)
+		}
+	}
+	channels := make(map[string]*ChannelStore, len(fs.channels))
+	for name, cs := range fs.channels {
+		channels[name] = cs
+	}
+	fs.Unlock()
+
+	for name, cs := range channels {
+		if ss, ok := cs.Subs.(*FileSubStore); ok {
+			ss.Lock()
+			if !ss.closed && ss.shouldCompact() {
+				if err := ss.compact(); err != nil {
+					Noticef("Unable to compact subscriptions file for channel=%s: %v", name, err)
+				}
+			}
+			ss.Unlock()
+		}
+		if ms, ok := cs.Msgs.(*FileMsgStore); ok {
+			ms.Lock()
+			if !ms.closed && ms.loaded {
+				if err := ms.offloadSlices(time.Now().UnixNano()); err != nil {
+					Noticef("Unable to offload messages of channel=%s: %v", name, err)
+				}
+			}
+			ms.Unlock()
+		}
+	}
+}
@@ -0,0 +1,111 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package stores
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestParseMaintenanceWindows(t *testing.T) {
+	windows, err := ParseMaintenanceWindows("Mon-Fri 01:00-05:00; sat,Sunday 22:00-02:30")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(windows) != 2 {
+		t.Fatalf("Expected 2 windows, got %v", windows)
+	}
+	// 2016-11-07 is a Monday.
+	at := func(day, hour, min int) time.Time {
+		return time.Date(2016, 11, 7+day, hour, min, 0, 0, time.Local)
+	}
+	for _, test := range []struct {
+		t      time.Time
+		within bool
+	}{
+		{at(0, 1, 0), true},
+		{at(0, 4, 59), true},
+		{at(0, 5, 0), false},
+		{at(1, 0, 59), false},
+		{at(4, 3, 0), true},
+		{at(5, 3, 0), false},
+		{at(5, 23, 0), true},
+		{at(6, 2, 0), true}, // Sunday, window of Saturday
+		{at(6, 2, 30), false},
+		{at(7, 0, 30), true}, // Monday, window of Sunday
+		{at(1, 23, 0), false},
+	} {
+		if within := inMaintenanceWindow(windows, test.t); within != test.within {
+			t.Fatalf("Expected %v to be within the windows: %v, got %v", test.t, test.within, within)
+		}
+	}
+	// No window allows the maintenance at any time.
+	if !inMaintenanceWindow(nil, time.Now()) {
+		t.Fatal("Maintenance should be allowed without windows")
+	}
+	for _, spec := range []string{"01:00-02:00", "Mon", "Mon 1:00-2:00", "Mon 01:00", "Foo 01:00-02:00", "Mon 24:00-02:00", "Mon 01:60-02:00", "* 01:00-25:00"} {
+		if _, err := ParseMaintenanceWindows(spec); err == nil {
+			t.Fatalf("Expected error for %q", spec)
+		}
+	}
+}
+
+func TestFSMaintenanceWindows(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	// A window that is never now.
+	var later MaintenanceWindow
+	later.Days[(time.Now().Weekday()+3)%7] = true
+	later.End = 24 * time.Hour
+	fs, state, err := NewFileStore(defaultDataStore, &testDefaultChannelLimits, MaintenanceWindows([]MaintenanceWindow{later}))
+	if err != nil {
+		t.Fatalf("Unable to create a FileStore instance: %v", err)
+	}
+	defer fs.Close()
+	if state == nil {
+		info := testDefaultServerInfo
+		if err := fs.Init(&info); err != nil {
+			t.Fatalf("Unexpected error durint Init: %v", err)
+		}
+	}
+	fs.Lock()
+	fs.opts.CompactEnabled = true
+	fs.opts.CompactFragmentation = 1
+	fs.opts.CompactMinFileSize = -1
+	fs.compactItvl = 0
+	fs.Unlock()
+
+	for i := 0; i < 10; i++ {
+		cid := fmt.Sprintf("cid_%d", i)
+		if _, _, err := fs.AddClient(cid, "hbInbox", nil); err != nil {
+			t.Fatalf("Unexpected error adding clients: %v", err)
+		}
+		if i%2 == 0 {
+			fs.DeleteClient(cid)
+		}
+	}
+	delRecs := func() int {
+		fs.RLock()
+		defer fs.RUnlock()
+		return fs.cliDeleteRecs
+	}
+	// Compaction is deferred outside of the window.
+	if n := delRecs(); n != 5 {
+		t.Fatalf("Expected 5 delete records, got %v", n)
+	}
+	fs.runMaintenance()
+	if n := delRecs(); n != 5 {
+		t.Fatalf("Expected 5 delete records, got %v", n)
+	}
+
+	// Within the window, the deferred compaction is performed.
+	fs.Lock()
+	fs.opts.MaintenanceWindows[0].Days = [7]bool{true, true, true, true, true, true, true}
+	fs.Unlock()
+	fs.runMaintenance()
+	if n := delRecs(); n != 0 {
+		t.Fatalf("Expected 0 delete records, got %v", n)
+	}
+}
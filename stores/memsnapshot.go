@@ -0,0 +1,435 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package stores
+
+import (
+	"bufio"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/nats-io/go-nats-streaming/pb"
+	"github.com/nats-io/nats-streaming-server/spb"
+)
+
+const (
+	// Name of the file holding the last snapshot of a memory store.
+	memSnapshotFileName = "snapshot.dat"
+
+	// Name of the file recording the changes of the clients and
+	// subscriptions since the last snapshot.
+	memSnapshotLogFileName = "snapshot.log"
+)
+
+// Record types of the snapshot and log files of the memory store. Records
+// of messages, subscriptions and pending messages apply to the channel of
+// the last snapRecChannel record.
+const (
+	snapRecServerInfo = recordType(iota) + 1
+	snapRecClient
+	snapRecDelClient
+	snapRecChannel
+	snapRecMsg
+	snapRecSub
+	snapRecDelSub
+	snapRecPending
+)
+
+// memSnapshots persists the state of a MemoryStore. The whole state is
+// written periodically in the snapshot file, while the changes of the
+// clients and subscriptions are appended to the log file as they happen,
+// and replayed on top of the snapshot on recovery. The messages stored,
+// and the messages sent or acknowledged, since the last snapshot are lost
+// if the server does not shut down cleanly.
+type memSnapshots struct {
+	sync.Mutex
+	dir    string
+	log    *os.File
+	buf    []byte
+	closed bool
+	quitCh chan struct{}
+	wg     sync.WaitGroup
+}
+
+// NewMemoryStoreWithSnapshots returns a factory for stores held in memory,
+// whose state is snapshotted in `rootDir` every `interval`, and when the
+// store is closed. It also returns the state recovered from the last
+// snapshot, if any.
+// If not limits are provided, the store will be created with
+// DefaultChannelLimits.
+func NewMemoryStoreWithSnapshots(rootDir string, interval time.Duration, limits *ChannelLimits) (*MemoryStore, *RecoveredState, error) {
+	if err := os.MkdirAll(rootDir, os.ModeDir+os.ModePerm); err != nil && !os.IsExist(err) {
+		return nil, nil, err
+	}
+	ms, _ := NewMemoryStore(limits)
+	ms.snap = &memSnapshots{dir: rootDir, quitCh: make(chan struct{})}
+
+	state, err := ms.recoverSnapshot()
+	if err == nil {
+		// Start from a fresh snapshot and an empty log.
+		err = ms.snapshot()
+	}
+	if err != nil {
+		// Don't overwrite the snapshot with a partially recovered state.
+		ms.snap.closed = true
+		ms.Close()
+		return nil, nil, err
+	}
+	if interval > 0 {
+		ms.snap.wg.Add(1)
+		go ms.snapshotLoop(interval)
+	}
+	return ms, state, nil
+}
+
+// snapshotLoop snapshots the store every `interval` until it is closed.
+func (ms *MemoryStore) snapshotLoop(interval time.Duration) {
+	defer ms.snap.wg.Done()
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ms.snap.quitCh:
+			return
+		case <-t.C:
+			if err := ms.snapshot(); err != nil {
+				Noticef("WARNING: Unable to snapshot memory store: %v", err)
+			}
+		}
+	}
+}
+
+// recoverSnapshot reads the snapshot file, then replays the log file.
+// It returns nil if there was no snapshot of an initialized store.
+func (ms *MemoryStore) recoverSnapshot() (*RecoveredState, error) {
+	for _, name := range []string{memSnapshotFileName, memSnapshotLogFileName} {
+		if err := ms.readSnapshotFile(filepath.Join(ms.snap.dir, name)); err != nil {
+			return nil, err
+		}
+	}
+	if ms.info == nil {
+		return nil, nil
+	}
+	state := &RecoveredState{Info: ms.info}
+	for _, c := range ms.clients {
+		state.Clients = append(state.Clients, c)
+	}
+	for _, cs := range ms.channels {
+		subStore := cs.Subs.(*MemorySubStore)
+		subStore.subsCount = len(subStore.subs)
+	}
+	state.RecoverSubs = func(f func(string, *RecoveredSubState) error) error {
+		for channel, cs := range ms.channels {
+			msgStore := cs.Msgs.(*MemoryMsgStore)
+			subStore := cs.Subs.(*MemorySubStore)
+			for id, sub := range subStore.subs {
+				rss := &RecoveredSubState{Sub: sub, Pending: make(PendingAcks)}
+				for seq := range subStore.pending[id] {
+					if m := msgStore.msgs[seq]; m != nil {
+						rss.Pending[seq] = m
+					}
+				}
+				if err := f(channel, rss); err != nil {
+					return err
+				}
+			}
+		}
+		// Now that the pending messages are handed out, the expired
+		// messages can be removed.
+		for _, cs := range ms.channels {
+			msgStore := cs.Msgs.(*MemoryMsgStore)
+			msgStore.Lock()
+			msgStore.setExpiryTimer(msgStore.expire)
+			msgStore.Unlock()
+		}
+		return nil
+	}
+	return state, nil
+}
+
+// readSnapshotFile applies the records of the given file, if it exists.
+func (ms *MemoryStore) readSnapshotFile(fileName string) error {
+	file, err := os.Open(fileName)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	br := bufio.NewReaderSize(file, defaultBufSize)
+	if err := checkFileVersion(br); err != nil {
+		return err
+	}
+
+	var (
+		recType  recordType
+		recSize  int
+		buf      []byte
+		msgStore *MemoryMsgStore
+		subStore *MemorySubStore
+	)
+	for {
+		buf, recSize, recType, err = readRecord(br, buf, true, crc32.IEEETable, true)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			// The last record of the log may be partially written.
+			if err == io.ErrUnexpectedEOF && filepath.Base(fileName) == memSnapshotLogFileName {
+				return nil
+			}
+			return err
+		}
+		rec := buf[:recSize]
+		if recType >= snapRecMsg && msgStore == nil {
+			return ErrCorruptedData
+		}
+		switch recType {
+		case snapRecServerInfo:
+			info := &spb.ServerInfo{}
+			if err := info.Unmarshal(rec); err != nil {
+				return ErrCorruptedData
+			}
+			ms.info = info
+		case snapRecClient:
+			c := &Client{}
+			if err := c.ClientInfo.Unmarshal(rec); err != nil {
+				return ErrCorruptedData
+			}
+			ms.clients[c.ID] = c
+		case snapRecDelClient:
+			c := spb.ClientDelete{}
+			if err := c.Unmarshal(rec); err != nil {
+				return ErrCorruptedData
+			}
+			delete(ms.clients, c.ID)
+		case snapRecChannel:
+			c := spb.SnapshotChannel{}
+			if err := c.Unmarshal(rec); err != nil {
+				return ErrCorruptedData
+			}
+			cs := ms.channels[c.Name]
+			if cs == nil {
+				cs = ms.newChannelStore(c.Name, nil)
+				ms.channels[c.Name] = cs
+			}
+			// The channel records written with the changes of the
+			// subscriptions don't have the creation time.
+			if c.Created != 0 {
+				cs.Created = time.Unix(0, c.Created)
+			}
+			msgStore = cs.Msgs.(*MemoryMsgStore)
+			subStore = cs.Subs.(*MemorySubStore)
+		case snapRecMsg:
+			m := &pb.MsgProto{}
+			if err := m.Unmarshal(rec); err != nil {
+				return ErrCorruptedData
+			}
+			ext := &spb.MsgExt{}
+			if err := ext.Unmarshal(rec); err != nil {
+				return ErrCorruptedData
+			}
+			msgStore.recoverMsg(m, ext)
+		case snapRecSub:
+			sub := &spb.SubState{}
+			if err := sub.Unmarshal(rec); err != nil {
+				return ErrCorruptedData
+			}
+			subStore.subs[sub.ID] = sub
+			if sub.ID > subStore.maxSubID {
+				subStore.maxSubID = sub.ID
+			}
+		case snapRecDelSub:
+			del := spb.SubStateDelete{}
+			if err := del.Unmarshal(rec); err != nil {
+				return ErrCorruptedData
+			}
+			delete(subStore.subs, del.ID)
+			delete(subStore.pending, del.ID)
+		case snapRecPending:
+			update := spb.SubStateUpdate{}
+			if err := update.Unmarshal(rec); err != nil {
+				return ErrCorruptedData
+			}
+			subStore.addPending(update.ID, update.Seqno)
+		default:
+			return fmt.Errorf("invalid snapshot record type: %v", recType)
+		}
+	}
+}
+
+// Snapshot implements the SnapshotStore interface: it snapshots the store
+// now, or returns ErrNoSnapshots if it was created without snapshots.
+func (ms *MemoryStore) Snapshot() error {
+	if ms.snap == nil {
+		return ErrNoSnapshots
+	}
+	return ms.snapshot()
+}
+
+// snapshot writes the state of the store in a temporary file, which then
+// replaces the snapshot file, and empties the log file.
+func (ms *MemoryStore) snapshot() error {
+	ms.snap.Lock()
+	defer ms.snap.Unlock()
+	if ms.snap.closed {
+		return nil
+	}
+
+	tmpFile, err := getTempFile(ms.snap.dir, "snapshot")
+	if err != nil {
+		return err
+	}
+	tmpFileName := tmpFile.Name()
+	defer os.Remove(tmpFileName)
+
+	bw := bufio.NewWriterSize(tmpFile, defaultBufSize)
+	err = ms.writeSnapshot(bw)
+	if err == nil {
+		err = bw.Flush()
+	}
+	if err == nil {
+		err = tmpFile.Sync()
+	}
+	if cerr := tmpFile.Close(); cerr != nil && err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmpFileName, filepath.Join(ms.snap.dir, memSnapshotFileName))
+	}
+	if err != nil {
+		return err
+	}
+
+	// The changes recorded in the log are now part of the snapshot.
+	if ms.snap.log != nil {
+		ms.snap.log.Close()
+	}
+	logFileName := filepath.Join(ms.snap.dir, memSnapshotLogFileName)
+	if err := os.Remove(logFileName); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	ms.snap.log, err = openFile(logFileName)
+	return err
+}
+
+// writeSnapshot writes the state of the store to `w`.
+// Snapshot lock is held on entry.
+func (ms *MemoryStore) writeSnapshot(w io.Writer) error {
+	ms.RLock()
+	info := ms.info
+	clients := make([]spb.ClientInfo, 0, len(ms.clients))
+	for _, c := range ms.clients {
+		clients = append(clients, c.ClientInfo)
+	}
+	channels := make(map[string]*ChannelStore, len(ms.channels))
+	for name, cs := range ms.channels {
+		channels[name] = cs
+	}
+	ms.RUnlock()
+
+	write := func(recType recordType, rec record) error {
+		var err error
+		ms.snap.buf, _, err = writeRecord(w, ms.snap.buf, recType, rec, crc32.IEEETable)
+		return err
+	}
+	if info != nil {
+		if err := write(snapRecServerInfo, info); err != nil {
+			return err
+		}
+	}
+	for i := range clients {
+		if err := write(snapRecClient, &clients[i]); err != nil {
+			return err
+		}
+	}
+	for name, cs := range channels {
+		if err := write(snapRecChannel, &spb.SnapshotChannel{Name: name, Created: cs.Created.UnixNano()}); err != nil {
+			return err
+		}
+		msgStore := cs.Msgs.(*MemoryMsgStore)
+		msgStore.RLock()
+		var msgs []*msgRecord
+		for seq := msgStore.first; seq != 0 && seq <= msgStore.last; seq++ {
+			if m := msgStore.msgs[seq]; m != nil {
+				msgs = append(msgs, &msgRecord{msg: m, ext: msgStore.exts[seq]})
+			}
+		}
+		msgStore.RUnlock()
+		for _, r := range msgs {
+			if err := write(snapRecMsg, r); err != nil {
+				return err
+			}
+		}
+
+		subStore := cs.Subs.(*MemorySubStore)
+		subStore.RLock()
+		var subs []*spb.SubState
+		var pending []spb.SubStateUpdate
+		for id, sub := range subStore.subs {
+			subs = append(subs, sub)
+			for seq := range subStore.pending[id] {
+				pending = append(pending, spb.SubStateUpdate{ID: id, Seqno: seq})
+			}
+		}
+		subStore.RUnlock()
+		for _, sub := range subs {
+			if err := write(snapRecSub, sub); err != nil {
+				return err
+			}
+		}
+		for i := range pending {
+			if err := write(snapRecPending, &pending[i]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// logRecord appends the record to the log file. For subscription records,
+// `channel` is not empty and a channel record is written first.
+func (s *memSnapshots) logRecord(channel string, recType recordType, rec record) error {
+	s.Lock()
+	defer s.Unlock()
+	if s.closed {
+		return nil
+	}
+	var err error
+	if channel != "" {
+		if s.buf, _, err = writeRecord(s.log, s.buf, snapRecChannel, &spb.SnapshotChannel{Name: channel}, crc32.IEEETable); err != nil {
+			return err
+		}
+	}
+	s.buf, _, err = writeRecord(s.log, s.buf, recType, rec, crc32.IEEETable)
+	return err
+}
+
+// closeSnapshots stops the periodic snapshots, takes a last snapshot and
+// closes the log file.
+func (ms *MemoryStore) closeSnapshots() error {
+	ms.snap.Lock()
+	closed := ms.snap.closed
+	ms.snap.Unlock()
+	if closed {
+		return nil
+	}
+	close(ms.snap.quitCh)
+	ms.snap.wg.Wait()
+
+	err := ms.snapshot()
+	ms.snap.Lock()
+	ms.snap.closed = true
+	if ms.snap.log != nil {
+		if lerr := ms.snap.log.Close(); lerr != nil && err == nil {
+			err = lerr
+		}
+	}
+	ms.snap.Unlock()
+	return err
+}
@@ -0,0 +1,278 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package stores
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func createDefaultMemSnapshotStore(t *testing.T, interval time.Duration) *MemoryStore {
+	ms, state, err := NewMemoryStoreWithSnapshots(defaultDataStore, interval, &testDefaultChannelLimits)
+	if err != nil {
+		stackFatalf(t, "Unable to create a MemoryStore instance: %v", err)
+	}
+	if state == nil {
+		info := testDefaultServerInfo
+		if err := ms.Init(&info); err != nil {
+			stackFatalf(t, "Unexpected error during Init: %v", err)
+		}
+	}
+	return ms
+}
+
+// copySnapshotFiles copies the snapshot files of the default data store to
+// `dir`, as they would be found after a crash.
+func copySnapshotFiles(t *testing.T, dir string) {
+	if err := os.MkdirAll(dir, os.ModeDir+os.ModePerm); err != nil {
+		stackFatalf(t, "Unable to create directory: %v", err)
+	}
+	for _, name := range []string{memSnapshotFileName, memSnapshotLogFileName} {
+		buf, err := ioutil.ReadFile(filepath.Join(defaultDataStore, name))
+		if err != nil {
+			stackFatalf(t, "Unable to read file: %v", err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, name), buf, 0666); err != nil {
+			stackFatalf(t, "Unable to write file: %v", err)
+		}
+	}
+}
+
+func TestMSSnapshotBasicSubStore(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	ms := createDefaultMemSnapshotStore(t, 0)
+	defer ms.Close()
+
+	testBasicSubStore(t, ms)
+}
+
+func TestMSSnapshotMaxSubs(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	ms := createDefaultMemSnapshotStore(t, 0)
+	defer ms.Close()
+
+	limitCount := 2
+
+	limits := testDefaultChannelLimits
+	limits.MaxSubs = limitCount
+
+	ms.SetChannelLimits(limits)
+
+	testMaxSubs(t, ms, limitCount)
+}
+
+func TestMSSnapshotClientAPIs(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	ms := createDefaultMemSnapshotStore(t, 0)
+	defer ms.Close()
+
+	testClientAPIs(t, ms)
+}
+
+func TestMSSnapshotBatchAcks(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	ms := createDefaultMemSnapshotStore(t, 0)
+	defer ms.Close()
+
+	subID := testBatchAcks(t, ms)
+	ms.Close()
+
+	ms, state, err := NewMemoryStoreWithSnapshots(defaultDataStore, 0, &testDefaultChannelLimits)
+	if err != nil {
+		t.Fatalf("Unable to create a MemoryStore instance: %v", err)
+	}
+	defer ms.Close()
+	checkBatchAcksRecovered(t, state, subID)
+}
+
+func TestMSSnapshotUpdateClient(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+	crashDir := defaultDataStore + ".crash"
+	defer os.RemoveAll(crashDir)
+
+	ms := createDefaultMemSnapshotStore(t, 0)
+	defer ms.Close()
+
+	// The update is recovered from the log.
+	testUpdateClient(t, ms)
+	copySnapshotFiles(t, crashDir)
+
+	crashed, state, err := NewMemoryStoreWithSnapshots(crashDir, 0, &testDefaultChannelLimits)
+	if err != nil {
+		t.Fatalf("Unable to create a MemoryStore instance: %v", err)
+	}
+	defer crashed.Close()
+	checkUpdateClientRecovered(t, state)
+}
+
+func TestMSSnapshotRecoverSubs(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	ms := createDefaultMemSnapshotStore(t, 0)
+	defer ms.Close()
+
+	testRecoverSubs(t, ms)
+	ms.Close()
+
+	ms, state, err := NewMemoryStoreWithSnapshots(defaultDataStore, 0, &testDefaultChannelLimits)
+	if err != nil {
+		t.Fatalf("Unable to create a MemoryStore instance: %v", err)
+	}
+	defer ms.Close()
+	checkRecoverSubs(t, state)
+}
+
+func TestMSSnapshotRecovery(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	ms := createDefaultMemSnapshotStore(t, 0)
+	defer ms.Close()
+	if _, _, err := ms.AddClient("me", "hbInbox", nil); err != nil {
+		t.Fatalf("Unexpected error adding client: %v", err)
+	}
+	if _, _, err := ms.AddClient("other", "hbInbox", nil); err != nil {
+		t.Fatalf("Unexpected error adding client: %v", err)
+	}
+	ms.DeleteClient("other")
+	for i := 0; i < 3; i++ {
+		storeMsg(t, ms, "foo", []byte("hello"))
+	}
+	storeMsg(t, ms, "bar", []byte("hello"))
+	sub1 := storeSub(t, ms, "foo")
+	sub2 := storeSub(t, ms, "foo")
+	storeSubPending(t, ms, "foo", sub1, 1, 2, 3)
+	storeSubAck(t, ms, "foo", sub1, 2)
+	storeSubDelete(t, ms, "foo", sub2)
+	created := ms.LookupChannel("foo").Created
+	ms.Close()
+
+	ms, state, err := NewMemoryStoreWithSnapshots(defaultDataStore, 0, &testDefaultChannelLimits)
+	if err != nil {
+		t.Fatalf("Unable to create a MemoryStore instance: %v", err)
+	}
+	defer ms.Close()
+	if state == nil || state.Info.ClusterID != testDefaultServerInfo.ClusterID {
+		t.Fatalf("Unexpected recovered state: %v", state)
+	}
+	if len(state.Clients) != 1 || state.Clients[0].ID != "me" || ms.GetClient("me") == nil {
+		t.Fatalf("Unexpected recovered clients: %v", state.Clients)
+	}
+	cs := ms.LookupChannel("foo")
+	if cs == nil || ms.LookupChannel("bar") == nil {
+		t.Fatal("Channels should have been recovered")
+	}
+	if !cs.Created.Equal(created) {
+		t.Fatalf("Expected creation time %v, got %v", created, cs.Created)
+	}
+	if n, _, _ := cs.Msgs.State(); n != 3 {
+		t.Fatalf("Expected 3 messages, got %v", n)
+	}
+	subs := getRecoveredSubs(t, state)["foo"]
+	if len(subs) != 1 || subs[0].Sub.ID != sub1 || len(subs[0].Pending) != 2 ||
+		subs[0].Pending[1] == nil || subs[0].Pending[3] == nil {
+		t.Fatalf("Unexpected recovered subscriptions: %v", subs)
+	}
+	if subID := storeSub(t, ms, "foo"); subID <= sub1 {
+		t.Fatalf("Expected subscription ID greater than %v, got %v", sub1, subID)
+	}
+}
+
+func TestMSSnapshotLogRecovery(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+	crashDir := defaultDataStore + ".crash"
+	defer os.RemoveAll(crashDir)
+
+	ms := createDefaultMemSnapshotStore(t, 0)
+	defer ms.Close()
+	storeMsg(t, ms, "foo", []byte("hello"))
+	sub1 := storeSub(t, ms, "foo")
+	if err := ms.snapshot(); err != nil {
+		t.Fatalf("Unexpected error on snapshot: %v", err)
+	}
+	// Changes after the snapshot.
+	if _, _, err := ms.AddClient("me", "hbInbox", nil); err != nil {
+		t.Fatalf("Unexpected error adding client: %v", err)
+	}
+	storeMsg(t, ms, "foo", []byte("hello"))
+	storeSubDelete(t, ms, "foo", sub1)
+	sub2 := storeSub(t, ms, "bar")
+	copySnapshotFiles(t, crashDir)
+
+	// Simulate a partially written record at the end of the log.
+	f, err := os.OpenFile(filepath.Join(crashDir, memSnapshotLogFileName), os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		t.Fatalf("Unable to open log file: %v", err)
+	}
+	f.Write([]byte{1, 2, 3})
+	f.Close()
+
+	crashed, state, err := NewMemoryStoreWithSnapshots(crashDir, 0, &testDefaultChannelLimits)
+	if err != nil {
+		t.Fatalf("Unable to create a MemoryStore instance: %v", err)
+	}
+	defer crashed.Close()
+	if state == nil || len(state.Clients) != 1 || state.Clients[0].ID != "me" {
+		t.Fatalf("Unexpected recovered state: %v", state)
+	}
+	// The message stored after the snapshot is lost.
+	if n, _, _ := crashed.LookupChannel("foo").Msgs.State(); n != 1 {
+		t.Fatalf("Expected 1 message, got %v", n)
+	}
+	recoveredSubs := getRecoveredSubs(t, state)
+	if len(recoveredSubs["foo"]) != 0 {
+		t.Fatalf("Subscription should have been deleted: %v", recoveredSubs["foo"])
+	}
+	if subs := recoveredSubs["bar"]; len(subs) != 1 || subs[0].Sub.ID != sub2 {
+		t.Fatalf("Unexpected recovered subscriptions: %v", subs)
+	}
+}
+
+func TestMSSnapshotInterval(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+	crashDir := defaultDataStore + ".crash"
+	defer os.RemoveAll(crashDir)
+
+	ms := createDefaultMemSnapshotStore(t, 50*time.Millisecond)
+	defer ms.Close()
+	storeMsg(t, ms, "foo", []byte("hello"))
+	storeMsg(t, ms, "foo", []byte("hello"))
+
+	time.Sleep(200 * time.Millisecond)
+	copySnapshotFiles(t, crashDir)
+
+	crashed, _, err := NewMemoryStoreWithSnapshots(crashDir, 0, &testDefaultChannelLimits)
+	if err != nil {
+		t.Fatalf("Unable to create a MemoryStore instance: %v", err)
+	}
+	defer crashed.Close()
+	cs := crashed.LookupChannel("foo")
+	if cs == nil {
+		t.Fatal("Channel should have been recovered")
+	}
+	if n, _, _ := cs.Msgs.State(); n != 2 {
+		t.Fatalf("Expected 2 messages, got %v", n)
+	}
+}
+
+func TestMSSnapshotRequiresDir(t *testing.T) {
+	config := &StoreConfig{Limits: &testDefaultChannelLimits, MemorySnapshotInterval: time.Second}
+	if _, _, err := NewStore(TypeMemory, config); err == nil {
+		t.Fatal("Expected error for memory store snapshots without directory")
+	}
+}
@@ -6,16 +6,24 @@ import (
 	"time"
 
 	"github.com/nats-io/go-nats-streaming/pb"
+	"github.com/nats-io/nats-streaming-server/spb"
 )
 
 // MemoryStore is a factory for message and subscription stores.
 type MemoryStore struct {
 	genericStore
+	info *spb.ServerInfo // only with snapshots
+	snap *memSnapshots   // nil, unless created with snapshots
 }
 
 // MemorySubStore is a subscription store in memory
 type MemorySubStore struct {
 	genericSubStore
+	// The subscriptions and their pending messages are only tracked when
+	// the store is snapshotted.
+	snap    *memSnapshots
+	subs    map[uint64]*spb.SubState
+	pending map[uint64]map[uint64]struct{}
 }
 
 // MemoryMsgStore is a per channel message store in memory
@@ -39,6 +47,22 @@ func NewMemoryStore(limits *ChannelLimits) (*MemoryStore, error) {
 // CreateChannel creates a ChannelStore for the given channel, and returns
 // `true` to indicate that the channel is new, false if it already exists.
 func (ms *MemoryStore) CreateChannel(channel string, userData interface{}) (*ChannelStore, bool, error) {
+	channelStore, isNew, err := ms.createChannel(channel, userData)
+	if err != nil || !isNew || ms.snap == nil {
+		return channelStore, isNew, err
+	}
+	// Log after releasing the store lock, which is acquired by the
+	// snapshots while holding the snapshot lock.
+	rec := &spb.SnapshotChannel{Name: channel, Created: channelStore.Created.UnixNano()}
+	if err := ms.snap.logRecord("", snapRecChannel, rec); err != nil {
+		return nil, false, err
+	}
+	return channelStore, true, nil
+}
+
+// createChannel is the implementation of CreateChannel, without the
+// snapshot log.
+func (ms *MemoryStore) createChannel(channel string, userData interface{}) (*ChannelStore, bool, error) {
 	ms.Lock()
 	defer ms.Unlock()
 	channelStore := ms.channels[channel]
@@ -46,25 +70,129 @@ func (ms *MemoryStore) CreateChannel(channel string, userData interface{}) (*Cha
 		return channelStore, false, nil
 	}
 
-	if err := ms.canAddChannel(); err != nil {
+	if err := ms.canAddChannel(channel); err != nil {
 		return nil, false, err
 	}
 
+	channelStore = ms.newChannelStore(channel, userData)
+	ms.channels[channel] = channelStore
+
+	return channelStore, true, nil
+}
+
+// newChannelStore returns a new ChannelStore for the given channel.
+func (ms *MemoryStore) newChannelStore(channel string, userData interface{}) *ChannelStore {
 	msgStore := &MemoryMsgStore{}
-	msgStore.init(channel, ms.limits)
+	msgStore.init(channel, ms.limits, ms.budget, ms.stamper)
 
-	subStore := &MemorySubStore{}
+	subStore := &MemorySubStore{snap: ms.snap}
 	subStore.init(channel, ms.limits)
+	if ms.snap != nil {
+		subStore.subs = make(map[uint64]*spb.SubState)
+		subStore.pending = make(map[uint64]map[uint64]struct{})
+	}
 
-	channelStore = &ChannelStore{
+	return &ChannelStore{
 		Subs:     subStore,
 		Msgs:     msgStore,
 		UserData: userData,
+		Created:  time.Now(),
 	}
+}
 
-	ms.channels[channel] = channelStore
+// Init records the server's information, when the store is snapshotted.
+func (ms *MemoryStore) Init(info *spb.ServerInfo) error {
+	if ms.snap == nil {
+		return nil
+	}
+	ms.Lock()
+	ms.info = info
+	ms.Unlock()
+	return ms.snap.logRecord("", snapRecServerInfo, info)
+}
 
-	return channelStore, true, nil
+// AddClient stores information about the client identified by `clientID`.
+func (ms *MemoryStore) AddClient(clientID, hbInbox string, userData interface{}) (*Client, bool, error) {
+	sc, isNew, err := ms.genericStore.AddClient(clientID, hbInbox, userData)
+	if err != nil || !isNew || ms.snap == nil {
+		return sc, isNew, err
+	}
+	if err := ms.snap.logRecord("", snapRecClient, &sc.ClientInfo); err != nil {
+		ms.genericStore.DeleteClient(clientID)
+		return nil, false, err
+	}
+	return sc, true, nil
+}
+
+// DeleteClient invalidates the client identified by `clientID`.
+func (ms *MemoryStore) DeleteClient(clientID string) *Client {
+	sc := ms.genericStore.DeleteClient(clientID)
+	if sc != nil && ms.snap != nil {
+		ms.snap.logRecord("", snapRecDelClient, &spb.ClientDelete{ID: clientID})
+	}
+	return sc
+}
+
+// SetClientUnreachable records the time since which the client does not
+// answer heartbeats.
+func (ms *MemoryStore) SetClientUnreachable(clientID string, since int64) error {
+	if err := ms.genericStore.SetClientUnreachable(clientID, since); err != nil {
+		return err
+	}
+	return ms.logClient(clientID)
+}
+
+// SetClientLastContact records the time at which the client last answered
+// a heartbeat.
+func (ms *MemoryStore) SetClientLastContact(clientID string, lastContact int64) error {
+	if err := ms.genericStore.SetClientLastContact(clientID, lastContact); err != nil {
+		return err
+	}
+	return ms.logClient(clientID)
+}
+
+// UpdateClient replaces the heartbeat inbox and the metadata of the client.
+func (ms *MemoryStore) UpdateClient(clientID, hbInbox string, metadata []byte) (*Client, error) {
+	sc, err := ms.genericStore.UpdateClient(clientID, hbInbox, metadata)
+	if err != nil {
+		return nil, err
+	}
+	if err := ms.logClient(clientID); err != nil {
+		return nil, err
+	}
+	return sc, nil
+}
+
+// logClient logs the current state of the client, if the store is
+// snapshotted.
+func (ms *MemoryStore) logClient(clientID string) error {
+	if ms.snap == nil {
+		return nil
+	}
+	ms.RLock()
+	c := ms.clients[clientID]
+	var info spb.ClientInfo
+	if c != nil {
+		info = c.ClientInfo
+	}
+	ms.RUnlock()
+	if c == nil {
+		return nil
+	}
+	return ms.snap.logRecord("", snapRecClient, &info)
+}
+
+// Close closes all stores, after taking a last snapshot if the store is
+// snapshotted.
+func (ms *MemoryStore) Close() error {
+	var err error
+	if ms.snap != nil {
+		err = ms.closeSnapshots()
+	}
+	if lerr := ms.genericStore.Close(); lerr != nil && err == nil {
+		err = lerr
+	}
+	return err
 }
 
 ////////////////////////////////////////////////////////////////////////////
@@ -72,57 +200,258 @@ func (ms *MemoryStore) CreateChannel(channel string, userData interface{}) (*Cha
 ////////////////////////////////////////////////////////////////////////////
 
 // Store a given message.
-func (ms *MemoryMsgStore) Store(reply string, data []byte) (*pb.MsgProto, error) {
+func (ms *MemoryMsgStore) Store(reply string, data []byte, ext *spb.MsgExt) (*pb.MsgProto, error) {
 	ms.Lock()
 	defer ms.Unlock()
 
-	if ms.first == 0 {
-		ms.first = 1
+	seq, now, err := ms.stamp()
+	if err != nil {
+		return nil, err
 	}
-	ms.last++
 	m := &pb.MsgProto{
-		Sequence:  ms.last,
+		Sequence:  seq,
 		Subject:   ms.subject,
 		Reply:     reply,
 		Data:      data,
-		Timestamp: time.Now().UnixNano(),
+		Timestamp: now,
+	}
+	ms.storeMsg(m, ext, m.Timestamp)
+	return m, nil
+}
+
+// StoreBatch stores the given messages atomically.
+func (ms *MemoryMsgStore) StoreBatch(msgs []*BatchMsg) ([]*pb.MsgProto, error) {
+	ms.Lock()
+	defer ms.Unlock()
+
+	seq, now, err := ms.stamp()
+	if err != nil {
+		return nil, err
+	}
+	stored := make([]*pb.MsgProto, len(msgs))
+	for i, bm := range msgs {
+		m := &pb.MsgProto{
+			Sequence:  seq + uint64(i),
+			Subject:   ms.subject,
+			Reply:     bm.Reply,
+			Data:      bm.Data,
+			Timestamp: now,
+		}
+		ms.storeMsg(m, bm.Ext, now)
+		stored[i] = m
 	}
-	ms.msgs[ms.last] = m
+	return stored, nil
+}
+
+// StoreMsg stores the given message, keeping its sequence and timestamp.
+func (ms *MemoryMsgStore) StoreMsg(m *pb.MsgProto, ext *spb.MsgExt) error {
+	ms.Lock()
+	defer ms.Unlock()
+
+	if m.Sequence <= ms.last {
+		return ErrSeqOutOfOrder
+	}
+	ms.storeMsg(m, ext, time.Now().UnixNano())
+	return nil
+}
+
+// PurgeBefore implements the PurgeMsgStore interface.
+func (ms *MemoryMsgStore) PurgeBefore(seq uint64) (int, error) {
+	ms.Lock()
+	defer ms.Unlock()
+
+	removed := 0
+	for ms.totalCount > 1 && ms.first < seq {
+		ms.totalBytes -= uint64(len(ms.msgs[ms.first].Data))
+		ms.totalCount--
+		ms.removeMsg(ms.first)
+		ms.setFirst(ms.nextSeq(ms.first))
+		removed++
+	}
+	return removed, nil
+}
+
+// recoverMsg adds a message read from a snapshot. As for the other stores,
+// the limits don't apply to recovered messages.
+func (ms *MemoryMsgStore) recoverMsg(m *pb.MsgProto, ext *spb.MsgExt) {
+	if ms.first == 0 {
+		ms.setFirst(m.Sequence)
+	}
+	ms.setLast(m.Sequence)
+	ms.addMsg(m, ext)
 	ms.totalCount++
-	ms.totalBytes += uint64(len(data))
+	ms.totalBytes += uint64(len(m.Data))
+	if prev := ms.supersede(m.Sequence, ext); prev != nil && prev.Sequence == ms.first {
+		ms.setFirst(ms.nextSeq(ms.first))
+	}
+}
+
+// storeMsg adds the message to the store and enforces the limits.
+// Lock is held on entry.
+func (ms *MemoryMsgStore) storeMsg(m *pb.MsgProto, ext *spb.MsgExt, now int64) {
+	if ms.first == 0 {
+		ms.setFirst(m.Sequence)
+	}
+	ms.setLast(m.Sequence)
+	ms.addMsg(m, ext)
+	ms.totalCount++
+	ms.totalBytes += uint64(len(m.Data))
+
+	// On compacted channels, remove the previous message with the same key.
+	if prev := ms.supersede(ms.last, ext); prev != nil && prev.Sequence == ms.first {
+		ms.setFirst(ms.nextSeq(ms.first))
+	}
+	ms.enforceLimits(now)
+}
 
-	// Check if we need to remove any (but leave at least the last added)
+// enforceLimits removes the first messages while the limits are exceeded
+// (but leaves at least the last added), including expired messages, and
+// while the memory budget is exceeded if trimming is enabled. The expiry
+// timer is then set for the new first message.
+// Lock is held on entry.
+func (ms *MemoryMsgStore) enforceLimits(now int64) {
 	for ms.totalCount > ms.limits.MaxNumMsgs ||
-		((ms.totalCount > 1) && (ms.totalBytes > ms.limits.MaxMsgBytes)) {
+		((ms.totalCount > 1) && (ms.totalBytes > ms.limits.MaxMsgBytes || ms.isExpired(ms.first, now) || ms.budget.mustTrim())) {
+		expired := ms.isExpired(ms.first, now)
 		firstMsg := ms.msgs[ms.first]
 		ms.totalBytes -= uint64(len(firstMsg.Data))
 		ms.totalCount--
-		if !ms.hitLimit {
+		if !expired && !ms.hitLimit {
 			ms.hitLimit = true
 			Noticef(droppingMsgsFmt, ms.subject, ms.totalCount, ms.limits.MaxNumMsgs, ms.totalBytes, ms.limits.MaxMsgBytes)
 		}
-		delete(ms.msgs, ms.first)
-		ms.first++
+		ms.removeMsg(ms.first)
+		ms.setFirst(ms.nextSeq(ms.first))
 	}
+	ms.setExpiryTimer(ms.expire)
+}
 
-	return m, nil
+// expire is called by the expiry timer to remove the expired messages
+// at the head of the log.
+func (ms *MemoryMsgStore) expire() {
+	ms.Lock()
+	if !ms.closed {
+		ms.expireAt = 0
+		ms.enforceLimits(time.Now().UnixNano())
+	}
+	ms.Unlock()
 }
 
 ////////////////////////////////////////////////////////////////////////////
 // MemorySubStore methods
 ////////////////////////////////////////////////////////////////////////////
 
+// CreateSub records a new subscription represented by SubState. On success,
+// it records the subscription's ID in SubState.ID. This ID is to be used
+// by the other SubStore methods.
+func (ss *MemorySubStore) CreateSub(sub *spb.SubState) error {
+	if ss.snap == nil {
+		return ss.genericSubStore.CreateSub(sub)
+	}
+	ss.Lock()
+	if err := ss.createSub(sub); err != nil {
+		ss.Unlock()
+		return err
+	}
+	ss.putSub(sub)
+	ss.Unlock()
+	return ss.snap.logRecord(ss.subject, snapRecSub, sub)
+}
+
+// UpdateSub updates a given subscription represented by SubState.
+func (ss *MemorySubStore) UpdateSub(sub *spb.SubState) error {
+	if ss.snap == nil {
+		return nil
+	}
+	ss.Lock()
+	ss.putSub(sub)
+	ss.Unlock()
+	return ss.snap.logRecord(ss.subject, snapRecSub, sub)
+}
+
+// putSub keeps a copy of the subscription, since the caller may modify it.
+// Lock is held on entry.
+func (ss *MemorySubStore) putSub(sub *spb.SubState) {
+	s := *sub
+	ss.subs[sub.ID] = &s
+}
+
+// DeleteSub invalidates this subscription.
+func (ss *MemorySubStore) DeleteSub(subid uint64) {
+	ss.genericSubStore.DeleteSub(subid)
+	if ss.snap == nil {
+		return
+	}
+	ss.Lock()
+	delete(ss.subs, subid)
+	delete(ss.pending, subid)
+	ss.Unlock()
+	ss.snap.logRecord(ss.subject, snapRecDelSub, &spb.SubStateDelete{ID: subid})
+}
+
 // AddSeqPending adds the given message seqno to the given subscription.
-func (*MemorySubStore) AddSeqPending(subid, seqno uint64) error {
-	// Overrides in case genericSubStore does something. For the memory
-	// based store, we want to minimize the cost of this to a minimum.
+func (ss *MemorySubStore) AddSeqPending(subid, seqno uint64) error {
+	// For the memory based store, we want to minimize the cost of this to
+	// a minimum. Pending messages are only tracked for the snapshots.
+	if ss.snap != nil {
+		ss.Lock()
+		ss.addPending(subid, seqno)
+		ss.Unlock()
+	}
 	return nil
 }
 
+// addPending adds the seqno to the pending messages of the subscription,
+// if it exists.
+// Lock is held on entry, or during recovery.
+func (ss *MemorySubStore) addPending(subid, seqno uint64) {
+	if ss.subs[subid] == nil {
+		return
+	}
+	pending := ss.pending[subid]
+	if pending == nil {
+		pending = make(map[uint64]struct{})
+		ss.pending[subid] = pending
+	}
+	pending[seqno] = struct{}{}
+}
+
 // AckSeqPending records that the given message seqno has been acknowledged
 // by the given subscription.
-func (*MemorySubStore) AckSeqPending(subid, seqno uint64) error {
-	// Overrides in case genericSubStore does something. For the memory
-	// based store, we want to minimize the cost of this to a minimum.
+func (ss *MemorySubStore) AckSeqPending(subid, seqno uint64) error {
+	// Same as AddSeqPending.
+	if ss.snap != nil {
+		ss.Lock()
+		delete(ss.pending[subid], seqno)
+		ss.Unlock()
+	}
+	return nil
+}
+
+// AckSeqPendingRange records that the messages from firstSeq to lastSeq
+// have been acknowledged by the given subscription.
+func (ss *MemorySubStore) AckSeqPendingRange(subid, firstSeq, lastSeq uint64) error {
+	if ss.snap != nil {
+		ss.Lock()
+		for seqno := range ss.pending[subid] {
+			if seqno >= firstSeq && seqno <= lastSeq {
+				delete(ss.pending[subid], seqno)
+			}
+		}
+		ss.Unlock()
+	}
+	return nil
+}
+
+// AckSeqPendingBatch records that the given messages have been acknowledged
+// by the given subscription.
+func (ss *MemorySubStore) AckSeqPendingBatch(subid uint64, seqnos ...uint64) error {
+	if ss.snap != nil {
+		ss.Lock()
+		for _, seqno := range seqnos {
+			delete(ss.pending[subid], seqno)
+		}
+		ss.Unlock()
+	}
 	return nil
 }
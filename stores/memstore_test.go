@@ -85,6 +85,64 @@ func TestMSBasicMsgStore(t *testing.T) {
 	testBasicMsgStore(t, ms)
 }
 
+func TestMSMsgExt(t *testing.T) {
+	ms := createDefaultMemStore(t)
+	defer ms.Close()
+
+	testMsgExt(t, ms)
+}
+
+func TestMSStoreMsg(t *testing.T) {
+	ms := createDefaultMemStore(t)
+	defer ms.Close()
+
+	testStoreMsg(t, ms)
+}
+
+func TestMSStoreBatch(t *testing.T) {
+	ms := createDefaultMemStore(t)
+	defer ms.Close()
+
+	testStoreBatch(t, ms)
+}
+
+func TestMSStoreTxNotSupported(t *testing.T) {
+	ms := createDefaultMemStore(t)
+	defer ms.Close()
+
+	if _, err := BeginTx(ms); err != ErrTxNotSupported {
+		t.Fatalf("Expected error %v, got %v", ErrTxNotSupported, err)
+	}
+}
+
+func TestMSMsgExpiration(t *testing.T) {
+	ms := createDefaultMemStore(t)
+	defer ms.Close()
+
+	testMsgExpiration(t, ms)
+}
+
+func TestMSPurgeBefore(t *testing.T) {
+	ms := createDefaultMemStore(t)
+	defer ms.Close()
+
+	testPurgeBefore(t, ms)
+}
+
+func TestMSMsgStamper(t *testing.T) {
+	ms := createDefaultMemStore(t)
+	defer ms.Close()
+
+	testMsgStamper(t, ms)
+}
+
+func TestMSKeyCompaction(t *testing.T) {
+	ms := createDefaultMemStore(t)
+	defer ms.Close()
+
+	testKeyCompaction(t, ms)
+}
+
 func TestMSMsgsState(t *testing.T) {
 	ms := createDefaultMemStore(t)
 	defer ms.Close()
@@ -92,6 +150,13 @@ func TestMSMsgsState(t *testing.T) {
 	testMsgsState(t, ms)
 }
 
+func TestMSGetChannels(t *testing.T) {
+	ms := createDefaultMemStore(t)
+	defer ms.Close()
+
+	testGetChannels(t, ms)
+}
+
 func TestMSMaxMsgs(t *testing.T) {
 	ms := createDefaultMemStore(t)
 	defer ms.Close()
@@ -99,6 +164,13 @@ func TestMSMaxMsgs(t *testing.T) {
 	testMaxMsgs(t, ms)
 }
 
+func TestMSMemoryBudget(t *testing.T) {
+	ms := createDefaultMemStore(t)
+	defer ms.Close()
+
+	testMemoryBudget(t, ms)
+}
+
 func TestMSMaxChannels(t *testing.T) {
 	ms := createDefaultMemStore(t)
 	defer ms.Close()
@@ -127,6 +199,13 @@ func TestMSMaxSubs(t *testing.T) {
 	testMaxSubs(t, ms, limitCount)
 }
 
+func TestMSTenantLimits(t *testing.T) {
+	ms := createDefaultMemStore(t)
+	defer ms.Close()
+
+	testTenantLimits(t, ms)
+}
+
 func TestMSBasicSubStore(t *testing.T) {
 	ms := createDefaultMemStore(t)
 	defer ms.Close()
@@ -141,6 +220,20 @@ func TestMSGetSeqFromTimestamp(t *testing.T) {
 	testGetSeqFromStartTime(t, ms)
 }
 
+func TestMSGetSeqFromTimestampIndex(t *testing.T) {
+	ms := createDefaultMemStore(t)
+	defer ms.Close()
+
+	testGetSeqFromTimestampIndex(t, ms)
+}
+
+func TestMSBatchAcks(t *testing.T) {
+	ms := createDefaultMemStore(t)
+	defer ms.Close()
+
+	testBatchAcks(t, ms)
+}
+
 func TestMSClientAPIs(t *testing.T) {
 	ms := createDefaultMemStore(t)
 	defer ms.Close()
@@ -148,6 +241,13 @@ func TestMSClientAPIs(t *testing.T) {
 	testClientAPIs(t, ms)
 }
 
+func TestMSUpdateClient(t *testing.T) {
+	ms := createDefaultMemStore(t)
+	defer ms.Close()
+
+	testUpdateClient(t, ms)
+}
+
 func TestMSFlush(t *testing.T) {
 	ms := createDefaultMemStore(t)
 	defer ms.Close()
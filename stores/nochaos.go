@@ -0,0 +1,25 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+//go:build !chaos
+// +build !chaos
+
+package stores
+
+import "io"
+
+// Faults are only injected when built with the `chaos` tag (see chaos.go).
+const chaosEnabled = false
+
+// chaosWriter returns `w` as is.
+func chaosWriter(w io.Writer) io.Writer {
+	return w
+}
+
+// chaosSyncFault never fails.
+func chaosSyncFault() error {
+	return nil
+}
+
+// chaosKillPoint does nothing.
+func chaosKillPoint(name string) {
+}
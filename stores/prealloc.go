@@ -0,0 +1,13 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+//go:build !linux
+// +build !linux
+
+package stores
+
+import "os"
+
+// preallocateFile is a no-op on platforms without fallocate(2).
+func preallocateFile(file *os.File, size int64) error {
+	return nil
+}
@@ -0,0 +1,21 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package stores
+
+import (
+	"os"
+	"syscall"
+)
+
+// Mode of fallocate(2) that does not change the size of the file.
+const fallocKeepSize = 0x1
+
+// preallocateFile reserves `size` bytes of disk space for the file, without
+// changing its size. It returns ErrNoSpace if the disk is full, but does
+// not fail if the file system does not support preallocation.
+func preallocateFile(file *os.File, size int64) error {
+	if err := syscall.Fallocate(int(file.Fd()), fallocKeepSize, 0, size); err == syscall.ENOSPC {
+		return ErrNoSpace
+	}
+	return nil
+}
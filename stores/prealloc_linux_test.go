@@ -0,0 +1,39 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package stores
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestFSPreallocate(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	if _, _, err := NewFileStore(defaultDataStore, &testDefaultChannelLimits, PreallocateSize(-1)); err == nil {
+		t.Fatal("Expected error with negative preallocate size")
+	}
+
+	size := int64(1024 * 1024)
+	fs, _, err := NewFileStore(defaultDataStore, &testDefaultChannelLimits, PreallocateSize(size))
+	if err != nil {
+		t.Fatalf("Unable to create a FileStore instance: %v", err)
+	}
+	defer fs.Close()
+	storeMsg(t, fs, "foo", []byte("hello"))
+
+	fi, err := os.Stat(filepath.Join(defaultDataStore, "foo", "msgs.1.dat"))
+	if err != nil {
+		t.Fatalf("Unable to stat file: %v", err)
+	}
+	// The size of the file is not changed.
+	if fi.Size() >= size {
+		t.Fatalf("Unexpected file size: %v", fi.Size())
+	}
+	if allocated := fi.Sys().(*syscall.Stat_t).Blocks * 512; allocated < size {
+		t.Skipf("File system does not support preallocation, allocated %v bytes", allocated)
+	}
+}
@@ -0,0 +1,112 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package stores
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// StoreConfig holds the configuration passed to a StoreFactory.
+type StoreConfig struct {
+	// Dir is the root directory, for store types that persist their state
+	// on disk.
+	Dir string
+	// Limits are the channel limits of the store.
+	Limits *ChannelLimits
+	// FileStoreOpts are the options of the FILE store type. Other store
+	// types are free to ignore them.
+	FileStoreOpts *FileStoreOptions
+	// MemorySnapshotInterval, if positive, makes the MEMORY store type
+	// snapshot its state in Dir at this interval.
+	MemorySnapshotInterval time.Duration
+}
+
+// StoreFactory creates a Store. If the store recovered some state, it
+// returns it, otherwise the returned RecoveredState is nil, and the server
+// will call Store.Init().
+type StoreFactory func(config *StoreConfig) (Store, *RecoveredState, error)
+
+var (
+	factoriesMu sync.RWMutex
+	factories   = make(map[string]StoreFactory)
+)
+
+func init() {
+	Register(TypeMemory, func(config *StoreConfig) (Store, *RecoveredState, error) {
+		if config.MemorySnapshotInterval > 0 {
+			if config.Dir == "" {
+				return nil, nil, fmt.Errorf("for %v stores with snapshots, root directory must be specified", TypeMemory)
+			}
+			ms, state, err := NewMemoryStoreWithSnapshots(config.Dir, config.MemorySnapshotInterval, config.Limits)
+			if err != nil {
+				return nil, nil, err
+			}
+			return ms, state, nil
+		}
+		ms, err := NewMemoryStore(config.Limits)
+		if err != nil {
+			return nil, nil, err
+		}
+		return ms, nil, nil
+	})
+	Register(TypeFile, func(config *StoreConfig) (Store, *RecoveredState, error) {
+		if config.Dir == "" {
+			return nil, nil, fmt.Errorf("for %v stores, root directory must be specified", TypeFile)
+		}
+		var options []FileStoreOption
+		if config.FileStoreOpts != nil {
+			options = append(options, AllOptions(config.FileStoreOpts))
+		}
+		fs, state, err := NewFileStore(config.Dir, config.Limits, options...)
+		if err != nil {
+			return nil, nil, err
+		}
+		return fs, state, nil
+	})
+}
+
+// Register makes a store type available under the given name, which is
+// case insensitive. This allows embedding applications, or alternate builds
+// of the server, to provide their own store implementation. Register panics
+// if the factory is nil or if a store type is already registered under that
+// name. It is meant to be called from an init() function.
+func Register(name string, factory StoreFactory) {
+	if factory == nil {
+		panic("stores: Register factory is nil")
+	}
+	name = strings.ToUpper(name)
+	factoriesMu.Lock()
+	defer factoriesMu.Unlock()
+	if _, dup := factories[name]; dup {
+		panic("stores: Register called twice for store type " + name)
+	}
+	factories[name] = factory
+}
+
+// RegisteredTypes returns the sorted names of the registered store types.
+func RegisteredTypes() []string {
+	factoriesMu.RLock()
+	names := make([]string, 0, len(factories))
+	for name := range factories {
+		names = append(names, name)
+	}
+	factoriesMu.RUnlock()
+	sort.Strings(names)
+	return names
+}
+
+// NewStore creates a store of the given type, which must have been
+// registered.
+func NewStore(storeType string, config *StoreConfig) (Store, *RecoveredState, error) {
+	factoriesMu.RLock()
+	factory := factories[strings.ToUpper(storeType)]
+	factoriesMu.RUnlock()
+	if factory == nil {
+		return nil, nil, fmt.Errorf("unsupported store type: %v", storeType)
+	}
+	return factory(config)
+}
@@ -0,0 +1,56 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package stores
+
+import (
+	"sort"
+	"testing"
+)
+
+func TestRegisterStore(t *testing.T) {
+	var gotConfig *StoreConfig
+	Register("test", func(config *StoreConfig) (Store, *RecoveredState, error) {
+		gotConfig = config
+		ms, err := NewMemoryStore(config.Limits)
+		return ms, nil, err
+	})
+	defer func() {
+		factoriesMu.Lock()
+		delete(factories, "TEST")
+		factoriesMu.Unlock()
+	}()
+
+	// Other store types may be registered depending on build tags.
+	types := RegisteredTypes()
+	if !sort.StringsAreSorted(types) || types[sort.SearchStrings(types, "TEST")] != "TEST" ||
+		types[sort.SearchStrings(types, TypeFile)] != TypeFile || types[sort.SearchStrings(types, TypeMemory)] != TypeMemory {
+		t.Fatalf("Unexpected registered types: %v", types)
+	}
+	config := &StoreConfig{Limits: &testDefaultChannelLimits}
+	s, state, err := NewStore("Test", config)
+	if err != nil {
+		t.Fatalf("Unexpected error creating store: %v", err)
+	}
+	defer s.Close()
+	if state != nil || gotConfig != config || s.Name() != TypeMemory {
+		t.Fatalf("Unexpected store %v, state %v, config %v", s.Name(), state, gotConfig)
+	}
+
+	if _, _, err := NewStore("unknown", config); err == nil {
+		t.Fatal("Expected error for unknown store type")
+	}
+	if _, _, err := NewStore(TypeFile, config); err == nil {
+		t.Fatal("Expected error for file store without directory")
+	}
+
+	for _, f := range []StoreFactory{nil, func(*StoreConfig) (Store, *RecoveredState, error) { return nil, nil, nil }} {
+		func() {
+			defer func() {
+				if r := recover(); r == nil {
+					t.Fatal("Expected Register to panic")
+				}
+			}()
+			Register("TEST", f)
+		}()
+	}
+}
@@ -0,0 +1,247 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package stores
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Payload hash of the signed requests: the objects are not hashed before
+// being uploaded, which would require reading them twice.
+const s3UnsignedPayload = "UNSIGNED-PAYLOAD"
+
+// Maximum size of the error returned by the object storage that is
+// included in the error of a request.
+const s3MaxErrorBody = 512
+
+// S3TierOptions are the options of an S3Tier.
+type S3TierOptions struct {
+	// Endpoint is the URL of the object storage, for instance
+	// https://s3.amazonaws.com, http://localhost:9000 for a MinIO server,
+	// or https://storage.googleapis.com for GCS (with HMAC keys).
+	Endpoint string
+	// Region of the bucket, us-east-1 if not set. GCS accepts any region,
+	// such as `auto`.
+	Region string
+	// Bucket in which the objects are stored.
+	Bucket string
+	// Prefix is prepended to the name of the objects, for instance to share
+	// a bucket between several servers.
+	Prefix string
+	// AccessKey and SecretKey are the credentials used to sign the requests.
+	AccessKey string
+	SecretKey string
+	// Timeout of each request, 0 for none.
+	Timeout time.Duration
+}
+
+// S3Tier is a Tier storing objects in a bucket of an object storage that
+// implements the S3 API, such as AWS S3, MinIO or GCS (through its XML
+// API). Requests are signed with AWS Signature Version 4, and use path
+// style URLs, so that the bucket name does not have to be a valid host
+// name.
+type S3Tier struct {
+	opts     S3TierOptions
+	endpoint *url.URL
+	client   *http.Client
+}
+
+// NewS3Tier returns a Tier storing objects in the bucket described by the
+// options.
+func NewS3Tier(opts S3TierOptions) (*S3Tier, error) {
+	if opts.Bucket == "" {
+		return nil, fmt.Errorf("s3 tier: bucket required")
+	}
+	if opts.AccessKey == "" || opts.SecretKey == "" {
+		return nil, fmt.Errorf("s3 tier: access key and secret key required")
+	}
+	endpoint, err := url.Parse(opts.Endpoint)
+	if err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Host == "" {
+		return nil, fmt.Errorf("s3 tier: invalid endpoint %q", opts.Endpoint)
+	}
+	if opts.Region == "" {
+		opts.Region = "us-east-1"
+	}
+	return &S3Tier{
+		opts:     opts,
+		endpoint: endpoint,
+		client:   &http.Client{Timeout: opts.Timeout},
+	}, nil
+}
+
+// objectURL returns the URL of the object with the given name.
+func (t *S3Tier) objectURL(name string) *url.URL {
+	u := *t.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + t.opts.Bucket + "/" + t.opts.Prefix + name
+	// Sent as signed.
+	u.RawPath = s3EscapePath(u.Path)
+	u.RawQuery = ""
+	return &u
+}
+
+// Put implements Tier. Objects are uploaded in a single request, which
+// the object storage makes visible only once complete.
+func (t *S3Tier) Put(name string, r io.Reader) error {
+	var size int64 = -1
+	if f, ok := r.(*os.File); ok {
+		if fi, err := f.Stat(); err == nil {
+			offset, err := f.Seek(0, 1)
+			if err == nil {
+				size = fi.Size() - offset
+			}
+		}
+	}
+	if size < 0 {
+		// The object storage requires the length of the content.
+		b, err := ioutil.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		r, size = bytes.NewReader(b), int64(len(b))
+	}
+	req, err := http.NewRequest("PUT", t.objectURL(name).String(), ioutil.NopCloser(r))
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	resp, err := t.do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Get implements Tier.
+func (t *S3Tier) Get(name string) (io.ReadCloser, error) {
+	req, err := http.NewRequest("GET", t.objectURL(name).String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := t.do(req)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// Delete implements Tier. Deleting an object that does not exist is not
+// an error.
+func (t *S3Tier) Delete(name string) error {
+	req, err := http.NewRequest("DELETE", t.objectURL(name).String(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := t.do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// do signs and sends the request, and returns an error if the response
+// is not successful.
+func (t *S3Tier) do(req *http.Request) (*http.Response, error) {
+	t.sign(req, time.Now())
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, s3MaxErrorBody))
+		resp.Body.Close()
+		return nil, fmt.Errorf("s3 tier: %s %s: %s: %s", req.Method, req.URL.Path, resp.Status,
+			strings.TrimSpace(string(body)))
+	}
+	return resp, nil
+}
+
+// sign adds the AWS Signature Version 4 of the request to its headers.
+// All the headers set on the request, plus its host, are signed. The
+// requests of the tier have no query parameters.
+func (t *S3Tier) sign(req *http.Request, now time.Time) {
+	now = now.UTC()
+	date := now.Format("20060102")
+	amzDate := now.Format("20060102T150405Z")
+	req.Header.Set("X-Amz-Date", amzDate)
+	if req.Header.Get("X-Amz-Content-Sha256") == "" {
+		req.Header.Set("X-Amz-Content-Sha256", s3UnsignedPayload)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		if k != "Authorization" {
+			headers[strings.ToLower(k)] = strings.TrimSpace(strings.Join(v, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonicalHeaders bytes.Buffer
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		s3EscapePath(req.URL.Path),
+		"",
+		canonicalHeaders.String(),
+		signedHeaders,
+		req.Header.Get("X-Amz-Content-Sha256"),
+	}, "\n")
+	scope := date + "/" + t.opts.Region + "/s3/aws4_request"
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+
+	key := hmacSHA256([]byte("AWS4"+t.opts.SecretKey), date)
+	key = hmacSHA256(key, t.opts.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		t.opts.AccessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// s3EscapePath escapes each segment of the path as required by the
+// signature: every byte but the unreserved characters is percent-encoded.
+func s3EscapePath(path string) string {
+	var buf bytes.Buffer
+	for i := 0; i < len(path); i++ {
+		c := path[i]
+		if c == '/' || s3Unreserved(c) {
+			buf.WriteByte(c)
+		} else {
+			fmt.Fprintf(&buf, "%%%02X", c)
+		}
+	}
+	return buf.String()
+}
+
+func s3Unreserved(c byte) bool {
+	return (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') ||
+		c == '-' || c == '_' || c == '.' || c == '~'
+}
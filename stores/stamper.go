@@ -0,0 +1,81 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package stores
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// MsgStamper assigns the sequence and timestamp of the messages stored with
+// MsgStore.Store, MsgStore.StoreBatch and transactions. The messages stored
+// with MsgStore.StoreMsg keep their own. By default, stores use
+// SystemStamper; a replicated deployment can use MonotonicStamper, or a
+// hybrid logical clock, so that the timestamps of a channel never go back
+// after a failover to a server whose clock is behind, and tests can use a
+// deterministic one. It is set with Store.SetMsgStamper.
+type MsgStamper interface {
+	// Stamp returns the sequence and timestamp of the next message of the
+	// channel, given the last sequence of the channel and the highest
+	// timestamp of the messages it stored. The sequence must be greater
+	// than `lastSeq`. The next messages of a batch get the following
+	// sequences and the same timestamp.
+	Stamp(channel string, lastSeq uint64, lastTimestamp int64) (uint64, int64)
+}
+
+// SystemStamper is the default MsgStamper: messages get the sequence
+// following the last one, and the system time, which may go back.
+type SystemStamper struct{}
+
+// Stamp implements the MsgStamper interface.
+func (SystemStamper) Stamp(channel string, lastSeq uint64, lastTimestamp int64) (uint64, int64) {
+	return lastSeq + 1, time.Now().UnixNano()
+}
+
+// MonotonicStamper is a MsgStamper whose timestamps are never lower than
+// the highest timestamp of the channel: if its clock is behind, messages
+// get the highest timestamp plus one nanosecond instead.
+type MonotonicStamper struct {
+	// Now returns the current time. If nil, time.Now is used.
+	Now func() time.Time
+}
+
+// Stamp implements the MsgStamper interface.
+func (st *MonotonicStamper) Stamp(channel string, lastSeq uint64, lastTimestamp int64) (uint64, int64) {
+	var now int64
+	if st.Now != nil {
+		now = st.Now().UnixNano()
+	} else {
+		now = time.Now().UnixNano()
+	}
+	if now <= lastTimestamp {
+		now = lastTimestamp + 1
+	}
+	return lastSeq + 1, now
+}
+
+// sharedStamper holds the MsgStamper of a store, shared with its message
+// stores so that it can be replaced after they are created.
+type sharedStamper struct {
+	v atomic.Value // stamperHolder
+}
+
+// stamperHolder wraps the MsgStamper, since atomic.Value requires values
+// of the same concrete type.
+type stamperHolder struct {
+	MsgStamper
+}
+
+func (ss *sharedStamper) set(stamper MsgStamper) {
+	if stamper == nil {
+		stamper = SystemStamper{}
+	}
+	ss.v.Store(stamperHolder{stamper})
+}
+
+func (ss *sharedStamper) get() MsgStamper {
+	if h, ok := ss.v.Load().(stamperHolder); ok {
+		return h.MsgStamper
+	}
+	return SystemStamper{}
+}
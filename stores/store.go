@@ -25,13 +25,22 @@ const (
 
 // Errors.
 var (
-	ErrTooManyChannels = errors.New("too many channels")
-	ErrTooManySubs     = errors.New("too many subscriptions per channel")
+	ErrTooManyChannels  = errors.New("too many channels")
+	ErrTooManySubs      = errors.New("too many subscriptions per channel")
+	ErrNoSpace          = errors.New("not enough free disk space")
+	ErrSeqOutOfOrder    = errors.New("message sequence not after the last stored sequence")
+	ErrReadOnly         = errors.New("store is read-only")
+	ErrCorruptedData    = errors.New("corrupted data")
+	ErrTxNotSupported   = errors.New("transactions not supported by this store")
+	ErrUpgradeRequired  = errors.New("store files must be upgraded")
+	ErrDeadlineExceeded = errors.New("store operation not completed before its deadline")
+	ErrNoSnapshots      = errors.New("snapshots not supported by this store")
+	ErrNoPurge          = errors.New("purge not supported by this store")
 )
 
-// Noticef logs a notice statement
+// Noticef logs a notice statement, tagged with the "STORE" component.
 func Noticef(format string, v ...interface{}) {
-	server.Noticef(format, v...)
+	server.Noticef("STORE: "+format, v...)
 }
 
 // ChannelLimits defines some limits on the store interface
@@ -46,6 +55,47 @@ type ChannelLimits struct {
 	MaxMsgAge time.Duration
 	// How many subscriptions per channel are allowed.
 	MaxSubs int
+	// Channels (wildcards allowed) on which only the latest message for
+	// a given key is retained.
+	CompactedChannels []string
+	// Tenants with their own limits.
+	Tenants []TenantLimits
+	// Channels with their own limits.
+	PerChannel []PerChannelLimits
+}
+
+// PerChannelLimits defines the limits of a single channel. A zero value
+// means that the limit of the channel's tenant, if any, or else the
+// corresponding ChannelLimits value, applies.
+type PerChannelLimits struct {
+	// Name of the channel.
+	Name string
+	// How many messages are allowed.
+	MaxNumMsgs int
+	// How many bytes (messages payloads) are allowed.
+	MaxMsgBytes uint64
+	// How many subscriptions are allowed.
+	MaxSubs int
+}
+
+// TenantLimits defines the limits of a tenant. A tenant owns the channels
+// whose name starts with the tenant name followed by a '.', for instance
+// `acme.orders` belongs to the tenant `acme`. The channels of a tenant
+// don't count toward ChannelLimits.MaxChannels, so that a tenant can't
+// prevent others from creating channels. For the other limits, a zero
+// value means that the corresponding ChannelLimits value applies.
+type TenantLimits struct {
+	// Name of the tenant, which is also the prefix of its channels.
+	Name string
+	// How many channels the tenant is allowed (ChannelLimits.MaxChannels
+	// if 0, but counted separately).
+	MaxChannels int
+	// How many messages per channel are allowed.
+	MaxNumMsgs int
+	// How many bytes (messages payloads) per channel are allowed.
+	MaxMsgBytes uint64
+	// How many subscriptions per channel are allowed.
+	MaxSubs int
 }
 
 // DefaultChannelLimits are the channel limits that a Store must
@@ -59,10 +109,26 @@ var DefaultChannelLimits = ChannelLimits{
 }
 
 // RecoveredState allows the server to reconstruct its state after a restart.
+// Recovered subscriptions are not part of this structure, instead they
+// are handed out one at a time by Recover.
 type RecoveredState struct {
 	Info    *spb.ServerInfo
 	Clients []*Client
-	Subs    RecoveredSubscriptions
+	// RecoverSubs is set by the store to hand out its recovered
+	// subscriptions. The server does not call it directly but uses Recover.
+	RecoverSubs func(f func(channel string, sub *RecoveredSubState) error) error
+}
+
+// Recover invokes f for each recovered subscription. The subscription's
+// map of pending messages is built just before f is called, so the store
+// does not have to materialize the pending messages of every subscription
+// at once. If f returns an error, recovery stops and this error is returned.
+// Recover must be invoked before the store is used, and only once.
+func (rs *RecoveredState) Recover(f func(channel string, sub *RecoveredSubState) error) error {
+	if rs.RecoverSubs == nil {
+		return nil
+	}
+	return rs.RecoverSubs(f)
 }
 
 // Client represents a client with ID, Heartbeat Inbox and user data sets
@@ -72,9 +138,6 @@ type Client struct {
 	UserData interface{}
 }
 
-// RecoveredSubscriptions is a map of recovered subscriptions, keyed by channel name.
-type RecoveredSubscriptions map[string][]*RecoveredSubState
-
 // PendingAcks is a map of messages waiting to be acknowledged, keyed by
 // message sequence number.
 type PendingAcks map[uint64]*pb.MsgProto
@@ -94,6 +157,43 @@ type ChannelStore struct {
 	Subs SubStore
 	// Msgs is the Messages Store.
 	Msgs MsgStore
+	// Created is the time the channel was created. It is the zero time if
+	// unknown, for instance for a channel recovered from files written by
+	// an older version of the server.
+	Created time.Time
+}
+
+// Flush persists the operations buffered by the messages store, then by the
+// subscriptions store, of this channel.
+func (cs *ChannelStore) Flush() error {
+	if err := cs.Msgs.Flush(); err != nil {
+		return err
+	}
+	return cs.Subs.Flush()
+}
+
+// ChannelInfo describes a channel and the state of its messages store.
+type ChannelInfo struct {
+	Name     string
+	Created  time.Time
+	FirstSeq uint64
+	LastSeq  uint64
+	Msgs     int
+	Bytes    uint64
+	// Retention is the progress of the background enforcement of the
+	// limits, nil if the limits are enforced as messages are stored.
+	Retention *RetentionStats
+}
+
+// RetentionStats describes the progress of the background enforcement of
+// the limits of a channel (see FileStoreOptions.RetentionRate).
+type RetentionStats struct {
+	// Messages, and their size, over the limits and not removed yet.
+	ExcessMsgs  int
+	ExcessBytes uint64
+	// Messages, and their size, removed by the background enforcement.
+	RemovedMsgs  uint64
+	RemovedBytes uint64
 }
 
 // Store is the storage interface for STAN servers.
@@ -113,6 +213,11 @@ type Store interface {
 	// to be retroactive.
 	SetChannelLimits(limits ChannelLimits)
 
+	// SetMsgStamper sets the MsgStamper assigning the sequence and timestamp
+	// of the messages stored from now on, in all channels. A nil stamper
+	// restores the default SystemStamper.
+	SetMsgStamper(stamper MsgStamper)
+
 	// CreateChannel creates a ChannelStore for the given channel, and returns
 	// `true` to indicate that the channel is new, false if it already exists.
 	CreateChannel(channel string, userData interface{}) (*ChannelStore, bool, error)
@@ -124,10 +229,21 @@ type Store interface {
 	// HasChannel returns true if this store has any channel.
 	HasChannel() bool
 
+	// GetChannelNames returns the names of all channels in this store.
+	GetChannelNames() []string
+
+	// GetChannels returns information about all channels in this store,
+	// sorted by channel name.
+	GetChannels() ([]*ChannelInfo, error)
+
 	// MsgsState returns message store statistics for a given channel, or all
 	// if 'channel' is AllChannels.
 	MsgsState(channel string) (numMessages int, byteSize uint64, err error)
 
+	// MemoryBudget returns the accounting of the memory used by the messages
+	// that this store keeps in memory.
+	MemoryBudget() *MemoryBudget
+
 	// AddClient stores information about the client identified by `clientID`.
 	// If a Client is already registered, this call returns the currently
 	// registered Client object, and the boolean set to false to indicate
@@ -150,10 +266,99 @@ type Store interface {
 	// and returns it to the caller.
 	DeleteClient(clientID string) *Client
 
+	// SetClientUnreachable records the time (UnixNano) since which the client
+	// identified by `clientID` does not answer heartbeats, or 0 if it answers
+	// again, so that this is known after a restart.
+	SetClientUnreachable(clientID string, since int64) error
+
+	// SetClientLastContact records the time (UnixNano) at which the client
+	// identified by `clientID` last answered a heartbeat, so that this is
+	// known after a restart. AddClient sets it to the current time.
+	SetClientLastContact(clientID string, lastContact int64) error
+
+	// UpdateClient replaces the heartbeat inbox and the metadata of the
+	// client identified by `clientID`, and returns the updated Client.
+	// The metadata is opaque to the store, which persists it with the client.
+	UpdateClient(clientID, hbInbox string, metadata []byte) (*Client, error)
+
+	// Flush persists the operations buffered by the stores of all channels,
+	// so that they are on stable storage when this call returns.
+	Flush() error
+
 	// Close closes all stores.
 	Close() error
 }
 
+// TxStore is implemented by the stores that can store messages on several
+// channels atomically, which are the LEVELDB and BOLT stores.
+type TxStore interface {
+	// BeginTx starts a transaction.
+	BeginTx() (Tx, error)
+}
+
+// Tx is a transaction storing messages on several channels atomically.
+type Tx interface {
+	// Store adds a message to store on the given channel, which must exist.
+	// Nothing is stored until Commit is called.
+	Store(channel string, msg *BatchMsg) error
+
+	// Commit stores the messages of the transaction atomically: either all
+	// of them are stored, with consecutive sequences per channel, or none
+	// is. The stored messages are returned in the order they were added.
+	Commit() ([]*pb.MsgProto, error)
+
+	// Rollback discards the transaction.
+	Rollback()
+}
+
+// BeginTx starts a transaction on the given store, or returns
+// ErrTxNotSupported if the store does not implement TxStore.
+func BeginTx(s Store) (Tx, error) {
+	ts, ok := s.(TxStore)
+	if !ok {
+		return nil, ErrTxNotSupported
+	}
+	return ts.BeginTx()
+}
+
+// SnapshotStore is implemented by the stores that can write their whole
+// state to disk on demand, which is the MEMORY store with snapshots.
+type SnapshotStore interface {
+	// Snapshot writes the state of the store to disk.
+	Snapshot() error
+}
+
+// Snapshot snapshots the given store, or returns ErrNoSnapshots if the
+// store does not implement SnapshotStore or was created without snapshots.
+func Snapshot(s Store) error {
+	ss, ok := s.(SnapshotStore)
+	if !ok {
+		return ErrNoSnapshots
+	}
+	return ss.Snapshot()
+}
+
+// PurgeMsgStore is implemented by the message stores that can remove the
+// messages at the head of a channel on demand, which are all the message
+// stores of this package.
+type PurgeMsgStore interface {
+	// PurgeBefore removes the messages with a sequence lower than seq, but
+	// always keeps the last message, as the limits do. It returns the
+	// number of messages removed.
+	PurgeBefore(seq uint64) (int, error)
+}
+
+// PurgeBefore removes the messages of the given store with a sequence
+// lower than seq, or returns ErrNoPurge if the store does not implement
+// PurgeMsgStore.
+func PurgeBefore(ms MsgStore, seq uint64) (int, error) {
+	ps, ok := ms.(PurgeMsgStore)
+	if !ok {
+		return 0, ErrNoPurge
+	}
+	return ps.PurgeBefore(seq)
+}
+
 // SubStore is the interface for storage of Subscriptions on a given channel.
 //
 // Implementations of this interface should not attempt to validate that
@@ -178,6 +383,15 @@ type SubStore interface {
 	// by the subscription 'subid'.
 	AckSeqPending(subid, seqno uint64) error
 
+	// AckSeqPendingRange records that all messages from 'firstSeq' to
+	// 'lastSeq', included, have been acknowledged by the subscription 'subid'.
+	AckSeqPendingRange(subid, firstSeq, lastSeq uint64) error
+
+	// AckSeqPendingBatch records that the given messages 'seqnos' have been
+	// acknowledged by the subscription 'subid'. The acks are persisted at
+	// once instead of one write per message.
+	AckSeqPendingBatch(subid uint64, seqnos ...uint64) error
+
 	// Flush is for stores that may buffer operations and need them to be persisted.
 	Flush() error
 
@@ -185,16 +399,50 @@ type SubStore interface {
 	Close() error
 }
 
+// BatchMsg is a message stored with MsgStore.StoreBatch.
+type BatchMsg struct {
+	Reply string
+	Data  []byte
+	Ext   *spb.MsgExt // Optional attributes
+}
+
 // MsgStore is the interface for storage of Messages on a given channel.
 type MsgStore interface {
 	// State returns some statistics related to this store.
 	State() (numMessages int, byteSize uint64, err error)
 
-	// Store stores a message.
-	Store(reply string, data []byte) (*pb.MsgProto, error)
-
-	// Lookup returns the stored message with given sequence number.
-	Lookup(seq uint64) *pb.MsgProto
+	// Store stores a message. The optional `ext` contains attributes, such
+	// as headers, that are persisted alongside the message.
+	Store(reply string, data []byte, ext *spb.MsgExt) (*pb.MsgProto, error)
+
+	// StoreBatch stores the messages atomically: either all of them are
+	// stored, with consecutive sequences, or none is. The messages become
+	// visible to the other methods at once, and are returned in order.
+	StoreBatch(msgs []*BatchMsg) ([]*pb.MsgProto, error)
+
+	// StoreMsg stores a copy of a message, such as one replicated from
+	// another server, keeping its sequence and timestamp. The sequence must
+	// be greater than the last sequence stored, but there may be a gap,
+	// otherwise ErrSeqOutOfOrder is returned. This is how mirrors and
+	// ImportArchive write exact copies, and what a replicating store
+	// should use instead of Store.
+	StoreMsg(m *pb.MsgProto, ext *spb.MsgExt) error
+
+	// Lookup returns the stored message with given sequence number, or nil
+	// if there is none. An error is returned if the message exists but can't
+	// be read, for instance ErrCorruptedData, so that the message is not
+	// mistaken for a removed one.
+	Lookup(seq uint64) (*pb.MsgProto, error)
+
+	// LookupExt returns the attributes stored with the message of given
+	// sequence number, nil if there are none.
+	LookupExt(seq uint64) *spb.MsgExt
+
+	// LookupRange returns, in sequence order, the messages stored with a
+	// sequence between first and last included, skipping the removed ones.
+	// At most max messages are returned, unless max is 0. An error is
+	// returned if one of the messages can't be read.
+	LookupRange(first, last uint64, max int) ([]*pb.MsgProto, error)
 
 	// FirstSequence returns sequence for first message stored, 0 if no
 	// message is stored.
@@ -212,11 +460,18 @@ type MsgStore interface {
 	// timestamp is greater or equal to given timestamp.
 	GetSequenceFromTimestamp(timestamp int64) uint64
 
-	// FirstMsg returns the first message stored.
-	FirstMsg() *pb.MsgProto
+	// FirstMsg returns the first message stored, nil if no message is
+	// stored, or an error if it can't be read.
+	FirstMsg() (*pb.MsgProto, error)
+
+	// LastMsg returns the last message stored, nil if no message is stored,
+	// or an error if it can't be read.
+	LastMsg() (*pb.MsgProto, error)
 
-	// LastMsg returns the last message stored.
-	LastMsg() *pb.MsgProto
+	// LastMsgForKey returns the latest message stored with the given key,
+	// nil if there is none or if the channel is not compacted, or an error
+	// if it can't be read.
+	LastMsgForKey(key string) (*pb.MsgProto, error)
 
 	// Flush is for stores that may buffer operations and need them to be persisted.
 	Flush() error
@@ -0,0 +1,800 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+// Package storetest is a conformance test suite for the implementations
+// of the stores.Store interface. A new store type runs it from one of its
+// tests:
+//
+//	func TestConformance(t *testing.T) {
+//		storetest.RunStoreTests(t, func(config *stores.StoreConfig) (stores.Store, *stores.RecoveredState, error) {
+//			return NewMyStore(config.Dir, config.Limits)
+//		})
+//	}
+package storetest
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/nats-io/go-nats-streaming/pb"
+	"github.com/nats-io/nats-streaming-server/spb"
+	"github.com/nats-io/nats-streaming-server/stores"
+)
+
+// defaultLimits are the limits the stores are created with, unless a test
+// needs its own.
+var defaultLimits = stores.ChannelLimits{
+	MaxChannels: 100,
+	MaxNumMsgs:  1000000,
+	MaxMsgBytes: 1000000 * 1024,
+	MaxSubs:     1000,
+}
+
+var serverInfo = spb.ServerInfo{
+	ClusterID:   "storetest",
+	Discovery:   "discovery",
+	Publish:     "publish",
+	Subscribe:   "subscribe",
+	Unsubscribe: "unsubscribe",
+	Close:       "close",
+}
+
+// storeTest is a test of the suite. The store it is given is created in an
+// empty directory, and is closed once the test returns.
+type storeTest struct {
+	name string
+	f    func(t *storeT, s stores.Store)
+}
+
+var storeTests = []storeTest{
+	{"NewChannel", testNewChannel},
+	{"MsgStore", testMsgStore},
+	{"MsgExt", testMsgExt},
+	{"KeyCompaction", testKeyCompaction},
+	{"StoreMsg", testStoreMsg},
+	{"StoreBatch", testStoreBatch},
+	{"LookupRange", testLookupRange},
+	{"SequenceFromTimestamp", testSequenceFromTimestamp},
+	{"MaxMsgs", testMaxMsgs},
+	{"MaxChannels", testMaxChannels},
+	{"MaxSubs", testMaxSubs},
+	{"SubStore", testSubStore},
+	{"Clients", testClients},
+	{"Flush", testFlush},
+	{"ConcurrentMsgs", testConcurrentMsgs},
+	{"ConcurrentSubs", testConcurrentSubs},
+	{"Recovery", testRecovery},
+	{"CloseIdempotent", testCloseIdempotent},
+}
+
+// RunStoreTests runs the conformance tests against the stores created by
+// the factory. Each test creates a store, with a StoreConfig whose Dir is
+// an empty directory removed at the end of the test. The factory is called
+// again with the same configuration, once the store is closed, to test the
+// recovery: if it returns a nil RecoveredState, the store is considered not
+// to persist its state and the recovery is not tested.
+func RunStoreTests(t *testing.T, factory stores.StoreFactory) {
+	for _, st := range storeTests {
+		runStoreTest(t, factory, st)
+	}
+}
+
+func runStoreTest(t *testing.T, factory stores.StoreFactory, st storeTest) {
+	dir, err := ioutil.TempDir("", "storetest_")
+	if err != nil {
+		t.Fatalf("%s: unable to create directory: %v", st.name, err)
+	}
+	defer os.RemoveAll(dir)
+
+	limits := defaultLimits
+	config := &stores.StoreConfig{Dir: dir, Limits: &limits}
+	st2 := &storeT{T: t, name: st.name, factory: factory, config: config}
+	s := st2.open()
+	if s == nil {
+		return
+	}
+	defer func() {
+		s.Close()
+		if st2.reopened != nil {
+			st2.reopened.Close()
+		}
+	}()
+	st.f(st2, s)
+}
+
+// storeT is given to the tests of the suite. It prefixes the failures with
+// the name of the test, followed by the stack of the callers.
+type storeT struct {
+	*testing.T
+	name     string
+	factory  stores.StoreFactory
+	config   *stores.StoreConfig
+	reopened stores.Store
+}
+
+func (t *storeT) Fatalf(format string, args ...interface{}) {
+	lines := []string{t.name + ": " + fmt.Sprintf(format, args...)}
+	for i := 1; true; i++ {
+		_, file, line, ok := runtime.Caller(i)
+		if !ok {
+			break
+		}
+		lines = append(lines, fmt.Sprintf("%d - %s:%d", i, file, line))
+	}
+	t.T.Fatalf("%s", strings.Join(lines, "\n"))
+}
+
+func (t *storeT) Fatal(args ...interface{}) {
+	t.Fatalf("%s", fmt.Sprint(args...))
+}
+
+// open creates a store and, if it recovered nothing, initializes it.
+func (t *storeT) open() stores.Store {
+	s, state, err := t.factory(t.config)
+	if err != nil {
+		t.Fatalf("unable to create the store: %v", err)
+	}
+	if state == nil {
+		if err := s.Init(&serverInfo); err != nil {
+			s.Close()
+			t.Fatalf("unable to initialize the store: %v", err)
+		}
+	}
+	return s
+}
+
+// reopen closes the store and creates a new one with the same
+// configuration, returning its recovered state, or nil if the store does
+// not persist its state, in which case the store is nil too.
+func (t *storeT) reopen(s stores.Store) (stores.Store, *stores.RecoveredState) {
+	if err := s.Close(); err != nil {
+		t.Fatalf("error closing the store: %v", err)
+	}
+	rs, state, err := t.factory(t.config)
+	if err != nil {
+		t.Fatalf("unable to reopen the store: %v", err)
+	}
+	if state == nil {
+		rs.Close()
+		return nil, nil
+	}
+	t.reopened = rs
+	return rs, state
+}
+
+func createChannel(t *storeT, s stores.Store, channel string) *stores.ChannelStore {
+	cs := s.LookupChannel(channel)
+	if cs == nil {
+		var err error
+		if cs, _, err = s.CreateChannel(channel, nil); err != nil {
+			t.Fatalf("error creating channel %q: %v", channel, err)
+		}
+	}
+	return cs
+}
+
+func storeMsg(t *storeT, s stores.Store, channel string, data []byte, ext *spb.MsgExt) *pb.MsgProto {
+	m, err := createChannel(t, s, channel).Msgs.Store("", data, ext)
+	if err != nil {
+		t.Fatalf("error storing message on %q: %v", channel, err)
+	}
+	return m
+}
+
+func lookup(t *storeT, ms stores.MsgStore, seq uint64) *pb.MsgProto {
+	m, err := ms.Lookup(seq)
+	if err != nil {
+		t.Fatalf("error looking up message %v: %v", seq, err)
+	}
+	return m
+}
+
+// checkMsg fails if the message is not the expected one.
+func checkMsg(t *storeT, m *pb.MsgProto, expected *pb.MsgProto) {
+	if m == nil || m.Sequence != expected.Sequence || m.Subject != expected.Subject ||
+		m.Reply != expected.Reply || !bytes.Equal(m.Data, expected.Data) || m.Timestamp != expected.Timestamp {
+		t.Fatalf("expected message %v, got %v", expected, m)
+	}
+}
+
+func checkState(t *storeT, ms stores.MsgStore, count int, size uint64) {
+	n, b, err := ms.State()
+	if err != nil || n != count || b != size {
+		t.Fatalf("expected %v messages of %v bytes, got %v messages of %v bytes, err=%v", count, size, n, b, err)
+	}
+}
+
+func testNewChannel(t *storeT, s stores.Store) {
+	if s.HasChannel() || s.LookupChannel("foo") != nil {
+		t.Fatal("a new store should not have channels")
+	}
+	cs, isNew, err := s.CreateChannel("foo", "user data")
+	if err != nil || !isNew {
+		t.Fatalf("unexpected result creating channel: isNew=%v err=%v", isNew, err)
+	}
+	if cs.Msgs == nil || cs.Subs == nil {
+		t.Fatal("the message and subscription stores should be set")
+	}
+	if !s.HasChannel() {
+		t.Fatal("HasChannel should return true")
+	}
+	if lcs := s.LookupChannel("foo"); lcs != cs || lcs.UserData != "user data" {
+		t.Fatalf("unexpected channel looked up: %v", lcs)
+	}
+	if ncs, isNew, err := s.CreateChannel("foo", nil); err != nil || isNew || ncs != cs {
+		t.Fatalf("creating an existing channel should return it: isNew=%v err=%v", isNew, err)
+	}
+	if _, _, err := s.CreateChannel("bar", nil); err != nil {
+		t.Fatalf("error creating channel: %v", err)
+	}
+	if names := s.GetChannelNames(); len(names) != 2 {
+		t.Fatalf("unexpected channel names: %v", names)
+	}
+	storeMsg(t, s, "foo", []byte("hello"), nil)
+	infos, err := s.GetChannels()
+	if err != nil {
+		t.Fatalf("error getting channels: %v", err)
+	}
+	if len(infos) != 2 || infos[0].Name != "bar" || infos[1].Name != "foo" ||
+		infos[0].Msgs != 0 || infos[1].Msgs != 1 || infos[1].Bytes != 5 ||
+		infos[1].FirstSeq != 1 || infos[1].LastSeq != 1 {
+		t.Fatalf("unexpected channels: %v", infos)
+	}
+	if n, b, err := s.MsgsState("foo"); err != nil || n != 1 || b != 5 {
+		t.Fatalf("unexpected state of foo: %v, %v, %v", n, b, err)
+	}
+}
+
+func testMsgStore(t *storeT, s stores.Store) {
+	ms := createChannel(t, s, "foo").Msgs
+	if first, last := ms.FirstAndLastSequence(); first != 0 || last != 0 {
+		t.Fatalf("unexpected sequences of an empty store: %v, %v", first, last)
+	}
+	if m, err := ms.FirstMsg(); m != nil || err != nil {
+		t.Fatalf("unexpected first message of an empty store: %v, %v", m, err)
+	}
+	if m, err := ms.LastMsg(); m != nil || err != nil {
+		t.Fatalf("unexpected last message of an empty store: %v, %v", m, err)
+	}
+	checkState(t, ms, 0, 0)
+
+	m1 := storeMsg(t, s, "foo", []byte("m1"), nil)
+	m2, err := ms.Store("inbox", []byte("msg2"), nil)
+	if err != nil {
+		t.Fatalf("error storing message: %v", err)
+	}
+	if m1.Sequence != 1 || m2.Sequence != 2 || m1.Subject != "foo" || m2.Reply != "inbox" || m2.Timestamp < m1.Timestamp {
+		t.Fatalf("unexpected stored messages: %v, %v", m1, m2)
+	}
+	checkMsg(t, lookup(t, ms, 1), m1)
+	checkMsg(t, lookup(t, ms, 2), m2)
+	if m := lookup(t, ms, 3); m != nil {
+		t.Fatalf("unexpected message: %v", m)
+	}
+	if first, last := ms.FirstAndLastSequence(); first != 1 || last != 2 || ms.FirstSequence() != 1 || ms.LastSequence() != 2 {
+		t.Fatalf("unexpected sequences: %v, %v", first, last)
+	}
+	m, err := ms.FirstMsg()
+	if err != nil {
+		t.Fatalf("error getting first message: %v", err)
+	}
+	checkMsg(t, m, m1)
+	if m, err = ms.LastMsg(); err != nil {
+		t.Fatalf("error getting last message: %v", err)
+	}
+	checkMsg(t, m, m2)
+	checkState(t, ms, 2, 6)
+}
+
+func testMsgExt(t *storeT, s stores.Store) {
+	ext := &spb.MsgExt{Headers: []*spb.MsgHeader{{Key: "trace-id", Value: "abc"}}, Key: "k1"}
+	m1 := storeMsg(t, s, "foo", []byte("m1"), ext)
+	m2 := storeMsg(t, s, "foo", []byte("m2"), nil)
+	ms := s.LookupChannel("foo").Msgs
+	if e := ms.LookupExt(m1.Sequence); e == nil || len(e.Headers) != 1 || e.Headers[0].Value != "abc" || e.Key != "k1" {
+		t.Fatalf("unexpected attributes: %v", e)
+	}
+	if e := ms.LookupExt(m2.Sequence); e != nil {
+		t.Fatalf("unexpected attributes: %v", e)
+	}
+	// Attributes are not accounted in the size of the messages.
+	checkState(t, ms, 2, 4)
+	// Channels that are not compacted keep all messages, and don't look
+	// up messages by key.
+	if m, err := ms.LastMsgForKey("k1"); m != nil || err != nil {
+		t.Fatalf("unexpected last message for key: %v, %v", m, err)
+	}
+}
+
+func testKeyCompaction(t *storeT, s stores.Store) {
+	limits := defaultLimits
+	limits.CompactedChannels = []string{"prices.>"}
+	s.SetChannelLimits(limits)
+	k1, k2 := &spb.MsgExt{Key: "k1"}, &spb.MsgExt{Key: "k2"}
+	storeMsg(t, s, "prices.a", []byte("m1"), k1)
+	m2 := storeMsg(t, s, "prices.a", []byte("m2"), k2)
+	m3 := storeMsg(t, s, "prices.a", []byte("m3"), k1)
+	ms := s.LookupChannel("prices.a").Msgs
+	if m := lookup(t, ms, 1); m != nil {
+		t.Fatalf("message 1 should have been replaced by message 3, got %v", m)
+	}
+	checkState(t, ms, 2, 4)
+	for key, expected := range map[string]*pb.MsgProto{"k1": m3, "k2": m2} {
+		m, err := ms.LastMsgForKey(key)
+		if err != nil {
+			t.Fatalf("error getting last message for key: %v", err)
+		}
+		checkMsg(t, m, expected)
+	}
+	if m, err := ms.LastMsgForKey("k3"); m != nil || err != nil {
+		t.Fatalf("unexpected last message for unknown key: %v, %v", m, err)
+	}
+}
+
+func testStoreMsg(t *storeT, s stores.Store) {
+	ms := createChannel(t, s, "foo").Msgs
+	m1 := &pb.MsgProto{Sequence: 10, Subject: "foo", Data: []byte("hello"), Timestamp: 1000}
+	if err := ms.StoreMsg(m1, nil); err != nil {
+		t.Fatalf("error storing message: %v", err)
+	}
+	if err := ms.StoreMsg(&pb.MsgProto{Sequence: 10, Subject: "foo", Timestamp: 2000}, nil); err != stores.ErrSeqOutOfOrder {
+		t.Fatalf("expected error %v, got %v", stores.ErrSeqOutOfOrder, err)
+	}
+	checkMsg(t, lookup(t, ms, 10), m1)
+	if m := storeMsg(t, s, "foo", []byte("next"), nil); m.Sequence != 11 {
+		t.Fatalf("expected sequence 11, got %v", m.Sequence)
+	}
+}
+
+func testStoreBatch(t *storeT, s stores.Store) {
+	storeMsg(t, s, "foo", []byte("first"), nil)
+	ms := s.LookupChannel("foo").Msgs
+	stored, err := ms.StoreBatch([]*stores.BatchMsg{{Data: []byte("m1")}, {Reply: "inbox", Data: []byte("m2")}})
+	if err != nil {
+		t.Fatalf("error storing batch: %v", err)
+	}
+	if len(stored) != 2 || stored[0].Sequence != 2 || stored[1].Sequence != 3 || stored[1].Reply != "inbox" {
+		t.Fatalf("unexpected stored messages: %v", stored)
+	}
+	for _, m := range stored {
+		checkMsg(t, lookup(t, ms, m.Sequence), m)
+	}
+	checkState(t, ms, 3, 9)
+}
+
+func testLookupRange(t *storeT, s stores.Store) {
+	ms := createChannel(t, s, "foo").Msgs
+	if msgs, err := ms.LookupRange(1, 10, 0); len(msgs) != 0 || err != nil {
+		t.Fatalf("unexpected messages of an empty store: %v, %v", msgs, err)
+	}
+	var stored []*pb.MsgProto
+	for i := 0; i < 5; i++ {
+		stored = append(stored, storeMsg(t, s, "foo", []byte("msg"), nil))
+	}
+	for _, c := range []struct {
+		first, last uint64
+		max         int
+		expected    []*pb.MsgProto
+	}{
+		{0, 100, 0, stored},
+		{2, 4, 0, stored[1:4]},
+		{2, 100, 2, stored[1:3]},
+		{4, 2, 0, nil},
+		{6, 10, 0, nil},
+	} {
+		msgs, err := ms.LookupRange(c.first, c.last, c.max)
+		if err != nil {
+			t.Fatalf("error looking up range %v-%v: %v", c.first, c.last, err)
+		}
+		if len(msgs) != len(c.expected) {
+			t.Fatalf("expected %v messages for range %v-%v, got %v", len(c.expected), c.first, c.last, len(msgs))
+		}
+		for i, m := range msgs {
+			checkMsg(t, m, c.expected[i])
+		}
+	}
+
+	// Removed messages are skipped.
+	limits := defaultLimits
+	limits.CompactedChannels = []string{"prices.>"}
+	s.SetChannelLimits(limits)
+	k1 := &spb.MsgExt{Key: "k1"}
+	storeMsg(t, s, "prices.a", []byte("m1"), k1)
+	m2 := storeMsg(t, s, "prices.a", []byte("m2"), nil)
+	m3 := storeMsg(t, s, "prices.a", []byte("m3"), k1)
+	msgs, err := s.LookupChannel("prices.a").Msgs.LookupRange(1, 3, 0)
+	if err != nil || len(msgs) != 2 {
+		t.Fatalf("unexpected messages: %v, %v", msgs, err)
+	}
+	checkMsg(t, msgs[0], m2)
+	checkMsg(t, msgs[1], m3)
+}
+
+func testSequenceFromTimestamp(t *storeT, s stores.Store) {
+	ms := createChannel(t, s, "foo").Msgs
+	if seq := ms.GetSequenceFromTimestamp(0); seq != 0 && seq != 1 {
+		t.Fatalf("unexpected sequence of an empty store: %v", seq)
+	}
+	for seq := uint64(1); seq <= 100; seq++ {
+		if err := ms.StoreMsg(&pb.MsgProto{Sequence: seq, Subject: "foo", Timestamp: int64(seq) * 10}, nil); err != nil {
+			t.Fatalf("error storing message: %v", err)
+		}
+	}
+	for _, c := range []struct {
+		ts  int64
+		seq uint64
+	}{{0, 1}, {10, 1}, {15, 2}, {500, 50}, {1000, 100}} {
+		if seq := ms.GetSequenceFromTimestamp(c.ts); seq != c.seq {
+			t.Fatalf("expected sequence %v for timestamp %v, got %v", c.seq, c.ts, seq)
+		}
+	}
+}
+
+func testMaxMsgs(t *storeT, s stores.Store) {
+	limits := defaultLimits
+	limits.MaxNumMsgs = 10
+	limits.MaxMsgBytes = 1000
+	s.SetChannelLimits(limits)
+	for i := 0; i < 15; i++ {
+		storeMsg(t, s, "foo", []byte("hello"), nil)
+	}
+	ms := s.LookupChannel("foo").Msgs
+	checkState(t, ms, 10, 50)
+	if first, last := ms.FirstAndLastSequence(); first != 6 || last != 15 {
+		t.Fatalf("unexpected sequences: %v, %v", first, last)
+	}
+	if m := lookup(t, ms, 5); m != nil {
+		t.Fatalf("message 5 should have been removed, got %v", m)
+	}
+	// Messages are removed to stay under the bytes limit, but the last
+	// message is kept even if it is bigger than the limit.
+	storeMsg(t, s, "bar", make([]byte, 600), nil)
+	storeMsg(t, s, "bar", make([]byte, 600), nil)
+	checkState(t, s.LookupChannel("bar").Msgs, 1, 600)
+	storeMsg(t, s, "bar", make([]byte, 2000), nil)
+	checkState(t, s.LookupChannel("bar").Msgs, 1, 2000)
+}
+
+func testMaxChannels(t *storeT, s stores.Store) {
+	limits := defaultLimits
+	limits.MaxChannels = 3
+	s.SetChannelLimits(limits)
+	for i := 0; i < 3; i++ {
+		createChannel(t, s, fmt.Sprintf("foo.%d", i))
+	}
+	if _, _, err := s.CreateChannel("foo.3", nil); err != stores.ErrTooManyChannels {
+		t.Fatalf("expected error %v, got %v", stores.ErrTooManyChannels, err)
+	}
+}
+
+func testMaxSubs(t *storeT, s stores.Store) {
+	limits := defaultLimits
+	limits.MaxSubs = 3
+	s.SetChannelLimits(limits)
+	ss := createChannel(t, s, "foo").Subs
+	var ids []uint64
+	for i := 0; i < 3; i++ {
+		sub := &spb.SubState{ClientID: "me"}
+		if err := ss.CreateSub(sub); err != nil {
+			t.Fatalf("error creating subscription: %v", err)
+		}
+		ids = append(ids, sub.ID)
+	}
+	if err := ss.CreateSub(&spb.SubState{ClientID: "me"}); err != stores.ErrTooManySubs {
+		t.Fatalf("expected error %v, got %v", stores.ErrTooManySubs, err)
+	}
+	// Deleting a subscription makes room for another one.
+	ss.DeleteSub(ids[0])
+	if err := ss.CreateSub(&spb.SubState{ClientID: "me"}); err != nil {
+		t.Fatalf("error creating subscription: %v", err)
+	}
+}
+
+func testSubStore(t *storeT, s stores.Store) {
+	ss := createChannel(t, s, "foo").Subs
+	sub1 := &spb.SubState{ClientID: "me", Inbox: "inbox1", AckInbox: "ack1", AckWaitInSecs: 30}
+	sub2 := &spb.SubState{ClientID: "me", Inbox: "inbox2", AckInbox: "ack2", AckWaitInSecs: 30}
+	if err := ss.CreateSub(sub1); err != nil {
+		t.Fatalf("error creating subscription: %v", err)
+	}
+	if err := ss.CreateSub(sub2); err != nil {
+		t.Fatalf("error creating subscription: %v", err)
+	}
+	if sub1.ID == 0 || sub2.ID == 0 || sub1.ID == sub2.ID {
+		t.Fatalf("subscriptions should get distinct non zero IDs: %v, %v", sub1.ID, sub2.ID)
+	}
+	sub1.AckInbox = "newAck1"
+	if err := ss.UpdateSub(sub1); err != nil {
+		t.Fatalf("error updating subscription: %v", err)
+	}
+	for seq := uint64(1); seq <= 5; seq++ {
+		if err := ss.AddSeqPending(sub1.ID, seq); err != nil {
+			t.Fatalf("error adding pending message: %v", err)
+		}
+	}
+	if err := ss.AckSeqPending(sub1.ID, 1); err != nil {
+		t.Fatalf("error acknowledging message: %v", err)
+	}
+	if err := ss.AckSeqPendingRange(sub1.ID, 2, 3); err != nil {
+		t.Fatalf("error acknowledging messages: %v", err)
+	}
+	if err := ss.AckSeqPendingBatch(sub1.ID, 5); err != nil {
+		t.Fatalf("error acknowledging messages: %v", err)
+	}
+	// Updates of unknown or deleted subscriptions are not errors.
+	ss.DeleteSub(sub2.ID)
+	if err := ss.AddSeqPending(sub2.ID, 1); err != nil {
+		t.Fatalf("unexpected error adding pending message to a deleted subscription: %v", err)
+	}
+	if err := ss.AckSeqPending(sub2.ID+100, 1); err != nil {
+		t.Fatalf("unexpected error acknowledging message of an unknown subscription: %v", err)
+	}
+}
+
+func testClients(t *storeT, s stores.Store) {
+	if s.DeleteClient("unknown") != nil {
+		t.Fatal("deleting an unknown client should return nil")
+	}
+	c, isNew, err := s.AddClient("c1", "hb1", "user data")
+	if err != nil || !isNew || c.ID != "c1" || c.HbInbox != "hb1" || c.UserData != "user data" {
+		t.Fatalf("unexpected result adding client: %v, %v, %v", c, isNew, err)
+	}
+	if c2, isNew, err := s.AddClient("c1", "hb2", nil); err != nil || isNew || c2 != c {
+		t.Fatalf("adding an existing client should return it: %v, %v, %v", c2, isNew, err)
+	}
+	if _, _, err := s.AddClient("c2", "hb2", nil); err != nil {
+		t.Fatalf("error adding client: %v", err)
+	}
+	if s.GetClient("c1") != c || s.GetClientsCount() != 2 || len(s.GetClients()) != 2 {
+		t.Fatalf("unexpected clients: %v", s.GetClients())
+	}
+	if err := s.SetClientUnreachable("c1", 123); err != nil {
+		t.Fatalf("error setting client unreachable: %v", err)
+	}
+	if err := s.SetClientUnreachable("unknown", 123); err == nil {
+		t.Fatal("expected error setting an unknown client unreachable")
+	}
+	if c := s.GetClient("c1"); c.UnreachableSince != 123 {
+		t.Fatalf("unexpected unreachable time: %v", c.UnreachableSince)
+	}
+	if c.LastContact == 0 {
+		t.Fatal("last contact should be set when the client is added")
+	}
+	if err := s.SetClientLastContact("c1", 456); err != nil {
+		t.Fatalf("error setting client last contact: %v", err)
+	}
+	if err := s.SetClientLastContact("unknown", 456); err == nil {
+		t.Fatal("expected error setting the last contact of an unknown client")
+	}
+	if c := s.GetClient("c1"); c.LastContact != 456 {
+		t.Fatalf("unexpected last contact: %v", c.LastContact)
+	}
+	if c, err := s.UpdateClient("c1", "newHb", []byte("metadata")); err != nil || c.HbInbox != "newHb" || string(c.Metadata) != "metadata" {
+		t.Fatalf("unexpected result updating client: %v, %v", c, err)
+	}
+	if _, err := s.UpdateClient("unknown", "hb", nil); err == nil {
+		t.Fatal("expected error updating an unknown client")
+	}
+	if dc := s.DeleteClient("c2"); dc == nil || dc.ID != "c2" {
+		t.Fatalf("unexpected deleted client: %v", dc)
+	}
+	if s.GetClient("c2") != nil || s.GetClientsCount() != 1 {
+		t.Fatal("client c2 should have been deleted")
+	}
+}
+
+func testFlush(t *storeT, s stores.Store) {
+	cs := createChannel(t, s, "foo")
+	storeMsg(t, s, "foo", []byte("hello"), nil)
+	sub := &spb.SubState{ClientID: "me"}
+	if err := cs.Subs.CreateSub(sub); err != nil {
+		t.Fatalf("error creating subscription: %v", err)
+	}
+	if err := cs.Subs.AddSeqPending(sub.ID, 1); err != nil {
+		t.Fatalf("error adding pending message: %v", err)
+	}
+	if err := cs.Flush(); err != nil {
+		t.Fatalf("error flushing channel: %v", err)
+	}
+	if err := s.Flush(); err != nil {
+		t.Fatalf("error flushing store: %v", err)
+	}
+}
+
+// testConcurrentMsgs stores messages from several go routines, on the same
+// and on distinct channels, and checks that no sequence is lost or
+// assigned twice.
+func testConcurrentMsgs(t *storeT, s stores.Store) {
+	const routines, count = 8, 100
+	shared := createChannel(t, s, "shared").Msgs
+	for i := 0; i < routines; i++ {
+		createChannel(t, s, fmt.Sprintf("own.%d", i))
+	}
+	var wg sync.WaitGroup
+	errs := make(chan error, 2*routines)
+	for i := 0; i < routines; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			own := s.LookupChannel(fmt.Sprintf("own.%d", i)).Msgs
+			for j := 0; j < count; j++ {
+				if _, err := shared.Store("", []byte("hello"), nil); err != nil {
+					errs <- err
+					return
+				}
+				if _, err := own.Store("", []byte("hello"), nil); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatalf("error storing message: %v", err)
+	}
+	checkState(t, shared, routines*count, routines*count*5)
+	if first, last := shared.FirstAndLastSequence(); first != 1 || last != routines*count {
+		t.Fatalf("unexpected sequences: %v, %v", first, last)
+	}
+	for seq := uint64(1); seq <= routines*count; seq++ {
+		if m := lookup(t, shared, seq); m == nil || m.Sequence != seq {
+			t.Fatalf("unexpected message %v: %v", seq, m)
+		}
+	}
+	for i := 0; i < routines; i++ {
+		checkState(t, s.LookupChannel(fmt.Sprintf("own.%d", i)).Msgs, count, count*5)
+	}
+}
+
+// testConcurrentSubs creates subscriptions and updates their pending
+// messages from several go routines.
+func testConcurrentSubs(t *storeT, s stores.Store) {
+	const routines, count = 8, 100
+	ss := createChannel(t, s, "foo").Subs
+	var wg sync.WaitGroup
+	ids := make(chan uint64, routines)
+	errs := make(chan error, routines)
+	for i := 0; i < routines; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sub := &spb.SubState{ClientID: "me"}
+			if err := ss.CreateSub(sub); err != nil {
+				errs <- err
+				return
+			}
+			ids <- sub.ID
+			for seq := uint64(1); seq <= count; seq++ {
+				if err := ss.AddSeqPending(sub.ID, seq); err != nil {
+					errs <- err
+					return
+				}
+				if err := ss.AckSeqPending(sub.ID, seq); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	close(ids)
+	for err := range errs {
+		t.Fatalf("error updating subscription: %v", err)
+	}
+	seen := make(map[uint64]bool)
+	for id := range ids {
+		if seen[id] {
+			t.Fatalf("subscription ID %v assigned twice", id)
+		}
+		seen[id] = true
+	}
+}
+
+// testRecovery checks that the server info, clients, messages and
+// subscriptions, with their pending messages, are recovered.
+func testRecovery(t *storeT, s stores.Store) {
+	if _, _, err := s.AddClient("c1", "hb1", nil); err != nil {
+		t.Fatalf("error adding client: %v", err)
+	}
+	if _, _, err := s.AddClient("c2", "hb2", nil); err != nil {
+		t.Fatalf("error adding client: %v", err)
+	}
+	s.DeleteClient("c2")
+	var msgs []*pb.MsgProto
+	for i := 0; i < 5; i++ {
+		msgs = append(msgs, storeMsg(t, s, "foo", []byte(fmt.Sprintf("msg%d", i)), nil))
+	}
+	ss := s.LookupChannel("foo").Subs
+	sub := &spb.SubState{ClientID: "c1", Inbox: "inbox", AckInbox: "ack", AckWaitInSecs: 30}
+	if err := ss.CreateSub(sub); err != nil {
+		t.Fatalf("error creating subscription: %v", err)
+	}
+	deleted := &spb.SubState{ClientID: "c1"}
+	if err := ss.CreateSub(deleted); err != nil {
+		t.Fatalf("error creating subscription: %v", err)
+	}
+	ss.DeleteSub(deleted.ID)
+	for _, m := range msgs {
+		if err := ss.AddSeqPending(sub.ID, m.Sequence); err != nil {
+			t.Fatalf("error adding pending message: %v", err)
+		}
+	}
+	if err := ss.AckSeqPendingRange(sub.ID, 1, 2); err != nil {
+		t.Fatalf("error acknowledging messages: %v", err)
+	}
+	if err := s.Flush(); err != nil {
+		t.Fatalf("error flushing store: %v", err)
+	}
+
+	rs, state := t.reopen(s)
+	if state == nil {
+		return
+	}
+	if state.Info == nil || state.Info.ClusterID != serverInfo.ClusterID {
+		t.Fatalf("unexpected recovered server info: %v", state.Info)
+	}
+	if len(state.Clients) != 1 || state.Clients[0].ID != "c1" || state.Clients[0].HbInbox != "hb1" {
+		t.Fatalf("unexpected recovered clients: %v", state.Clients)
+	}
+	cs := rs.LookupChannel("foo")
+	if cs == nil {
+		t.Fatal("channel foo should have been recovered")
+	}
+	for _, m := range msgs {
+		checkMsg(t, lookup(t, cs.Msgs, m.Sequence), m)
+	}
+	var recovered []*stores.RecoveredSubState
+	if err := state.Recover(func(channel string, rss *stores.RecoveredSubState) error {
+		if channel != "foo" {
+			return fmt.Errorf("unexpected channel %q", channel)
+		}
+		recovered = append(recovered, rss)
+		return nil
+	}); err != nil {
+		t.Fatalf("error recovering subscriptions: %v", err)
+	}
+	if len(recovered) != 1 || recovered[0].Sub.ID != sub.ID || recovered[0].Sub.Inbox != "inbox" {
+		t.Fatalf("unexpected recovered subscriptions: %v", recovered)
+	}
+	pending := recovered[0].Pending
+	if len(pending) != 3 {
+		t.Fatalf("expected 3 pending messages, got %v", pending)
+	}
+	for _, m := range msgs[2:] {
+		checkMsg(t, pending[m.Sequence], m)
+	}
+	// New messages and subscriptions follow the recovered ones.
+	if m := storeMsg(t, rs, "foo", []byte("next"), nil); m.Sequence != 6 {
+		t.Fatalf("expected sequence 6, got %v", m.Sequence)
+	}
+	newSub := &spb.SubState{ClientID: "c1"}
+	if err := cs.Subs.CreateSub(newSub); err != nil {
+		t.Fatalf("error creating subscription: %v", err)
+	}
+	if newSub.ID == sub.ID {
+		t.Fatalf("subscription ID %v assigned twice", newSub.ID)
+	}
+}
+
+func testCloseIdempotent(t *storeT, s stores.Store) {
+	cs := createChannel(t, s, "foo")
+	for i := 0; i < 2; i++ {
+		if err := cs.Msgs.Close(); err != nil {
+			t.Fatalf("error closing message store: %v", err)
+		}
+		if err := cs.Subs.Close(); err != nil {
+			t.Fatalf("error closing subscription store: %v", err)
+		}
+		if err := s.Close(); err != nil {
+			t.Fatalf("error closing store: %v", err)
+		}
+	}
+}
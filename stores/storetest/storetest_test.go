@@ -0,0 +1,31 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package storetest
+
+import (
+	"testing"
+
+	"github.com/nats-io/nats-streaming-server/stores"
+)
+
+func TestMemoryStore(t *testing.T) {
+	RunStoreTests(t, func(config *stores.StoreConfig) (stores.Store, *stores.RecoveredState, error) {
+		s, err := stores.NewMemoryStore(config.Limits)
+		return s, nil, err
+	})
+}
+
+func TestFileStore(t *testing.T) {
+	RunStoreTests(t, func(config *stores.StoreConfig) (stores.Store, *stores.RecoveredState, error) {
+		return stores.NewFileStore(config.Dir, config.Limits)
+	})
+}
+
+func TestRegisteredStores(t *testing.T) {
+	for _, storeType := range stores.RegisteredTypes() {
+		storeType := storeType
+		RunStoreTests(t, func(config *stores.StoreConfig) (stores.Store, *stores.RecoveredState, error) {
+			return stores.NewStore(storeType, config)
+		})
+	}
+}
@@ -0,0 +1,456 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package stores
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/nats-io/go-nats-streaming/pb"
+	"github.com/nats-io/nats-streaming-server/spb"
+)
+
+// Name of the file listing the message files of a channel that have been
+// offloaded to the tier.
+const tierIndexFileName = "msgs.tier"
+
+// Tier is an object storage (such as S3, GCS or MinIO) to which the file
+// store offloads the message files older than FileStoreOptions.TierAge.
+// Objects are written once and never modified. Names are slash separated
+// paths, starting with the channel directory name.
+type Tier interface {
+	// Put stores the content of `r` under the given name.
+	Put(name string, r io.Reader) error
+
+	// Get returns the content stored under the given name.
+	Get(name string) (io.ReadCloser, error)
+
+	// Delete removes the content stored under the given name.
+	Delete(name string) error
+}
+
+// DirTier is a Tier storing objects as files in a directory. This can be
+// used with an object storage bucket mounted in the file system.
+type DirTier struct {
+	dir string
+}
+
+// NewDirTier returns a Tier storing objects in the directory `dir`.
+func NewDirTier(dir string) *DirTier {
+	return &DirTier{dir: dir}
+}
+
+// Put implements Tier. The object is written in a temporary file that is
+// then renamed, so that a partially written object is never visible.
+func (t *DirTier) Put(name string, r io.Reader) error {
+	fileName := filepath.Join(t.dir, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(fileName), os.ModeDir+os.ModePerm); err != nil {
+		return err
+	}
+	tmpFile, err := ioutil.TempFile(filepath.Dir(fileName), filepath.Base(fileName))
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(tmpFile, r)
+	if err == nil {
+		err = tmpFile.Sync()
+	}
+	if lerr := tmpFile.Close(); lerr != nil && err == nil {
+		err = lerr
+	}
+	if err == nil {
+		err = os.Rename(tmpFile.Name(), fileName)
+	}
+	if err != nil {
+		os.Remove(tmpFile.Name())
+	}
+	return err
+}
+
+// Get implements Tier.
+func (t *DirTier) Get(name string) (io.ReadCloser, error) {
+	return os.Open(filepath.Join(t.dir, filepath.FromSlash(name)))
+}
+
+// Delete implements Tier.
+func (t *DirTier) Delete(name string) error {
+	return os.Remove(filepath.Join(t.dir, filepath.FromSlash(name)))
+}
+
+// tieredSlice is the range of sequences of a message file offloaded to
+// the tier, with what is needed to apply the limits of the channel to its
+// messages. It is also the record written in the tier index file.
+type tieredSlice struct {
+	first      uint64
+	last       uint64
+	msgs       uint64 // number of messages
+	bytes      uint64 // size of their payloads
+	expiration int64  // time at which all the messages have expired, 0 if some never expire
+}
+
+func (r *tieredSlice) Size() int {
+	var buf [binary.MaxVarintLen64]byte
+	return binary.PutUvarint(buf[:], r.first) + binary.PutUvarint(buf[:], r.last) +
+		binary.PutUvarint(buf[:], r.msgs) + binary.PutUvarint(buf[:], r.bytes) +
+		binary.PutVarint(buf[:], r.expiration)
+}
+
+func (r *tieredSlice) MarshalTo(buf []byte) (int, error) {
+	n := binary.PutUvarint(buf, r.first)
+	n += binary.PutUvarint(buf[n:], r.last)
+	n += binary.PutUvarint(buf[n:], r.msgs)
+	n += binary.PutUvarint(buf[n:], r.bytes)
+	n += binary.PutVarint(buf[n:], r.expiration)
+	return n, nil
+}
+
+func (r *tieredSlice) unmarshal(buf []byte) error {
+	for _, v := range []*uint64{&r.first, &r.last, &r.msgs, &r.bytes} {
+		var n int
+		if *v, n = binary.Uvarint(buf); n <= 0 {
+			return fmt.Errorf("invalid tiered slice record")
+		}
+		buf = buf[n:]
+	}
+	var n int
+	if r.expiration, n = binary.Varint(buf); n <= 0 {
+		return fmt.Errorf("invalid tiered slice record")
+	}
+	return nil
+}
+
+// tierCache holds the messages of the last slice fetched from the tier,
+// so that a subscription catching up does not fetch it for each message.
+type tierCache struct {
+	slice tieredSlice
+	msgs  map[uint64]*pb.MsgProto
+	exts  map[uint64]*spb.MsgExt
+	size  int64 // memory accounted in the budget of the store
+}
+
+// recoverTierIndex reads the list of slices offloaded to the tier.
+// Slices that are also present locally, which happens if the server
+// stopped before removing the local file, are ignored.
+func (ms *FileMsgStore) recoverTierIndex() error {
+	if _, err := os.Stat(ms.tierFile); os.IsNotExist(err) {
+		return nil
+	}
+	file, err := openFile(ms.tierFile, os.O_RDONLY)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	br := bufio.NewReader(file)
+	var buf []byte
+	for {
+		var size int
+		buf, size, _, err = readRecord(br, buf, false, ms.crcTable, ms.opts.DoCRC)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		slice := tieredSlice{}
+		if err := slice.unmarshal(buf[:size]); err != nil {
+			return err
+		}
+		if ms.first == 0 || slice.last < ms.first {
+			ms.tiered = append(ms.tiered, slice)
+			ms.tieredCount += int(slice.msgs)
+			ms.tieredBytes += slice.bytes
+		}
+	}
+	return nil
+}
+
+// writeTierIndex replaces the tier index file with the given slices. The
+// index is written in a temporary file that is then renamed, so that it is
+// never partially written.
+// Lock is held on entry.
+func (ms *FileMsgStore) writeTierIndex(slices []tieredSlice) error {
+	index, err := getTempFile(filepath.Dir(ms.tierFile), tierIndexFileName)
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(index)
+	var buf []byte
+	for i := 0; i < len(slices) && err == nil; i++ {
+		buf, _, err = writeRecord(bw, buf, recNoType, &slices[i], ms.crcTable)
+	}
+	if err == nil {
+		err = bw.Flush()
+	}
+	if err == nil && ms.opts.DoSync {
+		err = index.Sync()
+	}
+	if lerr := index.Close(); lerr != nil && err == nil {
+		err = lerr
+	}
+	if err == nil {
+		err = os.Rename(index.Name(), ms.tierFile)
+	}
+	if err != nil {
+		os.Remove(index.Name())
+	}
+	return err
+}
+
+// enforceTierLimits removes the oldest files offloaded to the tier whose
+// messages are all beyond the limits of the channel, or have all expired.
+// The tier holds the oldest messages of the channel, so they are removed
+// before the local ones. Objects are removed a file at a time, so the
+// channel may keep up to a file slice of messages beyond its limits.
+// Lock is held on entry.
+func (ms *FileMsgStore) enforceTierLimits(now int64) error {
+	count, bytes := ms.totalCount+ms.tieredCount, ms.totalBytes+ms.tieredBytes
+	n := 0
+	for ; n < len(ms.tiered); n++ {
+		slice := ms.tiered[n]
+		expired := slice.expiration > 0 && slice.expiration <= now
+		if !expired && count-int(slice.msgs) < ms.limits.MaxNumMsgs &&
+			bytes-slice.bytes < ms.limits.MaxMsgBytes {
+			break
+		}
+		count -= int(slice.msgs)
+		bytes -= slice.bytes
+	}
+	if n == 0 {
+		return nil
+	}
+	// The index is updated first, so that a file that could not be
+	// removed from the tier is no longer referenced.
+	if err := ms.writeTierIndex(ms.tiered[n:]); err != nil {
+		return err
+	}
+	removed := ms.tiered[:n]
+	// Readers may hold the previous list.
+	ms.tiered = append([]tieredSlice(nil), ms.tiered[n:]...)
+	ms.tieredCount, ms.tieredBytes = count-ms.totalCount, bytes-ms.totalBytes
+	for _, slice := range removed {
+		if err := ms.opts.Tier.Delete(ms.tierName(slice)); err != nil {
+			Noticef("Unable to remove messages %d to %d of channel=%s from the tier: %v",
+				slice.first, slice.last, ms.subject, err)
+		}
+	}
+	Noticef("Removed messages %d to %d of channel=%s from the tier",
+		removed[0].first, removed[n-1].last, ms.subject)
+	return nil
+}
+
+// tierName returns the name, in the tier, of the given slice.
+func (ms *FileMsgStore) tierName(slice tieredSlice) string {
+	return fmt.Sprintf("%s/msgs.%d-%d.dat", ms.tierDir, slice.first, slice.last)
+}
+
+// offloadSlices offloads the first file slices whose last message is older
+// than TierAge. The current slice is never offloaded.
+// Lock is held on entry.
+func (ms *FileMsgStore) offloadSlices(now int64) error {
+	if ms.opts.Tier == nil || ms.opts.TierAge <= 0 || !ms.opts.inMaintenanceWindow() {
+		return nil
+	}
+	maxTime := now - int64(time.Duration(ms.opts.TierAge)*time.Second)
+	for ms.currSliceIdx > 0 {
+		slice := ms.files[0]
+		if slice.msgsCount > 0 && slice.lastMsg.Timestamp > maxTime {
+			return nil
+		}
+		// Records of messages removed by key compaction are not offloaded.
+		if slice.rmCount > 0 && slice.msgsCount > 0 {
+			if err := ms.compactSlice(0); err != nil {
+				return err
+			}
+		}
+		if slice.msgsCount > 0 {
+			if err := ms.offloadSlice(slice); err != nil {
+				return err
+			}
+		}
+		if err := ms.removeAndShiftFiles(); err != nil {
+			return err
+		}
+		ms.currSliceIdx--
+	}
+	return nil
+}
+
+// offloadSlice uploads the file of the given slice to the tier and records
+// it in the tier index. The local file is not removed.
+// Lock is held on entry.
+func (ms *FileMsgStore) offloadSlice(slice *fileSlice) error {
+	tiered := tieredSlice{
+		first: slice.firstMsg.Sequence,
+		last:  slice.lastMsg.Sequence,
+		msgs:  uint64(slice.msgsCount),
+		bytes: slice.msgsSize,
+	}
+	for seq := tiered.first; seq <= tiered.last; seq++ {
+		if ms.msgs[seq] == nil {
+			continue
+		}
+		ext := ms.exts[seq]
+		if ext == nil || ext.Expiration == 0 {
+			tiered.expiration = 0
+			break
+		}
+		if ext.Expiration > tiered.expiration {
+			tiered.expiration = ext.Expiration
+		}
+	}
+	file, err := openFile(slice.fileName, os.O_RDONLY)
+	if err != nil {
+		return err
+	}
+	// The file version has been read, so the object contains only records.
+	err = ms.opts.Tier.Put(ms.tierName(tiered), file)
+	file.Close()
+	if err != nil {
+		return fmt.Errorf("unable to offload %s: %v", slice.fileName, err)
+	}
+	index, err := openFile(ms.tierFile)
+	if err != nil {
+		return err
+	}
+	if _, _, err = writeRecord(index, nil, recNoType, &tiered, ms.crcTable); err == nil && ms.opts.DoSync {
+		err = index.Sync()
+	}
+	if lerr := index.Close(); lerr != nil && err == nil {
+		err = lerr
+	}
+	if err != nil {
+		return err
+	}
+	ms.tiered = append(ms.tiered, tiered)
+	ms.tieredCount += int(tiered.msgs)
+	ms.tieredBytes += tiered.bytes
+	Noticef("Offloaded messages %d to %d of channel=%s", tiered.first, tiered.last, ms.subject)
+	return nil
+}
+
+// lookupTiered returns the message with given sequence, and its attributes,
+// if it belongs to a slice offloaded to the tier, or the error that
+// prevented the slice from being fetched.
+func (ms *FileMsgStore) lookupTiered(seq uint64) (*pb.MsgProto, *spb.MsgExt, error) {
+	ms.RLock()
+	idx := sort.Search(len(ms.tiered), func(i int) bool { return ms.tiered[i].last >= seq })
+	var slice tieredSlice
+	found := idx < len(ms.tiered) && ms.tiered[idx].first <= seq
+	if found {
+		slice = ms.tiered[idx]
+	}
+	ms.RUnlock()
+	if !found {
+		return nil, nil, nil
+	}
+	// The fetch is done without holding the store lock, so that the
+	// channel is not blocked while the slice is downloaded.
+	ms.tierLock.Lock()
+	defer ms.tierLock.Unlock()
+	cache := ms.tierCache
+	if cache == nil || cache.slice != slice {
+		var err error
+		if cache, err = ms.fetchTiered(slice); err != nil {
+			Noticef("Unable to fetch messages %d to %d of channel=%s: %v", slice.first, slice.last, ms.subject, err)
+			return nil, nil, err
+		}
+		ms.retainTierCache(cache)
+	}
+	return cache.msgs[seq], cache.exts[seq], nil
+}
+
+// tieredSequenceFromTimestamp returns the sequence of the first message
+// offloaded to the tier whose timestamp is greater or equal to the given
+// timestamp, 0 if there is none or if the tier can't be read. The slices
+// are searched with a binary search, so only a few of them are fetched.
+func (ms *FileMsgStore) tieredSequenceFromTimestamp(timestamp int64) uint64 {
+	ms.RLock()
+	tiered := ms.tiered
+	ms.RUnlock()
+
+	var err error
+	i := sort.Search(len(tiered), func(i int) bool {
+		// Messages removed by key compaction leave gaps, so the last
+		// message of the slice is the last one found.
+		for seq := tiered[i].last; seq >= tiered[i].first && err == nil; seq-- {
+			var m *pb.MsgProto
+			if m, _, err = ms.lookupTiered(seq); m != nil {
+				return m.Timestamp >= timestamp
+			}
+		}
+		return false
+	})
+	if i == len(tiered) {
+		return 0
+	}
+	for seq := tiered[i].first; seq <= tiered[i].last && err == nil; seq++ {
+		var m *pb.MsgProto
+		if m, _, err = ms.lookupTiered(seq); m != nil && m.Timestamp >= timestamp {
+			return seq
+		}
+	}
+	return 0
+}
+
+// retainTierCache replaces the messages of the last slice fetched with
+// `cache`, unless the memory budget is exceeded, in which case the previous
+// ones are released and the new ones are not kept.
+// Tier lock is held on entry.
+func (ms *FileMsgStore) retainTierCache(cache *tierCache) {
+	if ms.tierCache != nil {
+		ms.budget.add(-ms.tierCache.size)
+		ms.tierCache = nil
+	}
+	if ms.budget.Exceeded() {
+		return
+	}
+	ms.budget.add(cache.size)
+	ms.tierCache = cache
+}
+
+// fetchTiered reads the messages of the given slice from the tier.
+func (ms *FileMsgStore) fetchTiered(slice tieredSlice) (*tierCache, error) {
+	r, err := ms.opts.Tier.Get(ms.tierName(slice))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	cache := &tierCache{
+		slice: slice,
+		msgs:  make(map[uint64]*pb.MsgProto),
+		exts:  make(map[uint64]*spb.MsgExt),
+	}
+	br := bufio.NewReader(r)
+	var buf []byte
+	for {
+		var size int
+		buf, size, _, err = readRecord(br, buf, false, ms.crcTable, ms.opts.DoCRC)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		msg := &pb.MsgProto{}
+		if err := msg.Unmarshal(buf[:size]); err != nil {
+			return nil, ErrCorruptedData
+		}
+		ext := &spb.MsgExt{}
+		if err := ext.Unmarshal(buf[:size]); err != nil {
+			return nil, ErrCorruptedData
+		}
+		cache.msgs[msg.Sequence] = msg
+		if ext.Size() > 0 {
+			cache.exts[msg.Sequence] = ext
+		} else {
+			ext = nil
+		}
+		cache.size += msgMemSize(msg, ext)
+	}
+	return cache, nil
+}
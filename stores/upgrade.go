@@ -0,0 +1,147 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package stores
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/nats-io/nats-streaming-server/util"
+)
+
+// fileUpgrade rewrites the content of a store file, read from `r` after its
+// version record, in the format of the next version to `w`. The name of the
+// file (for instance "subs.dat") tells its kind.
+type fileUpgrade func(name string, r io.Reader, w io.Writer) error
+
+// fileUpgrades are the upgrades of the store files, indexed by the version
+// they upgrade from. A change of the format of any file must increment
+// fileVersion and register here the upgrade from the previous version, so
+// that the existing stores can still be opened.
+var fileUpgrades = map[int]fileUpgrade{}
+
+// isVersionedFile returns true if the file, found in the root directory of
+// a file store, starts with a version record.
+func isVersionedFile(name string) bool {
+	base := filepath.Base(name)
+	return strings.HasSuffix(base, ".dat") || base == msgsStateFileName || base == tierIndexFileName
+}
+
+// upgradeFiles checks the version of the files of the store located in
+// `rootDir`. If some were written in an older version, they are upgraded to
+// `version` if `upgrade` is true, otherwise ErrUpgradeRequired is returned.
+// Each file is upgraded one version at a time, by rewriting it to a
+// temporary file that then replaces it, so that an interrupted upgrade
+// resumes where it stopped. The files offloaded to a tier are not upgraded.
+func upgradeFiles(rootDir string, upgrade bool, version int, upgrades map[int]fileUpgrade) error {
+	var outdated []string
+	oldest := version
+	err := filepath.Walk(rootDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		// Files too small to have a version record are left to the recovery.
+		if info.IsDir() || !isVersionedFile(path) || info.Size() < 4 {
+			return nil
+		}
+		fv, err := readFileVersion(path)
+		if err != nil {
+			return err
+		}
+		// Invalid and newer versions are reported when the file is opened.
+		if fv > 0 && fv < version {
+			outdated = append(outdated, path)
+			if fv < oldest {
+				oldest = fv
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("unable to check the version of the files: %v", err)
+	}
+	if len(outdated) == 0 {
+		return nil
+	}
+	if !upgrade {
+		Noticef("%v files in %s are in version %v of the format, which must be upgraded to version %v",
+			len(outdated), rootDir, oldest, version)
+		return ErrUpgradeRequired
+	}
+	Noticef("Upgrading %v files in %s to version %v of the format", len(outdated), rootDir, version)
+	for _, path := range outdated {
+		for {
+			fv, err := readFileVersion(path)
+			if err == nil && fv < version {
+				err = upgradeFile(path, fv, upgrades[fv])
+			}
+			if err != nil {
+				return fmt.Errorf("unable to upgrade %s: %v", path, err)
+			}
+			if fv >= version {
+				break
+			}
+		}
+	}
+	Noticef("Upgraded %v files in %s", len(outdated), rootDir)
+	return nil
+}
+
+// readFileVersion returns the version record of the given file.
+func readFileVersion(path string) (int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	return util.ReadInt(file)
+}
+
+// upgradeFile upgrades the file from version `from` to the next one.
+func upgradeFile(path string, from int, upgrade fileUpgrade) error {
+	if upgrade == nil {
+		return fmt.Errorf("no upgrade from version %v", from)
+	}
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".upgrade")
+	if err != nil {
+		return err
+	}
+	tmpName := tmp.Name()
+	defer os.Remove(tmpName)
+	r := bufio.NewReader(src)
+	w := bufio.NewWriter(tmp)
+	_, err = util.ReadInt(r)
+	if err == nil {
+		err = util.WriteInt(w, from+1)
+	}
+	if err == nil {
+		err = upgrade(filepath.Base(path), r, w)
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	// Windows does not allow renaming over an opened file.
+	if cerr := src.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpName, path)
+}
@@ -0,0 +1,114 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package stores
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// versionedFiles returns the versions of the files of the store, by path.
+func versionedFiles(t *testing.T, rootDir string) map[string]int {
+	versions := make(map[string]int)
+	err := filepath.Walk(rootDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || !isVersionedFile(path) {
+			return err
+		}
+		fv, err := readFileVersion(path)
+		versions[path] = fv
+		return err
+	})
+	if err != nil {
+		stackFatalf(t, "Unable to read the versions of the files: %v", err)
+	}
+	return versions
+}
+
+func TestFSUpgradeFiles(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	fs := createDefaultFileStore(t)
+	storeMsg(t, fs, "foo", []byte("hello"))
+	storeSub(t, fs, "foo")
+	if _, _, err := fs.AddClient("me", "hbInbox", nil); err != nil {
+		t.Fatalf("Unexpected error adding client: %v", err)
+	}
+	fs.Close()
+
+	files := versionedFiles(t, defaultDataStore)
+	if len(files) == 0 {
+		t.Fatal("Expected files to be found")
+	}
+	// Files written in the current version don't need to be upgraded.
+	if err := upgradeFiles(defaultDataStore, false, fileVersion, fileUpgrades); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// Pretend that the format changed in the next version.
+	upgraded := make(map[string]int)
+	upgrades := map[int]fileUpgrade{
+		fileVersion: func(name string, r io.Reader, w io.Writer) error {
+			upgraded[name]++
+			_, err := io.Copy(w, r)
+			return err
+		},
+	}
+	if err := upgradeFiles(defaultDataStore, false, fileVersion+1, upgrades); err != ErrUpgradeRequired {
+		t.Fatalf("Expected error %v, got %v", ErrUpgradeRequired, err)
+	}
+	if len(upgraded) != 0 {
+		t.Fatalf("No file should have been upgraded, got %v", upgraded)
+	}
+	if err := upgradeFiles(defaultDataStore, true, fileVersion+1, upgrades); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for path, fv := range versionedFiles(t, defaultDataStore) {
+		if fv != fileVersion+1 {
+			t.Fatalf("File %v should have been upgraded, got version %v", path, fv)
+		}
+		if upgraded[filepath.Base(path)] == 0 {
+			t.Fatalf("File %v was not passed to the upgrade", path)
+		}
+	}
+	if after := versionedFiles(t, defaultDataStore); len(after) != len(files) {
+		t.Fatalf("Expected %v files, got %v", len(files), len(after))
+	}
+	// The content of the files is preserved by the upgrade.
+	content, err := ioutil.ReadFile(filepath.Join(defaultDataStore, "foo", "msgs.1.dat"))
+	if err != nil {
+		t.Fatalf("Unable to read message file: %v", err)
+	}
+	if len(content) <= 4 {
+		t.Fatalf("Message file should not be empty, got %v bytes", len(content))
+	}
+
+	// An upgrade path must exist for each version.
+	if err := upgradeFiles(defaultDataStore, true, fileVersion+2, upgrades); err == nil || err == ErrUpgradeRequired {
+		t.Fatalf("Expected an error for the missing upgrade, got %v", err)
+	}
+	// A failed upgrade leaves the file as it was.
+	files = versionedFiles(t, defaultDataStore)
+	failing := map[int]fileUpgrade{
+		fileVersion + 1: func(name string, r io.Reader, w io.Writer) error {
+			return errors.New("upgrade failure")
+		},
+	}
+	if err := upgradeFiles(defaultDataStore, true, fileVersion+2, failing); err == nil {
+		t.Fatal("Expected the upgrade to fail")
+	}
+	for path, fv := range versionedFiles(t, defaultDataStore) {
+		if fv != files[path] {
+			t.Fatalf("File %v should not have changed, got version %v", path, fv)
+		}
+	}
+	// No temporary file is left behind.
+	leftovers, _ := filepath.Glob(filepath.Join(defaultDataStore, "foo", "*.upgrade*"))
+	if len(leftovers) != 0 {
+		t.Fatalf("Unexpected temporary files: %v", leftovers)
+	}
+}
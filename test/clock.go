@@ -0,0 +1,117 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package test
+
+import (
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats-streaming-server/server"
+)
+
+// FakeClock is a server.Clock whose time only moves when Advance is called.
+// Set it in the server options to trigger the redelivery of unacknowledged
+// messages, or the expiration of messages, without waiting.
+//
+// The timestamps of the messages are assigned by the store from the system
+// time, so the clock should be created with time.Now() and advanced by a
+// bit more than the AckWait of a subscription to get its messages
+// redelivered.
+type FakeClock struct {
+	sync.Mutex
+	now    time.Time
+	timers []*fakeTimer // active timers, in the order they were set
+}
+
+type fakeTimer struct {
+	clock *FakeClock
+	when  time.Time
+	f     func()
+}
+
+// NewFakeClock returns a FakeClock set to the given time.
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{now: now}
+}
+
+// Now returns the time of the clock.
+func (c *FakeClock) Now() time.Time {
+	c.Lock()
+	defer c.Unlock()
+	return c.now
+}
+
+// AfterFunc returns a timer calling f when the clock is advanced past
+// the given duration.
+func (c *FakeClock) AfterFunc(d time.Duration, f func()) server.Timer {
+	t := &fakeTimer{clock: c, f: f}
+	t.Reset(d)
+	return t
+}
+
+// Advance moves the clock forward by the given duration. The timers that
+// are due, including the ones set by the timers fired in the meantime,
+// are fired in the order of their expiration, from the calling go routine,
+// with the clock set to their expiration time.
+func (c *FakeClock) Advance(d time.Duration) {
+	c.Lock()
+	end := c.now.Add(d)
+	for {
+		t := c.nextTimer(end)
+		if t == nil {
+			break
+		}
+		if t.when.After(c.now) {
+			c.now = t.when
+		}
+		c.removeTimer(t)
+		c.Unlock()
+		t.f()
+		c.Lock()
+	}
+	c.now = end
+	c.Unlock()
+}
+
+// nextTimer returns the first timer due at the given time, nil if none.
+// Clock lock held on entry.
+func (c *FakeClock) nextTimer(end time.Time) *fakeTimer {
+	var next *fakeTimer
+	for _, t := range c.timers {
+		if !t.when.After(end) && (next == nil || t.when.Before(next.when)) {
+			next = t
+		}
+	}
+	return next
+}
+
+// removeTimer removes the timer from the active ones, and returns
+// true if it was active. Clock lock held on entry.
+func (c *FakeClock) removeTimer(t *fakeTimer) bool {
+	for i, at := range c.timers {
+		if at == t {
+			c.timers = append(c.timers[:i], c.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Stop prevents the timer from firing. It returns false if the timer
+// had already fired or been stopped.
+func (t *fakeTimer) Stop() bool {
+	t.clock.Lock()
+	defer t.clock.Unlock()
+	return t.clock.removeTimer(t)
+}
+
+// Reset changes the timer to fire after the given duration from now. It
+// returns true if the timer was active.
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	t.clock.Lock()
+	defer t.clock.Unlock()
+	active := t.clock.removeTimer(t)
+	t.when = t.clock.now.Add(d)
+	t.clock.timers = append(t.clock.timers, t)
+	return active
+}
@@ -0,0 +1,153 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package test
+
+import (
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nats-io/go-nats-streaming"
+	"github.com/nats-io/nats-streaming-server/server"
+)
+
+const (
+	testClusterID = "test-cluster"
+	testPort      = 4260
+)
+
+// runTestServer starts a server, with its own NATS Server port so that
+// these tests can run along the server package tests, and connects a
+// client to it.
+func runTestServer(t *testing.T, sOpts *server.Options) (*server.StanServer, stan.Conn) {
+	sOpts.ID = testClusterID
+	nOpts := server.DefaultNatsServerOptions
+	nOpts.Port = testPort
+	s, err := server.StartServerWithOpts(sOpts, &nOpts)
+	if err != nil {
+		t.Fatalf("Unable to start server: %v", err)
+	}
+	sc, err := stan.Connect(testClusterID, "me", stan.NatsURL(fmt.Sprintf("nats://localhost:%d", testPort)))
+	if err != nil {
+		s.Shutdown()
+		t.Fatalf("Unable to connect: %v", err)
+	}
+	return s, sc
+}
+
+func TestFakeClockTimers(t *testing.T) {
+	start := time.Now()
+	c := NewFakeClock(start)
+	var fired []string
+	c.AfterFunc(2*time.Second, func() { fired = append(fired, "b") })
+	a := c.AfterFunc(time.Second, func() {
+		fired = append(fired, "a")
+		// Timers set while advancing fire if due.
+		c.AfterFunc(500*time.Millisecond, func() { fired = append(fired, "c") })
+	})
+	stopped := c.AfterFunc(time.Second, func() { fired = append(fired, "stopped") })
+	if !stopped.Stop() {
+		t.Fatal("Stop should have returned true")
+	}
+
+	c.Advance(999 * time.Millisecond)
+	if len(fired) != 0 {
+		t.Fatalf("No timer should have fired, got %v", fired)
+	}
+	c.Advance(time.Second)
+	if fmt.Sprint(fired) != "[a c]" {
+		t.Fatalf("Unexpected timers fired: %v", fired)
+	}
+	if now := c.Now(); !now.Equal(start.Add(1999 * time.Millisecond)) {
+		t.Fatalf("Unexpected time: %v", now)
+	}
+	if a.Reset(time.Second) {
+		t.Fatal("Reset of a fired timer should have returned false")
+	}
+	c.Advance(time.Second)
+	if fmt.Sprint(fired) != "[a c b a]" {
+		t.Fatalf("Unexpected timers fired: %v", fired)
+	}
+}
+
+func TestFakeClockRedelivery(t *testing.T) {
+	clock := NewFakeClock(time.Now())
+	sOpts := server.GetDefaultOptions()
+	sOpts.Clock = clock
+	s, sc := runTestServer(t, sOpts)
+	defer s.Shutdown()
+	defer sc.Close()
+
+	var delivered, redelivered int32
+	if _, err := sc.Subscribe("foo", func(m *stan.Msg) {
+		if m.Redelivered {
+			atomic.AddInt32(&redelivered, 1)
+		} else {
+			atomic.AddInt32(&delivered, 1)
+		}
+	}, stan.SetManualAckMode(), stan.AckWait(time.Second)); err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+	if err := sc.Publish("foo", []byte("hello")); err != nil {
+		t.Fatalf("Unexpected error on publish: %v", err)
+	}
+	waitFor(t, func() bool { return atomic.LoadInt32(&delivered) == 1 })
+
+	// The message is not redelivered until the clock is advanced.
+	time.Sleep(1100 * time.Millisecond)
+	if n := atomic.LoadInt32(&redelivered); n != 0 {
+		t.Fatalf("Message should not have been redelivered, got %v", n)
+	}
+	clock.Advance(2 * time.Second)
+	waitFor(t, func() bool { return atomic.LoadInt32(&redelivered) == 1 })
+}
+
+func TestFakeClockTimestamps(t *testing.T) {
+	start := time.Now().Add(-time.Hour)
+	clock := NewFakeClock(start)
+	sOpts := server.GetDefaultOptions()
+	sOpts.Clock = clock
+	sOpts.MonotonicTimestamps = true
+	s, sc := runTestServer(t, sOpts)
+	defer s.Shutdown()
+	defer sc.Close()
+
+	for i := 0; i < 2; i++ {
+		if err := sc.Publish("foo", []byte("hello")); err != nil {
+			t.Fatalf("Unexpected error on publish: %v", err)
+		}
+	}
+	clock.Advance(time.Second)
+	if err := sc.Publish("foo", []byte("hello")); err != nil {
+		t.Fatalf("Unexpected error on publish: %v", err)
+	}
+	ch := make(chan int64, 3)
+	if _, err := sc.Subscribe("foo", func(m *stan.Msg) { ch <- m.Timestamp }, stan.DeliverAllAvailable()); err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+	// The clock does not move between the first two, which get distinct
+	// timestamps nonetheless.
+	expected := []int64{start.UnixNano(), start.UnixNano() + 1, start.Add(time.Second).UnixNano()}
+	for _, e := range expected {
+		select {
+		case ts := <-ch:
+			if ts != e {
+				t.Fatalf("Expected timestamp %v, got %v", e, ts)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Did not get our message")
+		}
+	}
+}
+
+// waitFor fails the test if the condition is not met within a second.
+func waitFor(t *testing.T, cond func() bool) {
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for condition")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
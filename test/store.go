@@ -0,0 +1,284 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package test
+
+import (
+	"sync"
+	"time"
+
+	"github.com/nats-io/go-nats-streaming/pb"
+	"github.com/nats-io/nats-streaming-server/spb"
+	"github.com/nats-io/nats-streaming-server/stores"
+)
+
+// FaultStoreType is the store type of a FaultStore wrapping a memory store.
+// A server started with this store type gives access to the FaultStore
+// with StanServer.Store().
+const FaultStoreType = "FAULT"
+
+func init() {
+	stores.Register(FaultStoreType, func(config *stores.StoreConfig) (stores.Store, *stores.RecoveredState, error) {
+		ms, err := stores.NewMemoryStore(config.Limits)
+		if err != nil {
+			return nil, nil, err
+		}
+		return NewFaultStore(ms), nil, nil
+	})
+}
+
+// Op is a store operation in which a FaultStore can inject an error or
+// some latency.
+type Op int
+
+const (
+	// OpStoreMsg is the storing of messages: MsgStore.Store, StoreBatch
+	// and StoreMsg.
+	OpStoreMsg Op = iota
+	// OpLookupMsg is the lookup of messages: MsgStore.Lookup, FirstMsg,
+	// LastMsg and LastMsgForKey.
+	OpLookupMsg
+	// OpStoreSub is the storing of subscriptions: SubStore.CreateSub and
+	// UpdateSub.
+	OpStoreSub
+	// OpAddPending is SubStore.AddSeqPending.
+	OpAddPending
+	// OpAckPending is the storing of acks: SubStore.AckSeqPending,
+	// AckSeqPendingRange and AckSeqPendingBatch.
+	OpAckPending
+	// OpAddClient is Store.AddClient.
+	OpAddClient
+	// OpFlush is the Flush of the Store, MsgStore and SubStore.
+	OpFlush
+)
+
+// FaultStore wraps a Store, and the stores of its channels, to make the
+// operations fail or take longer. It is safe to change the injected
+// faults while the store is in use.
+type FaultStore struct {
+	stores.Store
+	sync.Mutex
+	errs     map[Op]error
+	latency  map[Op]time.Duration
+	channels map[string]*stores.ChannelStore
+}
+
+// NewFaultStore returns a FaultStore wrapping the given store. It does not
+// inject any fault until SetError or SetLatency is called.
+func NewFaultStore(s stores.Store) *FaultStore {
+	return &FaultStore{
+		Store:    s,
+		errs:     make(map[Op]error),
+		latency:  make(map[Op]time.Duration),
+		channels: make(map[string]*stores.ChannelStore),
+	}
+}
+
+// SetError makes the given operation fail with err, or succeed again if
+// err is nil. The failing operation is not performed on the wrapped store.
+func (fs *FaultStore) SetError(op Op, err error) {
+	fs.Lock()
+	if err == nil {
+		delete(fs.errs, op)
+	} else {
+		fs.errs[op] = err
+	}
+	fs.Unlock()
+}
+
+// SetLatency delays the given operation by d, or removes the delay if d
+// is 0.
+func (fs *FaultStore) SetLatency(op Op, d time.Duration) {
+	fs.Lock()
+	if d <= 0 {
+		delete(fs.latency, op)
+	} else {
+		fs.latency[op] = d
+	}
+	fs.Unlock()
+}
+
+// fault waits for the latency of the operation, if any, and returns its
+// injected error, if any.
+func (fs *FaultStore) fault(op Op) error {
+	fs.Lock()
+	err, d := fs.errs[op], fs.latency[op]
+	fs.Unlock()
+	if d > 0 {
+		time.Sleep(d)
+	}
+	return err
+}
+
+// wrap returns the ChannelStore with the wrapped message and subscription
+// stores of the given channel, creating it if needed.
+func (fs *FaultStore) wrap(channel string, cs *stores.ChannelStore) *stores.ChannelStore {
+	fs.Lock()
+	defer fs.Unlock()
+	if wcs := fs.channels[channel]; wcs != nil {
+		return wcs
+	}
+	wcs := &stores.ChannelStore{
+		UserData: cs.UserData,
+		Subs:     &faultSubStore{SubStore: cs.Subs, fs: fs},
+		Msgs:     &faultMsgStore{MsgStore: cs.Msgs, fs: fs},
+		Created:  cs.Created,
+	}
+	fs.channels[channel] = wcs
+	return wcs
+}
+
+// CreateChannel creates the channel in the wrapped store.
+func (fs *FaultStore) CreateChannel(channel string, userData interface{}) (*stores.ChannelStore, bool, error) {
+	cs, isNew, err := fs.Store.CreateChannel(channel, userData)
+	if cs == nil || err != nil {
+		return cs, isNew, err
+	}
+	return fs.wrap(channel, cs), isNew, nil
+}
+
+// LookupChannel looks up the channel in the wrapped store.
+func (fs *FaultStore) LookupChannel(channel string) *stores.ChannelStore {
+	cs := fs.Store.LookupChannel(channel)
+	if cs == nil {
+		return nil
+	}
+	return fs.wrap(channel, cs)
+}
+
+// AddClient adds the client to the wrapped store.
+func (fs *FaultStore) AddClient(clientID, hbInbox string, userData interface{}) (*stores.Client, bool, error) {
+	if err := fs.fault(OpAddClient); err != nil {
+		return nil, false, err
+	}
+	return fs.Store.AddClient(clientID, hbInbox, userData)
+}
+
+// Flush flushes the wrapped store.
+func (fs *FaultStore) Flush() error {
+	if err := fs.fault(OpFlush); err != nil {
+		return err
+	}
+	return fs.Store.Flush()
+}
+
+type faultMsgStore struct {
+	stores.MsgStore
+	fs *FaultStore
+}
+
+func (ms *faultMsgStore) Store(reply string, data []byte, ext *spb.MsgExt) (*pb.MsgProto, error) {
+	if err := ms.fs.fault(OpStoreMsg); err != nil {
+		return nil, err
+	}
+	return ms.MsgStore.Store(reply, data, ext)
+}
+
+func (ms *faultMsgStore) StoreBatch(msgs []*stores.BatchMsg) ([]*pb.MsgProto, error) {
+	if err := ms.fs.fault(OpStoreMsg); err != nil {
+		return nil, err
+	}
+	return ms.MsgStore.StoreBatch(msgs)
+}
+
+func (ms *faultMsgStore) StoreMsg(m *pb.MsgProto, ext *spb.MsgExt) error {
+	if err := ms.fs.fault(OpStoreMsg); err != nil {
+		return err
+	}
+	return ms.MsgStore.StoreMsg(m, ext)
+}
+
+func (ms *faultMsgStore) Lookup(seq uint64) (*pb.MsgProto, error) {
+	if err := ms.fs.fault(OpLookupMsg); err != nil {
+		return nil, err
+	}
+	return ms.MsgStore.Lookup(seq)
+}
+
+func (ms *faultMsgStore) LookupRange(first, last uint64, max int) ([]*pb.MsgProto, error) {
+	if err := ms.fs.fault(OpLookupMsg); err != nil {
+		return nil, err
+	}
+	return ms.MsgStore.LookupRange(first, last, max)
+}
+
+func (ms *faultMsgStore) FirstMsg() (*pb.MsgProto, error) {
+	if err := ms.fs.fault(OpLookupMsg); err != nil {
+		return nil, err
+	}
+	return ms.MsgStore.FirstMsg()
+}
+
+func (ms *faultMsgStore) LastMsg() (*pb.MsgProto, error) {
+	if err := ms.fs.fault(OpLookupMsg); err != nil {
+		return nil, err
+	}
+	return ms.MsgStore.LastMsg()
+}
+
+func (ms *faultMsgStore) LastMsgForKey(key string) (*pb.MsgProto, error) {
+	if err := ms.fs.fault(OpLookupMsg); err != nil {
+		return nil, err
+	}
+	return ms.MsgStore.LastMsgForKey(key)
+}
+
+func (ms *faultMsgStore) Flush() error {
+	if err := ms.fs.fault(OpFlush); err != nil {
+		return err
+	}
+	return ms.MsgStore.Flush()
+}
+
+type faultSubStore struct {
+	stores.SubStore
+	fs *FaultStore
+}
+
+func (ss *faultSubStore) CreateSub(sub *spb.SubState) error {
+	if err := ss.fs.fault(OpStoreSub); err != nil {
+		return err
+	}
+	return ss.SubStore.CreateSub(sub)
+}
+
+func (ss *faultSubStore) UpdateSub(sub *spb.SubState) error {
+	if err := ss.fs.fault(OpStoreSub); err != nil {
+		return err
+	}
+	return ss.SubStore.UpdateSub(sub)
+}
+
+func (ss *faultSubStore) AddSeqPending(subid, seqno uint64) error {
+	if err := ss.fs.fault(OpAddPending); err != nil {
+		return err
+	}
+	return ss.SubStore.AddSeqPending(subid, seqno)
+}
+
+func (ss *faultSubStore) AckSeqPending(subid, seqno uint64) error {
+	if err := ss.fs.fault(OpAckPending); err != nil {
+		return err
+	}
+	return ss.SubStore.AckSeqPending(subid, seqno)
+}
+
+func (ss *faultSubStore) AckSeqPendingRange(subid, firstSeq, lastSeq uint64) error {
+	if err := ss.fs.fault(OpAckPending); err != nil {
+		return err
+	}
+	return ss.SubStore.AckSeqPendingRange(subid, firstSeq, lastSeq)
+}
+
+func (ss *faultSubStore) AckSeqPendingBatch(subid uint64, seqnos ...uint64) error {
+	if err := ss.fs.fault(OpAckPending); err != nil {
+		return err
+	}
+	return ss.SubStore.AckSeqPendingBatch(subid, seqnos...)
+}
+
+func (ss *faultSubStore) Flush() error {
+	if err := ss.fs.fault(OpFlush); err != nil {
+		return err
+	}
+	return ss.SubStore.Flush()
+}
@@ -0,0 +1,143 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/nats-io/go-nats-streaming"
+	"github.com/nats-io/nats-streaming-server/server"
+	"github.com/nats-io/nats-streaming-server/stores"
+)
+
+func TestFaultStore(t *testing.T) {
+	sOpts := server.GetDefaultOptions()
+	sOpts.StoreType = FaultStoreType
+	s, sc := runTestServer(t, sOpts)
+	defer s.Shutdown()
+	defer sc.Close()
+
+	fs, ok := s.Store().(*FaultStore)
+	if !ok {
+		t.Fatalf("Unexpected store type: %T", s.Store())
+	}
+	if err := sc.Publish("foo", []byte("hello")); err != nil {
+		t.Fatalf("Unexpected error on publish: %v", err)
+	}
+
+	fs.SetError(OpStoreMsg, errors.New("disk full"))
+	if err := sc.Publish("foo", []byte("hello")); err == nil || err.Error() != "disk full" {
+		t.Fatalf("Expected error on publish, got %v", err)
+	}
+	fs.SetError(OpStoreMsg, nil)
+
+	fs.SetLatency(OpStoreMsg, 100*time.Millisecond)
+	start := time.Now()
+	if err := sc.Publish("foo", []byte("hello")); err != nil {
+		t.Fatalf("Unexpected error on publish: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Fatalf("Publish should have taken at least 100ms, took %v", elapsed)
+	}
+	fs.SetLatency(OpStoreMsg, 0)
+
+	if n, _, _ := fs.LookupChannel("foo").Msgs.State(); n != 2 {
+		t.Fatalf("Expected 2 messages, got %v", n)
+	}
+}
+
+func TestStoreErrorPolicyReadOnly(t *testing.T) {
+	sOpts := server.GetDefaultOptions()
+	sOpts.StoreType = FaultStoreType
+	sOpts.StoreErrorPolicy = server.StoreErrorReadOnly
+	s, sc := runTestServer(t, sOpts)
+	defer s.Shutdown()
+	defer sc.Close()
+
+	fs := s.Store().(*FaultStore)
+	if err := sc.Publish("foo", []byte("hello")); err != nil {
+		t.Fatalf("Unexpected error on publish: %v", err)
+	}
+	fs.SetError(OpStoreMsg, errors.New("disk full"))
+	if err := sc.Publish("foo", []byte("hello")); err == nil || err.Error() != "disk full" {
+		t.Fatalf("Expected error on publish, got %v", err)
+	}
+	// The server stays read-only once the store has recovered.
+	fs.SetError(OpStoreMsg, nil)
+	if err := sc.Publish("foo", []byte("hello")); err == nil || err.Error() != server.ErrReadOnly.Error() {
+		t.Fatalf("Expected error %v on publish, got %v", server.ErrReadOnly, err)
+	}
+	if h := s.Readiness(time.Now()); h.Status != server.HealthDegraded {
+		t.Fatalf("Unexpected readiness: %+v", h)
+	}
+	// Existing messages are still delivered.
+	ch := make(chan uint64, 1)
+	if _, err := sc.Subscribe("foo", func(m *stan.Msg) { ch <- m.Sequence }, stan.DeliverAllAvailable()); err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+	select {
+	case seq := <-ch:
+		if seq != 1 {
+			t.Fatalf("Unexpected sequence: %v", seq)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Did not get our message")
+	}
+}
+
+func TestStoreErrorPolicyRetry(t *testing.T) {
+	sOpts := server.GetDefaultOptions()
+	sOpts.StoreType = FaultStoreType
+	sOpts.StoreErrorPolicy = server.StoreErrorRetry
+	sOpts.StoreErrorRetries = 3
+	sOpts.StoreErrorBackoff = 50 * time.Millisecond
+	s, sc := runTestServer(t, sOpts)
+	defer s.Shutdown()
+	defer sc.Close()
+
+	// The write succeeds once the error is gone, within the retries.
+	fs := s.Store().(*FaultStore)
+	fs.SetError(OpStoreMsg, errors.New("I/O error"))
+	time.AfterFunc(75*time.Millisecond, func() { fs.SetError(OpStoreMsg, nil) })
+	if err := sc.Publish("foo", []byte("hello")); err != nil {
+		t.Fatalf("Unexpected error on publish: %v", err)
+	}
+	// Otherwise the error is returned after the retries: 50+100+200ms.
+	fs.SetError(OpStoreMsg, errors.New("I/O error"))
+	start := time.Now()
+	if err := sc.Publish("foo", []byte("hello")); err == nil || err.Error() != "I/O error" {
+		t.Fatalf("Expected error on publish, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 350*time.Millisecond {
+		t.Fatalf("Publish should have been retried for at least 350ms, took %v", elapsed)
+	}
+	fs.SetError(OpStoreMsg, nil)
+	if n, _, _ := fs.LookupChannel("foo").Msgs.State(); n != 1 {
+		t.Fatalf("Expected 1 message, got %v", n)
+	}
+}
+
+func TestStoreTimeout(t *testing.T) {
+	sOpts := server.GetDefaultOptions()
+	sOpts.StoreType = FaultStoreType
+	sOpts.StoreTimeout = 100 * time.Millisecond
+	s, sc := runTestServer(t, sOpts)
+	defer s.Shutdown()
+	defer sc.Close()
+
+	fs := s.Store().(*FaultStore)
+	fs.SetLatency(OpStoreMsg, time.Second)
+	start := time.Now()
+	if err := sc.Publish("foo", []byte("hello")); err == nil || err.Error() != stores.ErrDeadlineExceeded.Error() {
+		t.Fatalf("Expected error %v on publish, got %v", stores.ErrDeadlineExceeded, err)
+	}
+	if elapsed := time.Since(start); elapsed >= time.Second {
+		t.Fatalf("Publish should have failed after the store timeout, took %v", elapsed)
+	}
+	fs.SetLatency(OpStoreMsg, 0)
+	if err := sc.Publish("foo", []byte("hello")); err != nil {
+		t.Fatalf("Unexpected error on publish: %v", err)
+	}
+}
@@ -0,0 +1,490 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+// stan-admin sends administrative requests to a NATS Streaming server.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/nats-io/nats"
+	stand "github.com/nats-io/nats-streaming-server/server"
+	"github.com/nats-io/nats-streaming-server/spb"
+)
+
+var usageStr = `
+Usage: stan-admin [options] <command> [arguments]
+
+Options:
+    -s, --server <url>           NATS Server URL (default: nats://localhost:4222)
+    -c, --cluster_id <ID>        Cluster ID (default: test-cluster)
+    -t, --timeout <duration>     Request timeout (default: 2s)
+
+Commands:
+    clients [clientID]           List the clients, or only the given client,
+                                 with their heartbeat inbox and number of
+                                 subscriptions
+    close <clientID>             Close the client and remove its non-durable
+                                 subscriptions
+    channels [channel]           List the channels, or only the given channel,
+                                 with their creation time and messages
+    createchannel <channel>      Create the channel
+    durables [channel]           List the durable subscriptions of all channels,
+                                 or only of the given channel
+    queues [channel] [group]     List the members of the queue groups of all
+                                 channels, or only of the given channel and group
+    deldurable <channel> <clientID> <durable>
+                                 Delete the inactive durable subscription
+    rewind <channel> <clientID> <durable> <sequence|time> [keep]
+                                 Reposition the inactive durable subscription at
+                                 the given sequence, or RFC3339 time, dropping
+                                 its unacknowledged messages unless keep is given
+    exportdurable <channel> <clientID> <durable> <file>
+                                 Write the state of the inactive durable
+                                 subscription to the file
+    importdurable <file> [replace]
+                                 Create the durable subscription from the state
+                                 in the file, replacing an inactive durable with
+                                 the same name only if replace is given
+    copymsgs <channel> <target> [start] [end]
+                                 Copy the messages of the channel, from the start
+                                 to the end sequence if given, to the target
+                                 channel, keeping their timestamps
+    snapshot                     Snapshot the store, or flush all its channels,
+                                 before backing up its files
+    purge <channel> [sequence]   Remove the messages of the channel with a lower
+                                 sequence, or all of them but the last one
+    limits [channel]             Print the limits of the store, or those that
+                                 apply to the given channel
+    lameduck [timeout]           Put the server in lame duck mode, waiting up to
+                                 timeout (for instance 1m) for messages in flight
+                                 to be acknowledged before shutting down
+`
+
+// usage will print out the flag options for the tool.
+func usage() {
+	fmt.Printf("%s\n", usageStr)
+	os.Exit(0)
+}
+
+// adminConn sends administrative requests to the server.
+type adminConn struct {
+	nc        *nats.Conn
+	clusterID string
+	timeout   time.Duration
+}
+
+// adminRequest and adminResponse are implemented by the spb.Admin* messages.
+type adminRequest interface {
+	Marshal() ([]byte, error)
+}
+
+type adminResponse interface {
+	Unmarshal([]byte) error
+}
+
+// request sends the administrative `request` and decodes the reply into resp.
+func (ac *adminConn) request(request string, req adminRequest, resp adminResponse) error {
+	b, err := req.Marshal()
+	if err != nil {
+		return err
+	}
+	reply, err := ac.nc.Request(stand.AdminSubject(ac.clusterID, request), b, ac.timeout)
+	if err != nil {
+		return err
+	}
+	return resp.Unmarshal(reply.Data)
+}
+
+// commands maps a command name to its function and the minimum and maximum
+// number of arguments.
+var commands = map[string]struct {
+	minArgs int
+	maxArgs int
+	run     func(ac *adminConn, args []string) error
+}{
+	"clients":       {0, 1, listClients},
+	"close":         {1, 1, closeClient},
+	"channels":      {0, 1, listChannels},
+	"createchannel": {1, 1, createChannel},
+	"durables":      {0, 1, listDurables},
+	"queues":        {0, 2, listQueues},
+	"deldurable":    {3, 3, deleteDurable},
+	"rewind":        {4, 5, rewindDurable},
+	"exportdurable": {4, 4, exportDurable},
+	"importdurable": {1, 2, importDurable},
+	"copymsgs":      {2, 4, copyMsgs},
+	"snapshot":      {0, 0, snapshot},
+	"purge":         {1, 2, purgeChannel},
+	"limits":        {0, 1, printLimits},
+	"lameduck":      {0, 1, lameDuck},
+}
+
+func main() {
+	var (
+		url string
+		ac  adminConn
+	)
+	flag.StringVar(&url, "s", nats.DefaultURL, "NATS Server URL")
+	flag.StringVar(&url, "server", nats.DefaultURL, "NATS Server URL")
+	flag.StringVar(&ac.clusterID, "c", stand.DefaultClusterID, "Cluster ID")
+	flag.StringVar(&ac.clusterID, "cluster_id", stand.DefaultClusterID, "Cluster ID")
+	flag.DurationVar(&ac.timeout, "t", 2*time.Second, "Request timeout")
+	flag.DurationVar(&ac.timeout, "timeout", 2*time.Second, "Request timeout")
+	flag.Usage = usage
+	flag.Parse()
+
+	args := flag.Args()
+	if len(args) == 0 {
+		usage()
+	}
+	cmd, ok := commands[args[0]]
+	if !ok || len(args)-1 < cmd.minArgs || len(args)-1 > cmd.maxArgs {
+		usage()
+	}
+
+	nc, err := nats.Connect(url)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to connect to %s: %v\n", url, err)
+		os.Exit(1)
+	}
+	defer nc.Close()
+	ac.nc = nc
+
+	if err := cmd.run(&ac, args[1:]); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", args[0], err)
+		nc.Close()
+		os.Exit(1)
+	}
+}
+
+// listClients prints the clients registered with the server.
+func listClients(ac *adminConn, args []string) error {
+	req := &spb.AdminClientsRequest{}
+	if len(args) > 0 {
+		req.ClientID = args[0]
+	}
+	resp := &spb.AdminClientsResponse{}
+	if err := ac.request(stand.AdminClients, req, resp); err != nil {
+		return err
+	}
+	if resp.Error != "" {
+		return fmt.Errorf("%s", resp.Error)
+	}
+	fmt.Printf("%-30s %-40s %-13s %-25s %-15s %-10s %s\n", "CLIENT ID", "HEARTBEAT INBOX", "SUBSCRIPTIONS",
+		"CONNECTED", "USER", "VERSION", "UNREACHABLE SINCE")
+	for _, c := range resp.Clients {
+		connected, since := "", ""
+		if c.ConnectTime != 0 {
+			connected = time.Unix(0, c.ConnectTime).Format(time.RFC3339)
+		}
+		if c.UnreachableSince != 0 {
+			since = time.Unix(0, c.UnreachableSince).Format(time.RFC3339)
+		}
+		fmt.Printf("%-30s %-40s %-13d %-25s %-15s %-10s %s\n", c.ID, c.HbInbox, c.SubsCount,
+			connected, c.User, c.Version, since)
+	}
+	return nil
+}
+
+// closeClient closes the given client.
+func closeClient(ac *adminConn, args []string) error {
+	resp := &spb.AdminCloseClientResponse{}
+	if err := ac.request(stand.AdminCloseClient, &spb.AdminCloseClientRequest{ClientID: args[0]}, resp); err != nil {
+		return err
+	}
+	if resp.Error != "" {
+		return fmt.Errorf("%s", resp.Error)
+	}
+	fmt.Printf("Client %q closed\n", args[0])
+	return nil
+}
+
+// createChannel creates a channel.
+func createChannel(ac *adminConn, args []string) error {
+	resp := &spb.AdminCreateChannelResponse{}
+	if err := ac.request(stand.AdminCreateChannel, &spb.AdminCreateChannelRequest{Channel: args[0]}, resp); err != nil {
+		return err
+	}
+	if resp.Error != "" {
+		return fmt.Errorf("%s", resp.Error)
+	}
+	fmt.Printf("Channel %q created\n", args[0])
+	return nil
+}
+
+// listChannels prints the channels.
+func listChannels(ac *adminConn, args []string) error {
+	req := &spb.AdminChannelsRequest{}
+	if len(args) > 0 {
+		req.Channel = args[0]
+	}
+	resp := &spb.AdminChannelsResponse{}
+	if err := ac.request(stand.AdminChannels, req, resp); err != nil {
+		return err
+	}
+	if resp.Error != "" {
+		return fmt.Errorf("%s", resp.Error)
+	}
+	fmt.Printf("%-30s %-25s %10s %10s %10s %12s\n", "CHANNEL", "CREATED", "FIRST SEQ", "LAST SEQ", "MSGS", "BYTES")
+	for _, c := range resp.Channels {
+		created := ""
+		if c.Created != 0 {
+			created = time.Unix(0, c.Created).Format(time.RFC3339)
+		}
+		fmt.Printf("%-30s %-25s %10d %10d %10d %12d\n", c.Name, created, c.FirstSeq, c.LastSeq, c.Msgs, c.Bytes)
+	}
+	return nil
+}
+
+// listDurables prints the durable subscriptions.
+func listDurables(ac *adminConn, args []string) error {
+	req := &spb.AdminDurablesRequest{}
+	if len(args) > 0 {
+		req.Channel = args[0]
+	}
+	resp := &spb.AdminDurablesResponse{}
+	if err := ac.request(stand.AdminDurables, req, resp); err != nil {
+		return err
+	}
+	if resp.Error != "" {
+		return fmt.Errorf("%s", resp.Error)
+	}
+	fmt.Printf("%-20s %-20s %-20s %10s %10s %s\n", "CHANNEL", "CLIENT ID", "DURABLE", "LAST SENT", "PENDING", "ACTIVE")
+	for _, d := range resp.Durables {
+		fmt.Printf("%-20s %-20s %-20s %10d %10d %v\n", d.Channel, d.ClientID, d.DurableName,
+			d.LastSent, d.PendingCount, d.Active)
+	}
+	return nil
+}
+
+// listQueues prints the members of the queue groups.
+func listQueues(ac *adminConn, args []string) error {
+	req := &spb.AdminQueuesRequest{}
+	if len(args) > 0 {
+		req.Channel = args[0]
+	}
+	if len(args) > 1 {
+		req.QGroup = args[1]
+	}
+	resp := &spb.AdminQueuesResponse{}
+	if err := ac.request(stand.AdminQueues, req, resp); err != nil {
+		return err
+	}
+	if resp.Error != "" {
+		return fmt.Errorf("%s", resp.Error)
+	}
+	fmt.Printf("%-20s %-20s %-30s %10s %-25s %s\n", "CHANNEL", "QUEUE GROUP", "CLIENT ID", "PENDING", "LAST ACK", "STALLED")
+	for _, q := range resp.Members {
+		lastAck := ""
+		if q.LastAckTime != 0 {
+			lastAck = time.Unix(0, q.LastAckTime).Format(time.RFC3339)
+		}
+		fmt.Printf("%-20s %-20s %-30s %10d %-25s %v\n", q.Channel, q.QGroup, q.ClientID,
+			q.PendingCount, lastAck, q.Stalled)
+	}
+	return nil
+}
+
+// deleteDurable deletes the given durable subscription.
+func deleteDurable(ac *adminConn, args []string) error {
+	req := &spb.AdminDeleteDurableRequest{Channel: args[0], ClientID: args[1], DurableName: args[2]}
+	resp := &spb.AdminDeleteDurableResponse{}
+	if err := ac.request(stand.AdminDeleteDurable, req, resp); err != nil {
+		return err
+	}
+	if resp.Error != "" {
+		return fmt.Errorf("%s", resp.Error)
+	}
+	fmt.Printf("Durable %q of client %q on %q deleted\n", args[2], args[1], args[0])
+	return nil
+}
+
+// rewindDurable repositions the given durable subscription.
+func rewindDurable(ac *adminConn, args []string) error {
+	req := &spb.AdminRewindDurableRequest{Channel: args[0], ClientID: args[1], DurableName: args[2]}
+	if seq, err := strconv.ParseUint(args[3], 10, 64); err == nil {
+		req.StartSequence = seq
+	} else {
+		start, err := time.Parse(time.RFC3339, args[3])
+		if err != nil {
+			return fmt.Errorf("invalid sequence or time %q", args[3])
+		}
+		req.StartTime = start.UnixNano()
+	}
+	if len(args) > 4 {
+		if args[4] != "keep" {
+			return fmt.Errorf("unexpected argument %q", args[4])
+		}
+		req.KeepPending = true
+	}
+	resp := &spb.AdminRewindDurableResponse{}
+	if err := ac.request(stand.AdminRewindDurable, req, resp); err != nil {
+		return err
+	}
+	if resp.Error != "" {
+		return fmt.Errorf("%s", resp.Error)
+	}
+	fmt.Printf("Durable %q of client %q on %q rewound to sequence %d\n", args[2], args[1], args[0], resp.StartSequence)
+	return nil
+}
+
+// exportDurable writes the state of the given durable subscription to a file.
+func exportDurable(ac *adminConn, args []string) error {
+	req := &spb.AdminExportDurableRequest{Channel: args[0], ClientID: args[1], DurableName: args[2]}
+	resp := &spb.AdminExportDurableResponse{}
+	if err := ac.request(stand.AdminExportDurable, req, resp); err != nil {
+		return err
+	}
+	if resp.Error != "" {
+		return fmt.Errorf("%s", resp.Error)
+	}
+	b, err := resp.State.Marshal()
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(args[3], b, 0644); err != nil {
+		return err
+	}
+	fmt.Printf("Durable %q of client %q on %q exported to %s (last sent %d, %d pending)\n",
+		args[2], args[1], args[0], args[3], resp.State.Sub.LastSent, len(resp.State.Pending))
+	return nil
+}
+
+// importDurable creates a durable subscription from the state in a file.
+func importDurable(ac *adminConn, args []string) error {
+	b, err := ioutil.ReadFile(args[0])
+	if err != nil {
+		return err
+	}
+	req := &spb.AdminImportDurableRequest{State: &spb.AdminDurableState{}}
+	if err := req.State.Unmarshal(b); err != nil || req.State.Sub == nil {
+		return fmt.Errorf("invalid durable state in %s", args[0])
+	}
+	if len(args) > 1 {
+		if args[1] != "replace" {
+			return fmt.Errorf("unexpected argument %q", args[1])
+		}
+		req.Replace = true
+	}
+	resp := &spb.AdminImportDurableResponse{}
+	if err := ac.request(stand.AdminImportDurable, req, resp); err != nil {
+		return err
+	}
+	if resp.Error != "" {
+		return fmt.Errorf("%s", resp.Error)
+	}
+	fmt.Printf("Durable %q of client %q on %q imported\n", req.State.Sub.DurableName, req.State.ClientID, req.State.Channel)
+	return nil
+}
+
+// copyMsgs copies a range of messages of a channel to another channel.
+func copyMsgs(ac *adminConn, args []string) error {
+	req := &spb.AdminCopyMsgsRequest{Channel: args[0], Target: args[1]}
+	seqs := []*uint64{&req.StartSequence, &req.EndSequence}
+	for i, arg := range args[2:] {
+		seq, err := strconv.ParseUint(arg, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid sequence %q", arg)
+		}
+		*seqs[i] = seq
+	}
+	resp := &spb.AdminCopyMsgsResponse{}
+	if err := ac.request(stand.AdminCopyMsgs, req, resp); err != nil {
+		return err
+	}
+	if resp.Copied > 0 {
+		fmt.Printf("%d messages copied to %q, sequences %d to %d\n", resp.Copied, args[1], resp.FirstSequence, resp.LastSequence)
+	}
+	if resp.Error != "" {
+		return fmt.Errorf("%s", resp.Error)
+	}
+	if resp.Copied == 0 {
+		fmt.Println("No message to copy")
+	}
+	return nil
+}
+
+// lameDuck puts the server in lame duck mode.
+func lameDuck(ac *adminConn, args []string) error {
+	req := &spb.AdminLameDuckRequest{}
+	if len(args) > 0 {
+		timeout, err := time.ParseDuration(args[0])
+		if err != nil {
+			return err
+		}
+		req.TimeoutInSecs = int32(timeout / time.Second)
+	}
+	resp := &spb.AdminLameDuckResponse{}
+	if err := ac.request(stand.AdminLameDuck, req, resp); err != nil {
+		return err
+	}
+	if resp.Error != "" {
+		return fmt.Errorf("%s", resp.Error)
+	}
+	fmt.Println("Server in lame duck mode")
+	return nil
+}
+
+// snapshot snapshots the store, or flushes its channels.
+func snapshot(ac *adminConn, args []string) error {
+	resp := &spb.AdminSnapshotResponse{}
+	if err := ac.request(stand.AdminSnapshot, &spb.AdminSnapshotRequest{}, resp); err != nil {
+		return err
+	}
+	if resp.Error != "" {
+		return fmt.Errorf("%s", resp.Error)
+	}
+	if resp.Snapshot {
+		fmt.Printf("Store snapshotted (%d channels)\n", resp.Channels)
+	} else {
+		fmt.Printf("Store flushed (%d channels)\n", resp.Channels)
+	}
+	return nil
+}
+
+// purgeChannel removes the oldest messages of a channel.
+func purgeChannel(ac *adminConn, args []string) error {
+	req := &spb.AdminPurgeChannelRequest{Channel: args[0]}
+	if len(args) > 1 {
+		seq, err := strconv.ParseUint(args[1], 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid sequence %q", args[1])
+		}
+		req.Sequence = seq
+	}
+	resp := &spb.AdminPurgeChannelResponse{}
+	if err := ac.request(stand.AdminPurgeChannel, req, resp); err != nil {
+		return err
+	}
+	if resp.Error != "" {
+		return fmt.Errorf("%s", resp.Error)
+	}
+	fmt.Printf("%d messages removed from %q\n", resp.Purged, args[0])
+	return nil
+}
+
+// printLimits prints the limits of the store or of a channel.
+func printLimits(ac *adminConn, args []string) error {
+	req := &spb.AdminLimitsRequest{}
+	if len(args) > 0 {
+		req.Channel = args[0]
+	}
+	resp := &spb.AdminLimitsResponse{}
+	if err := ac.request(stand.AdminLimits, req, resp); err != nil {
+		return err
+	}
+	if resp.Error != "" {
+		return fmt.Errorf("%s", resp.Error)
+	}
+	fmt.Printf("Max channels: %d\n", resp.MaxChannels)
+	fmt.Printf("Max msgs:     %d\n", resp.MaxMsgs)
+	fmt.Printf("Max bytes:    %d\n", resp.MaxBytes)
+	fmt.Printf("Max age:      %v\n", time.Duration(resp.MaxAge))
+	fmt.Printf("Max subs:     %d\n", resp.MaxSubs)
+	return nil
+}
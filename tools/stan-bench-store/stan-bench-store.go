@@ -0,0 +1,353 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+// stan-bench-store runs publish, lookup and ack workloads directly against
+// a store, to compare the store types and their options.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats-streaming-server/spb"
+	"github.com/nats-io/nats-streaming-server/stores"
+)
+
+var usageStr = `
+Usage: stan-bench-store [options]
+
+Store options:
+    -store <type>                Store type (default: FILE)
+    -dir <path>                  Store directory (default: a temporary
+                                 directory, removed at the end)
+    -file_sync <bool>            Sync to disk after each write (default: true)
+    -file_group_commit <bool>    Commit the writes of concurrent publishers
+                                 together (default: false)
+    -file_buffer_size <size>     File store buffer size (default: 2MB)
+
+Workload options:
+    -channels <number>           Number of channels, each written to by its
+                                 own go routine (default: 1)
+    -msgs <number>               Number of messages per channel (default: 100000)
+    -size <bytes>                Size of the messages (default: 128)
+    -batch <number>              Messages stored per call, with StoreBatch
+                                 if more than 1 (default: 1)
+    -lookups <number>            Random lookups per channel (default: -msgs)
+    -subs <number>               Subscriptions per channel acknowledging every
+                                 message (default: 1)
+`
+
+// usage will print out the flag options for the tool.
+func usage() {
+	fmt.Printf("%s\n", usageStr)
+	os.Exit(0)
+}
+
+// benchOpts are the options of the benchmark.
+type benchOpts struct {
+	storeType string
+	dir       string
+	fileOpts  stores.FileStoreOptions
+	channels  int
+	msgs      int
+	size      int
+	batch     int
+	lookups   int
+	subs      int
+}
+
+// durations implements sort.Interface to compute the latency percentiles.
+type durations []time.Duration
+
+func (d durations) Len() int           { return len(d) }
+func (d durations) Less(i, j int) bool { return d[i] < d[j] }
+func (d durations) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
+
+// result holds the latencies of the operations of a phase.
+type result struct {
+	sync.Mutex
+	name      string
+	latencies durations
+	bytes     int64
+	elapsed   time.Duration
+}
+
+func (r *result) add(latencies durations, bytes int64) {
+	r.Lock()
+	r.latencies = append(r.latencies, latencies...)
+	r.bytes += bytes
+	r.Unlock()
+}
+
+// percentile returns the latency below which p percent of the operations are.
+func (r *result) percentile(p int) time.Duration {
+	i := len(r.latencies) * p / 100
+	if i >= len(r.latencies) {
+		i = len(r.latencies) - 1
+	}
+	return r.latencies[i]
+}
+
+func (r *result) print() {
+	if len(r.latencies) == 0 {
+		return
+	}
+	sort.Sort(r.latencies)
+	ops := len(r.latencies)
+	secs := r.elapsed.Seconds()
+	line := fmt.Sprintf("%-8s %9d ops in %-12v %10.0f ops/sec", r.name, ops, r.elapsed, float64(ops)/secs)
+	if r.bytes > 0 {
+		line += fmt.Sprintf(" %8.2f MB/sec", float64(r.bytes)/secs/(1024*1024))
+	}
+	fmt.Printf("%s  p50=%v p90=%v p99=%v max=%v\n", line,
+		r.percentile(50), r.percentile(90), r.percentile(99), r.latencies[ops-1])
+}
+
+// runPhase runs f for each channel in its own go routine, and returns the
+// latencies recorded by f.
+func runPhase(name string, opts *benchOpts, f func(channel int, r *result) error) (*result, error) {
+	r := &result{name: name}
+	errs := make(chan error, opts.channels)
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := 0; i < opts.channels; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := f(i, r); err != nil {
+				errs <- err
+			}
+		}(i)
+	}
+	wg.Wait()
+	r.elapsed = time.Since(start)
+	select {
+	case err := <-errs:
+		return nil, fmt.Errorf("%s: %v", name, err)
+	default:
+	}
+	return r, nil
+}
+
+func channelName(i int) string {
+	return fmt.Sprintf("bench.%d", i)
+}
+
+func publish(s stores.Store, opts *benchOpts) (*result, error) {
+	payload := make([]byte, opts.size)
+	return runPhase("publish", opts, func(i int, r *result) error {
+		cs, _, err := s.CreateChannel(channelName(i), nil)
+		if err != nil {
+			return err
+		}
+		latencies := make(durations, 0, opts.msgs/opts.batch+1)
+		batch := make([]*stores.BatchMsg, 0, opts.batch)
+		for sent := 0; sent < opts.msgs; {
+			n := opts.batch
+			if n > opts.msgs-sent {
+				n = opts.msgs - sent
+			}
+			start := time.Now()
+			if n == 1 {
+				_, err = cs.Msgs.Store("", payload, nil)
+			} else {
+				batch = batch[:0]
+				for j := 0; j < n; j++ {
+					batch = append(batch, &stores.BatchMsg{Data: payload})
+				}
+				_, err = cs.Msgs.StoreBatch(batch)
+			}
+			if err != nil {
+				return err
+			}
+			latencies = append(latencies, time.Since(start))
+			sent += n
+		}
+		r.add(latencies, int64(opts.msgs*opts.size))
+		return nil
+	})
+}
+
+func flush(s stores.Store) (*result, error) {
+	start := time.Now()
+	if err := s.Flush(); err != nil {
+		return nil, fmt.Errorf("flush: %v", err)
+	}
+	elapsed := time.Since(start)
+	return &result{name: "flush", latencies: durations{elapsed}, elapsed: elapsed}, nil
+}
+
+func lookup(s stores.Store, opts *benchOpts) (*result, error) {
+	return runPhase("lookup", opts, func(i int, r *result) error {
+		ms := s.LookupChannel(channelName(i)).Msgs
+		first, last := ms.FirstAndLastSequence()
+		if last == 0 {
+			return nil
+		}
+		rnd := rand.New(rand.NewSource(int64(i)))
+		latencies := make(durations, 0, opts.lookups)
+		var bytes int64
+		for j := 0; j < opts.lookups; j++ {
+			seq := first + uint64(rnd.Int63n(int64(last-first+1)))
+			start := time.Now()
+			m, err := ms.Lookup(seq)
+			if err != nil {
+				return err
+			}
+			latencies = append(latencies, time.Since(start))
+			if m != nil {
+				bytes += int64(len(m.Data))
+			}
+		}
+		r.add(latencies, bytes)
+		return nil
+	})
+}
+
+// ack adds each message as pending for the subscriptions, then acknowledges
+// them, and returns the results of both.
+func ack(s stores.Store, opts *benchOpts) (*result, *result, error) {
+	subIDs := make([][]uint64, opts.channels)
+	pending, err := runPhase("pending", opts, func(i int, r *result) error {
+		cs := s.LookupChannel(channelName(i))
+		first, last := cs.Msgs.FirstAndLastSequence()
+		latencies := make(durations, 0, opts.subs*int(last-first+1))
+		for j := 0; j < opts.subs; j++ {
+			sub := &spb.SubState{ClientID: "bench", Inbox: "inbox", AckInbox: "ack", AckWaitInSecs: 30}
+			if err := cs.Subs.CreateSub(sub); err != nil {
+				return err
+			}
+			subIDs[i] = append(subIDs[i], sub.ID)
+			for seq := first; seq <= last && seq != 0; seq++ {
+				start := time.Now()
+				if err := cs.Subs.AddSeqPending(sub.ID, seq); err != nil {
+					return err
+				}
+				latencies = append(latencies, time.Since(start))
+			}
+		}
+		r.add(latencies, 0)
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	acks, err := runPhase("ack", opts, func(i int, r *result) error {
+		cs := s.LookupChannel(channelName(i))
+		first, last := cs.Msgs.FirstAndLastSequence()
+		latencies := make(durations, 0, opts.subs*int(last-first+1))
+		for _, subID := range subIDs[i] {
+			for seq := first; seq <= last && seq != 0; seq++ {
+				start := time.Now()
+				if err := cs.Subs.AckSeqPending(subID, seq); err != nil {
+					return err
+				}
+				latencies = append(latencies, time.Since(start))
+			}
+		}
+		r.add(latencies, 0)
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return pending, acks, nil
+}
+
+func run(opts *benchOpts) error {
+	limits := stores.DefaultChannelLimits
+	limits.MaxChannels = opts.channels
+	limits.MaxNumMsgs = opts.msgs
+	limits.MaxMsgBytes = uint64(opts.msgs) * uint64(opts.size+1)
+	limits.MaxSubs = opts.subs
+	s, state, err := stores.NewStore(opts.storeType, &stores.StoreConfig{
+		Dir:           opts.dir,
+		Limits:        &limits,
+		FileStoreOpts: &opts.fileOpts,
+	})
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	if state != nil {
+		return fmt.Errorf("the store directory %q is not empty", opts.dir)
+	}
+	if err := s.Init(&spb.ServerInfo{ClusterID: "bench"}); err != nil {
+		return err
+	}
+
+	fmt.Printf("Store %s, %d channel(s), %d messages of %d bytes per channel, batches of %d, %d subscription(s) per channel\n\n",
+		s.Name(), opts.channels, opts.msgs, opts.size, opts.batch, opts.subs)
+	results := make([]*result, 0, 5)
+	r, err := publish(s, opts)
+	if err != nil {
+		return err
+	}
+	results = append(results, r)
+	if r, err = flush(s); err != nil {
+		return err
+	}
+	results = append(results, r)
+	if opts.lookups > 0 {
+		if r, err = lookup(s, opts); err != nil {
+			return err
+		}
+		results = append(results, r)
+	}
+	if opts.subs > 0 {
+		pending, acks, err := ack(s, opts)
+		if err != nil {
+			return err
+		}
+		results = append(results, pending, acks)
+	}
+	for _, r := range results {
+		r.print()
+	}
+	return nil
+}
+
+func main() {
+	opts := &benchOpts{fileOpts: stores.DefaultFileStoreOptions}
+	flag.StringVar(&opts.storeType, "store", stores.TypeFile, "Store type")
+	flag.StringVar(&opts.dir, "dir", "", "Store directory")
+	flag.BoolVar(&opts.fileOpts.DoSync, "file_sync", opts.fileOpts.DoSync, "Sync to disk after each write")
+	flag.BoolVar(&opts.fileOpts.GroupCommit, "file_group_commit", false, "Group the writes of concurrent publishers")
+	flag.IntVar(&opts.fileOpts.BufferSize, "file_buffer_size", opts.fileOpts.BufferSize, "File store buffer size")
+	flag.IntVar(&opts.channels, "channels", 1, "Number of channels")
+	flag.IntVar(&opts.msgs, "msgs", 100000, "Number of messages per channel")
+	flag.IntVar(&opts.size, "size", 128, "Size of the messages")
+	flag.IntVar(&opts.batch, "batch", 1, "Messages stored per call")
+	flag.IntVar(&opts.lookups, "lookups", -1, "Random lookups per channel")
+	flag.IntVar(&opts.subs, "subs", 1, "Subscriptions per channel")
+	flag.Usage = usage
+	flag.Parse()
+
+	if opts.channels <= 0 || opts.msgs <= 0 || opts.size < 0 || opts.batch <= 0 || opts.subs < 0 {
+		usage()
+	}
+	if opts.lookups < 0 {
+		opts.lookups = opts.msgs
+	}
+	opts.storeType = strings.ToUpper(opts.storeType)
+
+	if opts.dir == "" {
+		dir, err := ioutil.TempDir("", "stan_bench_store_")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to create the store directory: %v\n", err)
+			os.Exit(1)
+		}
+		defer os.RemoveAll(dir)
+		opts.dir = dir
+	}
+	if err := run(opts); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,348 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+// stan-kafka bridges a NATS Streaming channel and a Kafka topic, in either
+// direction, with at-least-once delivery.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/nats-io/go-nats-streaming"
+	"github.com/nats-io/nats"
+	stand "github.com/nats-io/nats-streaming-server/server"
+)
+
+var usageStr = `
+Usage: stan-kafka [options] to-kafka <channel> <topic>
+       stan-kafka [options] from-kafka <topic> <channel>
+
+Options:
+    -s, --server <url>           NATS Server URL (default: nats://localhost:4222)
+    -c, --cluster_id <ID>        Cluster ID (default: test-cluster)
+    -id, --client_id <ID>        Client ID (default: stan-kafka)
+    -b, --brokers <list>         Comma separated list of the Kafka brokers
+                                 (default: localhost:9092)
+
+to-kafka options:
+    -durable <name>              Name of the durable subscription that keeps
+                                 the position in the channel (default: stan-kafka)
+    -start_seq <sequence>        Sequence to start from the first time the
+                                 durable is created (default: first message)
+    -partition <number>          Partition of the topic to which the messages
+                                 are sent, in order (default: 0)
+    -ack_wait <duration>         Time after which a message that could not be
+                                 sent to Kafka is redelivered (default: 30s)
+
+from-kafka options:
+    -checkpoint <file>           File holding the offset of the next message
+                                 to transfer for each partition (required)
+    -checkpoint_interval <duration>
+                                 Interval at which the checkpoint file is
+                                 written (default: 1s)
+`
+
+// usage will print out the flag options for the tool.
+func usage() {
+	fmt.Printf("%s\n", usageStr)
+	os.Exit(0)
+}
+
+// bridgeOpts are the options of the bridge.
+type bridgeOpts struct {
+	url                string
+	clusterID          string
+	clientID           string
+	brokers            string
+	durable            string
+	startSeq           uint64
+	partition          int
+	ackWait            time.Duration
+	checkpoint         string
+	checkpointInterval time.Duration
+}
+
+func main() {
+	var opts bridgeOpts
+	flag.StringVar(&opts.url, "s", nats.DefaultURL, "NATS Server URL")
+	flag.StringVar(&opts.url, "server", nats.DefaultURL, "NATS Server URL")
+	flag.StringVar(&opts.clusterID, "c", stand.DefaultClusterID, "Cluster ID")
+	flag.StringVar(&opts.clusterID, "cluster_id", stand.DefaultClusterID, "Cluster ID")
+	flag.StringVar(&opts.clientID, "id", "stan-kafka", "Client ID")
+	flag.StringVar(&opts.clientID, "client_id", "stan-kafka", "Client ID")
+	flag.StringVar(&opts.brokers, "b", "localhost:9092", "Kafka brokers")
+	flag.StringVar(&opts.brokers, "brokers", "localhost:9092", "Kafka brokers")
+	flag.StringVar(&opts.durable, "durable", "stan-kafka", "Durable name")
+	flag.Uint64Var(&opts.startSeq, "start_seq", 0, "Start sequence")
+	flag.IntVar(&opts.partition, "partition", 0, "Kafka partition")
+	flag.DurationVar(&opts.ackWait, "ack_wait", 30*time.Second, "Redelivery delay")
+	flag.StringVar(&opts.checkpoint, "checkpoint", "", "Checkpoint file")
+	flag.DurationVar(&opts.checkpointInterval, "checkpoint_interval", time.Second, "Checkpoint interval")
+	flag.Usage = usage
+	flag.Parse()
+
+	args := flag.Args()
+	if len(args) != 3 {
+		usage()
+	}
+	var run func(sc stan.Conn, opts *bridgeOpts, from, to string, done chan struct{}) error
+	switch args[0] {
+	case "to-kafka":
+		run = toKafka
+	case "from-kafka":
+		if opts.checkpoint == "" {
+			usage()
+		}
+		run = fromKafka
+	default:
+		usage()
+	}
+
+	sc, err := stan.Connect(opts.clusterID, opts.clientID, stan.NatsURL(opts.url))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to connect to %s: %v\n", opts.url, err)
+		os.Exit(1)
+	}
+	done := make(chan struct{})
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigCh
+		close(done)
+	}()
+	err = run(sc, &opts, args[1], args[2], done)
+	sc.Close()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", args[0], err)
+		os.Exit(1)
+	}
+}
+
+// kafkaConfig returns the configuration of the Kafka producer and consumer.
+func kafkaConfig() *sarama.Config {
+	config := sarama.NewConfig()
+	config.ClientID = "stan-kafka"
+	// A message is acknowledged to the channel only once all the in-sync
+	// replicas have it.
+	config.Producer.RequiredAcks = sarama.WaitForAll
+	config.Producer.Return.Successes = true
+	config.Producer.Partitioner = sarama.NewManualPartitioner
+	config.Consumer.Return.Errors = true
+	return config
+}
+
+// toKafka sends the messages of the channel to the topic. The position in
+// the channel is kept by a durable subscription: a message is acknowledged
+// only once Kafka has stored it, otherwise it is redelivered after the ack
+// wait. With one message in flight, the messages are sent in the order of
+// their sequence. A message sent to Kafka whose ack is lost is sent again
+// when redelivered, so its key, the sequence of the message in the
+// channel, can be used to drop duplicates.
+func toKafka(sc stan.Conn, opts *bridgeOpts, channel, topic string, done chan struct{}) error {
+	producer, err := sarama.NewSyncProducer(strings.Split(opts.brokers, ","), kafkaConfig())
+	if err != nil {
+		return err
+	}
+	defer producer.Close()
+
+	start := stan.DeliverAllAvailable()
+	if opts.startSeq > 0 {
+		start = stan.StartAtSequence(opts.startSeq)
+	}
+	errCh := make(chan error, 1)
+	cb := func(m *stan.Msg) {
+		_, _, err := producer.SendMessage(&sarama.ProducerMessage{
+			Topic:     topic,
+			Partition: int32(opts.partition),
+			Key:       sarama.StringEncoder(strconv.FormatUint(m.Sequence, 10)),
+			Value:     sarama.ByteEncoder(m.Data),
+		})
+		if err != nil {
+			// Redelivered after the ack wait.
+			fmt.Fprintf(os.Stderr, "Unable to send message %d to %s: %v\n", m.Sequence, topic, err)
+			return
+		}
+		if err := m.Ack(); err != nil {
+			select {
+			case errCh <- err:
+			default:
+			}
+		}
+	}
+	sub, err := sc.Subscribe(channel, cb, stan.DurableName(opts.durable), start,
+		stan.SetManualAckMode(), stan.MaxInflight(1), stan.AckWait(opts.ackWait))
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Sending messages of channel %q to topic %q\n", channel, topic)
+	select {
+	case <-done:
+	case err = <-errCh:
+	}
+	// Close, not Unsubscribe, so that the durable is kept.
+	if lerr := sub.Close(); lerr != nil && err == nil {
+		err = lerr
+	}
+	return err
+}
+
+// checkpoint holds the offset of the next message to transfer for each
+// partition of the topic.
+type checkpoint struct {
+	sync.Mutex
+	file    string
+	offsets map[int32]int64
+	dirty   bool
+}
+
+// loadCheckpoint reads the checkpoint file, if it exists.
+func loadCheckpoint(file string) (*checkpoint, error) {
+	cp := &checkpoint{file: file, offsets: make(map[int32]int64)}
+	b, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return cp, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &cp.offsets); err != nil {
+		return nil, fmt.Errorf("error parsing checkpoint file %q: %v", file, err)
+	}
+	return cp, nil
+}
+
+// set records that the messages of the partition before `offset` have been
+// transferred.
+func (cp *checkpoint) set(partition int32, offset int64) {
+	cp.Lock()
+	cp.offsets[partition] = offset
+	cp.dirty = true
+	cp.Unlock()
+}
+
+// offset returns the offset to consume the partition from.
+func (cp *checkpoint) offset(partition int32) int64 {
+	cp.Lock()
+	defer cp.Unlock()
+	if offset, ok := cp.offsets[partition]; ok {
+		return offset
+	}
+	return sarama.OffsetOldest
+}
+
+// save writes the checkpoint file, if it changed, in a temporary file that
+// is then renamed, so that the file is never partially written.
+func (cp *checkpoint) save() error {
+	cp.Lock()
+	defer cp.Unlock()
+	if !cp.dirty {
+		return nil
+	}
+	b, err := json.Marshal(cp.offsets)
+	if err != nil {
+		return err
+	}
+	tmpFile, err := ioutil.TempFile(filepath.Dir(cp.file), filepath.Base(cp.file))
+	if err != nil {
+		return err
+	}
+	_, err = tmpFile.Write(b)
+	if err == nil {
+		err = tmpFile.Sync()
+	}
+	if lerr := tmpFile.Close(); lerr != nil && err == nil {
+		err = lerr
+	}
+	if err == nil {
+		err = os.Rename(tmpFile.Name(), cp.file)
+	}
+	if err != nil {
+		os.Remove(tmpFile.Name())
+		return err
+	}
+	cp.dirty = false
+	return nil
+}
+
+// fromKafka publishes the messages of all the partitions of the topic to
+// the channel. Each message is published synchronously, so the order of
+// the messages of a partition is kept, and the offset of the next message
+// is saved in the checkpoint file at regular intervals. After a restart,
+// the messages published since the last checkpoint are published again.
+func fromKafka(sc stan.Conn, opts *bridgeOpts, topic, channel string, done chan struct{}) error {
+	cp, err := loadCheckpoint(opts.checkpoint)
+	if err != nil {
+		return err
+	}
+	consumer, err := sarama.NewConsumer(strings.Split(opts.brokers, ","), kafkaConfig())
+	if err != nil {
+		return err
+	}
+	defer consumer.Close()
+	partitions, err := consumer.Partitions(topic)
+	if err != nil {
+		return err
+	}
+
+	var wg sync.WaitGroup
+	quit := make(chan struct{})
+	errCh := make(chan error, len(partitions))
+	for _, partition := range partitions {
+		pc, err := consumer.ConsumePartition(topic, partition, cp.offset(partition))
+		if err != nil {
+			close(quit)
+			wg.Wait()
+			return err
+		}
+		wg.Add(1)
+		go func(pc sarama.PartitionConsumer) {
+			defer wg.Done()
+			defer pc.Close()
+			for {
+				select {
+				case m := <-pc.Messages():
+					if err := sc.Publish(channel, m.Value); err != nil {
+						errCh <- fmt.Errorf("unable to publish message %d of partition %d: %v", m.Offset, m.Partition, err)
+						return
+					}
+					cp.set(m.Partition, m.Offset+1)
+				case err := <-pc.Errors():
+					errCh <- err
+					return
+				case <-quit:
+					return
+				}
+			}
+		}(pc)
+	}
+	fmt.Printf("Publishing messages of topic %q to channel %q\n", topic, channel)
+
+	ticker := time.NewTicker(opts.checkpointInterval)
+	defer ticker.Stop()
+	for err == nil {
+		select {
+		case <-ticker.C:
+			err = cp.save()
+		case err = <-errCh:
+		case <-done:
+			close(quit)
+			wg.Wait()
+			return cp.save()
+		}
+	}
+	close(quit)
+	wg.Wait()
+	// Keep what was transferred before the error.
+	cp.save()
+	return err
+}
@@ -0,0 +1,178 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+// stan-store exports the messages of a channel to archive files, and
+// imports them back, working directly on the store of a server that is
+// not running.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats-streaming-server/spb"
+	"github.com/nats-io/nats-streaming-server/stores"
+)
+
+var usageStr = `
+Usage: stan-store [options] export <channel> <directory>
+       stan-store [options] import <manifest> [channel]
+
+Store options:
+    -store <type>                Store type (default: FILE)
+    -dir <path>                  Store directory
+
+Export options:
+    -format <format>             Archive format: json (newline delimited JSON)
+                                 or proto (length-prefixed protobuf)
+                                 (default: json)
+    -from <time>                 Export the messages stored at or after this
+                                 time, in RFC3339 format (default: the first)
+    -to <time>                   Export the messages stored before this time,
+                                 in RFC3339 format (default: now)
+
+The export writes the messages to a data file in the directory, and then
+its manifest, a JSON file whose name is the one of the data file followed
+by .manifest.json. The import stores the messages of the archive described
+by the manifest in the channel, the archived one by default, keeping their
+sequence and timestamp.
+`
+
+// usage will print out the flag options for the tool.
+func usage() {
+	fmt.Printf("%s\n", usageStr)
+	os.Exit(0)
+}
+
+// openStore opens the store, read-only for an export if the store type
+// supports it.
+func openStore(storeType, dir string, readOnly bool) (stores.Store, error) {
+	limits := stores.DefaultChannelLimits
+	// The limits of the server don't apply to the import.
+	limits.MaxChannels = math.MaxInt32
+	limits.MaxNumMsgs = math.MaxInt32
+	limits.MaxMsgBytes = math.MaxUint64
+	fileOpts := stores.DefaultFileStoreOptions
+	fileOpts.ReadOnly = readOnly
+	s, state, err := stores.NewStore(storeType, &stores.StoreConfig{
+		Dir:           dir,
+		Limits:        &limits,
+		FileStoreOpts: &fileOpts,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if state == nil {
+		if readOnly {
+			s.Close()
+			return nil, fmt.Errorf("no store found in %q", dir)
+		}
+		if err := s.Init(&spb.ServerInfo{}); err != nil {
+			s.Close()
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// parseTime parses a time in RFC3339 format, returning `def` if empty.
+func parseTime(value string, def int64) (int64, error) {
+	if value == "" {
+		return def, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return 0, err
+	}
+	return t.UnixNano(), nil
+}
+
+func export(s stores.Store, channel, dir, format string, start, end int64) error {
+	cs := s.LookupChannel(channel)
+	if cs == nil {
+		return fmt.Errorf("channel %q not found", channel)
+	}
+	am, err := stores.ExportChannel(cs.Msgs, channel, dir, format, start, end)
+	if err != nil {
+		return err
+	}
+	if am.Count == 0 {
+		fmt.Printf("No message of channel %q in the time range\n", channel)
+		return nil
+	}
+	fmt.Printf("Exported %d messages of channel %q (sequences %d to %d) to %s\n",
+		am.Count, channel, am.FirstSeq, am.LastSeq, am.File)
+	return nil
+}
+
+func main() {
+	var (
+		storeType string
+		dir       string
+		format    string
+		from      string
+		to        string
+	)
+	flag.StringVar(&storeType, "store", stores.TypeFile, "Store type")
+	flag.StringVar(&dir, "dir", "", "Store directory")
+	flag.StringVar(&format, "format", stores.ArchiveJSON, "Archive format")
+	flag.StringVar(&from, "from", "", "Export the messages stored at or after this time")
+	flag.StringVar(&to, "to", "", "Export the messages stored before this time")
+	flag.Usage = usage
+	flag.Parse()
+
+	args := flag.Args()
+	if len(args) < 2 {
+		usage()
+	}
+	storeType = strings.ToUpper(storeType)
+
+	var err error
+	switch args[0] {
+	case "export":
+		if len(args) != 3 {
+			usage()
+		}
+		var start, end int64
+		if start, err = parseTime(from, 0); err != nil {
+			break
+		}
+		if end, err = parseTime(to, time.Now().UnixNano()); err != nil {
+			break
+		}
+		var s stores.Store
+		if s, err = openStore(storeType, dir, true); err != nil {
+			break
+		}
+		err = export(s, args[1], args[2], format, start, end)
+		s.Close()
+	case "import":
+		if len(args) > 3 {
+			usage()
+		}
+		channel := ""
+		if len(args) == 3 {
+			channel = args[2]
+		}
+		var s stores.Store
+		if s, err = openStore(storeType, dir, false); err != nil {
+			break
+		}
+		var n int
+		if n, err = stores.ImportArchive(s, args[1], channel); err == nil {
+			fmt.Printf("Imported %d messages\n", n)
+		}
+		if cerr := s.Close(); err == nil {
+			err = cerr
+		}
+	default:
+		usage()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+}
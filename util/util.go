@@ -5,6 +5,7 @@ package util
 import (
 	"encoding/binary"
 	"io"
+	"strings"
 )
 
 // ByteOrder specifies how to convert byte sequences into 16-, 32-, or 64-bit
@@ -51,3 +52,23 @@ func ReadInt(r io.Reader) (int, error) {
 	}
 	return int(ByteOrder.Uint32(bs)), nil
 }
+
+// SubjectMatches returns true if the given subject matches the given pattern.
+// The pattern can contain the NATS wildcards: '*' matches any single token,
+// while '>' matches one or more tokens and must be the last token.
+func SubjectMatches(pattern, subject string) bool {
+	pts := strings.Split(pattern, ".")
+	sts := strings.Split(subject, ".")
+	for i, pt := range pts {
+		if pt == ">" && i == len(pts)-1 {
+			return len(sts) > i
+		}
+		if i >= len(sts) {
+			return false
+		}
+		if pt != "*" && pt != sts[i] {
+			return false
+		}
+	}
+	return len(pts) == len(sts)
+}
@@ -58,3 +58,32 @@ func TestReadInt(t *testing.T) {
 		t.Fatalf("Expected to read 123, got: %v (err=%v)", v, err)
 	}
 }
+
+func TestSubjectMatches(t *testing.T) {
+	tests := []struct {
+		pattern string
+		subject string
+		match   bool
+	}{
+		{"foo", "foo", true},
+		{"foo", "bar", false},
+		{"foo", "foo.bar", false},
+		{"foo.bar", "foo", false},
+		{"foo.*", "foo.bar", true},
+		{"foo.*", "foo.bar.baz", false},
+		{"*.bar", "foo.bar", true},
+		{"*", "foo", true},
+		{"foo.>", "foo.bar", true},
+		{"foo.>", "foo.bar.baz", true},
+		{"foo.>", "foo", false},
+		{">", "foo.bar", true},
+		{"foo.*.baz", "foo.bar.baz", true},
+		{"foo.*.baz", "foo.bar.bat", false},
+	}
+	for _, test := range tests {
+		if m := SubjectMatches(test.pattern, test.subject); m != test.match {
+			t.Fatalf("Pattern %q and subject %q: expected match to be %v, got %v",
+				test.pattern, test.subject, test.match, m)
+		}
+	}
+}